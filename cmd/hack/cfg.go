@@ -1,21 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"io/ioutil"
 	"log"
 	"math/big"
-	"os"
 )
 
-func testGenCfg() {
-	args := os.Args
-	if len(args) == 4 {
-		fmt.Printf("%v\n", args[3])
-		absIntTest(args[3])
+// testGenCfg runs the analysis on the program given in args, or the built-in tests if there is none
+func testGenCfg(args []string) {
+	if len(args) == 1 {
+		fmt.Printf("%v\n", args[0])
+		absIntTest(args[0])
 		print("Finished running on program from command line.")
 		return
 	}
@@ -45,51 +50,51 @@ func testGenCfg() {
 func cfg0Test0() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x1, 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func cfg0Test1() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x2, byte(vm.PUSH1), 0x0, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func dfTest0() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x2, byte(vm.PUSH1), 0x0, 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func dfTest1() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x2, byte(vm.PUSH1), 0x0, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func dfTest2() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x2, byte(vm.PUSH1), 0x6, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func dfTest3() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 //should fail to find concrete jump
 func absIntTest1() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x1, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 //should fail to find concrete jump
 func absIntTest2() {
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = []byte{byte(vm.PUSH1), 0x0, byte(vm.JUMP), 0x0}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTest3() {
@@ -101,7 +106,14 @@ func absIntTest3() {
 		byte(vm.PUSH1), 0x0, //jump destination
 		byte(vm.JUMPI),
 		byte(vm.STOP)}
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
+}
+
+// absIntCfg runs the analysis of the contract code and prints the result, including the failures
+func absIntCfg(contract *vm.Contract) *vm.CfgAnalysisResult {
+	result, _ := vm.AbsIntCfgHarness(contract)
+	result.Render(vm.CfgFull)
+	return result
 }
 
 func absIntTest(s string) {
@@ -112,7 +124,65 @@ func absIntTest(s string) {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	result := absIntCfg(contract)
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile("cfg.json", out, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// cfgDot analyses the code with the given hash, or, if the hash is not given, the current code of the contract
+// with the given address, and writes the control flow graph into <code hash>.dot
+func cfgDot(chaindata string, codeHashHex string, address string) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	var codeHash common.Hash
+	var code []byte
+	if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		if codeHashHex != "0x00" {
+			codeHash = common.HexToHash(codeHashHex)
+		} else {
+			addr := common.HexToAddress(address)
+			var found bool
+			c := tx.Cursor(dbutils.PlainContractCodeBucket)
+			// This is a mapping of contractAddress + incarnation => CodeHash, the last incarnation is the current one
+			for k, v, err := c.Seek(addr[:]); k != nil && bytes.HasPrefix(k, addr[:]); k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				codeHash = common.BytesToHash(v)
+				found = true
+			}
+			if !found {
+				return fmt.Errorf("no code for address %x", addr)
+			}
+		}
+		var err error
+		code, err = tx.GetOne(dbutils.CodeBucket, codeHash[:])
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("code with hash %x not found", codeHash)
+	}
+
+	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
+	contract.Code = code
+	result, err := vm.AbsIntCfgHarness(contract)
+	if err != nil {
+		fmt.Printf("Analysis of %x: %v\n", codeHash, err)
+	}
+	filename := fmt.Sprintf("%x.dot", codeHash)
+	if err = ioutil.WriteFile(filename, []byte(result.Dot()), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Control flow graph written into %s\n", filename)
+	return nil
 }
 
 func absIntTestSimple00() {
@@ -132,7 +202,7 @@ func absIntTestSimple00() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestDiv00() {
@@ -152,7 +222,7 @@ func absIntTestDiv00() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestRequires00() {
@@ -173,7 +243,7 @@ func absIntTestRequires00() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestCall01() {
@@ -199,7 +269,7 @@ func absIntTestCall01() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestEcrecoverLoop02() {
@@ -223,7 +293,7 @@ func absIntTestEcrecoverLoop02() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestStorageVar03() {
@@ -246,7 +316,7 @@ func absIntTestStorageVar03() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestStaticLoop00() {
@@ -271,7 +341,7 @@ func absIntTestStaticLoop00() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestStaticLoop01() {
@@ -295,7 +365,7 @@ func absIntTestStaticLoop01() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestPrivateFunction01() {
@@ -320,7 +390,7 @@ func absIntTestPrivateFunction01() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestPrivateFunction02() {
@@ -346,7 +416,7 @@ func absIntTestPrivateFunction02() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestDepositContract() {
@@ -358,7 +428,7 @@ func absIntTestDepositContract() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 func absIntTestDepositContract2() {
@@ -370,7 +440,7 @@ func absIntTestDepositContract2() {
 
 	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
 	contract.Code = decoded
-	vm.AbsIntCfgHarness(contract)
+	absIntCfg(contract)
 }
 
 /////////////////////////////////////////////////////
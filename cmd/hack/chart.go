@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/hack/report"
+)
+
+// syncCharts draws the time of the sync and the size of the database (chart1.png), and the allocated heap and
+// the number of trie nodes (chart2.png) from the CSV files of two syncs with the columns
+// block (million), hours, database size (G), trie nodes (million), allocated heap (G)
+func syncCharts(bolt, badger string) error {
+	blocks := report.AxisSpec{Name: "Blocks, million", Format: "%.3fm", GridLines: []float64{1, 2, 3, 4, 5, 6}}
+	var days []float64
+	for h := 24.0; h <= 288; h += 24 {
+		days = append(days, h)
+	}
+	if err := report.RenderFile(report.ChartSpec{
+		XAxis:          blocks,
+		YAxis:          report.AxisSpec{Name: "Elapsed time", Format: "%d h", GridLines: days},
+		YAxisSecondary: report.AxisSpec{Format: "%d G"},
+		Series: []report.SeriesSpec{
+			{Name: "Cumulative sync time (bolt)", CSV: bolt, Y: 1, Fill: true, Color: "blue"},
+			{Name: "Cumulative sync time (badger)", CSV: badger, Y: 1, Fill: true, Color: "red"},
+			{Name: "Database size (bolt)", CSV: bolt, Y: 2, Secondary: true, Color: "black"},
+			{Name: "Database size (badger)", CSV: badger, Y: 2, Secondary: true, Color: "orange"},
+		},
+	}, "chart1.png"); err != nil {
+		return err
+	}
+	return report.RenderFile(report.ChartSpec{
+		XAxis:          blocks,
+		YAxis:          report.AxisSpec{Name: "Allocated heap", Format: "%.1f G", GridLines: days},
+		YAxisSecondary: report.AxisSpec{Format: "%.1f m"},
+		Series: []report.SeriesSpec{
+			{Name: "Allocated heap", CSV: bolt, Y: 4, Fill: true, Color: "yellow"},
+			{Name: "Trie nodes", CSV: bolt, Y: 3, Secondary: true, Color: "green"},
+		},
+	}, "chart2.png")
+}
+
+// readTrieLog parses the lines of the trie statistics starting with "Threshold:", 23 tokens each: the dust threshold
+// in wei is the token 1, the counts of the full nodes with 2 to 16 children are the tokens 5 to 19, and the count
+// of the short nodes is the token 21. Counts follow the colon
+func readTrieLog(path string) ([]float64, map[int][]float64, []float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+	var thresholds, shorts []float64
+	counts := make(map[int][]float64)
+	parse := func(token []byte) (float64, error) {
+		if i := bytes.IndexByte(token, ':'); i >= 0 {
+			token = token[i+1:]
+		}
+		return strconv.ParseFloat(string(token), 64)
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		tokens := bytes.Split(scanner.Bytes(), []byte(" "))
+		if !bytes.HasPrefix(scanner.Bytes(), []byte("Threshold:")) || len(tokens) != 23 {
+			continue
+		}
+		values := make([]float64, 0, 17)
+		for _, i := range []int{1, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 21} {
+			v, err := parse(tokens[i])
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			values = append(values, v)
+		}
+		thresholds = append(thresholds, values[0])
+		for i := 2; i <= 16; i++ {
+			counts[i] = append(counts[i], values[i-1])
+		}
+		shorts = append(shorts, values[16])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return thresholds, counts, shorts, nil
+}
+
+// trieChart draws the numbers of the short nodes (chart3.png), of the full nodes with 2 and 3 children
+// (chart4.png) and with more children (chart5.png) against the dust threshold
+func trieChart(logPath string) error {
+	thresholds, counts, shorts, err := readTrieLog(logPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d %d %d\n", len(thresholds), len(counts), len(shorts))
+	dust := report.AxisSpec{
+		Name:   "Dust threshold",
+		Format: "%d wei",
+		Ticks: []report.Tick{
+			{Value: 0.0, Label: "0"},
+			{Value: 1.0, Label: "wei"},
+			{Value: 10.0, Label: "10"},
+			{Value: 100.0, Label: "100"},
+			{Value: 1e3, Label: "1e3"},
+			{Value: 1e4, Label: "1e4"},
+			{Value: 1e5, Label: "1e5"},
+			{Value: 1e6, Label: "1e6"},
+			{Value: 1e7, Label: "1e7"},
+			{Value: 1e8, Label: "1e8"},
+			{Value: 1e9, Label: "1e9"},
+			{Value: 1e10, Label: "1e10"},
+		},
+	}
+	nodes := func(from, to int) []report.SeriesSpec {
+		var series []report.SeriesSpec
+		for i := from; i <= to; i++ {
+			series = append(series, report.SeriesSpec{Name: fmt.Sprintf("%d-nodes", i), XValues: thresholds, YValues: counts[i]})
+		}
+		return series
+	}
+	charts := []struct {
+		path   string
+		format string
+		scale  float64
+		series []report.SeriesSpec
+	}{
+		{"chart3.png", "%dm", 1e6, []report.SeriesSpec{{Name: "Short nodes", XValues: thresholds, YValues: shorts, Fill: true, Color: "blue"}}},
+		{"chart4.png", "%.2fm", 1e6, nodes(2, 3)},
+		{"chart5.png", "%.2fk", 1e3, nodes(4, 16)},
+	}
+	for _, c := range charts {
+		if err := report.RenderFile(report.ChartSpec{
+			Kind:   report.KindDistribution,
+			XAxis:  dust,
+			YAxis:  report.AxisSpec{Name: "Node count", Format: c.format, Scale: c.scale},
+			Series: c.series,
+		}, c.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chartFromSpec draws the chart described by the JSON file, see report.ChartSpec
+func chartFromSpec(specPath, out string) error {
+	spec, err := report.LoadSpec(specPath)
+	if err != nil {
+		return err
+	}
+	if err = report.RenderFile(spec, out); err != nil {
+		return err
+	}
+	fmt.Printf("Chart written to %s\n", out)
+	return nil
+}
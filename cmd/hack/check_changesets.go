@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/consensus/misc"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+const checkChangeSetsProgressFile = "checkChangeSets.progress"
+
+// checkChangeSetsProgressEvery - number of blocks after which the progress is saved
+const checkChangeSetsProgressEvery = 1000
+
+type checkChangeSetsProgress struct {
+	Next       uint64 `json:"next"`       // block to check next
+	Mismatches int    `json:"mismatches"` // blocks with mismatching change sets found so far
+}
+
+// replayBlock re-executes the block on top of the state as of the previous block, which the plain state reader takes
+// from the current state and the history, and returns the encoded account and storage change sets the execution
+// produces. Nothing is written into the database
+func replayBlock(tx ethdb.Tx, chainConfig *params.ChainConfig, chain core.ChainContext, block *types.Block) ([]byte, []byte, error) {
+	ibs := state.New(state.NewPlainDBState(tx, block.NumberU64()-1))
+	header := block.Header()
+	usedGas := new(uint64)
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(ibs)
+	}
+	noop := state.NewNoopWriter()
+	for i, txn := range block.Transactions() {
+		ibs.Prepare(txn.Hash(), block.Hash(), i)
+		if _, err := core.ApplyTransaction(chainConfig, chain, nil, gp, ibs, noop, header, txn, usedGas, vm.Config{}); err != nil {
+			return nil, nil, fmt.Errorf("tx %x failed: %w", txn.Hash(), err)
+		}
+	}
+	chain.Engine().Finalize(chainConfig, header, ibs, block.Transactions(), block.Uncles())
+
+	csw := state.NewChangeSetWriterPlain(block.NumberU64())
+	if err := ibs.CommitBlock(chainConfig.WithEIPsFlags(context.Background(), header.Number), csw); err != nil {
+		return nil, nil, fmt.Errorf("committing block %d failed: %w", block.NumberU64(), err)
+	}
+	accountChanges, err := csw.EncodeAccountChanges()
+	if err != nil {
+		return nil, nil, err
+	}
+	storageChanges, err := csw.EncodeStorageChanges()
+	if err != nil {
+		return nil, nil, err
+	}
+	return accountChanges, storageChanges, nil
+}
+
+// changeSetMismatch - the first key where the stored change set differs from the one produced by the execution
+type changeSetMismatch struct {
+	block      uint64
+	storage    bool
+	key        []byte // nil if the change sets contain the same changes, encoded differently
+	stored     []byte
+	inStored   bool
+	produced   []byte
+	inProduced bool
+}
+
+func (m *changeSetMismatch) String() string {
+	kind := "account"
+	if m.storage {
+		kind = "storage"
+	}
+	if m.key == nil {
+		return fmt.Sprintf("block %d: %s change sets have the same changes, encoded differently", m.block, kind)
+	}
+	value := func(v []byte, ok bool) string {
+		if !ok {
+			return "<missing>"
+		}
+		return fmt.Sprintf("[%x]", v)
+	}
+	return fmt.Sprintf("block %d: %s change sets differ at key %x\nstored:   %s\nproduced: %s",
+		m.block, kind, m.key, value(m.stored, m.inStored), value(m.produced, m.inProduced))
+}
+
+func changeSetPairs(storage bool, enc []byte) ([][2][]byte, error) {
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var pairs [][2][]byte
+	walker := func(k, v []byte) error {
+		pairs = append(pairs, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+		return nil
+	}
+	if storage {
+		return pairs, changeset.StorageChangeSetPlainBytes(enc).Walk(walker)
+	}
+	return pairs, changeset.AccountChangeSetPlainBytes(enc).Walk(walker)
+}
+
+// diffChangeSets returns nil if the encoded change sets are equal byte by byte
+func diffChangeSets(blockNum uint64, storage bool, stored, produced []byte) (*changeSetMismatch, error) {
+	if bytes.Equal(stored, produced) {
+		return nil, nil
+	}
+	storedPairs, err := changeSetPairs(storage, stored)
+	if err != nil {
+		return nil, fmt.Errorf("decoding stored change set of block %d: %w", blockNum, err)
+	}
+	producedPairs, err := changeSetPairs(storage, produced)
+	if err != nil {
+		return nil, err
+	}
+	m := &changeSetMismatch{block: blockNum, storage: storage}
+	for i := 0; i < len(storedPairs) || i < len(producedPairs); i++ {
+		var cmp int
+		switch {
+		case i == len(storedPairs):
+			cmp = 1
+		case i == len(producedPairs):
+			cmp = -1
+		default:
+			cmp = bytes.Compare(storedPairs[i][0], producedPairs[i][0])
+		}
+		if cmp <= 0 {
+			m.key, m.stored, m.inStored = storedPairs[i][0], storedPairs[i][1], true
+		}
+		if cmp >= 0 {
+			m.key, m.produced, m.inProduced = producedPairs[i][0], producedPairs[i][1], true
+		}
+		if cmp != 0 || !bytes.Equal(m.stored, m.produced) {
+			return m, nil
+		}
+		m.key, m.stored, m.inStored, m.produced, m.inProduced = nil, nil, false, nil, false
+	}
+	return m, nil
+}
+
+// checkBlockChangeSets replays the block and compares the change sets with the stored ones
+func checkBlockChangeSets(db ethdb.Database, chainConfig *params.ChainConfig, chain core.ChainContext, blockNum uint64) ([]*changeSetMismatch, error) {
+	hash, err := rawdb.ReadCanonicalHash(db, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	block := rawdb.ReadBlock(db, hash, blockNum)
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", blockNum)
+	}
+	block.Body().SendersToTxs(rawdb.ReadSenders(db, hash, blockNum))
+	tx := db.(ethdb.HasTx).Tx()
+	accountChanges, storageChanges, err := replayBlock(tx, chainConfig, chain, block)
+	if err != nil {
+		return nil, fmt.Errorf("replaying block %d: %w", blockNum, err)
+	}
+	var mismatches []*changeSetMismatch
+	for _, storage := range []bool{false, true} {
+		stored, err := tx.GetOne(dbutils.ChangeSetByIndexBucket(storage), dbutils.EncodeTimestamp(blockNum))
+		if err != nil {
+			return nil, err
+		}
+		produced := accountChanges
+		if storage {
+			produced = storageChanges
+		}
+		m, err := diffChangeSets(blockNum, storage, stored, produced)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+// checkChangeSets replays the blocks from `from` to `to` (the progress of the execution stage if 0) and reports
+// the change sets which differ from the stored ones into out. Unless continueOnError is set, it stops at the first
+// block with mismatching change sets. Progress is saved into the file, so that the next call resumes from it.
+// It returns the number of the blocks with mismatching change sets
+func checkChangeSets(ctx context.Context, db ethdb.Database, from, to uint64, continueOnError bool, progressPath string, out io.Writer) (int, error) {
+	var p checkChangeSetsProgress
+	if err := readJSON(progressPath, &p); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("reading progress file: %w", err)
+	}
+	if p.Next > from {
+		log.Info("Resuming the check", "block", p.Next, "mismatches", p.Mismatches)
+		from = p.Next
+	}
+	if from == 0 {
+		from = 1 // genesis is not executed
+	}
+	dbTx, err := db.Begin(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	defer dbTx.Rollback()
+	if to == 0 {
+		if to, _, err = stages.GetStageProgress(dbTx, stages.Execution); err != nil {
+			return 0, err
+		}
+	}
+	genesisHash, err := rawdb.ReadCanonicalHash(dbTx, 0)
+	if err != nil {
+		return 0, err
+	}
+	chainConfig, err := rawdb.ReadChainConfig(dbTx, genesisHash)
+	if err != nil {
+		return 0, err
+	}
+	chain := &core.TinyChainContext{}
+	chain.SetDB(dbTx)
+	chain.SetEngine(ethash.NewFaker())
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	p.Next = from
+	stopped := 0
+	for ; p.Next <= to; p.Next++ {
+		if err = common.Stopped(ctx.Done()); err != nil {
+			break
+		}
+		var mismatches []*changeSetMismatch
+		if mismatches, err = checkBlockChangeSets(dbTx, chainConfig, chain, p.Next); err != nil {
+			break
+		}
+		for _, m := range mismatches {
+			fmt.Fprintf(out, "%s\n", m)
+		}
+		if len(mismatches) > 0 {
+			if !continueOnError {
+				// the block is saved as the next one, to be checked again and counted when the check resumes
+				stopped = 1
+				err = fmt.Errorf("change sets of block %d do not match", p.Next)
+				break
+			}
+			p.Mismatches++
+		}
+		if p.Next%checkChangeSetsProgressEvery == 0 {
+			if err = writeJSON(progressPath, p); err != nil {
+				return p.Mismatches, err
+			}
+		}
+
+		select {
+		default:
+		case <-logEvery.C:
+			log.Info("Checked change sets", "block", p.Next, "mismatches", p.Mismatches)
+		}
+	}
+	if err != nil {
+		if err1 := writeJSON(progressPath, p); err1 != nil {
+			log.Warn("Saving the progress failed", "err", err1)
+		}
+		return p.Mismatches + stopped, err
+	}
+	if err = os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+		return p.Mismatches, err
+	}
+	return p.Mismatches, nil
+}
+
+func checkChangeSetsAction(ctx context.Context, chaindata string, from, to uint64, continueOnError bool) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	mismatches, err := checkChangeSets(ctx, db, from, to, continueOnError, checkChangeSetsProgressFile, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Blocks with mismatching change sets: %d\n", mismatches)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+// changeSetsFixture builds the chain where block 1 writes the storage, block 2 writes it again and self-destructs
+// the contract with storage, and block 3 transfers ether
+func changeSetsFixture(t *testing.T) *ethdb.ObjectDatabase {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	counter := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	destructible := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	recipient := common.HexToAddress("0x3000000000000000000000000000000000000003")
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: core.GenesisAlloc{
+			sender: {Balance: big.NewInt(params.Ether)},
+			// slot 0 += 1
+			counter: {Code: common.FromHex("0x600160005401600055"), Balance: common.Big0},
+			// selfdestruct(caller)
+			destructible: {Code: common.FromHex("0x33ff"), Balance: big.NewInt(10), Storage: map[common.Hash]common.Hash{
+				common.HexToHash("0x01"): common.HexToHash("0x02"),
+			}},
+		},
+	}
+	genDb := ethdb.NewMemDatabase()
+	defer genDb.Close()
+	genesis := gspec.MustCommit(genDb)
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+	blocks, _, err := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), genDb, 3, func(i int, b *core.BlockGen) {
+		var to []common.Address
+		switch i {
+		case 0:
+			to = []common.Address{counter}
+		case 1:
+			to = []common.Address{counter, destructible}
+		case 2:
+			to = []common.Address{recipient}
+		}
+		for _, address := range to {
+			tx, err := types.SignTx(types.NewTransaction(b.TxNonce(sender), address, uint256.NewInt().SetUint64(1000), 100000, uint256.NewInt(), nil), signer, key)
+			require.NoError(t, err)
+			b.AddTx(tx)
+		}
+	}, false /* intermediateHashes */)
+	require.NoError(t, err)
+
+	db := ethdb.NewMemDatabase()
+	gspec.MustCommit(db)
+	txCacher := core.NewTxSenderCacher(runtime.NumCPU())
+	bc, err := core.NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, txCacher)
+	require.NoError(t, err)
+	defer bc.Stop()
+	_, err = stagedsync.InsertBlocksInStages(db, gspec.Config, ethash.NewFaker(), blocks, bc)
+	require.NoError(t, err)
+	return db
+}
+
+func TestCheckChangeSets(t *testing.T) {
+	db := changeSetsFixture(t)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "tg-check-changesets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	progressPath := filepath.Join(dir, checkChangeSetsProgressFile)
+
+	storageChanges, err := db.Get(dbutils.PlainStorageChangeSetBucket, dbutils.EncodeTimestamp(2))
+	require.NoError(t, err)
+	require.NotEmpty(t, storageChanges)
+
+	var out bytes.Buffer
+	mismatches, err := checkChangeSets(context.Background(), db, 1, 0, false, progressPath, &out)
+	require.NoError(t, err)
+	require.Equal(t, 0, mismatches)
+	require.Empty(t, out.String())
+
+	// Corrupt the first change of the account change set of block 2
+	v, err := db.Get(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(2))
+	require.NoError(t, err)
+	cs, err := changeset.DecodeAccountsPlain(v)
+	require.NoError(t, err)
+	corrupted := cs.Changes[0].Key
+	cs.Changes[0].Value = []byte{0x01}
+	v, err = changeset.EncodeAccountsPlain(cs)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(2), v))
+
+	// Stops at the block and resumes from it
+	out.Reset()
+	mismatches, err = checkChangeSets(context.Background(), db, 1, 0, false, progressPath, &out)
+	require.Error(t, err)
+	require.Equal(t, 1, mismatches)
+	var p checkChangeSetsProgress
+	require.NoError(t, readJSON(progressPath, &p))
+	require.Equal(t, uint64(2), p.Next)
+	require.Equal(t, 0, p.Mismatches)
+	require.True(t, strings.HasPrefix(out.String(), "block 2: account change sets differ at key "+common.Bytes2Hex(corrupted)), out.String())
+	require.Contains(t, out.String(), "stored:   [01]")
+
+	out.Reset()
+	mismatches, err = checkChangeSets(context.Background(), db, 1, 0, true, progressPath, &out)
+	require.NoError(t, err)
+	require.Equal(t, 1, mismatches)
+	require.Equal(t, 1, strings.Count(out.String(), "block 2:"))
+	_, err = os.Stat(progressPath)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// codeStats aggregates the statistics of every contract code in CodeBucket, prints them,
+// and writes the opcode histogram into the CSV file
+func codeStats(chaindata string, output string) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+
+	var contracts, totalSize, pushBytes, jumpDests, truncated int
+	var maxBlockLen, selfDestructs, delegateCalls, create2s int
+	var opcodes [256]int
+	var contractsWithOpcode [256]int
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		c := tx.Cursor(dbutils.CodeBucket)
+		// This is a mapping of CodeHash => Byte code
+		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			stats := vm.CollectCodeStats(v)
+			contracts++
+			totalSize += stats.CodeSize
+			pushBytes += stats.PushBytes
+			jumpDests += stats.JumpDests
+			if stats.TruncatedPush {
+				truncated++
+			}
+			if stats.MaxBlockLen > maxBlockLen {
+				maxBlockLen = stats.MaxBlockLen
+			}
+			if stats.HasSelfDestruct {
+				selfDestructs++
+			}
+			if stats.HasDelegateCall {
+				delegateCalls++
+			}
+			if stats.HasCreate2 {
+				create2s++
+			}
+			for op, count := range stats.Opcodes {
+				opcodes[op] += count
+				if count > 0 {
+					contractsWithOpcode[op]++
+				}
+			}
+			select {
+			default:
+			case <-logEvery.C:
+				fmt.Printf("Processed %d contracts, last code hash %x\n", contracts, k)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var instructions int
+	for _, count := range opcodes {
+		instructions += count
+	}
+	fmt.Printf("Contracts: %d, code size: %d bytes, instructions: %d, push data: %d bytes\n", contracts, totalSize, instructions, pushBytes)
+	if totalSize > 0 {
+		fmt.Printf("JUMPDESTs: %d (%.2f per KB of code), longest basic block: %d instructions\n", jumpDests, float64(jumpDests)*1024/float64(totalSize), maxBlockLen)
+	}
+	fmt.Printf("Contracts with SELFDESTRUCT: %d, DELEGATECALL: %d, CREATE2: %d, truncated PUSH: %d\n", selfDestructs, delegateCalls, create2s, truncated)
+
+	ops := make([]int, 0, 256)
+	for op, count := range opcodes {
+		if count > 0 {
+			ops = append(ops, op)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return opcodes[ops[i]] > opcodes[ops[j]] })
+	fmt.Printf("%-16s %14s %8s %10s\n", "opcode", "count", "%", "contracts")
+	for _, op := range ops {
+		fmt.Printf("%-16s %14d %8.3f %10d\n", vm.OpCode(op), opcodes[op], float64(opcodes[op])*100/float64(instructions), contractsWithOpcode[op])
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err = w.Write([]string{"opcode", "count", "contracts"}); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err = w.Write([]string{vm.OpCode(op).String(), strconv.Itoa(opcodes[op]), strconv.Itoa(contractsWithOpcode[op])}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/internal/debug"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	chaindata   string
+	block       int
+	rewind      int
+	account     string
+	name        string
+	bucket      string
+	hash        string
+	jsonOutput  bool
+	exportDir   string
+	buckets     []string
+	force       bool
+	renderChart bool
+	toBlock     int
+	keepGoing   bool
+	sample      int
+	inputs      []string
+	logFile     string
+	chartSpec   string
+	chartOut    string
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func withChaindata(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&chaindata, "chaindata", "", "path to the chaindata database file")
+	must(cmd.MarkFlagDirname("chaindata"))
+	must(cmd.MarkFlagRequired("chaindata"))
+}
+
+func withBlock(cmd *cobra.Command, usage string) {
+	cmd.Flags().IntVar(&block, "block", 1, usage)
+}
+
+func withRewind(cmd *cobra.Command, usage string) {
+	cmd.Flags().IntVar(&rewind, "rewind", 1, usage)
+}
+
+func withAccount(cmd *cobra.Command, usage string) {
+	cmd.Flags().StringVar(&account, "account", "0x", usage)
+	must(cmd.MarkFlagRequired("account"))
+}
+
+func withName(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&name, "name", "", "name to add to the file names")
+}
+
+func withBucket(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&bucket, "bucket", "", "bucket in the database")
+	must(cmd.MarkFlagRequired("bucket"))
+}
+
+func withHash(cmd *cobra.Command, usage string, required bool) {
+	cmd.Flags().StringVar(&hash, "hash", "0x00", usage)
+	if required {
+		must(cmd.MarkFlagRequired("hash"))
+	}
+}
+
+func withExportDir(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&exportDir, "dir", "", "directory of the export")
+	must(cmd.MarkFlagDirname("dir"))
+	must(cmd.MarkFlagRequired("dir"))
+}
+
+func reportError(err error) {
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func rootCommand() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:   "hack",
+		Short: "hack is a collection of one-off tools to investigate and repair turbo-geth databases",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return utils.SetupCobra(cmd)
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			utils.StopDebug()
+		},
+	}
+	utils.CobraFlags(rootCmd, debug.Flags)
+	rootCmd.AddCommand(actionCommands()...)
+	return rootCmd
+}
+
+// actionCommands returns one command per action of the tool
+func actionCommands() []*cobra.Command {
+	cfgCmd := &cobra.Command{
+		Use:   "cfg [program]",
+		Short: "Runs the control flow graph analysis on the given program, or the built-in tests",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			testGenCfg(args)
+		},
+	}
+
+	scanJumpsCmd := &cobra.Command{
+		Use:   "scanJumps",
+		Short: "Collects the statistics of the jumps in the contract code into jumps<name>.csv",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(scanJumps(chaindata, fmt.Sprintf("jumps%s.csv", name)))
+		},
+	}
+	withChaindata(scanJumpsCmd)
+	withName(scanJumpsCmd)
+
+	codeStatsCmd := &cobra.Command{
+		Use:   "codeStats",
+		Short: "Collects the opcode statistics of the contract code into codeStats<name>.csv",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(codeStats(chaindata, fmt.Sprintf("codeStats%s.csv", name)))
+		},
+	}
+	withChaindata(codeStatsCmd)
+	withName(codeStatsCmd)
+
+	cfgDotCmd := &cobra.Command{
+		Use:   "cfgdot",
+		Short: "Writes the control flow graph of the contract code into <code hash>.dot",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(cfgDot(chaindata, hash, account))
+		},
+	}
+	withChaindata(cfgDotCmd)
+	withHash(cfgDotCmd, "hash of the code, takes precedence over --account", false)
+	cfgDotCmd.Flags().StringVar(&account, "account", "0x", "address of the contract to take the current code of")
+
+	bucketStatsCmd := &cobra.Command{
+		Use:   "bucketStats",
+		Short: "Prints the page and entry counts of all the buckets",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(bucketStats(chaindata))
+		},
+	}
+	withChaindata(bucketStatsCmd)
+
+	defragCmd := &cobra.Command{
+		Use:   "defrag",
+		Short: "Estimates the space taken by the data and reclaimable by copying it, per bucket",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(defrag(utils.RootContext(), chaindata, bucket, sample))
+		},
+	}
+	withChaindata(defragCmd)
+	defragCmd.Flags().StringVar(&bucket, "bucket", "", "report only this bucket")
+	defragCmd.Flags().IntVar(&sample, "sample", 0, "read this many random entries per bucket instead of all of them, estimates get confidence bounds")
+
+	replCmd := &cobra.Command{
+		Use:   "repl",
+		Short: "Opens the database read-only for interactive get, seek and count of the entries and decoding of the values",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(repl(utils.RootContext(), chaindata))
+		},
+	}
+	withChaindata(replCmd)
+
+	syncChartCmd := &cobra.Command{
+		Use:   "syncChart",
+		Short: "Draws the charts of two syncs from their CSV files into chart1.png and chart2.png",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(inputs) != 2 {
+				reportError(fmt.Errorf("expected 2 CSV files, got %d", len(inputs)))
+				return
+			}
+			reportError(syncCharts(inputs[0], inputs[1]))
+		},
+	}
+	syncChartCmd.Flags().StringSliceVar(&inputs, "csv", []string{"bolt.csv", "badger.csv"}, "CSV files of the two syncs")
+
+	trieChartCmd := &cobra.Command{
+		Use:   "trieChart",
+		Short: "Draws the counts of the trie nodes against the dust threshold from the log into chart3.png to chart5.png",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(trieChart(logFile))
+		},
+	}
+	trieChartCmd.Flags().StringVar(&logFile, "log", "dust/hack.log", "log of the trie statistics")
+
+	chartCmd := &cobra.Command{
+		Use:   "chart",
+		Short: "Draws the chart described by the JSON spec with the series from CSV files",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(chartFromSpec(chartSpec, chartOut))
+		},
+	}
+	chartCmd.Flags().StringVar(&chartSpec, "spec", "", "JSON file with the axes and the series of the chart, paths of the CSV files are relative to it")
+	must(chartCmd.MarkFlagRequired("spec"))
+	chartCmd.Flags().StringVar(&chartOut, "out", "chart.png", "PNG file to write the chart into")
+
+	testRewindCmd := &cobra.Command{
+		Use:   "testRewind",
+		Short: "Rewinds the chain and compares the state roots",
+		Run: func(cmd *cobra.Command, args []string) {
+			testRewind(chaindata, block, rewind)
+		},
+	}
+	withChaindata(testRewindCmd)
+	withBlock(testRewindCmd, "block number to rewind from")
+	withRewind(testRewindCmd, "number of blocks to rewind")
+
+	testResolveCmd := &cobra.Command{
+		Use:   "testResolve",
+		Short: "Resolves a hard-coded part of the state trie",
+		Run: func(cmd *cobra.Command, args []string) {
+			testResolve(chaindata)
+		},
+	}
+	withChaindata(testResolveCmd)
+
+	testBlockHashesCmd := &cobra.Command{
+		Use:   "testBlockHashes",
+		Short: "Searches the blocks from the given one for the one with the given state root",
+		Run: func(cmd *cobra.Command, args []string) {
+			testBlockHashes(chaindata, block, common.HexToHash(hash))
+		},
+	}
+	withChaindata(testBlockHashesCmd)
+	withBlock(testBlockHashesCmd, "block number to start the search from")
+	withHash(testBlockHashesCmd, "state root to search for", true)
+
+	compareTriesCmd := &cobra.Command{
+		Use:   "compareTries",
+		Short: "Compares the trie dumps root_<name>.txt and right_<name>.txt and prints the summary of the differences",
+		Run: func(cmd *cobra.Command, args []string) {
+			compareTries("root", "right", name, jsonOutput)
+		},
+	}
+	withName(compareTriesCmd)
+	compareTriesCmd.Flags().BoolVar(&jsonOutput, "json", false, "print the full list of the differences as JSON")
+
+	invTreeCmd := &cobra.Command{
+		Use:   "invTree",
+		Short: "Writes the differences between the trie dumps root_<name>.txt and right_<name>.txt into diff_<name>.txt",
+		Run: func(cmd *cobra.Command, args []string) {
+			invTree("root", "right", "diff", name)
+		},
+	}
+	withName(invTreeCmd)
+
+	readAccountCmd := &cobra.Command{
+		Use:   "readAccount",
+		Short: "Prints the account and its storage, and their history",
+		Run: func(cmd *cobra.Command, args []string) {
+			readAccount(chaindata, common.HexToAddress(account), uint64(block), uint64(rewind))
+		},
+	}
+	withChaindata(readAccountCmd)
+	withAccount(readAccountCmd, "address of the account")
+	withBlock(readAccountCmd, "block number to read the history from")
+	withRewind(readAccountCmd, "number of blocks of the history to read")
+
+	readPlainAccountCmd := &cobra.Command{
+		Use:   "readPlainAccount",
+		Short: "Prints the account from the plain state",
+		Run: func(cmd *cobra.Command, args []string) {
+			readPlainAccount(chaindata, common.HexToAddress(account))
+		},
+	}
+	withChaindata(readPlainAccountCmd)
+	withAccount(readPlainAccountCmd, "address of the account")
+
+	fixAccountCmd := &cobra.Command{
+		Use:   "fixAccount",
+		Short: "Overwrites the storage root of the account",
+		Run: func(cmd *cobra.Command, args []string) {
+			fixAccount(chaindata, common.HexToHash(account), common.HexToHash(hash))
+		},
+	}
+	withChaindata(fixAccountCmd)
+	withAccount(fixAccountCmd, "hash of the address of the account")
+	withHash(fixAccountCmd, "storage root to write", true)
+
+	nextIncarnationCmd := &cobra.Command{
+		Use:   "nextIncarnation",
+		Short: "Prints the incarnation of the storage of the account",
+		Run: func(cmd *cobra.Command, args []string) {
+			nextIncarnation(chaindata, common.HexToHash(account))
+		},
+	}
+	withChaindata(nextIncarnationCmd)
+	withAccount(nextIncarnationCmd, "hash of the address of the account")
+
+	dumpStorageCmd := &cobra.Command{
+		Use:   "dumpStorage",
+		Short: "Prints the storage history from the database in the default data directory",
+		Run: func(cmd *cobra.Command, args []string) {
+			dumpStorage()
+		},
+	}
+
+	currentCmd := &cobra.Command{
+		Use:   "current",
+		Short: "Prints the number of the head block",
+		Run: func(cmd *cobra.Command, args []string) {
+			printCurrentBlockNumber(chaindata)
+		},
+	}
+	withChaindata(currentCmd)
+
+	bucketCmd := &cobra.Command{
+		Use:   "bucket",
+		Short: "Writes the contents of the history bucket into bucket.txt",
+		Run: func(cmd *cobra.Command, args []string) {
+			printBucket(chaindata)
+		},
+	}
+	withChaindata(bucketCmd)
+
+	validateTxLookupsCmd := &cobra.Command{
+		Use:   "val-tx-lookup-2",
+		Short: "Checks the transaction lookup entries of all the blocks",
+		Run: func(cmd *cobra.Command, args []string) {
+			ValidateTxLookups2(chaindata)
+		},
+	}
+	withChaindata(validateTxLookupsCmd)
+
+	modiAccountsCmd := &cobra.Command{
+		Use:   "modiAccounts",
+		Short: "Prints the accounts modified in a range of blocks (disabled)",
+		Run: func(cmd *cobra.Command, args []string) {
+			getModifiedAccounts(chaindata)
+		},
+	}
+	withChaindata(modiAccountsCmd)
+
+	sliceCmd := &cobra.Command{
+		Use:   "slice",
+		Short: "Prints the records of the bucket with the given key prefix",
+		Run: func(cmd *cobra.Command, args []string) {
+			dbSlice(chaindata, bucket, common.FromHex(hash))
+		},
+	}
+	withChaindata(sliceCmd)
+	withBucket(sliceCmd)
+	withHash(sliceCmd, "key prefix", false)
+
+	getProofCmd := &cobra.Command{
+		Use:   "getProof",
+		Short: "Computes the proof of the account and checks it against the state root",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(testGetProof(chaindata, common.HexToAddress(account), rewind, false))
+		},
+	}
+	withChaindata(getProofCmd)
+	withAccount(getProofCmd, "address of the account")
+	withRewind(getProofCmd, "number of blocks to rewind the state by")
+
+	regenerateIHCmd := &cobra.Command{
+		Use:   "regenerateIH",
+		Short: "Regenerates the intermediate trie hashes",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(regenerate(chaindata))
+		},
+	}
+	withChaindata(regenerateIHCmd)
+
+	verifyRootCmd := &cobra.Command{
+		Use:   "verifyRoot",
+		Short: "Recomputes the state root at a block and localises the divergence from the header",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(verifyRoot(chaindata, uint64(block)))
+		},
+	}
+	withChaindata(verifyRootCmd)
+	withBlock(verifyRootCmd, "block number to verify the state root of")
+
+	checkHistoryCmd := &cobra.Command{
+		Use:   "checkHistory",
+		Short: "Checks the consistency of the history indices with the change sets",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(checkHistory(chaindata, uint64(block)))
+		},
+	}
+	withChaindata(checkHistoryCmd)
+	withBlock(checkHistoryCmd, "block number to start the check from")
+
+	checkChangeSetsCmd := &cobra.Command{
+		Use:   "checkChangeSets",
+		Short: "Replays the blocks and compares the change sets they produce with the stored ones",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(checkChangeSetsAction(utils.RootContext(), chaindata, uint64(block), uint64(toBlock), keepGoing))
+		},
+	}
+	withChaindata(checkChangeSetsCmd)
+	withBlock(checkChangeSetsCmd, "block number to start the check from")
+	checkChangeSetsCmd.Flags().IntVar(&toBlock, "to", 0, "block number to check up to, the progress of the execution stage if 0")
+	checkChangeSetsCmd.Flags().BoolVar(&keepGoing, "continue-on-error", false, "report all the blocks with mismatching change sets instead of stopping at the first one")
+
+	searchChangeSetCmd := &cobra.Command{
+		Use:   "searchChangeSet",
+		Short: "Searches the account change sets for the key",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(searchChangeSet(chaindata, common.FromHex(hash), uint64(block)))
+		},
+	}
+	withChaindata(searchChangeSetCmd)
+	withHash(searchChangeSetCmd, "key to search for", true)
+	withBlock(searchChangeSetCmd, "block number to start the search from")
+
+	searchStorageChangeSetCmd := &cobra.Command{
+		Use:   "searchStorageChangeSet",
+		Short: "Searches the storage change sets for the key",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(searchStorageChangeSet(chaindata, common.FromHex(hash), uint64(block)))
+		},
+	}
+	withChaindata(searchStorageChangeSetCmd)
+	withHash(searchStorageChangeSetCmd, "key to search for", true)
+	withBlock(searchStorageChangeSetCmd, "block number to start the search from")
+
+	changeSetStatsCmd := &cobra.Command{
+		Use:   "changeSetStats",
+		Short: "Prints the statistics of the change sets in a range of blocks",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(changeSetStats(chaindata, uint64(block), uint64(block)+uint64(rewind)))
+		},
+	}
+	withChaindata(changeSetStatsCmd)
+	withBlock(changeSetStatsCmd, "first block of the range")
+	withRewind(changeSetStatsCmd, "number of blocks in the range")
+
+	supplyCmd := &cobra.Command{
+		Use:   "supply",
+		Short: "Writes the supply of ether after every block, with the block and uncle rewards, into supply.csv",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(supply(chaindata, uint64(block), renderChart))
+		},
+	}
+	withChaindata(supplyCmd)
+	withBlock(supplyCmd, "block number to reconstruct the supply history down to")
+	supplyCmd.Flags().BoolVar(&renderChart, "chart", false, "render the supply history into supply.png")
+
+	extractCodeCmd := &cobra.Command{
+		Use:   "extractCode",
+		Short: "Copies the contract code into the database in ./codes",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(extractCode(chaindata))
+		},
+	}
+	withChaindata(extractCodeCmd)
+
+	iterateOverCodeCmd := &cobra.Command{
+		Use:   "iterateOverCode",
+		Short: "Prints the total sizes of the contract code and its keys",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(iterateOverCode(chaindata))
+		},
+	}
+	withChaindata(iterateOverCodeCmd)
+
+	mintCmd := &cobra.Command{
+		Use:   "mint",
+		Short: "Writes the ether minted in each block into mint.csv",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(mint(chaindata, uint64(block)))
+		},
+	}
+	withChaindata(mintCmd)
+	withBlock(mintCmd, "block number to start from")
+
+	zstdCmd := &cobra.Command{
+		Use:   "zstd",
+		Short: "Measures the compression of the receipts with zstd dictionaries",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(zstd(chaindata))
+		},
+	}
+	withChaindata(zstdCmd)
+
+	benchRlpCmd := &cobra.Command{
+		Use:   "benchRlp",
+		Short: "Compares the sizes and the encoding speed of the receipts in RLP and CBOR",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(benchRlp(chaindata))
+		},
+	}
+	withChaindata(benchRlpCmd)
+
+	extractHeadersCmd := &cobra.Command{
+		Use:   "extractHeaders",
+		Short: "Writes the hard-coded headers up to the block into hard-coded-headers.dat",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(extracHeaders(chaindata, uint64(block)))
+		},
+	}
+	withChaindata(extractHeadersCmd)
+	withBlock(extractHeadersCmd, "last block number to extract")
+
+	receiptSizesCmd := &cobra.Command{
+		Use:   "receiptSizes",
+		Short: "Prints the distribution of the receipt sizes",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(receiptSizes(chaindata))
+		},
+	}
+	withChaindata(receiptSizesCmd)
+
+	compactBitmapsCmd := &cobra.Command{
+		Use:   "compactBitmaps",
+		Short: "Compacts the bitmaps of the bucket",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(compactBitmaps(chaindata, bucket))
+		},
+	}
+	withChaindata(compactBitmapsCmd)
+	withBucket(compactBitmapsCmd)
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Exports the buckets into the chunk files portable between machines",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(exportDb(utils.RootContext(), chaindata, exportDir, buckets))
+		},
+	}
+	withChaindata(exportCmd)
+	withExportDir(exportCmd)
+	exportCmd.Flags().StringSliceVar(&buckets, "buckets", defaultExportBuckets, "buckets to export")
+
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Imports the buckets exported by the export command",
+		Run: func(cmd *cobra.Command, args []string) {
+			reportError(importDb(utils.RootContext(), chaindata, exportDir, force))
+		},
+	}
+	withChaindata(importCmd)
+	withExportDir(importCmd)
+	importCmd.Flags().BoolVar(&force, "force", false, "clear the buckets which are not empty instead of refusing to import")
+
+	return []*cobra.Command{
+		cfgCmd, scanJumpsCmd, codeStatsCmd, cfgDotCmd, bucketStatsCmd, defragCmd, replCmd, syncChartCmd, trieChartCmd, chartCmd, testRewindCmd, testResolveCmd,
+		testBlockHashesCmd, compareTriesCmd, invTreeCmd, readAccountCmd, readPlainAccountCmd, fixAccountCmd,
+		nextIncarnationCmd, dumpStorageCmd, currentCmd, bucketCmd, validateTxLookupsCmd, modiAccountsCmd, sliceCmd,
+		getProofCmd, regenerateIHCmd, verifyRootCmd, checkHistoryCmd, checkChangeSetsCmd, searchChangeSetCmd, searchStorageChangeSetCmd,
+		changeSetStatsCmd, supplyCmd, extractCodeCmd, iterateOverCodeCmd, mintCmd, zstdCmd, benchRlpCmd,
+		extractHeadersCmd, receiptSizesCmd, compactBitmapsCmd, exportCmd, importCmd,
+	}
+}
+
+// isLegacyInvocation tells whether the tool is invoked the old way, with the -action flag
+func isLegacyInvocation(args []string) bool {
+	for _, arg := range args {
+		if arg == "-action" || arg == "--action" || strings.HasPrefix(arg, "-action=") || strings.HasPrefix(arg, "--action=") {
+			return true
+		}
+	}
+	return false
+}
+
+// runLegacyAction supports the `hack -action <action>` invocation with the flags shared by all the actions.
+// Deprecated: it is going to be removed in the next release, use `hack <action>` instead
+func runLegacyAction(rootCmd *cobra.Command, args []string) error {
+	fs := flag.NewFlagSet("hack", flag.ContinueOnError)
+	action := fs.String("action", "", "action to execute")
+	verbosity := fs.Uint("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail (default 3)")
+	cpuprofile := fs.String("cpuprofile", "", "write cpu profile `file`")
+	fs.IntVar(&rewind, "rewind", 1, "rewind to given number of blocks")
+	fs.IntVar(&block, "block", 1, "specifies a block number for operation")
+	fs.StringVar(&account, "account", "0x", "specifies account to investigate")
+	fs.StringVar(&name, "name", "", "name to add to the file names")
+	fs.StringVar(&chaindata, "chaindata", "chaindata", "path to the chaindata database file")
+	fs.StringVar(&bucket, "bucket", "", "bucket in the database")
+	fs.StringVar(&hash, "hash", "0x00", "image for preimage or state root for testBlockHashes action")
+	fs.BoolVar(&jsonOutput, "json", false, "print the full output of compareTries action as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "hack -action is deprecated, use `hack %s` instead\n", *action)
+
+	log.SetupDefaultTerminalLogger(log.Lvl(*verbosity), "", "")
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			return fmt.Errorf("could not create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("could not start CPU profile: %w", err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+	for _, cmd := range rootCmd.Commands() {
+		if cmd.Name() == *action {
+			cmd.Run(cmd, fs.Args())
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q", *action)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func requiredFlags(cmd *cobra.Command) []string {
+	var required []string
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if len(f.Annotations[cobra.BashCompOneRequiredFlag]) > 0 {
+			required = append(required, f.Name)
+		}
+	})
+	sort.Strings(required)
+	return required
+}
+
+func TestActionCommandsParseFlags(t *testing.T) {
+	seen := make(map[string]struct{})
+	for _, cmd := range rootCommand().Commands() {
+		_, duplicate := seen[cmd.Name()]
+		require.False(t, duplicate, "duplicate command %s", cmd.Name())
+		seen[cmd.Name()] = struct{}{}
+		require.NotEmpty(t, cmd.Short, "command %s has no description", cmd.Name())
+
+		var args []string
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.DefValue))
+		})
+		require.NoError(t, cmd.ParseFlags(args), "command %s", cmd.Name())
+	}
+	for _, name := range []string{"searchStorageChangeSet", "compareTries", "regenerateIH", "cfgdot"} {
+		_, ok := seen[name]
+		require.True(t, ok, "command %s is missing", name)
+	}
+}
+
+func TestActionCommandsRequiredFlags(t *testing.T) {
+	for _, cmd := range rootCommand().Commands() {
+		required := requiredFlags(cmd)
+		if len(required) == 0 {
+			// Without the required flags the command would run
+			continue
+		}
+		rootCmd := rootCommand()
+		rootCmd.SetArgs([]string{cmd.Name()})
+		rootCmd.SetOut(ioutil.Discard)
+		rootCmd.SetErr(ioutil.Discard)
+		err := rootCmd.Execute()
+		require.Error(t, err, "command %s", cmd.Name())
+		require.True(t, strings.HasPrefix(err.Error(), "required flag(s)"), "command %s: %v", cmd.Name(), err)
+		for _, name := range required {
+			require.Contains(t, err.Error(), fmt.Sprintf("%q", name), "command %s", cmd.Name())
+		}
+	}
+}
+
+func TestLegacyInvocation(t *testing.T) {
+	require.True(t, isLegacyInvocation([]string{"-action", "current", "-chaindata", "x"}))
+	require.True(t, isLegacyInvocation([]string{"--action=current"}))
+	require.False(t, isLegacyInvocation([]string{"current", "--chaindata", "x"}))
+
+	err := runLegacyAction(rootCommand(), []string{"-action", "noSuchAction"})
+	require.EqualError(t, err, `unknown action "noSuchAction"`)
+}
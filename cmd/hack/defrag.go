@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Layout of LMDB pages, see mdb.c: page header, header of the node (entry) and its offset in the page
+const (
+	lmdbPageHeader = 16
+	lmdbNodeHeader = 8
+	lmdbNodeOffset = 2
+	lmdbPgnoSize   = 8 // leaf node of the value in overflow pages holds the page number instead
+)
+
+// defragConfidence - z-score of the 99% confidence bounds of the sampled estimates
+const defragConfidence = 2.576
+
+// entrySizes accumulates sizes of the entries: logical ones, and the space they take in the packed pages
+type entrySizes struct {
+	n             uint64
+	sum, sumSq    float64 // of key+value lengths
+	leafBytes     uint64
+	overflowPages uint64
+}
+
+func (s *entrySizes) add(pageSize int, k, v []byte) {
+	size := float64(len(k) + len(v))
+	s.n++
+	s.sum += size
+	s.sumSq += size * size
+	// me_nodemax of mdb.c - bigger entries keep the value in overflow pages
+	// nodes are aligned to 2 bytes
+	nodeMax := ((pageSize-lmdbPageHeader)/2)&^1 - lmdbNodeOffset
+	if node := lmdbNodeHeader + len(k) + len(v); node <= nodeMax {
+		s.leafBytes += uint64((node+1)&^1 + lmdbNodeOffset)
+		return
+	}
+	s.leafBytes += uint64((lmdbNodeHeader+len(k)+lmdbPgnoSize+1)&^1 + lmdbNodeOffset)
+	s.overflowPages += uint64((len(v) + lmdbPageHeader + pageSize - 1) / pageSize)
+}
+
+// bucketUsage - how much of the pages of the bucket is taken by the data
+type bucketUsage struct {
+	bucket        string
+	entries       uint64
+	sampled       bool
+	logical       float64 // bytes of the keys and values
+	logicalLow    float64 // confidence bounds of the sampled estimate, equal to logical after the full scan
+	logicalHigh   float64
+	pageBytes     uint64
+	overflowBytes uint64
+	packedBytes   float64 // bytes of leaf and overflow pages if the leaf pages were filled up
+}
+
+// reclaimable - estimate of the space a copy loading the entries in key order would free. Branch pages are not
+// counted: they shrink together with the leaf pages, but the copy still needs some
+func (u *bucketUsage) reclaimable() float64 {
+	return math.Max(0, float64(u.pageBytes)-u.packedBytes)
+}
+
+func (u *bucketUsage) overflowShare() float64 {
+	if u.pageBytes == 0 {
+		return 0
+	}
+	return float64(u.overflowBytes) / float64(u.pageBytes)
+}
+
+func newBucketUsage(bucket string, st *ethdb.BucketStat, s *entrySizes, pageSize int) *bucketUsage {
+	u := &bucketUsage{
+		bucket:        bucket,
+		entries:       st.Entries,
+		sampled:       s.n < st.Entries,
+		pageBytes:     st.Size,
+		overflowBytes: st.OverflowPages * uint64(pageSize),
+	}
+	if s.n == 0 {
+		return u
+	}
+	scale := float64(st.Entries) / float64(s.n)
+	n := float64(s.n)
+	mean := s.sum / n
+	u.logical = s.sum
+	if u.sampled {
+		u.logical = mean * float64(st.Entries)
+	}
+	u.logicalLow, u.logicalHigh = u.logical, u.logical
+	if u.sampled && s.n > 1 {
+		variance := math.Max(0, (s.sumSq-n*mean*mean)/(n-1))
+		margin := defragConfidence * math.Sqrt(variance/n) * float64(st.Entries)
+		u.logicalLow, u.logicalHigh = math.Max(0, u.logical-margin), u.logical+margin
+	}
+	leafPages := math.Ceil(float64(s.leafBytes) * scale / float64(pageSize-lmdbPageHeader))
+	u.packedBytes = (leafPages + float64(s.overflowPages)*scale) * float64(pageSize)
+	return u
+}
+
+// sampleEntries reads n entries at random keys between the first and the last key of the bucket. Keys are drawn
+// uniformly from the 8 bytes following the common prefix of the first and the last key, and the entry at or after
+// the key is taken, so the bounds of the estimates hold when the keys are spread evenly
+func sampleEntries(c ethdb.Cursor, n int, rnd *rand.Rand, f func(k, v []byte)) error {
+	first, _, err := c.First()
+	if err != nil || first == nil {
+		return err
+	}
+	first = common.CopyBytes(first)
+	last, _, err := c.Last()
+	if err != nil {
+		return err
+	}
+	prefix := 0
+	for prefix < len(first) && prefix < len(last) && first[prefix] == last[prefix] {
+		prefix++
+	}
+	window := func(key []byte) uint64 {
+		var w [8]byte
+		if prefix < len(key) {
+			copy(w[:], key[prefix:])
+		}
+		return binary.BigEndian.Uint64(w[:])
+	}
+	lo, hi := window(first), window(last)
+	seek := make([]byte, prefix+8)
+	copy(seek, first[:prefix])
+	for i := 0; i < n; i++ {
+		r := rnd.Uint64()
+		if hi-lo < math.MaxUint64 {
+			r %= hi - lo + 1
+		}
+		binary.BigEndian.PutUint64(seek[prefix:], lo+r)
+		k, v, err := c.Seek(seek)
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			if k, v, err = c.Last(); err != nil {
+				return err
+			}
+		}
+		f(k, v)
+	}
+	return nil
+}
+
+// defragReport estimates the usage of the pages of the buckets, all existing ones or only the given bucket.
+// If sample is not 0 and the bucket has more entries, only sample random entries of it are read.
+// Buckets are sorted by the reclaimable space, descending
+func defragReport(ctx context.Context, kv ethdb.KV, only string, sample int, rnd *rand.Rand) ([]*bucketUsage, error) {
+	var usages []*bucketUsage
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	if err := kv.View(ctx, func(tx ethdb.Tx) error {
+		buckets := []string{only}
+		if only == "" {
+			var err error
+			if buckets, err = tx.(ethdb.BucketMigrator).ExistingBuckets(); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range buckets {
+			st, err := tx.BucketStat(bucket)
+			if err != nil {
+				return fmt.Errorf("bucket %s: %w", bucket, err)
+			}
+			pageSize := os.Getpagesize()
+			if pages := st.BranchPages + st.LeafPages + st.OverflowPages; pages > 0 {
+				pageSize = int(st.Size / pages)
+			}
+			var s entrySizes
+			add := func(k, v []byte) {
+				s.add(pageSize, k, v)
+			}
+			c := tx.Cursor(bucket)
+			if sample > 0 && uint64(sample) < st.Entries {
+				err = sampleEntries(c, sample, rnd, add)
+			} else {
+				err = ethdb.ForEachPrefetched(c, 1000, func(k, v []byte) (bool, error) {
+					add(k, v)
+					select {
+					default:
+					case <-logEvery.C:
+						fmt.Printf("Scanning %s, entries: %d\n", bucket, s.n)
+					}
+					return true, nil
+				})
+			}
+			c.Close()
+			if err != nil {
+				return fmt.Errorf("bucket %s: %w", bucket, err)
+			}
+			usages = append(usages, newBucketUsage(bucket, st, &s, pageSize))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].reclaimable() > usages[j].reclaimable()
+	})
+	return usages, nil
+}
+
+func printDefragReport(w io.Writer, usages []*bucketUsage) error {
+	hr := func(bytes float64) string {
+		return datasize.ByteSize(bytes).HR()
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "bucket\tentries\tlogical\tpages\toverflow\treclaimable\t\n")
+	var logical, low, high, pages, reclaimable float64
+	for _, u := range usages {
+		logicalStr := hr(u.logical)
+		if u.sampled {
+			logicalStr = fmt.Sprintf("%s (%s..%s)", logicalStr, hr(u.logicalLow), hr(u.logicalHigh))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%.1f%%\t%s\t\n", u.bucket, u.entries, logicalStr, hr(float64(u.pageBytes)),
+			100*u.overflowShare(), hr(u.reclaimable()))
+		logical += u.logical
+		low += u.logicalLow
+		high += u.logicalHigh
+		pages += float64(u.pageBytes)
+		reclaimable += u.reclaimable()
+	}
+	total := hr(logical)
+	if low != high {
+		total = fmt.Sprintf("%s (%s..%s)", total, hr(low), hr(high))
+	}
+	fmt.Fprintf(tw, "total\t\t%s\t%s\t\t%s\t\n", total, hr(pages), hr(reclaimable))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if logical > 0 {
+		fmt.Fprintf(w, "Pages take %.2fx of the logical size\n", pages/logical)
+	}
+	return nil
+}
+
+func defrag(ctx context.Context, chaindata, only string, sample int) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	usages, err := defragReport(ctx, db.KV(), only, sample, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		return err
+	}
+	return printDefragReport(os.Stdout, usages)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// defragFixture fills three buckets: CodeBucket is fragmented by the inserts in random order followed by
+// the deletion of every other entry, BlockBodyPrefix is appended in key order, values of HeaderPrefix go
+// to overflow pages
+func defragFixture(t *testing.T) *ethdb.ObjectDatabase {
+	db := ethdb.NewMemDatabase()
+	value := func(i uint64) []byte {
+		return make([]byte, 100+i%150)
+	}
+	require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		c := tx.Cursor(dbutils.CodeBucket)
+		for _, i := range rand.New(rand.NewSource(1)).Perm(4000) {
+			if err := c.Put(dbutils.EncodeBlockNumber(uint64(i)), value(uint64(i))); err != nil {
+				return err
+			}
+		}
+		for i := uint64(1); i < 4000; i += 2 {
+			if err := c.Delete(dbutils.EncodeBlockNumber(i)); err != nil {
+				return err
+			}
+		}
+		c = tx.Cursor(dbutils.BlockBodyPrefix)
+		for i := uint64(0); i < 2000; i++ {
+			if err := c.Append(dbutils.EncodeBlockNumber(i), value(i)); err != nil {
+				return err
+			}
+		}
+		c = tx.Cursor(dbutils.HeaderPrefix)
+		for i := uint64(0); i < 20; i++ {
+			if err := c.Put(dbutils.EncodeBlockNumber(i), make([]byte, 10_000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return db
+}
+
+func usageOf(t *testing.T, usages []*bucketUsage, bucket string) *bucketUsage {
+	for _, u := range usages {
+		if u.bucket == bucket {
+			return u
+		}
+	}
+	t.Fatalf("bucket %s is not in the report", bucket)
+	return nil
+}
+
+func TestDefragReport(t *testing.T) {
+	db := defragFixture(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	usages, err := defragReport(ctx, db.KV(), "", 0, rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	require.Equal(t, dbutils.CodeBucket, usages[0].bucket, "fragmented bucket comes first")
+	var logical float64
+	for i := uint64(0); i < 4000; i += 2 {
+		logical += float64(8 + 100 + i%150)
+	}
+
+	fragmented := usageOf(t, usages, dbutils.CodeBucket)
+	require.False(t, fragmented.sampled)
+	require.Equal(t, uint64(2000), fragmented.entries)
+	require.Equal(t, logical, fragmented.logical)
+	require.Greater(t, fragmented.reclaimable(), float64(fragmented.pageBytes)/3)
+
+	dense := usageOf(t, usages, dbutils.BlockBodyPrefix)
+	require.Equal(t, float64(362_500), dense.logical)
+	require.Less(t, dense.reclaimable(), float64(dense.pageBytes)/5)
+
+	overflow := usageOf(t, usages, dbutils.HeaderPrefix)
+	require.Greater(t, overflow.overflowShare(), 0.9)
+	require.Less(t, overflow.reclaimable(), float64(overflow.pageBytes)/5)
+
+	empty := usageOf(t, usages, dbutils.PlainStateBucket)
+	require.Zero(t, empty.logical)
+	require.Zero(t, empty.reclaimable())
+
+	// Sampled estimate of the fragmented bucket
+	usages, err = defragReport(ctx, db.KV(), dbutils.CodeBucket, 200, rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	sampled := usages[0]
+	require.True(t, sampled.sampled)
+	require.Less(t, sampled.logicalLow, sampled.logicalHigh)
+	require.True(t, sampled.logicalLow <= logical && logical <= sampled.logicalHigh,
+		"%f not in %f..%f", logical, sampled.logicalLow, sampled.logicalHigh)
+	require.InEpsilon(t, fragmented.reclaimable(), sampled.reclaimable(), 0.2)
+
+	var out bytes.Buffer
+	require.NoError(t, printDefragReport(&out, usages))
+	require.Contains(t, out.String(), dbutils.CodeBucket)
+	require.Contains(t, out.String(), "..")
+	require.Contains(t, out.String(), "total")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/export"
+)
+
+var defaultExportBuckets = []string{
+	dbutils.HeaderPrefix,
+	dbutils.BlockBodyPrefix,
+	dbutils.Senders,
+	dbutils.PlainStateBucket,
+	dbutils.PlainAccountChangeSetBucket,
+	dbutils.PlainStorageChangeSetBucket,
+}
+
+func exportDb(ctx context.Context, chaindata string, dir string, buckets []string) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	return export.Buckets(ctx, db.KV(), dir, buckets)
+}
+
+func importDb(ctx context.Context, chaindata string, dir string, force bool) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	return export.Import(ctx, db, dir, filepath.Join(chaindata, export.ImportProgressFile), force)
+}
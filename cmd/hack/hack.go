@@ -5,22 +5,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"flag"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"math"
 	"math/big"
 	"os"
 	"os/signal"
 	"runtime"
-	"runtime/pprof"
 	"sort"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/holiman/uint256"
-	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -34,6 +32,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/vm"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/cbor"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/node"
@@ -42,272 +41,16 @@ import (
 	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
 	"github.com/ledgerwatch/turbo-geth/turbo/trie"
 	"github.com/valyala/gozstd"
-	"github.com/wcharczuk/go-chart"
-	"github.com/wcharczuk/go-chart/util"
 )
 
 var emptyCodeHash = crypto.Keccak256(nil)
 
-var verbosity = flag.Uint("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail (default 3)")
-var action = flag.String("action", "", "action to execute")
-var cpuprofile = flag.String("cpuprofile", "", "write cpu profile `file`")
-var rewind = flag.Int("rewind", 1, "rewind to given number of blocks")
-var block = flag.Int("block", 1, "specifies a block number for operation")
-var account = flag.String("account", "0x", "specifies account to investigate")
-var name = flag.String("name", "", "name to add to the file names")
-var chaindata = flag.String("chaindata", "chaindata", "path to the chaindata database file")
-var bucket = flag.String("bucket", "", "bucket in the database")
-var hash = flag.String("hash", "0x00", "image for preimage or state root for testBlockHashes action")
-
 func check(e error) {
 	if e != nil {
 		panic(e)
 	}
 }
 
-func parseFloat64(str string) float64 {
-	v, _ := strconv.ParseFloat(str, 64)
-	return v
-}
-
-func readData(filename string) (blocks []float64, hours []float64, dbsize []float64, trienodes []float64, heap []float64) {
-	err := util.File.ReadByLines(filename, func(line string) error {
-		parts := strings.Split(line, ",")
-		blocks = append(blocks, parseFloat64(strings.Trim(parts[0], " ")))
-		hours = append(hours, parseFloat64(strings.Trim(parts[1], " ")))
-		dbsize = append(dbsize, parseFloat64(strings.Trim(parts[2], " ")))
-		trienodes = append(trienodes, parseFloat64(strings.Trim(parts[3], " ")))
-		heap = append(heap, parseFloat64(strings.Trim(parts[4], " ")))
-		return nil
-	})
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-	return
-}
-
-func notables() []chart.GridLine {
-	return []chart.GridLine{
-		{Value: 1.0},
-		{Value: 2.0},
-		{Value: 3.0},
-		{Value: 4.0},
-		{Value: 5.0},
-		{Value: 6.0},
-	}
-}
-
-func days() []chart.GridLine {
-	return []chart.GridLine{
-		{Value: 24.0},
-		{Value: 48.0},
-		{Value: 72.0},
-		{Value: 96.0},
-		{Value: 120.0},
-		{Value: 144.0},
-		{Value: 168.0},
-		{Value: 192.0},
-		{Value: 216.0},
-		{Value: 240.0},
-		{Value: 264.0},
-		{Value: 288.0},
-	}
-}
-
-func mychart() {
-	blocks, hours, dbsize, trienodes, heap := readData("bolt.csv")
-	blocks0, hours0, dbsize0, _, _ := readData("badger.csv")
-	mainSeries := &chart.ContinuousSeries{
-		Name: "Cumulative sync time (bolt)",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorBlue,
-			FillColor:   chart.ColorBlue.WithAlpha(100),
-		},
-		XValues: blocks,
-		YValues: hours,
-	}
-	badgerSeries := &chart.ContinuousSeries{
-		Name: "Cumulative sync time (badger)",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorRed,
-			FillColor:   chart.ColorRed.WithAlpha(100),
-		},
-		XValues: blocks0,
-		YValues: hours0,
-	}
-	dbsizeSeries := &chart.ContinuousSeries{
-		Name: "Database size (bolt)",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorBlack,
-		},
-		YAxis:   chart.YAxisSecondary,
-		XValues: blocks,
-		YValues: dbsize,
-	}
-	dbsizeSeries0 := &chart.ContinuousSeries{
-		Name: "Database size (badger)",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorOrange,
-		},
-		YAxis:   chart.YAxisSecondary,
-		XValues: blocks,
-		YValues: dbsize0,
-	}
-
-	graph1 := chart.Chart{
-		Width:  1280,
-		Height: 720,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top: 50,
-			},
-		},
-		YAxis: chart.YAxis{
-			Name:      "Elapsed time",
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%d h", int(v.(float64)))
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.ColorBlue,
-				StrokeWidth: 1.0,
-			},
-			GridLines: days(),
-		},
-		YAxisSecondary: chart.YAxis{
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%d G", int(v.(float64)))
-			},
-		},
-		XAxis: chart.XAxis{
-			Name: "Blocks, million",
-			Style: chart.Style{
-				Show: true,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.3fm", v.(float64))
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.ColorAlternateGray,
-				StrokeWidth: 1.0,
-			},
-			GridLines: notables(),
-		},
-		Series: []chart.Series{
-			mainSeries,
-			badgerSeries,
-			dbsizeSeries,
-			dbsizeSeries0,
-		},
-	}
-
-	graph1.Elements = []chart.Renderable{chart.LegendThin(&graph1)}
-
-	buffer := bytes.NewBuffer([]byte{})
-	err := graph1.Render(chart.PNG, buffer)
-	check(err)
-	err = ioutil.WriteFile("chart1.png", buffer.Bytes(), 0644)
-	check(err)
-
-	heapSeries := &chart.ContinuousSeries{
-		Name: "Allocated heap",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorYellow,
-			FillColor:   chart.ColorYellow.WithAlpha(100),
-		},
-		XValues: blocks,
-		YValues: heap,
-	}
-	trienodesSeries := &chart.ContinuousSeries{
-		Name: "Trie nodes",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorGreen,
-		},
-		YAxis:   chart.YAxisSecondary,
-		XValues: blocks,
-		YValues: trienodes,
-	}
-	graph2 := chart.Chart{
-		Width:  1280,
-		Height: 720,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top: 50,
-			},
-		},
-		YAxis: chart.YAxis{
-			Name:      "Allocated heap",
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.1f G", v.(float64))
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.ColorYellow,
-				StrokeWidth: 1.0,
-			},
-			GridLines: days(),
-		},
-		YAxisSecondary: chart.YAxis{
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.1f m", v.(float64))
-			},
-		},
-		XAxis: chart.XAxis{
-			Name: "Blocks, million",
-			Style: chart.Style{
-				Show: true,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.3fm", v.(float64))
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.ColorAlternateGray,
-				StrokeWidth: 1.0,
-			},
-			GridLines: notables(),
-		},
-		Series: []chart.Series{
-			heapSeries,
-			trienodesSeries,
-		},
-	}
-
-	graph2.Elements = []chart.Renderable{chart.LegendThin(&graph2)}
-	buffer.Reset()
-	err = graph2.Render(chart.PNG, buffer)
-	check(err)
-	err = ioutil.WriteFile("chart2.png", buffer.Bytes(), 0644)
-	check(err)
-}
-
 //nolint
 func accountSavings(db ethdb.KV) (int, int) {
 	emptyRoots := 0
@@ -335,42 +78,20 @@ func accountSavings(db ethdb.KV) (int, int) {
 
 func bucketStats(chaindata string) error {
 	ethDb := ethdb.MustOpen(chaindata)
+	defer ethDb.Close()
 
-	var bucketList []string
-	if err1 := ethDb.KV().View(context.Background(), func(txa ethdb.Tx) error {
-		if bl, err := txa.(ethdb.BucketMigrator).ExistingBuckets(); err == nil {
-			bucketList = bl
-		} else {
+	fmt.Printf(",BranchPageN,LeafPageN,OverflowN,Entries\n")
+	return ethDb.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		bucketList, err := tx.(ethdb.BucketMigrator).ExistingBuckets()
+		if err != nil {
 			return err
 		}
-		return nil
-	}); err1 != nil {
-		ethDb.Close()
-		return err1
-	}
-	ethDb.Close()
-	env, err := lmdb.NewEnv()
-	if err != nil {
-		return err
-	}
-	err = env.SetMaxDBs(100)
-	if err != nil {
-		return err
-	}
-	err = env.Open(chaindata, lmdb.Readonly, 0664)
-	if err != nil {
-		return err
-	}
-	fmt.Printf(",BranchPageN,LeafPageN,OverflowN,Entries\n")
-	return env.View(func(tx *lmdb.Txn) error {
 		for _, bucket := range bucketList {
-			dbi, bucketErr := tx.OpenDBI(bucket, 0)
-			if bucketErr != nil {
-				fmt.Printf("opening bucket %s: %v\n", bucket, bucketErr)
+			bs, statErr := tx.BucketStat(bucket)
+			if statErr != nil {
+				fmt.Printf("bucket %s: %v\n", bucket, statErr)
 				continue
 			}
-			bs, statErr := tx.Stat(dbi)
-			check(statErr)
 			fmt.Printf("%s,%d,%d,%d,%d\n", bucket,
 				bs.BranchPages, bs.LeafPages, bs.OverflowPages, bs.Entries)
 		}
@@ -378,220 +99,6 @@ func bucketStats(chaindata string) error {
 	})
 }
 
-func readTrieLog() ([]float64, map[int][]float64, []float64) {
-	data, err := ioutil.ReadFile("dust/hack.log")
-	check(err)
-	thresholds := []float64{}
-	counts := map[int][]float64{}
-	for i := 2; i <= 16; i++ {
-		counts[i] = []float64{}
-	}
-	shorts := []float64{}
-	lines := bytes.Split(data, []byte("\n"))
-	for _, line := range lines {
-		if bytes.HasPrefix(line, []byte("Threshold:")) {
-			tokens := bytes.Split(line, []byte(" "))
-			if len(tokens) == 23 {
-				wei := parseFloat64(string(tokens[1]))
-				thresholds = append(thresholds, wei)
-				for i := 2; i <= 16; i++ {
-					pair := bytes.Split(tokens[i+3], []byte(":"))
-					counts[i] = append(counts[i], parseFloat64(string(pair[1])))
-				}
-				pair := bytes.Split(tokens[21], []byte(":"))
-				shorts = append(shorts, parseFloat64(string(pair[1])))
-			}
-		}
-	}
-	return thresholds, counts, shorts
-}
-
-func ts() []chart.GridLine {
-	return []chart.GridLine{
-		{Value: 420.0},
-	}
-}
-
-func trieChart() {
-	thresholds, counts, shorts := readTrieLog()
-	fmt.Printf("%d %d %d\n", len(thresholds), len(counts), len(shorts))
-	shortsSeries := &chart.ContinuousSeries{
-		Name: "Short nodes",
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.ColorBlue,
-			FillColor:   chart.ColorBlue.WithAlpha(100),
-		},
-		XValues: thresholds,
-		YValues: shorts,
-	}
-	countSeries := make(map[int]*chart.ContinuousSeries)
-	for i := 2; i <= 16; i++ {
-		countSeries[i] = &chart.ContinuousSeries{
-			Name: fmt.Sprintf("%d-nodes", i),
-			Style: chart.Style{
-				Show:        true,
-				StrokeColor: chart.GetAlternateColor(i),
-			},
-			XValues: thresholds,
-			YValues: counts[i],
-		}
-	}
-	xaxis := &chart.XAxis{
-		Name: "Dust theshold",
-		Style: chart.Style{
-			Show: true,
-		},
-		ValueFormatter: func(v interface{}) string {
-			return fmt.Sprintf("%d wei", int(v.(float64)))
-		},
-		GridMajorStyle: chart.Style{
-			Show:        true,
-			StrokeColor: chart.DefaultStrokeColor,
-			StrokeWidth: 1.0,
-		},
-		Range: &chart.ContinuousRange{
-			Min: thresholds[0],
-			Max: thresholds[len(thresholds)-1],
-		},
-		Ticks: []chart.Tick{
-			{Value: 0.0, Label: "0"},
-			{Value: 1.0, Label: "wei"},
-			{Value: 10.0, Label: "10"},
-			{Value: 100.0, Label: "100"},
-			{Value: 1e3, Label: "1e3"},
-			{Value: 1e4, Label: "1e4"},
-			{Value: 1e5, Label: "1e5"},
-			{Value: 1e6, Label: "1e6"},
-			{Value: 1e7, Label: "1e7"},
-			{Value: 1e8, Label: "1e8"},
-			{Value: 1e9, Label: "1e9"},
-			{Value: 1e10, Label: "1e10"},
-			//{1e15, "finney"},
-			//{1e18, "ether"},
-		},
-	}
-
-	graph3 := chart.Chart{
-		Width:  1280,
-		Height: 720,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top: 50,
-			},
-		},
-		XAxis: *xaxis,
-		YAxis: chart.YAxis{
-			Name:      "Node count",
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%dm", int(v.(float64)/1e6))
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.DefaultStrokeColor,
-				StrokeWidth: 1.0,
-			},
-		},
-		Series: []chart.Series{
-			shortsSeries,
-		},
-	}
-	graph3.Elements = []chart.Renderable{chart.LegendThin(&graph3)}
-	buffer := bytes.NewBuffer([]byte{})
-	err := graph3.Render(chart.PNG, buffer)
-	check(err)
-	err = ioutil.WriteFile("chart3.png", buffer.Bytes(), 0644)
-	check(err)
-	graph4 := chart.Chart{
-		Width:  1280,
-		Height: 720,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top: 50,
-			},
-		},
-		XAxis: *xaxis,
-		YAxis: chart.YAxis{
-			Name:      "Node count",
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.2fm", v.(float64)/1e6)
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.DefaultStrokeColor,
-				StrokeWidth: 1.0,
-			},
-		},
-		Series: []chart.Series{
-			countSeries[2],
-			countSeries[3],
-		},
-	}
-	graph4.Elements = []chart.Renderable{chart.LegendThin(&graph4)}
-	buffer = bytes.NewBuffer([]byte{})
-	err = graph4.Render(chart.PNG, buffer)
-	check(err)
-	err = ioutil.WriteFile("chart4.png", buffer.Bytes(), 0644)
-	check(err)
-	graph5 := chart.Chart{
-		Width:  1280,
-		Height: 720,
-		Background: chart.Style{
-			Padding: chart.Box{
-				Top: 50,
-			},
-		},
-		XAxis: *xaxis,
-		YAxis: chart.YAxis{
-			Name:      "Node count",
-			NameStyle: chart.StyleShow(),
-			Style:     chart.StyleShow(),
-			TickStyle: chart.Style{
-				TextRotationDegrees: 45.0,
-			},
-			ValueFormatter: func(v interface{}) string {
-				return fmt.Sprintf("%.2fk", v.(float64)/1e3)
-			},
-			GridMajorStyle: chart.Style{
-				Show:        true,
-				StrokeColor: chart.DefaultStrokeColor,
-				StrokeWidth: 1.0,
-			},
-		},
-		Series: []chart.Series{
-			countSeries[4],
-			countSeries[5],
-			countSeries[6],
-			countSeries[7],
-			countSeries[8],
-			countSeries[9],
-			countSeries[10],
-			countSeries[11],
-			countSeries[12],
-			countSeries[13],
-			countSeries[14],
-			countSeries[15],
-			countSeries[16],
-		},
-	}
-	graph5.Elements = []chart.Renderable{chart.LegendThin(&graph5)}
-	buffer = bytes.NewBuffer([]byte{})
-	err = graph5.Render(chart.PNG, buffer)
-	check(err)
-	err = ioutil.WriteFile("chart5.png", buffer.Bytes(), 0644)
-	check(err)
-}
-
 func extractTrie(block int) {
 	stateDb := ethdb.MustOpen("statedb")
 	defer stateDb.Close()
@@ -914,6 +421,32 @@ func invTree(wrong, right, diff string, name string) {
 	t1.PrintDiff(t2, c)
 }
 
+func compareTries(left, right string, name string, fullJSON bool) {
+	t1 := readTrie(fmt.Sprintf("%s_%s.txt", left, name))
+	t2 := readTrie(fmt.Sprintf("%s_%s.txt", right, name))
+	fmt.Printf("Root hashes: %x / %x\n", t1.Hash(), t2.Hash())
+	diff := t1.Diff(t2, 0)
+	counts := make(map[trie.DiffKind]int)
+	shallowest := -1
+	for _, e := range diff {
+		counts[e.Kind]++
+		if shallowest == -1 || e.Depth < shallowest {
+			shallowest = e.Depth
+		}
+	}
+	for _, kind := range []trie.DiffKind{trie.DiffMissingLeft, trie.DiffMissingRight, trie.DiffValueMismatch, trie.DiffHashMismatch} {
+		fmt.Printf("%s: %d\n", kind, counts[kind])
+	}
+	if shallowest != -1 {
+		fmt.Printf("Shallowest divergence depth: %d\n", shallowest)
+	}
+	if fullJSON {
+		out, err := json.MarshalIndent(diff, "", "  ")
+		check(err)
+		fmt.Printf("%s\n", out)
+	}
+}
+
 func preimage(chaindata string, image common.Hash) {
 	ethDb := ethdb.MustOpen(chaindata)
 	defer ethDb.Close()
@@ -1046,7 +579,7 @@ func repairCurrent() {
 	defer historyDb.Close()
 	currentDb := ethdb.MustOpen("statedb")
 	defer currentDb.Close()
-	check(historyDb.ClearBuckets(dbutils.CurrentStateBucket))
+	check(historyDb.ClearBucketsIncremental(context.Background(), dbutils.CurrentStateBucket))
 	check(historyDb.KV().Update(context.Background(), func(tx ethdb.Tx) error {
 		newB := tx.Cursor(dbutils.CurrentStateBucket)
 		count := 0
@@ -1247,20 +780,9 @@ func regenerate(chaindata string) error {
 	headNumber := rawdb.ReadHeaderNumber(db, headHash)
 	headHeader := rawdb.ReadHeader(db, headHash, *headNumber)
 	log.Info("Regeneration started")
-	collector := etl.NewCollector(".", etl.NewSortableBuffer(etl.BufferOptimalSize))
-	hashCollector := func(keyHex []byte, hash []byte) error {
-		if len(keyHex)%2 != 0 || len(keyHex) == 0 {
-			return nil
-		}
-		var k []byte
-		trie.CompressNibbles(keyHex, &k)
-		if hash == nil {
-			return collector.Collect(k, nil)
-		}
-		return collector.Collect(k, common.CopyBytes(hash))
-	}
+	collector := trie.NewETLHashCollector(".", etl.BufferOptimalSize)
 	loader := trie.NewFlatDbSubTrieLoader()
-	if err := loader.Reset(db, trie.NewRetainList(0), trie.NewRetainList(0), hashCollector /* HashCollector */, [][]byte{nil}, []int{0}, false); err != nil {
+	if err := loader.Reset(db, trie.NewRetainList(0), trie.NewRetainList(0), collector.Collect /* HashCollector */, [][]byte{nil}, []int{0}, false); err != nil {
 		return err
 	}
 	if subTries, err := loader.LoadSubTries(); err == nil {
@@ -1273,7 +795,7 @@ func regenerate(chaindata string) error {
 	}
 	/*
 		quitCh := make(chan struct{})
-		if err := collector.Load(db, dbutils.IntermediateTrieHashBucket, etl.IdentityLoadFunc, etl.TransformArgs{Quit: quitCh}); err != nil {
+		if err := collector.Load("regenerate", db, quitCh); err != nil {
 			return err
 		}
 	*/
@@ -1281,28 +803,14 @@ func regenerate(chaindata string) error {
 	return nil
 }
 
-func testGetProof(chaindata string, address common.Address, rewind int, regen bool) error {
-	if regen {
-		if err := regenerate(chaindata); err != nil {
-			return err
-		}
-	}
-	storageKeys := []string{}
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
-	headHash := rawdb.ReadHeadBlockHash(db)
-	headNumber := rawdb.ReadHeaderNumber(db, headHash)
-	block := *headNumber - uint64(rewind)
-	log.Info("GetProof", "address", address, "storage keys", len(storageKeys), "head", *headNumber, "block", block,
-		"alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys), "numGC", int(m.NumGC))
-
+// historicalState collects the values of the accounts and the storage items as of the given block from
+// the change sets of the later blocks up to the head. Code hashes of the contracts are taken from the current state
+func historicalState(db ethdb.Database, block, head uint64) (map[string]*accounts.Account, map[string][]byte, error) {
 	ts := dbutils.EncodeTimestamp(block + 1)
 	accountMap := make(map[string]*accounts.Account)
 	if err := db.Walk(dbutils.AccountChangeSetBucket, ts, 0, func(k, v []byte) (bool, error) {
 		timestamp, _ := dbutils.DecodeTimestamp(k)
-		if timestamp > *headNumber {
+		if timestamp > head {
 			return false, nil
 		}
 		if changeset.Len(v) > 0 {
@@ -1327,15 +835,12 @@ func testGetProof(chaindata string, address common.Address, rewind int, regen bo
 		}
 		return true, nil
 	}); err != nil {
-		return err
+		return nil, nil, err
 	}
-	runtime.ReadMemStats(&m)
-	log.Info("Constructed account map", "size", len(accountMap),
-		"alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys), "numGC", int(m.NumGC))
 	storageMap := make(map[string][]byte)
 	if err := db.Walk(dbutils.StorageChangeSetBucket, ts, 0, func(k, v []byte) (bool, error) {
 		timestamp, _ := dbutils.DecodeTimestamp(k)
-		if timestamp > *headNumber {
+		if timestamp > head {
 			return false, nil
 		}
 		if changeset.Len(v) > 0 {
@@ -1352,28 +857,52 @@ func testGetProof(chaindata string, address common.Address, rewind int, regen bo
 		}
 		return true, nil
 	}); err != nil {
+		return nil, nil, err
+	}
+	for ks, acc := range accountMap {
+		// Fill the code hashes
+		if acc != nil && acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
+			codeHash, err := db.Get(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix([]byte(ks), acc.Incarnation))
+			if err != nil {
+				return nil, nil, err
+			}
+			copy(acc.CodeHash[:], codeHash)
+		}
+	}
+	return accountMap, storageMap, nil
+}
+
+func testGetProof(chaindata string, address common.Address, rewind int, regen bool) error {
+	if regen {
+		if err := regenerate(chaindata); err != nil {
+			return err
+		}
+	}
+	storageKeys := []string{}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	headHash := rawdb.ReadHeadBlockHash(db)
+	headNumber := rawdb.ReadHeaderNumber(db, headHash)
+	block := *headNumber - uint64(rewind)
+	log.Info("GetProof", "address", address, "storage keys", len(storageKeys), "head", *headNumber, "block", block,
+		"alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys), "numGC", int(m.NumGC))
+
+	accountMap, storageMap, err := historicalState(db, block, *headNumber)
+	if err != nil {
 		return err
 	}
 	runtime.ReadMemStats(&m)
-	log.Info("Constructed storage map", "size", len(storageMap),
+	log.Info("Constructed account and storage maps", "accounts", len(accountMap), "storage", len(storageMap),
 		"alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys), "numGC", int(m.NumGC))
 	var unfurlList = make([]string, len(accountMap)+len(storageMap))
 	unfurl := trie.NewRetainList(0)
 	i := 0
-	for ks, acc := range accountMap {
+	for ks := range accountMap {
 		unfurlList[i] = ks
 		i++
 		unfurl.AddKey([]byte(ks))
-		if acc != nil {
-			// Fill the code hashes
-			if acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
-				if codeHash, err1 := db.Get(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix([]byte(ks), acc.Incarnation)); err1 == nil {
-					copy(acc.CodeHash[:], codeHash)
-				} else {
-					return err1
-				}
-			}
-		}
 	}
 	for ks := range storageMap {
 		unfurlList[i] = ks
@@ -1511,6 +1040,29 @@ func changeSetStats(chaindata string, block1, block2 uint64) error {
 	return nil
 }
 
+func checkHistory(chaindata string, block uint64) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	errCh := make(chan state.ConsistencyError, 1024)
+	done := make(chan struct{})
+	found := 0
+	go func() {
+		defer close(done)
+		for e := range errCh {
+			found++
+			fmt.Printf("%v\n", e)
+		}
+	}()
+	err := state.CheckHistoryConsistency(db.KV(), true /* plain */, block, math.MaxUint64, errCh)
+	close(errCh)
+	<-done
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Found %d inconsistencies\n", found)
+	return nil
+}
+
 func searchChangeSet(chaindata string, key []byte, block uint64) error {
 	fmt.Printf("Searching changesets\n")
 	db := ethdb.MustOpen(chaindata)
@@ -1568,68 +1120,19 @@ func searchStorageChangeSet(chaindata string, key []byte, block uint64) error {
 	return nil
 }
 
-func supply(chaindata string) error {
-	startTime := time.Now()
-	db := ethdb.MustOpen(chaindata)
-	defer db.Close()
-	count := 0
-	supply := uint256.NewInt()
-	var a accounts.Account
-	if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
-		c := tx.Cursor(dbutils.PlainStateBucket)
-		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
-			if err != nil {
-				return err
-			}
-			if len(k) != 20 {
-				continue
-			}
-			if err1 := a.DecodeForStorage(v); err1 != nil {
-				return err1
-			}
-			count++
-			supply.Add(supply, &a.Balance)
-			if count%100000 == 0 {
-				fmt.Printf("Processed %dK account records\n", count/1000)
-			}
-		}
-		return nil
-	}); err != nil {
-		return err
-	}
-	fmt.Printf("Total accounts: %d, supply: %d, took: %s\n", count, supply, time.Since(startTime))
-	return nil
-}
-
 func extractCode(chaindata string) error {
 	db := ethdb.MustOpen(chaindata)
 	defer db.Close()
 	destDb := ethdb.MustOpen("codes")
 	defer destDb.Close()
-	return destDb.KV().Update(context.Background(), func(tx1 ethdb.Tx) error {
-		c1 := tx1.Cursor(dbutils.PlainContractCodeBucket)
-		return db.KV().View(context.Background(), func(tx ethdb.Tx) error {
-			c := tx.Cursor(dbutils.PlainContractCodeBucket)
-			for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
-				if err != nil {
-					return err
-				}
-				if err = c1.Append(k, v); err != nil {
-					return err
-				}
-			}
-			c1 = tx1.Cursor(dbutils.CodeBucket)
-			c = tx.Cursor(dbutils.CodeBucket)
-			for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
-				if err != nil {
-					return err
-				}
-				if err = c1.Append(k, v); err != nil {
-					return err
-				}
+	return db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		for _, bucket := range []string{dbutils.PlainContractCodeBucket, dbutils.CodeBucket} {
+			c := tx.Cursor(bucket)
+			if err := ethdb.BulkLoad(destDb.KV(), bucket, ethdb.CursorIterator(c)); err != nil {
+				return err
 			}
-			return nil
-		})
+		}
+		return nil
 	})
 }
 
@@ -1976,51 +1479,22 @@ func mint(chaindata string, block uint64) error {
 	//mintFuncPrefix = common.FromHex("0xa0712d68")
 	var gwei uint256.Int
 	gwei.SetUint64(1000000000)
-	blockEncoded := dbutils.EncodeBlockNumber(block)
-	canonical := make(map[common.Hash]struct{})
 	if err1 := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
-		c := tx.Cursor(dbutils.HeaderPrefix)
-		// This is a mapping of contractAddress + incarnation => CodeHash
-		for k, v, err := c.Seek(blockEncoded); k != nil; k, v, err = c.Next() {
-			if err != nil {
-				return err
-			}
-			// Skip non relevant records
-			if !dbutils.CheckCanonicalKey(k) {
-				continue
-			}
-			canonical[common.BytesToHash(v)] = struct{}{}
-			if len(canonical)%100_000 == 0 {
-				log.Info("Read canonical hashes", "count", len(canonical))
-			}
-		}
-		log.Info("Read canonical hashes", "count", len(canonical))
-		c = tx.Cursor(dbutils.BlockBodyPrefix)
 		var prevBlock uint64
 		var burntGas uint64
-		for k, v, err := c.Seek(blockEncoded); k != nil; k, v, err = c.Next() {
-			if err != nil {
-				return err
-			}
-			blockNumber := binary.BigEndian.Uint64(k[:8])
-			blockHash := common.BytesToHash(k[8:])
-			if _, isCanonical := canonical[blockHash]; !isCanonical {
-				continue
-			}
+		return rawdb.ForEachCanonicalBody(context.Background(), tx, block, math.MaxUint64, func(blockNumber uint64, blockHash common.Hash, body *types.Body) error {
 			if blockNumber != prevBlock && blockNumber != prevBlock+1 {
 				fmt.Printf("Gap [%d-%d]\n", prevBlock, blockNumber-1)
 			}
 			prevBlock = blockNumber
-			bodyRlp, err := rawdb.DecompressBlockBody(v)
+			header := rawdb.ReadHeader(db, blockHash, blockNumber)
+			senders, err := rawdb.ReadSenders2(tx, blockNumber)
 			if err != nil {
 				return err
 			}
-			body := new(types.Body)
-			if err := rlp.Decode(bytes.NewReader(bodyRlp), body); err != nil {
-				return fmt.Errorf("invalid block body RLP: %w", err)
+			if senders == nil {
+				senders = rawdb.ReadSenders(db, blockHash, blockNumber)
 			}
-			header := rawdb.ReadHeader(db, blockHash, blockNumber)
-			senders := rawdb.ReadSenders(db, blockHash, blockNumber)
 			var ethSpent uint256.Int
 			var ethSpentTotal uint256.Int
 			var totalGas uint256.Int
@@ -2045,8 +1519,8 @@ func mint(chaindata string, block uint64) error {
 			if blockNumber%100_000 == 0 {
 				log.Info("Processed", "blocks", blockNumber)
 			}
-		}
-		return nil
+			return nil
+		})
 	}); err1 != nil {
 		return err1
 	}
@@ -2089,6 +1563,14 @@ func extracHeaders(chaindata string, block uint64) error {
 	return nil
 }
 
+func compactBitmaps(chaindata string, bucket string) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	return db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return bitmapdb.CompactBucket(tx, bucket, nil)
+	})
+}
+
 func receiptSizes(chaindata string) error {
 	db := ethdb.MustOpen(chaindata)
 	defer db.Close()
@@ -2120,166 +1602,16 @@ func receiptSizes(chaindata string) error {
 }
 
 func main() {
-	flag.Parse()
-
-	log.SetupDefaultTerminalLogger(log.Lvl(*verbosity), "", "")
-
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
-		if err != nil {
-			log.Error("could not create CPU profile", "error", err)
-			return
-		}
-		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Error("could not start CPU profile", "error", err)
-			return
-		}
-		defer pprof.StopCPUProfile()
-	}
-	//db := ethdb.MustOpen("/home/akhounov/.ethereum/geth/chaindata")
-	//db := ethdb.MustOpen(node.DefaultDataDir() + "/geth/chaindata")
-	//check(err)
-	//defer db.Close()
-	if *action == "cfg" {
-		testGenCfg()
-	}
-	if *action == "bucketStats" {
-		if err := bucketStats(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "syncChart" {
-		mychart()
-	}
-	//testRebuild()
-	if *action == "testRewind" {
-		testRewind(*chaindata, *block, *rewind)
-	}
-	//hashFile()
-	//buildHashFromFile()
-	if *action == "testResolve" {
-		testResolve(*chaindata)
-	}
-	//rlpIndices()
-	//printFullNodeRLPs()
-	//testStartup()
-	//testDifficulty()
-	//testRewindTests()
-	//if *reset != -1 {
-	//	testReset(uint64(*reset))
-	//}
-	if *action == "testBlockHashes" {
-		testBlockHashes(*chaindata, *block, common.HexToHash(*hash))
-	}
-	//printBuckets(db)
-	//printTxHashes()
-	//relayoutKeys()
-	//upgradeBlocks()
-	//compareTries()
-	if *action == "invTree" {
-		invTree("root", "right", "diff", *name)
-	}
-	//invTree("iw", "ir", "id", *block, true)
-	//loadAccount()
-	//printBranches(uint64(*block))
-	//extractTrie(*block)
-	//repair()
-	if *action == "readAccount" {
-		readAccount(*chaindata, common.HexToAddress(*account), uint64(*block), uint64(*rewind))
-	}
-	if *action == "readPlainAccount" {
-		readPlainAccount(*chaindata, common.HexToAddress(*account))
-	}
-	if *action == "fixAccount" {
-		fixAccount(*chaindata, common.HexToHash(*account), common.HexToHash(*hash))
-	}
-	if *action == "nextIncarnation" {
-		nextIncarnation(*chaindata, common.HexToHash(*account))
-	}
-	//repairCurrent()
-	//fmt.Printf("\u00b3\n")
-	if *action == "dumpStorage" {
-		dumpStorage()
-	}
-	if *action == "current" {
-		printCurrentBlockNumber(*chaindata)
-	}
-	if *action == "bucket" {
-		printBucket(*chaindata)
-	}
-
-	if *action == "val-tx-lookup-2" {
-		ValidateTxLookups2(*chaindata)
-	}
-	if *action == "modiAccounts" {
-		getModifiedAccounts(*chaindata)
-	}
-	if *action == "slice" {
-		dbSlice(*chaindata, *bucket, common.FromHex(*hash))
-	}
-	if *action == "getProof" {
-		if err := testGetProof(*chaindata, common.HexToAddress(*account), *rewind, false); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "regenerateIH" {
-		if err := regenerate(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "searchChangeSet" {
-		if err := searchChangeSet(*chaindata, common.FromHex(*hash), uint64(*block)); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "searchStorageChangeSet" {
-		if err := searchStorageChangeSet(*chaindata, common.FromHex(*hash), uint64(*block)); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "changeSetStats" {
-		if err := changeSetStats(*chaindata, uint64(*block), uint64(*block)+uint64(*rewind)); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "supply" {
-		if err := supply(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "extractCode" {
-		if err := extractCode(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "iterateOverCode" {
-		if err := iterateOverCode(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "mint" {
-		if err := mint(*chaindata, uint64(*block)); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "zstd" {
-		if err := zstd(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "benchRlp" {
-		if err := benchRlp(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
-	}
-	if *action == "extractHeaders" {
-		if err := extracHeaders(*chaindata, uint64(*block)); err != nil {
-			fmt.Printf("Error: %v\n", err)
+	rootCmd := rootCommand()
+	if isLegacyInvocation(os.Args[1:]) {
+		if err := runLegacyAction(rootCmd, os.Args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		return
 	}
-	if *action == "receiptSizes" {
-		if err := receiptSizes(*chaindata); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
+	if err := rootCmd.ExecuteContext(utils.RootContext()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
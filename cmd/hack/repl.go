@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/console/prompt"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// replBatch - number of entries seek and count read in one transaction. Every command runs in its own short
+// read transactions, so that the repl does not keep the pages of LMDB from being reused
+var replBatch = 10_000
+
+const replDefaultLimit = 10
+
+type replCommand struct {
+	usage   string
+	minArgs int
+	maxArgs int
+	run     func(ctx context.Context, kv ethdb.KV, args []string, w io.Writer) error
+}
+
+var replCommands map[string]replCommand
+
+func init() {
+	replCommands = map[string]replCommand{
+		"help":    {"help", 0, 0, replHelp},
+		"buckets": {"buckets", 0, 0, replBuckets},
+		"get":     {"get <bucket> <hexkey>", 2, 2, replGet},
+		"seek":    {"seek <bucket> <hexprefix> [limit]", 2, 3, replSeek},
+		"count":   {"count <bucket> <hexprefix>", 2, 2, replCount},
+		"decode":  {"decode account|header <hexvalue>", 2, 2, replDecode},
+	}
+}
+
+// replDecoders - decoders of the entries of the buckets which have them. They return "" for the entries they
+// do not know, like the storage entries of the state buckets
+var replDecoders = map[string]func(k, v []byte) (string, error){
+	dbutils.PlainStateBucket: func(k, v []byte) (string, error) {
+		if len(k) != common.AddressLength {
+			return "", nil
+		}
+		return describeAccount(v)
+	},
+	dbutils.CurrentStateBucket: func(k, v []byte) (string, error) {
+		if len(k) != common.HashLength {
+			return "", nil
+		}
+		return describeAccount(v)
+	},
+	dbutils.HeaderPrefix: func(k, v []byte) (string, error) {
+		if len(k) != 8+common.HashLength {
+			return "", nil
+		}
+		return describeHeader(v)
+	},
+}
+
+func describeAccount(v []byte) (string, error) {
+	var a accounts.Account
+	if err := a.DecodeForStorage(v); err != nil {
+		return "", fmt.Errorf("decoding account: %w", err)
+	}
+	return fmt.Sprintf("nonce: %d, balance: %d, incarnation: %d, root: %x, codeHash: %x",
+		a.Nonce, a.Balance.ToBig(), a.Incarnation, a.Root, a.CodeHash), nil
+}
+
+func describeHeader(v []byte) (string, error) {
+	var h types.Header
+	if err := rlp.DecodeBytes(v, &h); err != nil {
+		return "", fmt.Errorf("decoding header: %w", err)
+	}
+	return fmt.Sprintf("number: %d, hash: %x, parent: %x, root: %x, coinbase: %x, difficulty: %d, gasLimit: %d, gasUsed: %d, time: %d, extra: %x",
+		h.Number, h.Hash(), h.ParentHash, h.Root, h.Coinbase, h.Difficulty, h.GasLimit, h.GasUsed, h.Time, h.Extra), nil
+}
+
+func parseHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %q: %w", s, err)
+	}
+	return b, nil
+}
+
+func replBucket(name string) (dbutils.BucketConfigItem, error) {
+	cfg, ok := dbutils.BucketsConfigs[name]
+	if !ok {
+		return cfg, fmt.Errorf("unknown bucket %q, see buckets", name)
+	}
+	return cfg, nil
+}
+
+// printEntry prints the value in hex, after the key if withKey is set, and the value decoded if the bucket
+// has a decoder
+func printEntry(w io.Writer, bucket string, k, v []byte, withKey bool) error {
+	if withKey {
+		fmt.Fprintf(w, "%x ", k)
+	}
+	fmt.Fprintf(w, "%x\n", v)
+	decoder, ok := replDecoders[bucket]
+	if !ok {
+		return nil
+	}
+	decoded, err := decoder(k, v)
+	if err != nil {
+		fmt.Fprintf(w, "  %v\n", err)
+	} else if decoded != "" {
+		fmt.Fprintf(w, "  %s\n", decoded)
+	}
+	return nil
+}
+
+// walkPrefix calls f for the entries of the bucket with the prefix until f returns false. Every replBatch entries
+// the transaction is closed, and the walk continues after the last entry in a new one
+func walkPrefix(ctx context.Context, kv ethdb.KV, bucket string, prefix []byte, f func(k, v []byte) (bool, error)) error {
+	cfg, err := replBucket(bucket)
+	if err != nil {
+		return err
+	}
+	// with the keys conversion the cursor returns the keys of the dup sorted buckets unique
+	dupSort := cfg.Flags&lmdb.DupSort != 0 && !cfg.AutoDupSortKeysConversion
+	from := prefix
+	var lastK, lastV []byte
+	for {
+		n := 0
+		more := false
+		if err := kv.View(ctx, func(tx ethdb.Tx) error {
+			c := tx.Cursor(bucket)
+			defer c.Close()
+			k, v, err := c.Seek(from)
+			for ; k != nil && bytes.HasPrefix(k, prefix); k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				if lastK != nil && bytes.Equal(k, lastK) && (!dupSort || tx.DCmp(bucket, v, lastV) <= 0) {
+					continue // read by the previous transaction
+				}
+				if n == replBatch {
+					more = true
+					return nil
+				}
+				ok, err := f(k, v)
+				if err != nil || !ok {
+					return err
+				}
+				lastK, lastV = common.CopyBytes(k), common.CopyBytes(v)
+				n++
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+		from = lastK
+	}
+}
+
+func replHelp(_ context.Context, _ ethdb.KV, _ []string, w io.Writer) error {
+	usages := make([]string, 0, len(replCommands))
+	for _, cmd := range replCommands {
+		usages = append(usages, cmd.usage)
+	}
+	sort.Strings(usages)
+	for _, usage := range usages {
+		fmt.Fprintf(w, "%s\n", usage)
+	}
+	fmt.Fprintf(w, "exit\n")
+	return nil
+}
+
+func replBuckets(ctx context.Context, kv ethdb.KV, _ []string, w io.Writer) error {
+	return kv.View(ctx, func(tx ethdb.Tx) error {
+		buckets, err := tx.(ethdb.BucketMigrator).ExistingBuckets()
+		if err != nil {
+			return err
+		}
+		sort.Strings(buckets)
+		for _, bucket := range buckets {
+			st, err := tx.BucketStat(bucket)
+			if err != nil {
+				return fmt.Errorf("bucket %s: %w", bucket, err)
+			}
+			fmt.Fprintf(w, "%s %d\n", bucket, st.Entries)
+		}
+		return nil
+	})
+}
+
+func replGet(ctx context.Context, kv ethdb.KV, args []string, w io.Writer) error {
+	if _, err := replBucket(args[0]); err != nil {
+		return err
+	}
+	key, err := parseHex(args[1])
+	if err != nil {
+		return err
+	}
+	return kv.View(ctx, func(tx ethdb.Tx) error {
+		v, err := tx.GetOne(args[0], key)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			fmt.Fprintf(w, "not found\n")
+			return nil
+		}
+		return printEntry(w, args[0], key, v, false)
+	})
+}
+
+func replSeek(ctx context.Context, kv ethdb.KV, args []string, w io.Writer) error {
+	prefix, err := parseHex(args[1])
+	if err != nil {
+		return err
+	}
+	limit := replDefaultLimit
+	if len(args) == 3 {
+		if limit, err = strconv.Atoi(args[2]); err != nil || limit <= 0 {
+			return fmt.Errorf("invalid limit %q", args[2])
+		}
+	}
+	n := 0
+	if err = walkPrefix(ctx, kv, args[0], prefix, func(k, v []byte) (bool, error) {
+		n++
+		return n < limit, printEntry(w, args[0], k, v, true)
+	}); err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Fprintf(w, "not found\n")
+	}
+	return nil
+}
+
+func replCount(ctx context.Context, kv ethdb.KV, args []string, w io.Writer) error {
+	prefix, err := parseHex(args[1])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if err = walkPrefix(ctx, kv, args[0], prefix, func(k, v []byte) (bool, error) {
+		n++
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d\n", n)
+	return nil
+}
+
+func replDecode(_ context.Context, _ ethdb.KV, args []string, w io.Writer) error {
+	v, err := parseHex(args[1])
+	if err != nil {
+		return err
+	}
+	var decoded string
+	switch args[0] {
+	case "account":
+		decoded, err = describeAccount(v)
+	case "header":
+		decoded, err = describeHeader(v)
+	default:
+		return fmt.Errorf("unknown type %q, expected account or header", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", decoded)
+	return nil
+}
+
+// execReplLine runs one command of the repl. Panics of the decoders on malformed values are returned as errors
+func execReplLine(ctx context.Context, kv ethdb.KV, line string, w io.Writer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, ok := replCommands[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see help", fields[0])
+	}
+	args := fields[1:]
+	if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return cmd.run(ctx, kv, args, w)
+}
+
+// replCompleter completes the names of the commands and of the buckets
+func replCompleter(line string, pos int) (string, []string, string) {
+	head, tail := line[:pos], line[pos:]
+	start := strings.LastIndexByte(head, ' ') + 1
+	word := head[start:]
+	var candidates []string
+	if start == 0 {
+		for name := range replCommands {
+			candidates = append(candidates, name)
+		}
+		candidates = append(candidates, "exit")
+	} else if strings.Count(strings.TrimLeft(head, " "), " ") == 1 {
+		candidates = dbutils.Buckets
+	}
+	var completions []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			completions = append(completions, c+" ")
+		}
+	}
+	sort.Strings(completions)
+	return head[:start], completions, tail
+}
+
+func repl(ctx context.Context, chaindata string) error {
+	kv, err := ethdb.NewLMDB().Path(chaindata).ReadOnly().Open()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	prompt.Stdin.SetWordCompleter(replCompleter)
+	fmt.Printf("Type help for the list of commands\n")
+	for {
+		line, err := prompt.Stdin.PromptInput("db> ")
+		if err != nil {
+			return nil // end of the input or ctrl-c
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+		prompt.Stdin.AppendHistory(line)
+		if err := execReplLine(ctx, kv, line, os.Stdout); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+}
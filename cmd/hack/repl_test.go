@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepl(t *testing.T) {
+	defer func(prev int) { replBatch = prev }(replBatch)
+	replBatch = 2 // seek and count span several transactions
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+
+	address := common.HexToAddress("0x0100000000000000000000000000000000000001")
+	a := accounts.NewAccount()
+	a.Initialised = true
+	a.Nonce = 5
+	a.Balance.Set(uint256.NewInt().SetUint64(1000))
+	enc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(enc)
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, address[:], enc))
+	storageKey := dbutils.PlainGenerateCompositeStorageKey(address, 1, common.Hash{})
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, storageKey, []byte{0x2a}))
+
+	header := &types.Header{Number: big.NewInt(7), Difficulty: common.Big1, Extra: []byte("repl")}
+	rawdb.WriteHeader(ctx, db, header)
+	headerEnc, err := rlp.EncodeToBytes(header)
+	require.NoError(t, err)
+
+	for i := byte(0); i < 5; i++ {
+		require.NoError(t, db.Put(dbutils.CodeBucket, []byte{0xaa, i}, []byte{i}))
+	}
+	require.NoError(t, db.Put(dbutils.CodeBucket, []byte{0xbb}, []byte{0xff}))
+	require.NoError(t, db.KV().Update(ctx, func(tx ethdb.Tx) error {
+		c := tx.Cursor(dbutils.Senders2)
+		for i := byte(0); i < 5; i++ {
+			if err := c.Put(dbutils.EncodeBlockNumber(1), common.BytesToAddress([]byte{i}).Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	exec := func(format string, args ...interface{}) (string, error) {
+		var out bytes.Buffer
+		err := execReplLine(ctx, db.KV(), fmt.Sprintf(format, args...), &out)
+		return out.String(), err
+	}
+	mustExec := func(format string, args ...interface{}) string {
+		out, err := exec(format, args...)
+		require.NoError(t, err, format)
+		return out
+	}
+
+	out := mustExec("get %s %x", dbutils.PlainStateBucket, address)
+	require.Equal(t, fmt.Sprintf("%x\n  nonce: 5, balance: 1000, incarnation: 0", enc), out[:strings.Index(out, ", root")])
+	require.Equal(t, "2a\n", mustExec("get %s 0x%x", dbutils.PlainStateBucket, storageKey), "storage is not decoded")
+	require.Equal(t, "not found\n", mustExec("get %s ff", dbutils.CodeBucket))
+
+	require.Equal(t, "aa00 00\naa01 01\naa02 02\n", mustExec("seek %s aa 3", dbutils.CodeBucket))
+	require.Equal(t, "aa03 03\naa04 04\n", mustExec("seek %s aa03", dbutils.CodeBucket))
+	require.Equal(t, "not found\n", mustExec("seek %s cc", dbutils.CodeBucket))
+	require.Equal(t, "5\n", mustExec("count %s aa", dbutils.CodeBucket))
+	require.Equal(t, "6\n", mustExec("count %s 0x", dbutils.CodeBucket), "empty prefix")
+	require.Equal(t, "5\n", mustExec("count %s %x", dbutils.Senders2, dbutils.EncodeBlockNumber(1)), "duplicates span transactions")
+
+	out = mustExec("seek %s %x", dbutils.HeaderPrefix, dbutils.EncodeBlockNumber(7))
+	require.Contains(t, out, fmt.Sprintf("number: 7, hash: %x", header.Hash()))
+	require.Contains(t, mustExec("decode header %x", headerEnc), "extra: "+fmt.Sprintf("%x", "repl"))
+	require.Contains(t, mustExec("decode account %x", enc), "nonce: 5")
+	require.Contains(t, mustExec("buckets"), fmt.Sprintf("%s 6\n", dbutils.CodeBucket))
+	require.Contains(t, mustExec("help"), "seek <bucket> <hexprefix> [limit]")
+
+	for _, line := range []string{
+		"frob",
+		"get " + dbutils.CodeBucket,
+		"get nosuchbucket 00",
+		"get " + dbutils.CodeBucket + " zz",
+		"seek " + dbutils.CodeBucket + " aa 0",
+		"decode transaction 00",
+		"decode account 0102", // nonce is longer than the value
+		"decode account 01",   // decoder panics
+	} {
+		_, err := exec(line)
+		require.Error(t, err, line)
+	}
+
+	_, completions, _ := replCompleter("se", 2)
+	require.Equal(t, []string{"seek "}, completions)
+	head, completions, _ := replCompleter("get "+dbutils.PlainStateBucket[:3], 7)
+	require.Equal(t, "get ", head)
+	require.Contains(t, completions, dbutils.PlainStateBucket+" ")
+}
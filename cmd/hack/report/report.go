@@ -0,0 +1,371 @@
+// Package report renders the charts of the hack tool. Charts are described by ChartSpec, with the series taken
+// from the columns of CSV files or given in memory. The spec can also be read from a JSON file
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// Kinds of the charts
+const (
+	// KindSync - values growing over the blocks, like time and size of the sync, with primary and secondary Y axes
+	KindSync = "sync"
+	// KindDistribution - values against the thresholds, with the X axis labeled by the ticks
+	KindDistribution = "distribution"
+)
+
+var colors = map[string]drawing.Color{
+	"blue":   chart.ColorBlue,
+	"red":    chart.ColorRed,
+	"black":  chart.ColorBlack,
+	"orange": chart.ColorOrange,
+	"yellow": chart.ColorYellow,
+	"green":  chart.ColorGreen,
+	"gray":   chart.ColorAlternateGray,
+}
+
+type Tick struct {
+	Value float64 `json:"value"`
+	Label string  `json:"label"`
+}
+
+// AxisSpec - name and labels of the axis. Values are divided by Scale (1 if 0) and printed by Format, where %d
+// prints the integer part of the value. Formatter, if set, takes precedence over Format
+type AxisSpec struct {
+	Name      string                 `json:"name"`
+	Format    string                 `json:"format"`
+	Scale     float64                `json:"scale"`
+	GridLines []float64              `json:"gridLines"`
+	Ticks     []Tick                 `json:"ticks"`
+	Formatter func(v float64) string `json:"-"`
+}
+
+func (a AxisSpec) valueFormatter() func(v interface{}) string {
+	if a.Formatter != nil {
+		return func(v interface{}) string {
+			return a.Formatter(v.(float64))
+		}
+	}
+	if a.Format == "" {
+		return nil // default of go-chart
+	}
+	scale := a.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	integer := strings.Contains(a.Format, "%d")
+	return func(v interface{}) string {
+		value := v.(float64) / scale
+		if integer {
+			return fmt.Sprintf(a.Format, int64(value))
+		}
+		return fmt.Sprintf(a.Format, value)
+	}
+}
+
+func (a AxisSpec) gridLines() []chart.GridLine {
+	var lines []chart.GridLine
+	for _, v := range a.GridLines {
+		lines = append(lines, chart.GridLine{Value: v})
+	}
+	return lines
+}
+
+// yAxis returns the Y axis, with the major grid of the color if grid is set
+func (a AxisSpec) yAxis(grid bool, gridColor drawing.Color) chart.YAxis {
+	axis := chart.YAxis{
+		Name:      a.Name,
+		NameStyle: chart.StyleShow(),
+		Style:     chart.StyleShow(),
+		TickStyle: chart.Style{
+			TextRotationDegrees: 45.0,
+		},
+		ValueFormatter: a.valueFormatter(),
+	}
+	if grid {
+		axis.GridMajorStyle = chart.Style{
+			Show:        true,
+			StrokeColor: gridColor,
+			StrokeWidth: 1.0,
+		}
+		axis.GridLines = a.gridLines()
+	}
+	return axis
+}
+
+// SeriesSpec - series of the chart, from the columns X and Y (0-based) of the CSV file, or from XValues and YValues
+// if CSV is empty. Color is one of the named colors, an alternate color is picked if it is empty
+type SeriesSpec struct {
+	Name      string    `json:"name"`
+	CSV       string    `json:"csv"`
+	X         int       `json:"x"`
+	Y         int       `json:"y"`
+	Secondary bool      `json:"secondary"` // plotted against the secondary Y axis
+	Fill      bool      `json:"fill"`
+	Color     string    `json:"color"`
+	XValues   []float64 `json:"-"`
+	YValues   []float64 `json:"-"`
+}
+
+func (s SeriesSpec) series(index int) (*chart.ContinuousSeries, error) {
+	color := chart.GetAlternateColor(index)
+	if s.Color != "" {
+		var ok bool
+		if color, ok = colors[s.Color]; !ok {
+			return nil, fmt.Errorf("series %q: unknown color %q", s.Name, s.Color)
+		}
+	}
+	xValues, yValues := s.XValues, s.YValues
+	if s.CSV != "" {
+		columns, err := ReadColumns(s.CSV, s.X, s.Y)
+		if err != nil {
+			return nil, fmt.Errorf("series %q: %w", s.Name, err)
+		}
+		xValues, yValues = columns[0], columns[1]
+	}
+	if len(xValues) != len(yValues) {
+		return nil, fmt.Errorf("series %q: %d X values, %d Y values", s.Name, len(xValues), len(yValues))
+	}
+	series := &chart.ContinuousSeries{
+		Name: s.Name,
+		Style: chart.Style{
+			Show:        true,
+			StrokeColor: color,
+		},
+		XValues: xValues,
+		YValues: yValues,
+	}
+	if s.Fill {
+		series.Style.FillColor = color.WithAlpha(100)
+	}
+	if s.Secondary {
+		series.YAxis = chart.YAxisSecondary
+	}
+	return series, nil
+}
+
+// ChartSpec - chart of the kind KindSync (if empty) or KindDistribution
+type ChartSpec struct {
+	Kind           string       `json:"kind"`
+	XAxis          AxisSpec     `json:"xAxis"`
+	YAxis          AxisSpec     `json:"yAxis"`
+	YAxisSecondary AxisSpec     `json:"yAxisSecondary"`
+	Series         []SeriesSpec `json:"series"`
+}
+
+// ReadColumns reads the columns of the CSV file as floats. The first line is skipped if it can not be parsed,
+// as the header
+func ReadColumns(path string, columns ...int) ([][]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	values := make([][]float64, len(columns))
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		row := make([]float64, len(columns))
+		for i, column := range columns {
+			if column >= len(record) {
+				err = fmt.Errorf("%s:%d: no column %d", path, line, column)
+				break
+			}
+			if row[i], err = strconv.ParseFloat(strings.TrimSpace(record[column]), 64); err != nil {
+				err = fmt.Errorf("%s:%d: %w", path, line, err)
+				break
+			}
+		}
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, err
+		}
+		for i := range columns {
+			values[i] = append(values[i], row[i])
+		}
+	}
+}
+
+func newChart(spec ChartSpec) (*chart.Chart, []*chart.ContinuousSeries, error) {
+	if len(spec.Series) == 0 {
+		return nil, nil, errors.New("chart has no series")
+	}
+	graph := &chart.Chart{
+		Width:  1280,
+		Height: 720,
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top: 50,
+			},
+		},
+	}
+	var series []*chart.ContinuousSeries
+	for i, s := range spec.Series {
+		cs, err := s.series(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		series = append(series, cs)
+		graph.Series = append(graph.Series, cs)
+	}
+	graph.Elements = []chart.Renderable{chart.LegendThin(graph)}
+	return graph, series, nil
+}
+
+// SyncChart builds the chart of KindSync. Grid of the Y axis has the color of the first series
+func SyncChart(spec ChartSpec) (*chart.Chart, error) {
+	graph, series, err := newChart(spec)
+	if err != nil {
+		return nil, err
+	}
+	graph.XAxis = chart.XAxis{
+		Name: spec.XAxis.Name,
+		Style: chart.Style{
+			Show: true,
+		},
+		ValueFormatter: spec.XAxis.valueFormatter(),
+		GridMajorStyle: chart.Style{
+			Show:        true,
+			StrokeColor: chart.ColorAlternateGray,
+			StrokeWidth: 1.0,
+		},
+		GridLines: spec.XAxis.gridLines(),
+	}
+	graph.YAxis = spec.YAxis.yAxis(true, series[0].Style.StrokeColor)
+	for _, s := range spec.Series {
+		if s.Secondary {
+			graph.YAxisSecondary = spec.YAxisSecondary.yAxis(false, drawing.Color{})
+			break
+		}
+	}
+	return graph, nil
+}
+
+// DistributionChart builds the chart of KindDistribution. X axis spans from the smallest to the largest X value
+func DistributionChart(spec ChartSpec) (*chart.Chart, error) {
+	graph, series, err := newChart(spec)
+	if err != nil {
+		return nil, err
+	}
+	xRange := &chart.ContinuousRange{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, s := range series {
+		for _, x := range s.XValues {
+			xRange.Min, xRange.Max = math.Min(xRange.Min, x), math.Max(xRange.Max, x)
+		}
+	}
+	if xRange.Min > xRange.Max {
+		return nil, errors.New("chart has no values")
+	}
+	var ticks []chart.Tick
+	for _, t := range spec.XAxis.Ticks {
+		ticks = append(ticks, chart.Tick{Value: t.Value, Label: t.Label})
+	}
+	graph.XAxis = chart.XAxis{
+		Name: spec.XAxis.Name,
+		Style: chart.Style{
+			Show: true,
+		},
+		ValueFormatter: spec.XAxis.valueFormatter(),
+		GridMajorStyle: chart.Style{
+			Show:        true,
+			StrokeColor: chart.DefaultStrokeColor,
+			StrokeWidth: 1.0,
+		},
+		Range: xRange,
+		Ticks: ticks,
+	}
+	graph.YAxis = spec.YAxis.yAxis(true, chart.DefaultStrokeColor)
+	return graph, nil
+}
+
+// Build builds the chart of the kind of the spec
+func Build(spec ChartSpec) (*chart.Chart, error) {
+	switch spec.Kind {
+	case "", KindSync:
+		return SyncChart(spec)
+	case KindDistribution:
+		return DistributionChart(spec)
+	default:
+		return nil, fmt.Errorf("unknown kind of chart %q", spec.Kind)
+	}
+}
+
+func render(graph *chart.Chart, err error, out io.Writer) error {
+	if err != nil {
+		return err
+	}
+	return graph.Render(chart.PNG, out)
+}
+
+// RenderSyncChart writes the chart of KindSync as PNG
+func RenderSyncChart(spec ChartSpec, out io.Writer) error {
+	graph, err := SyncChart(spec)
+	return render(graph, err, out)
+}
+
+// RenderDistributionChart writes the chart of KindDistribution as PNG
+func RenderDistributionChart(spec ChartSpec, out io.Writer) error {
+	graph, err := DistributionChart(spec)
+	return render(graph, err, out)
+}
+
+// Render writes the chart of the kind of the spec as PNG
+func Render(spec ChartSpec, out io.Writer) error {
+	graph, err := Build(spec)
+	return render(graph, err, out)
+}
+
+// RenderFile writes the chart into the PNG file
+func RenderFile(spec ChartSpec, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = Render(spec, f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// LoadSpec reads the spec from the JSON file. Relative paths of the CSV files are resolved against the directory
+// of the spec
+func LoadSpec(path string) (ChartSpec, error) {
+	var spec ChartSpec
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return spec, err
+	}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, s := range spec.Series {
+		if s.CSV != "" && !filepath.IsAbs(s.CSV) {
+			spec.Series[i].CSV = filepath.Join(filepath.Dir(path), s.CSV)
+		}
+	}
+	return spec, nil
+}
@@ -0,0 +1,123 @@
+package report
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wcharczuk/go-chart"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestReadColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tg-report")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	columns, err := ReadColumns(writeFile(t, dir, "header.csv", "block,hours,size\n1, 0.5, 10\n2, 1.5, 20\n"), 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, [][]float64{{1, 2}, {10, 20}}, columns)
+
+	_, err = ReadColumns(writeFile(t, dir, "bad.csv", "1,2\n2,x\n"), 0, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bad.csv:2")
+	_, err = ReadColumns(writeFile(t, dir, "short.csv", "1,2\n2\n"), 0, 1)
+	require.Error(t, err)
+	_, err = ReadColumns(filepath.Join(dir, "missing.csv"), 0, 1)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSyncChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tg-report")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "sync.csv", "1,24,100\n2,48,200\n3,96,400\n")
+	writeFile(t, dir, "spec.json", `{
+		"xAxis": {"name": "Blocks, million", "format": "%.3fm", "gridLines": [1, 2]},
+		"yAxis": {"name": "Elapsed time", "format": "%d h", "gridLines": [24, 48, 72]},
+		"yAxisSecondary": {"format": "%.1f G", "scale": 100},
+		"series": [
+			{"name": "Sync time", "csv": "sync.csv", "x": 0, "y": 1, "fill": true, "color": "blue"},
+			{"name": "Database size", "csv": "sync.csv", "x": 0, "y": 2, "secondary": true}
+		]
+	}`)
+	spec, err := LoadSpec(filepath.Join(dir, "spec.json"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "sync.csv"), spec.Series[0].CSV, "relative to the spec")
+
+	graph, err := Build(spec)
+	require.NoError(t, err)
+	require.Len(t, graph.Series, 2)
+	timeSeries := graph.Series[0].(*chart.ContinuousSeries)
+	require.Equal(t, []float64{24, 48, 96}, timeSeries.YValues)
+	require.Equal(t, chart.ColorBlue, timeSeries.Style.StrokeColor)
+	require.Equal(t, chart.ColorBlue.WithAlpha(100), timeSeries.Style.FillColor)
+	sizeSeries := graph.Series[1].(*chart.ContinuousSeries)
+	require.Equal(t, chart.YAxisSecondary, sizeSeries.YAxis)
+	require.Equal(t, []float64{100, 200, 400}, sizeSeries.YValues)
+
+	require.Equal(t, "Blocks, million", graph.XAxis.Name)
+	require.Len(t, graph.XAxis.GridLines, 2)
+	require.Equal(t, "1.500m", graph.XAxis.ValueFormatter(1.5))
+	require.Equal(t, "Elapsed time", graph.YAxis.Name)
+	require.Len(t, graph.YAxis.GridLines, 3)
+	require.Equal(t, chart.ColorBlue, graph.YAxis.GridMajorStyle.StrokeColor, "grid of the first series")
+	require.Equal(t, "47 h", graph.YAxis.ValueFormatter(47.9))
+	require.True(t, graph.YAxisSecondary.Style.Show)
+	require.Equal(t, "2.5 G", graph.YAxisSecondary.ValueFormatter(250.0))
+	require.Len(t, graph.Elements, 1, "legend")
+
+	var png bytes.Buffer
+	require.NoError(t, Render(spec, &png))
+	require.True(t, bytes.HasPrefix(png.Bytes(), []byte("\x89PNG")))
+
+	spec.Series = spec.Series[:1]
+	graph, err = SyncChart(spec)
+	require.NoError(t, err)
+	require.False(t, graph.YAxisSecondary.Style.Show, "no series on the secondary axis")
+}
+
+func TestDistributionChart(t *testing.T) {
+	spec := ChartSpec{
+		Kind: KindDistribution,
+		XAxis: AxisSpec{Name: "Dust threshold", Ticks: []Tick{{0, "0"}, {1, "wei"}, {10, "10"}},
+			Formatter: func(v float64) string { return "x" }},
+		YAxis: AxisSpec{Name: "Node count", Format: "%.2fk", Scale: 1e3},
+		Series: []SeriesSpec{
+			{Name: "2-nodes", XValues: []float64{1, 10}, YValues: []float64{1000, 2000}},
+			{Name: "3-nodes", XValues: []float64{0.5, 5}, YValues: []float64{1, 2}},
+		},
+	}
+	graph, err := Build(spec)
+	require.NoError(t, err)
+	require.Len(t, graph.Series, 2)
+	require.NotEqual(t, graph.Series[0].(*chart.ContinuousSeries).Style.StrokeColor,
+		graph.Series[1].(*chart.ContinuousSeries).Style.StrokeColor, "alternate colors")
+	require.Equal(t, 0.5, graph.XAxis.Range.GetMin())
+	require.Equal(t, 10.0, graph.XAxis.Range.GetMax())
+	require.Len(t, graph.XAxis.Ticks, 3)
+	require.Equal(t, "wei", graph.XAxis.Ticks[1].Label)
+	require.Equal(t, "x", graph.XAxis.ValueFormatter(3.0))
+	require.Equal(t, "1.50k", graph.YAxis.ValueFormatter(1500.0))
+	require.Equal(t, chart.DefaultStrokeColor, graph.YAxis.GridMajorStyle.StrokeColor)
+
+	for _, broken := range []ChartSpec{
+		{},
+		{Kind: "pie", Series: spec.Series},
+		{Kind: KindDistribution, Series: []SeriesSpec{{Name: "empty"}}},
+		{Series: []SeriesSpec{{Name: "unknown color", Color: "mauve"}}},
+		{Series: []SeriesSpec{{Name: "uneven", XValues: []float64{1}}}},
+		{Series: []SeriesSpec{{Name: "missing", CSV: "no/such/file.csv"}}},
+	} {
+		_, err := Build(broken)
+		require.Error(t, err, "%+v", broken)
+	}
+}
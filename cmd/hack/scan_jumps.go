@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const (
+	// scanJumpsTimeout is the time given to the analysis of one contract
+	scanJumpsTimeout = 10 * time.Second
+	// scanJumpsInFlight is the number of contracts per worker that can be read ahead or wait to be written,
+	// which bounds the memory used by the scan
+	scanJumpsInFlight = 4
+)
+
+type scanJumpsTask struct {
+	seq      uint64
+	codeHash common.Hash
+	code     []byte
+}
+
+type scanJumpsResult struct {
+	seq      uint64
+	codeHash common.Hash
+	codeSize int
+	resolved bool
+	timeout  bool
+	badJumps int
+	edges    int
+	sources  []string // Opcodes which produced the unresolved jump destinations
+	duration time.Duration
+	err      string
+}
+
+// scanJumpsStats aggregates the results of the scan
+type scanJumpsStats struct {
+	total    int
+	resolved int
+	badJumps int // Contracts with jumps which could not be resolved statically
+	timeouts int
+	failed   int // Contracts whose analysis failed for other reasons
+	duration time.Duration
+	sources  map[string]int
+}
+
+func (s *scanJumpsStats) add(r *scanJumpsResult) {
+	s.total++
+	s.duration += r.duration
+	switch {
+	case r.resolved:
+		s.resolved++
+	case r.timeout:
+		s.timeouts++
+	case r.badJumps > 0:
+		s.badJumps++
+	default:
+		s.failed++
+	}
+	for _, source := range r.sources {
+		s.sources[source]++
+	}
+}
+
+func (s *scanJumpsStats) print() {
+	fmt.Printf("Contracts analysed: %d in %s\n", s.total, s.duration)
+	fmt.Printf("Fully resolved: %d, with non-static jumps: %d, timed out: %d, failed: %d\n", s.resolved, s.badJumps, s.timeouts, s.failed)
+	sources := make([]string, 0, len(s.sources))
+	for source := range s.sources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if s.sources[sources[i]] == s.sources[sources[j]] {
+			return sources[i] < sources[j]
+		}
+		return s.sources[sources[i]] > s.sources[sources[j]]
+	})
+	if len(sources) > 10 {
+		sources = sources[:10]
+	}
+	fmt.Printf("Top opcodes producing unresolved jump destinations:\n")
+	for _, source := range sources {
+		fmt.Printf("\t%s: %d\n", source, s.sources[source])
+	}
+}
+
+func analyseCode(task scanJumpsTask) (r *scanJumpsResult) {
+	r = &scanJumpsResult{seq: task.seq, codeHash: task.codeHash, codeSize: len(task.code)}
+	start := time.Now()
+	defer func() {
+		r.duration = time.Since(start)
+		// The analysis panics on internal inconsistencies, which should not stop the scan
+		if p := recover(); p != nil {
+			r.err = fmt.Sprintf("panic: %v", p)
+		}
+	}()
+	contract := vm.NewContract(dummyAccount{}, dummyAccount{}, uint256.NewInt(), 10000, false)
+	contract.Code = task.code
+	result, err := vm.AbsIntCfgHarnessWithTimeout(contract, scanJumpsTimeout)
+	r.resolved = err == nil
+	r.timeout = errors.Is(err, vm.ErrTimeout)
+	r.badJumps = len(result.BadJumps)
+	r.edges = result.ReachableEdges()
+	for _, badJump := range result.BadJumps {
+		r.sources = append(r.sources, badJump.Sources...)
+	}
+	if err != nil {
+		r.err = err.Error()
+	}
+	return r
+}
+
+// scanJumps runs the static jump analysis over every contract code in CodeBucket, writes a line per contract
+// into the CSV file, and prints the statistics. Lines are written in the order of code hashes, and the last
+// written code hash is persisted into <output>.progress, so that an interrupted scan resumes after it
+func scanJumps(chaindata string, output string) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+
+	progressFile := output + ".progress"
+	var startHash []byte
+	if progress, err := ioutil.ReadFile(progressFile); err == nil {
+		startHash = common.HexToHash(string(progress)).Bytes()
+		fmt.Printf("Resuming after code hash %x\n", startHash)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if startHash != nil {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(output, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	csvWriter := csv.NewWriter(w)
+	if startHash == nil {
+		if err = csvWriter.Write([]string{"code_hash", "code_size", "resolved", "bad_jumps", "reachable_edges", "duration_ms", "error"}); err != nil {
+			return err
+		}
+	}
+
+	// All analyses of the scan share the settings, which are not changed while the workers run
+	vm.StopOnError = false
+
+	workers := runtime.NumCPU()
+	inFlight := make(chan struct{}, workers*scanJumpsInFlight)
+	tasks := make(chan scanJumpsTask, workers)
+	results := make(chan *scanJumpsResult, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				results <- analyseCode(task)
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer func() {
+			close(tasks)
+			wg.Wait()
+			close(results)
+		}()
+		readErr = db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+			c := tx.Cursor(dbutils.CodeBucket)
+			var seq uint64
+			var k, v []byte
+			var err error
+			if startHash == nil {
+				k, v, err = c.First()
+			} else {
+				k, v, err = c.Seek(startHash)
+			}
+			// This is a mapping of CodeHash => Byte code
+			for ; k != nil; k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				if startHash != nil && common.BytesToHash(k) == common.BytesToHash(startHash) {
+					continue
+				}
+				inFlight <- struct{}{}
+				tasks <- scanJumpsTask{seq: seq, codeHash: common.BytesToHash(k), code: common.CopyBytes(v)}
+				seq++
+			}
+			return err
+		})
+	}()
+
+	// Results arrive out of order, they are buffered until all the preceding ones are written
+	stats := &scanJumpsStats{sources: make(map[string]int)}
+	pending := make(map[uint64]*scanJumpsResult)
+	var next uint64
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	for r := range results {
+		pending[r.seq] = r
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			delete(pending, next)
+			next++
+			<-inFlight
+			stats.add(r)
+			if err = csvWriter.Write([]string{
+				r.codeHash.Hex(),
+				strconv.Itoa(r.codeSize),
+				strconv.FormatBool(r.resolved),
+				strconv.Itoa(r.badJumps),
+				strconv.Itoa(r.edges),
+				strconv.FormatInt(r.duration.Milliseconds(), 10),
+				r.err,
+			}); err != nil {
+				return err
+			}
+			select {
+			default:
+			case <-logEvery.C:
+				csvWriter.Flush()
+				if err = w.Flush(); err != nil {
+					return err
+				}
+				if err = ioutil.WriteFile(progressFile, []byte(r.codeHash.Hex()), 0644); err != nil {
+					return err
+				}
+				fmt.Printf("Analysed %d contracts, last code hash %x\n", stats.total, r.codeHash)
+			}
+		}
+	}
+	if readErr != nil {
+		return readErr
+	}
+	csvWriter.Flush()
+	if err = csvWriter.Error(); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = os.Remove(progressFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stats.print()
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/cmd/hack/report"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// supplyRow - ether supply after the block, its change made by the block, and the block and uncle rewards
+// of the block. Change and rewards differ only when ether is burnt or created outside of the rewards
+type supplyRow struct {
+	block    uint64
+	supply   *big.Int
+	delta    *big.Int
+	issuance *big.Int
+}
+
+// currentSupply sums the balances of the accounts in the current state
+func currentSupply(tx ethdb.Tx) (*big.Int, int, error) {
+	count := 0
+	supply := uint256.NewInt()
+	var a accounts.Account
+	c := tx.Cursor(dbutils.PlainStateBucket)
+	defer c.Close()
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(k) != common.AddressLength {
+			continue
+		}
+		if err := a.DecodeForStorage(v); err != nil {
+			return nil, 0, err
+		}
+		count++
+		supply.Add(supply, &a.Balance)
+		if count%100000 == 0 {
+			fmt.Printf("Processed %dK account records\n", count/1000)
+		}
+	}
+	return supply.ToBig(), count, nil
+}
+
+// decodeBalance returns zero balance for the empty encoding of the account which does not exist
+func decodeBalance(enc []byte) (*uint256.Int, error) {
+	if len(enc) == 0 {
+		return uint256.NewInt(), nil
+	}
+	var a accounts.Account
+	if err := a.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	return a.Balance.Clone(), nil
+}
+
+// blockIssuance returns the block reward together with the rewards of the uncles included in the block
+func blockIssuance(db ethdb.Database, config *params.ChainConfig, blockNum uint64) (*big.Int, error) {
+	if blockNum == 0 {
+		return new(big.Int), nil
+	}
+	header := rawdb.ReadHeaderByNumber(db, blockNum)
+	if header == nil {
+		return nil, fmt.Errorf("header of block %d not found", blockNum)
+	}
+	body := rawdb.ReadBody(db, header.Hash(), blockNum)
+	if body == nil {
+		return nil, fmt.Errorf("body of block %d not found", blockNum)
+	}
+	reward, uncleRewards := ethash.AccumulateRewards(config, header, body.Uncles)
+	for i := range uncleRewards {
+		reward.Add(&reward, &uncleRewards[i])
+	}
+	return reward.ToBig(), nil
+}
+
+// supplyHistory reconstructs the ether supply after every block, from the block of the current state (progress of
+// the execution stage) down to the block `from`, walking the account change sets backwards once. The old balances
+// come from the change set of the block, the new ones from the newer change set of the account or from the current
+// state. Balances of the accounts changed by the newer blocks are kept in memory.
+// Rows are passed to f in descending order of the blocks
+func supplyHistory(db ethdb.Database, from uint64, f func(row supplyRow) error) error {
+	head, _, err := stages.GetStageProgress(db, stages.Execution)
+	if err != nil {
+		return err
+	}
+	genesisHash, err := rawdb.ReadCanonicalHash(db, 0)
+	if err != nil {
+		return err
+	}
+	config, err := rawdb.ReadChainConfig(db, genesisHash)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin(context.Background(), false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	kvTx := tx.(ethdb.HasTx).Tx()
+	supply, _, err := currentSupply(kvTx)
+	if err != nil {
+		return err
+	}
+
+	balances := make(map[common.Address]*uint256.Int)
+	c := kvTx.Cursor(dbutils.PlainAccountChangeSetBucket)
+	defer c.Close()
+	k, v, err := c.Seek(dbutils.EncodeTimestamp(head + 1))
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		k, v, err = c.Last()
+	} else {
+		k, v, err = c.Prev()
+	}
+	if err != nil {
+		return err
+	}
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	for blockNum := head; blockNum+1 > from; blockNum-- {
+		delta := new(big.Int)
+		if k != nil {
+			if timestamp, _ := dbutils.DecodeTimestamp(k); timestamp == blockNum {
+				if err = changeset.AccountChangeSetPlainBytes(v).Walk(func(address, enc []byte) error {
+					addr := common.BytesToAddress(address)
+					newBalance, ok := balances[addr]
+					if !ok {
+						current, err := kvTx.GetOne(dbutils.PlainStateBucket, address)
+						if err != nil {
+							return err
+						}
+						if newBalance, err = decodeBalance(current); err != nil {
+							return err
+						}
+					}
+					oldBalance, err := decodeBalance(enc)
+					if err != nil {
+						return err
+					}
+					delta.Add(delta, newBalance.ToBig())
+					delta.Sub(delta, oldBalance.ToBig())
+					balances[addr] = oldBalance
+					return nil
+				}); err != nil {
+					return err
+				}
+				if k, v, err = c.Prev(); err != nil {
+					return err
+				}
+			}
+		}
+		issuance, err := blockIssuance(tx, config, blockNum)
+		if err != nil {
+			return err
+		}
+		if err = f(supplyRow{block: blockNum, supply: new(big.Int).Set(supply), delta: delta, issuance: issuance}); err != nil {
+			return err
+		}
+		supply.Sub(supply, delta)
+
+		select {
+		default:
+		case <-logEvery.C:
+			fmt.Printf("Supply at block %d: %d, accounts in memory: %d\n", blockNum, supply, len(balances))
+		}
+		if blockNum == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// writeSupplyHistory writes the rows of the supply history as CSV and returns the totals of the changes and rewards,
+// and the number of blocks where they differ
+func writeSupplyHistory(db ethdb.Database, from uint64, w io.Writer, onRow func(row supplyRow)) (*big.Int, *big.Int, int, error) {
+	totalDelta, totalIssuance := new(big.Int), new(big.Int)
+	mismatches := 0
+	if _, err := fmt.Fprintf(w, "block,supply,delta,issuance\n"); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := supplyHistory(db, from, func(row supplyRow) error {
+		totalDelta.Add(totalDelta, row.delta)
+		totalIssuance.Add(totalIssuance, row.issuance)
+		if row.delta.Cmp(row.issuance) != 0 {
+			mismatches++
+		}
+		if onRow != nil {
+			onRow(row)
+		}
+		_, err := fmt.Fprintf(w, "%d,%d,%d,%d\n", row.block, row.supply, row.delta, row.issuance)
+		return err
+	}); err != nil {
+		return nil, nil, 0, err
+	}
+	return totalDelta, totalIssuance, mismatches, nil
+}
+
+func supply(chaindata string, from uint64, renderChart bool) error {
+	startTime := time.Now()
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	f, err := os.Create("supply.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var blocks, supplies []float64
+	var onRow func(row supplyRow)
+	if renderChart {
+		onRow = func(row supplyRow) {
+			eth, _ := new(big.Float).Quo(new(big.Float).SetInt(row.supply), big.NewFloat(params.Ether)).Float64()
+			blocks = append(blocks, float64(row.block))
+			supplies = append(supplies, eth)
+		}
+	}
+	totalDelta, totalIssuance, mismatches, err := writeSupplyHistory(db, from, w, onRow)
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Supply history written to supply.csv, change: %d, rewards: %d, blocks where they differ: %d, took: %s\n",
+		totalDelta, totalIssuance, mismatches, time.Since(startTime))
+	if renderChart {
+		return supplyChart(blocks, supplies)
+	}
+	return nil
+}
+
+func supplyChart(blocks, supplies []float64) error {
+	return report.RenderFile(report.ChartSpec{
+		XAxis: report.AxisSpec{Name: "Blocks, million", Format: "%.3fm", Scale: 1e6},
+		YAxis: report.AxisSpec{Name: "Supply", Format: "%.2fm ETH", Scale: 1e6},
+		Series: []report.SeriesSpec{
+			{Name: "Ether supply", XValues: blocks, YValues: supplies, Fill: true, Color: "blue"},
+		},
+	}, "supply.png")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeBalance(balance *big.Int) []byte {
+	if balance == nil {
+		return nil
+	}
+	a := accounts.NewAccount()
+	a.Initialised = true
+	b, _ := uint256.FromBig(balance)
+	a.Balance.Set(b)
+	v := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(v)
+	return v
+}
+
+func TestSupplyHistory(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+
+	genesisHash := common.HexToHash("0x01")
+	require.NoError(t, rawdb.WriteCanonicalHash(db, genesisHash, 0))
+	require.NoError(t, rawdb.WriteChainConfig(db, genesisHash, params.TestChainConfig))
+
+	sender, receiver := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	miner, uncleMiner := common.HexToAddress("0x03"), common.HexToAddress("0x04")
+	reward := big.NewInt(2e18)                            // Constantinople block reward
+	inclusion := new(big.Int).Div(reward, big.NewInt(32)) // reward for including the uncle
+	uncleReward := big.NewInt(1.75e18)                    // uncle of block 1 included in block 2
+
+	// Block 1 rewards the miner, block 2 includes an uncle and moves 10 wei between accounts,
+	// block 3 self-destructs the receiver, burning its 60 wei
+	var parent common.Hash
+	for blockNum := uint64(1); blockNum <= 3; blockNum++ {
+		header := &types.Header{Number: new(big.Int).SetUint64(blockNum), Coinbase: miner, ParentHash: parent, Difficulty: common.Big1}
+		body := &types.Body{}
+		if blockNum == 2 {
+			body.Uncles = []*types.Header{{Number: common.Big1, Coinbase: uncleMiner, Difficulty: common.Big2}}
+		}
+		rawdb.WriteHeader(ctx, db, header)
+		require.NoError(t, rawdb.WriteCanonicalHash(db, header.Hash(), blockNum))
+		rawdb.WriteBody(ctx, db, header.Hash(), blockNum, body)
+		parent = header.Hash()
+	}
+	minerAfter := func(blocks int64) *big.Int {
+		balance := new(big.Int).Mul(reward, big.NewInt(blocks))
+		if blocks >= 2 {
+			balance.Add(balance, inclusion)
+		}
+		return balance
+	}
+	changes := map[uint64][][2][]byte{
+		1: {{miner[:], nil}},
+		2: {{sender[:], encodeBalance(big.NewInt(100))}, {receiver[:], encodeBalance(big.NewInt(50))},
+			{miner[:], encodeBalance(minerAfter(1))}, {uncleMiner[:], nil}},
+		3: {{receiver[:], encodeBalance(big.NewInt(60))}, {miner[:], encodeBalance(minerAfter(2))}},
+	}
+	for blockNum, pairs := range changes {
+		cs := changeset.NewAccountChangeSetPlain()
+		for _, pair := range pairs {
+			require.NoError(t, cs.Add(pair[0], pair[1]))
+		}
+		v, err := changeset.EncodeAccountsPlain(cs)
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(blockNum), v))
+	}
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, sender[:], encodeBalance(big.NewInt(90))))
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, miner[:], encodeBalance(minerAfter(3))))
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, uncleMiner[:], encodeBalance(uncleReward)))
+	require.NoError(t, stages.SaveStageProgress(db, stages.Execution, 3, nil))
+
+	var rows []supplyRow
+	var csv bytes.Buffer
+	totalDelta, totalIssuance, mismatches, err := writeSupplyHistory(db, 0, &csv, func(row supplyRow) {
+		rows = append(rows, row)
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+
+	block2 := new(big.Int).Add(reward, inclusion)
+	block2.Add(block2, uncleReward)
+	expected := []struct {
+		delta    *big.Int
+		issuance *big.Int
+	}{
+		{new(big.Int).Sub(reward, big.NewInt(60)), reward},
+		{block2, block2},
+		{reward, reward},
+		{new(big.Int), new(big.Int)},
+	}
+	for i, row := range rows {
+		require.Equal(t, uint64(3-i), row.block)
+		require.Zero(t, expected[i].delta.Cmp(row.delta), "block %d: delta %d", row.block, row.delta)
+		require.Zero(t, expected[i].issuance.Cmp(row.issuance), "block %d: issuance %d", row.block, row.issuance)
+	}
+	require.Zero(t, big.NewInt(150).Cmp(rows[3].supply), "genesis supply %d", rows[3].supply)
+	require.Equal(t, 1, mismatches)
+	require.Zero(t, new(big.Int).Sub(totalIssuance, big.NewInt(60)).Cmp(totalDelta))
+	require.Contains(t, csv.String(), "block,supply,delta,issuance\n3,")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/turbo/trie"
+)
+
+// maxPrintedAccounts limits the number of accounts printed under the divergent prefix
+const maxPrintedAccounts = 16
+
+// stateOverlay is the state as of a historical block, on top of the current state
+type stateOverlay struct {
+	accountMap map[string]*accounts.Account
+	storageMap map[string][]byte
+	keys       []string // sorted keys of both maps
+}
+
+func newStateOverlay(db ethdb.Database, block, head uint64) (*stateOverlay, error) {
+	accountMap, storageMap, err := historicalState(db, block, head)
+	if err != nil {
+		return nil, err
+	}
+	o := &stateOverlay{accountMap: accountMap, storageMap: storageMap}
+	for ks := range accountMap {
+		o.keys = append(o.keys, ks)
+	}
+	for ks := range storageMap {
+		o.keys = append(o.keys, ks)
+	}
+	sort.Strings(o.keys)
+	return o, nil
+}
+
+// keysUnder returns the sorted keys of the overlay starting with the nibbles of the path
+func (o *stateOverlay) keysUnder(path []byte) []string {
+	var keys []string
+	for _, ks := range o.keys {
+		if hasNibblePrefix([]byte(ks), path) {
+			keys = append(keys, ks)
+		}
+	}
+	return keys
+}
+
+func hasNibblePrefix(key []byte, path []byte) bool {
+	if 2*len(key) < len(path) {
+		return false
+	}
+	for i, nibble := range path {
+		b := key[i/2]
+		if i%2 == 0 {
+			b >>= 4
+		}
+		if b&0xf != nibble {
+			return false
+		}
+	}
+	return true
+}
+
+// subTrieHash returns the hash of the subtrie of the accounts whose hashed addresses start with the path.
+// If useIH is set, the intermediate hashes are used wherever the overlay does not change the state,
+// otherwise the hash is computed from the state only. Nothing but the hash is kept in memory
+func subTrieHash(db ethdb.Database, path []byte, useIH bool, overlay *stateOverlay) (common.Hash, error) {
+	var dbPrefix []byte
+	for i, nibble := range path {
+		if i%2 == 0 {
+			dbPrefix = append(dbPrefix, nibble<<4)
+		} else {
+			dbPrefix[i/2] |= nibble
+		}
+	}
+	var rl trie.RetainDecider = trie.NewRetainAll(nil)
+	if useIH {
+		unfurl := trie.NewRetainList(0)
+		if overlay != nil {
+			for _, ks := range overlay.keysUnder(path) {
+				unfurl.AddKey([]byte(ks))
+			}
+		}
+		rl = unfurl
+	}
+	loader := trie.NewFlatDbSubTrieLoader()
+	if err := loader.Reset(db, rl, trie.NewRetainList(0), nil /* HashCollector */, [][]byte{dbPrefix}, []int{4 * len(path)}, false); err != nil {
+		return common.Hash{}, err
+	}
+	if overlay != nil {
+		r := &Receiver{defaultReceiver: trie.NewDefaultReceiver(), unfurlList: overlay.keysUnder(path), accountMap: overlay.accountMap, storageMap: overlay.storageMap}
+		r.defaultReceiver.Reset(trie.NewRetainList(0), nil /* HashCollector */, false)
+		loader.SetStreamReceiver(r)
+	}
+	subTries, err := loader.LoadSubTries()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return subTries.Hashes[0], nil
+}
+
+// rootMismatch describes the state root which does not match the header
+type rootMismatch struct {
+	expectedRoot common.Hash // state root in the header
+	computedRoot common.Hash // state root computed from the state
+	path         []byte      // nibbles of the shallowest subtrie whose hashes diverge, nil if none does
+	expected     common.Hash // hash of the subtrie given by the intermediate hashes
+	computed     common.Hash // hash of the subtrie computed from the state
+}
+
+// findRootMismatch recomputes the state root as of the block from the state, and compares it with the header.
+// If they differ, it descends nibble by nibble, comparing the hashes of the subtries computed from the state
+// with the ones given by the intermediate hashes, to find the shallowest divergent prefix.
+// It returns nil if the roots match
+func findRootMismatch(db ethdb.Database, block uint64) (*rootMismatch, error) {
+	hash, err := rawdb.ReadCanonicalHash(db, block)
+	if err != nil {
+		return nil, err
+	}
+	header := rawdb.ReadHeader(db, hash, block)
+	if header == nil {
+		return nil, fmt.Errorf("header of block %d not found", block)
+	}
+	var overlay *stateOverlay
+	if head := rawdb.ReadHeaderNumber(db, rawdb.ReadHeadBlockHash(db)); head != nil && block < *head {
+		if overlay, err = newStateOverlay(db, block, *head); err != nil {
+			return nil, err
+		}
+	}
+	computedRoot, err := subTrieHash(db, nil, false /* useIH */, overlay)
+	if err != nil {
+		return nil, err
+	}
+	if computedRoot == header.Root {
+		return nil, nil
+	}
+	m := &rootMismatch{expectedRoot: header.Root, computedRoot: computedRoot}
+	for len(m.path) < 2*common.HashLength {
+		diverged := false
+		for nibble := byte(0); nibble < 16 && !diverged; nibble++ {
+			child := append(append([]byte{}, m.path...), nibble)
+			expected, err := subTrieHash(db, child, true /* useIH */, overlay)
+			if err != nil {
+				return nil, err
+			}
+			computed, err := subTrieHash(db, child, false /* useIH */, overlay)
+			if err != nil {
+				return nil, err
+			}
+			if expected != computed {
+				m.path, m.expected, m.computed = child, expected, computed
+				diverged = true
+			}
+		}
+		if !diverged {
+			break
+		}
+	}
+	return m, nil
+}
+
+func verifyRoot(chaindata string, block uint64) error {
+	db := ethdb.MustOpen(chaindata)
+	defer db.Close()
+	m, err := findRootMismatch(db, block)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		fmt.Printf("State root of block %d matches the header\n", block)
+		return nil
+	}
+	fmt.Printf("State root of block %d: computed %x, expected %x\n", block, m.computedRoot, m.expectedRoot)
+	if m.path == nil {
+		fmt.Printf("Intermediate hashes agree with the state, the divergence cannot be localised\n")
+		return nil
+	}
+	fmt.Printf("Divergent prefix %x: computed %x, expected %x\n", m.path, m.computed, m.expected)
+	var dbPrefix []byte
+	for i := 0; i < len(m.path); i += 2 {
+		b := m.path[i] << 4
+		if i+1 < len(m.path) {
+			b |= m.path[i+1]
+		}
+		dbPrefix = append(dbPrefix, b)
+	}
+	printed := 0
+	return db.Walk(dbutils.CurrentStateBucket, dbPrefix, 4*len(m.path), func(k, v []byte) (bool, error) {
+		if len(k) != common.HashLength {
+			return true, nil
+		}
+		if printed == maxPrintedAccounts {
+			fmt.Printf("...\n")
+			return false, nil
+		}
+		printed++
+		var a accounts.Account
+		if err := a.DecodeForStorage(v); err != nil {
+			return false, err
+		}
+		fmt.Printf("%x: nonce %d, balance %d, code hash %x, incarnation %d\n", k, a.Nonce, a.Balance.ToBig(), a.CodeHash, a.Incarnation)
+		return true, nil
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/turbo/trie"
+	"github.com/stretchr/testify/require"
+)
+
+func putVerifyRootAccount(t *testing.T, db ethdb.Database, addrHash common.Hash, balance uint64) {
+	a := accounts.NewAccount()
+	a.Initialised = true
+	a.Balance.SetUint64(balance)
+	v := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(v)
+	require.NoError(t, db.Put(dbutils.CurrentStateBucket, addrHash.Bytes(), v))
+}
+
+func TestFindRootMismatch(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	var addrHashes []common.Hash
+	for i := 0; i < 300; i++ {
+		addrHash, err := common.HashData([]byte{byte(i >> 8), byte(i)})
+		require.NoError(t, err)
+		addrHashes = append(addrHashes, addrHash)
+		putVerifyRootAccount(t, db, addrHash, uint64(i+1))
+	}
+
+	// Generate the intermediate hashes and the header matching the state
+	collector := trie.NewETLHashCollector("", 256)
+	loader := trie.NewFlatDbSubTrieLoader()
+	require.NoError(t, loader.Reset(db, trie.NewRetainList(0), trie.NewRetainList(0), collector.Collect, [][]byte{nil}, []int{0}, false))
+	subTries, err := loader.LoadSubTries()
+	require.NoError(t, err)
+	require.NoError(t, collector.Load("verifyRoot", db, nil))
+
+	header := &types.Header{Number: common.Big1, Root: subTries.Hashes[0]}
+	rawdb.WriteHeader(context.Background(), db, header)
+	require.NoError(t, rawdb.WriteCanonicalHash(db, header.Hash(), 1))
+	rawdb.WriteHeadBlockHash(db, header.Hash())
+
+	m, err := findRootMismatch(db, 1)
+	require.NoError(t, err)
+	require.Nil(t, m)
+
+	corrupted := addrHashes[123]
+	putVerifyRootAccount(t, db, corrupted, 1000000)
+
+	m, err = findRootMismatch(db, 1)
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	require.Equal(t, header.Root, m.expectedRoot)
+	require.NotEqual(t, header.Root, m.computedRoot)
+	require.NotEmpty(t, m.path)
+	require.True(t, hasNibblePrefix(corrupted.Bytes(), m.path), "prefix %x does not cover %x", m.path, corrupted)
+	require.NotEqual(t, m.expected, m.computed)
+}
@@ -18,6 +18,7 @@ func Check(filesDir string) error {
 		nil,
 		3600, /* newAnchor future limit */
 		3600, /* newAnchor past limit */
+		nil,  /* preverifiedHashes */
 	)
 	if recovered, err := hd.RecoverFromFiles(uint64(time.Now().Unix())); err != nil || !recovered {
 		if err != nil {
@@ -9,10 +9,12 @@ var (
 	bufferSize int    // Size of buffer in MiB
 	natSetting string // NAT setting
 	port       int    // Listening port
+	chaindata  string // Path to the database where anchors and tips are stored
 )
 
 func init() {
 	downloadCmd.Flags().StringVar(&filesDir, "filesdir", "", "path to directory where files will be stored")
+	downloadCmd.Flags().StringVar(&chaindata, "chaindata", "", "path to the database where anchors and tips will be stored, files only if empty")
 	downloadCmd.Flags().IntVar(&bufferSize, "buffersize", 512, "size o the buffer in MiB")
 	downloadCmd.Flags().StringVar(&natSetting, "nat", "any", "NAT port mapping mechanism (any|none|upnp|pmp|extip:<IP>)")
 	downloadCmd.Flags().IntVar(&port, "port", 30303, "p2p port number")
@@ -23,6 +25,6 @@ var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download headers backwards",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return download.Download(natSetting, filesDir, bufferSize, port)
+		return download.Download(natSetting, filesDir, chaindata, bufferSize, port)
 	},
 }
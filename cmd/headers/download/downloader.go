@@ -12,6 +12,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/params"
 	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
@@ -27,8 +28,39 @@ func (cr chainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
 func (cr chainReader) GetHeaderByNumber(number uint64) *types.Header           { panic("") }
 func (cr chainReader) GetHeaderByHash(hash common.Hash) *types.Header          { panic("") }
 
-func processSegment(hd *headerdownload.HeaderDownload, segment *headerdownload.ChainSegment) {
-	log.Info(hd.AnchorState())
+// logSegmentError logs the error of processing a segment. Segments with tips below the tip limit are expected
+// to be rejected, they are not buffered either
+func logSegmentError(msg string, err error) {
+	if errors.Is(err, headerdownload.ErrTipBelowLimit) {
+		log.Debug(msg, "error", err)
+		return
+	}
+	log.Error(msg, "error", err)
+}
+
+// insertSegment writes the headers of the segment into the database, unless their parent is not there yet
+func insertSegment(db ethdb.Database, segment *headerdownload.ChainSegment, start, end int) {
+	if db == nil {
+		return
+	}
+	headers := make([]*types.Header, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		headers = append(headers, segment.Headers[i])
+	}
+	if err := headerdownload.InsertHeaders(db, headers); err != nil {
+		if errors.Is(err, headerdownload.ErrUnknownParent) {
+			log.Debug("Headers not inserted yet", "error", err)
+		} else {
+			log.Error("InsertHeaders failed", "error", err)
+		}
+	}
+}
+
+// processSegment attempts to attach the segment to the working trees, and returns the penalty that the peer
+// which sent the segment deserves
+func processSegment(hd *headerdownload.HeaderDownload, db ethdb.Database, kv ethdb.KV, segment *headerdownload.ChainSegment) headerdownload.Penalty {
+	penalty := headerdownload.NoPenalty
+	log.Info(hd.AnchorState(), "stats", hd.Stats())
 	log.Info("processSegment", "from", segment.Headers[0].Number.Uint64(), "to", segment.Headers[len(segment.Headers)-1].Number.Uint64())
 	foundAnchor, start, anchorParent, invalidAnchors := hd.FindAnchors(segment)
 	if len(invalidAnchors) > 0 {
@@ -36,11 +68,14 @@ func processSegment(hd *headerdownload.HeaderDownload, segment *headerdownload.C
 			log.Error("Invalidation of anchor failed", "error", err1)
 		}
 		log.Warn(fmt.Sprintf("Invalidated anchors %v for %x", invalidAnchors, anchorParent))
+		// The segment contradicts the anchors. The anchors have been dropped, but the segment may be the wrong one,
+		// so the sender is penalised too, and a peer that keeps doing this eventually gets banned
+		penalty = headerdownload.WrongChildDifficultyPenalty
 	}
-	foundTip, end, penalty := hd.FindTip(segment, start) // We ignore penalty because we will check it as part of PoW check
-	if penalty != headerdownload.NoPenalty {
-		log.Error(fmt.Sprintf("FindTip penalty %d", penalty))
-		return
+	foundTip, end, tipPenalty := hd.FindTip(segment, start)
+	if tipPenalty != headerdownload.NoPenalty {
+		log.Error(fmt.Sprintf("FindTip penalty %s", tipPenalty))
+		return tipPenalty
 	}
 	currentTime := uint64(time.Now().Unix())
 	var powDepth int
@@ -48,26 +83,30 @@ func processSegment(hd *headerdownload.HeaderDownload, segment *headerdownload.C
 		powDepth = powDepth1
 	} else {
 		log.Error("VerifySeals", "error", err1)
-		return
+		if sealPen := sealPenalty(err1); sealPen != headerdownload.NoPenalty {
+			return sealPen
+		}
+		return penalty
 	}
-	if err1 := hd.FlushBuffer(); err1 != nil {
+	if err1 := hd.FlushBuffer(kv); err1 != nil {
 		log.Error("Could not flush the buffer, will discard the data", "error", err1)
-		return
+		return penalty
 	}
 	// There are 4 cases
 	if foundAnchor {
 		if foundTip {
 			// Connect
 			if err1 := hd.Connect(segment, start, end, currentTime); err1 != nil {
-				log.Error("Connect failed", "error", err1)
+				logSegmentError("Connect failed", err1)
 			} else {
 				hd.AddSegmentToBuffer(segment, start, end)
+				insertSegment(db, segment, start, end)
 				log.Info("Connected", "start", start, "end", end)
 			}
 		} else {
 			// ExtendDown
 			if err1 := hd.ExtendDown(segment, start, end, powDepth, currentTime); err1 != nil {
-				log.Error("ExtendDown failed", "error", err1)
+				logSegmentError("ExtendDown failed", err1)
 			} else {
 				hd.AddSegmentToBuffer(segment, start, end)
 				log.Info("Extended Down", "start", start, "end", end)
@@ -79,16 +118,17 @@ func processSegment(hd *headerdownload.HeaderDownload, segment *headerdownload.C
 		} else {
 			// ExtendUp
 			if err1 := hd.ExtendUp(segment, start, end, currentTime); err1 != nil {
-				log.Error("ExtendUp failed", "error", err1)
+				logSegmentError("ExtendUp failed", err1)
 			} else {
 				hd.AddSegmentToBuffer(segment, start, end)
+				insertSegment(db, segment, start, end)
 				log.Info("Extended Up", "start", start, "end", end)
 			}
 		}
 	} else {
 		// NewAnchor
 		if err1 := hd.NewAnchor(segment, start, end, currentTime); err1 != nil {
-			log.Error("NewAnchor failed", "error", err1)
+			logSegmentError("NewAnchor failed", err1)
 		} else {
 			hd.AddSegmentToBuffer(segment, start, end)
 			log.Info("NewAnchor", "start", start, "end", end)
@@ -97,12 +137,14 @@ func processSegment(hd *headerdownload.HeaderDownload, segment *headerdownload.C
 	if start == 0 || end > 0 {
 		hd.CheckInitiation(segment, params.MainnetGenesisHash)
 	}
+	return penalty
 }
 
 // Downloader needs to be run from a go-routine, and it is in the sole control of the HeaderDownloader object
 func Downloader(
 	ctx context.Context,
 	filesDir string,
+	db ethdb.Database,
 	bufferLimit int,
 	newBlockCh chan NewBlockFromSentry,
 	newBlockHashCh chan NewBlockHashFromSentry,
@@ -126,6 +168,14 @@ func Downloader(
 	verifySealFunc := func(header *types.Header) error {
 		return engine.VerifySeal(cr, header)
 	}
+	var preverifiedHashes map[uint64]common.Hash
+	if _, err := os.Stat("preverified-hashes.dat"); err == nil {
+		if preverifiedHashes, err = headerdownload.ReadPreverifiedHashes("preverified-hashes.dat"); err != nil {
+			log.Error("Failed to read preverified hashes, all seals will be verified", "error", err)
+		} else {
+			log.Info("Loaded preverified hashes", "count", len(preverifiedHashes))
+		}
+	}
 	hd := headerdownload.NewHeaderDownload(
 		filesDir,
 		bufferLimit, /* bufferLimit */
@@ -135,9 +185,28 @@ func Downloader(
 		verifySealFunc,
 		3600, /* newAnchor future limit */
 		3600, /* newAnchor past limit */
+		preverifiedHashes,
 	)
+	hd.SetSkeletonThreshold(16 * headerdownload.MaxHeadersPerRequest)
+	var kv ethdb.KV
+	if db != nil {
+		kv = db.(ethdb.HasKV).KV()
+	}
 	hd.InitHardCodedTips("hard-coded-headers.dat")
-	if recovered, err := hd.RecoverFromFiles(uint64(time.Now().Unix())); err != nil || !recovered {
+	var recovered bool
+	if kv != nil {
+		if err := kv.View(ctx, func(tx ethdb.Tx) error {
+			var err error
+			recovered, err = hd.LoadState(tx, uint64(time.Now().Unix()))
+			return err
+		}); err != nil {
+			log.Error("Recovery from the database failed, will try the files", "error", err)
+			recovered = false
+		}
+	}
+	if recovered {
+		log.Info("Recovered from the database")
+	} else if recovered, err := hd.RecoverFromFiles(uint64(time.Now().Unix())); err != nil || !recovered {
 		if err != nil {
 			log.Error("Recovery from file failed, will start from scratch", "error", err)
 		}
@@ -167,16 +236,24 @@ func Downloader(
 		}
 	}
 	log.Info(hd.AnchorState())
+	penalties := NewPenaltyTracker(DefaultPenaltyWeights, DefaultBanThreshold, DefaultDecayInterval)
+	// penalise records the penalty and asks the sentry to ban the peer once its score crosses the threshold
+	penalise := func(msg SentryMsg, penalty headerdownload.Penalty) {
+		if penalty == headerdownload.NoPenalty {
+			return
+		}
+		if penalties.Add(headerdownload.PeerHandle(msg.sentryId), penalty, uint64(time.Now().Unix())) {
+			penaltyCh <- PenaltyMsg{SentryMsg: msg, penalty: penalty}
+		}
+	}
 	for {
 		select {
 		case newBlockReq := <-newBlockCh:
 			if segments, penalty, err := hd.SingleHeaderAsSegment(newBlockReq.Block.Header()); err == nil {
 				if penalty == headerdownload.NoPenalty {
-					processSegment(hd, segments[0]) // There is only one segment in this case
-				} else {
-					// Send penalty back to the sentry
-					penaltyCh <- PenaltyMsg{SentryMsg: newBlockReq.SentryMsg, penalty: penalty}
+					penalty = processSegment(hd, db, kv, segments[0]) // There is only one segment in this case
 				}
+				penalise(newBlockReq.SentryMsg, penalty)
 			} else {
 				log.Error("SingleHeaderAsSegment failed", "error", err)
 				continue
@@ -187,9 +264,10 @@ func Downloader(
 				if !hd.HasTip(announce.Hash) {
 					log.Info(fmt.Sprintf("Sending header request {hash: %x, height: %d, length: %d}", announce.Hash, announce.Number, 1))
 					reqHeadersCh <- headerdownload.HeaderRequest{
-						Hash:   announce.Hash,
-						Number: announce.Number,
-						Length: 1,
+						Hash:    announce.Hash,
+						Number:  announce.Number,
+						Amount:  1,
+						Reverse: true,
 					}
 				}
 			}
@@ -197,10 +275,10 @@ func Downloader(
 			if segments, penalty, err := hd.SplitIntoSegments(headersReq.headers); err == nil {
 				if penalty == headerdownload.NoPenalty {
 					for _, segment := range segments {
-						processSegment(hd, segment)
+						penalise(headersReq.SentryMsg, processSegment(hd, db, kv, segment))
 					}
 				} else {
-					penaltyCh <- PenaltyMsg{SentryMsg: headersReq.SentryMsg, penalty: penalty}
+					penalise(headersReq.SentryMsg, penalty)
 				}
 			} else {
 				log.Error("SingleHeaderAsSegment failed", "error", err)
@@ -213,7 +291,7 @@ func Downloader(
 		}
 		reqs := hd.RequestMoreHeaders(uint64(time.Now().Unix()), 5 /*timeout */)
 		for _, req := range reqs {
-			//log.Info(fmt.Sprintf("Sending header request {hash: %x, height: %d, length: %d}", req.Hash, req.Number, req.Length))
+			//log.Info(fmt.Sprintf("Sending header request {hash: %x, height: %d, amount: %d}", req.Hash, req.Number, req.Amount))
 			reqHeadersCh <- *req
 		}
 	}
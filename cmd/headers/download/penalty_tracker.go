@@ -0,0 +1,113 @@
+package download
+
+import (
+	"errors"
+
+	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
+)
+
+const (
+	// DefaultBanThreshold is the score at which a peer gets reported to the sentry for banning
+	DefaultBanThreshold = 20
+	// DefaultDecayInterval is the number of seconds it takes for a peer's score to decrease by one point
+	DefaultDecayInterval = 60
+)
+
+// DefaultPenaltyWeights specifies how much each kind of penalty contributes to the score of a peer.
+// Faults that cannot happen by accident (like invalid seals) weigh more than the ones that can be
+// caused by a slow or out-of-sync peer (like duplicate headers)
+var DefaultPenaltyWeights = map[headerdownload.Penalty]int{
+	headerdownload.BadBlockPenalty:              20,
+	headerdownload.DuplicateHeaderPenalty:       1,
+	headerdownload.WrongChildBlockHeightPenalty: 5,
+	headerdownload.WrongChildDifficultyPenalty:  5,
+	headerdownload.InvalidSealPenalty:           10,
+	headerdownload.TooFarFuturePenalty:          2,
+	headerdownload.TooFarPastPenalty:            2,
+}
+
+type peerScore struct {
+	score      int
+	lastUpdate uint64 // Time when the score was last decayed
+}
+
+// PenaltyTracker accumulates weighted penalty scores for peers. Once the score of a peer reaches the threshold,
+// the peer needs to be banned, and its score starts again from zero. Scores decay linearly over time,
+// so that occasional faults of otherwise well-behaving peers are forgiven
+type PenaltyTracker struct {
+	weights       map[headerdownload.Penalty]int
+	threshold     int
+	decayInterval uint64
+	scores        map[headerdownload.PeerHandle]*peerScore
+}
+
+func NewPenaltyTracker(weights map[headerdownload.Penalty]int, threshold int, decayInterval uint64) *PenaltyTracker {
+	return &PenaltyTracker{
+		weights:       weights,
+		threshold:     threshold,
+		decayInterval: decayInterval,
+		scores:        make(map[headerdownload.PeerHandle]*peerScore),
+	}
+}
+
+// decay brings the score of the peer up to date with currentTime, and removes the peer once it is fully forgiven
+func (pt *PenaltyTracker) decay(peer headerdownload.PeerHandle, currentTime uint64) *peerScore {
+	ps, ok := pt.scores[peer]
+	if !ok {
+		return nil
+	}
+	if pt.decayInterval == 0 || currentTime <= ps.lastUpdate {
+		return ps
+	}
+	points := (currentTime - ps.lastUpdate) / pt.decayInterval
+	if points >= uint64(ps.score) {
+		delete(pt.scores, peer)
+		return nil
+	}
+	ps.score -= int(points)
+	// Only advance by the whole intervals consumed, so that the remainder is not lost
+	ps.lastUpdate += points * pt.decayInterval
+	return ps
+}
+
+// Add records the penalty for the peer and returns true if the score of the peer has reached the ban threshold
+func (pt *PenaltyTracker) Add(peer headerdownload.PeerHandle, penalty headerdownload.Penalty, currentTime uint64) bool {
+	weight := pt.weights[penalty]
+	if weight <= 0 {
+		return false
+	}
+	ps := pt.decay(peer, currentTime)
+	if ps == nil {
+		ps = &peerScore{lastUpdate: currentTime}
+		pt.scores[peer] = ps
+	}
+	ps.score += weight
+	if ps.score < pt.threshold {
+		return false
+	}
+	delete(pt.scores, peer)
+	return true
+}
+
+// Score returns the current (decayed) score of the peer
+func (pt *PenaltyTracker) Score(peer headerdownload.PeerHandle, currentTime uint64) int {
+	if ps := pt.decay(peer, currentTime); ps != nil {
+		return ps.score
+	}
+	return 0
+}
+
+// sealPenalty chooses the penalty for the peer that sent a segment failing VerifySeals. Errors which are
+// not caused by the content of the segment do not incur any penalty
+func sealPenalty(err error) headerdownload.Penalty {
+	switch {
+	case errors.Is(err, headerdownload.ErrTooFarFuture):
+		return headerdownload.TooFarFuturePenalty
+	case errors.Is(err, headerdownload.ErrTooFarPast):
+		return headerdownload.TooFarPastPenalty
+	case errors.Is(err, headerdownload.ErrInvalidSeal):
+		return headerdownload.InvalidSealPenalty
+	default:
+		return headerdownload.NoPenalty
+	}
+}
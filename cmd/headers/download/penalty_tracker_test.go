@@ -0,0 +1,78 @@
+package download
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
+)
+
+func TestPenaltyBanThreshold(t *testing.T) {
+	pt := NewPenaltyTracker(DefaultPenaltyWeights, DefaultBanThreshold, DefaultDecayInterval)
+	peer := headerdownload.PeerHandle(1)
+	other := headerdownload.PeerHandle(2)
+	if pt.Add(peer, headerdownload.NoPenalty, 0) {
+		t.Errorf("NoPenalty must not ban")
+	}
+	if pt.Add(peer, headerdownload.InvalidSealPenalty, 0) {
+		t.Errorf("banned after first invalid seal, score %d", pt.Score(peer, 0))
+	}
+	if pt.Add(other, headerdownload.DuplicateHeaderPenalty, 0) {
+		t.Errorf("banned after duplicate header")
+	}
+	if !pt.Add(peer, headerdownload.InvalidSealPenalty, 0) {
+		t.Errorf("expected ban after second invalid seal")
+	}
+	if score := pt.Score(peer, 0); score != 0 {
+		t.Errorf("expected score to be reset after ban, got %d", score)
+	}
+	if score := pt.Score(other, 0); score != 1 {
+		t.Errorf("expected score of other peer 1, got %d", score)
+	}
+	if !pt.Add(other, headerdownload.BadBlockPenalty, 0) {
+		t.Errorf("expected ban after bad block")
+	}
+}
+
+func TestPenaltyDecay(t *testing.T) {
+	pt := NewPenaltyTracker(DefaultPenaltyWeights, DefaultBanThreshold, DefaultDecayInterval)
+	peer := headerdownload.PeerHandle(1)
+	pt.Add(peer, headerdownload.InvalidSealPenalty, 1000)
+	if score := pt.Score(peer, 1000+DefaultDecayInterval-1); score != 10 {
+		t.Errorf("expected no decay within one interval, got score %d", score)
+	}
+	if score := pt.Score(peer, 1000+3*DefaultDecayInterval+10); score != 7 {
+		t.Errorf("expected score 7 after 3 intervals, got %d", score)
+	}
+	// Remainder of the interval is carried over
+	if score := pt.Score(peer, 1000+4*DefaultDecayInterval); score != 6 {
+		t.Errorf("expected score 6 after 4 intervals, got %d", score)
+	}
+	// Decayed score is not enough for the ban
+	if pt.Add(peer, headerdownload.InvalidSealPenalty, 1000+4*DefaultDecayInterval) {
+		t.Errorf("banned with decayed score %d", pt.Score(peer, 1000+4*DefaultDecayInterval))
+	}
+	// Fully forgiven peers are forgotten
+	if score := pt.Score(peer, 1000+100*DefaultDecayInterval); score != 0 {
+		t.Errorf("expected score 0 after full decay, got %d", score)
+	}
+	if len(pt.scores) != 0 {
+		t.Errorf("expected fully decayed peer to be removed, got %d peers", len(pt.scores))
+	}
+}
+
+func TestSealPenalty(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		penalty headerdownload.Penalty
+	}{
+		{headerdownload.ErrTooFarFuture, headerdownload.TooFarFuturePenalty},
+		{headerdownload.ErrTooFarPast, headerdownload.TooFarPastPenalty},
+		{fmt.Errorf("%w for block %d: %v", headerdownload.ErrInvalidSeal, 1, "mismatch"), headerdownload.InvalidSealPenalty},
+		{fmt.Errorf("verifySeals anchors were not found"), headerdownload.NoPenalty},
+	} {
+		if penalty := sealPenalty(tc.err); penalty != tc.penalty {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.penalty, penalty)
+		}
+	}
+}
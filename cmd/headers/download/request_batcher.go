@@ -0,0 +1,161 @@
+package download
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultBatchWindow is how long header requests are collected before they are coalesced and sent
+	DefaultBatchWindow = 50 * time.Millisecond
+	// DefaultPeerRequestRate is the number of header requests per second that can be sent to one peer
+	DefaultPeerRequestRate = 10
+	// DefaultPeerRequestBurst is the number of header requests that can be sent to one peer at once
+	DefaultPeerRequestBurst = 20
+)
+
+// BatcherStats are the counters of requests sent by the RequestBatcher
+type BatcherStats struct {
+	BatchedSends      uint64 // Requests sent in place of several coalesced requests
+	IndividualSends   uint64 // Requests sent as they were received
+	CoalescedRequests uint64 // Requests received that were merged into the batched sends
+}
+
+func (bs BatcherStats) String() string {
+	return fmt.Sprintf("batched sends: %d (of %d requests), individual sends: %d", bs.BatchedSends, bs.CoalescedRequests, bs.IndividualSends)
+}
+
+// RequestBatcher collects header requests generated within a short window (for example, in response to a burst of
+// block announcements), and coalesces requests for nearby blocks into fewer requests with larger Amount
+type RequestBatcher struct {
+	window   time.Duration
+	pending  []headerdownload.HeaderRequest
+	deadline time.Time
+	stats    BatcherStats
+}
+
+func NewRequestBatcher(window time.Duration) *RequestBatcher {
+	return &RequestBatcher{window: window}
+}
+
+// Add puts the request into the current batch, the batch is ready to be sent once the window has passed since
+// its first request
+func (rb *RequestBatcher) Add(req headerdownload.HeaderRequest, now time.Time) {
+	if len(rb.pending) == 0 {
+		rb.deadline = now.Add(rb.window)
+	}
+	rb.pending = append(rb.pending, req)
+}
+
+// Flush returns the coalesced requests of the current batch, if its window has passed
+func (rb *RequestBatcher) Flush(now time.Time) []headerdownload.HeaderRequest {
+	if len(rb.pending) == 0 || now.Before(rb.deadline) {
+		return nil
+	}
+	reqs := rb.coalesce(rb.pending)
+	rb.pending = nil
+	return reqs
+}
+
+func (rb *RequestBatcher) Stats() BatcherStats {
+	return rb.stats
+}
+
+// lowestBlock is the lowest block height that the reverse request covers
+func lowestBlock(req *headerdownload.HeaderRequest) uint64 {
+	if uint64(req.Amount) > req.Number {
+		return 0
+	}
+	return req.Number + 1 - uint64(req.Amount)
+}
+
+// coalesce merges reverse contiguous requests, so that the request for the highest block also covers the lower blocks,
+// as long as the Amount does not exceed MaxHeadersPerRequest. This relies on the requested blocks being on the same
+// chain, which is normally the case for announcements. Blocks on other forks would be requested again later, when
+// their anchors are not extended. Other requests are left as they are
+func (rb *RequestBatcher) coalesce(reqs []headerdownload.HeaderRequest) []headerdownload.HeaderRequest {
+	var mergeable []headerdownload.HeaderRequest
+	var result []headerdownload.HeaderRequest
+	for _, req := range reqs {
+		if req.Reverse && req.Skip == 0 {
+			mergeable = append(mergeable, req)
+		} else {
+			result = append(result, req)
+			rb.stats.IndividualSends++
+		}
+	}
+	sort.SliceStable(mergeable, func(i, j int) bool { return mergeable[i].Number > mergeable[j].Number })
+	var current *headerdownload.HeaderRequest
+	var merged uint64
+	closeCurrent := func() {
+		if current == nil {
+			return
+		}
+		result = append(result, *current)
+		if merged > 1 {
+			rb.stats.BatchedSends++
+			rb.stats.CoalescedRequests += merged
+		} else {
+			rb.stats.IndividualSends++
+		}
+	}
+	for i := range mergeable {
+		req := &mergeable[i]
+		if current != nil {
+			lowest := lowestBlock(req)
+			sameBlock := req.Number == current.Number && req.Hash == current.Hash
+			if (sameBlock || req.Number < current.Number) && current.Number-lowest+1 <= headerdownload.MaxHeadersPerRequest {
+				if amount := int(current.Number - lowest + 1); amount > current.Amount {
+					current.Amount = amount
+				}
+				merged++
+				continue
+			}
+		}
+		closeCurrent()
+		current = &headerdownload.HeaderRequest{Hash: req.Hash, Number: req.Number, Amount: req.Amount, Reverse: true}
+		merged = 1
+	}
+	closeCurrent()
+	return result
+}
+
+// PeerRateLimiter is a token bucket for each peer, limiting the rate of requests sent to it
+type PeerRateLimiter struct {
+	lock     sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+}
+
+func NewPeerRateLimiter(requestsPerSecond float64, burst int) *PeerRateLimiter {
+	return &PeerRateLimiter{
+		limit:    rate.Limit(requestsPerSecond),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Allow takes a token from the bucket of the peer, and returns false if the bucket is empty
+func (prl *PeerRateLimiter) Allow(peerID string, now time.Time) bool {
+	prl.lock.Lock()
+	defer prl.lock.Unlock()
+	limiter, ok := prl.limiters[peerID]
+	if !ok {
+		limiter = rate.NewLimiter(prl.limit, prl.burst)
+		prl.limiters[peerID] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// Forget removes the bucket of the peer, once it has disconnected
+func (prl *PeerRateLimiter) Forget(peerID string) {
+	prl.lock.Lock()
+	defer prl.lock.Unlock()
+	delete(prl.limiters, peerID)
+}
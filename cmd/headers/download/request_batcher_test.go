@@ -0,0 +1,93 @@
+package download
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/turbo/stages/headerdownload"
+)
+
+func announcement(number uint64) headerdownload.HeaderRequest {
+	return headerdownload.HeaderRequest{Hash: common.BigToHash(new(big.Int).SetUint64(number)), Number: number, Amount: 1, Reverse: true}
+}
+
+func TestRequestBatcherAnnouncements(t *testing.T) {
+	rb := NewRequestBatcher(DefaultBatchWindow)
+	start := time.Unix(1000, 0)
+	// 100 rapid announcements of consecutive blocks, in random order
+	for i := 0; i < 100; i++ {
+		rb.Add(announcement(uint64(1000+(i*37)%100)), start.Add(time.Duration(i)*time.Microsecond))
+	}
+	if reqs := rb.Flush(start.Add(DefaultBatchWindow / 2)); reqs != nil {
+		t.Errorf("expected no requests before the window passed, got %d", len(reqs))
+	}
+	reqs := rb.Flush(start.Add(DefaultBatchWindow))
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	if reqs[0].Number != 1099 || reqs[0].Hash != announcement(1099).Hash || reqs[0].Amount != 100 || !reqs[0].Reverse {
+		t.Errorf("unexpected request %+v", reqs[0])
+	}
+	if stats := rb.Stats(); stats.BatchedSends != 1 || stats.CoalescedRequests != 100 || stats.IndividualSends != 0 {
+		t.Errorf("unexpected stats %s", stats)
+	}
+	if reqs = rb.Flush(start.Add(2 * DefaultBatchWindow)); reqs != nil {
+		t.Errorf("expected empty batch after flush, got %d requests", len(reqs))
+	}
+}
+
+func TestRequestBatcherLimits(t *testing.T) {
+	rb := NewRequestBatcher(DefaultBatchWindow)
+	now := time.Unix(1000, 0)
+	// Announcements spanning more than MaxHeadersPerRequest blocks
+	for i := uint64(0); i < 300; i++ {
+		rb.Add(announcement(10000+i), now)
+	}
+	// Skeleton request is never merged
+	skeleton := headerdownload.HeaderRequest{Hash: common.Hash{1}, Number: 500, Amount: 10, Skip: headerdownload.MaxHeadersPerRequest - 1, Reverse: true}
+	rb.Add(skeleton, now)
+	// Distant announcement is sent on its own
+	rb.Add(announcement(20000), now)
+	reqs := rb.Flush(now.Add(DefaultBatchWindow))
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 requests, got %d: %+v", len(reqs), reqs)
+	}
+	if reqs[0] != skeleton {
+		t.Errorf("expected skeleton request unchanged, got %+v", reqs[0])
+	}
+	if reqs[1].Number != 20000 || reqs[1].Amount != 1 {
+		t.Errorf("unexpected distant request %+v", reqs[1])
+	}
+	if reqs[2].Number != 10299 || reqs[2].Amount != headerdownload.MaxHeadersPerRequest {
+		t.Errorf("unexpected first batch %+v", reqs[2])
+	}
+	if reqs[3].Number != 10299-headerdownload.MaxHeadersPerRequest || reqs[3].Amount != 300-headerdownload.MaxHeadersPerRequest {
+		t.Errorf("unexpected second batch %+v", reqs[3])
+	}
+	if stats := rb.Stats(); stats.BatchedSends != 2 || stats.CoalescedRequests != 300 || stats.IndividualSends != 2 {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+func TestPeerRateLimiter(t *testing.T) {
+	prl := NewPeerRateLimiter(1, 2)
+	now := time.Unix(1000, 0)
+	if !prl.Allow("a", now) || !prl.Allow("a", now) {
+		t.Errorf("expected burst of 2 to be allowed")
+	}
+	if prl.Allow("a", now) {
+		t.Errorf("expected third request to be refused")
+	}
+	if !prl.Allow("b", now) {
+		t.Errorf("expected other peer to have its own bucket")
+	}
+	if !prl.Allow("a", now.Add(time.Second)) {
+		t.Errorf("expected the bucket to refill after a second")
+	}
+	prl.Forget("a")
+	if !prl.Allow("a", now.Add(time.Second)) || !prl.Allow("a", now.Add(time.Second)) {
+		t.Errorf("expected forgotten peer to start with full bucket")
+	}
+}
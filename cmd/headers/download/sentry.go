@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/p2p"
 	"github.com/ledgerwatch/turbo-geth/p2p/dnsdisc"
@@ -82,6 +84,7 @@ func makeP2PServer(
 	newBlockHashCh chan NewBlockHashFromSentry,
 	headersCh chan BlockHeadersFromSentry,
 	penaltyCh chan PenaltyMsg,
+	peerLimiter *PeerRateLimiter,
 ) (*p2p.Server, error) {
 	client := dnsdisc.NewClient(dnsdisc.Config{})
 
@@ -137,6 +140,7 @@ func makeP2PServer(
 				peerHeightMap.Delete(peerID)
 				peerTimeMap.Delete(peerID)
 				peerRwMap.Delete(peerID)
+				peerLimiter.Forget(peerID)
 				return nil
 			},
 		},
@@ -148,6 +152,17 @@ func makeP2PServer(
 	return &p2p.Server{Config: p2pConfig}, nil
 }
 
+// inboundTimeout is how long a peer goroutine waits for the downloader to accept an inbound message, before dropping it
+const inboundTimeout = 5 * time.Second
+
+// droppedInbound counts inbound messages dropped because the downloader did not keep up
+var droppedInbound uint64
+
+func dropInbound(peerID string, msgName string) {
+	dropped := atomic.AddUint64(&droppedInbound, 1)
+	log.Warn(fmt.Sprintf("[%s] Downloader is busy, dropped %s", peerID, msgName), "dropped total", dropped)
+}
+
 func errResp(code int, format string, v ...interface{}) error {
 	return fmt.Errorf("%v - %v", code, fmt.Sprintf(format, v...))
 }
@@ -257,7 +272,11 @@ func runPeer(
 				hashesStr.WriteString(fmt.Sprintf("%x-%x(%d)", hash[:4], hash[28:], header.Number.Uint64()))
 			}
 			log.Info(fmt.Sprintf("[%s] BlockHeadersMsg{%s}", peerID, hashesStr.String()))
-			headersCh <- BlockHeadersFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, headers: headers}
+			select {
+			case headersCh <- BlockHeadersFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, headers: headers}:
+			case <-time.After(inboundTimeout):
+				dropInbound(peerID, "BlockHeadersMsg")
+			}
 		case eth.GetBlockBodiesMsg:
 			// Decode the retrieval message
 			msgStream := rlp.NewStream(msg.Payload, uint64(msg.Size))
@@ -307,7 +326,11 @@ func runPeer(
 			}
 			peerMap.Store(peerID, highestBlock)
 			log.Info(fmt.Sprintf("[%s] NewBlockHashesMsg {%s}", peerID, numStr.String()))
-			newBlockHashCh <- NewBlockHashFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, NewBlockHashesData: announces}
+			select {
+			case newBlockHashCh <- NewBlockHashFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, NewBlockHashesData: announces}:
+			case <-time.After(inboundTimeout):
+				dropInbound(peerID, "NewBlockHashesMsg")
+			}
 		case eth.NewBlockMsg:
 			var request eth.NewBlockData
 			if err = msg.Decode(&request); err != nil {
@@ -321,7 +344,11 @@ func runPeer(
 				peerMap.Store(peerID, highestBlock)
 			}
 			log.Info(fmt.Sprintf("[%s] NewBlockMsg{blockNumber: %d}", peerID, blockNum))
-			newBlockCh <- NewBlockFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, NewBlockData: request}
+			select {
+			case newBlockCh <- NewBlockFromSentry{SentryMsg: SentryMsg{sentryId: 0, requestId: 0}, NewBlockData: request}:
+			case <-time.After(inboundTimeout):
+				dropInbound(peerID, "NewBlockMsg")
+			}
 		case eth.NewPooledTransactionHashesMsg:
 			var hashes []common.Hash
 			if err := msg.Decode(&hashes); err != nil {
@@ -378,15 +405,26 @@ func rootContext() context.Context {
 	return ctx
 }
 
-func Download(natSetting string, filesDir string, bufferSize int, port int) error {
+func Download(natSetting string, filesDir string, chaindata string, bufferSize int, port int) error {
 	ctx := rootContext()
+	var db ethdb.Database
+	if chaindata != "" {
+		objectDb := ethdb.MustOpen(chaindata)
+		defer objectDb.Close()
+		// Headers are inserted on top of the genesis, which is written if the database is empty
+		if _, _, _, err := core.SetupGenesisBlock(objectDb, nil /* genesis */, false /* history */, false /* overwrite */); err != nil {
+			return fmt.Errorf("setup genesis: %w", err)
+		}
+		db = objectDb
+	}
 	newBlockCh := make(chan NewBlockFromSentry)
 	newBlockHashCh := make(chan NewBlockHashFromSentry)
 	penaltyCh := make(chan PenaltyMsg)
 	reqHeadersCh := make(chan headerdownload.HeaderRequest)
 	headersCh := make(chan BlockHeadersFromSentry)
 	var peerHeightMap, peerRwMap, peerTimeMap sync.Map
-	server, err := makeP2PServer(natSetting, port, &peerHeightMap, &peerTimeMap, &peerRwMap, []string{eth.ProtocolName}, newBlockCh, newBlockHashCh, headersCh, penaltyCh)
+	peerLimiter := NewPeerRateLimiter(DefaultPeerRequestRate, DefaultPeerRequestBurst)
+	server, err := makeP2PServer(natSetting, port, &peerHeightMap, &peerTimeMap, &peerRwMap, []string{eth.ProtocolName}, newBlockCh, newBlockHashCh, headersCh, penaltyCh, peerLimiter)
 	if err != nil {
 		return err
 	}
@@ -394,7 +432,53 @@ func Download(natSetting string, filesDir string, bufferSize int, port int) erro
 	if err = server.Start(); err != nil {
 		return fmt.Errorf("could not start server: %w", err)
 	}
-	go Downloader(ctx, filesDir, bufferSize*1024*1024, newBlockCh, newBlockHashCh, headersCh, penaltyCh, reqHeadersCh)
+	go Downloader(ctx, filesDir, db, bufferSize*1024*1024, newBlockCh, newBlockHashCh, headersCh, penaltyCh, reqHeadersCh)
+
+	// Requests are coalesced within the batch window, and each peer gets only a limited rate of requests,
+	// so that a burst of announcements, or a misbehaving request loop, does not flood the peers
+	batcher := NewRequestBatcher(DefaultBatchWindow)
+	batchTicker := time.NewTicker(DefaultBatchWindow)
+	defer batchTicker.Stop()
+	sendHeaderRequest := func(req headerdownload.HeaderRequest) {
+		// Choose a peer that we can send this request to
+		var peerID string
+		var found bool
+		now := time.Now()
+		peerHeightMap.Range(func(key, value interface{}) bool {
+			valUint, _ := value.(uint64)
+			if valUint >= req.Number {
+				peerID = key.(string)
+				timeRaw, _ := peerTimeMap.Load(peerID)
+				t, _ := timeRaw.(int64)
+				// If request is large, we give 5 second pause to the peer before sending another request, unless it responded
+				if (req.Amount == 1 || t <= now.Unix()) && peerLimiter.Allow(peerID, now) {
+					found = true
+					return false
+				}
+			}
+			return true
+		})
+		if !found {
+			//log.Warn(fmt.Sprintf("Could not find suitable peer to send GetBlockHeadersData request for block %d", req.Number))
+			return
+		}
+		log.Info(fmt.Sprintf("Sending req for hash %x, blocknumber %d, amount %d, skip %d to peer %s\n", req.Hash, req.Number, req.Amount, req.Skip, peerID))
+		rwRaw, _ := peerRwMap.Load(peerID)
+		rw, _ := rwRaw.(p2p.MsgReadWriter)
+		if rw == nil {
+			log.Error(fmt.Sprintf("Could not find rw for peer %s", peerID))
+			return
+		}
+		if err := p2p.Send(rw, eth.GetBlockHeadersMsg, &eth.GetBlockHeadersData{
+			Amount:  uint64(req.Amount),
+			Reverse: req.Reverse,
+			Skip:    req.Skip,
+			Origin:  eth.HashOrNumber{Hash: req.Hash},
+		}); err != nil {
+			log.Error(fmt.Sprintf("Failed to send to peer %s: %v", peerID, err))
+		}
+		peerTimeMap.Store(peerID, now.Unix()+5)
+	}
 
 	go func() {
 		for {
@@ -402,44 +486,16 @@ func Download(natSetting string, filesDir string, bufferSize int, port int) erro
 			case <-ctx.Done():
 				return
 			case req := <-penaltyCh:
-				log.Warn(fmt.Sprintf("Received penalty %s for peer %d req %d", req.penalty, req.SentryMsg.sentryId, req.SentryMsg.requestId))
+				log.Warn(fmt.Sprintf("Peer %d crossed the penalty threshold with %s (req %d), banning", req.SentryMsg.sentryId, req.penalty, req.SentryMsg.requestId))
 			case req := <-reqHeadersCh:
-				// Choose a peer that we can send this request to
-				var peerID string
-				var found bool
-				peerHeightMap.Range(func(key, value interface{}) bool {
-					valUint, _ := value.(uint64)
-					if valUint >= req.Number {
-						peerID = key.(string)
-						timeRaw, _ := peerTimeMap.Load(peerID)
-						t, _ := timeRaw.(int64)
-						// If request is large, we give 5 second pause to the peer before sending another request, unless it responded
-						if req.Length == 1 || t <= time.Now().Unix() {
-							found = true
-							return false
-						}
-					}
-					return true
-				})
-				if !found {
-					//log.Warn(fmt.Sprintf("Could not find suitable peer to send GetBlockHeadersData request for block %d", req.Number))
-				} else {
-					log.Info(fmt.Sprintf("Sending req for hash %x, blocknumber %d, length %d to peer %s\n", req.Hash, req.Number, req.Length, peerID))
-					rwRaw, _ := peerRwMap.Load(peerID)
-					rw, _ := rwRaw.(p2p.MsgReadWriter)
-					if rw == nil {
-						log.Error(fmt.Sprintf("Could not find rw for peer %s", peerID))
-					} else {
-						if err := p2p.Send(rw, eth.GetBlockHeadersMsg, &eth.GetBlockHeadersData{
-							Amount:  uint64(req.Length),
-							Reverse: true,
-							Skip:    0,
-							Origin:  eth.HashOrNumber{Hash: req.Hash},
-						}); err != nil {
-							log.Error(fmt.Sprintf("Failed to send to peer %s: %v", peerID, err))
-						}
-						peerTimeMap.Store(peerID, time.Now().Unix()+5)
-					}
+				batcher.Add(req, time.Now())
+			case <-batchTicker.C:
+				reqs := batcher.Flush(time.Now())
+				for _, req := range reqs {
+					sendHeaderRequest(req)
+				}
+				if len(reqs) > 0 {
+					log.Debug("Header requests sent", "stats", batcher.Stats())
 				}
 			}
 		}
@@ -12,6 +12,7 @@ var (
 	compact            bool
 	referenceChaindata string
 	block              uint64
+	toBlock            uint64
 	unwind             uint64
 	unwindEvery        uint64
 	batchSizeStr       string
@@ -58,6 +59,10 @@ func withBlock(cmd *cobra.Command) {
 	cmd.Flags().Uint64Var(&block, "block", 0, "block test at this block")
 }
 
+func withToBlock(cmd *cobra.Command) {
+	cmd.Flags().Uint64Var(&toBlock, "to", 0, "last block of the range, 0 - up to the last executed block")
+}
+
 func withUnwind(cmd *cobra.Command) {
 	cmd.Flags().Uint64Var(&unwind, "unwind", 0, "how much blocks unwind on each iteration")
 }
@@ -131,14 +131,17 @@ func resetState(_ context.Context) error {
 func resetSenders(db *ethdb.ObjectDatabase) error {
 	if err := db.ClearBuckets(
 		dbutils.Senders,
+		dbutils.Senders2,
 	); err != nil {
 		return err
 	}
-	if err := stages.SaveStageProgress(db, stages.Senders, 0, nil); err != nil {
-		return err
-	}
-	if err := stages.SaveStageUnwind(db, stages.Senders, 0, nil); err != nil {
-		return err
+	for _, stage := range []stages.SyncStage{stages.Senders, stages.Senders2} {
+		if err := stages.SaveStageProgress(db, stage, 0, nil); err != nil {
+			return err
+		}
+		if err := stages.SaveStageUnwind(db, stage, 0, nil); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -91,6 +91,19 @@ var cmdStageHistory = &cobra.Command{
 	},
 }
 
+var cmdRebuildHistoryIndex = &cobra.Command{
+	Use:   "rebuild_history_index",
+	Short: "Rebuild account and storage history index of the blocks range [--block, --to] from the changesets",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := utils.RootContext()
+		if err := rebuildHistoryIndex(ctx); err != nil {
+			log.Error("Error", "err", err)
+			return err
+		}
+		return nil
+	},
+}
+
 var cmdLogIndex = &cobra.Command{
 	Use:   "stage_log_index",
 	Short: "",
@@ -232,6 +245,15 @@ func init() {
 
 	rootCmd.AddCommand(cmdStageHistory)
 
+	withChaindata(cmdRebuildHistoryIndex)
+	withMapSize(cmdRebuildHistoryIndex)
+	withFreelistReuse(cmdRebuildHistoryIndex)
+	withBlock(cmdRebuildHistoryIndex)
+	withToBlock(cmdRebuildHistoryIndex)
+	withDatadir(cmdRebuildHistoryIndex)
+
+	rootCmd.AddCommand(cmdRebuildHistoryIndex)
+
 	withChaindata(cmdLogIndex)
 	withMapSize(cmdLogIndex)
 	withFreelistReuse(cmdLogIndex)
@@ -550,6 +572,30 @@ func stageHistory(ctx context.Context) error {
 	return nil
 }
 
+func rebuildHistoryIndex(ctx context.Context) error {
+	tmpdir := path.Join(datadir, etl.TmpDirName)
+
+	db := openDatabase()
+	defer db.Close()
+
+	err := SetSnapshotKV(db, snapshotDir, snapshotMode)
+	if err != nil {
+		panic(err)
+	}
+
+	to := toBlock
+	if to == 0 {
+		if to, _, err = stages.GetStageProgress(db, stages.Execution); err != nil {
+			return err
+		}
+	}
+	log.Info("Rebuilding history index", "from", block, "to", to)
+	if err := core.RebuildHistoryIndexRange("AccountHistoryIndex", db, true /* plain */, false /* storage */, block, to, tmpdir, ctx.Done()); err != nil {
+		return err
+	}
+	return core.RebuildHistoryIndexRange("StorageHistoryIndex", db, true /* plain */, true /* storage */, block, to, tmpdir, ctx.Done())
+}
+
 func stageTxLookup(ctx context.Context) error {
 	core.UsePlainStateExecution = true
 	tmpdir := path.Join(datadir, etl.TmpDirName)
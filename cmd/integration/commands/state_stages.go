@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/turbo-geth/cmd/utils"
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -306,9 +307,12 @@ func checkHistory(db ethdb.Getter, changeSetBucket string, blockNum uint64) erro
 				return innerErr
 			}
 
-			index := dbutils.WrapHistoryIndex(indexBytes)
-			if findVal, _, ok := index.Search(blockNum); !ok {
-				return fmt.Errorf("%v,%v,%v", blockNum, findVal, common.Bytes2Hex(key))
+			index := roaring.New()
+			if _, innerErr = index.FromBuffer(indexBytes); innerErr != nil {
+				return innerErr
+			}
+			if !index.Contains(uint32(blockNum)) {
+				return fmt.Errorf("%v,%v", blockNum, common.Bytes2Hex(key))
 			}
 			return nil
 		}); err != nil {
@@ -1,8 +1,11 @@
 package cli
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -10,26 +13,34 @@ import (
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/internal/debug"
 	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/metrics"
 	"github.com/ledgerwatch/turbo-geth/node"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 	"github.com/spf13/cobra"
 )
 
 type Flags struct {
-	PrivateApiAddr    string
-	Chaindata         string
-	HttpListenAddress string
-	TLSCertfile       string
-	TLSCACert         string
-	TLSKeyFile        string
-	HttpPort          int
-	HttpCORSDomain    []string
-	HttpVirtualHost   []string
-	API               []string
-	Gascap            uint64
-	MaxTraces         uint64
-	TraceType         string
-	WebsocketEnabled  bool
+	PrivateApiAddr      string
+	PrivateApiTokenFile string
+	Chaindata           string
+	HttpListenAddress   string
+	TLSCertfile         string
+	TLSCACert           string
+	TLSKeyFile          string
+	HttpPort            int
+	HttpCORSDomain      []string
+	HttpVirtualHost     []string
+	API                 []string
+	Gascap              uint64
+	MaxTraces           uint64
+	TraceType           string
+	WebsocketEnabled    bool
+	DrainTimeout        time.Duration
+	NoRequestLog        bool
+	SlowCallThreshold   time.Duration
+	LogSampleRate       uint64
+	HistoryCacheSize    int
+	TxEnvCacheSize      int
 }
 
 var rootCmd = &cobra.Command{
@@ -52,11 +63,19 @@ func RootCommand() (*cobra.Command, *Flags) {
 
 	cfg := &Flags{}
 	rootCmd.PersistentFlags().StringVar(&cfg.PrivateApiAddr, "private.api.addr", "127.0.0.1:9090", "private api network address, for example: 127.0.0.1:9090, empty string means not to start the listener. do not expose to public network. serves remote database interface")
-	rootCmd.PersistentFlags().StringVar(&cfg.Chaindata, "chaindata", "", "path to the database")
+	rootCmd.PersistentFlags().StringVar(&cfg.Chaindata, "chaindata", "", "path to the database, opened directly in read-only mode instead of connecting to --private.api.addr")
 	rootCmd.PersistentFlags().StringVar(&cfg.HttpListenAddress, "http.addr", node.DefaultHTTPHost, "HTTP-RPC server listening interface")
+	rootCmd.PersistentFlags().StringVar(&cfg.TLSCertfile, "private.api.tls.cert", "", "certificate of the rpcdaemon for the TLS connection to --private.api.addr; without --private.api.tls.ca it is the certificate of the node")
+	rootCmd.PersistentFlags().StringVar(&cfg.TLSKeyFile, "private.api.tls.key", "", "key of --private.api.tls.cert")
+	rootCmd.PersistentFlags().StringVar(&cfg.TLSCACert, "private.api.tls.ca", "", "CA certificate which issued the certificates of the node and of the rpcdaemon, enables mutual TLS")
+	rootCmd.PersistentFlags().StringVar(&cfg.PrivateApiTokenFile, "private.api.token.file", "", "file with the token required by the node, see --private.api.token.file of turbo-geth")
+	// old names of the TLS flags
 	rootCmd.PersistentFlags().StringVar(&cfg.TLSCertfile, "tls.cert", "", "certificate for client side TLS handshake")
 	rootCmd.PersistentFlags().StringVar(&cfg.TLSKeyFile, "tls.key", "", "key file for client side TLS handshake")
 	rootCmd.PersistentFlags().StringVar(&cfg.TLSCACert, "tls.cacert", "", "CA certificate for client side TLS handshake")
+	_ = rootCmd.PersistentFlags().MarkDeprecated("tls.cert", "use --private.api.tls.cert")
+	_ = rootCmd.PersistentFlags().MarkDeprecated("tls.key", "use --private.api.tls.key")
+	_ = rootCmd.PersistentFlags().MarkDeprecated("tls.cacert", "use --private.api.tls.ca")
 	rootCmd.PersistentFlags().IntVar(&cfg.HttpPort, "http.port", node.DefaultHTTPPort, "HTTP-RPC server listening port")
 	rootCmd.PersistentFlags().StringSliceVar(&cfg.HttpCORSDomain, "http.corsdomain", []string{}, "Comma separated list of domains from which to accept cross origin requests (browser enforced)")
 	rootCmd.PersistentFlags().StringSliceVar(&cfg.HttpVirtualHost, "http.vhosts", node.DefaultConfig.HTTPVirtualHosts, "Comma separated list of virtual hostnames from which to accept requests (server enforced). Accepts '*' wildcard.")
@@ -65,6 +84,12 @@ func RootCommand() (*cobra.Command, *Flags) {
 	rootCmd.PersistentFlags().Uint64Var(&cfg.MaxTraces, "trace.maxtraces", 200, "Sets a limit on traces that can be returned in trace_filter")
 	rootCmd.PersistentFlags().StringVar(&cfg.TraceType, "trace.type", "parity", "Specify the type of tracing [geth|parity*] (experimental)")
 	rootCmd.PersistentFlags().BoolVar(&cfg.WebsocketEnabled, "ws", false, "Enable Websockets")
+	rootCmd.PersistentFlags().DurationVar(&cfg.DrainTimeout, "http.draintimeout", 10*time.Second, "How long to wait for in-flight requests to complete on shutdown before cancelling them")
+	rootCmd.PersistentFlags().BoolVar(&cfg.NoRequestLog, "rpc.log.disable", false, "Disable logging of RPC calls")
+	rootCmd.PersistentFlags().DurationVar(&cfg.SlowCallThreshold, "rpc.log.slow", 5*time.Second, "Log RPC calls running longer than this at warn level, 0 disables")
+	rootCmd.PersistentFlags().Uint64Var(&cfg.LogSampleRate, "rpc.log.sample", 1000, "Log every N-th RPC call at info level, 0 disables")
+	rootCmd.PersistentFlags().IntVar(&cfg.TxEnvCacheSize, "trace.txenvcache", 64, "Megabytes of memory for the states of the blocks kept between the traces of their transactions, so tracing the transactions of a block one by one doesn't replay the block from the start for every one, 0 disables")
+	rootCmd.PersistentFlags().IntVar(&cfg.HistoryCacheSize, "rpc.historycache", 256, "Megabytes of memory for the cache of the historical accounts and storage read by eth_getBalance, eth_getStorageAt and alike, 0 disables")
 
 	return rootCmd, cfg
 }
@@ -76,15 +101,15 @@ func OpenDB(cfg Flags) (ethdb.KV, ethdb.Backend, error) {
 	// Do not change the order of these checks. Chaindata needs to be checked first, because PrivateApiAddr has default value which is not ""
 	// If PrivateApiAddr is checked first, the Chaindata option will never work
 	if cfg.Chaindata != "" {
-		if database, errOpen := ethdb.Open(cfg.Chaindata); errOpen == nil {
-			db = database.KV()
-		} else {
-			err = errOpen
+		// read-only mode is safe to use together with running turbo-geth node, LMDB readers don't block the writer
+		db, err = ethdb.NewLMDB().Path(cfg.Chaindata).ReadOnly().Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not open chaindata: %w", err)
 		}
 	} else if cfg.PrivateApiAddr != "" {
-		db, txPool, err = ethdb.NewRemote().Path(cfg.PrivateApiAddr).Open(cfg.TLSCertfile, cfg.TLSKeyFile, cfg.TLSCACert)
+		db, txPool, err = openRemote(cfg)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not connect to remoteDb: %w", err)
+			return nil, nil, err
 		}
 	} else {
 		return nil, nil, fmt.Errorf("either remote db or lmdb must be specified")
@@ -94,21 +119,78 @@ func OpenDB(cfg Flags) (ethdb.KV, ethdb.Backend, error) {
 		return nil, nil, fmt.Errorf("could not connect to remoteDb: %w", err)
 	}
 
+	if metrics.Enabled {
+		db = instrumentedKV{db}
+	}
 	return db, txPool, err
 }
 
-func StartRpcServer(ctx context.Context, cfg Flags, rpcAPI []rpc.API) error {
+// openRemote connects to the private API of the node and checks the connection. Problems with the certificates or
+// the token are returned, an unreachable node is only reported: it may be started later. The connection is
+// health-checked and re-established when the node restarts, see remoteConn
+func openRemote(cfg Flags) (ethdb.KV, ethdb.Backend, error) {
+	opts := ethdb.NewRemote().Path(cfg.PrivateApiAddr)
+	if cfg.PrivateApiTokenFile != "" {
+		token, err := ioutil.ReadFile(cfg.PrivateApiTokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read --private.api.token.file: %w", err)
+		}
+		if len(bytes.TrimSpace(token)) == 0 {
+			return nil, nil, fmt.Errorf("--private.api.token.file %s is empty", cfg.PrivateApiTokenFile)
+		}
+		if cfg.TLSCertfile == "" {
+			log.Warn("The private api token is sent without TLS, use --private.api.tls.* flags unless the node runs on this host")
+		}
+		opts = opts.WithToken(string(bytes.TrimSpace(token)))
+	}
+	dial := func() (ethdb.KV, ethdb.Backend, error) {
+		return opts.Open(cfg.TLSCertfile, cfg.TLSKeyFile, cfg.TLSCACert)
+	}
+	db, backend, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not set up the connection to the node, check --private.api.tls.* flags: %w", err)
+	}
+
+	err = ping(db.(*ethdb.RemoteKV))
+	switch {
+	case err == nil:
+	case errors.Is(err, ethdb.ErrPrivateApiTLS):
+		db.Close()
+		return nil, nil, fmt.Errorf("%w (--private.api.tls.cert, --private.api.tls.key, --private.api.tls.ca)", err)
+	case errors.Is(err, ethdb.ErrPrivateApiToken):
+		db.Close()
+		return nil, nil, fmt.Errorf("%w (--private.api.token.file)", err)
+	default:
+		log.Warn("Could not reach the node, the calls will fail until it is up", "err", err)
+	}
+	conn := superviseRemote(dial, db, backend, err == nil)
+	return reconnectingKV{conn}, reconnectingBackend{conn}, nil
+}
+
+// StartRpcServer serves the given APIs until ctx is cancelled. On shutdown it stops accepting
+// new connections, waits up to cfg.DrainTimeout for in-flight requests and cancels the ones
+// still running after that. It returns only when all requests are finished, so the caller
+// can safely close the database afterwards.
+func StartRpcServer(ctx context.Context, cfg Flags, rpcAPI []rpc.API) (DrainStats, error) {
 	// register apis and create handler stack
 	httpEndpoint := fmt.Sprintf("%s:%d", cfg.HttpListenAddress, cfg.HttpPort)
 
 	srv := rpc.NewServer()
 	if err := node.RegisterApisFromWhitelist(rpcAPI, cfg.API, srv, false); err != nil {
-		return fmt.Errorf("could not start register RPC apis: %w", err)
+		return DrainStats{}, fmt.Errorf("could not start register RPC apis: %w", err)
+	}
+	if metrics.Enabled {
+		registerMetrics()
+		srv.Use(metricsMiddleware)
+	}
+	if !cfg.NoRequestLog {
+		srv.Use(newRequestLogger(log.Root(), cfg.SlowCallThreshold, cfg.LogSampleRate).middleware)
 	}
 
 	var err error
 
-	httpHandler := node.NewHTTPHandlerStack(srv, cfg.HttpCORSDomain, cfg.HttpVirtualHost)
+	// only plain http requests are tracked for draining, websocket connections live until srv.Stop
+	tracker := newRequestTracker(node.NewHTTPHandlerStack(srv, cfg.HttpCORSDomain, cfg.HttpVirtualHost))
 	var wsHandler http.Handler
 	if cfg.WebsocketEnabled {
 		wsHandler = srv.WebsocketHandler([]string{"*"})
@@ -118,12 +200,12 @@ func StartRpcServer(ctx context.Context, cfg Flags, rpcAPI []rpc.API) error {
 		if cfg.WebsocketEnabled && r.Method == "GET" {
 			wsHandler.ServeHTTP(w, r)
 		}
-		httpHandler.ServeHTTP(w, r)
+		tracker.ServeHTTP(w, r)
 	})
 
 	listener, _, err := node.StartHTTPEndpoint(httpEndpoint, rpc.DefaultHTTPTimeouts, handler)
 	if err != nil {
-		return fmt.Errorf("could not start RPC api: %w", err)
+		return DrainStats{}, fmt.Errorf("could not start RPC api: %w", err)
 	}
 
 	if cfg.TraceType != "parity" {
@@ -131,14 +213,29 @@ func StartRpcServer(ctx context.Context, cfg Flags, rpcAPI []rpc.API) error {
 	}
 	log.Info("HTTP endpoint opened", "url", httpEndpoint, "ws", cfg.WebsocketEnabled)
 
-	defer func() {
-		srv.Stop()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		_ = listener.Shutdown(shutdownCtx)
-		log.Info("HTTP endpoint closed", "url", httpEndpoint)
-	}()
 	<-ctx.Done()
-	log.Info("Exiting...")
-	return nil
+	log.Info("Exiting...", "inFlight", tracker.InFlight(), "drainTimeout", cfg.DrainTimeout)
+
+	stats := drain(listener, tracker, cfg.DrainTimeout)
+	// websocket connections are hijacked and not tracked by http.Server, stop them explicitly
+	srv.Stop()
+	log.Info("HTTP endpoint closed", "url", httpEndpoint)
+	return stats, nil
+}
+
+// drain shuts the http server down: the listener is closed immediately, in-flight requests
+// get up to timeout to finish, after which their contexts are cancelled
+func drain(httpSrv *http.Server, tracker *requestTracker, timeout time.Duration) DrainStats {
+	tracker.StartDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+		tracker.Abort()
+		// cancelled requests should return promptly, but don't hang forever on the ones which ignore ctx
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), timeout)
+		defer waitCancel()
+		tracker.Wait(waitCtx)
+		_ = httpSrv.Close()
+	}
+	return tracker.Stats()
 }
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DrainStats reports what happened to the requests which were in-flight at shutdown
+type DrainStats struct {
+	Drained uint64 // completed within the drain timeout
+	Aborted uint64 // still running after the drain timeout, their contexts were cancelled
+}
+
+// requestTracker counts in-flight http requests and allows to cancel all of them at once
+type requestTracker struct {
+	next http.Handler
+
+	wg       sync.WaitGroup
+	inFlight int64
+	draining int32
+	drained  uint64
+	aborted  uint64
+
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+func newRequestTracker(next http.Handler) *requestTracker {
+	return &requestTracker{next: next, abort: make(chan struct{})}
+}
+
+func (t *requestTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.wg.Add(1)
+	atomic.AddInt64(&t.inFlight, 1)
+	defer func() {
+		atomic.AddInt64(&t.inFlight, -1)
+		if atomic.LoadInt32(&t.draining) == 1 && !t.isAborted() {
+			atomic.AddUint64(&t.drained, 1)
+		}
+		t.wg.Done()
+	}()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	t.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// InFlight returns the number of requests being served right now
+func (t *requestTracker) InFlight() int64 {
+	return atomic.LoadInt64(&t.inFlight)
+}
+
+// StartDraining marks the beginning of shutdown, requests completed after this call are counted as drained
+func (t *requestTracker) StartDraining() {
+	atomic.StoreInt32(&t.draining, 1)
+}
+
+// Abort cancels the contexts of all in-flight requests
+func (t *requestTracker) Abort() {
+	t.abortOnce.Do(func() {
+		atomic.StoreUint64(&t.aborted, uint64(t.InFlight()))
+		close(t.abort)
+	})
+}
+
+func (t *requestTracker) isAborted() bool {
+	select {
+	case <-t.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until all in-flight requests are finished or ctx is done
+func (t *requestTracker) Wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (t *requestTracker) Stats() DrainStats {
+	return DrainStats{Drained: atomic.LoadUint64(&t.drained), Aborted: atomic.LoadUint64(&t.aborted)}
+}
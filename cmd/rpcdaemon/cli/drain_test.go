@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startTrackedServer(t *testing.T, h http.HandlerFunc) (*http.Server, *requestTracker, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tracker := newRequestTracker(h)
+	httpSrv := &http.Server{Handler: tracker}
+	go httpSrv.Serve(listener) //nolint:errcheck
+	return httpSrv, tracker, "http://" + listener.Addr().String()
+}
+
+func waitInFlight(t *testing.T, tracker *requestTracker) {
+	for i := 0; tracker.InFlight() == 0; i++ {
+		if i > 100 {
+			t.Fatal("request did not reach the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainCompletesSlowRequest(t *testing.T) {
+	httpSrv, tracker, url := startTrackedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url) //nolint:gosec
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resCh <- result{body: string(body), err: err}
+	}()
+	waitInFlight(t, tracker)
+
+	stats := drain(httpSrv, tracker, 5*time.Second)
+	require.Equal(t, DrainStats{Drained: 1}, stats)
+
+	res := <-resCh
+	require.NoError(t, res.err)
+	require.Equal(t, "done", res.body)
+
+	// listener must be closed after drain
+	_, err := http.Get(url) //nolint:gosec
+	require.Error(t, err)
+}
+
+func TestDrainAbortsRequestsAfterTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	httpSrv, tracker, url := startTrackedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	})
+
+	go func() {
+		resp, err := http.Get(url) //nolint:gosec
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitInFlight(t, tracker)
+
+	stats := drain(httpSrv, tracker, 100*time.Millisecond)
+	require.Equal(t, DrainStats{Aborted: 1}, stats)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request context was not cancelled")
+	}
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcdaemon_calls_total",
+		Help: "Number of RPC method calls, batch elements are counted separately",
+	}, []string{"method"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpcdaemon_errors_total",
+		Help: "Number of RPC method calls which returned an error",
+	}, []string{"method"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpcdaemon_call_duration_seconds",
+		Help:    "Duration of RPC method calls",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 10), // 0.5ms .. ~2m
+	}, []string{"method"})
+	rpcInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rpcdaemon_calls_in_flight",
+		Help: "Number of RPC method calls being executed right now",
+	})
+	dbOpenTxs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rpcdaemon_db_open_txs",
+		Help: "Number of open database read transactions",
+	})
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics adds rpcdaemon metrics to the default prometheus registry,
+// they are served on --metrics.addr together with the rest of the metrics
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		for _, c := range []prometheus.Collector{rpcCalls, rpcErrors, rpcDuration, rpcInFlight, dbOpenTxs} {
+			prometheus.MustRegister(c)
+		}
+	})
+}
+
+// metricsMiddleware records count, duration and errors of every method call
+func metricsMiddleware(next rpc.MethodHandler) rpc.MethodHandler {
+	return func(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+		rpcInFlight.Inc()
+		start := time.Now()
+		res, err := next(ctx, method, params)
+		rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		rpcCalls.WithLabelValues(method).Inc()
+		if err != nil {
+			rpcErrors.WithLabelValues(method).Inc()
+		}
+		rpcInFlight.Dec()
+		return res, err
+	}
+}
+
+// instrumentedKV tracks the number of open transactions in dbOpenTxs
+type instrumentedKV struct {
+	ethdb.KV
+}
+
+func (db instrumentedKV) View(ctx context.Context, f func(tx ethdb.Tx) error) error {
+	dbOpenTxs.Inc()
+	defer dbOpenTxs.Dec()
+	return db.KV.View(ctx, f)
+}
+
+func (db instrumentedKV) Update(ctx context.Context, f func(tx ethdb.Tx) error) error {
+	dbOpenTxs.Inc()
+	defer dbOpenTxs.Dec()
+	return db.KV.Update(ctx, f)
+}
+
+func (db instrumentedKV) Begin(ctx context.Context, parent ethdb.Tx, writable bool) (ethdb.Tx, error) {
+	if p, ok := parent.(*instrumentedTx); ok {
+		parent = p.Tx
+	}
+	tx, err := db.KV.Begin(ctx, parent, writable)
+	if err != nil {
+		return nil, err
+	}
+	dbOpenTxs.Inc()
+	return &instrumentedTx{Tx: tx}, nil
+}
+
+type instrumentedTx struct {
+	ethdb.Tx
+	closeOnce sync.Once
+}
+
+func (tx *instrumentedTx) Commit(ctx context.Context) error {
+	defer tx.closeOnce.Do(dbOpenTxs.Dec)
+	return tx.Tx.Commit(ctx)
+}
+
+func (tx *instrumentedTx) Rollback() {
+	defer tx.closeOnce.Do(dbOpenTxs.Dec)
+	tx.Tx.Rollback()
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type testEthAPI struct{}
+
+func (testEthAPI) GetLogs(_ context.Context) ([]string, error) { return []string{}, nil }
+
+func TestMetricsEndpoint(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rpcCalls, rpcErrors, rpcDuration, rpcInFlight, dbOpenTxs)
+
+	srv := rpc.NewServer()
+	require.NoError(t, srv.RegisterName("eth", testEthAPI{}))
+	srv.Use(metricsMiddleware)
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	before := testutil.ToFloat64(rpcCalls.WithLabelValues("eth_getLogs"))
+	var res []string
+	require.NoError(t, client.Call(&res, "eth_getLogs"))
+	require.NoError(t, client.BatchCall([]rpc.BatchElem{
+		{Method: "eth_getLogs", Result: &res},
+		{Method: "eth_getLogs", Result: &res},
+	}))
+	require.Equal(t, before+3, testutil.ToFloat64(rpcCalls.WithLabelValues("eth_getLogs")))
+
+	metricsSrv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer metricsSrv.Close()
+	resp, err := metricsSrv.Client().Get(metricsSrv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `rpcdaemon_calls_total{method="eth_getLogs"}`)
+	require.Contains(t, string(body), `rpcdaemon_call_duration_seconds_bucket{method="eth_getLogs"`)
+}
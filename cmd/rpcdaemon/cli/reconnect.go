@@ -0,0 +1,257 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Health checks of the connection to the node, and the delays between the attempts to reconnect, the delay doubles
+// after every failed attempt
+var (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	redialMinDelay      = time.Second
+	redialMaxDelay      = time.Minute
+)
+
+// remoteConn keeps the connection to the private API of the node. When the node stops answering the health checks
+// the connection is closed, its open transactions fail with ethdb.ErrNodeUnavailable, and the node is dialed again
+// until it answers. reconnectingKV and reconnectingBackend always use the current connection
+type remoteConn struct {
+	dial func() (ethdb.KV, ethdb.Backend, error)
+
+	lock    sync.RWMutex
+	kv      *ethdb.RemoteKV
+	backend ethdb.Backend
+	healthy bool
+
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// superviseRemote starts the health checks of the connection, healthy - the node answered on the connection
+func superviseRemote(dial func() (ethdb.KV, ethdb.Backend, error), kv ethdb.KV, backend ethdb.Backend, healthy bool) *remoteConn {
+	c := &remoteConn{
+		dial:    dial,
+		kv:      kv.(*ethdb.RemoteKV),
+		backend: backend,
+		healthy: healthy,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.supervise()
+	return c
+}
+
+func (c *remoteConn) supervise() {
+	defer close(c.done)
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		if !c.isHealthy() {
+			c.breakConn()
+			if !c.reconnect() {
+				return
+			}
+		}
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+		kv, err := c.current()
+		if err == nil {
+			err = ping(kv)
+		}
+		if err != nil {
+			log.Warn("The node does not answer, reconnecting", "err", err)
+			c.lock.Lock()
+			c.healthy = false
+			c.lock.Unlock()
+		}
+	}
+}
+
+func ping(kv *ethdb.RemoteKV) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return kv.Ping(ctx)
+}
+
+// breakConn closes the current connection, its open transactions fail with a retryable error
+func (c *remoteConn) breakConn() {
+	c.lock.Lock()
+	c.healthy = false
+	kv := c.kv
+	c.lock.Unlock()
+	kv.CloseWithError(ethdb.ErrNodeUnavailable)
+}
+
+// reconnect dials the node until it answers, false if the connection is closed meanwhile
+func (c *remoteConn) reconnect() bool {
+	delay := redialMinDelay
+	for {
+		kv, backend, err := c.dial()
+		if err == nil {
+			if err = ping(kv.(*ethdb.RemoteKV)); err == nil {
+				c.lock.Lock()
+				c.kv, c.backend, c.healthy = kv.(*ethdb.RemoteKV), backend, true
+				c.lock.Unlock()
+				log.Info("Reconnected to the node")
+				return true
+			}
+			kv.Close()
+		}
+		log.Warn("Could not reconnect to the node", "err", err, "retry in", delay)
+		select {
+		case <-c.quit:
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > redialMaxDelay {
+			delay = redialMaxDelay
+		}
+	}
+}
+
+func (c *remoteConn) isHealthy() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.healthy
+}
+
+// current - the connection, ethdb.ErrNodeUnavailable while reconnecting
+func (c *remoteConn) current() (*ethdb.RemoteKV, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.healthy {
+		return nil, ethdb.ErrNodeUnavailable
+	}
+	return c.kv, nil
+}
+
+func (c *remoteConn) currentBackend() (ethdb.Backend, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.healthy {
+		return nil, ethdb.ErrNodeUnavailable
+	}
+	return c.backend, nil
+}
+
+// latest - the connection, even if it's broken
+func (c *remoteConn) latest() *ethdb.RemoteKV {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.kv
+}
+
+func (c *remoteConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+		<-c.done
+		c.latest().Close()
+	})
+}
+
+// reconnectingKV - ethdb.KV of the current connection to the node
+type reconnectingKV struct {
+	*remoteConn
+}
+
+func (db reconnectingKV) View(ctx context.Context, f func(tx ethdb.Tx) error) error {
+	kv, err := db.current()
+	if err != nil {
+		return err
+	}
+	return kv.View(ctx, f)
+}
+
+func (db reconnectingKV) Update(ctx context.Context, f func(tx ethdb.Tx) error) error {
+	kv, err := db.current()
+	if err != nil {
+		return err
+	}
+	return kv.Update(ctx, f)
+}
+
+func (db reconnectingKV) Begin(ctx context.Context, parent ethdb.Tx, writable bool) (ethdb.Tx, error) {
+	kv, err := db.current()
+	if err != nil {
+		return nil, err
+	}
+	return kv.Begin(ctx, parent, writable)
+}
+
+func (db reconnectingKV) DiskSize(ctx context.Context) (uint64, error) {
+	kv, err := db.current()
+	if err != nil {
+		return 0, err
+	}
+	return kv.DiskSize(ctx)
+}
+
+func (db reconnectingKV) AllBuckets() dbutils.BucketsCfg {
+	return db.latest().AllBuckets()
+}
+
+func (db reconnectingKV) Readers() []ethdb.ReaderInfo {
+	return db.latest().Readers()
+}
+
+func (db reconnectingKV) Close() {
+	db.close()
+}
+
+// reconnectingBackend - ethdb.Backend of the current connection to the node
+type reconnectingBackend struct {
+	*remoteConn
+}
+
+func (b reconnectingBackend) AddLocal(signedTx []byte) ([]byte, error) {
+	backend, err := b.currentBackend()
+	if err != nil {
+		return common.Hash{}.Bytes(), err
+	}
+	return backend.AddLocal(signedTx)
+}
+
+func (b reconnectingBackend) Etherbase() (common.Address, error) {
+	backend, err := b.currentBackend()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return backend.Etherbase()
+}
+
+func (b reconnectingBackend) NetVersion() (uint64, error) {
+	backend, err := b.currentBackend()
+	if err != nil {
+		return 0, err
+	}
+	return backend.NetVersion()
+}
+
+func (b reconnectingBackend) ProtocolVersions() ([]uint, error) {
+	backend, err := b.currentBackend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.ProtocolVersions()
+}
+
+func (b reconnectingBackend) Subscribe(ctx context.Context, onEvent func(*remote.Event)) error {
+	backend, err := b.currentBackend()
+	if err != nil {
+		return err
+	}
+	return backend.Subscribe(ctx, onEvent)
+}
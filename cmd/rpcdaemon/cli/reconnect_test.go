@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func serve(t *testing.T, kv ethdb.KV, addr string) (string, *grpc.Server) {
+	lis, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	grpcServer := remotedbserver.NewGrpcServer(kv, nil, nil, nil, "")
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+	return lis.Addr().String(), grpcServer
+}
+
+func readValue(db ethdb.KV) ([]byte, error) {
+	var v []byte
+	err := db.View(context.Background(), func(tx ethdb.Tx) error {
+		var err error
+		v, err = tx.GetOne(dbutils.PlainStateBucket, []byte("key"))
+		return err
+	})
+	return v, err
+}
+
+func TestReconnectAfterNodeRestart(t *testing.T) {
+	defer func(interval, min, max time.Duration) {
+		healthCheckInterval, redialMinDelay, redialMaxDelay = interval, min, max
+	}(healthCheckInterval, redialMinDelay, redialMaxDelay)
+	healthCheckInterval, redialMinDelay, redialMaxDelay = 20*time.Millisecond, 10*time.Millisecond, 40*time.Millisecond
+
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+	require.NoError(t, kv.Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.Cursor(dbutils.PlainStateBucket).Put([]byte("key"), []byte("value"))
+	}))
+	addr, grpcServer := serve(t, kv, "127.0.0.1:0")
+
+	db, backend, err := OpenDB(Flags{PrivateApiAddr: addr})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NotNil(t, backend)
+	v, err := readValue(db)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), v)
+
+	// the node goes away in the middle of a transaction
+	tx, err := db.Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	grpcServer.Stop()
+	_, err = tx.GetOne(dbutils.PlainStateBucket, []byte("key"))
+	require.Equal(t, codes.Unavailable, status.Code(err), "retryable error, got %v", err)
+	tx.Rollback()
+
+	require.Eventually(t, func() bool {
+		_, err := readValue(db)
+		return status.Code(err) == codes.Unavailable
+	}, 10*time.Second, 10*time.Millisecond, "node is down")
+
+	// the node is back on the same address, the daemon is not restarted
+	_, grpcServer = serve(t, kv, addr)
+	defer grpcServer.Stop()
+	require.Eventually(t, func() bool {
+		v, err := readValue(db)
+		return err == nil && string(v) == "value"
+	}, 10*time.Second, 10*time.Millisecond, "reconnected")
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// maxLoggedParams limits the length of params printed in the request log
+const maxLoggedParams = 256
+
+// sensitiveMethods have params which must not get into logs as is
+var sensitiveMethods = map[string]bool{
+	"eth_sendRawTransaction": true,
+}
+
+// requestLogger logs calls slower than slowThreshold at Warn level and every
+// sampleRate-th call at Info level. Zero slowThreshold or sampleRate disable
+// the corresponding log.
+type requestLogger struct {
+	logger        log.Logger
+	slowThreshold time.Duration
+	sampleRate    uint64
+	calls         uint64 // accessed atomically
+}
+
+func newRequestLogger(logger log.Logger, slowThreshold time.Duration, sampleRate uint64) *requestLogger {
+	return &requestLogger{
+		logger:        logger,
+		slowThreshold: slowThreshold,
+		sampleRate:    sampleRate,
+	}
+}
+
+func (l *requestLogger) middleware(next rpc.MethodHandler) rpc.MethodHandler {
+	return func(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+		start := time.Now()
+		res, err := next(ctx, method, params)
+		duration := time.Since(start)
+
+		switch {
+		case l.slowThreshold > 0 && duration >= l.slowThreshold:
+			l.logger.Warn("Slow RPC call", "method", method, "params", loggedParams(method, params), "duration", duration, "err", err)
+		case l.sampleRate > 0 && atomic.AddUint64(&l.calls, 1)%l.sampleRate == 0:
+			l.logger.Info("RPC call", "method", method, "params", loggedParams(method, params), "duration", duration, "err", err)
+		}
+		return res, err
+	}
+}
+
+// loggedParams returns params in the form suitable for logging: truncated to maxLoggedParams,
+// raw transactions are replaced by their hashes
+func loggedParams(method string, params json.RawMessage) string {
+	if sensitiveMethods[method] {
+		var raw []hexutil.Bytes
+		if err := json.Unmarshal(params, &raw); err == nil && len(raw) == 1 {
+			return "txHash=" + crypto.Keccak256Hash(raw[0]).Hex()
+		}
+		return "hash=" + crypto.Keccak256Hash(params).Hex()
+	}
+	if len(params) > maxLoggedParams {
+		return string(params[:maxLoggedParams]) + "..."
+	}
+	return string(params)
+}
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+type delayedService struct {
+	delay time.Duration
+}
+
+func (s *delayedService) Sleep(secret string) string {
+	time.Sleep(s.delay)
+	return secret
+}
+
+func (s *delayedService) SendRawTransaction(encodedTx hexutil.Bytes) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+type recordedLogs struct {
+	sync.Mutex
+	records []*log.Record
+}
+
+func (r *recordedLogs) logger() log.Logger {
+	logger := log.New()
+	logger.SetHandler(log.FuncHandler(func(rec *log.Record) error {
+		r.Lock()
+		defer r.Unlock()
+		r.records = append(r.records, rec)
+		return nil
+	}))
+	return logger
+}
+
+func (r *recordedLogs) byLevel(lvl log.Lvl) []*log.Record {
+	r.Lock()
+	defer r.Unlock()
+	var res []*log.Record
+	for _, rec := range r.records {
+		if rec.Lvl == lvl {
+			res = append(res, rec)
+		}
+	}
+	return res
+}
+
+func recordField(rec *log.Record, key string) interface{} {
+	for i := 0; i+1 < len(rec.Ctx); i += 2 {
+		if rec.Ctx[i] == key {
+			return rec.Ctx[i+1]
+		}
+	}
+	return nil
+}
+
+func startLoggedServer(t *testing.T, l *requestLogger, delay time.Duration) *rpc.Client {
+	srv := rpc.NewServer()
+	require.NoError(t, srv.RegisterName("eth", &delayedService{delay: delay}))
+	srv.Use(l.middleware)
+	client := rpc.DialInProc(srv)
+	t.Cleanup(func() {
+		client.Close()
+		srv.Stop()
+	})
+	return client
+}
+
+func TestRequestLogSlowCall(t *testing.T) {
+	logs := &recordedLogs{}
+	client := startLoggedServer(t, newRequestLogger(logs.logger(), 50*time.Millisecond, 0), 100*time.Millisecond)
+
+	var res string
+	require.NoError(t, client.Call(&res, "eth_sleep", strings.Repeat("a", 2*maxLoggedParams)))
+
+	warns := logs.byLevel(log.LvlWarn)
+	require.Len(t, warns, 1)
+	require.Equal(t, "eth_sleep", recordField(warns[0], "method"))
+	require.GreaterOrEqual(t, recordField(warns[0], "duration").(time.Duration), 100*time.Millisecond)
+	params := recordField(warns[0], "params").(string)
+	require.Len(t, params, maxLoggedParams+len("..."))
+	require.Empty(t, logs.byLevel(log.LvlInfo))
+}
+
+func TestRequestLogFastCallNotLogged(t *testing.T) {
+	logs := &recordedLogs{}
+	client := startLoggedServer(t, newRequestLogger(logs.logger(), time.Second, 0), 0)
+
+	var res string
+	require.NoError(t, client.Call(&res, "eth_sleep", "x"))
+	require.Empty(t, logs.byLevel(log.LvlWarn))
+	require.Empty(t, logs.byLevel(log.LvlInfo))
+}
+
+func TestRequestLogSampling(t *testing.T) {
+	logs := &recordedLogs{}
+	client := startLoggedServer(t, newRequestLogger(logs.logger(), 0, 3), 0)
+
+	var res string
+	for i := 0; i < 9; i++ {
+		require.NoError(t, client.Call(&res, "eth_sleep", "x"))
+	}
+	require.Len(t, logs.byLevel(log.LvlInfo), 3)
+}
+
+func TestRequestLogHashesRawTransactions(t *testing.T) {
+	logs := &recordedLogs{}
+	client := startLoggedServer(t, newRequestLogger(logs.logger(), 10*time.Millisecond, 0), 50*time.Millisecond)
+
+	rawTx := hexutil.Bytes{0xf8, 0x6b, 0x80, 0xde, 0xad}
+	require.NoError(t, client.Call(nil, "eth_sendRawTransaction", rawTx))
+
+	warns := logs.byLevel(log.LvlWarn)
+	require.Len(t, warns, 1)
+	params := recordField(warns[0], "params").(string)
+	require.Equal(t, "txHash="+crypto.Keccak256Hash(rawTx).Hex(), params)
+	require.NotContains(t, params, rawTx.String())
+}
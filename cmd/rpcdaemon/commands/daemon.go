@@ -2,21 +2,35 @@ package commands
 
 import (
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/cli"
+	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/filters"
+	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/ledgerwatch/turbo-geth/turbo/transactions"
 )
 
 // APIList describes the list of available RPC apis
-func APIList(db ethdb.KV, eth ethdb.Backend, cfg cli.Flags, customAPIList []rpc.API) []rpc.API {
+func APIList(db ethdb.KV, eth ethdb.Backend, filters *filters.Filters, cfg cli.Flags, customAPIList []rpc.API) []rpc.API {
 	var defaultAPIList []rpc.API
 
 	dbReader := ethdb.NewObjectDatabase(db)
 
-	ethImpl := NewEthAPI(db, dbReader, eth, cfg.Gascap)
+	if filters != nil {
+		filters.SetLogsBackend(&logsBackend{db: dbReader})
+	}
+	ethImpl := NewEthAPI(db, dbReader, eth, filters, cfg.Gascap)
+	if cfg.HistoryCacheSize > 0 {
+		ethImpl.historyCache = state.NewHistoryCache(cfg.HistoryCacheSize * 1024 * 1024)
+	}
 	tgImpl := NewTgAPI(db, dbReader)
-	netImpl := NewNetAPIImpl(eth)
+	netImpl := NewNetAPIImpl(dbReader, eth)
 	debugImpl := NewPrivateDebugAPI(db, dbReader)
 	traceImpl := NewTraceAPI(db, dbReader, &cfg)
+	if cfg.TxEnvCacheSize > 0 {
+		txEnvCache := transactions.NewTxEnvCache(cfg.TxEnvCacheSize * 1024 * 1024)
+		debugImpl.txEnvCache = txEnvCache
+		traceImpl.txEnvCache = txEnvCache
+	}
 	web3Impl := NewWeb3APIImpl()
 	dbImpl := NewDBAPIImpl()   /* deprecated */
 	shhImpl := NewSHHAPIImpl() /* deprecated */
@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/cli"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/eth"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonOnLocalChaindata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcdaemon-chaindata")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// generate database the same way the node does and close it, no remote process is involved
+	writer := ethdb.NewObjectDatabase(ethdb.NewLMDB().Path(dir).MustOpen())
+	genesis := core.GenesisBlockForTesting(writer, common.HexToAddress("0x1"), big.NewInt(1000))
+	require.NoError(t, stages.SaveStageProgress(writer, stages.Execution, 0, nil))
+	require.NoError(t, stages.SaveStageProgress(writer, stages.Finish, 0, nil))
+	writer.Close()
+
+	cfg := cli.Flags{Chaindata: dir, API: []string{"eth", "net"}}
+	db, backend, err := cli.OpenDB(cfg)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Nil(t, backend)
+
+	srv := rpc.NewServer()
+	for _, api := range APIList(db, backend, nil, cfg, nil) {
+		require.NoError(t, srv.RegisterName(api.Namespace, api.Service))
+	}
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	var chainID hexutil.Uint64
+	require.NoError(t, client.Call(&chainID, "eth_chainId"))
+	require.Equal(t, params.TestChainConfig.ChainID.Uint64(), uint64(chainID))
+
+	var block map[string]interface{}
+	require.NoError(t, client.Call(&block, "eth_getBlockByNumber", "0x0", false))
+	require.Equal(t, genesis.Hash().Hex(), block["hash"])
+
+	// the backend is not available in chaindata mode, the answers come from the database and the build
+	var version string
+	require.NoError(t, client.Call(&version, "net_version"))
+	require.Equal(t, params.TestChainConfig.ChainID.String(), version)
+	var protocolVersion hexutil.Uint
+	require.NoError(t, client.Call(&protocolVersion, "eth_protocolVersion"))
+	require.Equal(t, hexutil.Uint(eth.ProtocolVersions[0]), protocolVersion)
+
+	err = db.Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.Cursor(dbutils.PlainStateBucket).Put([]byte{1}, []byte{1})
+	})
+	require.Error(t, err, "database must be opened read-only")
+}
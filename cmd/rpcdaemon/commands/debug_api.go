@@ -22,15 +22,20 @@ type PrivateDebugAPI interface {
 	StorageRangeAt(ctx context.Context, blockHash common.Hash, txIndex uint64, contractAddress common.Address, keyStart hexutil.Bytes, maxResult int) (StorageRangeResult, error)
 	TraceTransaction(ctx context.Context, hash common.Hash, config *eth.TraceConfig) (interface{}, error)
 	AccountRange(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, start []byte, maxResults int, nocode, nostorage, incompletes bool) (state.IteratorDump, error)
+	DumpBlock(ctx context.Context, blockNr rpc.BlockNumber, start *hexutil.Bytes, maxResults *int, withCode *bool) (state.IteratorDump, error)
 	GetModifiedAccountsByNumber(ctx context.Context, startNum rpc.BlockNumber, endNum *rpc.BlockNumber) ([]common.Address, error)
 	GetModifiedAccountsByHash(_ context.Context, startHash common.Hash, endHash *common.Hash) ([]common.Address, error)
 }
 
+// dumpBlockMaxStorage - maximum amount of storage items in one page of debug_dumpBlock
+const dumpBlockMaxStorage = 10_000
+
 // PrivateDebugAPIImpl is implementation of the PrivateDebugAPI interface based on remote Db access
 type PrivateDebugAPIImpl struct {
 	db           ethdb.KV
 	dbReader     ethdb.Database
 	chainContext core.ChainContext
+	txEnvCache   *transactions.TxEnvCache // nil if disabled, see --trace.txenvcache
 }
 
 // NewPrivateDebugAPI returns PrivateDebugAPIImpl instance
@@ -50,7 +55,6 @@ func (api *PrivateDebugAPIImpl) StorageRangeAt(ctx context.Context, blockHash co
 	defer tx.Rollback()
 
 	bc := adapter.NewBlockGetter(tx)
-	cc := adapter.NewChainContext(tx)
 	genesis, err := rawdb.ReadBlockByNumber(tx, 0)
 	if err != nil {
 		return StorageRangeResult{}, err
@@ -60,7 +64,8 @@ func (api *PrivateDebugAPIImpl) StorageRangeAt(ctx context.Context, blockHash co
 	if err != nil {
 		return StorageRangeResult{}, err
 	}
-	_, _, _, stateReader, err := transactions.ComputeTxEnv(ctx, bc, chainConfig, cc, tx.(ethdb.HasTx).Tx(), blockHash, txIndex)
+	cc := adapter.NewChainContext(tx, adapter.NewEngine(chainConfig, tx))
+	_, _, _, stateReader, err := api.txEnvCache.ComputeTxEnv(ctx, bc, chainConfig, cc, tx.(ethdb.HasTx).Tx(), blockHash, txIndex)
 	if err != nil {
 		return StorageRangeResult{}, err
 	}
@@ -127,6 +132,58 @@ func (api *PrivateDebugAPIImpl) AccountRange(ctx context.Context, blockNrOrHash
 	return res, nil
 }
 
+// DumpBlock implements debug_dumpBlock. Returns the state after the given block, in pages of at most
+// eth.AccountRangeMaxResults accounts and dumpBlockMaxStorage storage items. The result is the one of geth with "next",
+// the start of the next page, which is omitted after the last one. Code of the contracts is included only with withCode
+func (api *PrivateDebugAPIImpl) DumpBlock(ctx context.Context, blockNr rpc.BlockNumber, start *hexutil.Bytes, maxResults *int, withCode *bool) (state.IteratorDump, error) {
+	if blockNr == rpc.PendingBlockNumber {
+		return state.IteratorDump{}, fmt.Errorf("dump of pending state not supported")
+	}
+	tx, err := api.dbReader.Begin(ctx, false)
+	if err != nil {
+		return state.IteratorDump{}, err
+	}
+	defer tx.Rollback()
+
+	blockNumber, err := getBlockNumber(blockNr, tx)
+	if err != nil {
+		return state.IteratorDump{}, err
+	}
+	hash, err := rawdb.ReadCanonicalHash(tx, blockNumber)
+	if err != nil {
+		return state.IteratorDump{}, err
+	}
+	header := rawdb.ReadHeader(tx, hash, blockNumber)
+	if header == nil {
+		return state.IteratorDump{}, fmt.Errorf("block #%d not found", blockNumber)
+	}
+
+	limit := eth.AccountRangeMaxResults
+	if maxResults != nil && *maxResults > 0 && *maxResults < limit {
+		limit = *maxResults
+	}
+	var startKey []byte
+	if start != nil {
+		startKey = *start
+	}
+	dump, err := state.DumpStateAsOf(tx.(ethdb.HasTx).Tx(), true /* plain */, blockNumber+1, startKey, limit, dumpBlockMaxStorage, withCode != nil && *withCode)
+	if err != nil {
+		return state.IteratorDump{}, err
+	}
+
+	res := state.IteratorDump{
+		Root:     fmt.Sprintf("%x", header.Root),
+		Accounts: make(map[common.Address]state.DumpAccount, len(dump.Accounts)),
+		Next:     dump.Next,
+	}
+	for _, acc := range dump.Accounts {
+		addr := *acc.Address
+		acc.Address = nil
+		res.Accounts[addr] = acc
+	}
+	return res, nil
+}
+
 // GetModifiedAccountsByNumber implements debug_getModifiedAccountsByNumber. Returns a list of accounts modified in the given block.
 func (api *PrivateDebugAPIImpl) GetModifiedAccountsByNumber(ctx context.Context, startNumber rpc.BlockNumber, endNumber *rpc.BlockNumber) ([]common.Address, error) {
 	tx, err := api.dbReader.Begin(ctx, false)
@@ -1,5 +1,11 @@
 package commands
 
+import (
+	"errors"
+
+	"github.com/ledgerwatch/turbo-geth/core/state"
+)
+
 // NotImplemented is the URI prefix for smartcard wallets.
 const NotImplemented = "the function %s is currently not implemented"
 
@@ -8,3 +14,36 @@ const NotAvailableChainData = "the function %s is not available, please use --pr
 
 // NotAvailableDeprecated x
 const NotAvailableDeprecated = "the function %s has been deprecated"
+
+// JSON-RPC error codes of the requests for the historical state the node can't answer
+const (
+	HistoryPrunedErrorCode          = -32001
+	HistoryBehindExecutionErrorCode = -32002
+	NotInHistoryErrorCode           = -32003
+)
+
+type historyError struct {
+	code int
+	err  error
+}
+
+func (e *historyError) Error() string  { return e.err.Error() }
+func (e *historyError) ErrorCode() int { return e.code }
+func (e *historyError) Unwrap() error  { return e.err }
+
+// toHistoryError converts errors of the historical state lookups into JSON-RPC errors with distinct codes,
+// other errors are returned as is
+func toHistoryError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, state.ErrHistoryPruned):
+		return &historyError{code: HistoryPrunedErrorCode, err: err}
+	case errors.Is(err, state.ErrHistoryBehindExecution):
+		return &historyError{code: HistoryBehindExecutionErrorCode, err: err}
+	case errors.Is(err, state.ErrNotInHistory):
+		return &historyError{code: NotInHistoryErrorCode, err: err}
+	default:
+		return err
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 )
 
@@ -25,9 +26,13 @@ func (api *APIImpl) GetBalance(ctx context.Context, address common.Address, bloc
 		return nil, fmt.Errorf("getBalance cannot open tx: %v", err1)
 	}
 	defer tx.Rollback()
-	acc, err := rpchelper.GetAccount(tx, blockNumber, address)
+	reader, err := api.stateReader(tx, blockNumber)
 	if err != nil {
-		return nil, fmt.Errorf("cant get a balance for account %q for block %v", address.String(), blockNumber)
+		return nil, err
+	}
+	acc, err := reader.ReadAccountData(address)
+	if err != nil {
+		return nil, toHistoryError(fmt.Errorf("cant get a balance for account %q for block %v: %w", address.String(), blockNumber, err))
 	}
 	if acc == nil {
 		// Special case - non-existent account is assumed to have zero balance
@@ -49,10 +54,16 @@ func (api *APIImpl) GetTransactionCount(ctx context.Context, address common.Addr
 		return nil, fmt.Errorf("getTransactionCount cannot open tx: %v", err1)
 	}
 	defer tx.Rollback()
-	reader := adapter.NewStateReader(tx, blockNumber)
+	reader, err := api.stateReader(tx, blockNumber)
+	if err != nil {
+		return nil, err
+	}
 	acc, err := reader.ReadAccountData(address)
-	if acc == nil || err != nil {
-		return &nonce, err
+	if err != nil {
+		return nil, toHistoryError(err)
+	}
+	if acc == nil {
+		return &nonce, nil
 	}
 	return (*hexutil.Uint64)(&acc.Nonce), err
 }
@@ -69,9 +80,15 @@ func (api *APIImpl) GetCode(ctx context.Context, address common.Address, blockNr
 		return nil, fmt.Errorf("getCode cannot open tx: %v", err1)
 	}
 	defer tx.Rollback()
-	reader := adapter.NewStateReader(tx, blockNumber)
+	reader, err := api.stateReader(tx, blockNumber)
+	if err != nil {
+		return nil, err
+	}
 	acc, err := reader.ReadAccountData(address)
-	if acc == nil || err != nil {
+	if err != nil {
+		return nil, toHistoryError(err)
+	}
+	if acc == nil {
 		return hexutil.Bytes(""), nil
 	}
 	res, _ := reader.ReadAccountCode(address, acc.CodeHash)
@@ -95,16 +112,33 @@ func (api *APIImpl) GetStorageAt(ctx context.Context, address common.Address, in
 		return "", fmt.Errorf("getStorageAt cannot open tx: %v", err1)
 	}
 	defer tx.Rollback()
-	reader := adapter.NewStateReader(tx, blockNumber)
+	reader, err := api.stateReader(tx, blockNumber)
+	if err != nil {
+		return "", err
+	}
 	acc, err := reader.ReadAccountData(address)
-	if acc == nil || err != nil {
-		return hexutil.Encode(common.LeftPadBytes(empty[:], 32)), err
+	if err != nil {
+		return "", toHistoryError(err)
+	}
+	if acc == nil {
+		return hexutil.Encode(common.LeftPadBytes(empty[:], 32)), nil
 	}
 
 	location := common.HexToHash(index)
 	res, err := reader.ReadAccountStorage(address, acc.Incarnation, &location)
 	if err != nil {
-		res = empty
+		return "", toHistoryError(err)
+	}
+	return hexutil.Encode(common.LeftPadBytes(res[:], 32)), nil
+}
+
+// stateReader - reader of the state after the block, through the history cache if it is enabled
+func (api *APIImpl) stateReader(tx ethdb.Tx, blockNumber uint64) (*adapter.StateReader, error) {
+	reader := adapter.NewStateReader(tx, blockNumber)
+	if api.historyCache != nil {
+		if err := reader.SetHistoryCache(api.historyCache); err != nil {
+			return nil, fmt.Errorf("reading the head for the history cache: %w", err)
+		}
 	}
-	return hexutil.Encode(common.LeftPadBytes(res[:], 32)), err
+	return reader, nil
 }
@@ -6,9 +6,11 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/eth/filters"
 
+	rpcfilters "github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/filters"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
@@ -40,10 +42,12 @@ type EthAPI interface {
 
 	// Filter related (see ./eth_filters.go)
 	// newPendingTransactionFilter(ctx context.Context) (string, error)
-	// newBlockFilter(ctx context.Context) (string, error)
+	NewBlockFilter(_ context.Context) (rpc.ID, error)
 	// newFilter(ctx context.Context) (string, error)
-	// uninstallFilter(ctx context.Context) (string, error)
-	// getFilterChanges(ctx context.Context) (string, error)
+	UninstallFilter(_ context.Context, id rpc.ID) (bool, error)
+	GetFilterChanges(_ context.Context, id rpc.ID) ([]common.Hash, error)
+	NewHeads(ctx context.Context) (*rpc.Subscription, error)
+	Logs(ctx context.Context, crit filters.FilterCriteria) (*rpc.Subscription, error)
 
 	// Account related (see ./eth_accounts.go)
 	Accounts(ctx context.Context) ([]common.Address, error)
@@ -87,15 +91,18 @@ type APIImpl struct {
 	ethBackend   ethdb.Backend
 	dbReader     ethdb.Database
 	chainContext core.ChainContext
+	filters      *rpcfilters.Filters
 	GasCap       uint64
+	historyCache *state.HistoryCache // nil if disabled, see --rpc.historycache
 }
 
 // NewEthAPI returns APIImpl instance
-func NewEthAPI(db ethdb.KV, dbReader ethdb.Database, eth ethdb.Backend, gascap uint64) *APIImpl {
+func NewEthAPI(db ethdb.KV, dbReader ethdb.Database, eth ethdb.Backend, ff *rpcfilters.Filters, gascap uint64) *APIImpl {
 	return &APIImpl{
 		db:         db,
 		dbReader:   dbReader,
 		ethBackend: eth,
+		filters:    ff,
 		GasCap:     gascap,
 	}
 }
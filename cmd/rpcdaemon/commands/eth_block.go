@@ -13,11 +13,11 @@ import (
 
 // GetBlockByNumber implements eth_getBlockByNumber. Returns information about a block given the block's number.
 func (api *APIImpl) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber, fullTx bool) (map[string]interface{}, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	blockNum, err := getBlockNumber(number, tx)
 	if err != nil {
@@ -38,6 +38,11 @@ func (api *APIImpl) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber
 		return nil, err
 	}
 	additionalFields["totalDifficulty"] = (*hexutil.Big)(td)
+	if fullTx {
+		if err = fillSenders(tx, block); err != nil {
+			return nil, err
+		}
+	}
 	response, err := ethapi.RPCMarshalBlock(block, true, fullTx, additionalFields)
 
 	if err == nil && number == rpc.PendingBlockNumber {
@@ -51,11 +56,11 @@ func (api *APIImpl) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber
 
 // GetBlockByHash implements eth_getBlockByHash. Returns information about a block given the block's hash.
 func (api *APIImpl) GetBlockByHash(ctx context.Context, hash common.Hash, fullTx bool) (map[string]interface{}, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	additionalFields := make(map[string]interface{})
 
@@ -73,6 +78,11 @@ func (api *APIImpl) GetBlockByHash(ctx context.Context, hash common.Hash, fullTx
 		return nil, err
 	}
 	additionalFields["totalDifficulty"] = (*hexutil.Big)(td)
+	if fullTx {
+		if err = fillSenders(tx, block); err != nil {
+			return nil, err
+		}
+	}
 	response, err := ethapi.RPCMarshalBlock(block, true, fullTx, additionalFields)
 
 	if err == nil && int64(number) == rpc.PendingBlockNumber.Int64() {
@@ -86,11 +96,11 @@ func (api *APIImpl) GetBlockByHash(ctx context.Context, hash common.Hash, fullTx
 
 // GetBlockTransactionCountByNumber implements eth_getBlockTransactionCountByNumber. Returns the number of transactions in a block given the block's block number.
 func (api *APIImpl) GetBlockTransactionCountByNumber(ctx context.Context, blockNr rpc.BlockNumber) (*hexutil.Uint, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	blockNum, err := getBlockNumber(blockNr, tx)
 	if err != nil {
@@ -110,11 +120,11 @@ func (api *APIImpl) GetBlockTransactionCountByNumber(ctx context.Context, blockN
 
 // GetBlockTransactionCountByHash implements eth_getBlockTransactionCountByHash. Returns the number of transactions in a block given the block's block hash.
 func (api *APIImpl) GetBlockTransactionCountByHash(ctx context.Context, blockHash common.Hash) (*hexutil.Uint, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	block, err := rawdb.ReadBlockByHash(tx, blockHash)
 	if err != nil {
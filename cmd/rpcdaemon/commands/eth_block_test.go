@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/internal/ethapi"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestBlock writes genesis funding the key owner and canonical block 1 with transactions
+// signed by given signers, one transaction per signer
+func writeTestBlock(t *testing.T, db ethdb.Database, key *ecdsa.PrivateKey, signers ...types.Signer) (*types.Block, types.Receipts) {
+	genesis := core.GenesisBlockForTesting(db, crypto.PubkeyToAddress(key.PublicKey), big.NewInt(params.Ether))
+
+	txs := make([]*types.Transaction, len(signers))
+	receipts := make(types.Receipts, len(signers))
+	for i, signer := range signers {
+		txn, err := types.SignTx(types.NewTransaction(uint64(i), common.HexToAddress("0x1"), uint256.NewInt().SetUint64(1), params.TxGas, uint256.NewInt(), nil), signer, key)
+		require.NoError(t, err)
+		txs[i] = txn
+		receipts[i] = &types.Receipt{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: uint64(i+1) * params.TxGas, GasUsed: params.TxGas, TxHash: txn.Hash()}
+	}
+	block := types.NewBlock(&types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Difficulty: big.NewInt(1)}, txs, nil, receipts)
+
+	ctx := context.Background()
+	require.NoError(t, rawdb.WriteBlock(ctx, db, block))
+	require.NoError(t, rawdb.WriteCanonicalHash(db, block.Hash(), 1))
+	require.NoError(t, rawdb.WriteTd(db, block.Hash(), 1, big.NewInt(2)))
+	rawdb.WriteTxLookupEntries(db, block)
+	rawdb.WriteReceipts(db, block.Hash(), 1, receipts)
+	return block, receipts
+}
+
+func blockTxsFrom(t *testing.T, fields map[string]interface{}) []common.Address {
+	txs, ok := fields["transactions"].([]interface{})
+	require.True(t, ok)
+	require.NotNil(t, txs)
+	res := make([]common.Address, len(txs))
+	for i, txn := range txs {
+		res[i] = txn.(*ethapi.RPCTransaction).From
+	}
+	return res
+}
+
+func TestGetBlockByNumberFullTxSendersFromBucket(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	block, _ := writeTestBlock(t, db, key, types.NewEIP155Signer(params.TestChainConfig.ChainID))
+
+	// senders stored by the senders stage must be used as is, without recovery
+	stored := common.HexToAddress("0xdeadbeef")
+	rawdb.WriteSenders(context.Background(), db, block.Hash(), 1, []common.Address{stored})
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	fields, err := api.GetBlockByNumber(context.Background(), rpc.BlockNumber(1), true)
+	require.NoError(t, err)
+	require.Equal(t, []common.Address{stored}, blockTxsFrom(t, fields))
+}
+
+func TestGetBlockByNumberFullTxRecoversMissingSenders(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	// pre-EIP-155 and EIP-155 transactions in one block
+	writeTestBlock(t, db, key, types.HomesteadSigner{}, types.NewEIP155Signer(params.TestChainConfig.ChainID))
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	fields, err := api.GetBlockByNumber(context.Background(), rpc.BlockNumber(1), true)
+	require.NoError(t, err)
+	require.Equal(t, []common.Address{from, from}, blockTxsFrom(t, fields))
+}
+
+func TestGetBlockByNumberFullTxEmptyBlock(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	writeTestBlock(t, db, key)
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	fields, err := api.GetBlockByNumber(context.Background(), rpc.BlockNumber(1), true)
+	require.NoError(t, err)
+	require.Empty(t, blockTxsFrom(t, fields))
+}
@@ -1,5 +1,20 @@
 package commands
 
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/filters"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+var errFilterNotFound = errors.New("filter not found")
+
 // NewPendingTransactionFilter implements eth_newPendingTransactionFilter. Creates a pending transaction filter in the node. To check if the state has changed, call eth_getFilterChanges.
 // Parameters:
 //   None
@@ -11,6 +26,12 @@ package commands
 //   None
 // Returns:
 //   QUANTITY - A filter id
+func (api *APIImpl) NewBlockFilter(_ context.Context) (rpc.ID, error) {
+	if api.filters == nil {
+		return "", rpc.ErrNotificationsUnsupported
+	}
+	return api.filters.NewBlockFilter(), nil
+}
 
 // NewFilter implements eth_newFilter. Creates an arbitrary filter object, based on filter options, to notify when the state changes (logs). To check if the state has changed, call eth_getFilterChanges.
 // Parameters:
@@ -29,9 +50,126 @@ package commands
 //   QUANTITY - The filter id
 // Returns:
 //   Boolean - true if the filter was successfully uninstalled, false otherwise
+func (api *APIImpl) UninstallFilter(_ context.Context, id rpc.ID) (bool, error) {
+	if api.filters == nil {
+		return false, rpc.ErrNotificationsUnsupported
+	}
+	return api.filters.UninstallBlockFilter(id), nil
+}
 
 // GetFilterChanges implements eth_getFilterChanges. Polling method for a previously-created filter, which returns an array of logs which occurred since last poll.
 // Parameters:
 //   QUANTITY - The filter id
 // Returns:
 //   Array - Array of log objects, or an empty array if nothing has changed since last poll
+// Note: only the block filters are supported, their changes are the hashes of the new blocks
+func (api *APIImpl) GetFilterChanges(_ context.Context, id rpc.ID) ([]common.Hash, error) {
+	if api.filters == nil {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	hashes, ok := api.filters.BlockFilterChanges(id)
+	if !ok {
+		return nil, errFilterNotFound
+	}
+	return hashes, nil
+}
+
+// NewHeads implements eth_subscribe("newHeads"). Sends a notification each time a new header is appended to the chain.
+// Parameters:
+//   None
+// Returns:
+//   Subscription - the headers of the new blocks
+func (api *APIImpl) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	if api.filters == nil {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	id, headers := api.filters.SubscribeNewHeads()
+	go func() {
+		defer api.filters.UnsubscribeHeads(id)
+		for {
+			select {
+			case h := <-headers:
+				if err := notifier.Notify(rpcSub.ID, h); err != nil {
+					return
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// Logs implements eth_subscribe("logs"). Sends a notification for each log of the new blocks matching the criteria.
+// When the chain is reorganised, the logs of the abandoned blocks are sent again with "removed": true.
+// Parameters:
+//   Object - The filter options, fromBlock and toBlock limit the block numbers of the logs
+// Returns:
+//   Subscription - the matching logs
+func (api *APIImpl) Logs(ctx context.Context, crit filters.FilterCriteria) (*rpc.Subscription, error) {
+	if api.filters == nil {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	id, logs := api.filters.SubscribeLogs(crit)
+	go func() {
+		defer api.filters.UnsubscribeLogs(id)
+		for {
+			select {
+			case batch := <-logs:
+				for _, l := range batch {
+					if err := notifier.Notify(rpcSub.ID, l); err != nil {
+						return
+					}
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// logsBackend - headers and receipts of the new heads for the logs subscriptions, see filters.LogTail
+type logsBackend struct {
+	db ethdb.Database
+}
+
+func (b *logsBackend) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	ctx, tx, rollback, err := beginRequestTx(ctx, b.db)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback()
+	return rawdb.ReadHeaderByHash(tx, hash)
+}
+
+func (b *logsBackend) GetReceipts(ctx context.Context, hash common.Hash) (types.Receipts, error) {
+	ctx, tx, rollback, err := beginRequestTx(ctx, b.db)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback()
+	number := rawdb.ReadHeaderNumber(tx, hash)
+	if number == nil {
+		return nil, fmt.Errorf("block not found: %x", hash)
+	}
+	return getReceipts(ctx, tx, *number, hash)
+}
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"math/big"
 
@@ -14,25 +15,31 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
 	"github.com/ledgerwatch/turbo-geth/eth/filters"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/turbo/adapter"
 	"github.com/ledgerwatch/turbo-geth/turbo/transactions"
 )
 
-func getReceipts(ctx context.Context, tx rawdb.DatabaseReader, number uint64, hash common.Hash) (types.Receipts, error) {
+func getReceipts(ctx context.Context, tx ethdb.Database, number uint64, hash common.Hash) (types.Receipts, error) {
 	if cached := rawdb.ReadReceipts(tx, hash, number); cached != nil {
 		return cached, nil
 	}
+	if split, err := readReceiptsSplit(tx, number, hash); err != nil {
+		return nil, err
+	} else if split != nil {
+		return split, nil
+	}
 
 	block := rawdb.ReadBlock(tx, hash, number)
 
-	cc := adapter.NewChainContext(tx)
-	bc := adapter.NewBlockGetter(tx)
 	chainConfig, err := getChainConfig(tx)
 	if err != nil {
 		return nil, err
 	}
+	cc := adapter.NewChainContext(tx, adapter.NewEngine(chainConfig, tx))
+	bc := adapter.NewBlockGetter(tx)
 	_, _, ibs, dbstate, err := transactions.ComputeTxEnv(ctx, bc, chainConfig, cc, tx.(ethdb.HasTx).Tx(), hash, 0)
 	if err != nil {
 		return nil, err
@@ -55,14 +62,46 @@ func getReceipts(ctx context.Context, tx rawdb.DatabaseReader, number uint64, ha
 	return receipts, nil
 }
 
+// readReceiptsSplit - receipts of the canonical block reassembled from the split storage, with derived fields,
+// nil if they are not there
+func readReceiptsSplit(tx rawdb.DatabaseReader, number uint64, hash common.Hash) (types.Receipts, error) {
+	hasTx, ok := tx.(ethdb.HasTx)
+	if !ok || hasTx.Tx() == nil {
+		return nil, nil
+	}
+	canonical, err := rawdb.ReadCanonicalHash(tx, number)
+	if err != nil {
+		return nil, err
+	}
+	if canonical != hash {
+		return nil, nil
+	}
+	receipts, err := rawdb.ReadReceiptsSplit(hasTx.Tx(), number, true /* withLogs */)
+	if err != nil || receipts == nil {
+		return nil, err
+	}
+	body := rawdb.ReadBody(tx, hash, number)
+	if body == nil {
+		return nil, nil
+	}
+	senders, err := rawdb.ReadSendersPreferSenders2(tx, hash, number)
+	if err != nil {
+		return nil, err
+	}
+	if err := receipts.DeriveFields(hash, number, body.Transactions, senders); err != nil {
+		return nil, fmt.Errorf("derive fields of receipts of block %d: %w", number, err)
+	}
+	return receipts, nil
+}
+
 // GetLogsByHash non-standard RPC that returns all logs in a block
 // TODO(tjayrush): Since this is non-standard we could rename it to GetLogsByBlockHash to be more consistent and avoid confusion
 func (api *APIImpl) GetLogsByHash(ctx context.Context, hash common.Hash) ([][]*types.Log, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	ctx, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	number := rawdb.ReadHeaderNumber(tx, hash)
 	if number == nil {
@@ -84,14 +123,14 @@ func (api *APIImpl) GetLogs(ctx context.Context, crit filters.FilterCriteria) ([
 	var begin, end uint64
 	var logs []*types.Log //nolint:prealloc
 
-	tx, beginErr := api.dbReader.Begin(ctx, false)
+	ctx, tx, rollback, beginErr := beginRequestTx(ctx, api.dbReader)
 	if beginErr != nil {
 		return returnLogs(logs), beginErr
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	if crit.BlockHash != nil {
-		number := rawdb.ReadHeaderNumber(api.dbReader, *crit.BlockHash)
+		number := rawdb.ReadHeaderNumber(tx, *crit.BlockHash)
 		if number == nil {
 			return nil, fmt.Errorf("block not found: %x", *crit.BlockHash)
 		}
@@ -99,7 +138,7 @@ func (api *APIImpl) GetLogs(ctx context.Context, crit filters.FilterCriteria) ([
 		end = *number
 	} else {
 		// Convert the RPC block numbers into internal representations
-		latest, err := getLatestBlockNumber(api.dbReader)
+		latest, err := getLatestBlockNumber(tx)
 		if err != nil {
 			return nil, err
 		}
@@ -114,6 +153,56 @@ func (api *APIImpl) GetLogs(ctx context.Context, crit filters.FilterCriteria) ([
 		}
 	}
 
+	blockNumbers, err := getLogsBlocks(tx, crit, begin, end)
+	if err != nil {
+		return nil, err
+	}
+	if blockNumbers.GetCardinality() == 0 {
+		return returnLogs(logs), nil
+	}
+
+	for _, blockNToMatch := range blockNumbers.ToArray() {
+		blockHash, err := rawdb.ReadCanonicalHash(tx, uint64(blockNToMatch))
+		if err != nil {
+			return returnLogs(logs), err
+		}
+		if blockHash == (common.Hash{}) {
+			return returnLogs(logs), fmt.Errorf("block not found %d", uint64(blockNToMatch))
+		}
+		receipts, err := getReceipts(ctx, tx, uint64(blockNToMatch), blockHash)
+		if err != nil {
+			return returnLogs(logs), err
+		}
+		unfiltered := make([]*types.Log, 0, len(receipts))
+		for _, receipt := range receipts {
+			unfiltered = append(unfiltered, receipt.Logs...)
+		}
+		unfiltered = filterLogs(unfiltered, nil, nil, crit.Addresses, crit.Topics)
+		logs = append(logs, unfiltered...)
+	}
+
+	return returnLogs(logs), nil
+}
+
+// getLogsBlocks - blocks [begin, end] which may have logs matching the criteria. Logs index is used when it covers
+// the range, otherwise blooms of the blocks are used if they're written (see stages.BlockBloom).
+func getLogsBlocks(tx ethdb.Database, crit filters.FilterCriteria, begin, end uint64) (*roaring.Bitmap, error) {
+	logIndexAt, _, err := stages.GetStageProgress(tx, stages.LogIndex)
+	if err != nil {
+		return nil, err
+	}
+	if logIndexAt < end {
+		bloomAt, _, err := stages.GetStageProgress(tx, stages.BlockBloom)
+		if err != nil {
+			return nil, err
+		}
+		if bloomAt >= end {
+			blooms := tx.(ethdb.HasTx).Tx().Cursor(dbutils.BlockBloomPrefix)
+			defer blooms.Close()
+			return getBloomBitmap(blooms, crit.Addresses, crit.Topics, begin, end)
+		}
+	}
+
 	blockNumbers := roaring.New()
 	blockNumbers.AddRange(begin, end+1) // [min,max)
 
@@ -151,31 +240,69 @@ func (api *APIImpl) GetLogs(ctx context.Context, crit filters.FilterCriteria) ([
 		}
 	}
 
-	if blockNumbers.GetCardinality() == 0 {
-		return returnLogs(logs), nil
+	return blockNumbers, nil
+}
+
+// getBloomBitmap - blocks [from, to] whose blooms may contain logs of any of the addresses (if any) and
+// of any topic of every non-empty topics position, same semantics as getTopicsBitmap but without positions
+func getBloomBitmap(c ethdb.Cursor, addresses []common.Address, topics [][]common.Hash, from, to uint64) (*roaring.Bitmap, error) {
+	addrBlooms := make([]types.Bloom, len(addresses))
+	for i, addr := range addresses {
+		addrBlooms[i] = types.BytesToBloom(types.Bloom9(addr[:]).Bytes())
+	}
+	topicBlooms := make([][]types.Bloom, 0, len(topics))
+	for _, sub := range topics {
+		if len(sub) == 0 {
+			continue // wildcard
+		}
+		subBlooms := make([]types.Bloom, len(sub))
+		for i, topic := range sub {
+			subBlooms[i] = types.BytesToBloom(types.Bloom9(topic[:]).Bytes())
+		}
+		topicBlooms = append(topicBlooms, subBlooms)
 	}
 
-	for _, blockNToMatch := range blockNumbers.ToArray() {
-		blockHash, err := rawdb.ReadCanonicalHash(tx, uint64(blockNToMatch))
+	res := roaring.New()
+	for k, v, err := c.Seek(dbutils.EncodeBlockNumber(from)); k != nil; k, v, err = c.Next() {
 		if err != nil {
-			return returnLogs(logs), err
+			return nil, err
 		}
-		if blockHash == (common.Hash{}) {
-			return returnLogs(logs), fmt.Errorf("block not found %d", uint64(blockNToMatch))
+		blockNum := binary.BigEndian.Uint64(k)
+		if blockNum > to {
+			break
 		}
-		receipts, err := getReceipts(ctx, tx, uint64(blockNToMatch), blockHash)
-		if err != nil {
-			return returnLogs(logs), err
+		bloom := types.BytesToBloom(v)
+		if len(addrBlooms) > 0 && !bloomContainsAny(&bloom, addrBlooms) {
+			continue
 		}
-		unfiltered := make([]*types.Log, 0, len(receipts))
-		for _, receipt := range receipts {
-			unfiltered = append(unfiltered, receipt.Logs...)
+		matches := true
+		for _, subBlooms := range topicBlooms {
+			if !bloomContainsAny(&bloom, subBlooms) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			res.Add(uint32(blockNum))
 		}
-		unfiltered = filterLogs(unfiltered, nil, nil, crit.Addresses, crit.Topics)
-		logs = append(logs, unfiltered...)
 	}
+	return res, nil
+}
 
-	return returnLogs(logs), nil
+func bloomContainsAny(bloom *types.Bloom, needles []types.Bloom) bool {
+	for i := range needles {
+		contains := true
+		for j := range needles[i] {
+			if bloom[j]&needles[i][j] != needles[i][j] {
+				contains = false
+				break
+			}
+		}
+		if contains {
+			return true
+		}
+	}
+	return false
 }
 
 // The Topic list restricts matches to particular event topics. Each event has a list
@@ -218,15 +345,15 @@ func getTopicsBitmap(c ethdb.Cursor, topics [][]common.Hash, from, to uint32) (*
 
 // GetTransactionReceipt implements eth_getTransactionReceipt. Returns the receipt of a transaction given the transaction's hash.
 func (api *APIImpl) GetTransactionReceipt(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	ctx, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	// Retrieve the transaction and assemble its EVM context
 	txn, blockHash, blockNumber, txIndex := rawdb.ReadTransaction(tx, hash)
-	if tx == nil {
+	if txn == nil {
 		return nil, fmt.Errorf("transaction %#x not found", hash)
 	}
 
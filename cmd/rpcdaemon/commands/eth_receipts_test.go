@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+// countingKV counts all read transactions opened through it
+type countingKV struct {
+	ethdb.KV
+	txs int32
+}
+
+func (db *countingKV) View(ctx context.Context, f func(tx ethdb.Tx) error) error {
+	atomic.AddInt32(&db.txs, 1)
+	return db.KV.View(ctx, f)
+}
+
+func (db *countingKV) Begin(ctx context.Context, parent ethdb.Tx, writable bool) (ethdb.Tx, error) {
+	if parent == nil {
+		atomic.AddInt32(&db.txs, 1)
+	}
+	return db.KV.Begin(ctx, parent, writable)
+}
+
+func TestGetTransactionReceiptUsesSingleTx(t *testing.T) {
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+	db := ethdb.NewObjectDatabase(kv)
+
+	key, _ := crypto.GenerateKey()
+	block, _ := writeTestBlock(t, db, key, types.NewEIP155Signer(params.TestChainConfig.ChainID))
+	txn := block.Transactions()[0]
+
+	counting := &countingKV{KV: kv}
+	api := NewEthAPI(counting, ethdb.NewObjectDatabase(counting), nil, nil, 0)
+	fields, err := api.GetTransactionReceipt(context.Background(), txn.Hash())
+	require.NoError(t, err)
+	require.Equal(t, block.Hash(), fields["blockHash"])
+	require.Equal(t, crypto.PubkeyToAddress(key.PublicKey), fields["from"])
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.txs))
+}
+
+// writeBlooms writes blooms of blocks [0, blocks), the sparse topic is logged in every 1000th block only,
+// other blocks have logs of a few random contracts
+func writeBlooms(tb testing.TB, db ethdb.Database, blocks uint64, sparse common.Hash) {
+	rnd := rand.New(rand.NewSource(1))
+	for blockNum := uint64(0); blockNum < blocks; blockNum++ {
+		var logs []*types.Log
+		for i := 0; i < 10; i++ {
+			var addr common.Address
+			var topic common.Hash
+			rnd.Read(addr[:])
+			rnd.Read(topic[:])
+			logs = append(logs, &types.Log{Address: addr, Topics: []common.Hash{topic}})
+		}
+		if blockNum%1000 == 0 {
+			logs = append(logs, &types.Log{Address: common.HexToAddress("0x01"), Topics: []common.Hash{sparse}})
+		}
+		require.NoError(tb, rawdb.WriteBlockBloom(db, blockNum, types.CreateBloom(types.Receipts{{Logs: logs}})))
+	}
+}
+
+func TestGetBloomBitmap(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	sparse := common.HexToHash("0x1234")
+	writeBlooms(t, db, 10_000, sparse)
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	c := tx.Cursor(dbutils.BlockBloomPrefix)
+	defer c.Close()
+
+	m, err := getBloomBitmap(c, nil, [][]common.Hash{{sparse}}, 0, 9_999)
+	require.NoError(t, err)
+	for i := uint32(0); i < 10_000; i += 1000 {
+		require.True(t, m.Contains(i), "block %d", i)
+	}
+	// false positives are possible, but rare
+	require.Less(t, m.GetCardinality(), uint64(20))
+
+	m, err = getBloomBitmap(c, []common.Address{common.HexToAddress("0x01")}, [][]common.Hash{{}, {sparse}}, 2000, 5000)
+	require.NoError(t, err)
+	for i := uint32(2000); i <= 5000; i += 1000 {
+		require.True(t, m.Contains(i), "block %d", i)
+	}
+	require.Equal(t, uint32(2000), m.Minimum())
+	require.Equal(t, uint32(5000), m.Maximum())
+
+	// no criteria - all blocks
+	m, err = getBloomBitmap(c, nil, nil, 10, 19)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), m.GetCardinality())
+}
+
+// BenchmarkGetBloomBitmapSparseTopic - bloom-only filtering of 100k blocks for a topic logged in every 1000th block
+func BenchmarkGetBloomBitmapSparseTopic(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	sparse := common.HexToHash("0x1234")
+	writeBlooms(b, db, 100_000, sparse)
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(b, err)
+	defer tx.Rollback()
+	c := tx.Cursor(dbutils.BlockBloomPrefix)
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m, err := getBloomBitmap(c, nil, [][]common.Hash{{sparse}}, 0, 99_999)
+		require.NoError(b, err)
+		require.True(b, m.GetCardinality() >= 100)
+	}
+}
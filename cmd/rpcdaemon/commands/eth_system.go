@@ -7,6 +7,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/eth"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/log"
 )
 
 // BlockNumber implements eth_blockNumber. Returns the block number of most recent block.
@@ -18,27 +19,48 @@ func (api *APIImpl) BlockNumber(_ context.Context) (hexutil.Uint64, error) {
 	return hexutil.Uint64(execution), nil
 }
 
+// SyncingResult is returned by eth_syncing while the node is catching up with the chain
+type SyncingResult struct {
+	CurrentBlock hexutil.Uint64  `json:"currentBlock"` // progress of the Execution stage
+	HighestBlock hexutil.Uint64  `json:"highestBlock"` // progress of the Headers stage
+	Stages       []StageProgress `json:"stages"`       // turbo-geth extension: progress of every stage
+}
+
+// StageProgress is the block number reached by one stage of the staged sync
+type StageProgress struct {
+	StageName   string         `json:"stageName"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+}
+
 // Syncing implements eth_syncing. Returns a data object detaling the status of the sync process or false if not syncing.
-func (api *APIImpl) Syncing(_ context.Context) (interface{}, error) {
-	highestBlock, _, err := stages.GetStageProgress(api.dbReader, stages.Headers)
+// The node is considered synced when Bodies and Execution stages have reached the Headers stage.
+func (api *APIImpl) Syncing(ctx context.Context) (interface{}, error) {
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return false, err
 	}
+	defer rollback()
 
-	currentBlock, _, err := stages.GetStageProgress(api.dbReader, stages.Finish)
-	if err != nil {
-		return false, err
+	progress := make(map[string]uint64, len(stages.AllStages))
+	result := SyncingResult{Stages: make([]StageProgress, 0, len(stages.AllStages))}
+	for _, stage := range stages.AllStages {
+		blockNumber, _, err := stages.GetStageProgress(tx, stage)
+		if err != nil {
+			return false, err
+		}
+		progress[string(stage)] = blockNumber
+		result.Stages = append(result.Stages, StageProgress{StageName: string(stage), BlockNumber: hexutil.Uint64(blockNumber)})
 	}
 
+	highestBlock := progress[string(stages.Headers)]
+	currentBlock := progress[string(stages.Execution)]
 	// Return not syncing if the synchronisation already completed
-	if currentBlock >= highestBlock {
+	if currentBlock >= highestBlock && progress[string(stages.Bodies)] >= highestBlock {
 		return false, nil
 	}
-	// Otherwise gather the block sync stats
-	return map[string]hexutil.Uint64{
-		"currentBlock": hexutil.Uint64(currentBlock),
-		"highestBlock": hexutil.Uint64(highestBlock),
-	}, nil
+	result.CurrentBlock = hexutil.Uint64(currentBlock)
+	result.HighestBlock = hexutil.Uint64(highestBlock)
+	return result, nil
 }
 
 // ChainId implements eth_chainId. Returns the current ethereum chainId.
@@ -57,7 +79,15 @@ func (api *APIImpl) ChainId(ctx context.Context) (hexutil.Uint64, error) {
 }
 
 // ProtocolVersion implements eth_protocolVersion. Returns the current ethereum protocol version.
+// Without the backend it returns the primary version of this build, the chain config does not have it
 func (api *APIImpl) ProtocolVersion(_ context.Context) (hexutil.Uint, error) {
+	if api.ethBackend != nil {
+		versions, err := api.ethBackend.ProtocolVersions()
+		if err == nil {
+			return hexutil.Uint(versions[0]), nil
+		}
+		log.Warn("eth_protocolVersion: backend is not available, using the version of this build", "err", err)
+	}
 	return hexutil.Uint(eth.ProtocolVersions[0]), nil
 }
 
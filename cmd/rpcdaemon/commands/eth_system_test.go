@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func seedStages(t *testing.T, db ethdb.Database, progress map[string]uint64) {
+	for _, stage := range stages.AllStages {
+		require.NoError(t, stages.SaveStageProgress(db, stage, progress[string(stage)], nil))
+	}
+}
+
+func TestSyncingLagging(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	seedStages(t, db, map[string]uint64{
+		string(stages.Headers):   1000,
+		string(stages.Bodies):    900,
+		string(stages.Execution): 500,
+	})
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	res, err := api.Syncing(context.Background())
+	require.NoError(t, err)
+	syncing, ok := res.(SyncingResult)
+	require.True(t, ok)
+	require.Equal(t, hexutil.Uint64(500), syncing.CurrentBlock)
+	require.Equal(t, hexutil.Uint64(1000), syncing.HighestBlock)
+	require.Len(t, syncing.Stages, len(stages.AllStages))
+	for _, s := range syncing.Stages {
+		switch s.StageName {
+		case string(stages.Bodies):
+			require.Equal(t, hexutil.Uint64(900), s.BlockNumber)
+		case string(stages.Senders):
+			require.Equal(t, hexutil.Uint64(0), s.BlockNumber)
+		}
+	}
+}
+
+func TestSyncingBodiesLagging(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	// execution can't be ahead of bodies in practice, but eth_syncing must not rely on it
+	seedStages(t, db, map[string]uint64{
+		string(stages.Headers):   1000,
+		string(stages.Bodies):    999,
+		string(stages.Execution): 1000,
+	})
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	res, err := api.Syncing(context.Background())
+	require.NoError(t, err)
+	require.IsType(t, SyncingResult{}, res)
+}
+
+func TestSyncingAtHead(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	progress := map[string]uint64{}
+	for _, stage := range stages.AllStages {
+		progress[string(stage)] = 1000
+	}
+	seedStages(t, db, progress)
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	res, err := api.Syncing(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, false, res)
+}
+
+func TestSyncingEmptyDatabase(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	api := NewEthAPI(db.KV(), db, nil, nil, 0)
+	res, err := api.Syncing(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, false, res)
+}
@@ -2,29 +2,30 @@ package commands
 
 import (
 	"context"
-	"fmt"
 	"strconv"
 
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
-
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
 )
 
 // NetAPI the interface for the net_ RPC commands
 type NetAPI interface {
 	Listening(_ context.Context) (bool, error)
-	Version(_ context.Context) (string, error)
+	Version(ctx context.Context) (string, error)
 	PeerCount(_ context.Context) (hexutil.Uint, error)
 }
 
 // NetAPIImpl data structure to store things needed for net_ commands
 type NetAPIImpl struct {
+	dbReader   ethdb.Database
 	ethBackend ethdb.Backend
 }
 
 // NewNetAPIImpl returns NetAPIImplImpl instance
-func NewNetAPIImpl(eth ethdb.Backend) *NetAPIImpl {
+func NewNetAPIImpl(dbReader ethdb.Database, eth ethdb.Backend) *NetAPIImpl {
 	return &NetAPIImpl{
+		dbReader:   dbReader,
 		ethBackend: eth,
 	}
 }
@@ -36,18 +37,28 @@ func (api *NetAPIImpl) Listening(_ context.Context) (bool, error) {
 }
 
 // Version implements net_version. Returns the current network id.
-func (api *NetAPIImpl) Version(_ context.Context) (string, error) {
-	if api.ethBackend == nil {
-		// We're running in --chaindata mode or otherwise cannot get the backend
-		return "", fmt.Errorf(NotAvailableChainData, "net_version")
+// Without the backend (--chaindata mode, or the node is not reachable) it returns the chain id of the chain config,
+// which is the network id of the public networks
+func (api *NetAPIImpl) Version(ctx context.Context) (string, error) {
+	if api.ethBackend != nil {
+		res, err := api.ethBackend.NetVersion()
+		if err == nil {
+			return strconv.FormatUint(res, 10), nil
+		}
+		log.Warn("net_version: backend is not available, using the chain config", "err", err)
 	}
 
-	res, err := api.ethBackend.NetVersion()
+	tx, err := api.dbReader.Begin(ctx, false)
 	if err != nil {
 		return "", err
 	}
+	defer tx.Rollback()
 
-	return strconv.FormatUint(res, 10), nil
+	chainConfig, err := getChainConfig(tx)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(chainConfig.ChainID.Uint64(), 10), nil
 }
 
 // PeerCount implements net_peerCount. Returns number of peers currently connected to the client.
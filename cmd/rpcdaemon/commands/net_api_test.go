@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// countingBackend - the node side of the ETHBACKEND service, counts the calls which reach the node
+type countingBackend struct {
+	netVersionCalls       int
+	protocolVersionsCalls int
+}
+
+func (b *countingBackend) TxPool() *core.TxPool               { return nil }
+func (b *countingBackend) Etherbase() (common.Address, error) { return common.Address{}, nil }
+
+func (b *countingBackend) NetVersion() (uint64, error) {
+	b.netVersionCalls++
+	return 1337, nil
+}
+
+func (b *countingBackend) ProtocolVersions() []uint {
+	b.protocolVersionsCalls++
+	return []uint{65, 64}
+}
+
+func TestVersionsOverPrivateAPI(t *testing.T) {
+	conn := bufconn.Listen(1024 * 1024)
+	node := &countingBackend{}
+	grpcServer := grpc.NewServer()
+	remote.RegisterETHBACKENDServer(grpcServer, remotedbserver.NewEthBackendServer(node, nil))
+	go func() {
+		_ = grpcServer.Serve(conn)
+	}()
+	defer grpcServer.Stop()
+
+	kv, backend := ethdb.NewRemote().InMem(conn).MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+
+	netAPI := NewNetAPIImpl(nil, backend)
+	ethAPI := NewEthAPI(kv, nil, backend, nil, 0)
+	for i := 0; i < 3; i++ {
+		version, err := netAPI.Version(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "1337", version)
+		protocolVersion, err := ethAPI.ProtocolVersion(ctx)
+		require.NoError(t, err)
+		require.Equal(t, hexutil.Uint(65), protocolVersion)
+	}
+	require.Equal(t, 1, node.netVersionCalls, "cached by the client")
+	require.Equal(t, 1, node.protocolVersionsCalls, "cached by the client")
+}
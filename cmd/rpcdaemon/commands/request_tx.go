@@ -0,0 +1,25 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+type requestTxKey struct{}
+
+// beginRequestTx returns read transaction shared by everything executed within one RPC call.
+// The first call opens the transaction and stores it in the returned context, nested calls
+// receive the same one. This way the call sees a consistent snapshot of the database even if
+// the writer advances meanwhile, and occupies only one reader slot.
+// The returned rollback function closes the transaction only for the caller which opened it.
+func beginRequestTx(ctx context.Context, db ethdb.Database) (context.Context, ethdb.DbWithPendingMutations, func(), error) {
+	if tx, ok := ctx.Value(requestTxKey{}).(ethdb.DbWithPendingMutations); ok {
+		return ctx, tx, func() {}, nil
+	}
+	tx, err := db.Begin(ctx, false)
+	if err != nil {
+		return ctx, nil, nil, err
+	}
+	return context.WithValue(ctx, requestTxKey{}, tx), tx, tx.Rollback, nil
+}
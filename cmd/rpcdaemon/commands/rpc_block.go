@@ -2,10 +2,13 @@ package commands
 
 import (
 	"fmt"
+	"runtime"
 
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/rpc"
+	"golang.org/x/sync/errgroup"
 )
 
 func getBlockNumber(number rpc.BlockNumber, dbReader rawdb.DatabaseReader) (uint64, error) {
@@ -33,3 +36,43 @@ func getLatestBlockNumber(dbReader rawdb.DatabaseReader) (uint64, error) {
 
 	return blockNum, nil
 }
+
+// fillSenders sets senders of the block transactions from the Senders2 or Senders bucket, so marshalling
+// full transactions doesn't need ECDSA recovery. Senders missing in the buckets are recovered from the
+// signatures in parallel, with the same signers as newRPCTransaction, which then finds them cached.
+func fillSenders(dbReader rawdb.DatabaseReader, block *types.Block) error {
+	txs := block.Transactions()
+	if len(txs) == 0 {
+		return nil
+	}
+	senders, err := rawdb.ReadSendersPreferSenders2(dbReader, block.Hash(), block.NumberU64())
+	if err != nil {
+		return err
+	}
+	if len(senders) == len(txs) {
+		(&types.Body{Transactions: txs}).SendersToTxs(senders)
+		return nil
+	}
+
+	next := make(chan *types.Transaction, len(txs))
+	for _, txn := range txs {
+		next <- txn
+	}
+	close(next)
+	var g errgroup.Group
+	for i := 0; i < runtime.NumCPU() && i < len(txs); i++ {
+		g.Go(func() error {
+			for txn := range next {
+				var signer types.Signer = types.FrontierSigner{}
+				if txn.Protected() {
+					signer = types.NewEIP155Signer(txn.ChainID().ToBig())
+				}
+				if _, err := types.Sender(signer, txn); err != nil {
+					return fmt.Errorf("sender of tx %x: %w", txn.Hash(), err)
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// AccountChange is the state of the account before the block changed it, Account is nil if the account didn't exist
+type AccountChange struct {
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	Account     *AccountState  `json:"account"`
+}
+
+// AccountState is the account as stored in the state, without the storage root
+type AccountState struct {
+	Nonce       hexutil.Uint64 `json:"nonce"`
+	Balance     *hexutil.Big   `json:"balance"`
+	CodeHash    common.Hash    `json:"codeHash"`
+	Incarnation hexutil.Uint64 `json:"incarnation"`
+}
+
+// GetAccountHistory implements tg_getAccountHistory. Returns the changes of the account in blocks [fromBlock, toBlock]
+// in ascending order, each with the state of the account right before the block.
+func (api *TgImpl) GetAccountHistory(ctx context.Context, address common.Address, fromBlock, toBlock rpc.BlockNumber) ([]AccountChange, error) {
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback()
+
+	from, err := getBlockNumber(fromBlock, tx)
+	if err != nil {
+		return nil, err
+	}
+	to, err := getBlockNumber(toBlock, tx)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("fromBlock %d is greater than toBlock %d", from, to)
+	}
+
+	it, err := state.AccountHistoryIterator(tx.(ethdb.HasTx).Tx(), true /* plain */, address[:], from, to)
+	if err != nil {
+		return nil, toHistoryError(err)
+	}
+	defer it.Close()
+
+	result := []AccountChange{}
+	for {
+		blockNum, accData, ok, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		change := AccountChange{BlockNumber: hexutil.Uint64(blockNum)}
+		if accData != nil {
+			var acc accounts.Account
+			if err = acc.DecodeForStorage(accData); err != nil {
+				return nil, fmt.Errorf("decoding account %x at block %d: %w", address, blockNum, err)
+			}
+			change.Account = &AccountState{
+				Nonce:       hexutil.Uint64(acc.Nonce),
+				Balance:     (*hexutil.Big)(acc.Balance.ToBig()),
+				CodeHash:    acc.CodeHash,
+				Incarnation: hexutil.Uint64(acc.Incarnation),
+			}
+		}
+		result = append(result, change)
+	}
+	return result, nil
+}
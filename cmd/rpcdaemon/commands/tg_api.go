@@ -4,8 +4,11 @@ import (
 	"context"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/migrations"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 )
 
@@ -13,6 +16,9 @@ import (
 type TgAPI interface {
 	// System related (see ./tg_system.go)
 	Forks(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (Forks, error)
+	StageMetrics(ctx context.Context) (map[string]*stages.StageMetrics, error)
+	BucketStats(ctx context.Context) (map[string]*ethdb.BucketStat, error)
+	MigrationStatus(ctx context.Context) ([]migrations.BackgroundMigrationStatus, error)
 
 	// Blocks related (see ./tg_blocks.go)
 	GetHeaderByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Header, error)
@@ -26,6 +32,15 @@ type TgAPI interface {
 	// BlockReward(ctx context.Context, blockNr rpc.BlockNumber) (Issuance, error)
 	// UncleReward(ctx context.Context, blockNr rpc.BlockNumber) (Issuance, error)
 	Issuance(ctx context.Context, blockNr rpc.BlockNumber) (Issuance, error)
+
+	// Storage related (see ./tg_storage.go)
+	GetStorageRangeAt(ctx context.Context, blockHash common.Hash, txIndex uint64, contractAddress common.Address, keyStart hexutil.Bytes, maxResult int) (StorageRangeResult, error)
+
+	// Account related (see ./tg_account_history.go)
+	GetAccountHistory(ctx context.Context, address common.Address, fromBlock, toBlock rpc.BlockNumber) ([]AccountChange, error)
+
+	// Code related (see ./tg_code.go)
+	GetCodeAsOf(ctx context.Context, address common.Address, blockNr rpc.BlockNumber) (hexutil.Bytes, error)
 }
 
 // TgImpl is implementation of the TgAPI interface
@@ -0,0 +1,35 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// GetCodeAsOf implements tg_getCodeAsOf. Returns the code of the contract at the end of the given block.
+// Unlike eth_getCode it resolves the incarnation of the contract alive at that block, so the code of
+// self-destructed and recreated contracts is returned for the right incarnation.
+func (api *TgImpl) GetCodeAsOf(ctx context.Context, address common.Address, blockNr rpc.BlockNumber) (hexutil.Bytes, error) {
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback()
+
+	blockNum, err := getBlockNumber(blockNr, tx)
+	if err != nil {
+		return nil, err
+	}
+	code, err := state.GetCodeAsOf(tx.(ethdb.HasTx).Tx(), true /* plain */, address[:], blockNum+1)
+	if err != nil {
+		return nil, toHistoryError(err)
+	}
+	if code == nil {
+		return hexutil.Bytes(""), nil
+	}
+	return code, nil
+}
@@ -11,11 +11,11 @@ import (
 
 // GetLogsByHash implements tg_getLogsByHash. Returns an array of arrays of logs generated by the transactions in the block given by the block's hash.
 func (api *TgImpl) GetLogsByHash(ctx context.Context, hash common.Hash) ([][]*types.Log, error) {
-	tx, err := api.dbReader.Begin(ctx, false)
+	ctx, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	defer rollback()
 
 	number := rawdb.ReadHeaderNumber(tx, hash)
 	if number == nil {
@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// GetStorageRangeAt implements tg_getStorageRangeAt. Returns the storage of the contract, in the order of hashed storage keys,
+// starting from keyStart, at the point of the block right before execution of the transaction with index txIndex.
+// Only txIndex 0 (state before the block) and txIndex equal to the number of transactions (state after the block) can be served
+// from the history, other points require re-execution and are available via debug_storageRangeAt.
+// The result is compatible with debug_storageRangeAt: next page is requested by passing returned nextKey as keyStart.
+func (api *TgImpl) GetStorageRangeAt(ctx context.Context, blockHash common.Hash, txIndex uint64, contractAddress common.Address, keyStart hexutil.Bytes, maxResult int) (StorageRangeResult, error) {
+	_, tx, rollback, err := beginRequestTx(ctx, api.dbReader)
+	if err != nil {
+		return StorageRangeResult{}, err
+	}
+	defer rollback()
+
+	block, err := rawdb.ReadBlockByHash(tx, blockHash)
+	if err != nil {
+		return StorageRangeResult{}, err
+	}
+	if block == nil {
+		return StorageRangeResult{}, fmt.Errorf("block not found: %x", blockHash)
+	}
+	var timestamp uint64
+	switch txIndex {
+	case 0:
+		timestamp = block.NumberU64()
+	case uint64(len(block.Transactions())):
+		timestamp = block.NumberU64() + 1
+	default:
+		return StorageRangeResult{}, fmt.Errorf("state in the middle of the block %d (txIndex %d) is not available, use debug_storageRangeAt", block.NumberU64(), txIndex)
+	}
+
+	return storageRangeAsOf(tx, contractAddress, keyStart, maxResult, timestamp)
+}
+
+// storageRangeAsOf walks over the hashed state of the contract as of given timestamp.
+// Keys which preimages are not known are returned with nil Key, as geth does.
+func storageRangeAsOf(db ethdb.Database, contractAddress common.Address, keyStart []byte, maxResult int, timestamp uint64) (StorageRangeResult, error) {
+	kvTx := db.(ethdb.HasTx).Tx()
+	accData, err := state.GetAsOf(kvTx, false /* storage */, contractAddress[:], timestamp)
+	if err != nil {
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return StorageRangeResult{}, fmt.Errorf("account %x doesn't exist", contractAddress)
+		}
+		return StorageRangeResult{}, toHistoryError(fmt.Errorf("retrieving account %x: %w", contractAddress, err))
+	}
+	if len(accData) == 0 {
+		return StorageRangeResult{}, fmt.Errorf("account %x doesn't exist", contractAddress)
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(accData); err != nil {
+		return StorageRangeResult{}, fmt.Errorf("decoding account %x: %w", contractAddress, err)
+	}
+
+	addrHash, err := common.HashData(contractAddress[:])
+	if err != nil {
+		return StorageRangeResult{}, err
+	}
+	startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength)
+	copy(startkey, dbutils.GenerateStoragePrefix(addrHash[:], acc.Incarnation))
+	copy(startkey[common.HashLength+common.IncarnationLength:], keyStart)
+	fixedbits := 8 * (common.HashLength + common.IncarnationLength)
+
+	result := StorageRangeResult{Storage: StorageMap{}}
+	if err = state.WalkAsOf(kvTx, dbutils.CurrentStateBucket, dbutils.StorageHistoryBucket, startkey, fixedbits, timestamp, func(k, v []byte) (bool, error) {
+		if len(v) == 0 {
+			// Skip deleted entries
+			return true, nil
+		}
+		seckey := common.BytesToHash(k[common.HashLength:])
+		if len(result.Storage) == maxResult {
+			result.NextKey = &seckey
+			return false, nil
+		}
+		entry := StorageEntry{Value: common.BytesToHash(v)}
+		if preimage := rawdb.ReadPreimage(db, seckey); preimage != nil {
+			key := common.BytesToHash(preimage)
+			entry.Key = &key
+		}
+		result.Storage[seckey] = entry
+		return true, nil
+	}); err != nil {
+		return StorageRangeResult{}, fmt.Errorf("walking over storage of %x: %w", contractAddress, err)
+	}
+	return result, nil
+}
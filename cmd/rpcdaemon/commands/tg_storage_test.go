@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStorageRangeAtPagination(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	block, _ := writeTestBlock(t, db, key)
+
+	contract := common.HexToAddress("0xc0de")
+	acc := accounts.NewAccount()
+	acc.Incarnation = 1
+	accData := make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(accData)
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, contract[:], accData))
+
+	addrHash, err := common.HashData(contract[:])
+	require.NoError(t, err)
+	expected := map[common.Hash]common.Hash{}
+	for i := 1; i <= 5; i++ {
+		storageKey := common.BigToHash(big.NewInt(int64(i)))
+		seckey, err := common.HashData(storageKey[:])
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.CurrentStateBucket, dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, seckey), []byte{byte(i)}))
+		if i%2 == 1 {
+			rawdb.WritePreimages(db, map[common.Hash][]byte{seckey: storageKey[:]})
+		}
+		expected[seckey] = common.BytesToHash([]byte{byte(i)})
+	}
+
+	api := NewTgAPI(db.KV(), db)
+	collected := StorageMap{}
+	var start []byte
+	for page := 0; ; page++ {
+		require.Less(t, page, 3)
+		res, err := api.GetStorageRangeAt(context.Background(), block.Hash(), 0, contract, start, 2)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.Storage), 2)
+		for seckey, entry := range res.Storage {
+			_, seen := collected[seckey]
+			require.False(t, seen, "key %x returned twice", seckey)
+			collected[seckey] = entry
+		}
+		if res.NextKey == nil {
+			break
+		}
+		_, inPage := res.Storage[*res.NextKey]
+		require.False(t, inPage)
+		start = res.NextKey[:]
+	}
+
+	require.Len(t, collected, len(expected))
+	withPreimage := 0
+	for seckey, entry := range collected {
+		require.Equal(t, expected[seckey], entry.Value)
+		if entry.Key != nil {
+			hashed, err := common.HashData(entry.Key[:])
+			require.NoError(t, err)
+			require.Equal(t, seckey, hashed)
+			withPreimage++
+		}
+	}
+	require.Equal(t, 3, withPreimage)
+}
+
+func TestGetStorageRangeAtMiddleOfBlock(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, _ := crypto.GenerateKey()
+	block, _ := writeTestBlock(t, db, key, types.HomesteadSigner{}, types.HomesteadSigner{})
+
+	api := NewTgAPI(db.KV(), db)
+	_, err := api.GetStorageRangeAt(context.Background(), block.Hash(), 1, common.HexToAddress("0xc0de"), nil, 10)
+	require.Error(t, err)
+}
@@ -5,6 +5,9 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/forkid"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/migrations"
 	"github.com/ledgerwatch/turbo-geth/rpc"
 	"github.com/ledgerwatch/turbo-geth/turbo/rpchelper"
 )
@@ -51,3 +54,40 @@ func (api *TgImpl) Forks(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHas
 	}
 	return Forks{genesisHash, passedForks, nextFork}, nil
 }
+
+// StageMetrics implements tg_stageMetrics. Returns the latest timing and throughput of every sync stage which already ran, by stage name
+func (api *TgImpl) StageMetrics(ctx context.Context) (map[string]*stages.StageMetrics, error) {
+	tx, err := api.dbReader.Begin(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res := make(map[string]*stages.StageMetrics, len(stages.AllStages))
+	for _, stage := range stages.AllStages {
+		metrics, err := stages.GetStageMetrics(tx, stage)
+		if err != nil {
+			return nil, err
+		}
+		if metrics != nil {
+			res[string(stage)] = metrics
+		}
+	}
+	return res, nil
+}
+
+// BucketStats implements tg_bucketStats. Returns entries, pages and size of every database bucket, by bucket name
+func (api *TgImpl) BucketStats(ctx context.Context) (map[string]*ethdb.BucketStat, error) {
+	return ethdb.AllBucketsStat(ctx, api.db)
+}
+
+// MigrationStatus implements tg_migrationStatus. Returns the progress of the background migrations, features which
+// depend on an unfinished migration stay disabled until it's done
+func (api *TgImpl) MigrationStatus(ctx context.Context) ([]migrations.BackgroundMigrationStatus, error) {
+	tx, err := api.dbReader.Begin(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return migrations.BackgroundStatus(tx)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/ledgerwatch/turbo-geth/turbo/transactions"
 )
 
 // TraceAPI RPC interface into tracing API
@@ -28,10 +29,11 @@ type TraceAPI interface {
 
 // TraceAPIImpl is implementation of the TraceAPI interface based on remote Db access
 type TraceAPIImpl struct {
-	db        ethdb.KV
-	dbReader  ethdb.Database
-	maxTraces uint64
-	traceType string
+	db         ethdb.KV
+	dbReader   ethdb.Database
+	maxTraces  uint64
+	traceType  string
+	txEnvCache *transactions.TxEnvCache // nil if disabled, see --trace.txenvcache
 }
 
 // NewTraceAPI returns NewTraceAPI instance
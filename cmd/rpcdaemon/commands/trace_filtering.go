@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
@@ -244,7 +245,6 @@ func (api *TraceAPIImpl) Filter(ctx context.Context, req TraceFilterRequest) (Pa
 		return nil, err
 	}
 	getter := adapter.NewBlockGetter(api.dbReader)
-	chainContext := adapter.NewChainContext(api.dbReader)
 	genesis, err := rawdb.ReadBlockByNumber(api.dbReader, 0)
 	if err != nil {
 		return nil, err
@@ -254,6 +254,7 @@ func (api *TraceAPIImpl) Filter(ctx context.Context, req TraceFilterRequest) (Pa
 	if err != nil {
 		return nil, err
 	}
+	chainContext := adapter.NewChainContext(api.dbReader, adapter.NewEngine(chainConfig, api.dbReader))
 	traceType := "callTracer" // nolint: goconst
 	traces := ParityTraces{}
 	dbtx, err1 := api.db.Begin(ctx, nil, false)
@@ -293,7 +294,7 @@ func (api *TraceAPIImpl) Filter(ctx context.Context, req TraceFilterRequest) (Pa
 		} else {
 			// In this case, we're processing a transaction hash
 			tx, blockHash, blockNumber, txIndex := rawdb.ReadTransaction(api.dbReader, txOrBlockHash)
-			msg, vmctx, ibs, _, err := transactions.ComputeTxEnv(ctx, getter, chainConfig, chainContext, dbtx, blockHash, txIndex)
+			msg, vmctx, ibs, _, err := api.txEnvCache.ComputeTxEnv(ctx, getter, chainConfig, chainContext, dbtx, blockHash, txIndex)
 			if err != nil {
 				return nil, err
 			}
@@ -325,12 +326,13 @@ func retrieveHistory(tx ethdb.Tx, addr *common.Address, fromBlock uint64, toBloc
 			return nil, err
 		}
 
-		numbers, _, err := dbutils.WrapHistoryIndex(v).Decode()
-		if err != nil {
+		bm := roaring.New()
+		if _, err = bm.FromBuffer(v); err != nil {
 			return nil, err
 		}
-
-		blockNumbers = append(blockNumbers, numbers...)
+		for _, n := range bm.ToArray() {
+			blockNumbers = append(blockNumbers, uint64(n))
+		}
 	}
 
 	// cleanup for invalid blocks
@@ -376,9 +378,8 @@ func isAddressInFilter(addr *common.Address, filter []*common.Address) bool {
 // -- For convienience, we return both Parity and Geth traces for now. In the future we will either separate
 //    these functions or eliminate Geth traces
 // -- The function convertToParityTraces takes a hierarchical Geth trace and returns a flattened Parity trace
-func (api *TraceAPIImpl) getTransactionTraces(dbtx rawdb.DatabaseReader, ctx context.Context, txHash common.Hash) (ParityTraces, error) {
+func (api *TraceAPIImpl) getTransactionTraces(dbtx ethdb.Database, ctx context.Context, txHash common.Hash) (ParityTraces, error) {
 	getter := adapter.NewBlockGetter(dbtx)
-	chainContext := adapter.NewChainContext(dbtx)
 	genesis, err := rawdb.ReadBlockByNumber(dbtx, 0)
 	if err != nil {
 		return nil, err
@@ -388,10 +389,11 @@ func (api *TraceAPIImpl) getTransactionTraces(dbtx rawdb.DatabaseReader, ctx con
 	if err != nil {
 		return nil, err
 	}
+	chainContext := adapter.NewChainContext(dbtx, adapter.NewEngine(chainConfig, dbtx))
 	traceType := "callTracer" // nolint: goconst
 
 	tx, blockHash, blockNumber, txIndex := rawdb.ReadTransaction(dbtx, txHash)
-	msg, vmctx, ibs, _, err := transactions.ComputeTxEnv(ctx, getter, chainConfig, chainContext, dbtx.(ethdb.HasTx).Tx(), blockHash, txIndex)
+	msg, vmctx, ibs, _, err := api.txEnvCache.ComputeTxEnv(ctx, getter, chainConfig, chainContext, dbtx.(ethdb.HasTx).Tx(), blockHash, txIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -8,7 +8,6 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/eth"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
-	"github.com/ledgerwatch/turbo-geth/params"
 	"github.com/ledgerwatch/turbo-geth/turbo/adapter"
 	"github.com/ledgerwatch/turbo-geth/turbo/transactions"
 )
@@ -26,9 +25,13 @@ func (api *PrivateDebugAPIImpl) TraceTransaction(ctx context.Context, hash commo
 	if txn == nil {
 		return nil, fmt.Errorf("transaction %#x not found", hash)
 	}
+	chainConfig, err := getChainConfig(tx)
+	if err != nil {
+		return nil, err
+	}
 	getter := adapter.NewBlockGetter(tx)
-	chainContext := adapter.NewChainContext(tx)
-	msg, vmctx, ibs, _, err := transactions.ComputeTxEnv(ctx, getter, params.MainnetChainConfig, chainContext, tx.(ethdb.HasTx).Tx(), blockHash, txIndex)
+	chainContext := adapter.NewChainContext(tx, adapter.NewEngine(chainConfig, tx))
+	msg, vmctx, ibs, _, err := api.txEnvCache.ComputeTxEnv(ctx, getter, chainConfig, chainContext, tx.(ethdb.HasTx).Tx(), blockHash, txIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,266 @@
+// Package filters keeps the subscription of the RPC daemon to the events of the node, and fans the new chain heads
+// out to the eth_subscribe("newHeads") subscriptions and to the block filters, and their logs out to the
+// eth_subscribe("logs") subscriptions
+package filters
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	ethfilters "github.com/ledgerwatch/turbo-geth/eth/filters"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+)
+
+// Delays between the attempts to subscribe to the node, the delay doubles after every failed attempt
+var (
+	resubscribeMinDelay = time.Second
+	resubscribeMaxDelay = time.Minute
+)
+
+const (
+	// deadline - block filters not polled within deadline are removed
+	deadline = 5 * time.Minute
+	// headsBuffer - number of the headers a subscriber may lag behind before the headers are dropped
+	headsBuffer = 16
+	// logsBuffer - number of the batches of logs a subscriber may lag behind before the logs are dropped
+	logsBuffer = 16
+	// logsTimeout - time to get the logs of a new head
+	logsTimeout = time.Minute
+)
+
+type blockFilter struct {
+	hashes   []common.Hash
+	lastPoll time.Time
+}
+
+type logsSub struct {
+	crit ethfilters.FilterCriteria
+	ch   chan []*types.Log
+}
+
+// Filters - subscriptions to the new heads of the node
+type Filters struct {
+	lock         sync.Mutex
+	headsSubs    map[rpc.ID]chan *types.Header
+	blockFilters map[rpc.ID]*blockFilter
+	logsSubs     map[rpc.ID]*logsSub
+
+	tailLock sync.Mutex
+	logTail  *ethfilters.LogTail // nil until SetLogsBackend
+}
+
+// New subscribes to the events of the node until the context is done. Broken subscriptions are renewed
+func New(ctx context.Context, ethBackend ethdb.Backend) *Filters {
+	ff := &Filters{
+		headsSubs:    map[rpc.ID]chan *types.Header{},
+		blockFilters: map[rpc.ID]*blockFilter{},
+		logsSubs:     map[rpc.ID]*logsSub{},
+	}
+	go ff.subscribeLoop(ctx, ethBackend)
+	return ff
+}
+
+func (ff *Filters) subscribeLoop(ctx context.Context, ethBackend ethdb.Backend) {
+	delay := resubscribeMinDelay
+	for {
+		received := false
+		err := ethBackend.Subscribe(ctx, func(event *remote.Event) {
+			received = true
+			ff.onEvent(event)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			delay = resubscribeMinDelay
+		}
+		log.Warn("Subscription to the events of the node is broken, resubscribing", "err", err, "in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > resubscribeMaxDelay {
+			delay = resubscribeMaxDelay
+		}
+	}
+}
+
+func (ff *Filters) onEvent(event *remote.Event) {
+	switch event.Type {
+	case remote.EventType_HEADER:
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(event.Header, header); err != nil {
+			log.Warn("Could not decode the header of the new head", "number", event.Number, "err", err)
+			return
+		}
+		ff.OnNewHeader(header)
+	default:
+		log.Debug("Unknown event of the node", "type", event.Type)
+	}
+}
+
+// SetLogsBackend enables the logs subscriptions, the logs of the new heads are taken from the receipts of backend
+func (ff *Filters) SetLogsBackend(backend ethfilters.LogTailBackend) {
+	ff.tailLock.Lock()
+	defer ff.tailLock.Unlock()
+	ff.logTail = ethfilters.NewLogTail(backend, ethfilters.DefaultLogTailBlocks)
+}
+
+// OnNewHeader sends the header to the subscribers of the new heads, adds its hash to the block filters, and sends
+// the logs of the new head to the subscribers of the logs, with the logs retracted by the reorg if there was one
+func (ff *Filters) OnNewHeader(header *types.Header) {
+	ff.onNewHead(header)
+	ff.onNewLogs(header)
+}
+
+func (ff *Filters) onNewHead(header *types.Header) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	for id, ch := range ff.headsSubs {
+		select {
+		case ch <- header:
+		default:
+			log.Warn("Subscriber of the new heads does not keep up, header dropped", "id", id, "number", header.Number)
+		}
+	}
+	hash := header.Hash()
+	now := time.Now()
+	for id, f := range ff.blockFilters {
+		if now.Sub(f.lastPoll) > deadline {
+			delete(ff.blockFilters, id)
+			continue
+		}
+		f.hashes = append(f.hashes, hash)
+	}
+}
+
+func (ff *Filters) onNewLogs(header *types.Header) {
+	ff.tailLock.Lock()
+	defer ff.tailLock.Unlock()
+	if ff.logTail == nil {
+		return
+	}
+	ff.lock.Lock()
+	subscribed := len(ff.logsSubs) > 0
+	ff.lock.Unlock()
+	if !subscribed {
+		// nobody to retract the logs from
+		ff.logTail.Reset()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logsTimeout)
+	defer cancel()
+	added, removed, err := ff.logTail.Update(ctx, header)
+	if err != nil {
+		log.Warn("Could not get the logs of the new head", "number", header.Number, "err", err)
+		return
+	}
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	for id, sub := range ff.logsSubs {
+		for _, logs := range [][]*types.Log{removed, added} {
+			matched := ethfilters.MatchLogs(logs, sub.crit)
+			if len(matched) == 0 {
+				continue
+			}
+			select {
+			case sub.ch <- matched:
+			default:
+				log.Warn("Subscriber of the logs does not keep up, logs dropped", "id", id, "number", header.Number)
+			}
+		}
+	}
+}
+
+// SubscribeNewHeads returns the channel of the new heads and the id to unsubscribe with
+func (ff *Filters) SubscribeNewHeads() (rpc.ID, <-chan *types.Header) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	id := rpc.NewID()
+	ch := make(chan *types.Header, headsBuffer)
+	ff.headsSubs[id] = ch
+	return id, ch
+}
+
+// UnsubscribeHeads closes the channel of the subscription
+func (ff *Filters) UnsubscribeHeads(id rpc.ID) bool {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	ch, ok := ff.headsSubs[id]
+	if !ok {
+		return false
+	}
+	close(ch)
+	delete(ff.headsSubs, id)
+	return true
+}
+
+// NewBlockFilter installs the filter which collects the hashes of the new heads until they are polled
+func (ff *Filters) NewBlockFilter() rpc.ID {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	id := rpc.NewID()
+	ff.blockFilters[id] = &blockFilter{lastPoll: time.Now()}
+	return id
+}
+
+// BlockFilterChanges returns the hashes of the new heads since the last poll, false if there is no such filter
+func (ff *Filters) BlockFilterChanges(id rpc.ID) ([]common.Hash, bool) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	f, ok := ff.blockFilters[id]
+	if !ok {
+		return nil, false
+	}
+	hashes := f.hashes
+	f.hashes = nil
+	f.lastPoll = time.Now()
+	if hashes == nil {
+		hashes = []common.Hash{}
+	}
+	return hashes, true
+}
+
+// UninstallBlockFilter removes the filter, false if there is no such filter
+func (ff *Filters) UninstallBlockFilter(id rpc.ID) bool {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	if _, ok := ff.blockFilters[id]; !ok {
+		return false
+	}
+	delete(ff.blockFilters, id)
+	return true
+}
+
+// SubscribeLogs returns the channel of the logs matching the criteria and the id to unsubscribe with. Each batch
+// is either the logs of the new blocks or the logs retracted by a reorg, flagged Removed
+func (ff *Filters) SubscribeLogs(crit ethfilters.FilterCriteria) (rpc.ID, <-chan []*types.Log) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	id := rpc.NewID()
+	ch := make(chan []*types.Log, logsBuffer)
+	ff.logsSubs[id] = &logsSub{crit: crit, ch: ch}
+	return id, ch
+}
+
+// UnsubscribeLogs closes the channel of the subscription
+func (ff *Filters) UnsubscribeLogs(id rpc.ID) bool {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	sub, ok := ff.logsSubs[id]
+	if !ok {
+		return false
+	}
+	close(sub.ch)
+	delete(ff.logsSubs, id)
+	return true
+}
@@ -0,0 +1,178 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	ethfilters "github.com/ledgerwatch/turbo-geth/eth/filters"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/ledgerwatch/turbo-geth/rpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newHeader(number int64) *types.Header {
+	return &types.Header{Number: big.NewInt(number), Difficulty: common.Big1, Extra: []byte("head")}
+}
+
+// waitHead returns the header with the hash from the channel, skipping the others
+func waitHead(t *testing.T, heads <-chan *types.Header, hash common.Hash) *types.Header {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case h := <-heads:
+			if h.Hash() == hash {
+				return h
+			}
+		case <-timeout:
+			t.Fatalf("no header %x", hash)
+		}
+	}
+}
+
+func TestNewHeadsOverPrivateAPI(t *testing.T) {
+	conn := bufconn.Listen(1024 * 1024)
+	events := remotedbserver.NewEvents()
+	grpcServer := grpc.NewServer()
+	remote.RegisterETHBACKENDServer(grpcServer, remotedbserver.NewEthBackendServer(nil, events))
+	go func() {
+		_ = grpcServer.Serve(conn)
+	}()
+	defer grpcServer.Stop()
+
+	kv, backend := ethdb.NewRemote().InMem(conn).MustOpen()
+	defer kv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ff := New(ctx, backend)
+	id, heads := ff.SubscribeNewHeads()
+	filterID := ff.NewBlockFilter()
+
+	// the subscription is established in the background, the head is announced until it arrives
+	head := newHeader(1)
+	timeout := time.After(10 * time.Second)
+	var got *types.Header
+	for got == nil {
+		events.OnNewHeader(head)
+		select {
+		case got = <-heads:
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no new head over the subscription")
+		}
+	}
+	require.Equal(t, head.Hash(), got.Hash())
+	require.Equal(t, head.Extra, got.Extra)
+
+	next := newHeader(2)
+	events.OnNewHeader(next)
+	waitHead(t, heads, next.Hash())
+	hashes, ok := ff.BlockFilterChanges(filterID)
+	require.True(t, ok)
+	require.Equal(t, head.Hash(), hashes[0])
+	require.Equal(t, next.Hash(), hashes[len(hashes)-1])
+	hashes, ok = ff.BlockFilterChanges(filterID)
+	require.True(t, ok)
+	require.Empty(t, hashes, "polled")
+
+	require.True(t, ff.UninstallBlockFilter(filterID))
+	_, ok = ff.BlockFilterChanges(filterID)
+	require.False(t, ok)
+	require.True(t, ff.UnsubscribeHeads(id))
+	require.False(t, ff.UnsubscribeHeads(id))
+}
+
+type flakyBackend struct {
+	ethdb.Backend
+	failures int
+	attempts int
+	head     *types.Header
+}
+
+func (b *flakyBackend) Subscribe(ctx context.Context, onEvent func(*remote.Event)) error {
+	b.attempts++
+	if b.attempts <= b.failures {
+		return errors.New("connection refused")
+	}
+	enc, err := rlp.EncodeToBytes(b.head)
+	if err != nil {
+		return err
+	}
+	onEvent(&remote.Event{Type: remote.EventType_HEADER, Hash: b.head.Hash().Bytes(), Number: b.head.Number.Uint64(), Header: enc})
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestResubscribe(t *testing.T) {
+	defer func(min, max time.Duration) { resubscribeMinDelay, resubscribeMaxDelay = min, max }(resubscribeMinDelay, resubscribeMaxDelay)
+	resubscribeMinDelay, resubscribeMaxDelay = time.Millisecond, 4*time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := &flakyBackend{failures: 5, head: newHeader(7)}
+	ff := &Filters{headsSubs: map[rpc.ID]chan *types.Header{}, blockFilters: map[rpc.ID]*blockFilter{}}
+	_, heads := ff.SubscribeNewHeads()
+	go ff.subscribeLoop(ctx, backend)
+
+	got := waitHead(t, heads, backend.head.Hash())
+	require.Equal(t, uint64(7), got.Number.Uint64())
+	require.Equal(t, 6, backend.attempts)
+}
+
+type logsTestBackend map[common.Hash]*types.Header
+
+func (b logsTestBackend) HeaderByHash(_ context.Context, hash common.Hash) (*types.Header, error) {
+	return b[hash], nil
+}
+
+func (b logsTestBackend) GetReceipts(_ context.Context, hash common.Hash) (types.Receipts, error) {
+	h := b[hash]
+	return types.Receipts{{Logs: []*types.Log{{Address: common.Address{byte(h.Number.Uint64()), h.Extra[0]}}}}}, nil
+}
+
+func TestLogsSubscription(t *testing.T) {
+	backend := logsTestBackend{}
+	block := func(parent *types.Header, branch byte) *types.Header {
+		h := &types.Header{Number: big.NewInt(parent.Number.Int64() + 1), ParentHash: parent.Hash(), Extra: []byte{branch}}
+		backend[h.Hash()] = h
+		return h
+	}
+	b1 := block(&types.Header{Number: big.NewInt(0)}, 0)
+	b2 := block(b1, 0)
+	b2side := block(b1, 1)
+
+	ff := &Filters{headsSubs: map[rpc.ID]chan *types.Header{}, blockFilters: map[rpc.ID]*blockFilter{}, logsSubs: map[rpc.ID]*logsSub{}}
+	ff.SetLogsBackend(backend)
+	id, logs := ff.SubscribeLogs(ethfilters.FilterCriteria{})
+	ff.OnNewHeader(b1)
+	ff.OnNewHeader(b2)
+	ff.OnNewHeader(b2side)
+
+	require.Equal(t, common.Address{1, 0}, (<-logs)[0].Address)
+	require.Equal(t, common.Address{2, 0}, (<-logs)[0].Address)
+	removed := <-logs
+	require.Equal(t, common.Address{2, 0}, removed[0].Address)
+	require.True(t, removed[0].Removed)
+	added := <-logs
+	require.Equal(t, common.Address{2, 1}, added[0].Address)
+	require.False(t, added[0].Removed)
+
+	// the criteria of the subscription
+	_, filtered := ff.SubscribeLogs(ethfilters.FilterCriteria{Addresses: []common.Address{{3, 0}}})
+	ff.OnNewHeader(block(b2side, 0))
+	require.Equal(t, common.Address{3, 0}, (<-filtered)[0].Address)
+	require.Equal(t, common.Address{3, 0}, (<-logs)[0].Address)
+
+	require.True(t, ff.UnsubscribeLogs(id))
+	require.False(t, ff.UnsubscribeLogs(id))
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/cli"
 	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/turbo-geth/cmd/rpcdaemon/filters"
 	"github.com/ledgerwatch/turbo-geth/cmd/utils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/spf13/cobra"
 )
@@ -23,9 +26,20 @@ func main() {
 			return nil
 		}
 		defer db.Close()
+		go ethdb.LogOldestReader(cmd.Context().Done(), db, time.Minute)
 
-		var apiList = commands.APIList(db, backend, *cfg, nil)
-		return cli.StartRpcServer(cmd.Context(), *cfg, apiList)
+		var ff *filters.Filters
+		if backend != nil { // the events of the node are served only over the private API
+			ff = filters.New(cmd.Context(), backend)
+		}
+
+		var apiList = commands.APIList(db, backend, ff, *cfg, nil)
+		stats, err := cli.StartRpcServer(cmd.Context(), *cfg, apiList)
+		if err != nil {
+			return err
+		}
+		log.Info("In-flight requests on shutdown", "drained", stats.Drained, "aborted", stats.Aborted)
+		return nil
 	}
 
 	// Hacky way to get these strings into the commands package
@@ -202,7 +202,8 @@ func (r *StateGrowth1Reporter) StateGrowth1(ctx context.Context) {
 		if serr != nil {
 			return serr
 		}
-		c := tx.Cursor(dbutils.AccountsHistoryBucket).Prefetch(CursorBatchSize)
+		// creation flags are only kept by the legacy index format
+		c := tx.Cursor(dbutils.AccountsHistoryBucketOld1).Prefetch(CursorBatchSize)
 		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
 			if err != nil {
 				return err
@@ -326,7 +327,8 @@ func (r *StateGrowth2Reporter) StateGrowth2(ctx context.Context) {
 		if serr != nil {
 			return serr
 		}
-		c := tx.Cursor(dbutils.StorageHistoryBucket).Prefetch(CursorBatchSize)
+		// creation flags are only kept by the legacy index format
+		c := tx.Cursor(dbutils.StorageHistoryBucketOld1).Prefetch(CursorBatchSize)
 		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
 			if err != nil {
 				return err
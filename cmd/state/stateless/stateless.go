@@ -477,6 +477,10 @@ func Stateless(
 		willSnapshot := interval > 0 && blockNum > 0 && blockNum >= ignoreOlderThan && blockNum%interval == 0
 
 		if batch.BatchSize() >= 100000 || willSnapshot {
+			if err := tds.FlushIncarnations(); err != nil {
+				fmt.Printf("Failed to flush incarnations: %v\n", err)
+				return
+			}
 			if _, err := batch.Commit(); err != nil {
 				fmt.Printf("Failed to commit batch: %v\n", err)
 				return
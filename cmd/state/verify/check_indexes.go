@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -39,9 +40,12 @@ func CheckIndex(chaindata string, changeSetBucket string, indexBucket string) er
 				return innerErr
 			}
 
-			index := dbutils.WrapHistoryIndex(indexBytes)
-			if findVal, _, ok := index.Search(blockNum); !ok {
-				return fmt.Errorf("%v,%v,%v", blockNum, findVal, common.Bytes2Hex(key))
+			index := roaring.New()
+			if _, innerErr = index.FromBuffer(indexBytes); innerErr != nil {
+				return innerErr
+			}
+			if !index.Contains(uint32(blockNum)) {
+				return fmt.Errorf("%v,%v", blockNum, common.Bytes2Hex(key))
 			}
 			return nil
 		}); err != nil {
@@ -21,6 +21,7 @@ var (
 func main() {
 	// creating a turbo-api app with all defaults
 	app := turbocli.MakeApp(runTurboGeth, turbocli.DefaultFlags)
+	app.Commands = []cli.Command{migrateCommand}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/utils"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/migrations"
+	"github.com/ledgerwatch/turbo-geth/turbo/node"
+	"github.com/urfave/cli"
+)
+
+var (
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Apply the pending migrations without committing, report how they change the buckets and whether they pass verification",
+	}
+	verifyFlag = cli.BoolFlag{
+		Name:  "verify",
+		Usage: "Verify the applied migrations against the current database and save the results",
+	}
+)
+
+var migrateCommand = cli.Command{
+	Name:      "migrate",
+	Usage:     "Apply the pending database migrations while the node is stopped",
+	ArgsUsage: " ",
+	Flags:     []cli.Flag{dryRunFlag, verifyFlag},
+	Action:    migrate,
+	Description: `Without flags applies the pending migrations, which otherwise are applied at the start of the node.
+With --dry-run nothing is written, but the whole migration is kept in one transaction, so it needs the disk space of
+the migration. The global flags, like --datadir, go before the command: tg --datadir=<dir> migrate --dry-run`,
+}
+
+func migrate(cliCtx *cli.Context) error {
+	if cliCtx.Bool(dryRunFlag.Name) && cliCtx.Bool(verifyFlag.Name) {
+		return errors.New("--dry-run and --verify can't be used together")
+	}
+	stack, db := node.OpenChainDatabase(cliCtx, node.Params{})
+	defer stack.Close()
+	tmpdir := path.Join(stack.Config().DataDir, etl.TmpDirName)
+	migrator := migrations.NewMigrator()
+	if cliCtx.GlobalBool(utils.KeepDeprecatedBucketsFlag.Name) {
+		migrator.KeepDeprecatedBuckets()
+	} else if dir := cliCtx.GlobalString(utils.ExportDeprecatedBucketsFlag.Name); dir != "" {
+		migrator.ExportDeprecatedBuckets(dir)
+	}
+
+	switch {
+	case cliCtx.Bool(dryRunFlag.Name):
+		reports, err := migrator.DryRun(db, tmpdir)
+		for _, report := range reports {
+			logDryRunReport(report)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reports) == 0 {
+			log.Info("No pending migrations")
+		}
+		return nil
+	case cliCtx.Bool(verifyFlag.Name):
+		res, err := migrator.Verify(db)
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, v := range res {
+			if v.Ok {
+				log.Info("Verified migration", "name", v.Name)
+			} else {
+				failed++
+				log.Error("Migration verification failed", "name", v.Name, "err", v.Error)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d migrations failed verification", failed, len(res))
+		}
+		log.Info("Verified migrations", "amount", len(res))
+		return nil
+	default:
+		return migrator.Apply(db, tmpdir)
+	}
+}
+
+func logDryRunReport(report migrations.DryRunReport) {
+	log.Info("Migration dry run", "name", report.Name, "changed buckets", len(report.Buckets))
+	names := make([]string, 0, len(report.Buckets))
+	for name := range report.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		change := report.Buckets[name]
+		log.Info("  bucket", "name", name,
+			"entries", fmt.Sprintf("%d -> %d", change.EntriesBefore, change.EntriesAfter),
+			"size", fmt.Sprintf("%s -> %s", common.StorageSize(change.SizeBefore), common.StorageSize(change.SizeAfter)))
+	}
+	switch {
+	case report.Verification == nil:
+		log.Info("  no verification")
+	case report.Verification.Ok:
+		log.Info("  verification passed")
+	default:
+		log.Warn("  verification failed, the migration won't be applied", "err", report.Verification.Error)
+	}
+}
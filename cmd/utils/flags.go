@@ -396,9 +396,19 @@ var (
 		Usage: `Configures the storage mode of the app:
 * h - write history to the DB
 * r - write receipts to the DB
-* t - write tx lookup index to the DB`,
+* t - write tx lookup index to the DB
+* s - write tx senders in the Senders2 layout to the DB, an existing DB switches to it after the senders2_backfill background migration
+* b - write blooms of the block logs to the DB, used by eth_getLogs without receipts (r)`,
 		Value: ethdb.DefaultStorageMode.ToString(),
 	}
+	KeepDeprecatedBucketsFlag = cli.BoolFlag{
+		Name:  "migrations.keep-deprecated-buckets",
+		Usage: "Don't drop the deprecated buckets, the migrations which drop them stay pending (for the developers who still use the experimental buckets)",
+	}
+	ExportDeprecatedBucketsFlag = DirectoryFlag{
+		Name:  "migrations.export-deprecated-buckets",
+		Usage: "Directory to export the deprecated buckets to before they are dropped, one subdirectory per bucket",
+	}
 	SnapshotModeFlag = cli.StringFlag{
 		Name: "snapshot-mode",
 		Usage: `Configures the storage mode of the app:
@@ -433,6 +443,11 @@ var (
 		Usage: "private api network address, for example: 127.0.0.1:9090, empty string means not to start the listener. do not expose to public network. serves remote database interface",
 		Value: "",
 	}
+	PrivateApiTokenFileFlag = cli.StringFlag{
+		Name:  "private.api.token.file",
+		Usage: "file with the token the clients of the private api must present, empty means no token is required",
+		Value: "",
+	}
 	// Miner settings
 	MiningEnabledFlag = cli.BoolFlag{
 		Name:  "mine",
@@ -787,14 +802,18 @@ var (
 	// LMDB flags
 	LMDBMapSizeFlag = cli.StringFlag{
 		Name:  "lmdb.mapSize",
-		Usage: "Sets Memory map size. Lower it if you have issues with opening the DB",
-		Value: ethdb.LMDBDefaultMapSize.String(),
+		Usage: "Sets initial Memory map size, it grows when the database needs more. Lower it if you have issues with opening the DB",
+		Value: ethdb.LMDBDefaultInitialMapSize.String(),
 	}
 	LMDBMaxFreelistReuseFlag = cli.UintFlag{
 		Name:  "lmdb.maxFreelistReuse",
 		Usage: "Find a big enough contiguous page range for large values in freelist is hard just allocate new pages and even don't try to search if value is bigger than this limit. Measured in pages.",
 		Value: ethdb.LMDBDefaultMaxFreelistReuse,
 	}
+	LMDBReaderAgeLimitFlag = cli.DurationFlag{
+		Name:  "lmdb.readerAgeLimit",
+		Usage: "Abort read transactions (including ones of rpcdaemon) older than this. Old readers keep LMDB from reusing free pages and the database grows. 0 - no limit",
+	}
 )
 
 var MetricFlags = []cli.Flag{MetricsEnabledFlag, MetricsEnabledExpensiveFlag, MetricsHTTPFlag, MetricsPortFlag}
@@ -1017,6 +1036,16 @@ func SplitAndTrim(input string) (ret []string) {
 // read-only interface to the databae
 func setPrivateApi(ctx *cli.Context, cfg *node.Config) {
 	cfg.PrivateApiAddr = ctx.GlobalString(PrivateApiAddr.Name)
+	if tokenFile := ctx.GlobalString(PrivateApiTokenFileFlag.Name); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			Fatalf("Could not read the private api token: %v", err)
+		}
+		cfg.PrivateApiToken = strings.TrimSpace(string(token))
+		if cfg.PrivateApiToken == "" {
+			Fatalf("Private api token file %s is empty", tokenFile)
+		}
+	}
 	if ctx.GlobalBool(TLSFlag.Name) {
 		certFile := ctx.GlobalString(TLSCertFlag.Name)
 		keyFile := ctx.GlobalString(TLSKeyFlag.Name)
@@ -1290,13 +1319,13 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 		err := cfg.LMDBMapSize.UnmarshalText([]byte(ctx.GlobalString(LMDBMapSizeFlag.Name)))
 		if err != nil {
 			log.Error("Invalid LMDB map size provided. Will use defaults",
-				"lmdb.mapSize", ethdb.LMDBDefaultMapSize.HumanReadable(),
+				"lmdb.mapSize", ethdb.LMDBDefaultInitialMapSize.HumanReadable(),
 				"err", err,
 			)
 		} else {
 			if cfg.LMDBMapSize < 1*datasize.GB {
 				log.Error("Invalid LMDB map size provided. Will use defaults",
-					"lmdb.mapSize", ethdb.LMDBDefaultMapSize.HumanReadable(),
+					"lmdb.mapSize", ethdb.LMDBDefaultInitialMapSize.HumanReadable(),
 					"err", "the value should be at least 1 GB",
 				)
 			}
@@ -1311,6 +1340,7 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 				"err", "the value should be at least 16",
 			)
 		}
+		cfg.LMDBReaderAgeLimit = ctx.GlobalDuration(LMDBReaderAgeLimitFlag.Name)
 	}
 }
 
@@ -1598,6 +1628,10 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 		Fatalf(fmt.Sprintf("error while parsing mode: %v", err))
 	}
 	cfg.StorageMode = mode
+	cfg.KeepDeprecatedBuckets = ctx.GlobalBool(KeepDeprecatedBucketsFlag.Name)
+	if ctx.GlobalIsSet(ExportDeprecatedBucketsFlag.Name) {
+		cfg.ExportDeprecatedBuckets = ctx.GlobalString(ExportDeprecatedBucketsFlag.Name)
+	}
 	snMode, err := torrent.SnapshotModeFromString(ctx.GlobalString(SnapshotModeFlag.Name))
 	if err != nil {
 		Fatalf(fmt.Sprintf("error while parsing mode: %v", err))
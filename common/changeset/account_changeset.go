@@ -32,10 +32,18 @@ func (b AccountChangeSetBytes) Walk(f func(k, v []byte) error) error {
 	return walkAccountChangeSet(b, common.HashLength, f)
 }
 
+func (b AccountChangeSetBytes) WalkReverse(f func(k, v []byte) error) error {
+	return walkReverseAccountChangeSet(b, common.HashLength, f)
+}
+
 func (b AccountChangeSetBytes) Find(k []byte) ([]byte, error) {
 	return findInAccountChangeSetBytes(b, k, common.HashLength)
 }
 
+func (b AccountChangeSetBytes) Iterator() Iterator {
+	return newAccountChangeSetIterator(b, common.HashLength)
+}
+
 /* Plain changesets (key is a common.Address) */
 
 func NewAccountChangeSetPlain() *ChangeSet {
@@ -64,6 +72,14 @@ func (b AccountChangeSetPlainBytes) Walk(f func(k, v []byte) error) error {
 	return walkAccountChangeSet(b, common.AddressLength, f)
 }
 
+func (b AccountChangeSetPlainBytes) WalkReverse(f func(k, v []byte) error) error {
+	return walkReverseAccountChangeSet(b, common.AddressLength, f)
+}
+
 func (b AccountChangeSetPlainBytes) Find(k []byte) ([]byte, error) {
 	return findInAccountChangeSetBytes(b, k, common.AddressLength)
 }
+
+func (b AccountChangeSetPlainBytes) Iterator() Iterator {
+	return newAccountChangeSetIterator(b, common.AddressLength)
+}
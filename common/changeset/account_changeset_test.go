@@ -120,3 +120,29 @@ func runTestAccountEncoding(t *testing.T, ch *ChangeSet, isHashed bool) {
 		}
 	}
 }
+
+// Find is a binary search over sorted keys: time grows logarithmically with size of changeset
+func BenchmarkFindAccountPlain(b *testing.B) {
+	for _, numOfElements := range []int{1000, 50_000} {
+		ch := NewAccountChangeSetPlain()
+		for i := 0; i < numOfElements; i++ {
+			address := common.BytesToAddress(common.FromHex(fmt.Sprintf("%08x", i)))
+			if err := ch.Add(address[:], address[:]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		enc, err := EncodeAccountsPlain(ch)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		finder := AccountChangeSetPlainBytes(enc)
+		b.Run(fmt.Sprintf("%d", numOfElements), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := finder.Find(ch.Changes[i%numOfElements].Key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -25,7 +25,6 @@ func walkAccountChangeSet(b []byte, keyLen uint32, f func(k, v []byte) error) er
 	}
 	valOffset := 4 + n*keyLen + 4*n
 	if uint32(len(b)) < valOffset {
-		fmt.Println("walkAccounts account")
 		return fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset)
 	}
 
@@ -51,6 +50,47 @@ func walkAccountChangeSet(b []byte, keyLen uint32, f func(k, v []byte) error) er
 	return nil
 }
 
+// walkReverseAccountChangeSet iterates the account bytes with the keys of provided size in reverse order of keys
+func walkReverseAccountChangeSet(b []byte, keyLen uint32, f func(k, v []byte) error) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < 4 {
+		return fmt.Errorf("decode: input too short (%d bytes)", len(b))
+	}
+
+	n := binary.BigEndian.Uint32(b[0:4])
+
+	if n == 0 {
+		return nil
+	}
+	valOffset := 4 + n*keyLen + 4*n
+	if uint32(len(b)) < valOffset {
+		return fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset)
+	}
+
+	totalValLength := binary.BigEndian.Uint32(b[valOffset-4 : valOffset])
+	if uint32(len(b)) < valOffset+totalValLength {
+		return fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset+totalValLength)
+	}
+
+	for i := n; i > 0; i-- {
+		key := b[4+(i-1)*keyLen : 4+i*keyLen]
+		idx0 := uint32(0)
+		if i > 1 {
+			idx0 = binary.BigEndian.Uint32(b[4+n*keyLen+4*(i-2) : 4+n*keyLen+4*(i-1)])
+		}
+		idx1 := binary.BigEndian.Uint32(b[4+n*keyLen+4*(i-1) : 4+n*keyLen+4*i])
+		val := b[valOffset+idx0 : valOffset+idx1]
+
+		err := f(key, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func findInAccountChangeSetBytes(b []byte, k []byte, keyLen int) ([]byte, error) {
 	if len(b) == 0 {
 		return nil, ErrNotFound
@@ -118,7 +158,6 @@ func decodeAccountsWithKeyLen(b []byte, keyLen uint32, h *ChangeSet) error {
 
 	valOffset := 4 + numOfAccounts*keyLen + 4*numOfAccounts
 	if uint32(len(b)) < valOffset {
-		fmt.Println("DecodeAccounts account")
 		return fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset)
 	}
 
@@ -11,7 +11,9 @@ import (
 
 type Walker interface {
 	Walk(func(k, v []byte) error) error
+	WalkReverse(func(k, v []byte) error) error // in reverse order of keys, e.g. to unwind changes
 	Find(k []byte) ([]byte, error)
+	Iterator() Iterator
 }
 
 func NewChangeSet() *ChangeSet {
@@ -157,3 +159,37 @@ var Mapper = map[string]struct {
 		Encode:   EncodeStoragePlain,
 	},
 }
+
+// Cursor - part of ethdb.Cursor used by ForEachBlockReverse
+type Cursor interface {
+	Seek(seek []byte) ([]byte, []byte, error)
+	Prev() ([]byte, []byte, error)
+	Last() ([]byte, []byte, error)
+}
+
+// ForEachBlockReverse - calls fn with the encoded changeset of every block from `from` down to `to` (inclusive, from >= to),
+// newest first. c is a cursor over changeset bucket. Blocks without changeset are skipped
+func ForEachBlockReverse(c Cursor, from, to uint64, fn func(blockNum uint64, v []byte) error) error {
+	k, v, err := c.Seek(dbutils.EncodeTimestamp(from))
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		k, v, err = c.Last()
+	} else if blockNum, _ := dbutils.DecodeTimestamp(k); blockNum > from {
+		k, v, err = c.Prev()
+	}
+	for ; k != nil; k, v, err = c.Prev() {
+		if err != nil {
+			return err
+		}
+		blockNum, _ := dbutils.DecodeTimestamp(k)
+		if blockNum < to {
+			break
+		}
+		if err = fn(blockNum, v); err != nil {
+			return err
+		}
+	}
+	return err
+}
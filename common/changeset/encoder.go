@@ -0,0 +1,182 @@
+package changeset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// Encoder builds encoded changeset from the changes added in the order of keys, without collecting them
+// into ChangeSet: keys and values are copied to contiguous buffers of the encoding right away.
+// Output is the same as of EncodeAccounts/EncodeStorage (and plain versions) for the same changes.
+// Use Iterator to read encoded changeset without decoding it as a whole.
+type Encoder interface {
+	// Add - key must be greater than keys added before. Key and value can be reused after the call.
+	Add(k, v []byte) error
+	// WriteTo writes encoded changeset to w
+	WriteTo(w io.Writer) (int64, error)
+	// Encode returns encoded changeset
+	Encode() ([]byte, error)
+}
+
+/* Hashed changesets (key is a hash of common.Address) */
+
+func NewAccountsEncoder() Encoder { return &accountsEncoder{keyLen: common.HashLength} }
+func NewStorageEncoder() Encoder  { return &storageEncoder{keyPrefixLen: common.HashLength} }
+
+/* Plain changesets (key is a common.Address) */
+
+func NewAccountsEncoderPlain() Encoder { return &accountsEncoder{keyLen: common.AddressLength} }
+func NewStorageEncoderPlain() Encoder  { return &storageEncoder{keyPrefixLen: common.AddressLength} }
+
+// accountsEncoder - see encodeAccounts for the format
+type accountsEncoder struct {
+	keyLen  int
+	n       uint32
+	keys    []byte
+	offsets []byte // accumulating value indexes
+	values  []byte
+}
+
+func (e *accountsEncoder) Add(k, v []byte) error {
+	if len(k) != e.keyLen {
+		return fmt.Errorf("wrong key size in AccountChangeSet: expected %d, actual %d", e.keyLen, len(k))
+	}
+	if e.n > 0 {
+		if last := e.keys[len(e.keys)-e.keyLen:]; bytes.Compare(last, k) >= 0 {
+			return fmt.Errorf("keys must be added in increasing order: %x after %x", k, last)
+		}
+	}
+	e.keys = append(e.keys, k...)
+	e.values = append(e.values, v...)
+	var offset [4]byte
+	binary.BigEndian.PutUint32(offset[:], uint32(len(e.values)))
+	e.offsets = append(e.offsets, offset[:]...)
+	e.n++
+	return nil
+}
+
+func (e *accountsEncoder) WriteTo(w io.Writer) (int64, error) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], e.n)
+	return writeParts(w, n[:], e.keys, e.offsets, e.values)
+}
+
+func (e *accountsEncoder) Encode() ([]byte, error) {
+	return encodeTo(e, 4+len(e.keys)+len(e.offsets)+len(e.values))
+}
+
+// storageEncoder - see encodeStorage for the format
+type storageEncoder struct {
+	keyPrefixLen      int
+	n                 uint32
+	lastKey           []byte
+	contracts         []byte // address (hash) + number of keys before the end of previous contract
+	numOfContracts    uint32
+	incarnations      []byte // contract id + incarnation, only not default ones
+	numOfIncarnations uint32
+	keys              []byte
+	valLengths        []byte
+	numOfUint8        uint32
+	numOfUint16       uint32
+	numOfUint32       uint32
+	values            []byte
+}
+
+func (e *storageEncoder) Add(k, v []byte) error {
+	prefixLen := e.keyPrefixLen + common.IncarnationLength
+	if len(k) != prefixLen+common.HashLength {
+		return fmt.Errorf("wrong key size in StorageChangeSet: expected %d, actual %d", prefixLen+common.HashLength, len(k))
+	}
+	if e.n > 0 && bytes.Compare(e.lastKey, k) >= 0 {
+		return fmt.Errorf("keys must be added in increasing order: %x after %x", k, e.lastKey)
+	}
+
+	// found new contract address or incarnation
+	if e.n == 0 || !bytes.Equal(e.lastKey[:prefixLen], k[:prefixLen]) {
+		if e.numOfContracts > 0 {
+			e.contracts = appendUint32(e.contracts, e.n)
+		}
+		e.contracts = append(e.contracts, k[:e.keyPrefixLen]...)
+		if incarnation := binary.BigEndian.Uint64(k[e.keyPrefixLen:]); incarnation != DefaultIncarnation {
+			e.incarnations = appendUint32(e.incarnations, e.numOfContracts)
+			var inc [8]byte
+			binary.BigEndian.PutUint64(inc[:], incarnation)
+			e.incarnations = append(e.incarnations, inc[:]...)
+			e.numOfIncarnations++
+		}
+		e.numOfContracts++
+	}
+	e.lastKey = append(e.lastKey[:0], k...)
+	e.keys = append(e.keys, k[prefixLen:]...)
+
+	e.values = append(e.values, v...)
+	lengthOfValues := uint32(len(e.values))
+	switch {
+	case lengthOfValues <= 255:
+		e.valLengths = append(e.valLengths, uint8(lengthOfValues))
+		e.numOfUint8++
+	case lengthOfValues <= 65535:
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(lengthOfValues))
+		e.valLengths = append(e.valLengths, l[:]...)
+		e.numOfUint16++
+	default:
+		e.valLengths = appendUint32(e.valLengths, lengthOfValues)
+		e.numOfUint32++
+	}
+	e.n++
+	return nil
+}
+
+func (e *storageEncoder) WriteTo(w io.Writer) (int64, error) {
+	if e.numOfContracts == 0 {
+		return 0, errIncorrectData
+	}
+	return writeParts(w,
+		appendUint32(nil, e.numOfContracts),
+		e.contracts,
+		appendUint32(nil, e.n), // end of the last contract
+		appendUint32(nil, e.numOfIncarnations),
+		e.incarnations,
+		e.keys,
+		appendUint32(nil, e.numOfUint8),
+		appendUint32(nil, e.numOfUint16),
+		appendUint32(nil, e.numOfUint32),
+		e.valLengths,
+		e.values,
+	)
+}
+
+func (e *storageEncoder) Encode() ([]byte, error) {
+	return encodeTo(e, 4+len(e.contracts)+4+4+len(e.incarnations)+len(e.keys)+12+len(e.valLengths)+len(e.values))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func writeParts(w io.Writer, parts ...[]byte) (int64, error) {
+	var total int64
+	for _, part := range parts {
+		n, err := w.Write(part)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func encodeTo(e Encoder, size int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := e.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,96 @@
+package changeset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/stretchr/testify/require"
+)
+
+func randomStorageChangeSet(r *rand.Rand, ch *ChangeSet, keyPrefixLen int) {
+	numOfContracts := 1 + r.Intn(20)
+	for i := 0; i < numOfContracts; i++ {
+		prefix := make([]byte, keyPrefixLen+common.IncarnationLength)
+		r.Read(prefix[:keyPrefixLen])
+		binary.BigEndian.PutUint64(prefix[keyPrefixLen:], DefaultIncarnation)
+		if r.Intn(3) == 0 {
+			binary.BigEndian.PutUint64(prefix[keyPrefixLen:], uint64(r.Intn(5)))
+		}
+		for j := r.Intn(50); j >= 0; j-- {
+			key := make([]byte, common.HashLength)
+			r.Read(key)
+			// accumulated lengths of values get all 3 sizes: uint8, uint16, uint32
+			val := make([]byte, r.Intn(300))
+			r.Read(val)
+			if err := ch.Add(append(common.CopyBytes(prefix), key...), val); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+func randomAccountChangeSet(r *rand.Rand, ch *ChangeSet, keyLen int) {
+	for i := r.Intn(1000); i >= 0; i-- {
+		key := make([]byte, keyLen)
+		r.Read(key)
+		val := make([]byte, r.Intn(100))
+		r.Read(val)
+		if err := ch.Add(key, val); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestEncoderSameAsEncode(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	for _, tc := range []struct {
+		name    string
+		newCS   func() *ChangeSet
+		fill    func(r *rand.Rand, ch *ChangeSet)
+		encode  func(*ChangeSet) ([]byte, error)
+		encoder func() Encoder
+	}{
+		{"accounts", NewAccountChangeSet, func(r *rand.Rand, ch *ChangeSet) { randomAccountChangeSet(r, ch, common.HashLength) }, EncodeAccounts, NewAccountsEncoder},
+		{"accounts plain", NewAccountChangeSetPlain, func(r *rand.Rand, ch *ChangeSet) { randomAccountChangeSet(r, ch, common.AddressLength) }, EncodeAccountsPlain, NewAccountsEncoderPlain},
+		{"storage", NewStorageChangeSet, func(r *rand.Rand, ch *ChangeSet) { randomStorageChangeSet(r, ch, common.HashLength) }, EncodeStorage, NewStorageEncoder},
+		{"storage plain", NewStorageChangeSetPlain, func(r *rand.Rand, ch *ChangeSet) { randomStorageChangeSet(r, ch, common.AddressLength) }, EncodeStoragePlain, NewStorageEncoderPlain},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				ch := tc.newCS()
+				tc.fill(r, ch)
+				expected, err := tc.encode(ch) // sorts changes
+				require.NoError(t, err)
+
+				enc := tc.encoder()
+				for _, change := range ch.Changes {
+					require.NoError(t, enc.Add(change.Key, change.Value))
+				}
+				encoded, err := enc.Encode()
+				require.NoError(t, err)
+				require.Equal(t, expected, encoded)
+
+				buf := new(bytes.Buffer)
+				n, err := enc.WriteTo(buf)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(expected)), n)
+				require.Equal(t, expected, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestEncoderOrder(t *testing.T) {
+	enc := NewAccountsEncoderPlain()
+	require.NoError(t, enc.Add(common.HexToAddress("0x02").Bytes(), []byte{1}))
+	require.Error(t, enc.Add(common.HexToAddress("0x01").Bytes(), []byte{1}))
+	require.Error(t, enc.Add(common.HexToAddress("0x02").Bytes(), []byte{1}))
+	require.Error(t, enc.Add([]byte{1}, []byte{1}))
+
+	_, err := NewStorageEncoderPlain().Encode()
+	require.Equal(t, errIncorrectData, err)
+}
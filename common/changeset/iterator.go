@@ -0,0 +1,144 @@
+package changeset
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// Iterator pulls changes of the encoded changeset one by one in the order of keys,
+// without decoding the changeset as a whole. It keeps only its position, so many iterators
+// over the changesets of different blocks can be open at the same time.
+type Iterator interface {
+	// Next returns the next change, nil key when there are no more changes.
+	// Returned key is valid only until the next call.
+	Next() (k, v []byte, err error)
+}
+
+type accountChangeSetIterator struct {
+	b         []byte
+	keyLen    uint32
+	n, i      uint32
+	valOffset uint32
+	err       error
+}
+
+func newAccountChangeSetIterator(b []byte, keyLen uint32) *accountChangeSetIterator {
+	it := &accountChangeSetIterator{b: b, keyLen: keyLen}
+	if len(b) == 0 {
+		return it
+	}
+	if len(b) < 4 {
+		it.err = fmt.Errorf("decode: input too short (%d bytes)", len(b))
+		return it
+	}
+	n := binary.BigEndian.Uint32(b[0:4])
+	if n == 0 {
+		return it
+	}
+	valOffset := 4 + n*keyLen + 4*n
+	if uint32(len(b)) < valOffset {
+		it.err = fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset)
+		return it
+	}
+	totalValLength := binary.BigEndian.Uint32(b[valOffset-4 : valOffset])
+	if uint32(len(b)) < valOffset+totalValLength {
+		it.err = fmt.Errorf("decode: input too short (%d bytes, expected at least %d bytes)", len(b), valOffset+totalValLength)
+		return it
+	}
+	it.n, it.valOffset = n, valOffset
+	return it
+}
+
+func (it *accountChangeSetIterator) Next() ([]byte, []byte, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	if it.i >= it.n {
+		return nil, nil, nil
+	}
+	b, n, i, keyLen := it.b, it.n, it.i, it.keyLen
+	key := b[4+i*keyLen : 4+(i+1)*keyLen]
+	idx0 := uint32(0)
+	if i > 0 {
+		idx0 = binary.BigEndian.Uint32(b[4+n*keyLen+4*(i-1) : 4+n*keyLen+4*i])
+	}
+	idx1 := binary.BigEndian.Uint32(b[4+n*keyLen+4*i : 4+n*keyLen+4*(i+1)])
+	it.i++
+	return key, b[it.valOffset+idx0 : it.valOffset+idx1], nil
+}
+
+type storageChangeSetIterator struct {
+	b                      []byte
+	keyPrefixLen           int
+	numOfUniqueElements    int
+	notDefaultIncarnations map[uint32]uint64
+	keysStart              int
+	valsInfoStart          int
+
+	addrID int // index of the current address (hash) of the element
+	id     int // index of the next element
+	k      []byte
+	err    error
+}
+
+func newStorageChangeSetIterator(b []byte, keyPrefixLen int) *storageChangeSetIterator {
+	it := &storageChangeSetIterator{b: b, keyPrefixLen: keyPrefixLen}
+	if len(b) == 0 {
+		return it
+	}
+	if len(b) < 4 {
+		it.err = fmt.Errorf("decode: input too short (%d bytes)", len(b))
+		return it
+	}
+	numOfUniqueElements := int(binary.BigEndian.Uint32(b))
+	if numOfUniqueElements == 0 {
+		return it
+	}
+	incarnatonsInfo := 4 + numOfUniqueElements*(keyPrefixLen+4)
+	numOfNotDefaultIncarnations := int(binary.BigEndian.Uint32(b[incarnatonsInfo:]))
+	incarnatonsStart := incarnatonsInfo + 4
+	it.notDefaultIncarnations = make(map[uint32]uint64, numOfNotDefaultIncarnations)
+	for i := 0; i < numOfNotDefaultIncarnations; i++ {
+		it.notDefaultIncarnations[binary.BigEndian.Uint32(b[incarnatonsStart+i*12:])] = binary.BigEndian.Uint64(b[incarnatonsStart+i*12+4:])
+	}
+	it.keysStart = incarnatonsStart + numOfNotDefaultIncarnations*12
+	numOfElements := int(binary.BigEndian.Uint32(b[incarnatonsInfo-4:]))
+	it.valsInfoStart = it.keysStart + numOfElements*common.HashLength
+	it.numOfUniqueElements = numOfUniqueElements
+	it.k = make([]byte, keyPrefixLen+common.IncarnationLength+common.HashLength)
+	return it
+}
+
+// endKeys - index of the element after the last one of the address
+func (it *storageChangeSetIterator) endKeys(addrID int) int {
+	return int(binary.BigEndian.Uint32(it.b[4+(addrID+1)*it.keyPrefixLen+addrID*4:]))
+}
+
+func (it *storageChangeSetIterator) Next() ([]byte, []byte, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	for it.addrID < it.numOfUniqueElements && it.id >= it.endKeys(it.addrID) {
+		it.addrID++
+	}
+	if it.addrID >= it.numOfUniqueElements {
+		return nil, nil, nil
+	}
+	addrBytes := it.b[4+it.addrID*it.keyPrefixLen+it.addrID*4:]
+	incarnation := DefaultIncarnation
+	if inc, ok := it.notDefaultIncarnations[uint32(it.addrID)]; ok {
+		incarnation = inc
+	}
+	copy(it.k[:it.keyPrefixLen], addrBytes[:it.keyPrefixLen])
+	binary.BigEndian.PutUint64(it.k[it.keyPrefixLen:], incarnation)
+	copy(it.k[it.keyPrefixLen+common.IncarnationLength:], it.b[it.keysStart+it.id*common.HashLength:])
+	val, err := findValue(it.b[it.valsInfoStart:], it.id)
+	if err != nil {
+		it.err = err
+		return nil, nil, err
+	}
+	it.id++
+	return it.k, val, nil
+}
@@ -0,0 +1,89 @@
+package changeset
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/stretchr/testify/require"
+)
+
+func requireIteratorMatchesWalk(t *testing.T, w Walker) {
+	var walked []Change
+	require.NoError(t, w.Walk(func(k, v []byte) error {
+		walked = append(walked, Change{Key: common.CopyBytes(k), Value: common.CopyBytes(v)})
+		return nil
+	}))
+	var iterated []Change
+	it := w.Iterator()
+	for k, v, err := it.Next(); k != nil || err != nil; k, v, err = it.Next() {
+		require.NoError(t, err)
+		iterated = append(iterated, Change{Key: common.CopyBytes(k), Value: common.CopyBytes(v)})
+	}
+	require.Equal(t, walked, iterated)
+}
+
+func TestStorageChangeSetIterator(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		new       func() *ChangeSet
+		encode    encodeFunc
+		generator func(common.Address, uint64, common.Hash) []byte
+		bytes     func([]byte) Walker
+	}{
+		{"hashed", NewStorageChangeSet, EncodeStorage, hashKeyGenerator, func(b []byte) Walker { return StorageChangeSetBytes(b) }},
+		{"plain", NewStorageChangeSetPlain, EncodeStoragePlain, plainKeyGenerator, func(b []byte) Walker { return StorageChangeSetPlainBytes(b) }},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			requireIteratorMatchesWalk(t, tc.bytes(nil))
+			for _, numOfElements := range []int{1, 10, 300} {
+				ch := tc.new()
+				for i := 0; i < numOfElements; i++ {
+					inc := uint64(defaultIncarnation)
+					if i%3 == 0 {
+						inc = uint64(i + 2)
+					}
+					for j := 0; j < 3; j++ {
+						// values of different lengths use different offset sizes in the encoding
+						val := bytes.Repeat([]byte{byte(j)}, (i*j)%40)
+						require.NoError(t, ch.Add(getTestDataAtIndex(i, j, inc, tc.generator), val))
+					}
+				}
+				b, err := tc.encode(ch)
+				require.NoError(t, err)
+				requireIteratorMatchesWalk(t, tc.bytes(b))
+			}
+		})
+	}
+}
+
+func TestAccountChangeSetIterator(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		ch := NewAccountChangeSet()
+		if plain {
+			ch = NewAccountChangeSetPlain()
+		}
+		for i := 0; i < 100; i++ {
+			address := common.HexToAddress(fmt.Sprintf("0x%x", i+1))
+			key := address[:]
+			if !plain {
+				addrHash, err := common.HashData(address[:])
+				require.NoError(t, err)
+				key = addrHash[:]
+			}
+			require.NoError(t, ch.Add(key, bytes.Repeat([]byte{byte(i)}, i%7)))
+		}
+		b, err := EncodeAccounts(ch)
+		require.NoError(t, err)
+		if plain {
+			requireIteratorMatchesWalk(t, AccountChangeSetPlainBytes(b))
+		} else {
+			requireIteratorMatchesWalk(t, AccountChangeSetBytes(b))
+		}
+	}
+
+	_, _, err := AccountChangeSetPlainBytes([]byte{0, 0}).Iterator().Next()
+	require.Error(t, err)
+}
@@ -44,6 +44,10 @@ func (b StorageChangeSetBytes) Walk(f func(k, v []byte) error) error {
 	return walkStorageChangeSet(b, common.HashLength, f)
 }
 
+func (b StorageChangeSetBytes) WalkReverse(f func(k, v []byte) error) error {
+	return walkReverseStorageChangeSet(b, common.HashLength, f)
+}
+
 func (b StorageChangeSetBytes) Find(k []byte) ([]byte, error) {
 	return findWithoutIncarnationInStorageChangeSet(b, common.HashLength, k[:common.HashLength], k[common.HashLength:])
 }
@@ -55,6 +59,10 @@ func (b StorageChangeSetBytes) FindWithoutIncarnation(addrHashToFind []byte, key
 	return findWithoutIncarnationInStorageChangeSet(b, common.HashLength, addrHashToFind, keyHashToFind)
 }
 
+func (b StorageChangeSetBytes) Iterator() Iterator {
+	return newStorageChangeSetIterator(b, common.HashLength)
+}
+
 /* Plain changesets (key is a common.Address) */
 
 func NewStorageChangeSetPlain() *ChangeSet {
@@ -83,6 +91,10 @@ func (b StorageChangeSetPlainBytes) Walk(f func(k, v []byte) error) error {
 	return walkStorageChangeSet(b, common.AddressLength, f)
 }
 
+func (b StorageChangeSetPlainBytes) WalkReverse(f func(k, v []byte) error) error {
+	return walkReverseStorageChangeSet(b, common.AddressLength, f)
+}
+
 func (b StorageChangeSetPlainBytes) Find(k []byte) ([]byte, error) {
 	return findWithoutIncarnationInStorageChangeSet(b, common.AddressLength, k[:common.AddressLength], k[common.AddressLength:])
 }
@@ -94,3 +106,7 @@ func (b StorageChangeSetPlainBytes) FindWithIncarnation(k []byte) ([]byte, error
 func (b StorageChangeSetPlainBytes) FindWithoutIncarnation(addressToFind []byte, keyToFind []byte) ([]byte, error) {
 	return findWithoutIncarnationInStorageChangeSet(b, common.AddressLength, addressToFind, keyToFind)
 }
+
+func (b StorageChangeSetPlainBytes) Iterator() Iterator {
+	return newStorageChangeSetIterator(b, common.AddressLength)
+}
@@ -351,6 +351,65 @@ func walkStorageChangeSet(b []byte, keyPrefixLen int, f func(k, v []byte) error)
 	return nil
 }
 
+// walkReverseStorageChangeSet - same as walkStorageChangeSet, but in reverse order of keys
+func walkReverseStorageChangeSet(b []byte, keyPrefixLen int, f func(k, v []byte) error) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if len(b) < 4 {
+		return fmt.Errorf("decode: input too short (%d bytes)", len(b))
+	}
+
+	numOfUniqueElements := int(binary.BigEndian.Uint32(b))
+	if numOfUniqueElements == 0 {
+		return nil
+	}
+	incarnatonsInfo := 4 + numOfUniqueElements*(keyPrefixLen+4)
+	numOfNotDefaultIncarnations := int(binary.BigEndian.Uint32(b[incarnatonsInfo:]))
+	incarnatonsStart := incarnatonsInfo + 4
+
+	notDefaultIncarnations := make(map[uint32]uint64, numOfNotDefaultIncarnations)
+	if numOfNotDefaultIncarnations > 0 {
+		for i := 0; i < numOfNotDefaultIncarnations; i++ {
+			notDefaultIncarnations[binary.BigEndian.Uint32(b[incarnatonsStart+i*12:])] = binary.BigEndian.Uint64(b[incarnatonsStart+i*12+4:])
+		}
+	}
+
+	keysStart := incarnatonsStart + numOfNotDefaultIncarnations*12
+	numOfElements := int(binary.BigEndian.Uint32(b[incarnatonsInfo-4:]))
+	valsInfoStart := keysStart + numOfElements*common.HashLength
+
+	k := make([]byte, keyPrefixLen+common.HashLength+common.IncarnationLength)
+	for i := numOfUniqueElements - 1; i >= 0; i-- {
+		var startKeys int
+		if i > 0 {
+			startKeys = int(binary.BigEndian.Uint32(b[4+i*(keyPrefixLen)+(i-1)*4 : 4+i*(keyPrefixLen)+(i)*4]))
+		}
+		endKeys := int(binary.BigEndian.Uint32(b[4+(i+1)*(keyPrefixLen)+i*4:]))
+		addrBytes := b[4+i*(keyPrefixLen)+i*4:] // hash or raw address
+		incarnation := DefaultIncarnation
+		if inc, ok := notDefaultIncarnations[uint32(i)]; ok {
+			incarnation = inc
+		}
+
+		for j := endKeys - 1; j >= startKeys; j-- {
+			copy(k[:keyPrefixLen], addrBytes[:keyPrefixLen])
+			binary.BigEndian.PutUint64(k[keyPrefixLen:], incarnation)
+			copy(k[keyPrefixLen+common.IncarnationLength:keyPrefixLen+common.HashLength+common.IncarnationLength], b[keysStart+j*common.HashLength:])
+			val, innerErr := findValue(b[valsInfoStart:], j)
+			if innerErr != nil {
+				return innerErr
+			}
+			if err := f(k, val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func findInStorageChangeSet(b []byte, keyPrefixLen int, k []byte) ([]byte, error) {
 	return doSearch(
 		b,
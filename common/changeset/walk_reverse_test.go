@@ -0,0 +1,168 @@
+package changeset
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkReverse(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	collect := func(walk func(func(k, v []byte) error) error) (res [][2][]byte) {
+		require.NoError(t, walk(func(k, v []byte) error {
+			res = append(res, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+			return nil
+		}))
+		return res
+	}
+
+	for i := 0; i < 20; i++ {
+		accounts, accountsPlain := NewAccountChangeSet(), NewAccountChangeSetPlain()
+		randomAccountChangeSet(r, accounts, common.HashLength)
+		randomAccountChangeSet(r, accountsPlain, common.AddressLength)
+		storage, storagePlain := NewStorageChangeSet(), NewStorageChangeSetPlain()
+		randomStorageChangeSet(r, storage, common.HashLength)
+		randomStorageChangeSet(r, storagePlain, common.AddressLength)
+
+		var walkers []Walker
+		enc, err := EncodeAccounts(accounts)
+		require.NoError(t, err)
+		walkers = append(walkers, AccountChangeSetBytes(enc))
+		enc, err = EncodeAccountsPlain(accountsPlain)
+		require.NoError(t, err)
+		walkers = append(walkers, AccountChangeSetPlainBytes(enc))
+		enc, err = EncodeStorage(storage)
+		require.NoError(t, err)
+		walkers = append(walkers, StorageChangeSetBytes(enc))
+		enc, err = EncodeStoragePlain(storagePlain)
+		require.NoError(t, err)
+		walkers = append(walkers, StorageChangeSetPlainBytes(enc))
+
+		for _, w := range walkers {
+			forward, reverse := collect(w.Walk), collect(w.WalkReverse)
+			require.Equal(t, len(forward), len(reverse))
+			for j := range forward {
+				require.Equal(t, forward[j], reverse[len(reverse)-1-j])
+			}
+		}
+	}
+}
+
+// sliceCursor - Cursor over sorted key-value pairs
+type sliceCursor struct {
+	kvs [][2][]byte
+	pos int
+}
+
+func (c *sliceCursor) current() ([]byte, []byte, error) {
+	if c.pos < 0 || c.pos >= len(c.kvs) {
+		return nil, nil, nil
+	}
+	return c.kvs[c.pos][0], c.kvs[c.pos][1], nil
+}
+
+func (c *sliceCursor) Seek(seek []byte) ([]byte, []byte, error) {
+	c.pos = sort.Search(len(c.kvs), func(i int) bool { return bytes.Compare(c.kvs[i][0], seek) >= 0 })
+	return c.current()
+}
+
+func (c *sliceCursor) Prev() ([]byte, []byte, error) {
+	c.pos--
+	return c.current()
+}
+
+func (c *sliceCursor) Last() ([]byte, []byte, error) {
+	c.pos = len(c.kvs) - 1
+	return c.current()
+}
+
+func TestUnwindByForEachBlockReverse(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	addrs := make([]common.Address, 5)
+	for i := range addrs {
+		r.Read(addrs[i][:])
+	}
+	randomValue := func() []byte {
+		v := make([]byte, 1+r.Intn(10))
+		r.Read(v)
+		return v
+	}
+
+	// state - plain accounts and storage, empty value means deleted
+	state := map[string][]byte{}
+	for _, addr := range addrs[:3] {
+		state[string(addr[:])] = randomValue()
+		state[string(dbutils.PlainGenerateCompositeStorageKey(addr, 1, common.Hash{1}))] = randomValue()
+	}
+	original := map[string][]byte{}
+	for k, v := range state {
+		original[k] = v
+	}
+
+	accountChangeSets, storageChangeSets := &sliceCursor{}, &sliceCursor{}
+	// block 2 doesn't change storage. in block 3 contract is re-created
+	for blockNum := uint64(1); blockNum <= 3; blockNum++ {
+		accounts, storage := NewAccountChangeSetPlain(), NewStorageChangeSetPlain()
+		newState := map[string][]byte{}
+		for i, addr := range addrs {
+			addr := addr // addr[:] is kept by the changesets
+			if i == int(blockNum) {
+				continue
+			}
+			require.NoError(t, accounts.Add(addr[:], state[string(addr[:])]))
+			newState[string(addr[:])] = randomValue()
+			if blockNum == 2 {
+				continue
+			}
+			incarnation := blockNum/3 + 1
+			key := dbutils.PlainGenerateCompositeStorageKey(addr, incarnation, common.Hash{byte(r.Intn(3))})
+			require.NoError(t, storage.Add(key, state[string(key)]))
+			newState[string(key)] = randomValue()
+		}
+		for k, v := range newState {
+			state[k] = v
+		}
+
+		enc, err := EncodeAccountsPlain(accounts)
+		require.NoError(t, err)
+		accountChangeSets.kvs = append(accountChangeSets.kvs, [2][]byte{dbutils.EncodeTimestamp(blockNum), enc})
+		if storage.Len() > 0 {
+			enc, err = EncodeStoragePlain(storage)
+			require.NoError(t, err)
+			storageChangeSets.kvs = append(storageChangeSets.kvs, [2][]byte{dbutils.EncodeTimestamp(blockNum), enc})
+		}
+	}
+	require.NotEqual(t, original, state)
+
+	var unwound []uint64
+	unwind := func(c Cursor, walker func(v []byte) Walker) {
+		require.NoError(t, ForEachBlockReverse(c, 10, 1, func(blockNum uint64, v []byte) error {
+			unwound = append(unwound, blockNum)
+			return walker(v).WalkReverse(func(k, v []byte) error {
+				if len(v) == 0 {
+					delete(state, string(k))
+				} else {
+					state[string(k)] = common.CopyBytes(v)
+				}
+				return nil
+			})
+		}))
+	}
+	unwind(accountChangeSets, func(v []byte) Walker { return AccountChangeSetPlainBytes(v) })
+	unwind(storageChangeSets, func(v []byte) Walker { return StorageChangeSetPlainBytes(v) })
+	require.Equal(t, original, state)
+	require.Equal(t, []uint64{3, 2, 1, 3, 1}, unwound)
+
+	// range in the middle of history
+	unwound = nil
+	require.NoError(t, ForEachBlockReverse(accountChangeSets, 2, 2, func(blockNum uint64, _ []byte) error {
+		unwound = append(unwound, blockNum)
+		return nil
+	}))
+	require.Equal(t, []uint64{2}, unwound)
+}
@@ -2,6 +2,7 @@ package dbutils
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
 	"strings"
 
@@ -64,13 +65,15 @@ var (
 	CurrentStateBucket     = "CST2"
 	CurrentStateBucketOld1 = "CST"
 
-	//key - address hash
-	//value - list of block where it's changed
-	AccountsHistoryBucket = "hAT"
+	//key - address + shard number (4 bytes big-endian, max block number of the shard, ^uint32(0) for the last shard)
+	//value - roaring bitmap of blocks where account was changed
+	AccountsHistoryBucket     = "hAT2"
+	AccountsHistoryBucketOld1 = "hAT" // key - address + 8 bytes chunk number, value - HistoryIndexBytes
 
-	//key - address hash
-	//value - list of block where it's changed
-	StorageHistoryBucket = "hST"
+	//key - address + storage key + shard number (4 bytes big-endian, max block number of the shard, ^uint32(0) for the last shard)
+	//value - roaring bitmap of blocks where storage item was changed
+	StorageHistoryBucket     = "hST2"
+	StorageHistoryBucketOld1 = "hST" // key - address + storage key + 8 bytes chunk number, value - HistoryIndexBytes
 
 	//key - contract code hash
 	//value - contract code
@@ -112,8 +115,13 @@ var (
 	HeaderHashSuffix   = []byte("n") // headerPrefix + num (uint64 big endian) + headerHashSuffix -> hash
 	HeaderNumberPrefix = "H"         // headerNumberPrefix + hash -> num (uint64 big endian)
 
-	BlockBodyPrefix     = "b" // blockBodyPrefix + num (uint64 big endian) + hash -> block body
-	BlockReceiptsPrefix = "r" // blockReceiptsPrefix + num (uint64 big endian) + hash -> block receipts
+	BlockBodyPrefix     = "b"          // blockBodyPrefix + num (uint64 big endian) + hash -> block body
+	BlockReceiptsPrefix = "r"          // blockReceiptsPrefix + num (uint64 big endian) + hash -> block receipts
+	BlockBloomPrefix    = "blockBloom" // blockBloomPrefix + num (uint64 big endian) -> bloom of the canonical block logs
+
+	// Receipts of the canonical blocks are stored split: receipts without logs, and logs one by one
+	BlockReceiptsPrefix2 = "r2"  // blockReceiptsPrefix2 + num (uint64 big endian) -> block receipts without logs
+	Logs                 = "log" // logKey (num + txIdx + logIdx, uint32 big endian each) -> log, see LogKey
 
 	// Stores bitmap indices - in which block numbers saw logs of given 'address' or 'topic'
 	// [addr or topic] + [2 bytes inverted shard number] -> bitmap(blockN)
@@ -146,14 +154,22 @@ var (
 	// Position to where to unwind sync stages: stageName -> stageData
 	SyncStageUnwind     = "SSU2"
 	SyncStageUnwindOld1 = "SSU"
+	// Timing and throughput of sync stages: stageName -> stages.StageMetrics
+	SyncStageMetrics = "SSM"
 
 	CliqueBucket = "clique-"
 
+	// State of the header downloader - to continue after restart:
+	// HeaderDownloadAnchorPrefix + anchor hash -> anchor, HeaderDownloadTipPrefix + tip hash -> tip
+	HeaderDownloadBucket = "header_download"
+
 	// this bucket stored in separated database
 	InodesBucket = "inodes"
 
 	// Transaction senders - stored separately from the block bodies
 	Senders = "txSenders"
+	// Transaction senders of canonical blocks, DupSort|DupFixed: blockNum_u64 -> txIndex_u32 + sender_20bytes
+	Senders2 = "txSenders2"
 
 	// fastTrieProgressKey tracks the number of trie entries imported during fast sync.
 	FastTrieProgressKey = "TrieSync"
@@ -170,9 +186,16 @@ var (
 
 // Keys
 var (
+	HeaderDownloadAnchorPrefix = []byte("a")
+	HeaderDownloadTipPrefix    = []byte("t")
+
 	// last block that was pruned
 	// it's saved one in 5 minutes
 	LastPrunedBlockKey = []byte("LastPrunedBlock")
+	// HistoryPrunedToKey - changesets and history indices below this block are pruned (or being pruned)
+	HistoryPrunedToKey = []byte("HistoryPrunedTo")
+	// HistoryPruneProgressKey - changesets below this block are already pruned, interrupted prune continues from it
+	HistoryPruneProgressKey = []byte("HistoryPruneProgress")
 	//StorageModeHistory - does node save history.
 	StorageModeHistory = []byte("smHistory")
 	//StorageModeReceipts - does node save receipts.
@@ -181,6 +204,17 @@ var (
 	StorageModeTxIndex = []byte("smTxIndex")
 	//StorageModeCallTraces - does not build index of call traces
 	StorageModeCallTraces = []byte("smCallTraces")
+	//StorageModeSenders2 - does node save senders in the Senders2 layout
+	StorageModeSenders2 = []byte("smSenders2")
+	//StorageModeBlooms - does node save blooms of the block logs, used by eth_getLogs when there is no logs index
+	StorageModeBlooms = []byte("smBlooms")
+
+	// LMDBMapSize - current and max map size of LMDB, 8 bytes big-endian each. Saved when the map grows
+	LMDBMapSize = []byte("lmdbMapSize")
+
+	// ClearingBucketPrefix - "clearing:<bucket>" marker of unfinished ClearBucketsIncremental, value is amount of
+	// deleted keys, 8 bytes big-endian
+	ClearingBucketPrefix = []byte("clearing:")
 
 	HeadHeaderKey = "LastHeader"
 
@@ -213,6 +247,7 @@ var Buckets = []string{
 	HeaderNumberPrefix,
 	BlockBodyPrefix,
 	BlockReceiptsPrefix,
+	BlockBloomPrefix,
 	TxLookupPrefix,
 	BloomBitsPrefix,
 	PreimagePrefix,
@@ -223,11 +258,13 @@ var Buckets = []string{
 	CliqueBucket,
 	SyncStageProgress,
 	SyncStageUnwind,
+	SyncStageMetrics,
 	PlainStateBucket,
 	PlainContractCodeBucket,
 	PlainAccountChangeSetBucket,
 	PlainStorageChangeSetBucket,
 	Senders,
+	Senders2,
 	FastTrieProgressKey,
 	HeadBlockKey,
 	HeadFastBlockKey,
@@ -238,17 +275,36 @@ var Buckets = []string{
 	SnapshotInfoBucket,
 	CallFromIndex,
 	CallToIndex,
+	BlockReceiptsPrefix2,
+	Logs,
+	HeaderDownloadBucket,
 }
 
-// DeprecatedBuckets - list of buckets which can be programmatically deleted - for example after migration
+// DeprecatedBuckets - list of buckets which can be programmatically deleted - for example after migration.
+// The db doesn't create them, and the migrations package generates one migration per bucket which drops its data
+// (unless started with --migrations.keep-deprecated-buckets), so to free an unused bucket just move it here
 var DeprecatedBuckets = []string{
 	SyncStageProgressOld1,
 	SyncStageUnwindOld1,
 	CurrentStateBucketOld1,
 	PlainStateBucketOld1,
 	IntermediateTrieHashBucketOld1,
+	AccountsHistoryBucketOld1,
+	StorageHistoryBucketOld1,
+}
+
+// BucketRename - data of bucket Old is moved to bucket New by migration: migrations package generates one for
+// every item of BucketRenames. To rename bucket: replace Old by New in Buckets (keep BucketsConfigs item of Old if
+// it has one - it's needed to read Old) and add BucketRename here - Old becomes deprecated automatically.
+// TransformKV (optional) converts every key and value during the move.
+type BucketRename struct {
+	Old, New    string
+	TransformKV func(k, v []byte) ([]byte, []byte)
 }
 
+// BucketRenames - migrations of the renames are applied in order of this list, after other migrations
+var BucketRenames = []BucketRename{}
+
 type CustomComparator string
 
 const (
@@ -307,6 +363,9 @@ var BucketsConfigs = BucketsCfg{
 		Flags:               lmdb.DupSort,
 		CustomDupComparator: DupCmpSuffix32,
 	},
+	Senders2: {
+		Flags: lmdb.DupSort | lmdb.DupFixed,
+	},
 }
 
 func sortBuckets() {
@@ -355,4 +414,75 @@ func reinit() {
 		tmp.IsDeprecated = true
 		BucketsConfigs[name] = tmp
 	}
+
+	for _, r := range BucketRenames {
+		tmp := BucketsConfigs[r.Old]
+		tmp.IsDeprecated = true
+		BucketsConfigs[r.Old] = tmp
+	}
+	if err := checkBuckets(Buckets, DeprecatedBuckets, BucketsConfigs); err != nil {
+		panic(err)
+	}
+	if err := checkBucketRenames(Buckets, BucketRenames); err != nil {
+		panic(err)
+	}
+}
+
+// checkBuckets - protection against typos: names must be unique and not empty,
+// configured buckets must be in Buckets or be deprecated
+func checkBuckets(buckets, deprecated []string, cfg BucketsCfg) error {
+	registered := make(map[string]bool, len(buckets)+len(deprecated))
+	for _, list := range [][]string{buckets, deprecated} {
+		for _, name := range list {
+			if name == "" {
+				return fmt.Errorf("empty bucket name")
+			}
+			if registered[name] {
+				return fmt.Errorf("bucket %s is registered twice", name)
+			}
+			registered[name] = true
+		}
+	}
+	for name, item := range cfg {
+		if !registered[name] && !item.IsDeprecated {
+			return fmt.Errorf("bucket %s is in BucketsConfigs, but not in Buckets or DeprecatedBuckets", name)
+		}
+	}
+	return nil
+}
+
+// MustBucket - config of the bucket, panics with readable message if bucket is unknown
+func (cfg BucketsCfg) MustBucket(name string) BucketConfigItem {
+	item, ok := cfg[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown bucket: %q, add it to dbutils.Buckets", name))
+	}
+	return item
+}
+
+// MustBucket - config of the bucket from BucketsConfigs, panics with readable message if bucket is unknown
+func MustBucket(name string) BucketConfigItem {
+	return BucketsConfigs.MustBucket(name)
+}
+
+// checkBucketRenames - renamed buckets must not be used by code anymore, new buckets must be known
+func checkBucketRenames(buckets []string, renames []BucketRename) error {
+	isBucket := make(map[string]bool, len(buckets))
+	for _, name := range buckets {
+		isBucket[name] = true
+	}
+	renamed := make(map[string]bool, len(renames))
+	for _, r := range renames {
+		if renamed[r.Old] {
+			return fmt.Errorf("bucket %s is renamed twice", r.Old)
+		}
+		renamed[r.Old] = true
+		if isBucket[r.Old] {
+			return fmt.Errorf("bucket %s is renamed to %s, but still is in dbutils.Buckets", r.Old, r.New)
+		}
+		if !isBucket[r.New] {
+			return fmt.Errorf("bucket %s is renamed to %s, but it's not in dbutils.Buckets", r.Old, r.New)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,42 @@
+package dbutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckBucketRenames(t *testing.T) {
+	buckets := []string{"a", "b", "c"}
+	require.NoError(t, checkBucketRenames(buckets, []BucketRename{{Old: "old_a", New: "a"}, {Old: "old_b", New: "b"}}))
+	require.Error(t, checkBucketRenames(buckets, []BucketRename{{Old: "a", New: "b"}}))
+	require.Error(t, checkBucketRenames(buckets, []BucketRename{{Old: "old_a", New: "d"}}))
+	require.Error(t, checkBucketRenames(buckets, []BucketRename{{Old: "old_a", New: "a"}, {Old: "old_a", New: "b"}}))
+}
+
+func TestCheckBuckets(t *testing.T) {
+	require.NoError(t, checkBuckets([]string{"a", "b"}, []string{"old_a"}, BucketsCfg{"a": {}, "old_a": {}, "old_b": {IsDeprecated: true}}))
+	require.Error(t, checkBuckets([]string{"a", "b", "a"}, nil, BucketsCfg{}))
+	require.Error(t, checkBuckets([]string{"a", "b"}, []string{"a"}, BucketsCfg{}))
+	require.Error(t, checkBuckets([]string{"a", ""}, nil, BucketsCfg{}))
+	require.Error(t, checkBuckets([]string{"a"}, nil, BucketsCfg{"typo": {}}))
+	require.NoError(t, checkBuckets(Buckets, DeprecatedBuckets, BucketsConfigs))
+}
+
+func TestMustBucket(t *testing.T) {
+	require.Equal(t, BucketsConfigs[PlainStateBucket], MustBucket(PlainStateBucket))
+	require.PanicsWithValue(t, `unknown bucket: "typo", add it to dbutils.Buckets`, func() { MustBucket("typo") })
+}
+
+// go generate ./common/dbutils - to update list of referenced buckets
+func TestReferencedBucketsRegistered(t *testing.T) {
+	// buckets of other databases, opened with own BucketsCfg
+	otherDatabases := map[string]bool{InodesBucket: true}
+	for _, name := range referencedBuckets {
+		if otherDatabases[name] {
+			continue
+		}
+		_, ok := BucketsConfigs[name]
+		require.True(t, ok, "bucket %q is used, but it's not in dbutils.Buckets", name)
+	}
+}
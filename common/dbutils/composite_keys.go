@@ -3,6 +3,8 @@ package dbutils
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 )
@@ -163,3 +165,49 @@ func CompositeKeySuffix(key []byte, timestamp uint64) (composite, encodedTS []by
 	copy(composite[len(key):], encodedTS)
 	return composite, encodedTS
 }
+
+// LogKeyLength - length of the LogKey: block number, transaction index and log index, uint32 each
+const LogKeyLength = 3 * 4
+
+// EncodeBlockNumber32 encodes a block number as big endian uint32, as log keys and log indices keep it.
+// Panics if the block number doesn't fit into 4 bytes, instead of silently truncating it.
+func EncodeBlockNumber32(number uint64) []byte {
+	if number > math.MaxUint32 {
+		panic(fmt.Sprintf("block number %d doesn't fit into 4 bytes", number))
+	}
+	enc := make([]byte, 4)
+	binary.BigEndian.PutUint32(enc, uint32(number))
+	return enc
+}
+
+// logKey = blockNum (uint32 big endian) + txIdx (uint32 big endian) + logIdx (uint32 big endian)
+// keys are ordered the same way as logs in the chain
+func LogKey(blockNum uint64, txIdx, logIdx uint32) []byte {
+	key := make([]byte, LogKeyLength)
+	copy(key, EncodeBlockNumber32(blockNum))
+	binary.BigEndian.PutUint32(key[4:], txIdx)
+	binary.BigEndian.PutUint32(key[8:], logIdx)
+	return key
+}
+
+func ParseLogKey(k []byte) (blockNum uint64, txIdx, logIdx uint32, err error) {
+	if len(k) != LogKeyLength {
+		return 0, 0, 0, fmt.Errorf("log key must be %d bytes, got %d: %x", LogKeyLength, len(k), k)
+	}
+	return uint64(binary.BigEndian.Uint32(k)), binary.BigEndian.Uint32(k[4:]), binary.BigEndian.Uint32(k[8:]), nil
+}
+
+// topicBitmapKey = address + topic - key of the bitmap of blocks where the address emitted logs with the topic
+func TopicBitmapKey(addr common.Address, topic common.Hash) []byte {
+	key := make([]byte, common.AddressLength+common.HashLength)
+	copy(key, addr[:])
+	copy(key[common.AddressLength:], topic[:])
+	return key
+}
+
+func ParseTopicBitmapKey(k []byte) (common.Address, common.Hash, error) {
+	if len(k) != common.AddressLength+common.HashLength {
+		return common.Address{}, common.Hash{}, fmt.Errorf("topic bitmap key must be %d bytes, got %d: %x", common.AddressLength+common.HashLength, len(k), k)
+	}
+	return common.BytesToAddress(k[:common.AddressLength]), common.BytesToHash(k[common.AddressLength:]), nil
+}
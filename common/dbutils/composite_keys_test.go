@@ -1,6 +1,8 @@
 package dbutils
 
 import (
+	"bytes"
+	"math"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -94,3 +96,60 @@ func TestParseCompositeStorageKey(t *testing.T) {
 	assert.Equal(t, expectedIncarnation, incarnation, "incarnation should be extracted")
 	assert.Equal(t, expectedKey, key, "key should be extracted")
 }
+
+func TestLogKey(t *testing.T) {
+	cases := []struct {
+		blockNum      uint64
+		txIdx, logIdx uint32
+	}{
+		{0, 0, 0},
+		{1, 2, 3},
+		{0x01020304, 0x05060708, 0x090a0b0c},
+		{math.MaxUint32, math.MaxUint32, math.MaxUint32},
+	}
+	for _, c := range cases {
+		k := LogKey(c.blockNum, c.txIdx, c.logIdx)
+		assert.Equal(t, LogKeyLength, len(k))
+		blockNum, txIdx, logIdx, err := ParseLogKey(k)
+		assert.NoError(t, err)
+		assert.Equal(t, c.blockNum, blockNum)
+		assert.Equal(t, c.txIdx, txIdx)
+		assert.Equal(t, c.logIdx, logIdx)
+	}
+	assert.Equal(t, common.Hex2Bytes("0102030405060708090a0b0c"), LogKey(0x01020304, 0x05060708, 0x090a0b0c))
+
+	// byte order is the order of logs in the chain
+	assert.Equal(t, -1, bytes.Compare(LogKey(1, math.MaxUint32, math.MaxUint32), LogKey(2, 0, 0)))
+	assert.Equal(t, -1, bytes.Compare(LogKey(1, 1, math.MaxUint32), LogKey(1, 2, 0)))
+	assert.Equal(t, -1, bytes.Compare(LogKey(1, 1, 255), LogKey(1, 1, 256)))
+
+	// block numbers above 2^32 are not truncated
+	assert.Panics(t, func() { LogKey(math.MaxUint32+1, 0, 0) })
+	assert.Panics(t, func() { EncodeBlockNumber32(1 << 40) })
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, EncodeBlockNumber32(math.MaxUint32))
+
+	for _, bad := range [][]byte{nil, make([]byte, LogKeyLength-1), make([]byte, LogKeyLength+1), EncodeBlockNumber(1)} {
+		_, _, _, err := ParseLogKey(bad)
+		assert.Error(t, err)
+	}
+}
+
+func TestTopicBitmapKey(t *testing.T) {
+	addr := common.HexToAddress("0x5A0b54D5dc17e0AadC383d2db43B0a0D3E029c4c")
+	topic := common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	for _, c := range []struct {
+		addr  common.Address
+		topic common.Hash
+	}{{addr, topic}, {}, {addr, common.Hash{}}, {common.Address{}, topic}} {
+		k := TopicBitmapKey(c.addr, c.topic)
+		assert.Equal(t, append(c.addr.Bytes(), c.topic.Bytes()...), k)
+		parsedAddr, parsedTopic, err := ParseTopicBitmapKey(k)
+		assert.NoError(t, err)
+		assert.Equal(t, c.addr, parsedAddr)
+		assert.Equal(t, c.topic, parsedTopic)
+	}
+	for _, bad := range [][]byte{nil, addr.Bytes(), topic.Bytes(), append(TopicBitmapKey(addr, topic), 0)} {
+		_, _, err := ParseTopicBitmapKey(bad)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,3 @@
+package dbutils
+
+//go:generate go run ./internal/gen.go
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const dbutilsPath = "github.com/ledgerwatch/turbo-geth/common/dbutils"
+
+// collects names of string constants of bucket.go which are passed as first argument of function calls
+// anywhere in the repository (e.g. db.Get(dbutils.HeaderPrefix, ...)), and writes them to referenced_buckets_gen_test.go
+func main() {
+	fset := token.NewFileSet()
+	bucketsFile, err := parser.ParseFile(fset, "bucket.go", nil, 0)
+	if err != nil {
+		panic(err)
+	}
+	candidates := map[string]bool{}
+	for _, decl := range bucketsFile.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || (genDecl.Tok != token.VAR && genDecl.Tok != token.CONST) {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			valueSpec := spec.(*ast.ValueSpec)
+			for i, name := range valueSpec.Names {
+				if i >= len(valueSpec.Values) {
+					continue
+				}
+				if lit, ok := valueSpec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					candidates[name.Name] = true
+				}
+			}
+		}
+	}
+
+	dbutilsDir, err := filepath.Abs(".")
+	if err != nil {
+		panic(err)
+	}
+	referenced := map[string]bool{}
+	if err = filepath.Walk("../..", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch info.Name() {
+			case ".git", "vendor", "build", "node_modules", "testdata":
+				return filepath.SkipDir
+			}
+			if abs, _ := filepath.Abs(path); abs == dbutilsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".go" {
+			return nil
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+		if err != nil {
+			return nil // not our business
+		}
+		alias := ""
+		for _, imp := range f.Imports {
+			if p, _ := strconv.Unquote(imp.Path.Value); p == dbutilsPath {
+				alias = "dbutils"
+				if imp.Name != nil {
+					alias = imp.Name.Name
+				}
+			}
+		}
+		if alias == "" {
+			return nil
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			if _, ok := call.Fun.(*ast.ArrayType); ok { // []byte(dbutils.SomeKey) - key, not bucket
+				return true
+			}
+			sel, ok := call.Args[0].(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == alias && candidates[sel.Sel.Name] {
+				referenced[sel.Sel.Name] = true
+			}
+			return true
+		})
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+
+	names := make([]string, 0, len(referenced))
+	for name := range referenced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, `// Code generated by go generate; DO NOT EDIT.
+package dbutils
+
+// referencedBuckets - buckets used by code of the repository, see TestReferencedBucketsRegistered
+var referencedBuckets = []string{
+`)
+	for _, name := range names {
+		fmt.Fprintf(buf, "\t%s,\n", name)
+	}
+	fmt.Fprintf(buf, "}\n")
+
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile("referenced_buckets_gen_test.go", b, 0644); err != nil {
+		panic(err)
+	}
+}
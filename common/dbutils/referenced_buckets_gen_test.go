@@ -0,0 +1,57 @@
+// Code generated by go generate; DO NOT EDIT.
+package dbutils
+
+// referencedBuckets - buckets used by code of the repository, see TestReferencedBucketsRegistered
+var referencedBuckets = []string{
+	AccountChangeSetBucket,
+	AccountsHistoryBucket,
+	AccountsHistoryBucketOld1,
+	BlockBloomPrefix,
+	BlockBodyPrefix,
+	BlockReceiptsPrefix,
+	BlockReceiptsPrefix2,
+	BloomBitsPrefix,
+	CallFromIndex,
+	CallToIndex,
+	CliqueBucket,
+	CodeBucket,
+	ConfigPrefix,
+	ContractCodeBucket,
+	CurrentStateBucket,
+	CurrentStateBucketOld1,
+	DatabaseInfoBucket,
+	DatabaseVerisionKey,
+	FastTrieProgressKey,
+	HeadBlockKey,
+	HeadFastBlockKey,
+	HeadHeaderKey,
+	HeaderDownloadBucket,
+	HeaderNumberPrefix,
+	HeaderPrefix,
+	IncarnationMapBucket,
+	InodesBucket,
+	IntermediateTrieHashBucket,
+	IntermediateTrieHashBucketOld1,
+	LogAddressIndex,
+	LogTopicIndex,
+	Logs,
+	Migrations,
+	PlainAccountChangeSetBucket,
+	PlainContractCodeBucket,
+	PlainStateBucket,
+	PlainStateBucketOld1,
+	PlainStorageChangeSetBucket,
+	PreimagePrefix,
+	Senders,
+	Senders2,
+	SnapshotInfoBucket,
+	StorageChangeSetBucket,
+	StorageHistoryBucket,
+	StorageHistoryBucketOld1,
+	SyncStageMetrics,
+	SyncStageProgress,
+	SyncStageProgressOld1,
+	SyncStageUnwind,
+	SyncStageUnwindOld1,
+	TxLookupPrefix,
+}
@@ -68,3 +68,49 @@ func TestDB() string {
 	})
 	return testDB
 }
+
+// atomic: 1 if check is enabled
+var checkCursorAfterTx = func() uint32 {
+	if _, ok := os.LookupEnv("CHECK_CURSOR_AFTER_TX"); ok {
+		return 1
+	}
+	return 0
+}()
+
+// IsCursorAfterTxCheckEnabled - if CHECK_CURSOR_AFTER_TX environment variable is set, usage of a cursor
+// after its transaction was committed or rolled back panics with the stack of the commit/rollback
+func IsCursorAfterTxCheckEnabled() bool {
+	return atomic.LoadUint32(&checkCursorAfterTx) == 1
+}
+
+// OverrideCursorAfterTxCheck allows to explicitly enable or disable the check
+func OverrideCursorAfterTxCheck(val bool) {
+	if val {
+		atomic.StoreUint32(&checkCursorAfterTx, 1)
+	} else {
+		atomic.StoreUint32(&checkCursorAfterTx, 0)
+	}
+}
+
+// atomic: 1 if stacks are captured
+var readersStacks = func() uint32 {
+	if _, ok := os.LookupEnv("TRACK_READERS_STACKS"); ok {
+		return 1
+	}
+	return 0
+}()
+
+// IsReadersStacksEnabled - if TRACK_READERS_STACKS environment variable is set, stack of the code which opened
+// a read transaction is captured and reported by KV.Readers and by the reader age limit
+func IsReadersStacksEnabled() bool {
+	return atomic.LoadUint32(&readersStacks) == 1
+}
+
+// OverrideReadersStacks allows to explicitly enable or disable capturing of stacks
+func OverrideReadersStacks(val bool) {
+	if val {
+		atomic.StoreUint32(&readersStacks, 1)
+	} else {
+		atomic.StoreUint32(&readersStacks, 0)
+	}
+}
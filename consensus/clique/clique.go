@@ -180,6 +180,8 @@ type Clique struct {
 	signFn SignerFn       // Signer function to authorize hashes with
 	lock   sync.RWMutex   // Protects the signer fields
 
+	readOnly bool // Snapshots are loaded from the database, but not stored
+
 	// The fields below are for testing only
 	fakeDiff bool // Skip difficulty verifications
 }
@@ -205,6 +207,15 @@ func New(config *params.CliqueConfig, db ethdb.Database) *Clique {
 	}
 }
 
+// NewReadOnly creates a Clique engine which loads the checkpoint snapshots from
+// the database, but keeps the ones it computes only in memory. It is meant for
+// the replay of the blocks over a read-only database, e.g. in the rpcdaemon.
+func NewReadOnly(config *params.CliqueConfig, db ethdb.Database) *Clique {
+	c := New(config, db)
+	c.readOnly = true
+	return c
+}
+
 // Author implements consensus.Engine, returning the Ethereum address recovered
 // from the signature in the header's extra-data section.
 func (c *Clique) Author(header *types.Header) (common.Address, error) {
@@ -384,6 +395,9 @@ func (c *Clique) snapshot(chain consensus.ChainHeaderReader, number uint64, hash
 					copy(signers[i][:], checkpoint.Extra[extraVanity+i*common.AddressLength:])
 				}
 				snap = newSnapshot(c.config, c.signatures, number, hash, signers)
+				if c.readOnly {
+					break
+				}
 				if err := snap.store(c.db); err != nil {
 					return nil, err
 				}
@@ -421,7 +435,7 @@ func (c *Clique) snapshot(chain consensus.ChainHeaderReader, number uint64, hash
 	c.recents.Add(snap.Hash, snap)
 
 	// If we've generated a new checkpoint snapshot, save to disk
-	if snap.Number%checkpointInterval == 0 && len(headers) > 0 {
+	if snap.Number%checkpointInterval == 0 && len(headers) > 0 && !c.readOnly {
 		if err = snap.store(c.db); err != nil {
 			return nil, err
 		}
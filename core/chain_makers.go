@@ -263,12 +263,12 @@ func GenerateChain(config *params.ChainConfig, parent *types.Block, engine conse
 				}
 				fmt.Printf("===============================\n")
 			}
-			var hashCollector func(keyHex []byte, hash []byte) error
+			var hashCollector trie.HashCollector
 			var collector *etl.Collector
 			unfurl := trie.NewRetainList(0)
 			if intermediateHashes {
 				collector = etl.NewCollector("", etl.NewSortableBuffer(etl.BufferOptimalSize))
-				hashCollector = func(keyHex []byte, hash []byte) error {
+				hashCollector = trie.HashCollectorFunc(func(keyHex []byte, hash []byte) error {
 					if len(keyHex) == 0 {
 						return nil
 					}
@@ -276,7 +276,7 @@ func GenerateChain(config *params.ChainConfig, parent *types.Block, engine conse
 						return collector.Collect(keyHex[:trie.IHDupKeyLen], append(keyHex[trie.IHDupKeyLen:], hash...))
 					}
 					return collector.Collect(keyHex, hash)
-				}
+				})
 				changeSetWriter := stateWriter.ChangeSetWriter()
 				accountChangeSet, err1 := changeSetWriter.GetAccountChanges()
 				if err1 != nil {
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"context"
+	"errors"
+
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
 	"github.com/ledgerwatch/turbo-geth/rlp"
 )
 
@@ -14,6 +18,7 @@ type Backend interface {
 	TxPool() *TxPool
 	Etherbase() (common.Address, error)
 	NetVersion() (uint64, error)
+	ProtocolVersions() []uint // supported versions of the eth protocol, the first is primary
 }
 
 func NewEthBackend(eth Backend) *EthBackend {
@@ -28,3 +33,12 @@ func (back *EthBackend) AddLocal(signedtx []byte) ([]byte, error) {
 
 	return tx.Hash().Bytes(), back.TxPool().AddLocal(tx)
 }
+
+func (back *EthBackend) ProtocolVersions() ([]uint, error) {
+	return back.Backend.ProtocolVersions(), nil
+}
+
+// Subscribe is not supported in the process of the node, the events are served over the private API
+func (back *EthBackend) Subscribe(_ context.Context, _ func(*remote.Event)) error {
+	return errors.New("subscription to the events is only supported over the private API")
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -8,11 +9,13 @@ import (
 	"os"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/etl"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 )
 
@@ -70,6 +73,192 @@ func (ig *IndexGenerator) GenerateIndex(startBlock, endBlock uint64, changeSetBu
 	return nil
 }
 
+// RebuildHistoryIndexRange (re)builds the history index from the changesets of blocks [from, to], e.g. after
+// changesets were imported out of band. Entries within [from, to] are replaced by the ones from the changesets,
+// so entries of keys which have no changes in the range are removed, entries outside of the range are kept.
+// Rerunning it over an already indexed range produces the same index. Stage progress is not touched, it's up to the caller.
+func RebuildHistoryIndexRange(logPrefix string, db ethdb.Database, plain, storage bool, from, to uint64, tmpdir string, quit <-chan struct{}) error {
+	var changeSetBucket string
+	switch {
+	case plain && storage:
+		changeSetBucket = dbutils.PlainStorageChangeSetBucket
+	case plain:
+		changeSetBucket = dbutils.PlainAccountChangeSetBucket
+	case storage:
+		changeSetBucket = dbutils.StorageChangeSetBucket
+	default:
+		changeSetBucket = dbutils.AccountChangeSetBucket
+	}
+	if to < from {
+		return fmt.Errorf("%s: rebuild history index: to %d smaller than from %d", logPrefix, to, from)
+	}
+	v := changeset.Mapper[changeSetBucket]
+
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	if err := truncateIndexRange(tx.(ethdb.HasTx).Tx(), v.IndexBucket, from, to, quit); err != nil {
+		return fmt.Errorf("%s: truncate index: %w", logPrefix, err)
+	}
+
+	shards := tx.(ethdb.HasTx).Tx().Cursor(v.IndexBucket)
+	defer shards.Close()
+	if err := etl.Transform(logPrefix, tx, changeSetBucket,
+		v.IndexBucket,
+		tmpdir,
+		func(dbKey, dbValue []byte, next etl.ExtractNextFunc) error {
+			blockNum, _ := dbutils.DecodeTimestamp(dbKey)
+			return v.WalkerAdapter(dbValue).Walk(func(changesetKey, _ []byte) error {
+				blockNumBytes := make([]byte, 4)
+				binary.BigEndian.PutUint32(blockNumBytes, uint32(blockNum))
+				return next(dbKey, dbutils.CompositeKeyWithoutIncarnation(changesetKey), blockNumBytes)
+			})
+		},
+		rebuildRangeLoadFunc(shards, from, to),
+		etl.TransformArgs{
+			ExtractStartKey: dbutils.EncodeTimestamp(from),
+			ExtractEndKey:   dbutils.EncodeTimestamp(to),
+			BufferType:      etl.SortableAppendBuffer,
+			Quit:            quit,
+			LogDetailsExtract: func(k, v []byte) (additionalLogArguments []interface{}) {
+				blockNum, _ := dbutils.DecodeTimestamp(k)
+				return []interface{}{"block", blockNum}
+			},
+		},
+	); err != nil {
+		return err
+	}
+
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateIndexRange removes blocks [from, to] from every key of the index, the keys without changes in the range
+// must not keep stale entries there
+func truncateIndexRange(tx ethdb.Tx, bucket string, from, to uint64, quit <-chan struct{}) error {
+	keys := map[string]struct{}{}
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	for k, v, err := c.Seek(nil); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		// shards are keyed by their maximum, the ones below from keep only the blocks before the range
+		if binary.BigEndian.Uint32(k[len(k)-4:]) < uint32(from) {
+			continue
+		}
+		key := k[:len(k)-4]
+		if _, ok := keys[string(key)]; ok {
+			continue
+		}
+		m := roaring.New()
+		if _, err := m.FromBuffer(v); err != nil {
+			return fmt.Errorf("couldn't read shard %x: %w", k, err)
+		}
+		var before uint64
+		if from > 0 {
+			before = m.Rank(uint32(from - 1))
+		}
+		if m.Rank(uint32(to)) > before {
+			keys[string(key)] = struct{}{}
+		}
+	}
+
+	for k := range keys {
+		if err := bitmapdb.TruncateRange(tx, bucket, []byte(k), from, to+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildRangeLoadFunc merges block numbers (4 bytes each) of the index key into its shards.
+// Shards which may keep blocks of [from, to] are read, blocks of the range are replaced, and the shards are rewritten.
+// For the blocks appended after the end of the index only the last shard is rewritten.
+func rebuildRangeLoadFunc(shards ethdb.Cursor, from, to uint64) etl.LoadFunc {
+	var curKey []byte
+	var cur *roaring.Bitmap
+	var curShards [][]byte // shard keys of curKey which are in the db now
+	buf := bytes.NewBuffer(nil)
+	return func(k []byte, value []byte, _ etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		if len(value)%4 != 0 {
+			return fmt.Errorf("value of %x must be a multiple of 4, got %d bytes", k, len(value))
+		}
+		// the same key comes in a row if it was collected into several files
+		if !bytes.Equal(k, curKey) {
+			curKey, cur, curShards = common.CopyBytes(k), roaring.New(), nil
+			// shards are keyed by their maximum, the ones below ShardKey(k, from) keep only the blocks before the range
+			for shardKey, shardBytes, err := shards.Seek(bitmapdb.ShardKey(k, uint32(from))); shardKey != nil; shardKey, shardBytes, err = shards.Next() {
+				if err != nil {
+					return err
+				}
+				if len(shardKey) != len(k)+4 || !bytes.HasPrefix(shardKey, k) {
+					break
+				}
+				shard := roaring.New()
+				if _, err = shard.FromBuffer(common.CopyBytes(shardBytes)); err != nil {
+					return fmt.Errorf("couldn't read shard %x: %w", shardKey, err)
+				}
+				cur.Or(shard)
+				curShards = append(curShards, common.CopyBytes(shardKey))
+			}
+			cur.RemoveRange(from, to+1)
+		}
+		for i := 0; i < len(value); i += 4 {
+			cur.Add(binary.BigEndian.Uint32(value[i:]))
+		}
+
+		bm := cur.Clone()
+		newShards := make(map[string]struct{}, len(curShards))
+		var written [][]byte
+		nextChunk := bitmapdb.ChunkIterator(bm, bitmapdb.ChunkLimit)
+		for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+			chunk.RunOptimize()
+			buf.Reset()
+			if _, err := chunk.WriteTo(buf); err != nil {
+				return err
+			}
+			shardKey := bitmapdb.ShardKey(k, ^uint32(0))
+			if bm.GetCardinality() > 0 { // not the last shard
+				shardKey = bitmapdb.ShardKey(k, chunk.Maximum())
+			}
+			newShards[string(shardKey)] = struct{}{}
+			written = append(written, shardKey)
+			if err := next(k, shardKey, common.CopyBytes(buf.Bytes())); err != nil {
+				return err
+			}
+		}
+		for _, shardKey := range curShards {
+			if _, ok := newShards[string(shardKey)]; ok {
+				continue
+			}
+			if err := next(k, shardKey, nil); err != nil {
+				return err
+			}
+		}
+		curShards = written
+		return nil
+	}
+}
+
 func (ig *IndexGenerator) Truncate(timestampTo uint64, changeSetBucket string) error {
 	vv, ok := changeset.Mapper[changeSetBucket]
 	if !ok {
@@ -96,51 +285,12 @@ func (ig *IndexGenerator) Truncate(timestampTo uint64, changeSetBucket string) e
 		return err
 	}
 
-	historyEffects := make(map[string][]byte)
-	keySize := vv.KeySize
-	if dbutils.StorageChangeSetBucket == changeSetBucket || dbutils.PlainStorageChangeSetBucket == changeSetBucket {
-		keySize -= 8
-	}
-
-	var startKey = make([]byte, keySize+8)
-
-	for key := range keys {
-		copy(startKey[:keySize], dbutils.CompositeKeyWithoutIncarnation([]byte(key)))
-
-		binary.BigEndian.PutUint64(startKey[keySize:], timestampTo)
-		if err := ig.db.Walk(vv.IndexBucket, startKey, 8*keySize, func(k, v []byte) (bool, error) {
-			timestamp := binary.BigEndian.Uint64(k[keySize:]) // the last timestamp in the chunk
-			kStr := string(common.CopyBytes(k))
-			if timestamp > timestampTo {
-				historyEffects[kStr] = nil
-				// truncate the chunk
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
-					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
-					lastK := make([]byte, len(k))
-					copy(lastK, k[:keySize])
-					binary.BigEndian.PutUint64(lastK[keySize:], ^uint64(0))
-					historyEffects[string(lastK)] = common.CopyBytes(index)
-				}
-			}
-			return true, nil
-		}); err != nil {
-			return err
-		}
-	}
 	mutation := ig.db.NewBatch()
 	defer mutation.Rollback()
 
-	for key, value := range historyEffects {
-		if value == nil {
-			if err := mutation.Delete(vv.IndexBucket, []byte(key)); err != nil {
-				return err
-			}
-		} else {
-			if err := mutation.Put(vv.IndexBucket, []byte(key), value); err != nil {
-				return err
-			}
+	for key := range keys {
+		if err := bitmapdb.TruncateGreater(mutation, vv.IndexBucket, dbutils.CompositeKeyWithoutIncarnation([]byte(key)), timestampTo); err != nil {
+			return err
 		}
 		if mutation.BatchSize() >= mutation.IdealBatchSize() {
 			if err := mutation.CommitAndBegin(context.Background()); err != nil {
@@ -162,46 +312,43 @@ func (ig *IndexGenerator) DropIndex(bucket string) error {
 }
 
 func loadFunc(k []byte, value []byte, state etl.CurrentTableReader, next etl.LoadNextFunc) error {
-	if len(value)%9 != 0 {
-		log.Error("Value must be a multiple of 9", "ln", len(value), "k", common.Bytes2Hex(k))
+	if len(value)%8 != 0 {
+		log.Error("Value must be a multiple of 8", "ln", len(value), "k", common.Bytes2Hex(k))
 		return errors.New("incorrect value")
 	}
-	k = common.CopyBytes(k)
-	currentChunkKey := dbutils.IndexChunkKey(k, ^uint64(0))
-	indexBytes, err1 := state.Get(currentChunkKey)
-	if err1 != nil && !errors.Is(err1, ethdb.ErrKeyNotFound) {
-		return fmt.Errorf("find chunk failed: %w", err1)
+	indexKey := dbutils.CompositeKeyWithoutIncarnation(k)
+	lastShardKey := bitmapdb.ShardKey(indexKey, ^uint32(0))
+	lastShardBytes, err := state.Get(lastShardKey)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return fmt.Errorf("find last shard failed: %w", err)
 	}
-	currentIndex := dbutils.WrapHistoryIndex(indexBytes)
-
-	for i := 0; i < len(value); i += 9 {
-		b := binary.BigEndian.Uint64(value[i:])
-		vzero := value[i+8] == 1
-		blockNr := b
-		if err1 != nil && err1 != ethdb.ErrKeyNotFound {
-			return fmt.Errorf("find chunk failed: %w", err1)
-		}
 
-		if dbutils.CheckNewIndexChunk(currentIndex, blockNr) {
-			// Chunk overflow, need to write the "old" current chunk under its key derived from the last element
-			indexKey, err3 := currentIndex.Key(k)
-			if err3 != nil {
-				return err3
-			}
-			// Flush the old chunk
-			if err4 := next(k, indexKey, currentIndex); err4 != nil {
-				return err4
-			}
-			// Start a new chunk
-			currentIndex = dbutils.NewHistoryIndex()
+	bm := roaring.New()
+	if len(lastShardBytes) > 0 {
+		if _, err = bm.FromBuffer(common.CopyBytes(lastShardBytes)); err != nil {
+			return fmt.Errorf("couldn't read last shard of %x: %w", indexKey, err)
 		}
-		currentIndex = currentIndex.Append(blockNr, vzero)
 	}
-
-	if err := next(k, currentChunkKey, currentIndex); err != nil {
-		return err
+	for i := 0; i < len(value); i += 8 {
+		bm.Add(uint32(binary.BigEndian.Uint64(value[i:])))
 	}
 
+	buf := bytes.NewBuffer(nil)
+	nextChunk := bitmapdb.ChunkIterator(bm, bitmapdb.ChunkLimit)
+	for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+		chunk.RunOptimize()
+		buf.Reset()
+		if _, err = chunk.WriteTo(buf); err != nil {
+			return err
+		}
+		shardKey := lastShardKey
+		if bm.GetCardinality() > 0 { // not the last shard
+			shardKey = bitmapdb.ShardKey(indexKey, chunk.Maximum())
+		}
+		if err = next(k, shardKey, common.CopyBytes(buf.Bytes())); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -210,11 +357,8 @@ func getExtractFunc(bytes2walker func([]byte) changeset.Walker) etl.ExtractFunc
 		blockNum, _ := dbutils.DecodeTimestamp(dbKey)
 		return bytes2walker(dbValue).Walk(func(changesetKey, changesetValue []byte) error {
 			key := common.CopyBytes(changesetKey)
-			v := make([]byte, 9)
+			v := make([]byte, 8)
 			binary.BigEndian.PutUint64(v, blockNum)
-			if len(changesetValue) == 0 {
-				v[8] = 1
-			}
 			return next(dbKey, key, v)
 		})
 	}
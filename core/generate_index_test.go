@@ -1,7 +1,9 @@
 package core
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -9,12 +11,13 @@ import (
 	"strconv"
 	"testing"
 
-	"github.com/ledgerwatch/turbo-geth/common/changeset"
-
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 )
 
@@ -38,19 +41,10 @@ func TestIndexGenerator_GenerateIndex_SimpleCase(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			checkIndex(t, db, csInfo.IndexBucket, addrs[0], 0, expecedIndexes[string(addrs[0])][0])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[0], 999, expecedIndexes[string(addrs[0])][0])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[0], 1000, expecedIndexes[string(addrs[0])][1])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[0], 1999, expecedIndexes[string(addrs[0])][1])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[0], 2000, expecedIndexes[string(addrs[0])][2])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[1], 0, expecedIndexes[string(addrs[1])][0])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[1], 2000, expecedIndexes[string(addrs[1])][1])
-			checkIndex(t, db, csInfo.IndexBucket, addrs[2], 0, expecedIndexes[string(addrs[2])][0])
-
-			//check last chunk
-			lastChunkCheck(t, db, csInfo.IndexBucket, addrs[0], expecedIndexes[string(addrs[0])][2])
-			lastChunkCheck(t, db, csInfo.IndexBucket, addrs[1], expecedIndexes[string(addrs[1])][1])
-			lastChunkCheck(t, db, csInfo.IndexBucket, addrs[2], expecedIndexes[string(addrs[2])][0])
+			for i := range addrs {
+				checkIndex(t, db, csInfo.IndexBucket, addrs[i], expecedIndexes[string(addrs[i])])
+				lastChunkCheck(t, db, csInfo.IndexBucket, addrs[i], expecedIndexes[string(addrs[i])])
+			}
 		}
 	}
 
@@ -81,81 +75,29 @@ func TestIndexGenerator_Truncate(t *testing.T) {
 			return arr[:pos]
 		}
 
-		t.Run("truncate to 2050 "+string(csbucket), func(t *testing.T) {
-			expected[string(hashes[0])][2] = reduceSlice(expected[string(hashes[0])][2], 2050)
-			expected[string(hashes[1])][1] = reduceSlice(expected[string(hashes[1])][1], 2050)
-			expected[string(hashes[2])][0] = reduceSlice(expected[string(hashes[2])][0], 2050)
-
-			err = ig.Truncate(2050, csbucket)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			checkIndex(t, db, indexBucket, hashes[0], 2030, expected[string(hashes[0])][2])
-			checkIndex(t, db, indexBucket, hashes[1], 2030, expected[string(hashes[1])][1])
-			checkIndex(t, db, indexBucket, hashes[2], 2030, expected[string(hashes[2])][0])
-			checkIndex(t, db, indexBucket, hashes[0], 1999, expected[string(hashes[0])][1])
-			checkIndex(t, db, indexBucket, hashes[1], 999, expected[string(hashes[1])][0])
-		})
-
-		t.Run("truncate to 2000 "+string(csbucket), func(t *testing.T) {
-			expected[string(hashes[0])][2] = reduceSlice(expected[string(hashes[0])][2], 2000)
-			expected[string(hashes[1])][1] = reduceSlice(expected[string(hashes[1])][1], 2000)
-			expected[string(hashes[2])][0] = reduceSlice(expected[string(hashes[2])][0], 2000)
-
-			err = ig.Truncate(2000, csbucket)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			checkIndex(t, db, indexBucket, hashes[0], 2000, expected[string(hashes[0])][2])
-			checkIndex(t, db, indexBucket, hashes[1], 2000, expected[string(hashes[1])][1])
-			checkIndex(t, db, indexBucket, hashes[2], expected[string(hashes[2])][0][len(expected[string(hashes[2])][0])-1], expected[string(hashes[2])][0])
-		})
-
-		t.Run("truncate to 1999 "+string(csbucket), func(t *testing.T) {
-			err = ig.Truncate(1999, csbucket)
-			if err != nil {
-				t.Fatal(err)
-			}
-			checkIndex(t, db, indexBucket, hashes[0], 1999, expected[string(hashes[0])][1])
-			checkIndex(t, db, indexBucket, hashes[1], 1998, expected[string(hashes[1])][0])
-			checkIndex(t, db, indexBucket, hashes[2], 1998, expected[string(hashes[2])][0])
-			_, err = db.GetIndexChunk(csbucket, hashes[0], 2000)
-			if err != ethdb.ErrKeyNotFound {
-				t.Fatal()
-			}
-			_, err = db.GetIndexChunk(csbucket, hashes[1], 2000)
-			if err != ethdb.ErrKeyNotFound {
-				t.Fatal()
-			}
-		})
-
-		t.Run("truncate to 999 "+string(csbucket), func(t *testing.T) {
-			expected[string(hashes[1])][0] = reduceSlice(expected[string(hashes[1])][0], 999)
-			expected[string(hashes[2])][0] = reduceSlice(expected[string(hashes[2])][0], 999)
-
-			err = ig.Truncate(999, csbucket)
-			if err != nil {
-				t.Fatal(err)
-			}
-			checkIndex(t, db, indexBucket, hashes[0], 999, expected[string(hashes[0])][0])
-			checkIndex(t, db, indexBucket, hashes[1], 998, expected[string(hashes[1])][0])
-			checkIndex(t, db, indexBucket, hashes[2], 999, expected[string(hashes[2])][0])
-			_, err = db.GetIndexChunk(csbucket, hashes[0], 1000)
-			if err != ethdb.ErrKeyNotFound {
-				t.Fatal()
-			}
-			_, err = db.GetIndexChunk(csbucket, hashes[1], 1000)
-			if err != ethdb.ErrKeyNotFound {
-				t.Fatal()
-			}
-		})
+		for _, timestampTo := range []uint64{2050, 2000, 1999, 999} {
+			timestampTo := timestampTo
+			t.Run(fmt.Sprintf("truncate to %d %s", timestampTo, csbucket), func(t *testing.T) {
+				for i := range hashes {
+					expected[string(hashes[i])] = reduceSlice(expected[string(hashes[i])], timestampTo)
+				}
+
+				err = ig.Truncate(timestampTo, csbucket)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := range hashes {
+					checkIndex(t, db, indexBucket, hashes[i], expected[string(hashes[i])])
+					lastChunkCheck(t, db, indexBucket, hashes[i], expected[string(hashes[i])])
+				}
+			})
+		}
 		db.Close()
 	}
 }
 
-func generateTestData(t *testing.T, db ethdb.Database, csBucket string, numOfBlocks int) ([][]byte, map[string][][]uint64) { //nolint
+func generateTestData(t *testing.T, db ethdb.Database, csBucket string, numOfBlocks int) ([][]byte, map[string][]uint64) { //nolint
 	csInfo, ok := changeset.Mapper[string(csBucket)]
 	if !ok {
 		t.Fatal("incorrect cs bucket")
@@ -182,44 +124,18 @@ func generateTestData(t *testing.T, db ethdb.Database, csBucket string, numOfBlo
 		}
 	}
 
-	expected1 := make([]dbutils.HistoryIndexBytes, 0)
-	expected1 = append(expected1, dbutils.NewHistoryIndex())
-	expected2 := make([]dbutils.HistoryIndexBytes, 0)
-	expected2 = append(expected2, dbutils.NewHistoryIndex())
-	expected3 := make([]dbutils.HistoryIndexBytes, 0)
-	expected3 = append(expected3, dbutils.NewHistoryIndex())
-
+	expected := make(map[string][]uint64, len(addrs))
 	for i := 0; i < numOfBlocks; i++ {
 		cs := csInfo.New()
-		err = cs.Add(addrs[0], []byte(strconv.Itoa(i)))
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if dbutils.CheckNewIndexChunk(expected1[len(expected1)-1], uint64(i)) {
-			expected1 = append(expected1, dbutils.NewHistoryIndex())
-		}
-		expected1[len(expected1)-1] = expected1[len(expected1)-1].Append(uint64(i), false)
-
-		if i%2 == 0 {
-			err = cs.Add(addrs[1], []byte(strconv.Itoa(i)))
-			if err != nil {
-				t.Fatal(err)
-			}
-			if dbutils.CheckNewIndexChunk(expected2[len(expected2)-1], uint64(i)) {
-				expected2 = append(expected2, dbutils.NewHistoryIndex())
+		for j, step := range []int{1, 2, 3} {
+			if i%step != 0 {
+				continue
 			}
-			expected2[len(expected2)-1] = expected2[len(expected2)-1].Append(uint64(i), false)
-		}
-		if i%3 == 0 {
-			err = cs.Add(addrs[2], []byte(strconv.Itoa(i)))
+			err = cs.Add(addrs[j], []byte(strconv.Itoa(i)))
 			if err != nil {
 				t.Fatal(err)
 			}
-			if dbutils.CheckNewIndexChunk(expected3[len(expected3)-1], uint64(i)) {
-				expected3 = append(expected3, dbutils.NewHistoryIndex())
-			}
-			expected3[len(expected3)-1] = expected3[len(expected3)-1].Append(uint64(i), false)
+			expected[string(addrs[j])] = append(expected[string(addrs[j])], uint64(i))
 		}
 		v, err := csInfo.Encode(cs)
 		if err != nil {
@@ -230,46 +146,30 @@ func generateTestData(t *testing.T, db ethdb.Database, csBucket string, numOfBlo
 			t.Fatal(err)
 		}
 	}
-	res := make([][]uint64, len(expected1))
-	for i := range expected1 {
-		res[i], _, err = expected1[i].Decode()
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-	res2 := make([][]uint64, len(expected2))
-	for i := range expected2 {
-		res2[i], _, err = expected2[i].Decode()
-		if err != nil {
-			t.Fatal(err)
-		}
-
-	}
-	res3 := make([][]uint64, len(expected3))
-	for i := range expected3 {
-		res3[i], _, err = expected3[i].Decode()
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-	return addrs, map[string][][]uint64{
-		string(addrs[0]): res,
-		string(addrs[1]): res2,
-		string(addrs[2]): res3,
-	}
+	return addrs, expected
 }
 
-func checkIndex(t *testing.T, db ethdb.Database, bucket string, addrHash []byte, chunkBlock uint64, expected []uint64) {
+// checkIndex - joins all the shards of the key and compares with expected block numbers
+func checkIndex(t *testing.T, db ethdb.Database, bucket string, key []byte, expected []uint64) {
 	t.Helper()
-	b, err := db.GetIndexChunk(bucket, addrHash, chunkBlock)
-	if err != nil {
-		t.Fatal(err, common.Bytes2Hex(addrHash), chunkBlock)
-	}
-	val, _, err := dbutils.HistoryIndexBytes(b).Decode()
-	if err != nil {
-		t.Fatal(err)
+	var val []uint64
+	if err := db.Walk(bucket, dbutils.CompositeKeyWithoutIncarnation(key), 8*len(dbutils.CompositeKeyWithoutIncarnation(key)), func(k, v []byte) (bool, error) {
+		bm := roaring.New()
+		if _, err := bm.FromBuffer(common.CopyBytes(v)); err != nil {
+			return false, err
+		}
+		if bm.IsEmpty() {
+			return false, fmt.Errorf("empty shard %x", k)
+		}
+		val = append(val, bm.ToArray()...)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err, common.Bytes2Hex(key))
 	}
 
+	if len(val) == 0 && len(expected) == 0 {
+		return
+	}
 	if !reflect.DeepEqual(val, expected) {
 		fmt.Println("get", val)
 		fmt.Println("expected", expected)
@@ -277,21 +177,28 @@ func checkIndex(t *testing.T, db ethdb.Database, bucket string, addrHash []byte,
 	}
 }
 
+// lastChunkCheck - the last shard must exist unless the index is empty and must keep the greatest block number
 func lastChunkCheck(t *testing.T, db ethdb.Database, bucket string, key []byte, expected []uint64) {
 	t.Helper()
-	v, err := db.Get(bucket, dbutils.CurrentChunkKey(key))
+	lastShardKey := bitmapdb.ShardKey(dbutils.CompositeKeyWithoutIncarnation(key), ^uint32(0))
+	v, err := db.Get(bucket, lastShardKey)
+	if len(expected) == 0 {
+		if !errors.Is(err, ethdb.ErrKeyNotFound) {
+			t.Fatal("last shard of the empty index", common.Bytes2Hex(key), err)
+		}
+		return
+	}
 	if err != nil {
-		t.Fatal(err, dbutils.CurrentChunkKey(key))
+		t.Fatal(err, common.Bytes2Hex(lastShardKey))
 	}
 
-	val, _, err := dbutils.HistoryIndexBytes(v).Decode()
-	if err != nil {
+	bm := roaring.New()
+	if _, err = bm.FromBuffer(common.CopyBytes(v)); err != nil {
 		t.Fatal(err)
 	}
-
-	if !reflect.DeepEqual(val, expected) {
-		fmt.Println(val)
-		fmt.Println(expected)
+	if uint64(bm.Maximum()) != expected[len(expected)-1] {
+		fmt.Println(bm.Maximum())
+		fmt.Println(expected[len(expected)-1])
 		t.Fatal()
 	}
 }
@@ -316,3 +223,90 @@ func generateAddrs(numOfAddrs int, isPlain bool) ([][]byte, error) {
 	}
 	return addrs, nil
 }
+
+func TestRebuildHistoryIndexRange(t *testing.T) {
+	for _, storage := range []bool{false, true} {
+		storage := storage
+		t.Run(fmt.Sprintf("storage=%t", storage), func(t *testing.T) {
+			csBucket := dbutils.PlainAccountChangeSetBucket
+			if storage {
+				csBucket = dbutils.PlainStorageChangeSetBucket
+			}
+			indexBucket := changeset.Mapper[csBucket].IndexBucket
+			db := ethdb.NewMemDatabase()
+			defer db.Close()
+			// enough blocks for several shards of the key changed in every block
+			const blocks = 5000
+			keys, expected := generateTestData(t, db, csBucket, blocks)
+			rebuild := func(from, to uint64) {
+				if err := RebuildHistoryIndexRange("logPrefix", db, true /* plain */, storage, from, to, "", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bucketHash := func() common.Hash {
+				hasher := sha256.New()
+				if err := db.Walk(indexBucket, nil, 0, func(k, v []byte) (bool, error) {
+					hasher.Write(k)
+					hasher.Write(v)
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return common.BytesToHash(hasher.Sum(nil))
+			}
+
+			rebuild(0, blocks-1)
+			for i := range keys {
+				checkIndex(t, db, indexBucket, keys[i], expected[string(keys[i])])
+				lastChunkCheck(t, db, indexBucket, keys[i], expected[string(keys[i])])
+			}
+			full := bucketHash()
+
+			// rerunning over already indexed ranges doesn't change the index
+			for _, r := range [][2]uint64{{1000, 3000}, {0, blocks - 1}, {4990, blocks - 1}, {0, 10}} {
+				rebuild(r[0], r[1])
+				if bucketHash() != full {
+					t.Fatalf("index changed after rebuilding [%d, %d]", r[0], r[1])
+				}
+			}
+
+			// entries in the range of the key without changes there are removed, the ones outside of it are kept
+			bogus := common.CopyBytes(dbutils.CompositeKeyWithoutIncarnation(keys[0]))
+			bogus[0] ^= 0xff
+			if err := bitmapdb.AppendMergeByOr(db, indexBucket, bogus, roaring.BitmapOf(10, 1500, 2999)); err != nil {
+				t.Fatal(err)
+			}
+			rebuild(1000, 3000)
+			var bogusBlocks []uint32
+			if err := db.Walk(indexBucket, bogus, 8*len(bogus), func(k, v []byte) (bool, error) {
+				bm := roaring.New()
+				if _, err := bm.FromBuffer(common.CopyBytes(v)); err != nil {
+					return false, err
+				}
+				bogusBlocks = append(bogusBlocks, bm.ToArray()...)
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bogusBlocks, []uint32{10}) {
+				t.Fatalf("stale entries of %x after rebuild: %v", bogus, bogusBlocks)
+			}
+
+			// the range in the middle is missing, e.g. changesets were imported out of band
+			if err := db.ClearBuckets(indexBucket); err != nil {
+				t.Fatal(err)
+			}
+			rebuild(0, 999)
+			rebuild(3001, blocks-1)
+			rebuild(1000, 3000)
+			for i := range keys {
+				checkIndex(t, db, indexBucket, keys[i], expected[string(keys[i])])
+				lastChunkCheck(t, db, indexBucket, keys[i], expected[string(keys[i])])
+			}
+			rebuild(1000, 3000)
+			for i := range keys {
+				checkIndex(t, db, indexBucket, keys[i], expected[string(keys[i])])
+			}
+		})
+	}
+}
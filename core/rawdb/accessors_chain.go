@@ -22,6 +22,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"math/big"
 
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -315,6 +316,60 @@ func ReadBody(db DatabaseReader, hash common.Hash, number uint64) *types.Body {
 	return body
 }
 
+// ForEachCanonicalBody calls fn for the bodies of canonical blocks [from, to], in ascending order of block numbers.
+// Blocks without body are skipped. The decompression buffer is reused between the blocks, so fn gets a freshly
+// decoded body which doesn't reference it. Stops on the first error of fn or when ctx is cancelled.
+func ForEachCanonicalBody(ctx context.Context, tx ethdb.Tx, from, to uint64, fn func(blockNum uint64, hash common.Hash, body *types.Body) error) error {
+	headers := tx.Cursor(dbutils.HeaderPrefix)
+	defer headers.Close()
+	bodies := tx.Cursor(dbutils.BlockBodyPrefix)
+	defer bodies.Close()
+
+	var buf []byte
+	var canonical []byte // canonical hash of canonicalNum, nil if there is no canonical block of the number
+	var canonicalNum uint64
+	var hasCanonical bool
+	for k, v, err := bodies.Seek(dbutils.EncodeBlockNumber(from)); k != nil; k, v, err = bodies.Next() {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		blockNum := binary.BigEndian.Uint64(k[:8])
+		if blockNum > to {
+			break
+		}
+		// bodies of all forks are in the bucket, canonical hash is read once for all of them
+		if !hasCanonical || canonicalNum != blockNum {
+			hashBytes, err := headers.SeekExact(dbutils.HeaderHashKey(blockNum))
+			if err != nil {
+				return err
+			}
+			canonical, canonicalNum, hasCanonical = common.CopyBytes(hashBytes), blockNum, true
+		}
+		if canonical == nil || !bytes.Equal(k[8:], canonical) {
+			continue
+		}
+
+		bodyRlp := v
+		if debug.IsBlockCompressionEnabled() && len(v) > 0 {
+			if buf, err = snappy.Decode(buf[:cap(buf)], v); err != nil {
+				return fmt.Errorf("decompress body of block %d: %w", blockNum, err)
+			}
+			bodyRlp = buf
+		}
+		body := new(types.Body)
+		if err = rlp.DecodeBytes(bodyRlp, body); err != nil {
+			return fmt.Errorf("invalid body RLP of block %d: %w", blockNum, err)
+		}
+		if err = fn(blockNum, common.BytesToHash(canonical), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ReadSenders(db DatabaseReader, hash common.Hash, number uint64) []common.Address {
 	data, err := db.Get(dbutils.Senders, dbutils.BlockBodyKey(number, hash))
 	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
@@ -327,6 +382,91 @@ func ReadSenders(db DatabaseReader, hash common.Hash, number uint64) []common.Ad
 	return senders
 }
 
+// senders2Stride - size of the Senders2 value: txIndex_u32 + sender
+const senders2Stride = 4 + common.AddressLength
+
+// ReadSenders2 retrieves senders of the canonical block transactions from the Senders2 bucket, in transactions order.
+// Returns nil if there are no senders of the block.
+func ReadSenders2(tx ethdb.Tx, number uint64) ([]common.Address, error) {
+	c := tx.CursorDupFixed(dbutils.Senders2)
+	defer c.Close()
+	key := dbutils.EncodeBlockNumber(number)
+	k, _, err := c.Seek(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, nil
+	}
+	var senders []common.Address
+	for v, err := c.GetMulti(); v != nil; _, v, err = c.NextMulti() {
+		if err != nil {
+			return nil, err
+		}
+		if len(v)%senders2Stride != 0 {
+			return nil, fmt.Errorf("senders2 of block %d: %d bytes are not multiple of %d", number, len(v), senders2Stride)
+		}
+		for i := 0; i < len(v); i += senders2Stride {
+			var sender common.Address
+			copy(sender[:], v[i+4:i+senders2Stride])
+			senders = append(senders, sender)
+		}
+	}
+	return senders, nil
+}
+
+// WriteSenders2 stores senders of the canonical block transactions into the Senders2 bucket
+func WriteSenders2(tx ethdb.Tx, number uint64, senders []common.Address) error {
+	if len(senders) == 0 {
+		return nil
+	}
+	page := make([]byte, len(senders)*senders2Stride)
+	for i, sender := range senders {
+		binary.BigEndian.PutUint32(page[i*senders2Stride:], uint32(i))
+		copy(page[i*senders2Stride+4:], sender[:])
+	}
+	c := tx.CursorDupFixed(dbutils.Senders2)
+	defer c.Close()
+	return c.PutMulti(dbutils.EncodeBlockNumber(number), page, senders2Stride)
+}
+
+// DeleteSenders2 removes senders of the blocks from the given one and above
+func DeleteSenders2(tx ethdb.Tx, from uint64) error {
+	c := tx.CursorDupFixed(dbutils.Senders2)
+	defer c.Close()
+	start := dbutils.EncodeBlockNumber(from)
+	for k, _, err := c.Seek(start); k != nil; k, _, err = c.Seek(start) {
+		if err != nil {
+			return err
+		}
+		if err = c.DeleteCurrentDuplicates(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSendersPreferSenders2 retrieves senders of the block transactions from the Senders2 bucket if the block is
+// canonical and its senders are there, otherwise from the Senders bucket
+func ReadSendersPreferSenders2(db DatabaseReader, hash common.Hash, number uint64) ([]common.Address, error) {
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		canonical, err := ReadCanonicalHash(db, number)
+		if err != nil {
+			return nil, err
+		}
+		if canonical == hash {
+			senders, err := ReadSenders2(hasTx.Tx(), number)
+			if err != nil {
+				return nil, err
+			}
+			if senders != nil {
+				return senders, nil
+			}
+		}
+	}
+	return ReadSenders(db, hash, number), nil
+}
+
 // WriteBody storea a block body into the database.
 func WriteBody(ctx context.Context, db DatabaseWriter, hash common.Hash, number uint64, body *types.Body) {
 	if common.IsCanceled(ctx) {
@@ -394,6 +534,94 @@ func ReadTd(db DatabaseReader, hash common.Hash, number uint64) (*big.Int, error
 	return td, nil
 }
 
+// ReadHeadersByRange reads canonical headers of blocks [from, from+count) walking HeaderPrefix with a single cursor.
+// If any of the blocks has no canonical header, returns error wrapping ethdb.ErrKeyNotFound with its number.
+func ReadHeadersByRange(tx ethdb.Tx, from, count uint64) ([]*types.Header, error) {
+	headers := make([]*types.Header, 0, count)
+	if err := walkCanonicalHeaders(tx, from, count, dbutils.IsHeaderKey, func(blockNum uint64, v []byte) error {
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(v, header); err != nil {
+			return fmt.Errorf("invalid block header RLP of block %d: %w", blockNum, err)
+		}
+		headers = append(headers, header)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// ReadTdByRange reads total difficulties of canonical blocks [from, from+count) walking HeaderPrefix with a single cursor.
+// If any of the blocks has no total difficulty, returns error wrapping ethdb.ErrKeyNotFound with its number.
+func ReadTdByRange(tx ethdb.Tx, from, count uint64) ([]*big.Int, error) {
+	tds := make([]*big.Int, 0, count)
+	if err := walkCanonicalHeaders(tx, from, count, dbutils.IsHeaderTDKey, func(blockNum uint64, v []byte) error {
+		td := new(big.Int)
+		if err := rlp.DecodeBytes(v, td); err != nil {
+			return fmt.Errorf("invalid block total difficulty RLP of block %d: %w", blockNum, err)
+		}
+		tds = append(tds, td)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return tds, nil
+}
+
+// walkCanonicalHeaders calls fn for the values of canonical blocks [from, from+count) which keys match isValueKey.
+// Records of one block number are adjacent in HeaderPrefix, but canonical hash record can be before or after
+// the header records of the block - so values of all forks are kept until the block number changes.
+func walkCanonicalHeaders(tx ethdb.Tx, from, count uint64, isValueKey func(k []byte) bool, fn func(blockNum uint64, v []byte) error) error {
+	if count == 0 {
+		return nil
+	}
+	to := from + count - 1
+	if to < from {
+		to = math.MaxUint64
+	}
+	c := tx.Cursor(dbutils.HeaderPrefix)
+	defer c.Close()
+
+	next := from
+	var canonical []byte
+	values := map[string][]byte{} // hash -> value, of block next
+	flush := func() error {
+		v, ok := values[string(canonical)]
+		if canonical == nil || !ok {
+			return fmt.Errorf("%w: canonical block %d", ethdb.ErrKeyNotFound, next)
+		}
+		if err := fn(next, v); err != nil {
+			return err
+		}
+		next++
+		canonical = nil
+		for hash := range values {
+			delete(values, hash)
+		}
+		return nil
+	}
+	for k, v, err := c.Seek(dbutils.EncodeBlockNumber(from)); ; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		// all records of block next are read
+		for k == nil || binary.BigEndian.Uint64(k[:8]) != next {
+			if err = flush(); err != nil {
+				return err
+			}
+			if next > to {
+				return nil
+			}
+		}
+		switch {
+		case dbutils.IsHeaderHashKey(k):
+			canonical = common.CopyBytes(v)
+		case isValueKey(k):
+			values[string(k[8:8+common.HashLength])] = common.CopyBytes(v)
+		}
+	}
+}
+
 // WriteTd stores the total difficulty of a block into the database.
 func WriteTd(db DatabaseWriter, hash common.Hash, number uint64, td *big.Int) error {
 	data, err := rlp.EncodeToBytes(td)
@@ -460,6 +688,27 @@ func ReadRawReceipts(db DatabaseReader, hash common.Hash, number uint64) types.R
 	return receipts
 }
 
+// ReadBlockBloom retrieves the bloom of the canonical block logs, nil if there is no bloom of the block
+func ReadBlockBloom(db DatabaseReader, number uint64) (*types.Bloom, error) {
+	data, err := db.Get(dbutils.BlockBloomPrefix, dbutils.EncodeBlockNumber(number))
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) != types.BloomByteLength {
+		return nil, fmt.Errorf("bloom of block %d: expected %d bytes, got %d", number, types.BloomByteLength, len(data))
+	}
+	bloom := types.BytesToBloom(data)
+	return &bloom, nil
+}
+
+// WriteBlockBloom stores the bloom of the canonical block logs
+func WriteBlockBloom(db DatabaseWriter, number uint64, bloom types.Bloom) error {
+	return db.Put(dbutils.BlockBloomPrefix, dbutils.EncodeBlockNumber(number), common.CopyBytes(bloom[:]))
+}
+
 // ReadReceipts retrieves all the transaction receipts belonging to a block, including
 // its correspoinding metadata fields. If it is unable to populate these metadata
 // fields then nil is returned.
@@ -507,6 +756,136 @@ func DeleteReceipts(db DatabaseDeleter, hash common.Hash, number uint64) {
 	}
 }
 
+// storedLog - log in the Logs bucket, leading zero bytes of Data (e.g. of ABI-encoded numbers) are stored as their count
+type storedLog struct {
+	Address common.Address `codec:"1"`
+	Topics  []common.Hash  `codec:"2"`
+	Zeros   uint64         `codec:"3"`
+	Data    []byte         `codec:"4"`
+}
+
+// WriteReceiptsSplit stores receipts of the canonical block without logs into the BlockReceiptsPrefix2 bucket,
+// and their logs into the Logs bucket, one record per log. Logs left from the previous write of the block are removed.
+func WriteReceiptsSplit(tx ethdb.Tx, number uint64, receipts types.Receipts) error {
+	slim := make(types.Receipts, len(receipts))
+	for i, r := range receipts {
+		withoutLogs := *r
+		withoutLogs.Logs = nil
+		slim[i] = &withoutLogs
+	}
+	v := make([]byte, 0, 1024)
+	if err := cbor.Marshal(&v, slim); err != nil {
+		return fmt.Errorf("encode receipts of block %d: %w", number, err)
+	}
+	rc := tx.Cursor(dbutils.BlockReceiptsPrefix2)
+	defer rc.Close()
+	if err := rc.Put(dbutils.EncodeBlockNumber(number), v); err != nil {
+		return err
+	}
+
+	c := tx.Cursor(dbutils.Logs)
+	defer c.Close()
+	if err := deleteLogs(c, number, number); err != nil {
+		return err
+	}
+	for txIdx, r := range receipts {
+		for logIdx, l := range r.Logs {
+			data := bytes.TrimLeft(l.Data, "\x00")
+			stored := storedLog{Address: l.Address, Topics: l.Topics, Zeros: uint64(len(l.Data) - len(data)), Data: data}
+			v = v[:0]
+			if err := cbor.Marshal(&v, &stored); err != nil {
+				return fmt.Errorf("encode log %d of tx %d of block %d: %w", logIdx, txIdx, number, err)
+			}
+			if err := c.Put(dbutils.LogKey(number, uint32(txIdx), uint32(logIdx)), common.CopyBytes(v)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadReceiptsSplit retrieves receipts of the canonical block stored by WriteReceiptsSplit, nil if there are none.
+// Logs are read only if withLogs is set, otherwise receipts have no logs - enough for gas and status.
+// Like ReadRawReceipts, it doesn't populate the derived fields.
+func ReadReceiptsSplit(tx ethdb.Tx, number uint64, withLogs bool) (types.Receipts, error) {
+	v, err := tx.GetOne(dbutils.BlockReceiptsPrefix2, dbutils.EncodeBlockNumber(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	receipts := types.Receipts{}
+	if err = cbor.Unmarshal(&receipts, common.CopyBytes(v)); err != nil {
+		return nil, fmt.Errorf("decode receipts of block %d: %w", number, err)
+	}
+	if !withLogs {
+		return receipts, nil
+	}
+
+	c := tx.Cursor(dbutils.Logs)
+	defer c.Close()
+	blockKey := dbutils.EncodeBlockNumber32(number)
+	for k, v, err := c.Seek(blockKey); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(k, blockKey) {
+			break
+		}
+		_, txIdx, logIdx, err := dbutils.ParseLogKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if int(txIdx) >= len(receipts) || int(logIdx) != len(receipts[txIdx].Logs) {
+			return nil, fmt.Errorf("log %d of tx %d of block %d doesn't match receipts", logIdx, txIdx, number)
+		}
+		var stored storedLog
+		if err = cbor.Unmarshal(&stored, common.CopyBytes(v)); err != nil {
+			return nil, fmt.Errorf("decode log %d of tx %d of block %d: %w", logIdx, txIdx, number, err)
+		}
+		data := make([]byte, stored.Zeros+uint64(len(stored.Data)))
+		copy(data[stored.Zeros:], stored.Data)
+		receipts[txIdx].Logs = append(receipts[txIdx].Logs, &types.Log{Address: stored.Address, Topics: stored.Topics, Data: data})
+	}
+	return receipts, nil
+}
+
+// DeleteReceiptsSplit removes receipts and logs of the blocks from the given one and above
+func DeleteReceiptsSplit(tx ethdb.Tx, from uint64) error {
+	c := tx.Cursor(dbutils.BlockReceiptsPrefix2)
+	defer c.Close()
+	start := dbutils.EncodeBlockNumber(from)
+	for k, _, err := c.Seek(start); k != nil; k, _, err = c.Seek(start) {
+		if err != nil {
+			return err
+		}
+		if err = c.DeleteCurrent(); err != nil {
+			return err
+		}
+	}
+	logs := tx.Cursor(dbutils.Logs)
+	defer logs.Close()
+	return deleteLogs(logs, from, math.MaxUint32)
+}
+
+// deleteLogs removes logs of the blocks [from, to] from the Logs bucket
+func deleteLogs(c ethdb.Cursor, from, to uint64) error {
+	start := dbutils.EncodeBlockNumber32(from)
+	for k, _, err := c.Seek(start); k != nil; k, _, err = c.Seek(start) {
+		if err != nil {
+			return err
+		}
+		if uint64(binary.BigEndian.Uint32(k)) > to {
+			break
+		}
+		if err = c.DeleteCurrent(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ReadBlock retrieves an entire block corresponding to the hash, assembling it
 // back from the stored header and body. If either the header or body could not
 // be retrieved nil is returned.
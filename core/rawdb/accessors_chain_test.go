@@ -20,13 +20,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/sha3"
 
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/u256"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -106,6 +109,250 @@ func TestBodyStorage(t *testing.T) {
 	}
 }
 
+// writeCanonicalBodies writes bodies of canonical blocks [0, n) with txs transactions each, and side bodies of every 3rd block
+func writeCanonicalBodies(tb testing.TB, db ethdb.Database, n, txs int) map[uint64]common.Hash {
+	canonical := map[uint64]common.Hash{}
+	for i := 0; i < n; i++ {
+		number := uint64(i)
+		body := &types.Body{}
+		for j := 0; j < txs; j++ {
+			body.Transactions = append(body.Transactions, types.NewTransaction(uint64(i*txs+j), common.Address{1}, u256.Num1, 21000, u256.Num1, nil))
+		}
+		hash := common.BytesToHash(append(dbutils.EncodeBlockNumber(number), 1))
+		WriteBody(context.Background(), db, hash, number, body)
+		if err := WriteCanonicalHash(db, hash, number); err != nil {
+			tb.Fatal(err)
+		}
+		canonical[number] = hash
+		if i%3 == 0 {
+			side := &types.Body{Uncles: []*types.Header{{Extra: []byte("side")}}}
+			WriteBody(context.Background(), db, common.BytesToHash(append(dbutils.EncodeBlockNumber(number), 2)), number, side)
+		}
+	}
+	return canonical
+}
+
+func TestForEachCanonicalBody(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	canonical := writeCanonicalBodies(t, db, 10, 2)
+	// canonical block without body is skipped
+	DeleteBody(db, canonical[7], 7)
+
+	forEach := func(ctx context.Context, from, to uint64, fn func(blockNum uint64, hash common.Hash, body *types.Body) error) error {
+		return db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+			return ForEachCanonicalBody(ctx, tx, from, to, fn)
+		})
+	}
+
+	var visited []uint64
+	if err := forEach(context.Background(), 2, 9, func(blockNum uint64, hash common.Hash, body *types.Body) error {
+		if hash != canonical[blockNum] {
+			t.Fatalf("block %d: have hash %x, want %x", blockNum, hash, canonical[blockNum])
+		}
+		if len(body.Transactions) != 2 || body.Transactions[0].Nonce() != blockNum*2 || len(body.Uncles) != 0 {
+			t.Fatalf("block %d: unexpected body %v", blockNum, body)
+		}
+		visited = append(visited, blockNum)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(visited) != fmt.Sprint([]uint64{2, 3, 4, 5, 6, 8, 9}) {
+		t.Fatalf("visited blocks %v", visited)
+	}
+
+	// error of fn stops iteration
+	visited = nil
+	stop := errors.New("stop")
+	if err := forEach(context.Background(), 0, 9, func(blockNum uint64, _ common.Hash, _ *types.Body) error {
+		visited = append(visited, blockNum)
+		if blockNum == 1 {
+			return stop
+		}
+		return nil
+	}); !errors.Is(err, stop) || len(visited) != 2 {
+		t.Fatalf("have err %v after blocks %v", err, visited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := forEach(ctx, 0, 9, func(uint64, common.Hash, *types.Body) error {
+		t.Fatal("called after cancellation")
+		return nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("have err %v, want %v", err, context.Canceled)
+	}
+}
+
+func BenchmarkForEachCanonicalBody(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	const blocks = 1000
+	writeCanonicalBodies(b, db, blocks, 10)
+
+	b.Run("ReadCanonicalHash+ReadBody", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for number := uint64(0); number < blocks; number++ {
+				hash, err := ReadCanonicalHash(db, number)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if body := ReadBody(db, hash, number); body == nil {
+					b.Fatalf("no body of block %d", number)
+				}
+			}
+		}
+	})
+	b.Run("ForEachCanonicalBody", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+				return ForEachCanonicalBody(context.Background(), tx, 0, blocks-1, func(uint64, common.Hash, *types.Body) error { return nil })
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// writeCanonicalHeaders writes canonical headers [0, n) with total difficulties, and side headers of every 3rd block
+func writeCanonicalHeaders(tb testing.TB, db ethdb.Database, n int) []common.Hash {
+	canonical := make([]common.Hash, n)
+	for i := 0; i < n; i++ {
+		for _, extra := range [][]byte{[]byte("side"), nil} {
+			if extra != nil && i%3 != 0 {
+				continue
+			}
+			header := &types.Header{Number: big.NewInt(int64(i)), Extra: extra}
+			WriteHeader(context.Background(), db, header)
+			if err := WriteTd(db, header.Hash(), uint64(i), big.NewInt(int64(i*10+len(extra)))); err != nil {
+				tb.Fatal(err)
+			}
+			canonical[i] = header.Hash()
+		}
+		if err := WriteCanonicalHash(db, canonical[i], uint64(i)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return canonical
+}
+
+func TestReadHeadersAndTdByRange(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	canonical := writeCanonicalHeaders(t, db, 10)
+
+	var headers []*types.Header
+	var tds []*big.Int
+	read := func(from, count uint64) (err error) {
+		return db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+			if headers, err = ReadHeadersByRange(tx, from, count); err != nil {
+				return err
+			}
+			tds, err = ReadTdByRange(tx, from, count)
+			return err
+		})
+	}
+
+	if err := read(2, 7); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 7 || len(tds) != 7 {
+		t.Fatalf("have %d headers and %d tds, want 7", len(headers), len(tds))
+	}
+	for i, header := range headers {
+		number := uint64(i + 2)
+		if header.Hash() != canonical[number] {
+			t.Fatalf("block %d: have header %x, want %x", number, header.Hash(), canonical[number])
+		}
+		if tds[i].Uint64() != number*10 {
+			t.Fatalf("block %d: have td %d, want %d", number, tds[i], number*10)
+		}
+	}
+	if err := read(0, 0); err != nil || len(headers) != 0 {
+		t.Fatalf("empty range: have %d headers, err %v", len(headers), err)
+	}
+
+	// range beyond the last block
+	if err := read(8, 5); !errors.Is(err, ethdb.ErrKeyNotFound) || !strings.Contains(err.Error(), "block 10") {
+		t.Fatalf("have err %v, want missing block 10", err)
+	}
+	// gaps in the middle of the range
+	if err := DeleteCanonicalHash(db, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(0, 10); !errors.Is(err, ethdb.ErrKeyNotFound) || !strings.Contains(err.Error(), "block 6") {
+		t.Fatalf("have err %v, want missing block 6", err)
+	}
+	if err := WriteCanonicalHash(db, canonical[6], 6); err != nil {
+		t.Fatal(err)
+	}
+	DeleteHeader(db, canonical[3], 3)
+	if err := read(0, 10); !errors.Is(err, ethdb.ErrKeyNotFound) || !strings.Contains(err.Error(), "block 3") {
+		t.Fatalf("have err %v, want missing block 3", err)
+	}
+}
+
+func BenchmarkReadHeadersByRange(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	const blocks = 10_000
+	writeCanonicalHeaders(b, db, blocks)
+
+	b.Run("ReadCanonicalHash+ReadHeader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for number := uint64(0); number < blocks; number++ {
+				hash, err := ReadCanonicalHash(db, number)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if header := ReadHeader(db, hash, number); header == nil {
+					b.Fatalf("no header of block %d", number)
+				}
+			}
+		}
+	})
+	b.Run("ReadHeadersByRange", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+				_, err := ReadHeadersByRange(tx, 0, blocks)
+				return err
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadCanonicalHash+ReadTd", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for number := uint64(0); number < blocks; number++ {
+				hash, err := ReadCanonicalHash(db, number)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if td, err := ReadTd(db, hash, number); err != nil || td == nil {
+					b.Fatalf("no td of block %d: %v", number, err)
+				}
+			}
+		}
+	})
+	b.Run("ReadTdByRange", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+				_, err := ReadTdByRange(tx, 0, blocks)
+				return err
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 // Tests block storage and retrieval operations.
 func TestBlockStorage(t *testing.T) {
 	db := ethdb.NewMemDatabase()
@@ -395,6 +642,97 @@ func TestBlockReceiptStorage(t *testing.T) {
 	}
 }
 
+func TestReceiptsSplitStorage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	// ABI-encoded numbers have long zero prefixes
+	zeroPrefixed := append(make([]byte, 60), 0x01, 0x02, 0x03, 0x04)
+	receipts := types.Receipts{
+		{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 1,
+			Logs: []*types.Log{
+				{Address: common.BytesToAddress([]byte{0x11}), Topics: []common.Hash{{1}, {2}}, Data: zeroPrefixed},
+				{Address: common.BytesToAddress([]byte{0x01, 0x11}), Data: make([]byte, 32)},
+				{Address: common.BytesToAddress([]byte{0x02, 0x11}), Topics: []common.Hash{{3}}, Data: []byte{0x01, 0x00}},
+			},
+		},
+		{
+			Status:            types.ReceiptStatusFailed,
+			CumulativeGasUsed: 2,
+		},
+		{
+			PostState:         common.Hash{2}.Bytes(),
+			CumulativeGasUsed: 3,
+			Logs:              []*types.Log{{Address: common.BytesToAddress([]byte{0x22})}},
+		},
+	}
+	read := func(number uint64, withLogs bool) (rs types.Receipts) {
+		if err := db.KV().View(context.Background(), func(tx ethdb.Tx) (err error) {
+			rs, err = ReadReceiptsSplit(tx, number, withLogs)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+	update := func(f func(tx ethdb.Tx) error) {
+		if err := db.KV().Update(context.Background(), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rs := read(1, true); rs != nil {
+		t.Fatalf("non existent receipts returned: %v", rs)
+	}
+	update(func(tx ethdb.Tx) error {
+		for _, number := range []uint64{1, 2} {
+			if err := WriteReceiptsSplit(tx, number, receipts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	rs := read(1, true)
+	if err := checkReceiptsRLP(rs, receipts); err != nil {
+		t.Fatal(err)
+	}
+	for i := range receipts {
+		for j, l := range receipts[i].Logs {
+			if !bytes.Equal(rs[i].Logs[j].Data, l.Data) {
+				t.Fatalf("data of log %d of receipt %d: have %x, want %x", j, i, rs[i].Logs[j].Data, l.Data)
+			}
+		}
+	}
+
+	// gas and status without logs
+	rs = read(1, false)
+	for i := range receipts {
+		if rs[i].Status != receipts[i].Status || rs[i].CumulativeGasUsed != receipts[i].CumulativeGasUsed || len(rs[i].Logs) != 0 {
+			t.Fatalf("receipt %d without logs: have %+v, want %+v", i, rs[i], receipts[i])
+		}
+	}
+
+	// rewrite with less logs doesn't leave old ones
+	update(func(tx ethdb.Tx) error { return WriteReceiptsSplit(tx, 1, receipts[1:]) })
+	if err := checkReceiptsRLP(read(1, true), receipts[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReceiptsRLP(read(2, true), receipts); err != nil {
+		t.Fatal(err)
+	}
+
+	update(func(tx ethdb.Tx) error { return DeleteReceiptsSplit(tx, 2) })
+	if rs := read(2, true); rs != nil {
+		t.Fatalf("deleted receipts returned: %v", rs)
+	}
+	if err := checkReceiptsRLP(read(1, true), receipts[1:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func checkReceiptsRLP(have, want types.Receipts) error {
 	if len(have) != len(want) {
 		return fmt.Errorf("receipts sizes mismatch: have %d, want %d", len(have), len(want))
@@ -0,0 +1,152 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+)
+
+// AccountHistoryIter iterates over the changes of one account in ascending block order.
+// Each change yields the account as it was before the block, nil if the account didn't exist.
+type AccountHistoryIter struct {
+	tx         ethdb.Tx
+	addr       []byte
+	toBlock    uint64
+	legacy     bool
+	index      ethdb.Cursor
+	changeSets ethdb.Cursor
+
+	indexK, indexV []byte // current shard (chunk) of the index, nil when the index is exhausted
+	blocks         []uint64
+	created        []bool // only the legacy index marks changes from the empty record
+	pos            int
+}
+
+// AccountHistoryIterator returns iterator over the changes of the account in blocks [fromBlock, toBlock].
+// Caller must call Close when done.
+func AccountHistoryIterator(tx ethdb.Tx, plain bool, addr []byte, fromBlock, toBlock uint64) (*AccountHistoryIter, error) {
+	if !plain {
+		return nil, errors.New("history of hashed state is not supported")
+	}
+	prunedTo, err := historyPrunedTo(tx)
+	if err != nil {
+		return nil, err
+	}
+	if fromBlock < prunedTo {
+		return nil, ErrHistoryPruned
+	}
+	hBucket, legacy := historyBucket(tx, false /* storage */)
+	it := &AccountHistoryIter{
+		tx:         tx,
+		addr:       addr,
+		toBlock:    toBlock,
+		legacy:     legacy,
+		index:      tx.Cursor(hBucket),
+		changeSets: tx.Cursor(dbutils.PlainAccountChangeSetBucket),
+	}
+
+	var seekKey []byte
+	if legacy {
+		seekKey = dbutils.IndexChunkKey(addr, fromBlock)
+	} else {
+		seekKey = bitmapdb.ShardKey(addr, uint32(fromBlock))
+	}
+	if it.indexK, it.indexV, err = it.index.Seek(seekKey); err != nil {
+		it.Close()
+		return nil, err
+	}
+	if err = it.decodeChunk(fromBlock); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// decodeChunk reads block numbers >= fromBlock from the current chunk of the index
+func (it *AccountHistoryIter) decodeChunk(fromBlock uint64) error {
+	it.blocks, it.created, it.pos = it.blocks[:0], it.created[:0], 0
+	suffixLen := 4
+	if it.legacy {
+		suffixLen = 8
+	}
+	if it.indexK == nil || len(it.indexK) != len(it.addr)+suffixLen || !bytes.HasPrefix(it.indexK, it.addr) {
+		it.indexK = nil
+		return nil
+	}
+	if it.legacy {
+		blocks, created, err := dbutils.WrapHistoryIndex(it.indexV).Decode()
+		if err != nil {
+			return err
+		}
+		for i := range blocks {
+			if blocks[i] >= fromBlock {
+				it.blocks = append(it.blocks, blocks[i])
+				it.created = append(it.created, created[i])
+			}
+		}
+		return nil
+	}
+	bm := roaring.New()
+	if _, err := bm.FromBuffer(it.indexV); err != nil {
+		return fmt.Errorf("decoding history index of %x: %w", it.addr, err)
+	}
+	if fromBlock > 0 {
+		bm.RemoveRange(0, fromBlock)
+	}
+	for _, blockNum := range bm.ToArray() {
+		it.blocks = append(it.blocks, uint64(blockNum))
+		it.created = append(it.created, false)
+	}
+	return nil
+}
+
+// Next returns the next change of the account, ok is false when there are no more changes in the range
+func (it *AccountHistoryIter) Next() (blockNum uint64, account []byte, ok bool, err error) {
+	for it.pos >= len(it.blocks) {
+		if it.indexK == nil {
+			return 0, nil, false, nil
+		}
+		if it.indexK, it.indexV, err = it.index.Next(); err != nil {
+			return 0, nil, false, err
+		}
+		if err = it.decodeChunk(0); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	blockNum, created := it.blocks[it.pos], it.created[it.pos]
+	it.pos++
+	if blockNum > it.toBlock {
+		it.indexK, it.blocks = nil, it.blocks[:0]
+		return 0, nil, false, nil
+	}
+	if created {
+		return blockNum, nil, true, nil
+	}
+
+	changeSetData, err := it.changeSets.SeekExact(dbutils.EncodeTimestamp(blockNum))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	data, err := changeset.AccountChangeSetPlainBytes(changeSetData).Find(it.addr)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("finding %x in the changeset %d: %w", it.addr, blockNum, err)
+	}
+	if len(data) == 0 {
+		return blockNum, nil, true, nil
+	}
+	if data, err = restoreCodeHash(it.tx, it.addr, data); err != nil {
+		return 0, nil, false, err
+	}
+	return blockNum, data, true, nil
+}
+
+func (it *AccountHistoryIter) Close() {
+	it.index.Close()
+	it.changeSets.Close()
+}
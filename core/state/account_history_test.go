@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountHistoryIterator(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01")
+	other := common.HexToAddress("0x02")
+	// account is created in block 1, modified in blocks 2..5 and deleted in block 6
+	writeBalanceHistory(t, db, addr, 5)
+	// history index of the neighbour key must not be visited
+	require.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.AccountsHistoryBucket, other[:], roaring.BitmapOf(1, 2, 3)))
+	lastState, err := db.Get(dbutils.PlainStateBucket, addr[:])
+	require.NoError(t, err)
+	cs := changeset.NewAccountChangeSetPlain()
+	require.NoError(t, cs.Add(addr[:], lastState))
+	v, err := changeset.EncodeAccountsPlain(cs)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(6), v))
+	require.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.AccountsHistoryBucket, addr[:], roaring.BitmapOf(6)))
+	require.NoError(t, db.Delete(dbutils.PlainStateBucket, addr[:]))
+
+	type change struct {
+		blockNum uint64
+		exists   bool
+		balance  uint64
+	}
+	collect := func(from, to uint64) []change {
+		tx, err := db.KV().Begin(context.Background(), nil, false)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		it, err := AccountHistoryIterator(tx, true /* plain */, addr[:], from, to)
+		require.NoError(t, err)
+		defer it.Close()
+		var changes []change
+		for {
+			blockNum, v, ok, err := it.Next()
+			require.NoError(t, err)
+			if !ok {
+				return changes
+			}
+			c := change{blockNum: blockNum}
+			if v != nil {
+				var acc accounts.Account
+				require.NoError(t, acc.DecodeForStorage(v))
+				c.exists, c.balance = true, acc.Balance.Uint64()
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	require.Equal(t, []change{
+		{1, false, 0},
+		{2, true, 10},
+		{3, true, 20},
+		{4, true, 30},
+		{5, true, 40},
+		{6, true, 50},
+	}, collect(0, 100))
+	require.Equal(t, []change{{3, true, 20}, {4, true, 30}}, collect(3, 4))
+	require.Nil(t, collect(7, 100))
+
+	_, err = AccountHistoryIterator(nil, false /* plain */, addr[:], 0, 100)
+	require.Error(t, err)
+}
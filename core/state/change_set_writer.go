@@ -1,8 +1,10 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/holiman/uint256"
 
@@ -14,6 +16,7 @@ import (
 )
 
 type changesetFactory func() *changeset.ChangeSet
+type encoderFactory func() changeset.Encoder
 type accountKeyGen func(common.Address) ([]byte, error)
 type storageKeyGen func(common.Address, uint64, common.Hash) ([]byte, error)
 
@@ -44,49 +47,100 @@ func plainStorageKeyGen(address common.Address, incarnation uint64, key common.H
 }
 
 // ChangeSetWriter is a mock StateWriter that accumulates changes in-memory into ChangeSets.
+//
+// The changesets of the block keep the values at the beginning of the block, and only of the entries which the block
+// really changed: the writes are compared with the originals when the changes are taken, so a storage item or an account
+// which one transaction changes and a later one reverts is not in the changesets, nor in the history index which
+// writeIndex builds from them. Storage items of the account deleted in the block compare their originals with the
+// empty value. Accounts are kept also if:
+//   - the account was created (CreateContract) or deleted in the block, even if it ends up equal to the original - its
+//     incarnation changed, and the entry with the empty value of an account created in the block is what marks the
+//     creation in the legacy history index
+//   - any storage item of the account is kept
 type ChangeSetWriter struct {
-	accountChanges map[common.Address][]byte
-	storageChanged map[common.Address]bool
-	storageChanges map[string][]byte
-	storageFactory changesetFactory
-	accountFactory changesetFactory
-	accountKeyGen  accountKeyGen
-	storageKeyGen  storageKeyGen
-	blockNumber    uint64
+	accountChanges map[common.Address]*accountChange
+	storageChanges map[string]*storageChange
+	// storageByAddress - storage changes of every account, so DeleteAccount and the accounts find theirs
+	storageByAddress map[common.Address][]*storageChange
+	storageFactory   changesetFactory
+	accountFactory   changesetFactory
+	storageEncoder   encoderFactory
+	accountEncoder   encoderFactory
+	accountKeyGen    accountKeyGen
+	storageKeyGen    storageKeyGen
+	blockNumber      uint64
+}
+
+type accountChange struct {
+	original  []byte // encoded account at the beginning of the block, empty if it didn't exist
+	changed   bool   // the last update differs from the original
+	recreated bool   // created or deleted in the block
+}
+
+type storageChange struct {
+	address  common.Address
+	original []byte // value at the beginning of the block
+	value    []byte // last written value, empty after the account was deleted
 }
 
 func NewChangeSetWriter() *ChangeSetWriter {
 	return &ChangeSetWriter{
-		accountChanges: make(map[common.Address][]byte),
-		storageChanged: make(map[common.Address]bool),
-		storageChanges: make(map[string][]byte),
-		storageFactory: changeset.NewStorageChangeSet,
-		accountFactory: changeset.NewAccountChangeSet,
-		accountKeyGen:  hashedAccountKeyGen,
-		storageKeyGen:  hashedStorageKeyGen,
+		accountChanges:   make(map[common.Address]*accountChange),
+		storageChanges:   make(map[string]*storageChange),
+		storageByAddress: make(map[common.Address][]*storageChange),
+		storageFactory:   changeset.NewStorageChangeSet,
+		accountFactory:   changeset.NewAccountChangeSet,
+		storageEncoder:   changeset.NewStorageEncoder,
+		accountEncoder:   changeset.NewAccountsEncoder,
+		accountKeyGen:    hashedAccountKeyGen,
+		storageKeyGen:    hashedStorageKeyGen,
 	}
 }
 func NewChangeSetWriterPlain(blockNumber uint64) *ChangeSetWriter {
 	return &ChangeSetWriter{
-		accountChanges: make(map[common.Address][]byte),
-		storageChanged: make(map[common.Address]bool),
-		storageChanges: make(map[string][]byte),
-		storageFactory: changeset.NewStorageChangeSetPlain,
-		accountFactory: changeset.NewAccountChangeSetPlain,
-		accountKeyGen:  plainAccountKeyGen,
-		storageKeyGen:  plainStorageKeyGen,
-		blockNumber:    blockNumber,
+		accountChanges:   make(map[common.Address]*accountChange),
+		storageChanges:   make(map[string]*storageChange),
+		storageByAddress: make(map[common.Address][]*storageChange),
+		storageFactory:   changeset.NewStorageChangeSetPlain,
+		accountFactory:   changeset.NewAccountChangeSetPlain,
+		storageEncoder:   changeset.NewStorageEncoderPlain,
+		accountEncoder:   changeset.NewAccountsEncoderPlain,
+		accountKeyGen:    plainAccountKeyGen,
+		storageKeyGen:    plainStorageKeyGen,
+		blockNumber:      blockNumber,
 	}
 }
 
+// storageChanged - the block changed some storage of the account
+func (w *ChangeSetWriter) storageChanged(address common.Address) bool {
+	for _, c := range w.storageByAddress[address] {
+		if c.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *storageChange) changed() bool {
+	return !bytes.Equal(c.original, c.value)
+}
+
+// accountChanged - the entry of the account is kept in the changeset, see ChangeSetWriter
+func (w *ChangeSetWriter) accountChanged(address common.Address, c *accountChange) bool {
+	return c.changed || c.recreated || w.storageChanged(address)
+}
+
 func (w *ChangeSetWriter) GetAccountChanges() (*changeset.ChangeSet, error) {
 	cs := w.accountFactory()
-	for address, val := range w.accountChanges {
+	for address, c := range w.accountChanges {
+		if !w.accountChanged(address, c) {
+			continue
+		}
 		key, err := w.accountKeyGen(address)
 		if err != nil {
 			return nil, err
 		}
-		if err := cs.Add(key, val); err != nil {
+		if err := cs.Add(key, c.original); err != nil {
 			return nil, err
 		}
 	}
@@ -94,14 +148,65 @@ func (w *ChangeSetWriter) GetAccountChanges() (*changeset.ChangeSet, error) {
 }
 func (w *ChangeSetWriter) GetStorageChanges() (*changeset.ChangeSet, error) {
 	cs := w.storageFactory()
-	for key, val := range w.storageChanges {
-		if err := cs.Add([]byte(key), val); err != nil {
+	for key, c := range w.storageChanges {
+		if !c.changed() {
+			continue
+		}
+		if err := cs.Add([]byte(key), c.original); err != nil {
 			return nil, err
 		}
 	}
 	return cs, nil
 }
 
+// EncodeAccountChanges - encoded GetAccountChanges, without building the ChangeSet
+func (w *ChangeSetWriter) EncodeAccountChanges() ([]byte, error) {
+	changes := make([][2][]byte, 0, len(w.accountChanges))
+	for address, c := range w.accountChanges {
+		if !w.accountChanged(address, c) {
+			continue
+		}
+		key, err := w.accountKeyGen(address)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, [2][]byte{key, c.original})
+	}
+	sort.Slice(changes, func(i, j int) bool { return bytes.Compare(changes[i][0], changes[j][0]) < 0 })
+
+	enc := w.accountEncoder()
+	for _, change := range changes {
+		if err := enc.Add(change[0], change[1]); err != nil {
+			return nil, err
+		}
+	}
+	return enc.Encode()
+}
+
+// EncodeStorageChanges - encoded GetStorageChanges, without building the ChangeSet. nil if there are no changes
+func (w *ChangeSetWriter) EncodeStorageChanges() ([]byte, error) {
+	keys := make([]string, 0, len(w.storageChanges))
+	for key, c := range w.storageChanges {
+		if c.changed() {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Strings(keys)
+
+	enc := w.storageEncoder()
+	var k []byte
+	for _, key := range keys {
+		k = append(k[:0], key...)
+		if err := enc.Add(k, w.storageChanges[key].original); err != nil {
+			return nil, err
+		}
+	}
+	return enc.Encode()
+}
+
 func accountsEqual(a1, a2 *accounts.Account) bool {
 	if a1.Nonce != a2.Nonce {
 		return false
@@ -127,11 +232,19 @@ func accountsEqual(a1, a2 *accounts.Account) bool {
 	return true
 }
 
-func (w *ChangeSetWriter) UpdateAccountData(ctx context.Context, address common.Address, original, account *accounts.Account) error {
-	if !accountsEqual(original, account) || w.storageChanged[address] {
-
-		w.accountChanges[address] = originalAccountData(original, true /*omitHashes*/)
+func (w *ChangeSetWriter) account(address common.Address) *accountChange {
+	c, ok := w.accountChanges[address]
+	if !ok {
+		c = &accountChange{}
+		w.accountChanges[address] = c
 	}
+	return c
+}
+
+func (w *ChangeSetWriter) UpdateAccountData(ctx context.Context, address common.Address, original, account *accounts.Account) error {
+	c := w.account(address)
+	c.original = originalAccountData(original, true /*omitHashes*/)
+	c.changed = !accountsEqual(original, account)
 	return nil
 }
 
@@ -140,12 +253,18 @@ func (w *ChangeSetWriter) UpdateAccountCode(address common.Address, incarnation
 }
 
 func (w *ChangeSetWriter) DeleteAccount(ctx context.Context, address common.Address, original *accounts.Account) error {
-	w.accountChanges[address] = originalAccountData(original, false)
+	c := w.account(address)
+	c.original = originalAccountData(original, false)
+	c.changed, c.recreated = true, true
+	for _, s := range w.storageByAddress[address] {
+		s.value = nil
+	}
 	return nil
 }
 
 func (w *ChangeSetWriter) WriteAccountStorage(ctx context.Context, address common.Address, incarnation uint64, key *common.Hash, original, value *uint256.Int) error {
-	if *original == *value {
+	// the write which reverts an earlier one must find its entry
+	if *original == *value && len(w.storageByAddress[address]) == 0 {
 		return nil
 	}
 
@@ -154,13 +273,22 @@ func (w *ChangeSetWriter) WriteAccountStorage(ctx context.Context, address commo
 		return err
 	}
 
-	w.storageChanges[string(compositeKey)] = original.Bytes()
-	w.storageChanged[address] = true
+	c, ok := w.storageChanges[string(compositeKey)]
+	if !ok {
+		if *original == *value {
+			return nil
+		}
+		c = &storageChange{address: address, original: original.Bytes()}
+		w.storageChanges[string(compositeKey)] = c
+		w.storageByAddress[address] = append(w.storageByAddress[address], c)
+	}
+	c.value = value.Bytes()
 
 	return nil
 }
 
 func (w *ChangeSetWriter) CreateContract(address common.Address) error {
+	w.account(address).recreated = true
 	return nil
 }
 
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func changesMap(t *testing.T, cs *changeset.ChangeSet, err error) map[string][]byte {
+	require.NoError(t, err)
+	res := make(map[string][]byte, cs.Len())
+	for _, c := range cs.Changes {
+		res[string(c.Key)] = c.Value
+	}
+	return res
+}
+
+func testAccount(balance uint64, incarnation uint64) *accounts.Account {
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Balance = *uint256.NewInt().SetUint64(balance)
+	acc.Incarnation = incarnation
+	return &acc
+}
+
+func TestChangeSetWriterRevertedInBlock(t *testing.T) {
+	ctx := context.Background()
+	contract, reverted, created := common.HexToAddress("0xc0de"), common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	key1, key2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	empty := accounts.NewAccount()
+	w := NewChangeSetWriterPlain(1)
+
+	// tx 1
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key1, uint256.NewInt().SetUint64(1), uint256.NewInt().SetUint64(5)))
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key2, uint256.NewInt(), uint256.NewInt().SetUint64(7)))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, testAccount(1, 1), testAccount(1, 1)))
+	require.NoError(t, w.UpdateAccountData(ctx, reverted, testAccount(1, 0), testAccount(2, 0)))
+	require.NoError(t, w.UpdateAccountData(ctx, created, &empty, testAccount(3, 0)))
+	// tx 2 reverts key1 and the balance of reverted
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key1, uint256.NewInt().SetUint64(1), uint256.NewInt().SetUint64(1)))
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key2, uint256.NewInt(), uint256.NewInt().SetUint64(8)))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, testAccount(1, 1), testAccount(1, 1)))
+	require.NoError(t, w.UpdateAccountData(ctx, reverted, testAccount(1, 0), testAccount(1, 0)))
+
+	storage := changesMap(t, w.GetStorageChanges())
+	require.Equal(t, map[string][]byte{
+		string(dbutils.PlainGenerateCompositeStorageKey(contract, 1, key2)): {},
+	}, storage, "key1 is reverted, key2 keeps the value at the beginning of the block")
+
+	accs := changesMap(t, w.GetAccountChanges())
+	require.Len(t, accs, 2)
+	require.Contains(t, accs, string(contract[:]), "kept while its storage is kept")
+	require.NotContains(t, accs, string(reverted[:]))
+	require.Equal(t, []byte{}, accs[string(created[:])], "empty value - the account didn't exist")
+
+	// the last storage change is reverted too
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key2, uint256.NewInt(), uint256.NewInt()))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, testAccount(1, 1), testAccount(1, 1)))
+	encoded, err := w.EncodeStorageChanges()
+	require.NoError(t, err)
+	require.Nil(t, encoded)
+	accs = changesMap(t, w.GetAccountChanges())
+	require.NotContains(t, accs, string(contract[:]))
+}
+
+func TestChangeSetWriterDeletedInBlock(t *testing.T) {
+	ctx := context.Background()
+	contract, ephemeral := common.HexToAddress("0xc0de"), common.HexToAddress("0xe0")
+	key1, key2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	empty := accounts.NewAccount()
+	w := NewChangeSetWriterPlain(1)
+
+	// contract changes key1 and sets key2, then self-destructs: key1 loses its original, key2 is empty as before
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key1, uint256.NewInt().SetUint64(1), uint256.NewInt().SetUint64(2)))
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key2, uint256.NewInt(), uint256.NewInt().SetUint64(3)))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, testAccount(1, 1), testAccount(1, 1)))
+	require.NoError(t, w.DeleteAccount(ctx, contract, testAccount(1, 1)))
+
+	// contract created and self-destructed in the block
+	require.NoError(t, w.CreateContract(ephemeral))
+	require.NoError(t, w.WriteAccountStorage(ctx, ephemeral, 1, &key1, uint256.NewInt(), uint256.NewInt().SetUint64(1)))
+	require.NoError(t, w.UpdateAccountData(ctx, ephemeral, &empty, testAccount(0, 1)))
+	require.NoError(t, w.DeleteAccount(ctx, ephemeral, &empty))
+
+	storage := changesMap(t, w.GetStorageChanges())
+	require.Equal(t, map[string][]byte{
+		string(dbutils.PlainGenerateCompositeStorageKey(contract, 1, key1)): {1},
+	}, storage)
+
+	accs := changesMap(t, w.GetAccountChanges())
+	require.Len(t, accs, 2)
+	require.NotEmpty(t, accs[string(contract[:])])
+	require.Equal(t, []byte{}, accs[string(ephemeral[:])], "created in the block, kept")
+
+	// recreated equal to the original, the incarnation is different
+	w = NewChangeSetWriterPlain(2)
+	require.NoError(t, w.DeleteAccount(ctx, contract, testAccount(1, 1)))
+	require.NoError(t, w.CreateContract(contract))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, testAccount(1, 1), testAccount(1, 2)))
+	accs = changesMap(t, w.GetAccountChanges())
+	require.Contains(t, accs, string(contract[:]))
+}
+
+func TestChangeSetWriterHistoryIndex(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+	reverted, created := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	key := common.HexToHash("0x01")
+	empty := accounts.NewAccount()
+
+	w := NewPlainStateWriter(db, nil, 1)
+	require.NoError(t, w.UpdateAccountData(ctx, reverted, testAccount(1, 0), testAccount(2, 0)))
+	require.NoError(t, w.WriteAccountStorage(ctx, reverted, 1, &key, uint256.NewInt(), uint256.NewInt().SetUint64(1)))
+	require.NoError(t, w.UpdateAccountData(ctx, reverted, testAccount(1, 0), testAccount(1, 0)))
+	require.NoError(t, w.WriteAccountStorage(ctx, reverted, 1, &key, uint256.NewInt(), uint256.NewInt()))
+	require.NoError(t, w.UpdateAccountData(ctx, created, &empty, testAccount(3, 0)))
+	require.NoError(t, w.WriteChangeSets())
+	require.NoError(t, w.WriteHistory())
+
+	tx, err := db.KV().Begin(ctx, nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	indexed := func(bucket string, key []byte) bool {
+		c := tx.Cursor(bucket)
+		defer c.Close()
+		bm, err := bitmapdb.Get(c, key, 0, 10)
+		require.NoError(t, err)
+		return bm.Contains(1)
+	}
+	// writeIndex indexes every change it gets, the creation with the empty value too
+	require.True(t, indexed(dbutils.AccountsHistoryBucket, created[:]))
+	require.False(t, indexed(dbutils.AccountsHistoryBucket, reverted[:]))
+	require.False(t, indexed(dbutils.StorageHistoryBucket, dbutils.CompositeKeyWithoutIncarnation(dbutils.PlainGenerateCompositeStorageKey(reverted, 1, key))),
+		"reverted storage is not indexed")
+
+	v, err := GetAsOf(tx, false /* storage */, created[:], 1)
+	require.NoError(t, err)
+	require.Empty(t, v, "the account didn't exist before the block")
+}
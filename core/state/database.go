@@ -36,6 +36,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/turbo/trie"
 )
@@ -235,7 +236,7 @@ type TrieDbState struct {
 	hashBuilder       *trie.HashBuilder
 	loader            *trie.SubTrieLoader
 	pw                *PreimageWriter
-	incarnationMap    map[common.Address]uint64 // Temporary map of incarnation for the cases when contracts are deleted and recreated within 1 block
+	incarnations      *IncarnationTracker // Incarnations of the deleted contracts until they are flushed to IncarnationMapBucket, see FlushIncarnations
 }
 
 func NewTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) *TrieDbState {
@@ -251,7 +252,7 @@ func NewTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) *TrieDb
 		tp:                tp,
 		pw:                &PreimageWriter{db: db, savePreimages: true},
 		hashBuilder:       trie.NewHashBuilder(false),
-		incarnationMap:    make(map[common.Address]uint64),
+		incarnations:      NewIncarnationTracker(),
 	}
 
 	tp.SetBlockNumber(blockNr)
@@ -287,14 +288,14 @@ func (tds *TrieDbState) Copy() *TrieDbState {
 	tp.SetBlockNumber(n)
 
 	cpy := TrieDbState{
-		t:              &tcopy,
-		tMu:            new(sync.Mutex),
-		db:             tds.db,
-		blockNr:        n,
-		tp:             tp,
-		pw:             &PreimageWriter{db: tds.db, savePreimages: true},
-		hashBuilder:    trie.NewHashBuilder(false),
-		incarnationMap: make(map[common.Address]uint64),
+		t:            &tcopy,
+		tMu:          new(sync.Mutex),
+		db:           tds.db,
+		blockNr:      n,
+		tp:           tp,
+		pw:           &PreimageWriter{db: tds.db, savePreimages: true},
+		hashBuilder:  trie.NewHashBuilder(false),
+		incarnations: NewIncarnationTracker(),
 	}
 
 	cpy.t.AddObserver(tp)
@@ -349,7 +350,7 @@ func (tds *TrieDbState) WithNewBuffer() *TrieDbState {
 		tp:                tds.tp,
 		pw:                tds.pw,
 		hashBuilder:       trie.NewHashBuilder(false),
-		incarnationMap:    make(map[common.Address]uint64),
+		incarnations:      tds.incarnations, // the buffers write into the same database
 	}
 	tds.tMu.Unlock()
 
@@ -952,80 +953,16 @@ func (tds *TrieDbState) deleteTimestamp(timestamp uint64) error {
 }
 
 func (tds *TrieDbState) truncateHistory(timestampTo uint64, accountMap map[string][]byte, storageMap map[string][]byte) error {
-	accountHistoryEffects := make(map[string][]byte)
-	startKey := make([]byte, common.HashLength+8)
 	for key := range accountMap {
-		copy(startKey, []byte(key))
-		binary.BigEndian.PutUint64(startKey[common.HashLength:], timestampTo)
-		if err := tds.db.Walk(dbutils.AccountsHistoryBucket, startKey, 8*common.HashLength, func(k, v []byte) (bool, error) {
-			timestamp := binary.BigEndian.Uint64(k[common.HashLength:]) // the last timestamp in the chunk
-			kStr := string(common.CopyBytes(k))
-			if timestamp > timestampTo {
-				accountHistoryEffects[kStr] = nil
-				// truncate the chunk
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
-					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
-					lastK := make([]byte, len(k))
-					copy(lastK, k[:common.HashLength])
-					binary.BigEndian.PutUint64(lastK[common.HashLength:], ^uint64(0))
-					accountHistoryEffects[string(lastK)] = common.CopyBytes(index)
-				}
-			}
-			return true, nil
-		}); err != nil {
+		if err := bitmapdb.TruncateGreater(tds.db, dbutils.AccountsHistoryBucket, []byte(key), timestampTo); err != nil {
 			return err
 		}
 	}
-	storageHistoryEffects := make(map[string][]byte)
-	startKey = make([]byte, 2*common.HashLength+8)
 	for key := range storageMap {
-		copy(startKey, []byte(key)[:common.HashLength])
-		copy(startKey[common.HashLength:], []byte(key)[common.HashLength+8:])
-		binary.BigEndian.PutUint64(startKey[2*common.HashLength:], timestampTo)
-		if err := tds.db.Walk(dbutils.StorageHistoryBucket, startKey, 8*2*common.HashLength, func(k, v []byte) (bool, error) {
-			timestamp := binary.BigEndian.Uint64(k[2*common.HashLength:]) // the last timestamp in the chunk
-			kStr := string(common.CopyBytes(k))
-			if timestamp > timestampTo {
-				storageHistoryEffects[kStr] = nil
-				index := dbutils.WrapHistoryIndex(v)
-				index = index.TruncateGreater(timestampTo)
-				if len(index) > 8 { // If the chunk is empty after truncation, it gets simply deleted
-					// Truncated chunk becomes "the last chunk" with the timestamp 0xffff....ffff
-					lastK := make([]byte, len(k))
-					copy(lastK, k[:2*common.HashLength])
-					binary.BigEndian.PutUint64(lastK[2*common.HashLength:], ^uint64(0))
-					storageHistoryEffects[string(lastK)] = common.CopyBytes(index)
-				}
-			}
-			return true, nil
-		}); err != nil {
+		if err := bitmapdb.TruncateGreater(tds.db, dbutils.StorageHistoryBucket, dbutils.CompositeKeyWithoutIncarnation([]byte(key)), timestampTo); err != nil {
 			return err
 		}
 	}
-	for key, value := range accountHistoryEffects {
-		if value == nil {
-			if err := tds.db.Delete(dbutils.AccountsHistoryBucket, []byte(key)); err != nil {
-				return err
-			}
-		} else {
-			if err := tds.db.Put(dbutils.AccountsHistoryBucket, []byte(key), value); err != nil {
-				return err
-			}
-		}
-	}
-	for key, value := range storageHistoryEffects {
-		if value == nil {
-			if err := tds.db.Delete(dbutils.StorageHistoryBucket, []byte(key)); err != nil {
-				return err
-			}
-		} else {
-			if err := tds.db.Put(dbutils.StorageHistoryBucket, []byte(key), value); err != nil {
-				return err
-			}
-		}
-	}
 	return nil
 }
 
@@ -1204,7 +1141,7 @@ func (tds *TrieDbState) ReadAccountCodeSize(address common.Address, codeHash com
 }
 
 func (tds *TrieDbState) ReadAccountIncarnation(address common.Address) (uint64, error) {
-	if inc, ok := tds.incarnationMap[address]; ok {
+	if inc, ok := tds.incarnations.Get(address); ok {
 		return inc, nil
 	}
 	if b, err := tds.db.Get(dbutils.IncarnationMapBucket, address[:]); err == nil {
@@ -1222,11 +1159,24 @@ type TrieStateWriter struct {
 	tds *TrieDbState
 }
 
+// FlushIncarnations writes the incarnations of the deleted contracts into IncarnationMapBucket, where
+// ReadAccountIncarnation finds them after the tracker is reset or the node is restarted. It must be called
+// before the database batch of the blocks is committed
+func (tds *TrieDbState) FlushIncarnations() error {
+	return tds.incarnations.FlushToDB(tds.db)
+}
+
+// EvictTries flushes the incarnations of the deleted contracts, see FlushIncarnations, and evicts the tries
+// to fit MaxTrieCacheSize
 func (tds *TrieDbState) EvictTries(print bool) {
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
 	strict := print
-	tds.incarnationMap = make(map[common.Address]uint64)
+	if err := tds.FlushIncarnations(); err != nil {
+		log.Error("Could not flush incarnations of the deleted contracts", "err", err)
+	} else {
+		tds.incarnations.Reset()
+	}
 	if print {
 		trieSize := tds.t.TrieSize()
 		fmt.Println("") // newline for better formatting
@@ -1330,7 +1280,7 @@ func (tsw *TrieStateWriter) DeleteAccount(_ context.Context, address common.Addr
 	delete(tsw.tds.currentBuffer.codeUpdates, addrHash)
 	tsw.tds.currentBuffer.deleted[addrHash] = struct{}{}
 	if original.Incarnation > 0 {
-		tsw.tds.incarnationMap[address] = original.Incarnation
+		tsw.tds.incarnations.SetIfHigher(address, original.Incarnation)
 	}
 	return nil
 }
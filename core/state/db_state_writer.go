@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"sort"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/holiman/uint256"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/turbo/trie"
 )
 
@@ -204,12 +207,7 @@ func (dsw *DbStateWriter) CreateContract(address common.Address) error {
 // WriteChangeSets causes accumulated change sets to be written into
 // the database (or batch) associated with the `dsw`
 func (dsw *DbStateWriter) WriteChangeSets() error {
-	accountChanges, err := dsw.csw.GetAccountChanges()
-	if err != nil {
-		return err
-	}
-	var accountSerialised []byte
-	accountSerialised, err = changeset.EncodeAccounts(accountChanges)
+	accountSerialised, err := dsw.csw.EncodeAccountChanges()
 	if err != nil {
 		return err
 	}
@@ -217,16 +215,11 @@ func (dsw *DbStateWriter) WriteChangeSets() error {
 	if err = dsw.db.Put(dbutils.AccountChangeSetBucket, key, accountSerialised); err != nil {
 		return err
 	}
-	storageChanges, err := dsw.csw.GetStorageChanges()
+	storageSerialized, err := dsw.csw.EncodeStorageChanges()
 	if err != nil {
 		return err
 	}
-	var storageSerialized []byte
-	if storageChanges.Len() > 0 {
-		storageSerialized, err = changeset.EncodeStorage(storageChanges)
-		if err != nil {
-			return err
-		}
+	if storageSerialized != nil {
 		if err = dsw.db.Put(dbutils.StorageChangeSetBucket, key, storageSerialized); err != nil {
 			return err
 		}
@@ -256,37 +249,26 @@ func (dsw *DbStateWriter) WriteHistory() error {
 	return nil
 }
 
+// writeIndex adds blocknum to the history index of every key changed in the block.
+// Changes are grouped by the index key first (storage keys of different incarnations share it),
+// so the last shard of each key is read once and each touched shard is written once.
 func writeIndex(blocknum uint64, changes *changeset.ChangeSet, bucket string, changeDb ethdb.GetterPutter) error {
+	keys := make([]string, 0, len(changes.Changes))
+	seen := make(map[string]struct{}, len(changes.Changes))
 	for _, change := range changes.Changes {
-		currentChunkKey := dbutils.CurrentChunkKey(change.Key)
-		indexBytes, err := changeDb.Get(bucket, currentChunkKey)
-		if err != nil && err != ethdb.ErrKeyNotFound {
-			return fmt.Errorf("find chunk failed: %w", err)
-		}
-
-		var index dbutils.HistoryIndexBytes
-		if len(indexBytes) == 0 {
-			index = dbutils.NewHistoryIndex()
-		} else if dbutils.CheckNewIndexChunk(indexBytes, blocknum) {
-			// Chunk overflow, need to write the "old" current chunk under its key derived from the last element
-			index = dbutils.WrapHistoryIndex(indexBytes)
-			indexKey, err := index.Key(change.Key)
-			if err != nil {
-				return err
-			}
-			// Flush the old chunk
-			if err := changeDb.Put(bucket, indexKey, index); err != nil {
-				return err
-			}
-			// Start a new chunk
-			index = dbutils.NewHistoryIndex()
-		} else {
-			index = dbutils.WrapHistoryIndex(indexBytes)
+		k := string(dbutils.CompositeKeyWithoutIncarnation(change.Key))
+		if _, ok := seen[k]; ok {
+			continue
 		}
-		index = index.Append(blocknum, len(change.Value) == 0)
+		seen[k] = struct{}{}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-		if err := changeDb.Put(bucket, currentChunkKey, index); err != nil {
-			return err
+	delta := roaring.BitmapOf(uint32(blocknum))
+	for _, k := range keys {
+		if err := bitmapdb.AppendMergeByOr(changeDb, bucket, []byte(k), delta); err != nil {
+			return fmt.Errorf("appending %x to history index: %w", k, err)
 		}
 	}
 
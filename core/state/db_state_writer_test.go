@@ -0,0 +1,98 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+type countingGetterPutter struct {
+	ethdb.Database
+	gets, puts int
+}
+
+func (c *countingGetterPutter) Get(bucket string, key []byte) ([]byte, error) {
+	c.gets++
+	return c.Database.Get(bucket, key)
+}
+
+func (c *countingGetterPutter) Put(bucket string, key, value []byte) error {
+	c.puts++
+	return c.Database.Put(bucket, key, value)
+}
+
+func TestWriteIndexOverflowInTheMiddleOfBlock(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addrHash := common.HexToHash("0xaa")
+	keyHashes := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03")}
+
+	// sparse values don't compress, so the shards fill up quickly
+	expected := make(map[string]*roaring.Bitmap)
+	var shardsBefore, shardsAfter int
+	overflowed := false
+	for blockNum := uint64(2); blockNum < 8000 && !overflowed; blockNum += 2 {
+		cs := changeset.NewStorageChangeSet()
+		for _, keyHash := range keyHashes {
+			// storage of two incarnations of the contract shares the index key
+			for _, incarnation := range []uint64{1, 2} {
+				require.NoError(t, cs.Add(dbutils.GenerateCompositeStorageKey(addrHash, incarnation, keyHash), []byte{1}))
+			}
+		}
+		shardsBefore = countShards(t, db, keyHashes[1], addrHash)
+		counting := &countingGetterPutter{Database: db}
+		require.NoError(t, writeIndex(blockNum, cs, dbutils.StorageHistoryBucket, counting))
+		shardsAfter = countShards(t, db, keyHashes[1], addrHash)
+		overflowed = shardsBefore > 0 && shardsAfter > shardsBefore
+
+		require.Equal(t, len(keyHashes), counting.gets)
+		if overflowed {
+			require.Equal(t, len(keyHashes)*2, counting.puts)
+		} else {
+			require.Equal(t, len(keyHashes), counting.puts)
+		}
+		for _, keyHash := range keyHashes {
+			k := string(dbutils.CompositeKeyWithoutIncarnation(dbutils.GenerateCompositeStorageKey(addrHash, 0, keyHash)))
+			if expected[k] == nil {
+				expected[k] = roaring.New()
+			}
+			expected[k].Add(uint32(blockNum))
+		}
+	}
+	require.True(t, overflowed)
+	require.Equal(t, 1, shardsBefore)
+	require.Equal(t, 2, shardsAfter)
+
+	for k, bm := range expected {
+		key := []byte(k)
+		fromShards := roaring.New()
+		var lastShardKey []byte
+		require.NoError(t, db.Walk(dbutils.StorageHistoryBucket, key, 8*len(key), func(shardKey, v []byte) (bool, error) {
+			shard := roaring.New()
+			_, err := shard.FromBuffer(common.CopyBytes(v))
+			require.NoError(t, err)
+			require.True(t, uint64(shard.GetSerializedSizeInBytes()) < bitmapdb.ChunkLimit+256)
+			fromShards.Or(shard)
+			lastShardKey = common.CopyBytes(shardKey)
+			return true, nil
+		}))
+		require.Equal(t, bitmapdb.ShardKey(key, ^uint32(0)), lastShardKey)
+		require.Equal(t, bm.ToArray(), fromShards.ToArray())
+	}
+}
+
+func countShards(t *testing.T, db ethdb.Database, keyHash, addrHash common.Hash) int {
+	key := dbutils.CompositeKeyWithoutIncarnation(dbutils.GenerateCompositeStorageKey(addrHash, 0, keyHash))
+	n := 0
+	require.NoError(t, db.Walk(dbutils.StorageHistoryBucket, key, 8*len(key), func(k, _ []byte) (bool, error) {
+		n++
+		return true, nil
+	}))
+	return n
+}
@@ -19,6 +19,7 @@ package state
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -281,3 +282,119 @@ func (d *Dumper) DefaultRawDump() Dump {
 func (d *Dumper) DefaultDump() []byte {
 	return d.Dump(false, false, false)
 }
+
+// ErrDumpStorageLimit is returned by DumpStateAsOf when the storage of one account doesn't fit into the page
+var ErrDumpStorageLimit = errors.New("storage of the account exceeds the limit of the dump")
+
+// StateDump is a page of the state as of a block, see DumpStateAsOf
+type StateDump struct {
+	Accounts []DumpAccount // in order of the keys, Address is set in the plain state and SecureKey in the hashed one
+	Next     []byte        // key of the account to continue from, nil after the last account
+}
+
+// DumpStateAsOf returns the accounts, and the storage of the contracts, as of the timestamp - the state before the block
+// with this number, same as GetAsOf. The page starts from startKey and ends after maxResults accounts, or before the
+// account whose storage would exceed maxStorage items in total (0 - no limit). ErrDumpStorageLimit is returned if the
+// first account of the page doesn't fit. Code of the contracts is included only if withCode is set, because of its
+// size. Roots of the accounts are the storage roots, the state root is not known for the history. Without plain the
+// hashed state and its history are dumped, keys of the accounts are the hashes of the addresses
+func DumpStateAsOf(tx ethdb.Tx, plain bool, timestamp uint64, startKey []byte, maxResults int, maxStorage int, withCode bool) (*StateDump, error) {
+	stateBucket, codeBucket, keyLen := dbutils.CurrentStateBucket, dbutils.ContractCodeBucket, common.HashLength
+	if plain {
+		stateBucket, codeBucket, keyLen = dbutils.PlainStateBucket, dbutils.PlainContractCodeBucket, common.AddressLength
+	}
+
+	type keyedAccount struct {
+		key []byte
+		acc accounts.Account
+	}
+	var accs []keyedAccount
+	res := &StateDump{}
+	if err := WalkAsOf(tx, stateBucket, dbutils.AccountsHistoryBucket, startKey, 0, timestamp, func(k, v []byte) (bool, error) {
+		if len(k) != keyLen {
+			return true, nil
+		}
+		if maxResults > 0 && len(accs) >= maxResults {
+			res.Next = common.CopyBytes(k)
+			return false, nil
+		}
+		a := keyedAccount{key: common.CopyBytes(k)}
+		if err := a.acc.DecodeForStorage(v); err != nil {
+			return false, fmt.Errorf("decoding %x for %x: %w", v, k, err)
+		}
+		accs = append(accs, a)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	storageItems := 0
+	for i, a := range accs {
+		account := DumpAccount{
+			Balance:  a.acc.Balance.ToBig().String(),
+			Nonce:    a.acc.Nonce,
+			Root:     fmt.Sprintf("%x", trie.EmptyRoot),
+			CodeHash: fmt.Sprintf("%x", emptyCodeHash),
+		}
+		if plain {
+			addr := common.BytesToAddress(a.key)
+			account.Address = &addr
+		} else {
+			account.SecureKey = a.key
+		}
+
+		if a.acc.Incarnation > 0 {
+			var prefix []byte
+			if plain {
+				prefix = dbutils.PlainGenerateStoragePrefix(a.key, a.acc.Incarnation)
+			} else {
+				prefix = dbutils.GenerateStoragePrefix(a.key, a.acc.Incarnation)
+			}
+			codeHash, err := tx.GetOne(codeBucket, prefix)
+			if err != nil {
+				return nil, fmt.Errorf("getting code hash for %x: %w", a.key, err)
+			}
+			if len(codeHash) > 0 {
+				account.CodeHash = fmt.Sprintf("%x", codeHash)
+				if withCode && !bytes.Equal(codeHash, emptyCodeHash) {
+					code, err := tx.GetOne(dbutils.CodeBucket, codeHash)
+					if err != nil {
+						return nil, fmt.Errorf("getting code for %x: %w", a.key, err)
+					}
+					account.Code = fmt.Sprintf("%x", code)
+				}
+			}
+
+			account.Storage = make(map[string]string)
+			t := trie.New(common.Hash{})
+			exceeded := false
+			if err = WalkAsOf(tx, stateBucket, dbutils.StorageHistoryBucket, prefix, 8*len(prefix), timestamp, func(ks, vs []byte) (bool, error) {
+				if maxStorage > 0 && storageItems+len(account.Storage) >= maxStorage {
+					exceeded = true
+					return false, nil
+				}
+				location := common.BytesToHash(ks[keyLen:])
+				account.Storage[location.String()] = fmt.Sprintf("%x", vs)
+				h := location
+				if plain {
+					h = crypto.Keccak256Hash(location[:])
+				}
+				t.Update(h[:], common.CopyBytes(vs))
+				return true, nil
+			}); err != nil {
+				return nil, fmt.Errorf("walking over storage for %x: %w", a.key, err)
+			}
+			if exceeded {
+				if i == 0 {
+					return nil, fmt.Errorf("%w: %x, limit %d", ErrDumpStorageLimit, a.key, maxStorage)
+				}
+				res.Next = a.key
+				break
+			}
+			storageItems += len(account.Storage)
+			account.Root = fmt.Sprintf("%x", t.Hash())
+		}
+		res.Accounts = append(res.Accounts, account)
+	}
+	return res, nil
+}
@@ -0,0 +1,157 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDumpTestState - accounts 0x01..0x0a with balances 1..10 are created in block 1, 0x09 and 0x0a are contracts
+// with two storage items. Block 2 changes the balance of 0x03 and the storage of 0x09, block 3 deletes 0x05
+func writeDumpTestState(t *testing.T, db ethdb.Database) (code []byte) {
+	ctx := context.Background()
+	code = []byte{0x60, 0x00}
+	codeHash := crypto.Keccak256Hash(code)
+	key1, key2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	newAccount := func(balance uint64, incarnation uint64) *accounts.Account {
+		acc := accounts.NewAccount()
+		acc.Initialised = true
+		acc.Balance = *uint256.NewInt().SetUint64(balance)
+		acc.Incarnation = incarnation
+		if incarnation > 0 {
+			acc.CodeHash = codeHash
+		}
+		return &acc
+	}
+	empty := accounts.NewAccount()
+	commit := func(w *PlainStateWriter) {
+		require.NoError(t, w.WriteChangeSets())
+		require.NoError(t, w.WriteHistory())
+	}
+
+	w := NewPlainStateWriter(db, nil, 1)
+	for i := uint64(1); i <= 10; i++ {
+		addr := common.BytesToAddress([]byte{byte(i)})
+		if i < 9 {
+			require.NoError(t, w.UpdateAccountData(ctx, addr, &empty, newAccount(i, 0)))
+			continue
+		}
+		require.NoError(t, w.CreateContract(addr))
+		require.NoError(t, w.UpdateAccountCode(addr, 1, codeHash, code))
+		require.NoError(t, w.WriteAccountStorage(ctx, addr, 1, &key1, uint256.NewInt(), uint256.NewInt().SetUint64(1)))
+		require.NoError(t, w.WriteAccountStorage(ctx, addr, 1, &key2, uint256.NewInt(), uint256.NewInt().SetUint64(2)))
+		require.NoError(t, w.UpdateAccountData(ctx, addr, &empty, newAccount(i, 1)))
+	}
+	commit(w)
+
+	w = NewPlainStateWriter(db, nil, 2)
+	require.NoError(t, w.UpdateAccountData(ctx, common.BytesToAddress([]byte{3}), newAccount(3, 0), newAccount(100, 0)))
+	contract := common.BytesToAddress([]byte{9})
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key1, uint256.NewInt().SetUint64(1), uint256.NewInt().SetUint64(3)))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, newAccount(9, 1), newAccount(9, 1)))
+	commit(w)
+
+	w = NewPlainStateWriter(db, nil, 3)
+	require.NoError(t, w.DeleteAccount(ctx, common.BytesToAddress([]byte{5}), newAccount(5, 0)))
+	commit(w)
+	return code
+}
+
+func dumpBalances(dump *StateDump) map[common.Address]string {
+	res := make(map[common.Address]string, len(dump.Accounts))
+	for _, acc := range dump.Accounts {
+		res[*acc.Address] = acc.Balance
+	}
+	return res
+}
+
+func TestDumpStateAsOf(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	code := writeDumpTestState(t, db)
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	expected := make(map[common.Address]string, 10)
+	for i := 1; i <= 10; i++ {
+		expected[common.BytesToAddress([]byte{byte(i)})] = fmt.Sprintf("%d", i)
+	}
+
+	// state after block 1
+	dump, err := DumpStateAsOf(tx, true /* plain */, 2, nil, 0, 0, false)
+	require.NoError(t, err)
+	require.Nil(t, dump.Next)
+	require.Equal(t, expected, dumpBalances(dump))
+	contract := dump.Accounts[8]
+	require.Equal(t, common.BytesToAddress([]byte{9}), *contract.Address)
+	require.Equal(t, map[string]string{
+		common.HexToHash("0x01").String(): "01",
+		common.HexToHash("0x02").String(): "02",
+	}, contract.Storage)
+	require.Equal(t, fmt.Sprintf("%x", crypto.Keccak256(code)), contract.CodeHash)
+	require.Empty(t, contract.Code, "code is not included by default")
+
+	// state after block 2
+	expected[common.BytesToAddress([]byte{3})] = "100"
+	dump, err = DumpStateAsOf(tx, true /* plain */, 3, nil, 0, 0, true)
+	require.NoError(t, err)
+	require.Equal(t, expected, dumpBalances(dump))
+	require.Equal(t, "03", dump.Accounts[8].Storage[common.HexToHash("0x01").String()])
+	require.NotEqual(t, contract.Root, dump.Accounts[8].Root)
+	require.Equal(t, contract.Root, dump.Accounts[9].Root, "same storage as 0x09 had")
+	require.Equal(t, fmt.Sprintf("%x", code), dump.Accounts[9].Code)
+
+	// the account deleted in block 3 is not in the state after it
+	delete(expected, common.BytesToAddress([]byte{5}))
+	dump, err = DumpStateAsOf(tx, true /* plain */, 4, nil, 0, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, expected, dumpBalances(dump))
+
+	// pages
+	var pages []map[common.Address]string
+	var next []byte
+	for {
+		dump, err = DumpStateAsOf(tx, true /* plain */, 4, next, 4, 0, false)
+		require.NoError(t, err)
+		pages = append(pages, dumpBalances(dump))
+		if next = dump.Next; next == nil {
+			break
+		}
+	}
+	require.Len(t, pages, 3)
+	require.Len(t, pages[0], 4)
+	all := make(map[common.Address]string)
+	for _, page := range pages {
+		for addr, balance := range page {
+			all[addr] = balance
+		}
+	}
+	require.Equal(t, expected, all)
+}
+
+func TestDumpStateAsOfStorageLimit(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	writeDumpTestState(t, db)
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	// 0x09 fits, 0x0a starts the next page
+	dump, err := DumpStateAsOf(tx, true /* plain */, 4, nil, 0, 3, false)
+	require.NoError(t, err)
+	require.Len(t, dump.Accounts, 8)
+	require.Equal(t, common.BytesToAddress([]byte{10}).Bytes(), dump.Next)
+
+	_, err = DumpStateAsOf(tx, true /* plain */, 4, dump.Next, 0, 1, false)
+	require.True(t, errors.Is(err, ErrDumpStorageLimit))
+}
@@ -2,22 +2,36 @@ package state
 
 import (
 	"bytes"
+	"container/heap"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"sort"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 )
 
 //MaxChangesetsSearch -
 const MaxChangesetsSearch = 256
 
+var (
+	// ErrNotInHistory - the key didn't change since the timestamp, so its value is the current one (or it never existed).
+	// It wraps ethdb.ErrKeyNotFound, so the callers checking for the missing key don't need to know about history.
+	ErrNotInHistory = fmt.Errorf("not in history: %w", ethdb.ErrKeyNotFound)
+	// ErrHistoryBehindExecution - the key might have changed in the executed blocks which are not indexed yet
+	ErrHistoryBehindExecution = errors.New("history index is behind execution")
+)
+
+// GetAsOf returns the value of the key as of the timestamp. Apart from errors of the database it returns
+// ErrNotInHistory if the key didn't exist, ErrHistoryPruned or ErrHistoryBehindExecution if the node doesn't have the data.
 func GetAsOf(tx ethdb.Tx, storage bool, key []byte, timestamp uint64) ([]byte, error) {
 	var dat []byte
 	v, err := FindByHistory(tx, storage, key, timestamp)
@@ -26,7 +40,7 @@ func GetAsOf(tx ethdb.Tx, storage bool, key []byte, timestamp uint64) ([]byte, e
 		copy(dat, v)
 		return dat, nil
 	}
-	if !errors.Is(err, ethdb.ErrKeyNotFound) {
+	if !errors.Is(err, ErrNotInHistory) {
 		return nil, err
 	}
 	v, err = tx.GetOne(dbutils.PlainStateBucket, key)
@@ -34,102 +48,299 @@ func GetAsOf(tx ethdb.Tx, storage bool, key []byte, timestamp uint64) ([]byte, e
 		return nil, err
 	}
 	if v == nil {
-		return nil, ethdb.ErrKeyNotFound
+		return nil, ErrNotInHistory
 	}
 	dat = make([]byte, len(v))
 	copy(dat, v)
 	return dat, nil
 }
 
+// GetMultiAsOf - batch version of GetAsOf for many keys at the same timestamp. Keys are looked up in sorted order
+// within one transaction, reusing cursors over the history buckets. Results are returned in the order of keys,
+// keys which are neither in the history nor in the current state get nil entries.
+func GetMultiAsOf(db ethdb.KV, plain bool, storage bool, keys [][]byte, timestamp uint64) ([][]byte, error) {
+	if !plain {
+		return nil, errors.New("history of hashed state is not supported")
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	results := make([][]byte, len(keys))
+	if err := db.View(context.Background(), func(tx ethdb.Tx) error {
+		hc, err := newHistoryCursors(tx, storage)
+		if err != nil {
+			return err
+		}
+		defer hc.Close()
+		for _, i := range order {
+			v, err := findByHistory(tx, hc, keys[i], timestamp)
+			if err == nil {
+				results[i] = common.CopyBytes(v)
+				continue
+			}
+			if !errors.Is(err, ErrNotInHistory) {
+				return err
+			}
+			v, err = tx.GetOne(dbutils.PlainStateBucket, keys[i])
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				results[i] = common.CopyBytes(v)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// FindByHistory returns the value of the key before its first change at or after the timestamp.
+// ErrNotInHistory means the key didn't change since the timestamp.
 func FindByHistory(tx ethdb.Tx, storage bool, key []byte, timestamp uint64) ([]byte, error) {
-	var hBucket string
+	hc, err := newHistoryCursors(tx, storage)
+	if err != nil {
+		return nil, err
+	}
+	defer hc.Close()
+	return findByHistory(tx, hc, key, timestamp)
+}
+
+// historyCursors - cursors over the history index and changesets of accounts or storage
+type historyCursors struct {
+	storage    bool
+	legacy     bool
+	prunedTo   uint64
+	indexedTo  uint64
+	executedTo uint64
+	index      ethdb.Cursor
+	changeSets ethdb.Cursor
+}
+
+func newHistoryCursors(tx ethdb.Tx, storage bool) (*historyCursors, error) {
+	prunedTo, err := historyPrunedTo(tx)
+	if err != nil {
+		return nil, err
+	}
+	stage := stages.AccountHistoryIndex
 	if storage {
-		hBucket = dbutils.StorageHistoryBucket
-	} else {
-		hBucket = dbutils.AccountsHistoryBucket
+		stage = stages.StorageHistoryIndex
 	}
-	c := tx.Cursor(hBucket)
-	defer c.Close()
-	k, v, seekErr := c.Seek(dbutils.IndexChunkKey(key, timestamp))
-	if seekErr != nil {
-		return nil, seekErr
+	indexedTo, executedTo, err := getIndexGenerationProgress(tx, stage)
+	if err != nil {
+		return nil, err
 	}
-	if k == nil {
-		return nil, ethdb.ErrKeyNotFound
+	hBucket, legacy := historyBucket(tx, storage)
+	return &historyCursors{
+		storage:    storage,
+		legacy:     legacy,
+		prunedTo:   prunedTo,
+		indexedTo:  indexedTo,
+		executedTo: executedTo,
+		index:      tx.Cursor(hBucket),
+		changeSets: tx.Cursor(dbutils.ChangeSetByIndexBucket(storage)),
+	}, nil
+}
+
+func (hc *historyCursors) Close() {
+	hc.index.Close()
+	hc.changeSets.Close()
+}
+
+// notInHistory - error for the key which has no changes at or after the timestamp in the index
+func (hc *historyCursors) notInHistory(timestamp uint64) error {
+	if hc.executedTo > hc.indexedTo && timestamp <= hc.executedTo {
+		return ErrHistoryBehindExecution
 	}
-	if storage {
-		if !bytes.Equal(k[:common.AddressLength], key[:common.AddressLength]) ||
-			!bytes.Equal(k[common.AddressLength:common.AddressLength+common.HashLength], key[common.AddressLength+common.IncarnationLength:]) {
-			return nil, ethdb.ErrKeyNotFound
+	return ErrNotInHistory
+}
+
+func findByHistory(tx ethdb.Tx, hc *historyCursors, key []byte, timestamp uint64) ([]byte, error) {
+	if timestamp < hc.prunedTo {
+		return nil, ErrHistoryPruned
+	}
+	storage := hc.storage
+	var changeSetBlock uint64
+	if hc.legacy {
+		var set, ok bool
+		var err error
+		changeSetBlock, set, ok, err = findInLegacyIndex(hc.index, storage, key, timestamp)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		if !bytes.HasPrefix(k, key) {
-			return nil, ethdb.ErrKeyNotFound
+		if !ok {
+			return nil, hc.notInHistory(timestamp)
 		}
-	}
-	index := dbutils.WrapHistoryIndex(v)
-
-	changeSetBlock, set, ok := index.Search(timestamp)
-	var data []byte
-	if ok {
 		// set == true if this change was from empty record (non-existent account) to non-empty
 		// In such case, we do not need to examine changeSet and return empty data
 		if set && !storage {
 			return []byte{}, nil
 		}
-		csBucket := dbutils.ChangeSetByIndexBucket(storage)
-		csKey := dbutils.EncodeTimestamp(changeSetBlock)
-		changeSetData, err := tx.GetOne(csBucket, csKey)
+	} else {
+		var ok bool
+		var err error
+		changeSetBlock, ok, err = findInIndex(hc.index, storage, key, timestamp)
 		if err != nil {
 			return nil, err
 		}
-
-		if storage {
-			data, err = changeset.StorageChangeSetPlainBytes(changeSetData).FindWithIncarnation(key)
-		} else {
-			data, err = changeset.AccountChangeSetPlainBytes(changeSetData).Find(key)
-		}
-		if err != nil {
-			if !errors.Is(err, changeset.ErrNotFound) {
-				return nil, fmt.Errorf("finding %x in the changeset %d: %w", key, changeSetBlock, err)
-			}
-			return nil, ethdb.ErrKeyNotFound
+		if !ok {
+			return nil, hc.notInHistory(timestamp)
 		}
+	}
+
+	changeSetData, err := hc.changeSets.SeekExact(dbutils.EncodeTimestamp(changeSetBlock))
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if storage {
+		data, err = changeset.StorageChangeSetPlainBytes(changeSetData).FindWithIncarnation(key)
 	} else {
-		//fmt.Printf("Not Found changeSetBlock in [%s]\n", index)
-		return nil, ethdb.ErrKeyNotFound
+		data, err = changeset.AccountChangeSetPlainBytes(changeSetData).Find(key)
+	}
+	if err != nil {
+		if !errors.Is(err, changeset.ErrNotFound) {
+			return nil, fmt.Errorf("finding %x in the changeset %d: %w", key, changeSetBlock, err)
+		}
+		return nil, ErrNotInHistory
 	}
 
-	//restore codehash
 	if !storage {
-		var acc accounts.Account
-		if err := acc.DecodeForStorage(data); err != nil {
+		return restoreCodeHash(tx, key, data)
+	}
+	return data, nil
+}
+
+// restoreCodeHash - account changesets don't keep code hashes of contracts, they are taken from PlainContractCodeBucket
+func restoreCodeHash(tx ethdb.Tx, key []byte, data []byte) ([]byte, error) {
+	var acc accounts.Account
+	if err := acc.DecodeForStorage(data); err != nil {
+		return nil, err
+	}
+	if acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
+		codeHash, err := tx.GetOne(dbutils.PlainContractCodeBucket, dbutils.PlainGenerateStoragePrefix(key, acc.Incarnation))
+		if err != nil {
 			return nil, err
 		}
-		if acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
-			var codeHash []byte
-			var err error
-			codeHash, err = tx.GetOne(dbutils.PlainContractCodeBucket, dbutils.PlainGenerateStoragePrefix(key, acc.Incarnation))
-			if err != nil {
-				return nil, err
-			}
-			if len(codeHash) > 0 {
-				acc.CodeHash = common.BytesToHash(codeHash)
-			}
-			data = make([]byte, acc.EncodingLengthForStorage())
-			acc.EncodeForStorage(data)
+		if len(codeHash) > 0 {
+			acc.CodeHash = common.BytesToHash(codeHash)
 		}
-		return data, nil
+		data = make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(data)
 	}
-
 	return data, nil
 }
 
+// GetCodeAsOf returns the code of the contract as of the timestamp, nil if the account didn't exist or had no code.
+// Incarnation and code hash come from the history of the account, so the code of self-destructed
+// and recreated contracts is resolved for the incarnation alive at that time.
+func GetCodeAsOf(tx ethdb.Tx, plain bool, addr []byte, timestamp uint64) ([]byte, error) {
+	if !plain {
+		return nil, errors.New("history of hashed state is not supported")
+	}
+	accData, err := GetAsOf(tx, false /* storage */, addr, timestamp)
+	if err != nil {
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(accData) == 0 {
+		return nil, nil
+	}
+	if accData, err = restoreCodeHash(tx, addr, accData); err != nil {
+		return nil, err
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(accData); err != nil {
+		return nil, err
+	}
+	if acc.IsEmptyCodeHash() {
+		return nil, nil
+	}
+	code, err := tx.GetOne(dbutils.CodeBucket, acc.CodeHash[:])
+	if err != nil {
+		return nil, err
+	}
+	return common.CopyBytes(code), nil
+}
+
+// historyBucket returns the bucket with history index. Databases which were not migrated yet
+// still have the legacy chunked index, it's used until the migration drops it.
+func historyBucket(tx ethdb.Tx, storage bool) (string, bool) {
+	bucket, legacyBucket := dbutils.AccountsHistoryBucket, dbutils.AccountsHistoryBucketOld1
+	if storage {
+		bucket, legacyBucket = dbutils.StorageHistoryBucket, dbutils.StorageHistoryBucketOld1
+	}
+	if migrator, ok := tx.(ethdb.BucketMigrator); ok && migrator.ExistsBucket(legacyBucket) {
+		return legacyBucket, true
+	}
+	return bucket, false
+}
+
+// findInIndex returns the first block >= timestamp where the key was changed.
+// Seek by shard number lands on the only shard which can contain such block.
+func findInIndex(c ethdb.Cursor, storage bool, key []byte, timestamp uint64) (uint64, bool, error) {
+	indexKey := key
+	if storage {
+		indexKey = dbutils.CompositeKeyWithoutIncarnation(key)
+	}
+	k, v, err := c.Seek(bitmapdb.ShardKey(indexKey, uint32(timestamp)))
+	if err != nil {
+		return 0, false, err
+	}
+	if k == nil || len(k) != len(indexKey)+4 || !bytes.HasPrefix(k, indexKey) {
+		return 0, false, nil
+	}
+	bm := roaring.New()
+	if _, err = bm.FromBuffer(v); err != nil {
+		return 0, false, fmt.Errorf("decoding history index of %x: %w", indexKey, err)
+	}
+	changeSetBlock, ok := bitmapdb.SeekInBitmap(bm, timestamp)
+	return changeSetBlock, ok, nil
+}
+
+func findInLegacyIndex(c ethdb.Cursor, storage bool, key []byte, timestamp uint64) (uint64, bool, bool, error) {
+	k, v, seekErr := c.Seek(dbutils.IndexChunkKey(key, timestamp))
+	if seekErr != nil {
+		return 0, false, false, seekErr
+	}
+	if k == nil {
+		return 0, false, false, nil
+	}
+	if storage {
+		if !bytes.Equal(k[:common.AddressLength], key[:common.AddressLength]) ||
+			!bytes.Equal(k[common.AddressLength:common.AddressLength+common.HashLength], key[common.AddressLength+common.IncarnationLength:]) {
+			return 0, false, false, nil
+		}
+	} else {
+		if !bytes.HasPrefix(k, key) {
+			return 0, false, false, nil
+		}
+	}
+	changeSetBlock, set, ok := dbutils.WrapHistoryIndex(v).Search(timestamp)
+	return changeSetBlock, set, ok, nil
+}
+
 func WalkAsOf(db ethdb.Tx, bucket string, hBucket string, startkey []byte, fixedbits int, timestamp uint64, walker func(k []byte, v []byte) (bool, error)) error {
 	//fmt.Printf("WalkAsOf %x %x %x %d %d\n", bucket, hBucket, startkey, fixedbits, timestamp)
 	if !(bucket == dbutils.PlainStateBucket || bucket == dbutils.CurrentStateBucket) {
 		return fmt.Errorf("unsupported state bucket: %s", string(bucket))
 	}
+	prunedTo, err := historyPrunedTo(db)
+	if err != nil {
+		return err
+	}
+	if timestamp < prunedTo {
+		return ErrHistoryPruned
+	}
 	if hBucket == dbutils.AccountsHistoryBucket {
 		return walkAsOfThinAccounts(db, bucket, hBucket, startkey, fixedbits, timestamp, walker)
 	} else if hBucket == dbutils.StorageHistoryBucket {
@@ -151,11 +362,11 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 	if innerErr != nil {
 		return innerErr
 	}
+	storageHistoryBucket, _ := historyBucket(tx, true /* storage */)
 	if executedTo > generatedTo+MaxChangesetsSearch {
 		return fmt.Errorf("too high difference between last generated index block(%v) and last executed block(%v)", generatedTo, executedTo)
 	}
 
-	startkeyNoInc := dbutils.CompositeKeyWithoutIncarnation(startkey)
 	part1End := common.HashLength
 	part2Start := common.HashLength + common.IncarnationLength
 	part3Start := common.HashLength + common.IncarnationLength + common.HashLength
@@ -164,6 +375,7 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 		part2Start = common.AddressLength + common.IncarnationLength
 		part3Start = common.AddressLength + common.IncarnationLength + common.HashLength
 	}
+	startkeyNoInc := storageKeyWithoutIncarnation(startkey, part1End)
 
 	//for storage
 	mainCursor := ethdb.NewSplitCursor(
@@ -174,10 +386,7 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 		part2Start,
 		part3Start,
 	)
-	fixetBitsForHistory := fixedbits - 8*common.IncarnationLength
-	if fixetBitsForHistory < 0 {
-		fixetBitsForHistory = 0
-	}
+	fixetBitsForHistory := historyFixedBits(fixedbits, part1End)
 
 	part1End = common.HashLength
 	part2Start = common.HashLength
@@ -190,7 +399,7 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 
 	//for historic data
 	var historyCursor historyCursor = ethdb.NewSplitCursor(
-		tx.Cursor(dbutils.StorageHistoryBucket),
+		tx.Cursor(storageHistoryBucket),
 		startkeyNoInc,
 		fixetBitsForHistory,
 		part1End,   /* part1end */
@@ -207,7 +416,8 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 		part3Start = common.AddressLength + common.IncarnationLength + common.HashLength
 	}
 
-	decorator := NewChangesetSearchDecorator(historyCursor, tx, csBucket, startkey, fixetBitsForHistory, part1End, part2Start, part3Start, timestamp, returnCorrectWalker(bucket, hBucket))
+	// changeset keys have incarnation, so they are matched the same way as the keys of the state
+	decorator := NewChangesetSearchDecorator(historyCursor, tx, csBucket, startkey, fixedbits, part1End, part2Start, part3Start, timestamp, returnCorrectWalker(bucket, hBucket))
 	err := decorator.buildChangeset(generatedTo, executedTo)
 	if err != nil {
 		return err
@@ -271,6 +481,32 @@ func walkAsOfThinStorage(tx ethdb.Tx, bucket string, hBucket string, startkey []
 	return err
 }
 
+// storageKeyWithoutIncarnation - like dbutils.CompositeKeyWithoutIncarnation, but also works for prefixes of the storage key
+func storageKeyWithoutIncarnation(key []byte, addrLen int) []byte {
+	if len(key) <= addrLen {
+		return common.CopyBytes(key)
+	}
+	res := make([]byte, addrLen, len(key))
+	copy(res, key[:addrLen])
+	if len(key) > addrLen+common.IncarnationLength {
+		res = append(res, key[addrLen+common.IncarnationLength:]...)
+	}
+	return res
+}
+
+// historyFixedBits - translates fixedbits of the storage key to the key of history index, which has no incarnation.
+// Bits of the incarnation can't be matched in the history, so the prefix is cut to the address there.
+func historyFixedBits(fixedbits int, addrLen int) int {
+	switch {
+	case fixedbits <= 8*addrLen:
+		return fixedbits
+	case fixedbits <= 8*(addrLen+common.IncarnationLength):
+		return 8 * addrLen
+	default:
+		return fixedbits - 8*common.IncarnationLength
+	}
+}
+
 func walkAsOfThinAccounts(tx ethdb.Tx, bucket string, hBucket string, startkey []byte, fixedbits int, timestamp uint64, walker func(k []byte, v []byte) (bool, error)) error {
 	fixedbytes, mask := ethdb.Bytesmask(fixedbits)
 	csBucket := dbutils.AccountChangeSetBucket
@@ -282,6 +518,7 @@ func walkAsOfThinAccounts(tx ethdb.Tx, bucket string, hBucket string, startkey [
 	if innerErr != nil {
 		return innerErr
 	}
+	accountsHistoryBucket, _ := historyBucket(tx, false /* storage */)
 	if executedTo > generatedTo+MaxChangesetsSearch {
 		return fmt.Errorf("too high difference between last generated index block(%v) and last executed block(%v)", generatedTo, executedTo)
 	}
@@ -299,7 +536,7 @@ func walkAsOfThinAccounts(tx ethdb.Tx, bucket string, hBucket string, startkey [
 	}
 
 	var hCursor historyCursor = ethdb.NewSplitCursor(
-		tx.Cursor(dbutils.AccountsHistoryBucket),
+		tx.Cursor(accountsHistoryBucket),
 		startkey,
 		fixedbits,
 		part1End,   /* part1end */
@@ -381,36 +618,59 @@ func walkAsOfThinAccounts(tx ethdb.Tx, bucket string, hBucket string, startkey [
 
 }
 
-func findInHistory(hK, hV []byte, timestamp uint64, csGetter func([]byte) ([]byte, error), adapter func(v []byte) changeset.Walker) ([]byte, bool, error) {
-	index := dbutils.WrapHistoryIndex(hV)
-	if changeSetBlock, set, ok := index.Search(timestamp); ok {
-		// set == true if this change was from empty record (non-existent account) to non-empty
-		// In such case, we do not need to examine changeSet and simply skip the record
-		if !set {
-			// Extract value from the changeSet
-			csKey := dbutils.EncodeTimestamp(changeSetBlock)
-			changeSetData, err := csGetter(csKey)
-			if err != nil {
-				return nil, false, err
-			}
-			if changeSetData == nil {
-				return nil, false, fmt.Errorf("could not find ChangeSet record for index entry %d (query timestamp %d) key %s, csKey %s", changeSetBlock, timestamp, common.Bytes2Hex(hK), common.Bytes2Hex(csKey))
-			}
-
-			data, err2 := adapter(changeSetData).Find(hK)
-			if err2 != nil {
-				return nil, false, fmt.Errorf("could not find key %x in the ChangeSet record for index entry %d (query timestamp %d): %v",
-					hK,
-					changeSetBlock,
-					timestamp,
-					err2,
-				)
-			}
-			return data, true, nil
+func findInHistory(hK, hV, tsEnc []byte, timestamp uint64, csGetter func([]byte) ([]byte, error), adapter func(v []byte) changeset.Walker) ([]byte, bool, error) {
+	var changeSetBlock uint64
+	var set, ok bool
+	if len(tsEnc) == 8 { // chunk of the legacy index
+		changeSetBlock, set, ok = dbutils.WrapHistoryIndex(hV).Search(timestamp)
+	} else {
+		bm := roaring.New()
+		if _, err := bm.FromBuffer(hV); err != nil {
+			return nil, false, fmt.Errorf("decoding history index of %x: %w", hK, err)
 		}
+		changeSetBlock, ok = bitmapdb.SeekInBitmap(bm, timestamp)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	// set == true if this change was from empty record (non-existent account) to non-empty
+	// In such case, we do not need to examine changeSet and simply skip the record
+	if set {
 		return nil, true, nil
 	}
-	return nil, false, nil
+	// Extract value from the changeSet
+	csKey := dbutils.EncodeTimestamp(changeSetBlock)
+	changeSetData, err := csGetter(csKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if changeSetData == nil {
+		return nil, false, fmt.Errorf("could not find ChangeSet record for index entry %d (query timestamp %d) key %s, csKey %s", changeSetBlock, timestamp, common.Bytes2Hex(hK), common.Bytes2Hex(csKey))
+	}
+
+	data, err2 := adapter(changeSetData).Find(hK)
+	if err2 != nil {
+		return nil, false, fmt.Errorf("could not find key %x in the ChangeSet record for index entry %d (query timestamp %d): %v",
+			hK,
+			changeSetBlock,
+			timestamp,
+			err2,
+		)
+	}
+	return data, true, nil
+}
+
+// chunkUpperBound decodes the number of history index chunk from the key suffix:
+// 4 bytes shard number of the bitmap index or 8 bytes chunk number of the legacy one
+func chunkUpperBound(tsEnc []byte) uint64 {
+	if len(tsEnc) == 4 {
+		n := binary.BigEndian.Uint32(tsEnc)
+		if n == ^uint32(0) {
+			return ^uint64(0)
+		}
+		return uint64(n)
+	}
+	return binary.BigEndian.Uint64(tsEnc)
 }
 
 func returnCorrectWalker(bucket, hBucket string) func(v []byte) changeset.Walker {
@@ -483,8 +743,7 @@ type changesetSearchDecorator struct {
 	timestamp     uint64
 	walkerAdapter func(v []byte) changeset.Walker
 
-	pos    int
-	values []changeset.Change
+	changes changesetsMerger
 
 	kd1, kd2, kd3, dv []byte
 	kc1, kc2, kc3, cv []byte
@@ -506,7 +765,7 @@ func NextForChunkedData(oldAddr, oldKey []byte, cursor historyCursor, timestamp
 
 	hAddrHash0 := hAddrHash
 	hKeyHash0 := hKeyHash
-	for bytes.Equal(hAddrHash, hAddrHash0) && bytes.Equal(hKeyHash, hKeyHash0) && tsEnc != nil && binary.BigEndian.Uint64(tsEnc) < timestamp {
+	for bytes.Equal(hAddrHash, hAddrHash0) && bytes.Equal(hKeyHash, hKeyHash0) && tsEnc != nil && chunkUpperBound(tsEnc) < timestamp {
 		hAddrHash, hKeyHash, tsEnc, hV, err2 = cursor.Next()
 		if err2 != nil {
 			return nil, nil, nil, nil, err2
@@ -516,23 +775,8 @@ func NextForChunkedData(oldAddr, oldKey []byte, cursor historyCursor, timestamp
 }
 
 func (csd *changesetSearchDecorator) Seek() ([]byte, []byte, []byte, []byte, error) {
-	pos := sort.Search(len(csd.values), func(i int) bool {
-		return bytes.Compare(csd.startKey, csd.values[i].Key) < 0
-	})
-
-	if pos < len(csd.values) {
-		csd.pos = pos
-		if !csd.matchKey(csd.values[csd.pos].Key) {
-			csd.kd1 = nil
-			csd.kd2 = nil
-			csd.kd3 = nil
-			csd.dv = nil
-		} else {
-			csd.kd1 = csd.values[csd.pos].Key[:csd.part1End]
-			csd.kd2 = csd.values[csd.pos].Key[csd.part2Start:csd.part3Start]
-			csd.kd3 = csd.values[csd.pos].Key[csd.part3Start:]
-			csd.dv = csd.values[csd.pos].Value
-		}
+	if err := csd.nextChange(); err != nil {
+		return nil, nil, nil, nil, err
 	}
 
 	hAddrHash, hKeyHash, tsEnc, hV, err2 := csd.historyCursor.Seek()
@@ -543,7 +787,7 @@ func (csd *changesetSearchDecorator) Seek() ([]byte, []byte, []byte, []byte, err
 	hAddrHash0 := hAddrHash
 	hKeyHash0 := hKeyHash
 	//find first chunk after timestamp
-	for hAddrHash != nil && tsEnc != nil && bytes.Equal(hAddrHash, hAddrHash0) && bytes.Equal(hKeyHash, hKeyHash0) && binary.BigEndian.Uint64(tsEnc) < csd.timestamp {
+	for hAddrHash != nil && tsEnc != nil && bytes.Equal(hAddrHash, hAddrHash0) && bytes.Equal(hKeyHash, hKeyHash0) && chunkUpperBound(tsEnc) < csd.timestamp {
 		hAddrHash, hKeyHash, tsEnc, hV, err2 = csd.historyCursor.Next()
 		if err2 != nil {
 			return nil, nil, nil, nil, err2
@@ -557,7 +801,7 @@ func (csd *changesetSearchDecorator) Seek() ([]byte, []byte, []byte, []byte, err
 		get := func(k []byte) ([]byte, error) {
 			return csd.tx.GetOne(csd.bucketName, k)
 		}
-		data, found, innerErr := findInHistory(hK, hV, csd.timestamp, get, csd.walkerAdapter)
+		data, found, innerErr := findInHistory(hK, hV, tsEnc, csd.timestamp, get, csd.walkerAdapter)
 		if innerErr != nil {
 			return nil, nil, nil, nil, innerErr
 		}
@@ -599,24 +843,8 @@ func (csd *changesetSearchDecorator) Seek() ([]byte, []byte, []byte, []byte, err
 	}
 	//shift changesets cursor
 	if cmp <= 0 {
-		csd.pos++
-		if csd.pos < len(csd.values) {
-			if !csd.matchKey(csd.values[csd.pos].Key) {
-				csd.kd1 = nil
-				csd.kd2 = nil
-				csd.kd3 = nil
-				csd.dv = nil
-			} else {
-				csd.kd1 = csd.values[csd.pos].Key[:csd.part1End]
-				csd.kd2 = csd.values[csd.pos].Key[csd.part2Start:csd.part3Start]
-				csd.kd3 = csd.values[csd.pos].Key[csd.part3Start:]
-				csd.dv = csd.values[csd.pos].Value
-			}
-		} else {
-			csd.kd1 = nil
-			csd.kd2 = nil
-			csd.kd3 = nil
-			csd.dv = nil
+		if err := csd.nextChange(); err != nil {
+			return nil, nil, nil, nil, err
 		}
 	}
 
@@ -634,7 +862,7 @@ func (csd *changesetSearchDecorator) Seek() ([]byte, []byte, []byte, []byte, err
 			get := func(k []byte) ([]byte, error) {
 				return csd.tx.GetOne(csd.bucketName, k)
 			}
-			data, found, innderErr := findInHistory(hK, hV, csd.timestamp, get, csd.walkerAdapter)
+			data, found, innderErr := findInHistory(hK, hV, tsEnc, csd.timestamp, get, csd.walkerAdapter)
 			if innderErr != nil {
 				return nil, nil, nil, nil, innderErr
 			}
@@ -681,24 +909,8 @@ func (csd *changesetSearchDecorator) Next() ([]byte, []byte, []byte, []byte, err
 	}
 	//shift changesets cursor
 	if cmp <= 0 {
-		csd.pos++
-		if csd.pos < len(csd.values) {
-			if !csd.matchKey(csd.values[csd.pos].Key) {
-				csd.kd1 = nil
-				csd.kd2 = nil
-				csd.kd3 = nil
-				csd.dv = nil
-			} else {
-				csd.kd1 = csd.values[csd.pos].Key[:csd.part1End]
-				csd.kd2 = csd.values[csd.pos].Key[csd.part2Start:csd.part3Start]
-				csd.kd3 = csd.values[csd.pos].Key[csd.part3Start:]
-				csd.dv = csd.values[csd.pos].Value
-			}
-		} else {
-			csd.kd1 = nil
-			csd.kd2 = nil
-			csd.kd3 = nil
-			csd.dv = nil
+		if err := csd.nextChange(); err != nil {
+			return nil, nil, nil, nil, err
 		}
 	}
 
@@ -715,7 +927,7 @@ func (csd *changesetSearchDecorator) Next() ([]byte, []byte, []byte, []byte, err
 			get := func(k []byte) ([]byte, error) {
 				return csd.tx.GetOne(csd.bucketName, k)
 			}
-			data, found, innderErr := findInHistory(hK, hV, csd.timestamp, get, csd.walkerAdapter)
+			data, found, innderErr := findInHistory(hK, hV, tsEnc, csd.timestamp, get, csd.walkerAdapter)
 			if innderErr != nil {
 				return nil, nil, nil, nil, innderErr
 			}
@@ -733,8 +945,6 @@ func (csd *changesetSearchDecorator) Next() ([]byte, []byte, []byte, []byte, err
 	return key1, key2, key3, val, err
 }
 
-var ErrNotInHistory = errors.New("not in history")
-
 func (csd *changesetSearchDecorator) matchKey(k []byte) bool {
 	if k == nil {
 		return false
@@ -751,66 +961,118 @@ func (csd *changesetSearchDecorator) matchKey(k []byte) bool {
 	return (k[csd.matchBytes-1] & csd.byteMask) == (csd.startKey[csd.matchBytes-1] & csd.byteMask)
 }
 
+// nextChange moves to the next key of the changesets, keys not matching the startKey end the changesets
+func (csd *changesetSearchDecorator) nextChange() error {
+	k, v, err := csd.changes.next()
+	if err != nil {
+		return err
+	}
+	if !csd.matchKey(k) {
+		csd.kd1, csd.kd2, csd.kd3, csd.dv = nil, nil, nil, nil
+		return nil
+	}
+	csd.kd1 = k[:csd.part1End]
+	csd.kd2 = k[csd.part2Start:csd.part3Start]
+	csd.kd3 = k[csd.part3Start:]
+	csd.dv = v
+	return nil
+}
+
+// buildChangeset opens changesets of the blocks [from, to] which are not in the index yet.
+// Changesets of the blocks before the timestamp don't affect the state as of the timestamp.
 func (csd *changesetSearchDecorator) buildChangeset(from, to uint64) error {
 	if from >= to {
 		return nil
 	}
-	cs := make([]struct {
-		Walker   changeset.Walker
-		BlockNum uint64
-	}, 0, to-from)
-
+	if from < csd.timestamp {
+		from = csd.timestamp
+	}
 	c := csd.tx.Cursor(csd.bucketName)
 	defer c.Close()
-	_, _, err := c.Seek(dbutils.EncodeTimestamp(from))
-	if err != nil {
-		return err
-	}
-	err = ethdb.ForEach(c, func(k, v []byte) (bool, error) {
+	for k, v, err := c.Seek(dbutils.EncodeTimestamp(from)); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
 		blockNum, _ := dbutils.DecodeTimestamp(k)
 		if blockNum > to {
-			return false, nil
+			break
+		}
+		// values stay valid until the end of the transaction, so changesets are not copied
+		if err = csd.changes.add(csd.walkerAdapter(v).Iterator(), blockNum, csd.startKey); err != nil {
+			return err
 		}
-		cs = append(cs, struct {
-			Walker   changeset.Walker
-			BlockNum uint64
-		}{Walker: csd.walkerAdapter(common.CopyBytes(v)), BlockNum: blockNum})
-
-		return true, nil
-	})
-	if err != nil {
-		return err
 	}
+	return nil
+}
 
-	sort.Slice(cs, func(i, j int) bool {
-		return cs[i].BlockNum < cs[j].BlockNum
-	})
-	mp := make(map[string][]byte)
-	for i := len(cs) - 1; i >= 0; i-- {
-		replace := cs[i].BlockNum >= csd.timestamp
-		err = cs[i].Walker.Walk(func(k, v []byte) error {
-			if replace {
-				mp[string(k)] = v
-			}
-			return nil
-		})
+// changesetsMerger merges changesets of many blocks in the order of keys, for the keys changed in
+// many blocks the value from the earliest block wins. Only the current change of every changeset
+// is kept in the heap, so memory doesn't depend on the size of the changesets.
+type changesetsMerger struct {
+	h changesetsHeap
+}
+
+type changesetHead struct {
+	it       changeset.Iterator
+	blockNum uint64
+	k, v     []byte
+}
+
+// add adds the changeset of the block, positioned at the first key >= startKey
+func (m *changesetsMerger) add(it changeset.Iterator, blockNum uint64, startKey []byte) error {
+	for {
+		k, v, err := it.Next()
 		if err != nil {
 			return err
 		}
+		if k == nil {
+			return nil
+		}
+		if bytes.Compare(k, startKey) >= 0 {
+			heap.Push(&m.h, &changesetHead{it: it, blockNum: blockNum, k: k, v: v})
+			return nil
+		}
+	}
+}
+
+// next returns the smallest key with its value from the earliest block, nil key when all changesets are over
+func (m *changesetsMerger) next() ([]byte, []byte, error) {
+	if len(m.h) == 0 {
+		return nil, nil, nil
 	}
-	res := make([]changeset.Change, len(mp))
-	i := 0
-	for k := range mp {
-		res[i] = changeset.Change{
-			Key:   []byte(k),
-			Value: mp[k],
+	k, v := common.CopyBytes(m.h[0].k), m.h[0].v
+	for len(m.h) > 0 && bytes.Equal(m.h[0].k, k) {
+		head := m.h[0]
+		nextK, nextV, err := head.it.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if nextK == nil {
+			heap.Pop(&m.h)
+			continue
 		}
-		i++
+		head.k, head.v = nextK, nextV
+		heap.Fix(&m.h, 0)
 	}
-	sort.Slice(res, func(i, j int) bool {
-		cmp := bytes.Compare(res[i].Key, res[j].Key)
-		return cmp <= 0
-	})
-	csd.values = res
-	return nil
+	return k, v, nil
+}
+
+type changesetsHeap []*changesetHead
+
+func (h changesetsHeap) Len() int { return len(h) }
+func (h changesetsHeap) Less(i, j int) bool {
+	if cmp := bytes.Compare(h[i].k, h[j].k); cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].blockNum < h[j].blockNum
+}
+func (h changesetsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *changesetsHeap) Push(x interface{}) { *h = append(*h, x.(*changesetHead)) }
+func (h *changesetsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
 }
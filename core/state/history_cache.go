@@ -0,0 +1,219 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/metrics"
+)
+
+var (
+	historyCacheHitMeter  = metrics.NewRegisteredCounter("state/history/cache/hit", nil)
+	historyCacheMissMeter = metrics.NewRegisteredCounter("state/history/cache/miss", nil)
+)
+
+// historyCacheMaxHeads - number of the recent heads remembered by HistoryCache to tell the views of older
+// transactions from the views after an unwind
+const historyCacheMaxHeads = 128
+
+// kinds of the entries of HistoryCache
+const (
+	historyEntry       byte = iota // the value is from a changeset, it doesn't change while the chain is not reorganised
+	latestEntry                    // the value is from the current state, valid only at the same head
+	latestMissingEntry             // the key is neither in the history nor in the current state, valid only at the same head
+)
+
+// HistoryCache - cache of the results of GetAsOf, shared by the readers of the historical state. The entries are keyed
+// by the kind of the key (account or storage), the key and the timestamp. Values found in the changesets are kept
+// until the chain is reorganised. Values taken from the current state are tagged with the head (progress of the
+// Execution stage) they were read at, and are used only by the readers at the same head. The chain is checked once
+// per transaction, see View
+type HistoryCache struct {
+	hits       uint64 // atomic
+	misses     uint64 // atomic
+	generation uint64 // atomic, incremented when the cache is reset
+
+	cache *fastcache.Cache
+
+	lock     sync.Mutex
+	head     uint64
+	headHash common.Hash
+	heads    map[uint64]common.Hash // recent heads of the chain the entries belong to
+}
+
+// NewHistoryCache - the cache takes up to maxBytes of memory, fastcache allocates 32Mb at least
+func NewHistoryCache(maxBytes int) *HistoryCache {
+	return &HistoryCache{
+		cache: fastcache.New(maxBytes),
+		heads: make(map[uint64]common.Hash),
+	}
+}
+
+// HistoryCacheStats - numbers of the lookups served from the cache and from the database
+type HistoryCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (c *HistoryCache) Stats() HistoryCacheStats {
+	return HistoryCacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+}
+
+// HistoryCacheView - GetAsOf over the transaction, served from the cache when possible
+type HistoryCacheView struct {
+	cache      *HistoryCache
+	tx         ethdb.Tx
+	head       uint64
+	generation uint64
+}
+
+// View reads the head of the transaction. The head which doesn't belong to the chain of the cached entries means
+// the chain was reorganised (or the transaction is very old) - the cache is reset then
+func (c *HistoryCache) View(tx ethdb.Tx) (*HistoryCacheView, error) {
+	head, hash, err := readExecutionHead(tx)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case len(c.heads) == 0:
+		c.addHead(head, hash)
+	case head > c.head:
+		prevHash, err := readCanonicalHash(tx, c.head)
+		if err != nil {
+			return nil, err
+		}
+		if prevHash != c.headHash {
+			c.reset()
+		}
+		c.addHead(head, hash)
+	default:
+		// the view of an older transaction is fine as long as its head is one of the recent heads
+		if known, ok := c.heads[head]; !ok || known != hash {
+			c.reset()
+			c.addHead(head, hash)
+		}
+	}
+	return &HistoryCacheView{cache: c, tx: tx, head: head, generation: atomic.LoadUint64(&c.generation)}, nil
+}
+
+func (c *HistoryCache) addHead(head uint64, hash common.Hash) {
+	c.head, c.headHash = head, hash
+	c.heads[head] = hash
+	if len(c.heads) <= historyCacheMaxHeads {
+		return
+	}
+	oldest := head
+	for n := range c.heads {
+		if n < oldest {
+			oldest = n
+		}
+	}
+	delete(c.heads, oldest)
+}
+
+func (c *HistoryCache) reset() {
+	atomic.AddUint64(&c.generation, 1)
+	c.cache.Reset()
+	c.heads = make(map[uint64]common.Hash)
+}
+
+// GetAsOf - same as GetAsOf of the package
+func (v *HistoryCacheView) GetAsOf(storage bool, key []byte, timestamp uint64) ([]byte, error) {
+	c := v.cache
+	if atomic.LoadUint64(&c.generation) != v.generation {
+		// the cache belongs to another chain now
+		return GetAsOf(v.tx, storage, key, timestamp)
+	}
+	cacheKey := historyCacheKey(storage, key, timestamp)
+	if enc, ok := c.cache.HasGet(nil, cacheKey); ok && v.valid(enc, timestamp) {
+		atomic.AddUint64(&c.hits, 1)
+		historyCacheHitMeter.Inc(1)
+		if enc[0] == latestMissingEntry {
+			return nil, ErrNotInHistory
+		}
+		return enc[9:], nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+	historyCacheMissMeter.Inc(1)
+
+	kind := historyEntry
+	val, err := FindByHistory(v.tx, storage, key, timestamp)
+	if err != nil {
+		if !errors.Is(err, ErrNotInHistory) {
+			return nil, err
+		}
+		if val, err = v.tx.GetOne(dbutils.PlainStateBucket, key); err != nil {
+			return nil, err
+		}
+		kind = latestEntry
+		if val == nil {
+			kind = latestMissingEntry
+		}
+	}
+	if kind == historyEntry && timestamp > v.head {
+		kind = latestEntry
+	}
+	enc := make([]byte, 9+len(val))
+	enc[0] = kind
+	binary.BigEndian.PutUint64(enc[1:], v.head)
+	copy(enc[9:], val)
+	if atomic.LoadUint64(&c.generation) == v.generation {
+		c.cache.Set(cacheKey, enc)
+	}
+	if kind == latestMissingEntry {
+		return nil, ErrNotInHistory
+	}
+	return enc[9:], nil
+}
+
+// valid - the values from the changesets are valid for the timestamps up to the head of the view: the blocks
+// after it might be of another chain. The values from the current state are valid only at the same head
+func (v *HistoryCacheView) valid(enc []byte, timestamp uint64) bool {
+	if len(enc) < 9 {
+		return false
+	}
+	if enc[0] == historyEntry {
+		return timestamp <= v.head
+	}
+	return binary.BigEndian.Uint64(enc[1:]) == v.head
+}
+
+func historyCacheKey(storage bool, key []byte, timestamp uint64) []byte {
+	k := make([]byte, 1+len(key)+8)
+	if storage {
+		k[0] = 1
+	}
+	copy(k[1:], key)
+	binary.BigEndian.PutUint64(k[1+len(key):], timestamp)
+	return k
+}
+
+func readExecutionHead(tx ethdb.Tx) (uint64, common.Hash, error) {
+	v, err := tx.GetOne(dbutils.SyncStageProgress, stages.Execution)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return 0, common.Hash{}, err
+	}
+	var head uint64
+	if len(v) >= 8 {
+		head = binary.BigEndian.Uint64(v[:8])
+	}
+	hash, err := readCanonicalHash(tx, head)
+	return head, hash, err
+}
+
+func readCanonicalHash(tx ethdb.Tx, number uint64) (common.Hash, error) {
+	v, err := tx.GetOne(dbutils.HeaderPrefix, dbutils.HeaderHashKey(number))
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(v), nil
+}
@@ -0,0 +1,166 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// countingTx counts the reads of the database: GetOne calls and opened cursors
+type countingTx struct {
+	ethdb.Tx
+	reads int
+}
+
+func (tx *countingTx) GetOne(bucket string, key []byte) ([]byte, error) {
+	tx.reads++
+	return tx.Tx.GetOne(bucket, key)
+}
+
+func (tx *countingTx) Cursor(bucket string) ethdb.Cursor {
+	tx.reads++
+	return tx.Tx.Cursor(bucket)
+}
+
+func setExecutionHead(t testing.TB, db ethdb.Database, head uint64, hash common.Hash) {
+	require.NoError(t, stages.SaveStageProgress(db, stages.Execution, head, nil))
+	require.NoError(t, db.Put(dbutils.HeaderPrefix, dbutils.HeaderHashKey(head), hash[:]))
+}
+
+func balanceAsOf(t *testing.T, view *HistoryCacheView, addr common.Address, timestamp uint64) uint64 {
+	enc, err := view.GetAsOf(false /* storage */, addr[:], timestamp)
+	require.NoError(t, err)
+	var acc accounts.Account
+	require.NoError(t, acc.DecodeForStorage(enc))
+	return acc.Balance.Uint64()
+}
+
+func TestHistoryCache(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	writeDumpTestState(t, db)
+	setExecutionHead(t, db, 3, common.Hash{3})
+	cache := NewHistoryCache(32 * 1024 * 1024)
+	addr := common.BytesToAddress([]byte{3})
+	view := func() (*HistoryCacheView, func()) {
+		tx, err := db.KV().Begin(context.Background(), nil, false)
+		require.NoError(t, err)
+		v, err := cache.View(tx)
+		require.NoError(t, err)
+		return v, tx.Rollback
+	}
+
+	v, done := view()
+	require.Equal(t, uint64(3), balanceAsOf(t, v, addr, 2), "from the changeset of block 2")
+	require.Equal(t, uint64(100), balanceAsOf(t, v, addr, 4), "from the current state")
+	_, err := v.GetAsOf(false /* storage */, common.HexToAddress("0xff").Bytes(), 4)
+	require.True(t, errors.Is(err, ErrNotInHistory))
+	require.Equal(t, HistoryCacheStats{Misses: 3}, cache.Stats())
+
+	require.Equal(t, uint64(3), balanceAsOf(t, v, addr, 2))
+	require.Equal(t, uint64(100), balanceAsOf(t, v, addr, 4))
+	_, err = v.GetAsOf(false /* storage */, common.HexToAddress("0xff").Bytes(), 4)
+	require.True(t, errors.Is(err, ErrNotInHistory))
+	require.Equal(t, HistoryCacheStats{Hits: 3, Misses: 3}, cache.Stats())
+	done()
+
+	// block 4 changes the balance, the values from the current state are read again
+	w := NewPlainStateWriter(db, nil, 4)
+	require.NoError(t, w.UpdateAccountData(context.Background(), addr, testAccount(100, 0), testAccount(200, 0)))
+	require.NoError(t, w.WriteChangeSets())
+	require.NoError(t, w.WriteHistory())
+	setExecutionHead(t, db, 4, common.Hash{4})
+	v, done = view()
+	require.Equal(t, uint64(3), balanceAsOf(t, v, addr, 2))
+	require.Equal(t, uint64(100), balanceAsOf(t, v, addr, 4), "from the changeset of block 4 now")
+	require.Equal(t, uint64(200), balanceAsOf(t, v, addr, 5))
+	require.Equal(t, HistoryCacheStats{Hits: 4, Misses: 5}, cache.Stats())
+	done()
+
+	// another block 4 - the cache is reset
+	setExecutionHead(t, db, 4, common.Hash{0x44})
+	v, done = view()
+	require.Equal(t, uint64(3), balanceAsOf(t, v, addr, 2))
+	require.Equal(t, HistoryCacheStats{Hits: 4, Misses: 6}, cache.Stats())
+	done()
+}
+
+func TestHistoryCacheStorage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	writeDumpTestState(t, db)
+	setExecutionHead(t, db, 3, common.Hash{3})
+	cache := NewHistoryCache(32 * 1024 * 1024)
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	v, err := cache.View(tx)
+	require.NoError(t, err)
+
+	key := dbutils.PlainGenerateCompositeStorageKey(common.BytesToAddress([]byte{9}), 1, common.HexToHash("0x01"))
+	for i := 0; i < 2; i++ {
+		val, err := v.GetAsOf(true /* storage */, key, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint256.NewInt().SetUint64(1).Bytes(), val)
+		val, err = v.GetAsOf(true /* storage */, key, 4)
+		require.NoError(t, err)
+		require.Equal(t, uint256.NewInt().SetUint64(3).Bytes(), val)
+	}
+	require.Equal(t, HistoryCacheStats{Hits: 2, Misses: 2}, cache.Stats())
+}
+
+// BenchmarkHistoryCache reads the balances of the same accounts at the same block in a new transaction every time,
+// as eth_getBalance does
+func BenchmarkHistoryCache(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	mutDB := db.NewBatch()
+	addrs, _, _, _, _ := generateAccountsWithStorageAndHistory(b, mutDB, 1_000, 0)
+	if _, err := mutDB.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	setExecutionHead(b, db, 2, common.Hash{2})
+
+	run := func(b *testing.B, getAsOf func(tx ethdb.Tx, key []byte) ([]byte, error)) {
+		reads := 0
+		for i := 0; i < b.N; i++ {
+			for _, addr := range addrs {
+				if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+					counted := &countingTx{Tx: tx}
+					_, err := getAsOf(counted, addr[:])
+					reads += counted.reads
+					return err
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(reads)/float64(b.N*len(addrs)), "dbreads/op")
+	}
+
+	b.Run("no cache", func(b *testing.B) {
+		run(b, func(tx ethdb.Tx, key []byte) ([]byte, error) {
+			return GetAsOf(tx, false /* storage */, key, 2)
+		})
+	})
+	b.Run("cache", func(b *testing.B) {
+		cache := NewHistoryCache(32 * 1024 * 1024)
+		run(b, func(tx ethdb.Tx, key []byte) ([]byte, error) {
+			view, err := cache.View(tx)
+			if err != nil {
+				return nil, err
+			}
+			return view.GetAsOf(false /* storage */, key, 2)
+		})
+		stats := cache.Stats()
+		b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hits")
+	})
+}
@@ -0,0 +1,269 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Both checks re-open read transaction after every batch, so long scans don't keep old snapshot of the database
+const (
+	checkChangeSetsBatch = 10_000  // blocks
+	checkIndexBatch      = 100_000 // shards
+)
+
+type ConsistencyErrorKind int
+
+const (
+	// MissingIndexEntry - key is in the changeset of the block, but the block is not in the index of the key
+	MissingIndexEntry ConsistencyErrorKind = iota
+	// DanglingIndexEntry - block is in the index of the key, but the changeset of the block doesn't have the key
+	DanglingIndexEntry
+	// ShardOutOfOrder - shard number doesn't match its values, or values of the shard overlap with the previous shard
+	ShardOutOfOrder
+	// IndexPastExecution - index has the block which is not executed yet
+	IndexPastExecution
+)
+
+func (k ConsistencyErrorKind) String() string {
+	switch k {
+	case MissingIndexEntry:
+		return "missing index entry"
+	case DanglingIndexEntry:
+		return "dangling index entry"
+	case ShardOutOfOrder:
+		return "shard out of order"
+	case IndexPastExecution:
+		return "index entry past execution"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// ConsistencyError describes one inconsistency between the history index and the changesets
+type ConsistencyError struct {
+	Kind     ConsistencyErrorKind
+	Bucket   string // bucket where the inconsistent record was found
+	Key      []byte // index key: address or address + storage key (without incarnation)
+	BlockNum uint64
+}
+
+func (e ConsistencyError) Error() string {
+	return fmt.Sprintf("%s: bucket %s, key %x, block %d", e.Kind, e.Bucket, e.Key, e.BlockNum)
+}
+
+type changeSetFinder interface {
+	Find(k []byte) ([]byte, error)
+}
+
+// CheckHistoryConsistency cross-checks the history indices against the changesets of blocks [fromBlock, toBlock]:
+// every key of the changeset must be in the index, every block of the index must have the key in its changeset,
+// shards must be ordered and the index must not refer to the blocks which are not executed yet.
+// Found inconsistencies are sent to errCh, returned error means the check couldn't complete.
+func CheckHistoryConsistency(db ethdb.KV, plain bool, fromBlock, toBlock uint64, errCh chan<- ConsistencyError) error {
+	if !plain {
+		return errors.New("history of hashed state is not supported")
+	}
+	for _, csBucket := range []string{dbutils.PlainAccountChangeSetBucket, dbutils.PlainStorageChangeSetBucket} {
+		if err := checkChangeSetsIndexed(db, csBucket, fromBlock, toBlock, errCh); err != nil {
+			return err
+		}
+		if err := checkIndexReferences(db, csBucket, fromBlock, toBlock, errCh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexStage(csBucket string) stages.SyncStage {
+	if csBucket == dbutils.PlainStorageChangeSetBucket {
+		return stages.StorageHistoryIndex
+	}
+	return stages.AccountHistoryIndex
+}
+
+func checkNotLegacy(tx ethdb.Tx, csBucket string) error {
+	if hBucket, legacy := historyBucket(tx, csBucket == dbutils.PlainStorageChangeSetBucket); legacy {
+		return fmt.Errorf("history index %s must be migrated before the check", hBucket)
+	}
+	return nil
+}
+
+// checkChangeSetsIndexed reports keys of the changesets which are missing in the index.
+// Blocks which the index stage didn't reach yet are skipped.
+func checkChangeSetsIndexed(db ethdb.KV, csBucket string, fromBlock, toBlock uint64, errCh chan<- ConsistencyError) error {
+	info := changeset.Mapper[csBucket]
+	var generatedTo uint64
+	if err := db.View(context.Background(), func(tx ethdb.Tx) error {
+		if err := checkNotLegacy(tx, csBucket); err != nil {
+			return err
+		}
+		var err error
+		generatedTo, _, err = getIndexGenerationProgress(tx, indexStage(csBucket))
+		return err
+	}); err != nil {
+		return err
+	}
+	if toBlock > generatedTo {
+		toBlock = generatedTo
+	}
+
+	for from := fromBlock; from <= toBlock; {
+		to := toBlock
+		if to-from >= checkChangeSetsBatch {
+			to = from + checkChangeSetsBatch - 1
+		}
+		if err := db.View(context.Background(), func(tx ethdb.Tx) error {
+			c := tx.Cursor(csBucket)
+			defer c.Close()
+			indexC := tx.Cursor(info.IndexBucket)
+			defer indexC.Close()
+			for k, v, err := c.Seek(dbutils.EncodeTimestamp(from)); k != nil; k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				blockNum, _ := dbutils.DecodeTimestamp(k)
+				if blockNum > to {
+					break
+				}
+				if err = info.WalkerAdapter(v).Walk(func(changeKey, _ []byte) error {
+					indexKey := dbutils.CompositeKeyWithoutIncarnation(changeKey)
+					bm, innerErr := bitmapdb.Get(indexC, indexKey, uint32(blockNum), uint32(blockNum))
+					if innerErr != nil {
+						return innerErr
+					}
+					if !bm.Contains(uint32(blockNum)) {
+						errCh <- ConsistencyError{Kind: MissingIndexEntry, Bucket: csBucket, Key: common.CopyBytes(indexKey), BlockNum: blockNum}
+					}
+					return nil
+				}); err != nil {
+					return fmt.Errorf("walking over changeset %d: %w", blockNum, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Info("Checked changesets", "bucket", csBucket, "block", to)
+		if to == toBlock {
+			break
+		}
+		from = to + 1
+	}
+	return nil
+}
+
+// checkIndexReferences reports blocks of the index which changesets don't have the key,
+// blocks past the executed one and the shards out of order.
+func checkIndexReferences(db ethdb.KV, csBucket string, fromBlock, toBlock uint64, errCh chan<- ConsistencyError) error {
+	info := changeset.Mapper[csBucket]
+	var executedTo uint64
+	if err := db.View(context.Background(), func(tx ethdb.Tx) error {
+		var err error
+		_, executedTo, err = getIndexGenerationProgress(tx, indexStage(csBucket))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	var (
+		seekKey   = []byte{}
+		prevKey   []byte // index key of the previous shard
+		prevShard uint32 // number of the previous shard
+		done      bool
+	)
+	reportShard := func(key []byte, blockNum uint64) {
+		if blockNum < fromBlock || blockNum > toBlock {
+			return
+		}
+		errCh <- ConsistencyError{Kind: ShardOutOfOrder, Bucket: info.IndexBucket, Key: common.CopyBytes(key), BlockNum: blockNum}
+	}
+	for !done {
+		processed := 0
+		if err := db.View(context.Background(), func(tx ethdb.Tx) error {
+			indexC := tx.Cursor(info.IndexBucket)
+			defer indexC.Close()
+			csC := tx.Cursor(csBucket)
+			defer csC.Close()
+			k, v, err := indexC.Seek(seekKey)
+			if err == nil && k != nil && len(seekKey) > 0 && bytes.Equal(k, seekKey) {
+				k, v, err = indexC.Next()
+			}
+			if err != nil {
+				return err
+			}
+			for ; k != nil; k, v, err = indexC.Next() {
+				if err != nil {
+					return err
+				}
+				if processed == checkIndexBatch {
+					return nil
+				}
+				processed++
+				seekKey = common.CopyBytes(k)
+
+				key, shardNum := k[:len(k)-4], binary.BigEndian.Uint32(k[len(k)-4:])
+				bm := roaring.New()
+				if _, err = bm.FromBuffer(v); err != nil {
+					return fmt.Errorf("decoding shard %x: %w", k, err)
+				}
+				if prevKey != nil && !bytes.Equal(prevKey, key) && prevShard != ^uint32(0) {
+					reportShard(prevKey, uint64(prevShard)) // key has no last shard
+				}
+				if !bm.IsEmpty() {
+					if shardNum != ^uint32(0) && bm.Maximum() != shardNum {
+						reportShard(key, uint64(bm.Maximum()))
+					}
+					if bytes.Equal(prevKey, key) && bm.Minimum() <= prevShard {
+						reportShard(key, uint64(bm.Minimum()))
+					}
+				}
+				prevKey, prevShard = common.CopyBytes(key), shardNum
+
+				bm.RemoveRange(0, fromBlock)
+				for it := bm.Iterator(); it.HasNext(); {
+					blockNum := uint64(it.Next())
+					if blockNum > toBlock {
+						break
+					}
+					if blockNum > executedTo {
+						errCh <- ConsistencyError{Kind: IndexPastExecution, Bucket: info.IndexBucket, Key: common.CopyBytes(key), BlockNum: blockNum}
+						continue
+					}
+					changeSetData, err := csC.SeekExact(dbutils.EncodeTimestamp(blockNum))
+					if err != nil {
+						return err
+					}
+					if changeSetData != nil {
+						if _, err = info.WalkerAdapter(changeSetData).(changeSetFinder).Find(key); err == nil {
+							continue
+						} else if !errors.Is(err, changeset.ErrNotFound) {
+							return fmt.Errorf("finding %x in the changeset %d: %w", key, blockNum, err)
+						}
+					}
+					errCh <- ConsistencyError{Kind: DanglingIndexEntry, Bucket: info.IndexBucket, Key: common.CopyBytes(key), BlockNum: blockNum}
+				}
+			}
+			done = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Info("Checked history index", "bucket", info.IndexBucket, "key", fmt.Sprintf("%x", seekKey))
+	}
+	if prevKey != nil && prevShard != ^uint32(0) {
+		reportShard(prevKey, uint64(prevShard))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func checkHistory(t *testing.T, db ethdb.Database, fromBlock, toBlock uint64) []ConsistencyError {
+	errCh := make(chan ConsistencyError, 100)
+	require.NoError(t, CheckHistoryConsistency(db.(ethdb.HasKV).KV(), true /* plain */, fromBlock, toBlock, errCh))
+	close(errCh)
+	var found []ConsistencyError
+	for e := range errCh {
+		found = append(found, e)
+	}
+	return found
+}
+
+func TestCheckHistoryConsistency(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01")
+	writeBalanceHistory(t, db, addr, 10)
+	for _, stage := range []stages.SyncStage{stages.Execution, stages.AccountHistoryIndex, stages.StorageHistoryIndex} {
+		require.NoError(t, stages.SaveStageProgress(db, stage, 10, nil))
+	}
+	require.Empty(t, checkHistory(t, db, 0, 100))
+
+	// changeset of the block 3 is lost
+	require.NoError(t, db.Delete(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(3)))
+	// changeset of the block 5 has the key which is not indexed
+	notIndexed := common.HexToAddress("0x02")
+	cs := changeset.NewAccountChangeSetPlain()
+	require.NoError(t, cs.Add(addr[:], []byte{}))
+	require.NoError(t, cs.Add(notIndexed[:], []byte{}))
+	v, err := changeset.EncodeAccountsPlain(cs)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(5), v))
+	// index refers to the block which is not executed
+	require.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.AccountsHistoryBucket, addr[:], roaring.BitmapOf(20)))
+	// shards overlap
+	overlapping := common.HexToAddress("0x03")
+	for shardNum, bm := range map[uint32]*roaring.Bitmap{7: roaring.BitmapOf(7), ^uint32(0): roaring.BitmapOf(6)} {
+		buf, err := bm.ToBytes()
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.AccountsHistoryBucket, bitmapdb.ShardKey(overlapping[:], shardNum), buf))
+	}
+
+	require.ElementsMatch(t, []ConsistencyError{
+		{Kind: DanglingIndexEntry, Bucket: dbutils.AccountsHistoryBucket, Key: addr[:], BlockNum: 3},
+		{Kind: MissingIndexEntry, Bucket: dbutils.PlainAccountChangeSetBucket, Key: notIndexed[:], BlockNum: 5},
+		{Kind: IndexPastExecution, Bucket: dbutils.AccountsHistoryBucket, Key: addr[:], BlockNum: 20},
+		{Kind: ShardOutOfOrder, Bucket: dbutils.AccountsHistoryBucket, Key: overlapping[:], BlockNum: 6},
+		{Kind: DanglingIndexEntry, Bucket: dbutils.AccountsHistoryBucket, Key: overlapping[:], BlockNum: 6},
+		{Kind: DanglingIndexEntry, Bucket: dbutils.AccountsHistoryBucket, Key: overlapping[:], BlockNum: 7},
+	}, checkHistory(t, db, 0, 100))
+
+	// only the requested blocks are checked
+	require.ElementsMatch(t, []ConsistencyError{
+		{Kind: MissingIndexEntry, Bucket: dbutils.PlainAccountChangeSetBucket, Key: notIndexed[:], BlockNum: 5},
+	}, checkHistory(t, db, 4, 5))
+}
@@ -0,0 +1,49 @@
+package state
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAsOfErrors(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01")
+	neverExisted := common.HexToAddress("0x02")
+	writeBalanceHistory(t, db, addr, 7)
+
+	// blocks up to 10 are executed, but only 7 are indexed
+	require.NoError(t, stages.SaveStageProgress(db, stages.AccountHistoryIndex, 7, nil))
+	require.NoError(t, stages.SaveStageProgress(db, stages.Execution, 10, nil))
+
+	for _, timestamp := range []uint64{8, 10} {
+		_, err := balanceAsOf(t, db, addr, timestamp)
+		require.True(t, errors.Is(err, ErrHistoryBehindExecution), "timestamp %d: %v", timestamp, err)
+		_, err = balanceAsOf(t, db, neverExisted, timestamp)
+		require.True(t, errors.Is(err, ErrHistoryBehindExecution), "timestamp %d: %v", timestamp, err)
+	}
+	// changes of the indexed blocks are still found
+	balance, err := balanceAsOf(t, db, addr, 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), balance)
+	// state after the last executed block is the current one
+	balance, err = balanceAsOf(t, db, addr, 11)
+	require.NoError(t, err)
+	require.Equal(t, uint64(70), balance)
+
+	require.NoError(t, stages.SaveStageProgress(db, stages.AccountHistoryIndex, 10, nil))
+	_, err = balanceAsOf(t, db, neverExisted, 8)
+	require.True(t, errors.Is(err, ErrNotInHistory), "%v", err)
+	require.True(t, errors.Is(err, ethdb.ErrKeyNotFound), "callers checking for the missing key keep working")
+
+	require.NoError(t, PruneHistory(db, 5, 2, nil))
+	_, err = balanceAsOf(t, db, addr, 3)
+	require.True(t, errors.Is(err, ErrHistoryPruned), "%v", err)
+	_, err = balanceAsOf(t, db, neverExisted, 3)
+	require.True(t, errors.Is(err, ErrHistoryPruned), "%v", err)
+}
@@ -0,0 +1,142 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// ErrHistoryPruned is returned for the state older than the history kept by the node
+var ErrHistoryPruned = errors.New("history pruned")
+
+// PruneHistory deletes changesets with timestamp < keepFrom and removes such blocks from the history indices.
+// Every batchSize blocks are committed together with the progress, so interrupted prune continues from where it stopped.
+// Requests for the state older than keepFrom get ErrHistoryPruned as soon as the prune starts.
+func PruneHistory(db ethdb.Database, keepFrom uint64, batchSize int, quit <-chan struct{}) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d", batchSize)
+	}
+	if migrator, ok := db.(ethdb.BucketsMigrator); ok {
+		for _, bucket := range []string{dbutils.AccountsHistoryBucketOld1, dbutils.StorageHistoryBucketOld1} {
+			if exists, err := migrator.BucketExists(bucket); err != nil {
+				return err
+			} else if exists {
+				return fmt.Errorf("history index %s must be migrated before pruning", bucket)
+			}
+		}
+	}
+
+	prunedTo, err := readBlockNumber(db, dbutils.HistoryPrunedToKey)
+	if err != nil {
+		return err
+	}
+	if keepFrom < prunedTo {
+		keepFrom = prunedTo
+	}
+	if err = db.Put(dbutils.DatabaseInfoBucket, dbutils.HistoryPrunedToKey, dbutils.EncodeBlockNumber(keepFrom)); err != nil {
+		return err
+	}
+	from, err := readBlockNumber(db, dbutils.HistoryPruneProgressKey)
+	if err != nil {
+		return err
+	}
+
+	for from < keepFrom {
+		if err = common.Stopped(quit); err != nil {
+			return err
+		}
+		to := from + uint64(batchSize)
+		if to > keepFrom {
+			to = keepFrom
+		}
+		batch := db.NewBatch()
+		if err = pruneHistoryRange(batch, from, to, keepFrom); err != nil {
+			batch.Rollback()
+			return err
+		}
+		if err = batch.Put(dbutils.DatabaseInfoBucket, dbutils.HistoryPruneProgressKey, dbutils.EncodeBlockNumber(to)); err != nil {
+			batch.Rollback()
+			return err
+		}
+		if _, err = batch.Commit(); err != nil {
+			return err
+		}
+		log.Info("Pruning history", "block", to, "keepFrom", keepFrom)
+		from = to
+	}
+	return nil
+}
+
+// pruneHistoryRange deletes changesets of blocks [from, to) and truncates history of the keys changed in these blocks
+func pruneHistoryRange(db ethdb.Database, from, to, keepFrom uint64) error {
+	for _, csBucket := range []string{
+		dbutils.PlainAccountChangeSetBucket,
+		dbutils.PlainStorageChangeSetBucket,
+		dbutils.AccountChangeSetBucket,
+		dbutils.StorageChangeSetBucket,
+	} {
+		info := changeset.Mapper[csBucket]
+		// only plain changesets are indexed
+		indexed := csBucket == dbutils.PlainAccountChangeSetBucket || csBucket == dbutils.PlainStorageChangeSetBucket
+		var timestamps [][]byte
+		keys := make(map[string]struct{})
+		if err := db.Walk(csBucket, dbutils.EncodeTimestamp(from), 0, func(k, v []byte) (bool, error) {
+			blockNum, _ := dbutils.DecodeTimestamp(k)
+			if blockNum >= to {
+				return false, nil
+			}
+			timestamps = append(timestamps, common.CopyBytes(k))
+			if !indexed {
+				return true, nil
+			}
+			return true, info.WalkerAdapter(v).Walk(func(changeKey, _ []byte) error {
+				keys[string(dbutils.CompositeKeyWithoutIncarnation(changeKey))] = struct{}{}
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range timestamps {
+			if err := db.Delete(csBucket, k); err != nil {
+				return err
+			}
+		}
+		for key := range keys {
+			if err := bitmapdb.TruncateLess(db, info.IndexBucket, []byte(key), keepFrom); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// historyPrunedTo returns the block below which the history is not available
+func historyPrunedTo(tx ethdb.Tx) (uint64, error) {
+	v, err := tx.GetOne(dbutils.DatabaseInfoBucket, dbutils.HistoryPrunedToKey)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return 0, err
+	}
+	if len(v) < 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func readBlockNumber(db ethdb.Getter, key []byte) (uint64, error) {
+	v, err := db.Get(dbutils.DatabaseInfoBucket, key)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return 0, err
+	}
+	if len(v) < 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
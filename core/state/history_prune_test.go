@@ -0,0 +1,125 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBalanceHistory - balance of the account is 10*i after block i, account is created in block 1
+func writeBalanceHistory(t *testing.T, db ethdb.Database, addr common.Address, blocks uint64) {
+	encode := func(balance uint64) []byte {
+		acc := accounts.NewAccount()
+		acc.Initialised = true
+		acc.Balance = *uint256.NewInt().SetUint64(balance)
+		v := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(v)
+		return v
+	}
+	for i := uint64(1); i <= blocks; i++ {
+		cs := changeset.NewAccountChangeSetPlain()
+		if i == 1 {
+			require.NoError(t, cs.Add(addr[:], []byte{}))
+		} else {
+			require.NoError(t, cs.Add(addr[:], encode(10*(i-1))))
+		}
+		v, err := changeset.EncodeAccountsPlain(cs)
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(i), v))
+		require.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.AccountsHistoryBucket, addr[:], roaring.BitmapOf(uint32(i))))
+	}
+	require.NoError(t, db.Put(dbutils.PlainStateBucket, addr[:], encode(10*blocks)))
+}
+
+func balanceAsOf(t *testing.T, db ethdb.Database, addr common.Address, timestamp uint64) (uint64, error) {
+	tx, err := db.(ethdb.HasKV).KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	v, err := GetAsOf(tx, false /* storage */, addr[:], timestamp)
+	if err != nil {
+		return 0, err
+	}
+	var acc accounts.Account
+	require.NoError(t, acc.DecodeForStorage(v))
+	return acc.Balance.Uint64(), nil
+}
+
+func TestPruneHistory(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01")
+	writeBalanceHistory(t, db, addr, 10)
+
+	require.NoError(t, PruneHistory(db, 5, 2, nil))
+
+	for timestamp := uint64(0); timestamp < 5; timestamp++ {
+		_, err := balanceAsOf(t, db, addr, timestamp)
+		require.True(t, errors.Is(err, ErrHistoryPruned), "timestamp %d: %v", timestamp, err)
+	}
+	for timestamp := uint64(5); timestamp <= 11; timestamp++ {
+		balance, err := balanceAsOf(t, db, addr, timestamp)
+		require.NoError(t, err)
+		require.Equal(t, 10*(timestamp-1), balance)
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		_, err := db.Get(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(i))
+		if i < 5 {
+			require.True(t, errors.Is(err, ethdb.ErrKeyNotFound))
+		} else {
+			require.NoError(t, err)
+		}
+	}
+	v, err := db.Get(dbutils.AccountsHistoryBucket, bitmapdb.ShardKey(addr[:], ^uint32(0)))
+	require.NoError(t, err)
+	bm := roaring.New()
+	_, err = bm.FromBuffer(v)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{5, 6, 7, 8, 9, 10}, bm.ToArray())
+
+	// prune point can't move back
+	require.NoError(t, PruneHistory(db, 3, 2, nil))
+	_, err = balanceAsOf(t, db, addr, 4)
+	require.True(t, errors.Is(err, ErrHistoryPruned))
+}
+
+func TestPruneHistoryResume(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01")
+	writeBalanceHistory(t, db, addr, 10)
+
+	quit := make(chan struct{})
+	close(quit)
+	require.True(t, errors.Is(PruneHistory(db, 5, 2, quit), common.ErrStopped))
+	// interrupted prune already hides the history it's going to delete
+	_, err := balanceAsOf(t, db, addr, 4)
+	require.True(t, errors.Is(err, ErrHistoryPruned))
+
+	// emulate interruption after the first batch: blocks below 3 are pruned
+	require.NoError(t, db.Delete(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(1)))
+	require.NoError(t, db.Delete(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(2)))
+	require.NoError(t, db.Put(dbutils.DatabaseInfoBucket, dbutils.HistoryPruneProgressKey, dbutils.EncodeBlockNumber(3)))
+
+	require.NoError(t, PruneHistory(db, 5, 2, nil))
+	for i := uint64(1); i < 5; i++ {
+		_, err = db.Get(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(i))
+		require.True(t, errors.Is(err, ethdb.ErrKeyNotFound))
+	}
+	v, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.HistoryPruneProgressKey)
+	require.NoError(t, err)
+	require.Equal(t, dbutils.EncodeBlockNumber(5), v)
+	balance, err := balanceAsOf(t, db, addr, 6)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), balance)
+}
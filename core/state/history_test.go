@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/holiman/uint256"
 	"github.com/stretchr/testify/assert"
@@ -25,6 +27,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/ledgerwatch/turbo-geth/turbo/trie"
 )
 
@@ -66,17 +69,7 @@ func TestMutation_DeleteTimestamp(t *testing.T) {
 		t.FailNow()
 	}
 
-	indexBytes, innerErr := db.GetIndexChunk(dbutils.AccountsHistoryBucket, addrHashes[0].Bytes(), 1)
-	if innerErr != nil {
-		t.Fatal(err)
-	}
-
-	index := dbutils.WrapHistoryIndex(indexBytes)
-
-	parsed, _, innerErr := index.Decode()
-	if innerErr != nil {
-		t.Fatal(innerErr)
-	}
+	parsed := readLastIndexShard(t, db, dbutils.AccountsHistoryBucket, addrHashes[0].Bytes()).ToArray()
 	if parsed[0] != 1 {
 		t.Fatal("incorrect block num")
 	}
@@ -135,23 +128,13 @@ func TestMutationCommitThinHistory(t *testing.T) {
 			t.Fatal("Accounts not equals")
 		}
 
-		indexBytes, err := db.GetIndexChunk(dbutils.AccountsHistoryBucket, addr.Bytes(), 2)
-		if err != nil {
-			t.Fatal("error on get account", i, err)
-		}
-
-		index := dbutils.WrapHistoryIndex(indexBytes)
-		parsedIndex, _, err := index.Decode()
-		if err != nil {
-			t.Fatal("error on get account", i, err)
-		}
-
-		if parsedIndex[0] != 1 && index.Len() != 1 {
+		index := readLastIndexShard(t, db, dbutils.AccountsHistoryBucket, addr.Bytes())
+		if index.Minimum() != 1 && index.GetCardinality() != 1 {
 			t.Fatal("incorrect history index")
 		}
 
 		resAccStorage := make(map[common.Hash]uint256.Int)
-		err = db.Walk(dbutils.PlainStateBucket, dbutils.PlainGenerateStoragePrefix(addr[:], acc.Incarnation), 8*(common.AddressLength+8), func(k, v []byte) (b bool, e error) {
+		err := db.Walk(dbutils.PlainStateBucket, dbutils.PlainGenerateStoragePrefix(addr[:], acc.Incarnation), 8*(common.AddressLength+8), func(k, v []byte) (b bool, e error) {
 			resAccStorage[common.BytesToHash(k[common.AddressLength+8:])] = *uint256.NewInt().SetBytes(v)
 			return true, nil
 		})
@@ -236,7 +219,7 @@ func TestMutationCommitThinHistory(t *testing.T) {
 	}
 }
 
-func generateAccountsWithStorageAndHistory(t *testing.T, db ethdb.Database, numOfAccounts, numOfStateKeys int) ([]common.Address, []*accounts.Account, []map[common.Hash]uint256.Int, []*accounts.Account, []map[common.Hash]uint256.Int) {
+func generateAccountsWithStorageAndHistory(t testing.TB, db ethdb.Database, numOfAccounts, numOfStateKeys int) ([]common.Address, []*accounts.Account, []map[common.Hash]uint256.Int, []*accounts.Account, []map[common.Hash]uint256.Int) {
 	t.Helper()
 
 	accHistory := make([]*accounts.Account, numOfAccounts)
@@ -288,7 +271,7 @@ func generateAccountsWithStorageAndHistory(t *testing.T, db ethdb.Database, numO
 	return addrs, accState, accStateStorage, accHistory, accHistoryStateStorage
 }
 
-func randomAccount(t *testing.T) (*accounts.Account, common.Address, common.Hash) {
+func randomAccount(t testing.TB) (*accounts.Account, common.Address, common.Hash) {
 	t.Helper()
 	key, err := crypto.GenerateKey()
 	if err != nil {
@@ -2371,3 +2354,376 @@ func assertChangesEquals(t *testing.T, changesObtained, changesExpected *changes
 		t.Fatal("block result is incorrect")
 	}
 }
+
+func readLastIndexShard(t *testing.T, db ethdb.Getter, bucket string, key []byte) *roaring.Bitmap {
+	t.Helper()
+	v, err := db.Get(bucket, bitmapdb.ShardKey(key, ^uint32(0)))
+	if err != nil {
+		t.Fatal("error on get index", common.Bytes2Hex(key), err)
+	}
+	bm := roaring.New()
+	if _, err = bm.FromBuffer(common.CopyBytes(v)); err != nil {
+		t.Fatal("error on decode index", common.Bytes2Hex(key), err)
+	}
+	return bm
+}
+
+// BenchmarkFindInIndex compares history index lookup of the account changed in a million blocks
+func BenchmarkFindInIndex(b *testing.B) {
+	const blocks = 1_000_000
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	addr := common.HexToAddress("0x01").Bytes()
+	if err := db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.(ethdb.BucketMigrator).CreateBucket(dbutils.AccountsHistoryBucketOld1)
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	bm := roaring.New()
+	legacy := dbutils.NewHistoryIndex()
+	for i := uint64(0); i < blocks*3; i += 3 {
+		bm.Add(uint32(i))
+		if dbutils.CheckNewIndexChunk(legacy, i) {
+			lastBlock, _ := legacy.LastElement()
+			if err := db.Put(dbutils.AccountsHistoryBucketOld1, dbutils.IndexChunkKey(addr, lastBlock), legacy); err != nil {
+				b.Fatal(err)
+			}
+			legacy = dbutils.NewHistoryIndex()
+		}
+		legacy = legacy.Append(i, false)
+	}
+	if err := db.Put(dbutils.AccountsHistoryBucketOld1, dbutils.CurrentChunkKey(addr), legacy); err != nil {
+		b.Fatal(err)
+	}
+	if err := bitmapdb.AppendMergeByOr(db, dbutils.AccountsHistoryBucket, addr, bm); err != nil {
+		b.Fatal(err)
+	}
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	b.Run("bitmap", func(b *testing.B) {
+		c := tx.Cursor(dbutils.AccountsHistoryBucket)
+		defer c.Close()
+		for i := 0; i < b.N; i++ {
+			if _, ok, err := findInIndex(c, false, addr, uint64(i%(blocks*3))); err != nil || !ok {
+				b.Fatal(ok, err)
+			}
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		c := tx.Cursor(dbutils.AccountsHistoryBucketOld1)
+		defer c.Close()
+		for i := 0; i < b.N; i++ {
+			if _, _, ok, err := findInLegacyIndex(c, false, addr, uint64(i%(blocks*3))); err != nil || !ok {
+				b.Fatal(ok, err)
+			}
+		}
+	})
+}
+
+func TestGetMultiAsOf(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	mutDB := db.NewBatch()
+	addrs, _, _, _, accHistoryStateStorage := generateAccountsWithStorageAndHistory(t, mutDB, 5, 3)
+	if _, err := mutDB.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := common.HexToAddress("0xdead")
+	accKeys := [][]byte{missing[:]}
+	var storageKeys [][]byte
+	for i := len(addrs) - 1; i >= 0; i-- {
+		accKeys = append(accKeys, addrs[i].Bytes())
+		for k := range accHistoryStateStorage[i] {
+			storageKeys = append(storageKeys, dbutils.PlainGenerateCompositeStorageKey(addrs[i], uint64(i+1), k))
+		}
+	}
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, timestamp := range []uint64{1, 3} {
+		for _, storage := range []bool{false, true} {
+			keys := accKeys
+			if storage {
+				keys = storageKeys
+			}
+			res, err := GetMultiAsOf(db.KV(), true /* plain */, storage, keys, timestamp)
+			assert.NoError(t, err)
+			assert.Len(t, res, len(keys))
+			for i, key := range keys {
+				expected, err := GetAsOf(tx, storage, key, timestamp)
+				if errors.Is(err, ethdb.ErrKeyNotFound) {
+					assert.Nil(t, res[i], "%x", key)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, expected, res[i], "%x", key)
+			}
+		}
+	}
+
+	res, err := GetMultiAsOf(db.KV(), true /* plain */, false /* storage */, nil, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+	_, err = GetMultiAsOf(db.KV(), false /* plain */, false /* storage */, accKeys, 1)
+	assert.Error(t, err)
+}
+
+// BenchmarkGetMultiAsOf compares individual GetAsOf calls, each in its own transaction, with one batched call
+func BenchmarkGetMultiAsOf(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	mutDB := db.NewBatch()
+	addrs, _, _, _, _ := generateAccountsWithStorageAndHistory(b, mutDB, 10_000, 0)
+	if _, err := mutDB.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	keys := make([][]byte, len(addrs))
+	for i := range addrs {
+		keys[i] = addrs[i].Bytes()
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+					_, err := GetAsOf(tx, false /* storage */, key, 1)
+					return err
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := GetMultiAsOf(db.KV(), true /* plain */, false /* storage */, keys, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestWalkAsOfStoragePartialBytes walks over the storage as of block 2 with the prefixes which are not byte aligned.
+// The same synthetic data is written to plain and hashed state, both walks must match the model of the state.
+func TestWalkAsOfStoragePartialBytes(t *testing.T) {
+	const numOfAddrs, numOfKeys = 16, 4
+	type item struct {
+		addr  common.Address
+		key   common.Hash
+		cur   []byte // value in the current state, nil if absent
+		old   []byte // value in the changeset of block 2, nil if not changed
+		asOf2 []byte // expected value as of block 2, nil if absent
+	}
+	var items []item
+	for i := 0; i < numOfAddrs; i++ {
+		var addr common.Address
+		addr[0] = byte(i<<4 | i)
+		addr[1] = byte(i * 37)
+		addr[2] = byte(i * 91)
+		for j := 0; j < numOfKeys; j++ {
+			var key common.Hash
+			key[0] = byte(j * 85)
+			key[1] = byte(i + j)
+			it := item{addr: addr, key: key}
+			switch (i + j) % 4 {
+			case 0: // deleted in block 2
+				it.old = []byte{byte(100 + i + j)}
+				it.asOf2 = it.old
+			case 1: // modified in block 2
+				it.cur = []byte{byte(1 + i + j)}
+				it.old = []byte{byte(100 + i + j)}
+				it.asOf2 = it.old
+			case 2: // created in block 2
+				it.cur = []byte{byte(1 + i + j)}
+				it.old = []byte{}
+			case 3: // not changed
+				it.cur = []byte{byte(1 + i + j)}
+				it.asOf2 = it.cur
+			}
+			items = append(items, it)
+		}
+	}
+
+	const incarnation = 1
+	stateBucket := func(plain bool) (string, int) {
+		if plain {
+			return dbutils.PlainStateBucket, common.AddressLength
+		}
+		return dbutils.CurrentStateBucket, common.HashLength
+	}
+	dbs := make(map[bool]ethdb.Database)
+	for _, plain := range []bool{true, false} {
+		db := ethdb.NewMemDatabase()
+		defer db.Close()
+		dbs[plain] = db
+		bucket, addrLen := stateBucket(plain)
+		csBucket := dbutils.StorageChangeSetBucket
+		cs1, cs2 := changeset.NewStorageChangeSet(), changeset.NewStorageChangeSet()
+		encode := changeset.EncodeStorage
+		if plain {
+			csBucket = dbutils.PlainStorageChangeSetBucket
+			cs1, cs2 = changeset.NewStorageChangeSetPlain(), changeset.NewStorageChangeSetPlain()
+			encode = changeset.EncodeStoragePlain
+		}
+		stateKey := func(it item) []byte {
+			k := make([]byte, addrLen+common.IncarnationLength+common.HashLength)
+			copy(k, it.addr[:])
+			binary.BigEndian.PutUint64(k[addrLen:], incarnation)
+			copy(k[addrLen+common.IncarnationLength:], it.key[:])
+			return k
+		}
+		for _, it := range items {
+			k := stateKey(it)
+			if it.cur != nil {
+				assert.NoError(t, db.Put(bucket, k, it.cur))
+			}
+			if it.key[0] == 0 { // changed in block 1 as well
+				assert.NoError(t, cs1.Add(k, []byte{200}))
+				assert.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.StorageHistoryBucket, dbutils.CompositeKeyWithoutIncarnation(k), roaring.BitmapOf(1)))
+			}
+			if it.old != nil {
+				assert.NoError(t, cs2.Add(k, it.old))
+				assert.NoError(t, bitmapdb.AppendMergeByOr(db, dbutils.StorageHistoryBucket, dbutils.CompositeKeyWithoutIncarnation(k), roaring.BitmapOf(2)))
+			}
+		}
+		for blockNum, cs := range []*changeset.ChangeSet{1: cs1, 2: cs2} {
+			if cs == nil {
+				continue
+			}
+			sort.Sort(cs)
+			v, err := encode(cs)
+			assert.NoError(t, err)
+			assert.NoError(t, db.Put(csBucket, dbutils.EncodeTimestamp(uint64(blockNum)), v))
+		}
+		assert.NoError(t, stages.SaveStageProgress(db, stages.StorageHistoryIndex, 2, nil))
+		assert.NoError(t, stages.SaveStageProgress(db, stages.Execution, 2, nil))
+	}
+
+	walk := func(plain bool, startkey []byte, fixedbits int) map[string][]byte {
+		bucket, addrLen := stateBucket(plain)
+		// same prefix, but the address is padded to the length of the hash in the hashed state
+		key := make([]byte, addrLen+common.IncarnationLength+common.HashLength)
+		if fixedbits <= 8*common.AddressLength {
+			copy(key, startkey[:common.AddressLength])
+		} else {
+			copy(key, startkey[:common.AddressLength])
+			copy(key[addrLen:], startkey[common.AddressLength:])
+			fixedbits += 8 * (addrLen - common.AddressLength)
+		}
+
+		res := make(map[string][]byte)
+		tx, err := dbs[plain].(ethdb.HasKV).KV().Begin(context.Background(), nil, false)
+		assert.NoError(t, err)
+		defer tx.Rollback()
+		assert.NoError(t, WalkAsOf(tx, bucket, dbutils.StorageHistoryBucket, key, fixedbits, 2, func(k, v []byte) (bool, error) {
+			// normalize the key to address + storage key
+			res[string(k[:common.AddressLength])+string(k[addrLen:])] = common.CopyBytes(v)
+			return true, nil
+		}))
+		return res
+	}
+
+	check := func(startkey []byte, fixedbits int) {
+		fixedbytes, mask := ethdb.Bytesmask(fixedbits)
+		expected := make(map[string][]byte)
+		for _, it := range items {
+			k := make([]byte, common.AddressLength+common.IncarnationLength+common.HashLength)
+			copy(k, it.addr[:])
+			binary.BigEndian.PutUint64(k[common.AddressLength:], incarnation)
+			copy(k[common.AddressLength+common.IncarnationLength:], it.key[:])
+			if !bytes.Equal(k[:fixedbytes-1], startkey[:fixedbytes-1]) || k[fixedbytes-1]&mask != startkey[fixedbytes-1]&mask {
+				continue
+			}
+			if it.asOf2 != nil {
+				expected[string(it.addr[:])+string(it.key[:])] = it.asOf2
+			}
+		}
+		for _, plain := range []bool{true, false} {
+			assert.Equal(t, expected, walk(plain, startkey, fixedbits), "plain=%t startkey=%x fixedbits=%d", plain, startkey, fixedbits)
+		}
+	}
+
+	startkey := func(prefix []byte) []byte {
+		k := make([]byte, common.AddressLength+common.IncarnationLength+common.HashLength)
+		copy(k, prefix)
+		return k
+	}
+	// all prefixes of 4 and 12 bits
+	for p := 0; p < 1<<4; p++ {
+		check(startkey([]byte{byte(p << 4)}), 4)
+	}
+	for p := 0; p < 1<<12; p++ {
+		check(startkey([]byte{byte(p >> 4), byte(p << 4)}), 12)
+	}
+	// prefixes of 20 bits around each address
+	for i := 0; i < numOfAddrs; i++ {
+		addr := items[i*numOfKeys].addr
+		p := uint32(addr[0])<<12 | uint32(addr[1])<<4 | uint32(addr[2])>>4
+		for _, q := range []uint32{p - 1, p, p + 1} {
+			check(startkey([]byte{byte(q >> 12), byte(q >> 4), byte(q << 4)}), 20)
+		}
+	}
+	// prefix of 4 bits of the storage key in every address
+	for i := 0; i < numOfAddrs; i++ {
+		for p := 0; p < 1<<4; p++ {
+			k := startkey(items[i*numOfKeys].addr[:])
+			binary.BigEndian.PutUint64(k[common.AddressLength:], incarnation)
+			k[common.AddressLength+common.IncarnationLength] = byte(p << 4)
+			check(k, 8*(common.AddressLength+common.IncarnationLength)+4)
+		}
+	}
+}
+
+// changesets which are not indexed yet are merged by the changesetSearchDecorator
+func BenchmarkWalkAsOfNotIndexedChangesets(b *testing.B) {
+	const blocks, changesPerBlock = 100, 1000 // 100k changes
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	for blockNum := uint64(1); blockNum <= blocks; blockNum++ {
+		cs := changeset.NewAccountChangeSetPlain()
+		for i := 0; i < changesPerBlock; i++ {
+			var addr common.Address
+			binary.BigEndian.PutUint64(addr[:], uint64(i)*blocks+blockNum%7)
+			if err := cs.Add(addr[:], []byte{byte(blockNum)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		v, err := changeset.EncodeAccountsPlain(cs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(blockNum), v); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := stages.SaveStageProgress(db, stages.Execution, blocks, nil); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var count int
+		if err := db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+			return WalkAsOf(tx, dbutils.PlainStateBucket, dbutils.AccountsHistoryBucket, []byte{}, 0, 1, func(k []byte, v []byte) (bool, error) {
+				count++
+				return true, nil
+			})
+		}); err != nil {
+			b.Fatal(err)
+		}
+		if count != 7*changesPerBlock {
+			b.Fatalf("expected %d accounts, got %d", 7*changesPerBlock, count)
+		}
+	}
+}
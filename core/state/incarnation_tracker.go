@@ -0,0 +1,67 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// IncarnationTracker remembers incarnations of the deleted contracts, for the cases when contracts
+// are deleted and recreated before the deletion reaches IncarnationMapBucket.
+// It's safe for concurrent use.
+type IncarnationTracker struct {
+	mu           sync.RWMutex
+	incarnations map[common.Address]uint64
+}
+
+func NewIncarnationTracker() *IncarnationTracker {
+	return &IncarnationTracker{incarnations: make(map[common.Address]uint64)}
+}
+
+func (t *IncarnationTracker) Get(address common.Address) (uint64, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	inc, ok := t.incarnations[address]
+	return inc, ok
+}
+
+// SetIfHigher remembers the incarnation unless a higher one is already known
+func (t *IncarnationTracker) SetIfHigher(address common.Address, incarnation uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if incarnation > t.incarnations[address] {
+		t.incarnations[address] = incarnation
+	}
+}
+
+func (t *IncarnationTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.incarnations = make(map[common.Address]uint64)
+}
+
+// FlushToDB writes remembered incarnations into IncarnationMapBucket, in the order of addresses
+func (t *IncarnationTracker) FlushToDB(db ethdb.Putter) error {
+	t.mu.RLock()
+	addresses := make([]common.Address, 0, len(t.incarnations))
+	values := make(map[common.Address]uint64, len(t.incarnations))
+	for address, inc := range t.incarnations {
+		addresses = append(addresses, address)
+		values[address] = inc
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+	for _, address := range addresses {
+		if err := db.Put(dbutils.IncarnationMapBucket, common.CopyBytes(address[:]), dbutils.EncodeBlockNumber(values[address])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
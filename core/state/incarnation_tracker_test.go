@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncarnationTrackerConcurrent(t *testing.T) {
+	tracker := NewIncarnationTracker()
+	addresses := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for inc := uint64(1); inc <= 1000; inc++ {
+				for i, address := range addresses {
+					tracker.SetIfHigher(address, inc*uint64(i+1)+uint64(w))
+					_, ok := tracker.Get(address)
+					require.True(t, ok)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i, address := range addresses {
+		inc, ok := tracker.Get(address)
+		require.True(t, ok)
+		require.Equal(t, 1000*uint64(i+1)+7, inc)
+	}
+	// lower incarnation doesn't override
+	tracker.SetIfHigher(addresses[0], 1)
+	inc, _ := tracker.Get(addresses[0])
+	require.Equal(t, uint64(1007), inc)
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	require.NoError(t, tracker.FlushToDB(db))
+	for i, address := range addresses {
+		v, err := db.Get(dbutils.IncarnationMapBucket, address[:])
+		require.NoError(t, err)
+		require.Equal(t, dbutils.EncodeBlockNumber(1000*uint64(i+1)+7), v)
+	}
+
+	tracker.Reset()
+	_, ok := tracker.Get(addresses[0])
+	require.False(t, ok)
+}
+
+// TestIncarnationTrackerDeleteAccountRace - DeleteAccount of the writers of several buffers races SetIfHigher,
+// run with -race
+func TestIncarnationTrackerDeleteAccountRace(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tds := NewTrieDbState(common.Hash{}, db, 1)
+	addresses := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(writer *TrieStateWriter) {
+			defer wg.Done()
+			for inc := uint64(1); inc <= 1000; inc++ {
+				for _, address := range addresses {
+					require.NoError(t, writer.DeleteAccount(context.Background(), address, &accounts.Account{Incarnation: 2 * inc}))
+				}
+			}
+		}(tds.WithNewBuffer().TrieStateWriter())
+		go func() {
+			defer wg.Done()
+			for inc := uint64(1); inc <= 1000; inc++ {
+				for _, address := range addresses {
+					tds.incarnations.SetIfHigher(address, 2*inc+1)
+					_, ok := tds.incarnations.Get(address)
+					require.True(t, ok)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, address := range addresses {
+		inc, err := tds.ReadAccountIncarnation(address)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2001), inc)
+	}
+}
+
+func TestIncarnationTrackerSurvivesRestart(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	address := common.HexToAddress("0x01")
+	tds := NewTrieDbState(common.Hash{}, db, 1)
+	require.NoError(t, tds.TrieStateWriter().DeleteAccount(context.Background(), address, &accounts.Account{Incarnation: 5}))
+
+	// the commit of the blocks evicts the tries
+	tds.EvictTries(false)
+	_, ok := tds.incarnations.Get(address)
+	require.False(t, ok, "flushed")
+	inc, err := tds.ReadAccountIncarnation(address)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), inc)
+
+	restarted := NewTrieDbState(common.Hash{}, db, 1)
+	inc, err = restarted.ReadAccountIncarnation(address)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), inc)
+}
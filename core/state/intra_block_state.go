@@ -164,6 +164,14 @@ func (sdb *IntraBlockState) Copy() *IntraBlockState {
 	return ibs
 }
 
+// SetStateReader replaces the reader of the data which is not in the state yet,
+// e.g. to continue the execution in another database transaction.
+func (sdb *IntraBlockState) SetStateReader(stateReader StateReader) {
+	sdb.Lock()
+	defer sdb.Unlock()
+	sdb.stateReader = stateReader
+}
+
 func (sdb *IntraBlockState) SetTracer(tracer StateTracer) {
 	sdb.Lock()
 	defer sdb.Unlock()
@@ -8,7 +8,6 @@ import (
 	"github.com/holiman/uint256"
 
 	"github.com/ledgerwatch/turbo-geth/common"
-	"github.com/ledgerwatch/turbo-geth/common/changeset"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -148,12 +147,7 @@ func (w *PlainStateWriter) WriteChangeSets() error {
 	if w.changeSetsDB != nil {
 		db = w.changeSetsDB
 	}
-	accountChanges, err := w.csw.GetAccountChanges()
-	if err != nil {
-		return err
-	}
-	var accountSerialised []byte
-	accountSerialised, err = changeset.EncodeAccountsPlain(accountChanges)
+	accountSerialised, err := w.csw.EncodeAccountChanges()
 	if err != nil {
 		return err
 	}
@@ -161,16 +155,11 @@ func (w *PlainStateWriter) WriteChangeSets() error {
 	if err = db.Append(dbutils.PlainAccountChangeSetBucket, key, accountSerialised); err != nil {
 		return err
 	}
-	storageChanges, err := w.csw.GetStorageChanges()
+	storageSerialized, err := w.csw.EncodeStorageChanges()
 	if err != nil {
 		return err
 	}
-	var storageSerialized []byte
-	if storageChanges.Len() > 0 {
-		storageSerialized, err = changeset.EncodeStoragePlain(storageChanges)
-		if err != nil {
-			return err
-		}
+	if storageSerialized != nil {
 		if err = db.Append(dbutils.PlainStorageChangeSetBucket, key, storageSerialized); err != nil {
 			return err
 		}
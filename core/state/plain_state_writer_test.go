@@ -0,0 +1,187 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlainStateWriterRoundTrip(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+	contract := common.HexToAddress("0xc0de")
+	selfDestructed := common.HexToAddress("0xdead")
+	eoa := common.HexToAddress("0x01")
+	key1, key2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	code := []byte{0x60, 0x00}
+	codeHash := crypto.Keccak256Hash(code)
+
+	newAccount := func(balance uint64, incarnation uint64) *accounts.Account {
+		acc := accounts.NewAccount()
+		acc.Initialised = true
+		acc.Balance = *uint256.NewInt().SetUint64(balance)
+		acc.Incarnation = incarnation
+		if incarnation > 0 {
+			acc.CodeHash = codeHash
+		}
+		return &acc
+	}
+	empty := accounts.NewAccount()
+	commit := func(w *PlainStateWriter) {
+		require.NoError(t, w.WriteChangeSets())
+		require.NoError(t, w.WriteHistory())
+	}
+
+	// block 1: contracts with storage and an EOA are created
+	w := NewPlainStateWriter(db, nil, 1)
+	for _, addr := range []common.Address{contract, selfDestructed} {
+		require.NoError(t, w.CreateContract(addr))
+		require.NoError(t, w.UpdateAccountCode(addr, 1, codeHash, code))
+		require.NoError(t, w.WriteAccountStorage(ctx, addr, 1, &key1, uint256.NewInt(), uint256.NewInt().SetUint64(1)))
+		require.NoError(t, w.WriteAccountStorage(ctx, addr, 1, &key2, uint256.NewInt(), uint256.NewInt().SetUint64(2)))
+		require.NoError(t, w.UpdateAccountData(ctx, addr, &empty, newAccount(1, 1)))
+	}
+	require.NoError(t, w.UpdateAccountData(ctx, eoa, &empty, newAccount(5, 0)))
+	commit(w)
+
+	// block 2: storage is modified and zeroed, accounts are deleted
+	w = NewPlainStateWriter(db, nil, 2)
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key1, uint256.NewInt().SetUint64(1), uint256.NewInt().SetUint64(3)))
+	require.NoError(t, w.WriteAccountStorage(ctx, contract, 1, &key2, uint256.NewInt().SetUint64(2), uint256.NewInt()))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, newAccount(1, 1), newAccount(1, 1)))
+	require.NoError(t, w.DeleteAccount(ctx, selfDestructed, newAccount(1, 1)))
+	require.NoError(t, w.DeleteAccount(ctx, eoa, newAccount(5, 0)))
+	commit(w)
+
+	// current state
+	_, err := db.Get(dbutils.PlainStateBucket, dbutils.PlainGenerateCompositeStorageKey(contract, 1, key2))
+	require.True(t, errors.Is(err, ethdb.ErrKeyNotFound), "zero value must be deleted")
+	v, err := db.Get(dbutils.PlainContractCodeBucket, dbutils.PlainGenerateStoragePrefix(contract[:], 1))
+	require.NoError(t, err)
+	require.Equal(t, codeHash[:], v)
+	v, err = db.Get(dbutils.IncarnationMapBucket, selfDestructed[:])
+	require.NoError(t, err)
+	require.Equal(t, dbutils.EncodeBlockNumber(1), v)
+	_, err = db.Get(dbutils.IncarnationMapBucket, eoa[:])
+	require.True(t, errors.Is(err, ethdb.ErrKeyNotFound))
+
+	tx, err := db.KV().Begin(ctx, nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	balanceAt := func(addr common.Address, timestamp uint64) (uint64, bool) {
+		v, err := GetAsOf(tx, false /* storage */, addr[:], timestamp)
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return 0, false
+		}
+		require.NoError(t, err)
+		if len(v) == 0 {
+			return 0, false
+		}
+		var acc accounts.Account
+		require.NoError(t, acc.DecodeForStorage(v))
+		if acc.Incarnation > 0 {
+			require.Equal(t, codeHash, acc.CodeHash)
+		}
+		return acc.Balance.Uint64(), true
+	}
+	storageAt := func(addr common.Address, key common.Hash, timestamp uint64) []byte {
+		v, err := GetAsOf(tx, true /* storage */, dbutils.PlainGenerateCompositeStorageKey(addr, 1, key), timestamp)
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil
+		}
+		require.NoError(t, err)
+		if len(v) == 0 {
+			return nil
+		}
+		return v
+	}
+
+	for _, addr := range []common.Address{contract, selfDestructed, eoa} {
+		_, exists := balanceAt(addr, 1)
+		require.False(t, exists)
+		require.Nil(t, storageAt(addr, key1, 1))
+	}
+
+	balance, exists := balanceAt(eoa, 2)
+	require.True(t, exists)
+	require.Equal(t, uint64(5), balance)
+	_, exists = balanceAt(eoa, 3)
+	require.False(t, exists)
+	balance, exists = balanceAt(selfDestructed, 2)
+	require.True(t, exists)
+	require.Equal(t, uint64(1), balance)
+	_, exists = balanceAt(selfDestructed, 3)
+	require.False(t, exists)
+	balance, exists = balanceAt(contract, 3)
+	require.True(t, exists)
+	require.Equal(t, uint64(1), balance)
+
+	require.Equal(t, []byte{1}, storageAt(contract, key1, 2))
+	require.Equal(t, []byte{2}, storageAt(contract, key2, 2))
+	require.Equal(t, []byte{3}, storageAt(contract, key1, 3))
+	require.Nil(t, storageAt(contract, key2, 3))
+}
+
+func TestGetCodeAsOfRecreatedContract(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	ctx := context.Background()
+	contract := common.HexToAddress("0xc0de")
+	code1, code2 := []byte{0x60, 0x01}, []byte{0x60, 0x02}
+	codeHash1, codeHash2 := crypto.Keccak256Hash(code1), crypto.Keccak256Hash(code2)
+	newContract := func(balance uint64, incarnation uint64, codeHash common.Hash) *accounts.Account {
+		acc := accounts.NewAccount()
+		acc.Initialised = true
+		acc.Balance = *uint256.NewInt().SetUint64(balance)
+		acc.Incarnation = incarnation
+		acc.CodeHash = codeHash
+		return &acc
+	}
+	empty := accounts.NewAccount()
+	commit := func(w *PlainStateWriter) {
+		require.NoError(t, w.WriteChangeSets())
+		require.NoError(t, w.WriteHistory())
+	}
+
+	// block 1: created with code1
+	w := NewPlainStateWriter(db, nil, 1)
+	require.NoError(t, w.CreateContract(contract))
+	require.NoError(t, w.UpdateAccountCode(contract, 1, codeHash1, code1))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, &empty, newContract(1, 1, codeHash1)))
+	commit(w)
+	// block 2: self-destructed
+	w = NewPlainStateWriter(db, nil, 2)
+	require.NoError(t, w.DeleteAccount(ctx, contract, newContract(1, 1, codeHash1)))
+	commit(w)
+	// block 3: recreated with code2
+	w = NewPlainStateWriter(db, nil, 3)
+	require.NoError(t, w.CreateContract(contract))
+	require.NoError(t, w.UpdateAccountCode(contract, 2, codeHash2, code2))
+	require.NoError(t, w.UpdateAccountData(ctx, contract, &empty, newContract(1, 2, codeHash2)))
+	commit(w)
+	// block 4: balance changes, code hash is omitted in the changeset
+	w = NewPlainStateWriter(db, nil, 4)
+	require.NoError(t, w.UpdateAccountData(ctx, contract, newContract(1, 2, codeHash2), newContract(2, 2, codeHash2)))
+	commit(w)
+
+	tx, err := db.KV().Begin(ctx, nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	for timestamp, expected := range map[uint64][]byte{1: nil, 2: code1, 3: nil, 4: code2, 5: code2} {
+		code, err := GetCodeAsOf(tx, true /* plain */, contract[:], timestamp)
+		require.NoError(t, err)
+		require.Equal(t, expected, code, "timestamp %d", timestamp)
+	}
+	_, err = GetCodeAsOf(tx, false /* plain */, contract[:], 1)
+	require.Error(t, err)
+}
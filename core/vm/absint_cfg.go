@@ -0,0 +1,368 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CfgVerbosity selects how much of the analysis result is printed by Render
+type CfgVerbosity int
+
+const (
+	CfgQuiet   CfgVerbosity = iota // Nothing is printed
+	CfgSummary                     // Edge counts, bad jumps and failures
+	CfgFull                        // Summary, annotated listing of the program and the cfg.dot file
+)
+
+// CfgEdge is a possible transition of the execution from one statement to another
+type CfgEdge struct {
+	From      int  `json:"from"`
+	To        int  `json:"to"`
+	IsJump    bool `json:"isJump"`
+	Reachable bool `json:"reachable"` // The edge is reachable from the entry of the program
+}
+
+// CfgStmt is the metadata of the statement at a program counter
+type CfgStmt struct {
+	PC             int    `json:"pc"`
+	Opcode         string `json:"opcode"`
+	NumBytes       int    `json:"numBytes"`
+	InferredAsData bool   `json:"inferredAsData"`
+	Reachable      bool   `json:"reachable"`
+}
+
+// CfgBadJump is a jump whose destination could not be resolved
+type CfgBadJump struct {
+	PC           int      `json:"pc"`
+	Widened      bool     `json:"widened"`      // The state of the jump was widened, which may be the cause
+	Destinations []string `json:"destinations"` // Abstract values of the destination, ⊤ values carry the pc where they were produced
+	Sources      []string `json:"sources"`      // Opcodes that produced the ⊤ destinations
+}
+
+// CfgAnalysisResult is the outcome of AbsIntCfgHarness. It can be marshalled into JSON
+type CfgAnalysisResult struct {
+	Edges    []CfgEdge          `json:"edges"`
+	Stmts    []CfgStmt          `json:"stmts"`
+	States   map[int][][]string `json:"states"` // Sets of abstract stacks for each reached program counter, top first
+	BadJumps []CfgBadJump       `json:"badJumps"`
+	Widened  []int              `json:"widened"`            // Program counters where the states were widened
+	Failures []string           `json:"failures,omitempty"` // Errors that did not stop the analysis
+	Error    string             `json:"error,omitempty"`    // Error that stopped the analysis, the result is then partial
+
+	program *program
+	anly    *anlyResult
+}
+
+// AbsIntCfgHarness runs the abstract interpretation of the contract code and returns the control flow graph.
+// The result is returned, possibly partial, together with the error if the analysis failed or found bad jumps
+func AbsIntCfgHarness(contract *Contract) (*CfgAnalysisResult, error) {
+	return AbsIntCfgHarnessWithTimeout(contract, 0)
+}
+
+// AbsIntCfgHarnessWithTimeout is AbsIntCfgHarness which gives up with ErrTimeout (and a partial result) after
+// the timeout, unless it is zero
+func AbsIntCfgHarnessWithTimeout(contract *Contract, timeout time.Duration) (*CfgAnalysisResult, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	program := toProgram(contract)
+	res, err := analyseUntil(program, deadline)
+	result := newCfgAnalysisResult(program, res)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	if len(res.badJumps) > 0 {
+		return result, fmt.Errorf("%d bad jumps found, %d of them after widening", len(res.badJumps), len(res.widenedJumps))
+	}
+	return result, nil
+}
+
+func newCfgAnalysisResult(program *program, res *anlyResult) *CfgAnalysisResult {
+	result := &CfgAnalysisResult{
+		States:   make(map[int][][]string),
+		Failures: res.failures,
+		program:  program,
+		anly:     res,
+	}
+	reachablePCs := map[int]bool{0: true}
+	for _, e := range res.edges {
+		reachable := res.reachable[[2]int{e.pc0, e.pc1}]
+		if reachable {
+			reachablePCs[e.pc0] = true
+			reachablePCs[e.pc1] = true
+		}
+		result.Edges = append(result.Edges, CfgEdge{From: e.pc0, To: e.pc1, IsJump: e.isJump, Reachable: reachable})
+	}
+	for _, stmt := range program.stmts {
+		result.Stmts = append(result.Stmts, CfgStmt{
+			PC:             stmt.pc,
+			Opcode:         stmt.opcode.String(),
+			NumBytes:       stmt.numBytes,
+			InferredAsData: stmt.inferredAsData,
+			Reachable:      reachablePCs[stmt.pc],
+		})
+		st := res.D[stmt.pc]
+		if st == nil || len(st.stackset) == 0 {
+			continue
+		}
+		stacks := make([][]string, 0, len(st.stackset))
+		for _, stack := range st.stackset {
+			values := make([]string, 0, len(stack.values))
+			for _, value := range stack.values {
+				values = append(values, value.String(false))
+			}
+			stacks = append(stacks, values)
+		}
+		result.States[stmt.pc] = stacks
+	}
+	for pc := range res.widenings {
+		result.Widened = append(result.Widened, pc)
+	}
+	sort.Ints(result.Widened)
+	badPCs := make([]int, 0, len(res.badJumps))
+	for pc := range res.badJumps {
+		badPCs = append(badPCs, pc)
+	}
+	sort.Ints(badPCs)
+	for _, pc := range badPCs {
+		badJump := CfgBadJump{PC: pc, Widened: res.widenedJumps[pc]}
+		var values []AbsValue
+		for _, stack := range res.D[pc].stackset {
+			value := stack.values[0]
+			if !ExistsIn(values, value) {
+				values = append(values, value)
+				badJump.Destinations = append(badJump.Destinations, value.String(false))
+			}
+			if value.kind == TopValue && !value.fromDeepStack {
+				source := program.stmts[value.pc].opcode.String()
+				var seen bool
+				for _, s := range badJump.Sources {
+					seen = seen || s == source
+				}
+				if !seen {
+					badJump.Sources = append(badJump.Sources, source)
+				}
+			}
+		}
+		result.BadJumps = append(result.BadJumps, badJump)
+	}
+	return result
+}
+
+// ReachableEdges returns the number of edges reachable from the entry of the program
+func (r *CfgAnalysisResult) ReachableEdges() int {
+	var n int
+	for _, e := range r.Edges {
+		if e.Reachable {
+			n++
+		}
+	}
+	return n
+}
+
+// Render prints the result to the standard output, with the given verbosity
+func (r *CfgAnalysisResult) Render(verbosity CfgVerbosity) {
+	if verbosity == CfgQuiet {
+		return
+	}
+	if verbosity >= CfgFull {
+		printAnlyState(r.program, r.anly.prevEdgeMap, r.anly.D, nil)
+		if len(r.BadJumps) > 0 {
+			printAnlyState(r.program, r.anly.prevEdgeMap, r.anly.D, r.anly.badJumps)
+		}
+	}
+	fmt.Printf("\n# of unreachable edges: %v\n", len(r.Edges)-r.ReachableEdges())
+	fmt.Printf("# of total edges: %v\n", len(r.Edges))
+	if len(r.Widened) > 0 {
+		fmt.Printf("States widened at pc=%v\n", r.Widened)
+	}
+	for _, badJump := range r.BadJumps {
+		var widened string
+		if badJump.Widened {
+			widened = " (after widening)"
+		}
+		fmt.Printf("Bad jump at pc=%v%s, destinations: %s\n", badJump.PC, widened, strings.Join(badJump.Destinations, ","))
+	}
+	for _, failure := range r.Failures {
+		fmt.Printf("FAILURE: %s\n", failure)
+	}
+	if r.Error != "" {
+		fmt.Printf("FAILURE: %s\n", r.Error)
+	}
+}
+
+// cfgBlock is a basic block: a sequence of statements entered only at the first one and left only after the last one
+type cfgBlock struct {
+	stmts     []CfgStmt
+	reachable bool
+	badJump   bool
+}
+
+// Dot renders the control flow graph in the Graphviz DOT format. Statements are grouped into basic blocks,
+// edges are labelled with the jump opcode, blocks with bad jumps are red and unreachable blocks are gray
+func (r *CfgAnalysisResult) Dot() string {
+	// Edges from push data are artifacts of resolving every program counter
+	isData := make(map[int]bool)
+	for _, stmt := range r.Stmts {
+		isData[stmt.PC] = stmt.InferredAsData
+	}
+	incoming := make(map[int][]CfgEdge)
+	outgoing := make(map[int][]CfgEdge)
+	for _, e := range r.Edges {
+		if isData[e.From] {
+			continue
+		}
+		incoming[e.To] = append(incoming[e.To], e)
+		outgoing[e.From] = append(outgoing[e.From], e)
+	}
+	badJumps := make(map[int]bool)
+	for _, badJump := range r.BadJumps {
+		badJumps[badJump.PC] = true
+	}
+
+	var blocks []*cfgBlock
+	var prev *CfgStmt
+	for i := range r.Stmts {
+		stmt := r.Stmts[i]
+		if stmt.InferredAsData {
+			continue
+		}
+		startsBlock := prev == nil || len(incoming[stmt.PC]) != 1 || incoming[stmt.PC][0].IsJump ||
+			len(outgoing[prev.PC]) != 1 || outgoing[prev.PC][0].To != stmt.PC
+		if startsBlock {
+			blocks = append(blocks, &cfgBlock{reachable: stmt.Reachable})
+		}
+		block := blocks[len(blocks)-1]
+		block.stmts = append(block.stmts, stmt)
+		block.badJump = block.badJump || badJumps[stmt.PC]
+		prev = &r.Stmts[i]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("digraph cfg {\n")
+	sb.WriteString("\tnode [shape=box fontname=\"monospace\"];\n")
+	for _, block := range blocks {
+		fmt.Fprintf(&sb, "\tb%d [label=\"", block.stmts[0].PC)
+		for _, stmt := range block.stmts {
+			fmt.Fprintf(&sb, "%d: %s\\l", stmt.PC, stmt.Opcode)
+		}
+		sb.WriteString("\"")
+		if block.badJump {
+			sb.WriteString(" style=filled fillcolor=red")
+		} else if !block.reachable {
+			sb.WriteString(" style=filled fillcolor=gray")
+		}
+		sb.WriteString("];\n")
+	}
+	for _, block := range blocks {
+		last := block.stmts[len(block.stmts)-1]
+		for _, e := range outgoing[last.PC] {
+			if e.IsJump {
+				fmt.Fprintf(&sb, "\tb%d -> b%d [label=\"%s\"];\n", block.stmts[0].PC, e.To, last.Opcode)
+			} else {
+				fmt.Fprintf(&sb, "\tb%d -> b%d;\n", block.stmts[0].PC, e.To)
+			}
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// CreationCfgAnalysisResult is the outcome of AbsIntCreationCfgHarness: the analysis of the creation code,
+// and the analysis of the runtime code it returns
+type CreationCfgAnalysisResult struct {
+	Constructor       *CfgAnalysisResult `json:"constructor"`
+	Runtime           *CfgAnalysisResult `json:"runtime,omitempty"`
+	RuntimeOffset     uint64             `json:"runtimeOffset"`
+	RuntimeLength     uint64             `json:"runtimeLength"`
+	RuntimeUnresolved bool               `json:"runtimeUnresolved"` // The runtime code could not be located statically
+}
+
+// AbsIntCreationCfgHarness analyses the creation code of a contract. If the constructor ends with the canonical
+// CODECOPY of the runtime code into memory followed by the RETURN of that memory, and their operands are
+// constants, the runtime code is analysed separately, otherwise only the constructor result is returned
+func AbsIntCreationCfgHarness(contract *Contract) (*CreationCfgAnalysisResult, error) {
+	constructor, err := AbsIntCfgHarness(contract)
+	result := &CreationCfgAnalysisResult{Constructor: constructor}
+	offset, length, ok := constructor.runtimeSegment()
+	if !ok || offset+length < offset || offset+length > uint64(len(contract.Code)) {
+		result.RuntimeUnresolved = true
+		return result, err
+	}
+	result.RuntimeOffset, result.RuntimeLength = offset, length
+
+	runtimeContract := NewContract(contract.caller, contract.self, contract.value, contract.Gas, contract.skipAnalysis)
+	runtimeContract.Code = contract.Code[offset : offset+length]
+	var runtimeErr error
+	result.Runtime, runtimeErr = AbsIntCfgHarness(runtimeContract)
+	if err == nil {
+		err = runtimeErr
+	}
+	return result, err
+}
+
+// concreteOperand returns the value at the given depth of the stack, if it is the same constant in all stacks
+func concreteOperand(st *astate, depth int) (uint64, bool) {
+	if st == nil || len(st.stackset) == 0 {
+		return 0, false
+	}
+	var operand uint64
+	for i, stack := range st.stackset {
+		value := stack.values[depth]
+		if value.kind != ConcreteValue || !value.value.IsUint64() {
+			return 0, false
+		}
+		if i > 0 && value.value.Uint64() != operand {
+			return 0, false
+		}
+		operand = value.value.Uint64()
+	}
+	return operand, true
+}
+
+// runtimeSegment finds the code copied by CODECOPY into the memory returned by RETURN
+func (r *CfgAnalysisResult) runtimeSegment() (offset uint64, length uint64, found bool) {
+	type codeCopy struct {
+		dest, offset, length uint64
+	}
+	var copies []codeCopy
+	var returns [][2]uint64 // memory offset and length
+	for _, stmt := range r.program.stmts {
+		if stmt.inferredAsData {
+			continue
+		}
+		st := r.anly.D[stmt.pc]
+		switch stmt.opcode {
+		case CODECOPY:
+			dest, ok0 := concreteOperand(st, 0)
+			codeOffset, ok1 := concreteOperand(st, 1)
+			codeLength, ok2 := concreteOperand(st, 2)
+			if ok0 && ok1 && ok2 {
+				copies = append(copies, codeCopy{dest: dest, offset: codeOffset, length: codeLength})
+			}
+		case RETURN:
+			memOffset, ok0 := concreteOperand(st, 0)
+			memLength, ok1 := concreteOperand(st, 1)
+			if ok0 && ok1 {
+				returns = append(returns, [2]uint64{memOffset, memLength})
+			}
+		}
+	}
+	for _, c := range copies {
+		for _, ret := range returns {
+			if c.dest != ret[0] || c.length != ret[1] {
+				continue
+			}
+			if found && (c.offset != offset || c.length != length) {
+				// Different runtime code returned on different paths
+				return 0, 0, false
+			}
+			offset, length, found = c.offset, c.length, true
+		}
+	}
+	return offset, length, found
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func TestCfgAnalysisResult(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x09, byte(PUSH1), 0x00, byte(MSTORE),
+		byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP),
+		byte(JUMPDEST), byte(STOP),
+	}
+	result, err := AbsIntCfgHarness(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The push data at pc=1 is decoded as MULMOD, with an unreachable edge to pc=2
+	if len(result.Edges) != 8 || result.ReachableEdges() != 7 {
+		t.Errorf("expected 8 edges (7 reachable), got %d (%d reachable)", len(result.Edges), result.ReachableEdges())
+	}
+	if len(result.BadJumps) != 0 {
+		t.Errorf("expected no bad jumps, got %+v", result.BadJumps)
+	}
+	if jump := result.Edges[6]; jump != (CfgEdge{From: 8, To: 9, IsJump: true, Reachable: true}) {
+		t.Errorf("unexpected jump edge %+v", jump)
+	}
+	if stmt := result.Stmts[1]; !stmt.InferredAsData || stmt.Reachable {
+		t.Errorf("expected unreachable push data at pc=1, got %+v", stmt)
+	}
+	if stmt := result.Stmts[10]; stmt.Opcode != "STOP" || !stmt.Reachable {
+		t.Errorf("expected reachable STOP at pc=10, got %+v", stmt)
+	}
+	if stacks := result.States[9]; len(stacks) != 1 || len(stacks[0]) != absStackLen {
+		t.Errorf("expected one stack at pc=9, got %v", stacks)
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CfgAnalysisResult
+	if err = json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Edges, result.Edges) || !reflect.DeepEqual(decoded.Stmts, result.Stmts) || !reflect.DeepEqual(decoded.States, result.States) {
+		t.Errorf("result changed after JSON round trip")
+	}
+}
+
+func TestCfgAnalysisResultBadJump(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x10, byte(PUSH1), 0x00, byte(MSTORE),
+		byte(PUSH1), 0x20, byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(CALLDATACOPY),
+		byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP),
+		byte(JUMPDEST), byte(STOP),
+	}
+	result, err := AbsIntCfgHarness(contract)
+	if err == nil || result.Error == "" {
+		t.Errorf("expected the analysis to fail")
+	}
+	expected := []CfgBadJump{{PC: 15, Destinations: []string{"⊤14"}, Sources: []string{"MLOAD"}}}
+	if !reflect.DeepEqual(result.BadJumps, expected) {
+		t.Errorf("expected bad jumps %+v, got %+v", expected, result.BadJumps)
+	}
+}
+
+func TestCfgDot(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x05, byte(JUMP),
+		byte(CALLVALUE), byte(JUMP), // unreachable
+		byte(JUMPDEST), byte(CALLVALUE), byte(JUMP), // bad jump
+	}
+	result, _ := AbsIntCfgHarness(contract)
+	expected, err := ioutil.ReadFile("testdata/absint_cfg.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dot := result.Dot(); dot != string(expected) {
+		t.Errorf("unexpected DOT output:\n%s\nexpected:\n%s", dot, expected)
+	}
+}
+
+func TestCfgAnalysisTimeout(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{byte(PUSH1), 0x00, byte(JUMPDEST), byte(PUSH1), 0x02, byte(JUMP)}
+	result, err := AbsIntCfgHarnessWithTimeout(contract, time.Nanosecond)
+	if !errors.Is(err, ErrTimeout) || result.Error != ErrTimeout.Error() {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestCreationCfgAnalysis(t *testing.T) {
+	// Creation code of tests/contracts/selfDestructor.sol
+	bin, err := ioutil.ReadFile("testdata/selfDestructor.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := hex.DecodeString(strings.TrimSpace(string(bin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = code
+	result, err := AbsIntCreationCfgHarness(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RuntimeUnresolved || result.RuntimeOffset != 0x23 || result.RuntimeLength != 0x88 {
+		t.Fatalf("expected runtime code at 0x23 of length 0x88, got %+v", result)
+	}
+	if len(result.Constructor.BadJumps) != 0 || len(result.Runtime.BadJumps) != 0 {
+		t.Errorf("expected no bad jumps, got %d in constructor, %d in runtime", len(result.Constructor.BadJumps), len(result.Runtime.BadJumps))
+	}
+	if len(result.Runtime.Stmts) != 0x88 {
+		t.Errorf("expected runtime code to be analysed on its own, got %d statements", len(result.Runtime.Stmts))
+	}
+}
+
+func TestCreationCfgAnalysisUnresolved(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x10, byte(DUP1),
+		byte(PUSH1), 0x00, byte(CALLDATALOAD), // runtime code offset is not a constant
+		byte(PUSH1), 0x00, byte(CODECOPY),
+		byte(PUSH1), 0x00, byte(RETURN),
+	}
+	result, err := AbsIntCreationCfgHarness(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.RuntimeUnresolved || result.Runtime != nil {
+		t.Errorf("expected the runtime code to be unresolved, got %+v", result)
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"github.com/holiman/uint256"
 	"github.com/logrusorgru/aurora"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //////////////////////////////////////////////////
@@ -22,6 +24,27 @@ const (
 var DEBUG = false
 var StopOnError = true
 
+// MaxArithStackSetSize is the number of stacks in a state above which the values computed by arithmetic
+// are widened to ⊤. Without it, loops that count with concrete values would never converge
+var MaxArithStackSetSize = 32
+
+// MaxStackSetSize is the number of stacks in the state at a join point above which the state is widened
+// into a single stack, with ⊤ wherever the stacks differ
+var MaxStackSetSize = 256
+
+// MaxStateUpdates is the number of updates of the state at a join point after which it is widened like
+// a state with more than MaxStackSetSize stacks
+var MaxStateUpdates = 128
+
+// MaxAnlyIterations is the number of worklist iterations after which the analysis gives up, returning a partial result
+var MaxAnlyIterations = 1 << 20
+
+// ErrTimeout is returned when the analysis does not finish before its deadline, the result is then partial
+var ErrTimeout = errors.New("abstract interpretation timed out")
+
+// deadlineCheckInterval is the number of worklist iterations between the checks of the deadline
+const deadlineCheckInterval = 256
+
 //////////////////////////
 
 // stmt is the representation of an executable instruction - extension of an opcode
@@ -234,8 +257,9 @@ func (d AbsValueKind) String() string {
 type AbsValue struct {
 	kind          AbsValueKind
 	value         uint256.Int //only when kind=ConcreteValue
-	pc            int         //only when kind=TopValue
+	pc            int         //when kind=TopValue, or kind=ConcreteValue and computed
 	fromDeepStack bool        //only when Kind=TopValue
+	computed      bool        //only when kind=ConcreteValue, value is the result of arithmetic
 }
 
 func (c0 AbsValue) String(abbrev bool) string {
@@ -264,6 +288,10 @@ func AbsValueConcrete(value uint256.Int) AbsValue {
 	return AbsValue{kind: ConcreteValue, value: value}
 }
 
+func absValueComputed(value uint256.Int, pc int) AbsValue {
+	return AbsValue{kind: ConcreteValue, value: value, pc: pc, computed: true}
+}
+
 func (c0 AbsValue) Eq(c1 AbsValue) bool {
 	if c0.kind != c1.kind {
 		return false
@@ -279,13 +307,22 @@ func (c0 AbsValue) Eq(c1 AbsValue) bool {
 }
 
 //////////////////////////////////////////////////
+
+// astack is the abstract stack, together with the abstract memory of the same execution path.
+// Memory is a map from concrete, word-aligned offsets to the concrete values stored there;
+// all other memory words are unknown
 type astack struct {
 	values []AbsValue
+	mem    map[uint64]AbsValue
 }
 
 func (s *astack) Copy() *astack {
 	newStack := &astack{}
 	newStack.values = append(newStack.values, s.values...)
+	newStack.mem = make(map[uint64]AbsValue, len(s.mem))
+	for offset, value := range s.mem {
+		newStack.mem[offset] = value
+	}
 	return newStack
 }
 
@@ -317,15 +354,75 @@ func (s *astack) Eq(s1 *astack) bool {
 			return false
 		}
 	}
+	if len(s.mem) != len(s1.mem) {
+		return false
+	}
+	for offset, value := range s.mem {
+		if value1, ok := s1.mem[offset]; !ok || !value.Eq(value1) {
+			return false
+		}
+	}
 	return true
 }
 
+// Leq returns true if the stack is covered by s1: each value is either equal to the one in s1, or the one in s1
+// is ⊤, and the memory words known in s1 are known in the stack with the same values
+func (s *astack) Leq(s1 *astack) bool {
+	for i := 0; i < absStackLen; i++ {
+		if s1.values[i].kind != TopValue && !s.values[i].Eq(s1.values[i]) {
+			return false
+		}
+	}
+	for offset, value1 := range s1.mem {
+		if value, ok := s.mem[offset]; !ok || !value.Eq(value1) {
+			return false
+		}
+	}
+	return true
+}
+
+// wordOffset returns the memory offset if the value is concrete and word-aligned
+func wordOffset(value AbsValue) (uint64, bool) {
+	if value.kind != ConcreteValue || !value.value.IsUint64() {
+		return 0, false
+	}
+	offset := value.value.Uint64()
+	return offset, offset%32 == 0
+}
+
+// updateMemory applies the effect of the instruction on the abstract memory, before its operands are popped.
+// MSTORE of a concrete value to a concrete, word-aligned offset is remembered. Writes to other concrete offsets
+// forget the overlapping words, and writes to unknown offsets or ranges forget the whole memory
+func (s *astack) updateMemory(opcode OpCode) {
+	switch opcode {
+	case MSTORE, MSTORE8:
+		offsetValue := s.values[0]
+		if offsetValue.kind != ConcreteValue || !offsetValue.value.IsUint64() {
+			s.mem = make(map[uint64]AbsValue)
+			return
+		}
+		offset, aligned := wordOffset(offsetValue)
+		if opcode == MSTORE && aligned && s.values[1].kind == ConcreteValue {
+			s.mem[offset] = s.values[1]
+			return
+		}
+		word := offset - offset%32
+		delete(s.mem, word)
+		if opcode == MSTORE && !aligned {
+			delete(s.mem, word+32)
+		}
+	case CALLDATACOPY, CODECOPY, EXTCODECOPY, RETURNDATACOPY, CALL, CALLCODE, DELEGATECALL, STATICCALL:
+		s.mem = make(map[uint64]AbsValue)
+	}
+}
+
 //////////////////////////////////////////////////
 
 type astate struct {
 	stackset    []*astack
 	anlyCounter int
 	worklistLen int
+	widened     bool // values were widened to ⊤ in this state or in the states it was derived from
 }
 
 func emptyState() *astate {
@@ -460,6 +557,59 @@ func resolve(program *program, pc0 int, st0 *astate) ResolveResult {
 	return ResolveResult{edges: edges, resolved: true, badJump: nil}
 }
 
+func isArith(opcode OpCode) bool {
+	switch opcode {
+	case ADD, SUB, MUL, AND, OR, SHL, SHR:
+		return true
+	}
+	return false
+}
+
+// evalArith computes the result of the binary operation on the operands a (top of the stack) and b.
+// The result is concrete if both operands are, or if the concrete operand alone determines it
+// (like AND with zero, or a shift by 256 bits or more), otherwise it is ⊤
+func evalArith(opcode OpCode, a AbsValue, b AbsValue, pc int) AbsValue {
+	aConcrete := a.kind == ConcreteValue
+	bConcrete := b.kind == ConcreteValue
+	var result uint256.Int
+	switch {
+	case aConcrete && bConcrete:
+		switch opcode {
+		case ADD:
+			result.Add(&a.value, &b.value)
+		case SUB:
+			result.Sub(&a.value, &b.value)
+		case MUL:
+			result.Mul(&a.value, &b.value)
+		case AND:
+			result.And(&a.value, &b.value)
+		case OR:
+			result.Or(&a.value, &b.value)
+		case SHL:
+			if a.value.LtUint64(256) {
+				result.Lsh(&b.value, uint(a.value.Uint64()))
+			}
+		case SHR:
+			if a.value.LtUint64(256) {
+				result.Rsh(&b.value, uint(a.value.Uint64()))
+			}
+		}
+	case opcode == AND && ((aConcrete && a.value.IsZero()) || (bConcrete && b.value.IsZero())):
+	case opcode == OR && ((aConcrete && isAllOnes(&a.value)) || (bConcrete && isAllOnes(&b.value))):
+		result.SetAllOne()
+	case (opcode == SHL || opcode == SHR) && aConcrete && !a.value.LtUint64(256):
+	default:
+		return AbsValueTop(pc, false)
+	}
+	return absValueComputed(result, pc)
+}
+
+func isAllOnes(value *uint256.Int) bool {
+	var allOnes uint256.Int
+	allOnes.SetAllOne()
+	return value.Eq(&allOnes)
+}
+
 func post(st0 *astate, edge edge) (*astate, error) {
 	st1 := emptyState()
 	stmt := edge.stmt
@@ -491,7 +641,26 @@ func post(st0 *astate, edge edge) (*astate, error) {
 			stack1.values[opNum] = a
 
 			isStackTooShort = isStackTooShort || a.fromDeepStack || b.fromDeepStack
+		} else if isArith(stmt.opcode) {
+			a := stack1.Pop(edge.pc0)
+			b := stack1.Pop(edge.pc0)
+			isStackTooShort = isStackTooShort || a.fromDeepStack || b.fromDeepStack
+
+			stack1.Push(evalArith(stmt.opcode, a, b, edge.pc0))
+		} else if stmt.opcode == MLOAD {
+			offset := stack1.Pop(edge.pc0)
+			isStackTooShort = isStackTooShort || offset.fromDeepStack
+
+			value := AbsValueTop(edge.pc0, false)
+			if off, ok := wordOffset(offset); ok {
+				if stored, ok := stack1.mem[off]; ok {
+					value = stored
+				}
+			}
+			stack1.Push(value)
 		} else {
+			stack1.updateMemory(stmt.opcode)
+
 			for i := 0; i < stmt.operation.numPop; i++ {
 				s := stack1.Pop(edge.pc0)
 				isStackTooShort = isStackTooShort || s.fromDeepStack
@@ -505,6 +674,8 @@ func post(st0 *astate, edge edge) (*astate, error) {
 		st1.Add(stack1)
 	}
 
+	st1.widened = st0.widened
+
 	if isStackTooShort {
 		return st1, errors.New("abstract stack too short: reached unmodelled depth")
 	}
@@ -516,7 +687,7 @@ func Leq(st0 *astate, st1 *astate) bool {
 	for _, stack0 := range st0.stackset {
 		var found bool
 		for _, stack1 := range st1.stackset {
-			if stack0.Eq(stack1) {
+			if stack0.Leq(stack1) {
 				found = true
 				break
 			}
@@ -536,6 +707,69 @@ func Lub(st0 *astate, st1 *astate) *astate {
 	for _, stack := range st1.stackset {
 		newState.Add(stack)
 	}
+	newState.widened = st0.widened || st1.widened
+	return newState
+}
+
+// widen applies widening to the state at pc after it has been updated for the given number of times, and
+// returns true if anything was widened. Values computed by arithmetic are widened in any state with more than
+// MaxArithStackSetSize stacks. At join points, states with too many stacks or updates are merged into one stack
+func widen(st *astate, pc int, updates int, isJoin bool) (*astate, bool) {
+	var widened bool
+	if len(st.stackset) > MaxArithStackSetSize {
+		st, widened = widenComputed(st)
+	}
+	if isJoin && len(st.stackset) > 1 && (len(st.stackset) > MaxStackSetSize || updates > MaxStateUpdates) {
+		st = widenAll(st, pc)
+		widened = true
+	}
+	return st, widened
+}
+
+// widenComputed replaces the values computed by arithmetic with ⊤, which merges the stacks that only differ in them
+func widenComputed(st *astate) (*astate, bool) {
+	newState := emptyState()
+	newState.widened = st.widened
+	var widened bool
+	for _, stack := range st.stackset {
+		newStack := stack.Copy()
+		for i, value := range newStack.values {
+			if value.kind == ConcreteValue && value.computed {
+				newStack.values[i] = AbsValueTop(value.pc, false)
+				widened = true
+			}
+		}
+		for offset, value := range newStack.mem {
+			if value.computed {
+				delete(newStack.mem, offset)
+				widened = true
+			}
+		}
+		newState.Add(newStack)
+	}
+	newState.widened = newState.widened || widened
+	return newState, widened
+}
+
+// widenAll merges all stacks of the state into one, keeping the values (and memory words) on which all stacks agree
+// and replacing the others with ⊤ produced at pc
+func widenAll(st *astate, pc int) *astate {
+	merged := st.stackset[0].Copy()
+	for _, stack := range st.stackset[1:] {
+		for i, value := range stack.values {
+			if !merged.values[i].Eq(value) {
+				merged.values[i] = AbsValueTop(pc, merged.values[i].fromDeepStack || value.fromDeepStack)
+			}
+		}
+		for offset, value := range merged.mem {
+			if value1, ok := stack.mem[offset]; !ok || !value.Eq(value1) {
+				delete(merged.mem, offset)
+			}
+		}
+	}
+	newState := emptyState()
+	newState.widened = true
+	newState.Add(merged)
 	return newState
 }
 
@@ -645,10 +879,104 @@ func check(program *program, prevEdgeMap map[int]map[int]bool) {
 	}
 }
 
-func AbsIntCfgHarness(contract *Contract) {
+// anlyResult is the outcome of the abstract interpretation of a program: the abstract state at each program counter,
+// the edges of the CFG (all of them, and the discovered ones indexed by destination in prevEdgeMap) and the jumps
+// that could not be resolved. Bad jumps in states
+// where values were widened are also recorded in widenedJumps, as they may be caused by the imprecision
+type anlyResult struct {
+	D            map[int]*astate
+	prevEdgeMap  map[int]map[int]bool
+	badJumps     map[int]bool
+	widenedJumps map[int]bool
+	edges        []edge
+	reachable    map[[2]int]bool // (pc0, pc1) of the edges reachable from the entry
+	widenings    map[int]bool    // program counters where states were widened
+	failures     []string        // errors that did not stop the analysis
+}
+
+func (res *anlyResult) addBadJump(pc int) {
+	res.badJumps[pc] = true
+	if res.D[pc].widened {
+		res.widenedJumps[pc] = true
+	}
+}
 
-	program := toProgram(contract)
+func (res *anlyResult) badJumpError(pc int) error {
+	if res.widenedJumps[pc] {
+		return fmt.Errorf("unable to resolve at pc=%x (state widened)", pc)
+	}
+	return fmt.Errorf("unable to resolve at pc=%x", pc)
+}
+
+// reversePostOrder numbers the program counters reachable from the entry through the edges discovered so far
+// in the reverse post-order of a depth-first search
+func reversePostOrder(entry int, prevEdgeMap map[int]map[int]bool) map[int]int {
+	succs := make(map[int][]int)
+	for pc1, pc0s := range prevEdgeMap {
+		for pc0 := range pc0s {
+			succs[pc0] = append(succs[pc0], pc1)
+		}
+	}
+	for _, pc1s := range succs {
+		sort.Ints(pc1s)
+	}
+
+	type frame struct {
+		pc   int
+		next int // index of the next successor to visit
+	}
+	var postOrder []int
+	visited := map[int]bool{entry: true}
+	stack := []frame{{pc: entry}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next < len(succs[top.pc]) {
+			pc1 := succs[top.pc][top.next]
+			top.next++
+			if !visited[pc1] {
+				visited[pc1] = true
+				stack = append(stack, frame{pc: pc1})
+			}
+		} else {
+			postOrder = append(postOrder, top.pc)
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	rpo := make(map[int]int, len(postOrder))
+	for i, pc := range postOrder {
+		rpo[pc] = len(postOrder) - 1 - i
+	}
+	return rpo
+}
 
+// nextEdge returns the index of the worklist edge to process next: the one whose source comes first in the
+// reverse post-order, so that the states of loop bodies are complete before they flow back to the loop heads
+func nextEdge(workList []edge, rpo map[int]int) int {
+	rank := func(e edge) int {
+		if r, ok := rpo[e.pc0]; ok {
+			return r
+		}
+		return len(rpo) + e.pc0
+	}
+	best := 0
+	for i := 1; i < len(workList); i++ {
+		r, bestR := rank(workList[i]), rank(workList[best])
+		if r < bestR || (r == bestR && workList[i].pc1 < workList[best].pc1) {
+			best = i
+		}
+	}
+	return best
+}
+
+// analyse runs the abstract interpretation of the program until a fixpoint is reached, or, if StopOnError
+// is set, until the first failure. It gives up after MaxAnlyIterations iterations
+func analyse(program *program) (*anlyResult, error) {
+	return analyseUntil(program, time.Time{})
+}
+
+// analyseUntil is analyse which also gives up with ErrTimeout once the deadline (unless zero) has passed
+func analyseUntil(program *program, deadline time.Time) (*anlyResult, error) {
 	startPC := 0
 	codeLen := len(program.contract.Code)
 	D := make(map[int]*astate)
@@ -658,32 +986,50 @@ func AbsIntCfgHarness(contract *Contract) {
 	D[startPC] = botState()
 
 	prevEdgeMap := make(map[int]map[int]bool)
+	badJumps := make(map[int]bool)
+	res := &anlyResult{D: D, prevEdgeMap: prevEdgeMap, badJumps: badJumps, widenedJumps: make(map[int]bool), reachable: make(map[[2]int]bool), widenings: make(map[int]bool)}
 
+	var anlyErr error
 	var workList []edge
 	{
 		resolution := resolve(program, startPC, D[startPC])
 		if !resolution.resolved {
-			fmt.Printf("Unable to resolve at pc=%x\n", startPC)
-			return
-		}
-
-		for _, e := range resolution.edges {
-			if prevEdgeMap[e.pc1] == nil {
-				prevEdgeMap[e.pc1] = make(map[int]bool)
+			res.addBadJump(startPC)
+			anlyErr = res.badJumpError(startPC)
+		} else {
+			for _, e := range resolution.edges {
+				if prevEdgeMap[e.pc1] == nil {
+					prevEdgeMap[e.pc1] = make(map[int]bool)
+				}
+				prevEdgeMap[e.pc1][e.pc0] = true
 			}
-			prevEdgeMap[e.pc1][e.pc0] = true
+			workList = resolution.edges
 		}
-		workList = resolution.edges
 	}
 
 	check(program, prevEdgeMap)
 
+	rpo := reversePostOrder(startPC, prevEdgeMap)
+	cfgChanged := false
+	updates := make(map[int]int)
 	anlyCounter := 0
-	badJumps := make(map[int]bool)
+loop:
 	for len(workList) > 0 {
-		//sortEdges(workList)
-		var e edge
-		e, workList = workList[0], workList[1:]
+		if anlyCounter >= MaxAnlyIterations {
+			anlyErr = fmt.Errorf("gave up after %d iterations, the result is partial", MaxAnlyIterations)
+			break
+		}
+		if !deadline.IsZero() && anlyCounter%deadlineCheckInterval == 0 && time.Now().After(deadline) {
+			anlyErr = ErrTimeout
+			break
+		}
+		if cfgChanged {
+			rpo = reversePostOrder(startPC, prevEdgeMap)
+			cfgChanged = false
+		}
+		i := nextEdge(workList, rpo)
+		e := workList[i]
+		workList = append(workList[:i], workList[i+1:]...)
 
 		//fmt.Printf("%v\n", e.pc0)
 		if e.pc0 == -1 {
@@ -700,12 +1046,11 @@ func AbsIntCfgHarness(contract *Contract) {
 		post1, err := post(preDpc0, e)
 		if err != nil {
 			if StopOnError {
-				printAnlyState(program, prevEdgeMap, D, nil)
-				fmt.Printf("FAILURE: pc=%v %v\n", e.pc0, err)
-				return
+				anlyErr = fmt.Errorf("pc=%v %w", e.pc0, err)
+				break loop
 			}
 
-			fmt.Printf("FAILURE: pc=%v %v\n", e.pc0, err)
+			res.failures = append(res.failures, fmt.Sprintf("pc=%v %v", e.pc0, err))
 		}
 
 		if DEBUG {
@@ -736,16 +1081,21 @@ func AbsIntCfgHarness(contract *Contract) {
 				//fmt.Printf("lub\t\t\t%v\n", postDpc1)
 				printAnlyState(program, prevEdgeMap, D, nil)
 			}
+			updates[e.pc1]++
+			isJoin := len(prevEdgeMap[e.pc1]) > 1 || (len(prevEdgeMap[e.pc1]) == 1 && !prevEdgeMap[e.pc1][e.pc0])
+			if widenedDpc1, ok := widen(postDpc1, e.pc1, updates[e.pc1], isJoin); ok {
+				postDpc1 = widenedDpc1
+				res.widenings[e.pc1] = true
+			}
 			D[e.pc1] = postDpc1
 
 			resolution := resolve(program, e.pc1, D[e.pc1])
 
 			if !resolution.resolved {
-				badJumps[resolution.badJump.pc] = true
-				fmt.Printf("FAILURE: Unable to resolve: anlyCounter=%v pc=%x\n", aurora.Red(anlyCounter), aurora.Red(e.pc1))
+				res.addBadJump(resolution.badJump.pc)
 				if StopOnError {
-					printAnlyState(program, prevEdgeMap, D, badJumps)
-					return
+					anlyErr = res.badJumpError(e.pc1)
+					break loop
 				}
 			} else {
 				for _, e := range resolution.edges {
@@ -756,18 +1106,23 @@ func AbsIntCfgHarness(contract *Contract) {
 						}
 					}
 					if !inWorkList {
-						head := []edge{e}
-						workList = append(head, workList...)
+						workList = append(workList, e)
 					}
 				}
 
 				if prevEdgeMap[e.pc1] == nil {
 					prevEdgeMap[e.pc1] = make(map[int]bool)
 				}
-				prevEdgeMap[e.pc1][e.pc0] = true
+				if !prevEdgeMap[e.pc1][e.pc0] {
+					prevEdgeMap[e.pc1][e.pc0] = true
+					cfgChanged = true
+				}
 			}
 		}
-		DEBUG = false
+		if DEBUG {
+			// Only written when set, so that concurrent analyses do not race on it
+			DEBUG = false
+		}
 
 		decp1Copy := D[e.pc1]
 		decp1Copy.anlyCounter = anlyCounter
@@ -778,28 +1133,18 @@ func AbsIntCfgHarness(contract *Contract) {
 		check(program, prevEdgeMap)
 	}
 
-	print("\nFinal resolve....")
-	var finalEdges []edge
+	// Final resolve, also done after a failure, so that the partial result is complete
 	for pc := 0; pc < codeLen; pc++ {
 		resolution := resolve(program, pc, D[pc])
 		if !resolution.resolved {
-			badJumps[resolution.badJump.pc] = true
-			fmt.Println("Bad jump found during final resolve.")
+			res.addBadJump(resolution.badJump.pc)
 		}
-		finalEdges = append(finalEdges, resolution.edges...)
+		res.edges = append(res.edges, resolution.edges...)
 	}
 	//need to run a DFS from the entry point to pick only reachable stmts
-
-	reachableEdges := getEntryReachableEdges(0, finalEdges)
-
-	fmt.Printf("\n# of unreachable edges: %v\n", len(finalEdges)-len(reachableEdges))
-	fmt.Printf("\n# of total edges: %v\n", len(finalEdges))
-	//printEdges(edges)
-
-	printAnlyState(program, prevEdgeMap, D, nil)
-	println("done valueset")
-
-	if len(badJumps) > 0 {
-		printAnlyState(program, prevEdgeMap, D, badJumps)
+	for _, e := range getEntryReachableEdges(startPC, res.edges) {
+		res.reachable[[2]int{e.pc0, e.pc1}] = true
 	}
+
+	return res, anlyErr
 }
@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func TestAbsIntMemoryJumps(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     []byte
+		badJumps int
+	}{
+		{
+			name: "jump target stored in memory",
+			code: []byte{
+				byte(PUSH1), 0x09, byte(PUSH1), 0x00, byte(MSTORE), // mem[0] = 9
+				byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP), // jump to mem[0]
+				byte(JUMPDEST), byte(STOP),
+			},
+		},
+		{
+			name: "jump target in one of two words",
+			code: []byte{
+				byte(PUSH1), 0x0f, byte(PUSH1), 0x20, byte(MSTORE), // mem[32] = 15
+				byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(MSTORE), // mem[0] = 0
+				byte(PUSH1), 0x20, byte(MLOAD), byte(JUMP), // jump to mem[32]
+				byte(STOP),
+				byte(JUMPDEST), byte(STOP),
+			},
+		},
+		{
+			name: "memory overwritten by CALLDATACOPY",
+			code: []byte{
+				byte(PUSH1), 0x10, byte(PUSH1), 0x00, byte(MSTORE), // mem[0] = 16
+				byte(PUSH1), 0x20, byte(PUSH1), 0x00, byte(PUSH1), 0x00, byte(CALLDATACOPY),
+				byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP), // jump to unknown
+				byte(JUMPDEST), byte(STOP),
+			},
+			badJumps: 1,
+		},
+		{
+			name: "unaligned store overlaps the jump target",
+			code: []byte{
+				byte(PUSH1), 0x0e, byte(PUSH1), 0x00, byte(MSTORE), // mem[0] = 14
+				byte(PUSH1), 0x00, byte(PUSH1), 0x10, byte(MSTORE), // mem[16..48] = 0
+				byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP), // jump to unknown
+				byte(JUMPDEST), byte(STOP),
+			},
+			badJumps: 1,
+		},
+	}
+	for _, test := range tests {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+		contract.Code = test.code
+		res, err := analyse(toProgram(contract))
+		if len(res.badJumps) != test.badJumps {
+			t.Errorf("%s: expected %d bad jumps, got %d (err: %v)", test.name, test.badJumps, len(res.badJumps), err)
+		}
+		if test.badJumps == 0 && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestAbsIntArithJumps(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+	}{
+		{"ADD", []byte{byte(PUSH1), 0x05, byte(PUSH1), 0x01, byte(ADD), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"SUB", []byte{byte(PUSH1), 0x01, byte(PUSH1), 0x07, byte(SUB), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"MUL", []byte{byte(PUSH1), 0x03, byte(PUSH1), 0x02, byte(MUL), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"AND", []byte{byte(PUSH2), 0xff, 0x07, byte(PUSH1), 0xff, byte(AND), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"OR", []byte{byte(PUSH1), 0x04, byte(PUSH1), 0x02, byte(OR), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"SHL", []byte{byte(PUSH1), 0x03, byte(PUSH1), 0x01, byte(SHL), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"SHR", []byte{byte(PUSH1), 0x0c, byte(PUSH1), 0x01, byte(SHR), byte(JUMP), byte(JUMPDEST), byte(STOP)}},
+		{"AND with zero", []byte{
+			byte(CALLVALUE), byte(PUSH1), 0x00, byte(AND), // 0, whatever the call value
+			byte(PUSH1), 0x08, byte(ADD), byte(JUMP),
+			byte(JUMPDEST), byte(STOP),
+		}},
+	}
+	for _, test := range tests {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+		contract.Code = test.code
+		res, err := analyse(toProgram(contract))
+		if err != nil || len(res.badJumps) != 0 {
+			t.Errorf("%s: expected no bad jumps, got %d (err: %v)", test.name, len(res.badJumps), err)
+		}
+	}
+}
+
+func TestAbsIntArithWidening(t *testing.T) {
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x00, // counter
+		byte(JUMPDEST), byte(PUSH1), 0x01, byte(ADD), // counter++
+		byte(DUP1), byte(PUSH1), 0x02, byte(JUMPI), // loop while counter != 0
+		byte(STOP),
+	}
+	res, err := analyse(toProgram(contract))
+	if err != nil || len(res.badJumps) != 0 {
+		t.Fatalf("expected no bad jumps, got %d (err: %v)", len(res.badJumps), err)
+	}
+	if !res.D[2].widened {
+		t.Errorf("expected the counter to be widened at the loop head")
+	}
+	if n := len(res.D[2].stackset); n > MaxArithStackSetSize {
+		t.Errorf("expected at most %d stacks at the loop head, got %d", MaxArithStackSetSize, n)
+	}
+}
+
+func TestAbsIntJoinWidening(t *testing.T) {
+	defer func(maxStackSetSize, maxStateUpdates int) {
+		MaxStackSetSize, MaxStateUpdates = maxStackSetSize, maxStateUpdates
+	}(MaxStackSetSize, MaxStateUpdates)
+
+	code := []byte{
+		byte(PUSH1), 0x01,
+		byte(JUMPDEST), byte(PUSH1), 0x01, // the stack grows with each iteration
+		byte(PUSH1), 0x02, byte(JUMP),
+	}
+	for _, limits := range [][2]int{{4, 1000}, {1000, 4}} {
+		MaxStackSetSize, MaxStateUpdates = limits[0], limits[1]
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+		contract.Code = code
+		res, err := analyse(toProgram(contract))
+		if err != nil || len(res.badJumps) != 0 {
+			t.Fatalf("limits %v: expected no bad jumps, got %d (err: %v)", limits, len(res.badJumps), err)
+		}
+		if !res.widenings[2] || len(res.widenings) != 1 {
+			t.Errorf("limits %v: expected widening at the loop head only, got %v", limits, res.widenings)
+		}
+		if n := len(res.D[2].stackset); n > 4 {
+			t.Errorf("limits %v: expected at most 4 stacks at the loop head, got %d", limits, n)
+		}
+	}
+}
+
+func TestAbsIntIterationCap(t *testing.T) {
+	defer func(maxAnlyIterations int) { MaxAnlyIterations = maxAnlyIterations }(MaxAnlyIterations)
+	MaxAnlyIterations = 3
+
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), uint256.NewInt(), 10000, false)
+	contract.Code = []byte{
+		byte(PUSH1), 0x09, byte(PUSH1), 0x00, byte(MSTORE),
+		byte(PUSH1), 0x00, byte(MLOAD), byte(JUMP),
+		byte(JUMPDEST), byte(STOP),
+	}
+	res, err := analyse(toProgram(contract))
+	if err == nil {
+		t.Fatalf("expected the analysis to give up")
+	}
+	if len(res.D[5].stackset) == 0 || len(res.D[10].stackset) != 0 {
+		t.Errorf("expected the states to be computed up to pc=5 only")
+	}
+}
@@ -0,0 +1,62 @@
+package vm
+
+// codeStatsJumpTable provides the metadata of the opcodes for CollectCodeStats
+var codeStatsJumpTable = newIstanbulInstructionSet()
+
+// CodeStats are the statistics of a contract code
+type CodeStats struct {
+	CodeSize        int
+	Opcodes         [256]int // Number of occurrences of each opcode, not counting push data
+	PushBytes       int      // Total number of bytes of push data
+	TruncatedPush   bool     // The last PUSH is cut short by the end of the code
+	JumpDests       int
+	MaxBlockLen     int // Number of instructions in the longest basic block
+	HasSelfDestruct bool
+	HasDelegateCall bool
+	HasCreate2      bool
+}
+
+// CollectCodeStats computes the statistics of the code. Like the abstract interpretation, it treats the bytes
+// following a PUSH as data, and everything else as instructions. Basic blocks start at JUMPDEST, and end
+// with a jump or an instruction that stops the execution
+func CollectCodeStats(code []byte) *CodeStats {
+	stats := &CodeStats{CodeSize: len(code)}
+	var blockLen int
+	endBlock := func() {
+		if blockLen > stats.MaxBlockLen {
+			stats.MaxBlockLen = blockLen
+		}
+		blockLen = 0
+	}
+	for pc := 0; pc < len(code); pc++ {
+		op := OpCode(code[pc])
+		stats.Opcodes[op]++
+		if op == JUMPDEST {
+			endBlock()
+			stats.JumpDests++
+		}
+		blockLen++
+		switch op {
+		case SELFDESTRUCT:
+			stats.HasSelfDestruct = true
+		case DELEGATECALL:
+			stats.HasDelegateCall = true
+		case CREATE2:
+			stats.HasCreate2 = true
+		}
+		operation := codeStatsJumpTable[op]
+		if op.IsPush() {
+			pushBytes := operation.opNum
+			if pc+pushBytes >= len(code) {
+				pushBytes = len(code) - pc - 1
+				stats.TruncatedPush = true
+			}
+			stats.PushBytes += pushBytes
+			pc += pushBytes
+		} else if operation == nil || operation.halts || operation.reverts || op == JUMP || op == JUMPI {
+			endBlock()
+		}
+	}
+	endBlock()
+	return stats
+}
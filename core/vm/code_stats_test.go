@@ -0,0 +1,34 @@
+package vm
+
+import (
+	"testing"
+)
+
+func TestCollectCodeStats(t *testing.T) {
+	code := []byte{
+		byte(PUSH2), 0x00, 0x05, byte(JUMP),
+		byte(STOP),
+		byte(JUMPDEST), byte(CALLER), byte(SELFDESTRUCT),
+		byte(PUSH4), 0xaa, 0xbb, // truncated
+	}
+	stats := CollectCodeStats(code)
+	for op, count := range map[OpCode]int{PUSH2: 1, JUMP: 1, STOP: 1, JUMPDEST: 1, CALLER: 1, SELFDESTRUCT: 1, PUSH4: 1, SDIV: 0} {
+		if stats.Opcodes[op] != count {
+			t.Errorf("expected %d of %v, got %d", count, op, stats.Opcodes[op])
+		}
+	}
+	if stats.CodeSize != len(code) || stats.PushBytes != 4 || !stats.TruncatedPush {
+		t.Errorf("unexpected size %d, push bytes %d, truncated %t", stats.CodeSize, stats.PushBytes, stats.TruncatedPush)
+	}
+	if stats.JumpDests != 1 || stats.MaxBlockLen != 3 {
+		t.Errorf("unexpected jumpdests %d, max block length %d", stats.JumpDests, stats.MaxBlockLen)
+	}
+	if !stats.HasSelfDestruct || stats.HasDelegateCall || stats.HasCreate2 {
+		t.Errorf("unexpected flags %+v", stats)
+	}
+
+	stats = CollectCodeStats([]byte{byte(DELEGATECALL), byte(CREATE2), byte(PUSH1), 0x01})
+	if stats.HasSelfDestruct || !stats.HasDelegateCall || !stats.HasCreate2 || stats.TruncatedPush || stats.MaxBlockLen != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -18,11 +18,8 @@
 package eth
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
@@ -40,6 +37,7 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/accounts"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/hexutil"
 	"github.com/ledgerwatch/turbo-geth/consensus"
 	"github.com/ledgerwatch/turbo-geth/consensus/clique"
@@ -52,6 +50,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/eth/downloader"
 	"github.com/ledgerwatch/turbo-geth/eth/filters"
 	"github.com/ledgerwatch/turbo-geth/eth/gasprice"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
 	"github.com/ledgerwatch/turbo-geth/event"
@@ -82,6 +81,9 @@ type Ethereum struct {
 	chainDb    *ethdb.ObjectDatabase // Block chain database
 	chainKV    ethdb.KV              // Same as chainDb, but different interface
 	privateAPI *grpc.Server
+	events     *remotedbserver.Events // new chain heads for the subscribers of the private API
+
+	backgroundMigrations *migrations.BackgroundScheduler
 
 	eventMux       *event.TypeMux
 	engine         consensus.Engine
@@ -146,7 +148,13 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 	}
 
 	tmpdir := path.Join(stack.Config().DataDir, etl.TmpDirName)
-	err = migrations.NewMigrator().Apply(chainDb, tmpdir)
+	migrator := migrations.NewMigrator()
+	if config.KeepDeprecatedBuckets {
+		migrator.KeepDeprecatedBuckets()
+	} else if config.ExportDeprecatedBuckets != "" {
+		migrator.ExportDeprecatedBuckets(config.ExportDeprecatedBuckets)
+	}
+	err = migrator.Apply(chainDb, tmpdir)
 	if err != nil {
 		return nil, err
 	}
@@ -222,6 +230,17 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !sm.Senders2 && config.StorageMode.Senders2 {
+		// existing database switches to storage mode `s` when the background migration copied the old senders
+		if err = migrations.FeatureSenders2.Check(chainDb); err != nil {
+			log.Warn("Storage mode s is not enabled yet", "err", err)
+			config.StorageMode.Senders2 = false
+		} else if err = chainDb.Put(dbutils.DatabaseInfoBucket, dbutils.StorageModeSenders2, []byte{1}); err != nil {
+			return nil, err
+		} else {
+			sm.Senders2 = true
+		}
+	}
 	if !reflect.DeepEqual(sm, config.StorageMode) {
 		return nil, errors.New("mode is " + config.StorageMode.ToString() + " original mode is " + sm.ToString())
 	}
@@ -259,46 +278,18 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 	eth.txPool = core.NewTxPool(config.TxPool, chainConfig, chainDb, txCacher)
 
 	if stack.Config().PrivateApiAddr != "" {
+		eth.events = remotedbserver.NewEvents()
+		var creds *credentials.TransportCredentials
 		if stack.Config().TLSConnection {
-			// load peer cert/key, ca cert
-			var creds credentials.TransportCredentials
-
-			if stack.Config().TLSCACert != "" {
-				var peerCert tls.Certificate
-				var caCert []byte
-				peerCert, err = tls.LoadX509KeyPair(stack.Config().TLSCertFile, stack.Config().TLSKeyFile)
-				if err != nil {
-					log.Error("load peer cert/key error:%v", err)
-					return nil, err
-				}
-				caCert, err = ioutil.ReadFile(stack.Config().TLSCACert)
-				if err != nil {
-					log.Error("read ca cert file error:%v", err)
-					return nil, err
-				}
-				caCertPool := x509.NewCertPool()
-				caCertPool.AppendCertsFromPEM(caCert)
-				creds = credentials.NewTLS(&tls.Config{
-					Certificates: []tls.Certificate{peerCert},
-					ClientCAs:    caCertPool,
-					ClientAuth:   tls.RequireAndVerifyClientCert,
-				})
-			} else {
-				creds, err = credentials.NewServerTLSFromFile(stack.Config().TLSCertFile, stack.Config().TLSKeyFile)
-			}
-
-			if err != nil {
-				return nil, err
-			}
-			eth.privateAPI, err = remotedbserver.StartGrpc(chainDb.KV(), eth, stack.Config().PrivateApiAddr, &creds)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			eth.privateAPI, err = remotedbserver.StartGrpc(chainDb.KV(), eth, stack.Config().PrivateApiAddr, nil)
+			tlsCreds, err := remotedbserver.TLS(stack.Config().TLSCertFile, stack.Config().TLSKeyFile, stack.Config().TLSCACert)
 			if err != nil {
 				return nil, err
 			}
+			creds = &tlsCreds
+		}
+		eth.privateAPI, err = remotedbserver.StartGrpc(chainDb.KV(), eth, eth.events, stack.Config().PrivateApiAddr, creds, stack.Config().PrivateApiToken)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -306,7 +297,11 @@ func New(stack *node.Node, config *Config) (*Ethereum, error) {
 	if checkpoint == nil {
 		//checkpoint = params.TrustedCheckpoints[genesisHash]
 	}
-	if eth.protocolManager, err = NewProtocolManager(chainConfig, checkpoint, config.SyncMode, config.NetworkID, eth.eventMux, eth.txPool, eth.engine, eth.blockchain, chainDb, config.Whitelist, config.StagedSync); err != nil {
+	stagedSync := config.StagedSync
+	if stagedSync == nil && eth.events != nil {
+		stagedSync = stagedsync.New(stagedsync.DefaultStages(), stagedsync.DefaultUnwindOrder(), stagedsync.OptionalParameters{Notifier: eth.events})
+	}
+	if eth.protocolManager, err = NewProtocolManager(chainConfig, checkpoint, config.SyncMode, config.NetworkID, eth.eventMux, eth.txPool, eth.engine, eth.blockchain, chainDb, config.Whitelist, stagedSync); err != nil {
 		return nil, err
 	}
 	eth.miner = miner.New(eth, &config.Miner, chainConfig, eth.EventMux(), eth.engine, eth.isLocalBlock)
@@ -661,6 +656,7 @@ func (s *Ethereum) ChainKV() ethdb.KV                  { return s.chainKV }
 func (s *Ethereum) IsListening() bool                  { return true } // Always listening
 func (s *Ethereum) EthVersion() int                    { return int(ProtocolVersions[0]) }
 func (s *Ethereum) NetVersion() (uint64, error)        { return s.networkID, nil }
+func (s *Ethereum) ProtocolVersions() []uint           { return ProtocolVersions }
 func (s *Ethereum) Downloader() *downloader.Downloader { return s.protocolManager.downloader }
 func (s *Ethereum) SyncProgress() ethereum.SyncProgress {
 	return s.protocolManager.downloader.Progress()
@@ -691,6 +687,9 @@ func (s *Ethereum) Protocols() []p2p.Protocol {
 func (s *Ethereum) Start() error {
 	s.startEthEntryUpdate(s.p2pServer.LocalNode())
 
+	s.backgroundMigrations = migrations.NewBackgroundScheduler(s.chainDb, s.Downloader().Synchronising)
+	s.backgroundMigrations.Start()
+
 	// Figure out a max peers count based on the server limits
 	maxPeers := s.p2pServer.MaxPeers
 	withTxPool := s.config.SyncMode != downloader.StagedSync
@@ -742,6 +741,9 @@ func (s *Ethereum) Stop() error {
 		log.Warn("error while stopping transaction pool", "err", err)
 	}
 	s.miner.Stop()
+	if s.backgroundMigrations != nil {
+		s.backgroundMigrations.Stop()
+	}
 	s.blockchain.Stop()
 	s.engine.Close()
 	s.eventMux.Stop()
@@ -132,6 +132,11 @@ type Config struct {
 	SnapshotMode    torrent.SnapshotMode
 	SnapshotSeeding bool
 
+	// KeepDeprecatedBuckets skips the migrations which drop the deprecated buckets, ExportDeprecatedBuckets is the
+	// directory they are exported to before the drop
+	KeepDeprecatedBuckets   bool
+	ExportDeprecatedBuckets string
+
 	// DownloadOnly is set when the node does not need to process the blocks, but simply
 	// download them
 	DownloadOnly        bool
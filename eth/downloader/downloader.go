@@ -614,18 +614,18 @@ func (d *Downloader) syncWithPeer(p *peerConnection, hash common.Hash, blockNumb
 			return err
 		}
 		if canRunCycleInOneTransaction {
-			if hasTx, ok := tx.(ethdb.HasTx); ok && hasTx.Tx() == nil {
-				return nil
-			}
-
-			commitStart := time.Now()
-			_, errTx := tx.Commit()
-			if errTx == nil {
+			if hasTx, ok := tx.(ethdb.HasTx); !ok || hasTx.Tx() != nil {
+				commitStart := time.Now()
+				if _, errTx := tx.Commit(); errTx != nil {
+					return errTx
+				}
 				log.Info("Commit cycle", "in", time.Since(commitStart))
 			}
-			return errTx
 		}
 
+		if err := d.stagedSync.NotifyNewHead(d.stateDB); err != nil {
+			log.Warn("Could not notify about the new head", "err", err)
+		}
 		return nil
 	}
 
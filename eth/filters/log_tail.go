@@ -0,0 +1,147 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+)
+
+// DefaultLogTailBlocks - number of the recent blocks LogTail remembers, reorgs deeper than that are not retracted
+const DefaultLogTailBlocks = 128
+
+// LogTailBackend - headers and receipts of the blocks for LogTail, Backend is one
+type LogTailBackend interface {
+	HeaderByHash(ctx context.Context, blockHash common.Hash) (*types.Header, error)
+	GetReceipts(ctx context.Context, blockHash common.Hash) (types.Receipts, error)
+}
+
+// LogTail - logs of the canonical chain as its head moves. It remembers the last announced blocks with their logs,
+// a new head is traced back by the parent hashes until it meets one of them. The logs of the remembered blocks
+// above the meeting point are retracted, the logs of the new blocks are fetched from the receipts. The logs of
+// the abandoned blocks come from the memory, because the receipts of non-canonical blocks may be gone already.
+// LogTail is not safe for concurrent use. The rpcdaemon feeds it with the heads announced by the node
+type LogTail struct {
+	backend   LogTailBackend
+	maxBlocks int
+	blocks    []tailBlock // announced blocks of the canonical chain, consecutive, the oldest first
+}
+
+type tailBlock struct {
+	number uint64
+	hash   common.Hash
+	logs   []*types.Log
+}
+
+// NewLogTail - maxBlocks is the number of the recent blocks to remember, see DefaultLogTailBlocks
+func NewLogTail(backend LogTailBackend, maxBlocks int) *LogTail {
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	return &LogTail{backend: backend, maxBlocks: maxBlocks}
+}
+
+// Update moves the tail to the new head. added - the logs of the blocks which joined the canonical chain, the oldest
+// first. removed - the logs of the announced blocks which left it, the newest first, flagged Removed. The first head
+// after New or Reset adds only its own logs. If the new chain doesn't meet the remembered blocks within maxBlocks
+// blocks, the remembered blocks from the oldest traced number up are removed, only the traced blocks are added.
+// On error the tail stays at the previous head
+func (t *LogTail) Update(ctx context.Context, head *types.Header) (added, removed []*types.Log, err error) {
+	var newHeaders []*types.Header // the newest first
+	keep := 0                      // number of the remembered blocks which stay in the chain
+	for h := head; ; {
+		n := h.Number.Uint64()
+		if b, ok := t.block(n); ok && b.hash == h.Hash() {
+			keep = int(n-t.blocks[0].number) + 1
+			break
+		}
+		newHeaders = append(newHeaders, h)
+		if len(t.blocks) == 0 || n == 0 || n <= t.blocks[0].number || len(newHeaders) >= t.maxBlocks {
+			keep = t.below(n)
+			break
+		}
+		parent, err := t.backend.HeaderByHash(ctx, h.ParentHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if parent == nil {
+			return nil, nil, fmt.Errorf("header %x of block %d not found", h.ParentHash, n-1)
+		}
+		h = parent
+	}
+
+	newBlocks := make([]tailBlock, 0, len(newHeaders))
+	for i := len(newHeaders) - 1; i >= 0; i-- {
+		h := newHeaders[i]
+		receipts, err := t.backend.GetReceipts(ctx, h.Hash())
+		if err != nil {
+			return nil, nil, fmt.Errorf("receipts of block %d %x: %w", h.Number.Uint64(), h.Hash(), err)
+		}
+		b := tailBlock{number: h.Number.Uint64(), hash: h.Hash(), logs: blockLogs(h, receipts)}
+		newBlocks = append(newBlocks, b)
+		added = append(added, b.logs...)
+	}
+
+	for i := len(t.blocks) - 1; i >= keep; i-- {
+		for _, l := range t.blocks[i].logs {
+			removedLog := *l
+			removedLog.Removed = true
+			removed = append(removed, &removedLog)
+		}
+	}
+	t.blocks = t.blocks[:keep]
+	if len(t.blocks) > 0 && len(newBlocks) > 0 && t.blocks[len(t.blocks)-1].number+1 != newBlocks[0].number {
+		// the gap between them is unknown
+		t.blocks = nil
+	}
+	t.blocks = append(t.blocks, newBlocks...)
+	if len(t.blocks) > t.maxBlocks {
+		t.blocks = append([]tailBlock(nil), t.blocks[len(t.blocks)-t.maxBlocks:]...)
+	}
+	return added, removed, nil
+}
+
+// Reset forgets the announced blocks, e.g. when there are no subscribers to send the logs to
+func (t *LogTail) Reset() {
+	t.blocks = nil
+}
+
+func (t *LogTail) block(number uint64) (tailBlock, bool) {
+	if len(t.blocks) == 0 || number < t.blocks[0].number || number-t.blocks[0].number >= uint64(len(t.blocks)) {
+		return tailBlock{}, false
+	}
+	return t.blocks[number-t.blocks[0].number], true
+}
+
+// below - number of the remembered blocks with the numbers less than the given one
+func (t *LogTail) below(number uint64) int {
+	if len(t.blocks) == 0 || number <= t.blocks[0].number {
+		return 0
+	}
+	if k := number - t.blocks[0].number; k < uint64(len(t.blocks)) {
+		return int(k)
+	}
+	return len(t.blocks)
+}
+
+// blockLogs - copies of the logs of the receipts with the fields derived from the block
+func blockLogs(header *types.Header, receipts types.Receipts) []*types.Log {
+	var logs []*types.Log
+	hash := header.Hash()
+	for _, receipt := range receipts {
+		for _, l := range receipt.Logs {
+			logCopy := *l
+			logCopy.BlockNumber = header.Number.Uint64()
+			logCopy.BlockHash = hash
+			logCopy.Removed = false
+			logs = append(logs, &logCopy)
+		}
+	}
+	return logs
+}
+
+// MatchLogs - the logs matching the criteria of the logs subscription
+func MatchLogs(logs []*types.Log, crit FilterCriteria) []*types.Log {
+	return filterLogs(logs, crit.FromBlock, crit.ToBlock, crit.Addresses, crit.Topics)
+}
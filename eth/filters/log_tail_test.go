@@ -0,0 +1,151 @@
+package filters
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/stretchr/testify/require"
+)
+
+type tailTestBackend struct {
+	headers  map[common.Hash]*types.Header
+	receipts map[common.Hash]types.Receipts
+}
+
+func (b *tailTestBackend) HeaderByHash(_ context.Context, hash common.Hash) (*types.Header, error) {
+	return b.headers[hash], nil
+}
+
+func (b *tailTestBackend) GetReceipts(_ context.Context, hash common.Hash) (types.Receipts, error) {
+	return b.receipts[hash], nil
+}
+
+// chain adds the blocks on top of the parent, each with one log from the address {number, branch}
+func (b *tailTestBackend) chain(parent *types.Header, n int, branch byte) []*types.Header {
+	var headers []*types.Header
+	for i := 0; i < n; i++ {
+		h := &types.Header{Number: big.NewInt(parent.Number.Int64() + 1), ParentHash: parent.Hash(), Extra: []byte{branch}}
+		b.headers[h.Hash()] = h
+		addr := common.Address{byte(h.Number.Uint64()), branch}
+		b.receipts[h.Hash()] = types.Receipts{{Logs: []*types.Log{{Address: addr}}}}
+		headers = append(headers, h)
+		parent = h
+	}
+	return headers
+}
+
+// addrs - the addresses of the logs, the blocks they belong to
+func addrs(t *testing.T, logs []*types.Log, removed bool) []common.Address {
+	var res []common.Address
+	for _, l := range logs {
+		require.Equal(t, removed, l.Removed)
+		require.Equal(t, l.Address[0], byte(l.BlockNumber))
+		res = append(res, l.Address)
+	}
+	return res
+}
+
+func TestLogTail(t *testing.T) {
+	backend := &tailTestBackend{headers: map[common.Hash]*types.Header{}, receipts: map[common.Hash]types.Receipts{}}
+	genesis := &types.Header{Number: big.NewInt(0)}
+	backend.headers[genesis.Hash()] = genesis
+	main := backend.chain(genesis, 10, 0)
+	tail := NewLogTail(backend, DefaultLogTailBlocks)
+	ctx := context.Background()
+
+	// the first head adds only its own logs
+	added, removed, err := tail.Update(ctx, main[4])
+	require.NoError(t, err)
+	require.Equal(t, []common.Address{{5, 0}}, addrs(t, added, false))
+	require.Empty(t, removed)
+
+	// several blocks at once
+	added, removed, err = tail.Update(ctx, main[7])
+	require.NoError(t, err)
+	require.Equal(t, []common.Address{{6, 0}, {7, 0}, {8, 0}}, addrs(t, added, false))
+	require.Empty(t, removed)
+
+	// the same head again
+	added, removed, err = tail.Update(ctx, main[7])
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	t.Run("1-block reorg", func(t *testing.T) {
+		side := backend.chain(main[6], 1, 1)
+		require.Equal(t, main[7].Number, side[0].Number)
+		added, removed, err := tail.Update(ctx, side[0])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{8, 1}}, addrs(t, added, false))
+		require.Equal(t, []common.Address{{8, 0}}, addrs(t, removed, true))
+		require.Equal(t, main[7].Hash(), removed[0].BlockHash)
+
+		// and back, the logs of the side block are retracted from the memory
+		delete(backend.receipts, side[0].Hash())
+		added, removed, err = tail.Update(ctx, main[8])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{8, 0}, {9, 0}}, addrs(t, added, false))
+		require.Equal(t, []common.Address{{8, 1}}, addrs(t, removed, true))
+	})
+
+	t.Run("multi-block reorg", func(t *testing.T) {
+		// the longer branch forks off after block 5
+		side := backend.chain(main[4], 5, 2)
+		added, removed, err := tail.Update(ctx, side[4])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{6, 2}, {7, 2}, {8, 2}, {9, 2}, {10, 2}}, addrs(t, added, false))
+		require.Equal(t, []common.Address{{9, 0}, {8, 0}, {7, 0}, {6, 0}}, addrs(t, removed, true), "the newest first")
+
+		// the shorter branch forks off after block 7 of the side branch
+		short := backend.chain(side[1], 1, 3)
+		added, removed, err = tail.Update(ctx, short[0])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{8, 3}}, addrs(t, added, false))
+		require.Equal(t, []common.Address{{10, 2}, {9, 2}, {8, 2}}, addrs(t, removed, true))
+	})
+
+	t.Run("reorg deeper than the memory", func(t *testing.T) {
+		small := NewLogTail(backend, 2)
+		_, _, err := small.Update(ctx, main[5])
+		require.NoError(t, err)
+		_, _, err = small.Update(ctx, main[7])
+		require.NoError(t, err)
+		side := backend.chain(main[3], 4, 4)
+		added, removed, err := small.Update(ctx, side[3])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{7, 4}, {8, 4}}, addrs(t, added, false), "only the last blocks are traced")
+		require.Equal(t, []common.Address{{8, 0}, {7, 0}}, addrs(t, removed, true))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		tail.Reset()
+		added, removed, err := tail.Update(ctx, main[9])
+		require.NoError(t, err)
+		require.Equal(t, []common.Address{{10, 0}}, addrs(t, added, false))
+		require.Empty(t, removed)
+	})
+}
+
+func TestLogTailMissingParent(t *testing.T) {
+	backend := &tailTestBackend{headers: map[common.Hash]*types.Header{}, receipts: map[common.Hash]types.Receipts{}}
+	genesis := &types.Header{Number: big.NewInt(0)}
+	main := backend.chain(genesis, 3, 0)
+	tail := NewLogTail(backend, DefaultLogTailBlocks)
+	ctx := context.Background()
+	_, _, err := tail.Update(ctx, main[0])
+	require.NoError(t, err)
+
+	delete(backend.headers, main[1].Hash())
+	_, _, err = tail.Update(ctx, main[2])
+	require.Error(t, err)
+
+	// the tail stays at the previous head
+	backend.headers[main[1].Hash()] = main[1]
+	added, removed, err := tail.Update(ctx, main[2])
+	require.NoError(t, err)
+	require.Equal(t, []common.Address{{2, 0}, {3, 0}}, addrs(t, added, false))
+	require.Empty(t, removed)
+}
@@ -1,10 +1,15 @@
 package stagedsync
 
 import (
+	"context"
+
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 )
 
+// checkpointEvery - amount of blocks between intermediate checkpoints of the stages executed in checkpoints
+var checkpointEvery uint64 = 500_000
+
 // ExecFunc is the execution function for the stage to move forward.
 // * state - is the current state of the stage and contains stage data.
 // * unwinder - if the stage needs to cause unwinding, `unwinder` methods can be used.
@@ -52,6 +57,48 @@ func (s *StageState) UpdateWithStageData(db ethdb.Putter, newBlockNum uint64, st
 	return stages.SaveStageProgress(db, s.Stage, newBlockNum, stageData)
 }
 
+// UpdateIntermediate saves a checkpoint in the middle of the stage execution, so an interrupted stage resumes after `blockNum`
+// instead of redoing the whole range. If the stage began the transaction itself (`ownTx`), the transaction is committed
+// and a new one is begun in the same object. A transaction of the caller is never committed, the checkpoint becomes durable
+// together with the rest of the caller's work.
+// Unwind treats the checkpoint as any other progress of the stage, so it's rolled back to the unwind point.
+func (s *StageState) UpdateIntermediate(tx ethdb.DbWithPendingMutations, blockNum uint64, ownTx bool) error {
+	if err := s.Update(tx, blockNum); err != nil {
+		return err
+	}
+	if ownTx {
+		if err := tx.CommitAndBegin(context.Background()); err != nil {
+			return err
+		}
+	}
+	if s.state != nil && s.state.onCheckpoint != nil {
+		return s.state.onCheckpoint(s.Stage, blockNum)
+	}
+	return nil
+}
+
+// ExecuteInCheckpoints calls `f` for the consecutive ranges of blocks [from, to], at most `checkpointEvery` blocks each,
+// and saves an intermediate checkpoint (see `UpdateIntermediate`) after every range but the last one.
+func (s *StageState) ExecuteInCheckpoints(tx ethdb.DbWithPendingMutations, from, to uint64, ownTx bool, f func(from, to uint64) error) error {
+	for rangeFrom := from; rangeFrom <= to; {
+		rangeTo := to
+		if to-rangeFrom >= checkpointEvery {
+			rangeTo = rangeFrom + checkpointEvery - 1
+		}
+		if err := f(rangeFrom, rangeTo); err != nil {
+			return err
+		}
+		if rangeTo == to {
+			break
+		}
+		if err := s.UpdateIntermediate(tx, rangeTo, ownTx); err != nil {
+			return err
+		}
+		rangeFrom = rangeTo + 1
+	}
+	return nil
+}
+
 // Done makes sure that the stage execution is complete and proceeds to the next state.
 // If Done() is not called and the stage `ExecFunc` exits, then the same stage will be called again.
 // This side effect is useful for something like block body download.
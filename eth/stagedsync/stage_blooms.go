@@ -0,0 +1,128 @@
+package stagedsync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// SpawnBlockBloom writes blooms of the executed canonical blocks logs. Bloom is created from the stored receipts,
+// blocks without stored receipts get the bloom of their header - it's validated to be the same.
+// It's a fallback for eth_getLogs on the nodes without logs index.
+func SpawnBlockBloom(s *StageState, db ethdb.Database, quit <-chan struct{}) error {
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	endBlock, err := s.ExecutionAt(tx)
+	logPrefix := s.state.LogPrefix()
+	if err != nil {
+		return fmt.Errorf("%s: getting last executed block: %w", logPrefix, err)
+	}
+	if endBlock == s.BlockNumber {
+		s.Done()
+		return nil
+	}
+
+	start := s.BlockNumber
+	if start > 0 {
+		start++
+	}
+	if err := promoteBlockBloom(logPrefix, tx, start, endBlock, quit); err != nil {
+		return err
+	}
+
+	if err := s.DoneAndUpdate(tx, endBlock); err != nil {
+		return err
+	}
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func promoteBlockBloom(logPrefix string, db ethdb.Database, from, to uint64, quit <-chan struct{}) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	for blockNum := from; blockNum <= to; blockNum++ {
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		hash, err := rawdb.ReadCanonicalHash(db, blockNum)
+		if err != nil {
+			return err
+		}
+		var bloom types.Bloom
+		if receipts := rawdb.ReadRawReceipts(db, hash, blockNum); receipts != nil {
+			bloom = types.CreateBloom(receipts)
+		} else {
+			header := rawdb.ReadHeader(db, hash, blockNum)
+			if header == nil {
+				return fmt.Errorf("%s: header of the block %d not found", logPrefix, blockNum)
+			}
+			bloom = header.Bloom
+		}
+		if err := rawdb.WriteBlockBloom(db, blockNum, bloom); err != nil {
+			return err
+		}
+
+		select {
+		default:
+		case <-logEvery.C:
+			log.Info(fmt.Sprintf("[%s] Progress", logPrefix), "number", blockNum)
+		}
+	}
+	return nil
+}
+
+func UnwindBlockBloom(u *UnwindState, s *StageState, db ethdb.Database) error {
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	logPrefix := s.state.LogPrefix()
+	for blockNum := u.UnwindPoint + 1; blockNum <= s.BlockNumber; blockNum++ {
+		if err := tx.Delete(dbutils.BlockBloomPrefix, dbutils.EncodeBlockNumber(blockNum)); err != nil {
+			return fmt.Errorf("%s: %w", logPrefix, err)
+		}
+	}
+	if err := u.Done(tx); err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
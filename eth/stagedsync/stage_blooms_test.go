@@ -0,0 +1,61 @@
+package stagedsync
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockBloom(t *testing.T) {
+	require := require.New(t)
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	expected := map[uint64]types.Bloom{}
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	for blockNum := uint64(0); blockNum <= 10; blockNum++ {
+		receipts := types.Receipts{{Logs: []*types.Log{{Address: common.BigToAddress(new(big.Int).SetUint64(blockNum)), Topics: []common.Hash{{byte(blockNum)}}}}}}
+		expected[blockNum] = types.CreateBloom(receipts)
+		header := &types.Header{Number: new(big.Int).SetUint64(blockNum), Bloom: expected[blockNum]}
+		rawdb.WriteHeader(context.Background(), tx, header)
+		require.NoError(rawdb.WriteCanonicalHash(tx, header.Hash(), blockNum))
+		// receipts of the odd blocks are not stored, their bloom comes from the header
+		if blockNum%2 == 0 {
+			require.NoError(appendReceipts(tx, receipts, blockNum, header.Hash()))
+		}
+	}
+	require.NoError(stages.SaveStageProgress(tx, stages.Execution, 10, nil))
+	_, err = tx.Commit()
+	require.NoError(err)
+
+	require.NoError(SpawnBlockBloom(&StageState{Stage: stages.BlockBloom}, db, nil))
+	for blockNum := uint64(0); blockNum <= 10; blockNum++ {
+		bloom, err := rawdb.ReadBlockBloom(db, blockNum)
+		require.NoError(err)
+		require.NotNil(bloom, "block %d", blockNum)
+		require.Equal(expected[blockNum], *bloom, "block %d", blockNum)
+	}
+
+	u := &UnwindState{Stage: stages.BlockBloom, UnwindPoint: 5}
+	require.NoError(UnwindBlockBloom(u, &StageState{Stage: stages.BlockBloom, BlockNumber: 10}, db))
+	for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+		bloom, err := rawdb.ReadBlockBloom(db, blockNum)
+		require.NoError(err)
+		if blockNum <= 5 {
+			require.NotNil(bloom, "block %d", blockNum)
+		} else {
+			require.Nil(bloom, "block %d", blockNum)
+		}
+	}
+	progress, _, err := stages.GetStageProgress(db, stages.BlockBloom)
+	require.NoError(err)
+	require.Equal(uint64(5), progress)
+}
@@ -173,7 +173,8 @@ func promoteCallTraces(logPrefix string, tx ethdb.Database, startBlock, endBlock
 		senders := rawdb.ReadSenders(tx, blockHash, blockNum)
 		block.Body().SendersToTxs(senders)
 
-		if accountCsKey != nil {
+		// values before the block are preset into the caches from its changesets, caches are off for short runs
+		if caching && accountCsKey != nil {
 			accountCsBlockNum, _ := dbutils.DecodeTimestamp(accountCsKey)
 			if accountCsBlockNum == blockNum {
 				cs := changeset.AccountChangeSetPlainBytes(accountCsVal)
@@ -194,7 +195,7 @@ func promoteCallTraces(logPrefix string, tx ethdb.Database, startBlock, endBlock
 				}
 			}
 		}
-		if storageCsKey != nil {
+		if caching && storageCsKey != nil {
 			storageCsBlockNum, _ := dbutils.DecodeTimestamp(storageCsKey)
 			if storageCsBlockNum == blockNum {
 				cs := changeset.StorageChangeSetPlainBytes(storageCsVal)
@@ -254,6 +255,12 @@ func promoteCallTraces(logPrefix string, tx ethdb.Database, startBlock, endBlock
 		}
 	}
 
+	return loadCallTraces(logPrefix, tx, collectorFrom, collectorTo, froms, tos, quit)
+}
+
+// loadCallTraces flushes in-memory bitmaps into the collectors and merges everything collected into
+// CallFromIndex and CallToIndex, appending to the last shards of the keys
+func loadCallTraces(logPrefix string, tx ethdb.Database, collectorFrom, collectorTo *etl.Collector, froms, tos map[string]*roaring.Bitmap, quit <-chan struct{}) error {
 	if err := flushBitmaps(collectorFrom, froms); err != nil {
 		return err
 	}
@@ -394,14 +401,15 @@ func unwindCallTraces(logPrefix string, db rawdb.DatabaseReader, from, to uint64
 		a := addr // To copy addr
 		tos[string(a[:])] = struct{}{}
 	}
+	return truncateCallTraces(tx, froms, tos, to+1, from+1)
+}
 
-	if err := truncateBitmaps(db.(ethdb.HasTx).Tx(), dbutils.CallFromIndex, froms, to+1, from+1); err != nil {
+// truncateCallTraces removes blocks [from, to) from the bitmaps of the given addresses
+func truncateCallTraces(tx ethdb.Tx, froms, tos map[string]struct{}, from, to uint64) error {
+	if err := truncateBitmaps(tx, dbutils.CallFromIndex, froms, from, to); err != nil {
 		return err
 	}
-	if err := truncateBitmaps(db.(ethdb.HasTx).Tx(), dbutils.CallToIndex, tos, to+1, from+1); err != nil {
-		return err
-	}
-	return nil
+	return truncateBitmaps(tx, dbutils.CallToIndex, tos, from, to)
 }
 
 type CallTracer struct {
@@ -416,11 +424,25 @@ func NewCallTracer() *CallTracer {
 	}
 }
 
-func (ct *CallTracer) CaptureStart(depth int, from common.Address, to common.Address, call bool, input []byte, gas uint64, value *big.Int) error {
+// CaptureStart is invoked for CALL and contract creations, including the nested ones.
+// EVM doesn't invoke it for CALLCODE, DELEGATECALL and STATICCALL, see CaptureState
+func (ct *CallTracer) CaptureStart(depth int, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	ct.froms[from] = struct{}{}
+	ct.tos[to] = struct{}{}
 	return nil
 }
+
+// CaptureState records calls which don't reach CaptureStart, it's invoked before the opcode is executed.
+// Address is the second item of the stack for all of them
 func (ct *CallTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *stack.Stack, _ *stack.ReturnStack, rData []byte, contract *vm.Contract, depth int, err error) error {
-	//TODO: Populate froms and tos if it is any call opcode
+	if err != nil {
+		return nil
+	}
+	switch op {
+	case vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		ct.froms[contract.Address()] = struct{}{}
+		ct.tos[common.Address(stack.Back(1).Bytes20())] = struct{}{}
+	}
 	return nil
 }
 func (ct *CallTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *stack.Stack, _ *stack.ReturnStack, contract *vm.Contract, depth int, err error) error {
@@ -0,0 +1,147 @@
+package stagedsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/core/vm/runtime"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallTracer(t *testing.T) {
+	require := require.New(t)
+	tracer := NewCallTracer()
+	eoa, contract, callee := common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")
+	require.NoError(tracer.CaptureStart(0, eoa, contract, false, nil, 0, nil))
+	require.NoError(tracer.CaptureStart(1, contract, callee, false, nil, 0, nil))
+	require.Equal(map[common.Address]struct{}{eoa: {}, contract: {}}, tracer.froms)
+	require.Equal(map[common.Address]struct{}{contract: {}, callee: {}}, tracer.tos)
+}
+
+func TestCallTracerNotCallOpcodes(t *testing.T) {
+	require := require.New(t)
+	delegated, static, callCoded := common.HexToAddress("0xde1e"), common.HexToAddress("0x57a7"), common.HexToAddress("0xc0de")
+	// retSize, retOffset, argsSize, argsOffset, [value], address, gas
+	call := func(op vm.OpCode, addr common.Address, withValue bool) []byte {
+		code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0}
+		if withValue {
+			code = append(code, byte(vm.PUSH1), 0)
+		}
+		code = append(code, byte(vm.PUSH20))
+		code = append(code, addr[:]...)
+		return append(code, byte(vm.GAS), byte(op), byte(vm.POP))
+	}
+	var code []byte
+	code = append(code, call(vm.DELEGATECALL, delegated, false)...)
+	code = append(code, call(vm.STATICCALL, static, false)...)
+	code = append(code, call(vm.CALLCODE, callCoded, true)...)
+	code = append(code, byte(vm.STOP))
+
+	tracer := NewCallTracer()
+	origin := common.HexToAddress("0x01")
+	_, _, err := runtime.Execute(code, nil, &runtime.Config{
+		Origin:    origin,
+		GasLimit:  1_000_000,
+		EVMConfig: vm.Config{Debug: true, Tracer: tracer},
+	}, 0)
+	require.NoError(err)
+
+	contract := common.BytesToAddress([]byte("contract")) // address used by runtime.Execute
+	require.Equal(map[common.Address]struct{}{origin: {}, contract: {}}, tracer.froms)
+	require.Equal(map[common.Address]struct{}{contract: {}, delegated: {}, static: {}, callCoded: {}}, tracer.tos)
+}
+
+func TestCallTracesPromoteUnwindSymmetry(t *testing.T) {
+	require := require.New(t)
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	addr1, addr2, addr3 := common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")
+	// calls of the blocks: block number -> from -> to
+	calls := map[uint64]map[common.Address]common.Address{
+		1: {addr1: addr2},
+		2: {addr2: addr3},
+		3: {addr1: addr3},
+		4: {addr3: addr1},
+		5: {addr1: addr2, addr2: addr3},
+	}
+	promote := func(from, to uint64) {
+		froms, tos := map[string]*roaring.Bitmap{}, map[string]*roaring.Bitmap{}
+		add := func(m map[string]*roaring.Bitmap, addr common.Address, blockNum uint64) {
+			if _, ok := m[string(addr[:])]; !ok {
+				m[string(addr[:])] = roaring.New()
+			}
+			m[string(addr[:])].Add(uint32(blockNum))
+		}
+		for blockNum := from; blockNum <= to; blockNum++ {
+			for caller, callee := range calls[blockNum] {
+				add(froms, caller, blockNum)
+				add(tos, callee, blockNum)
+			}
+		}
+		collectorFrom := etl.NewCollector("", etl.NewSortableBuffer(etl.BufferOptimalSize))
+		collectorTo := etl.NewCollector("", etl.NewSortableBuffer(etl.BufferOptimalSize))
+		require.NoError(loadCallTraces("logPrefix", tx, collectorFrom, collectorTo, froms, tos, nil))
+	}
+	unwind := func(from, to uint64) {
+		froms, tos := map[string]struct{}{}, map[string]struct{}{}
+		for blockNum := to + 1; blockNum <= from; blockNum++ {
+			for caller, callee := range calls[blockNum] {
+				froms[string(caller[:])] = struct{}{}
+				tos[string(callee[:])] = struct{}{}
+			}
+		}
+		require.NoError(truncateCallTraces(tx.(ethdb.HasTx).Tx(), froms, tos, to+1, from+1))
+	}
+	blocks := func(bucket string, addr common.Address) []uint32 {
+		c := tx.(ethdb.HasTx).Tx().Cursor(bucket)
+		defer c.Close()
+		m, err := bitmapdb.Get(c, addr[:], 0, 10_000_000)
+		require.NoError(err)
+		return m.ToArray()
+	}
+	snapshot := func() map[string][]uint32 {
+		res := map[string][]uint32{}
+		for _, bucket := range []string{dbutils.CallFromIndex, dbutils.CallToIndex} {
+			for _, addr := range []common.Address{addr1, addr2, addr3} {
+				res[bucket+string(addr[:])] = blocks(bucket, addr)
+			}
+		}
+		return res
+	}
+
+	promote(1, 3)
+	require.Equal([]uint32{1, 3}, blocks(dbutils.CallFromIndex, addr1))
+	require.Equal([]uint32{2, 3}, blocks(dbutils.CallToIndex, addr3))
+	afterBlock3 := snapshot()
+
+	promote(4, 5)
+	require.Equal([]uint32{1, 3, 5}, blocks(dbutils.CallFromIndex, addr1))
+	require.Equal([]uint32{2, 5}, blocks(dbutils.CallFromIndex, addr2))
+	require.Equal([]uint32{4}, blocks(dbutils.CallToIndex, addr1))
+
+	unwind(5, 3)
+	require.Equal(afterBlock3, snapshot())
+
+	// promoting the unwound blocks again gives the same index
+	promote(4, 5)
+	afterBlock5 := snapshot()
+	unwind(5, 3)
+	promote(4, 5)
+	require.Equal(afterBlock5, snapshot())
+
+	unwind(5, 0)
+	for _, v := range snapshot() {
+		require.Empty(v)
+	}
+}
@@ -1,6 +1,7 @@
 package stagedsync
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -9,33 +10,29 @@ import (
 )
 
 func SpawnAccountHistoryIndex(s *StageState, db ethdb.Database, tmpdir string, quitCh <-chan struct{}) error {
-	endBlock, err := s.ExecutionAt(db)
-	logPrefix := s.state.LogPrefix()
-	if err != nil {
-		return fmt.Errorf("%s: getting last executed block: %w", logPrefix, err)
-	}
-	if endBlock == s.BlockNumber {
-		s.Done()
-		return nil
-	}
-	var blockNum uint64
-	lastProcessedBlockNumber := s.BlockNumber
-	if lastProcessedBlockNumber > 0 {
-		blockNum = lastProcessedBlockNumber + 1
-	}
+	return spawnHistoryIndex(s, db, false /* storage */, tmpdir, quitCh)
+}
 
-	ig := core.NewIndexGenerator(logPrefix, db, quitCh)
-	ig.TempDir = tmpdir
+func SpawnStorageHistoryIndex(s *StageState, db ethdb.Database, tmpdir string, quitCh <-chan struct{}) error {
+	return spawnHistoryIndex(s, db, true /* storage */, tmpdir, quitCh)
+}
 
-	if err := ig.GenerateIndex(blockNum, endBlock, dbutils.PlainAccountChangeSetBucket, tmpdir); err != nil {
-		return fmt.Errorf("%s: fail to generate index: %w", logPrefix, err)
+func spawnHistoryIndex(s *StageState, db ethdb.Database, storage bool, tmpdir string, quitCh <-chan struct{}) error {
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 	}
 
-	return s.DoneAndUpdate(db, endBlock)
-}
-
-func SpawnStorageHistoryIndex(s *StageState, db ethdb.Database, tmpdir string, quitCh <-chan struct{}) error {
-	endBlock, err := s.ExecutionAt(db)
+	endBlock, err := s.ExecutionAt(tx)
 	logPrefix := s.state.LogPrefix()
 	if err != nil {
 		return fmt.Errorf("%s: getting last executed block: %w", logPrefix, err)
@@ -49,13 +46,22 @@ func SpawnStorageHistoryIndex(s *StageState, db ethdb.Database, tmpdir string, q
 	if lastProcessedBlockNumber > 0 {
 		blockNum = lastProcessedBlockNumber + 1
 	}
-	ig := core.NewIndexGenerator(logPrefix, db, quitCh)
-	ig.TempDir = tmpdir
-	if err := ig.GenerateIndex(blockNum, endBlock, dbutils.PlainStorageChangeSetBucket, tmpdir); err != nil {
+
+	if err := s.ExecuteInCheckpoints(tx, blockNum, endBlock, !useExternalTx, func(from, to uint64) error {
+		return core.RebuildHistoryIndexRange(logPrefix, tx, true /* plain */, storage, from, to, tmpdir, quitCh)
+	}); err != nil {
 		return fmt.Errorf("%s: fail to generate index: %w", logPrefix, err)
 	}
 
-	return s.DoneAndUpdate(db, endBlock)
+	if err := s.DoneAndUpdate(tx, endBlock); err != nil {
+		return err
+	}
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func UnwindAccountHistoryIndex(u *UnwindState, s *StageState, db ethdb.Database, quitCh <-chan struct{}) error {
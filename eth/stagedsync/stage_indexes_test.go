@@ -0,0 +1,90 @@
+package stagedsync
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountHistoryIndexResumesFromCheckpoint(t *testing.T) {
+	require := require.New(t)
+	defer func(prev uint64) { checkpointEvery = prev }(checkpointEvery)
+	checkpointEvery = 50
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	const blocks = 200
+	addr := common.HexToAddress("0x01")
+	csInfo := changeset.Mapper[dbutils.PlainAccountChangeSetBucket]
+	var expected []uint32
+	for blockNum := uint64(0); blockNum < blocks; blockNum++ {
+		cs := csInfo.New()
+		require.NoError(cs.Add(addr[:], []byte(strconv.Itoa(int(blockNum)))))
+		v, err := csInfo.Encode(cs)
+		require.NoError(err)
+		require.NoError(db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(blockNum), v))
+		expected = append(expected, uint32(blockNum))
+	}
+	require.NoError(stages.SaveStageProgress(db, stages.Execution, blocks-1, nil))
+	indexed := func() []uint32 {
+		tx, err := db.KV().Begin(context.Background(), nil, false)
+		require.NoError(err)
+		defer tx.Rollback()
+		c := tx.Cursor(csInfo.IndexBucket)
+		defer c.Close()
+		m, err := bitmapdb.Get(c, addr[:], 0, 10_000_000)
+		require.NoError(err)
+		return m.ToArray()
+	}
+	progress := func() uint64 {
+		progress, _, err := stages.GetStageProgress(db, stages.AccountHistoryIndex)
+		require.NoError(err)
+		return progress
+	}
+
+	errCrash := errors.New("crash")
+	st := NewState(nil)
+	st.OnCheckpoint(func(_ stages.SyncStage, blockNum uint64) error {
+		if blockNum == 99 {
+			return errCrash
+		}
+		return nil
+	})
+
+	// checkpoints never commit transaction of the caller
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	err = SpawnAccountHistoryIndex(&StageState{state: st, Stage: stages.AccountHistoryIndex}, tx, "", nil)
+	require.True(errors.Is(err, errCrash), "%v", err)
+	tx.Rollback()
+	require.Equal(uint64(0), progress())
+	require.Empty(indexed())
+
+	// the stage owning the transaction commits checkpoints
+	err = SpawnAccountHistoryIndex(&StageState{state: st, Stage: stages.AccountHistoryIndex}, db, "", nil)
+	require.True(errors.Is(err, errCrash), "%v", err)
+	require.Equal(uint64(99), progress())
+	require.Equal(expected[:100], indexed())
+
+	// restart resumes from the checkpoint
+	require.NoError(SpawnAccountHistoryIndex(&StageState{state: NewState(nil), Stage: stages.AccountHistoryIndex, BlockNumber: progress()}, db, "", nil))
+	require.Equal(uint64(blocks-1), progress())
+	require.Equal(expected, indexed())
+
+	// unwind rolls the progress back, and the index can be built again
+	u := &UnwindState{Stage: stages.AccountHistoryIndex, UnwindPoint: 120}
+	require.NoError(UnwindAccountHistoryIndex(u, &StageState{Stage: stages.AccountHistoryIndex, BlockNumber: progress()}, db, nil))
+	require.Equal(uint64(120), progress())
+	require.Equal(expected[:121], indexed())
+	require.NoError(SpawnAccountHistoryIndex(&StageState{state: NewState(nil), Stage: stages.AccountHistoryIndex, BlockNumber: progress()}, db, "", nil))
+	require.Equal(expected, indexed())
+}
@@ -84,7 +84,7 @@ func regenerateIntermediateHashes(logPrefix string, db ethdb.Database, tmpdir st
 	comparator := db.(ethdb.HasTx).Tx().Comparator(dbutils.IntermediateTrieHashBucket)
 	buf.SetComparator(comparator)
 	collector := etl.NewCollector(tmpdir, buf)
-	hashCollector := func(keyHex []byte, hash []byte) error {
+	hashCollector := trie.HashCollectorFunc(func(keyHex []byte, hash []byte) error {
 		if len(keyHex) == 0 {
 			return nil
 		}
@@ -92,7 +92,7 @@ func regenerateIntermediateHashes(logPrefix string, db ethdb.Database, tmpdir st
 			return collector.Collect(keyHex[:trie.IHDupKeyLen], append(keyHex[trie.IHDupKeyLen:], hash...))
 		}
 		return collector.Collect(keyHex, hash)
-	}
+	})
 	loader := trie.NewFlatDBTrieLoader(logPrefix, dbutils.CurrentStateBucket, dbutils.IntermediateTrieHashBucket)
 	if err := loader.Reset(trie.NewRetainList(0), hashCollector /* HashCollector */, false); err != nil {
 		return err
@@ -252,7 +252,7 @@ func incrementIntermediateHashes(logPrefix string, s *StageState, db ethdb.Datab
 	comparator := db.(ethdb.HasTx).Tx().Comparator(dbutils.IntermediateTrieHashBucket)
 	buf.SetComparator(comparator)
 	collector := etl.NewCollector(tmpdir, buf)
-	hashCollector := func(keyHex []byte, hash []byte) error {
+	hashCollector := trie.HashCollectorFunc(func(keyHex []byte, hash []byte) error {
 		if len(keyHex) == 0 {
 			return nil
 		}
@@ -261,7 +261,7 @@ func incrementIntermediateHashes(logPrefix string, s *StageState, db ethdb.Datab
 		}
 
 		return collector.Collect(keyHex, hash)
-	}
+	})
 	loader := trie.NewFlatDBTrieLoader(logPrefix, dbutils.CurrentStateBucket, dbutils.IntermediateTrieHashBucket)
 	// hashCollector in the line below will collect deletes
 	if err := loader.Reset(unfurl, hashCollector, false); err != nil {
@@ -354,7 +354,7 @@ func unwindIntermediateHashesStageImpl(logPrefix string, u *UnwindState, s *Stag
 	comparator := db.(ethdb.HasTx).Tx().Comparator(dbutils.IntermediateTrieHashBucket)
 	buf.SetComparator(comparator)
 	collector := etl.NewCollector(tmpdir, buf)
-	hashCollector := func(keyHex []byte, hash []byte) error {
+	hashCollector := trie.HashCollectorFunc(func(keyHex []byte, hash []byte) error {
 		if len(keyHex) == 0 {
 			return nil
 		}
@@ -362,7 +362,7 @@ func unwindIntermediateHashesStageImpl(logPrefix string, u *UnwindState, s *Stag
 			return collector.Collect(keyHex[:trie.IHDupKeyLen], append(keyHex[trie.IHDupKeyLen:], hash...))
 		}
 		return collector.Collect(keyHex, hash)
-	}
+	})
 	loader := trie.NewFlatDBTrieLoader(logPrefix, dbutils.CurrentStateBucket, dbutils.IntermediateTrieHashBucket)
 	// hashCollector in the line below will collect deletes
 	if err := loader.Reset(unfurl, hashCollector, false); err != nil {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/ledgerwatch/turbo-geth/ethdb/cbor"
@@ -17,6 +18,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
@@ -24,10 +26,12 @@ import (
 )
 
 const (
-	logIndicesMemLimit       = 256 * datasize.MB
-	logIndicesCheckSizeEvery = 30 * time.Second
+	logIndicesMemLimit = 256 * datasize.MB
 )
 
+// logIndicesBufferSize - size of the append buffer of each collector, tests make it small to get many buffer files
+var logIndicesBufferSize = int(logIndicesMemLimit / 2)
+
 func SpawnLogIndex(s *StageState, db ethdb.Database, tmpdir string, quit <-chan struct{}) error {
 	var tx ethdb.DbWithPendingMutations
 	var useExternalTx bool
@@ -58,7 +62,9 @@ func SpawnLogIndex(s *StageState, db ethdb.Database, tmpdir string, quit <-chan
 		start++
 	}
 
-	if err := promoteLogIndex(logPrefix, tx, start, tmpdir, quit); err != nil {
+	if err := s.ExecuteInCheckpoints(tx, start, endBlock, !useExternalTx, func(from, to uint64) error {
+		return promoteLogIndex(logPrefix, tx, from, to, tmpdir, quit)
+	}); err != nil {
 		return err
 	}
 
@@ -74,30 +80,65 @@ func SpawnLogIndex(s *StageState, db ethdb.Database, tmpdir string, quit <-chan
 	return nil
 }
 
-func promoteLogIndex(logPrefix string, db ethdb.Database, start uint64, tmpdir string, quit <-chan struct{}) error {
+// promoteLogIndex - indexes logs of the blocks [start, end]
+func promoteLogIndex(logPrefix string, db ethdb.Database, start, end uint64, tmpdir string, quit <-chan struct{}) error {
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
 
 	tx := db.(ethdb.HasTx).Tx()
-	topics := map[string]*roaring.Bitmap{}
-	addresses := map[string]*roaring.Bitmap{}
 	receipts := tx.Cursor(dbutils.BlockReceiptsPrefix)
 	defer receipts.Close()
-	checkFlushEvery := time.NewTicker(logIndicesCheckSizeEvery)
-	defer checkFlushEvery.Stop()
 
-	collectorTopics := etl.NewCollector(tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize))
-	collectorAddrs := etl.NewCollector(tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize))
-
-	for k, v, err := receipts.Seek(dbutils.EncodeBlockNumber(start)); k != nil; k, v, err = receipts.Next() {
-		if err != nil {
-			return err
+	// (key, block number) pairs are collected and loaded in one sorted pass, merging into the existing shards.
+	// Append buffers keep the block numbers of a key together, so the memory limit is about the raw data,
+	// not about the bitmap objects.
+	collectorTopics := etl.NewCollector(tmpdir, etl.NewAppendBuffer(logIndicesBufferSize))
+	collectorAddrs := etl.NewCollector(tmpdir, etl.NewAppendBuffer(logIndicesBufferSize))
+
+	// Receipts are read by this goroutine (cursor belongs to the transaction), decoded by the workers,
+	// and collected by this goroutine again, in the order they were read.
+	numOfWorkers := runtime.NumCPU()
+	jobs := make(chan *logIndexJob, numOfWorkers*4)
+	results := make(chan *logIndexJob, numOfWorkers*4)
+	done := make(chan struct{})
+	defer close(done)
+	wg := new(sync.WaitGroup)
+	wg.Add(numOfWorkers)
+	for i := 0; i < numOfWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			decodeLogIndexJobs(logPrefix, jobs, results, done)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := map[uint64]*logIndexJob{}
+	var nextSeq uint64
+	var blockNum uint64
+	merge := func(job *logIndexJob) error {
+		if job.err != nil {
+			return job.err
 		}
-
-		if err := common.Stopped(quit); err != nil {
-			return err
+		pending[job.seq] = job
+		for next, ok := pending[nextSeq]; ok; next, ok = pending[nextSeq] {
+			delete(pending, nextSeq)
+			nextSeq++
+			blockNum = next.blockNum
+			v := dbutils.EncodeBlockNumber32(blockNum)
+			for _, topic := range next.topics {
+				if err := collectorTopics.Collect([]byte(topic), v); err != nil {
+					return err
+				}
+			}
+			for _, addr := range next.addrs {
+				if err := collectorAddrs.Collect([]byte(addr), v); err != nil {
+					return err
+				}
+			}
 		}
-		blockNum := binary.BigEndian.Uint64(k[:8])
 
 		select {
 		default:
@@ -105,115 +146,160 @@ func promoteLogIndex(logPrefix string, db ethdb.Database, start uint64, tmpdir s
 			var m runtime.MemStats
 			runtime.ReadMemStats(&m)
 			log.Info(fmt.Sprintf("[%s] Progress", logPrefix), "number", blockNum, "alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys))
-		case <-checkFlushEvery.C:
-			if needFlush(topics, logIndicesMemLimit) {
-				if err := flushBitmaps(collectorTopics, topics); err != nil {
-					return err
-				}
-				topics = map[string]*roaring.Bitmap{}
-			}
-
-			if needFlush(addresses, logIndicesMemLimit) {
-				if err := flushBitmaps(collectorAddrs, addresses); err != nil {
-					return err
-				}
-				addresses = map[string]*roaring.Bitmap{}
-			}
 		}
+		return nil
+	}
 
-		receipts := types.Receipts{}
-		if err := cbor.Unmarshal(&receipts, v); err != nil {
-			return fmt.Errorf("%s: receipt unmarshal failed: %w, blocl=%d", logPrefix, err, blockNum)
+	var seq uint64
+	for k, v, err := receipts.Seek(dbutils.EncodeBlockNumber(start)); k != nil; k, v, err = receipts.Next() {
+		if err != nil {
+			return err
 		}
 
-		for _, receipt := range receipts {
-			for _, log := range receipt.Logs {
-				for _, topic := range log.Topics {
-					topicStr := string(topic.Bytes())
-					m, ok := topics[topicStr]
-					if !ok {
-						m = roaring.New()
-						topics[topicStr] = m
-					}
-					m.Add(uint32(blockNum))
-				}
-
-				accStr := string(log.Address.Bytes())
-				m, ok := addresses[accStr]
-				if !ok {
-					m = roaring.New()
-					addresses[accStr] = m
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		number := binary.BigEndian.Uint64(k[:8])
+		if number > end {
+			break
+		}
+		// receipts of non-canonical blocks may stay in the bucket, they are not indexed
+		canonical, err := rawdb.ReadCanonicalHash(db, number)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(canonical[:], k[8:]) {
+			continue
+		}
+		job := &logIndexJob{seq: seq, blockNum: number, receipts: common.CopyBytes(v)}
+		seq++
+		for sent := false; !sent; {
+			select {
+			case jobs <- job:
+				sent = true
+			case result := <-results:
+				if err := merge(result); err != nil {
+					return err
 				}
-				m.Add(uint32(blockNum))
 			}
 		}
 	}
+	close(jobs)
+	for result := range results {
+		if err := common.Stopped(quit); err != nil {
+			return err
+		}
+		if err := merge(result); err != nil {
+			return err
+		}
+	}
 
-	if err := flushBitmaps(collectorTopics, topics); err != nil {
+	loaderFunc := loadLogIndexFunc(logPrefix)
+	if err := collectorTopics.Load(logPrefix, db, dbutils.LogTopicIndex, loaderFunc, etl.TransformArgs{Quit: quit}); err != nil {
 		return err
 	}
-	if err := flushBitmaps(collectorAddrs, addresses); err != nil {
+
+	if err := collectorAddrs.Load(logPrefix, db, dbutils.LogAddressIndex, loaderFunc, etl.TransformArgs{Quit: quit}); err != nil {
 		return err
 	}
 
-	var currentBitmap = roaring.New()
-	var buf = bytes.NewBuffer(nil)
+	return nil
+}
+
+type logIndexJob struct {
+	seq      uint64 // order in which receipts were read
+	blockNum uint64
+	receipts []byte
+	topics   []string // unique topics of the block
+	addrs    []string // unique addresses of the block
+	err      error
+}
+
+func decodeLogIndexJobs(logPrefix string, in <-chan *logIndexJob, out chan<- *logIndexJob, done <-chan struct{}) {
+	for {
+		var job *logIndexJob
+		var ok bool
+		select {
+		case <-done:
+			return
+		case job, ok = <-in:
+			if !ok {
+				return
+			}
+		}
 
-	var loaderFunc = func(k []byte, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
-		lastChunkKey := make([]byte, len(k)+4)
-		copy(lastChunkKey, k)
-		binary.BigEndian.PutUint32(lastChunkKey[len(k):], ^uint32(0))
+		receipts := types.Receipts{}
+		if err := cbor.Unmarshal(&receipts, job.receipts); err != nil {
+			job.err = fmt.Errorf("%s: receipt unmarshal failed: %w, block=%d", logPrefix, err, job.blockNum)
+		} else {
+			topics := map[string]struct{}{}
+			addrs := map[string]struct{}{}
+			for _, receipt := range receipts {
+				for _, log := range receipt.Logs {
+					for _, topic := range log.Topics {
+						topics[string(topic.Bytes())] = struct{}{}
+					}
+					addrs[string(log.Address.Bytes())] = struct{}{}
+				}
+			}
+			for topic := range topics {
+				job.topics = append(job.topics, topic)
+			}
+			for addr := range addrs {
+				job.addrs = append(job.addrs, addr)
+			}
+		}
+		job.receipts = nil
+
+		select {
+		case <-done:
+			return
+		case out <- job:
+		}
+	}
+}
+
+// loadLogIndexFunc merges collected block numbers (4 bytes each, ascending) of the key into its last shard,
+// and writes out the shards which became full
+func loadLogIndexFunc(logPrefix string) etl.LoadFunc {
+	buf := bytes.NewBuffer(nil)
+	return func(k []byte, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		if len(v)%4 != 0 {
+			return fmt.Errorf("%s: value of %x must be a multiple of 4, got %d bytes", logPrefix, k, len(v))
+		}
+		lastChunkKey := bitmapdb.ShardKey(k, ^uint32(0))
 		lastChunkBytes, err := table.Get(lastChunkKey)
 		if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
 			return fmt.Errorf("%s: find last chunk failed: %w", logPrefix, err)
 		}
 
-		lastChunk := roaring.New()
+		bm := roaring.New()
 		if len(lastChunkBytes) > 0 {
-			_, err = lastChunk.FromBuffer(lastChunkBytes)
-			if err != nil {
+			if _, err = bm.FromBuffer(common.CopyBytes(lastChunkBytes)); err != nil {
 				return fmt.Errorf("%s: couldn't read last log index chunk: %w, len(lastChunkBytes)=%d", logPrefix, err, len(lastChunkBytes))
 			}
 		}
-
-		if _, err := currentBitmap.FromBuffer(v); err != nil {
-			return err
+		for i := 0; i < len(v); i += 4 {
+			bm.Add(binary.BigEndian.Uint32(v[i:]))
 		}
-		currentBitmap.Or(lastChunk) // merge last existing chunk from db - next loop will overwrite it
-		nextChunk := bitmapdb.ChunkIterator(currentBitmap, bitmapdb.ChunkLimit)
+
+		nextChunk := bitmapdb.ChunkIterator(bm, bitmapdb.ChunkLimit)
 		for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+			chunk.RunOptimize()
 			buf.Reset()
 			if _, err := chunk.WriteTo(buf); err != nil {
 				return err
 			}
-			chunkKey := make([]byte, len(k)+4)
-			copy(chunkKey, k)
-			if currentBitmap.GetCardinality() == 0 {
-				binary.BigEndian.PutUint32(chunkKey[len(k):], ^uint32(0))
-				if err := next(k, chunkKey, common.CopyBytes(buf.Bytes())); err != nil {
-					return err
-				}
-				break
+			chunkKey := lastChunkKey
+			if bm.GetCardinality() > 0 { // not the last chunk
+				chunkKey = bitmapdb.ShardKey(k, chunk.Maximum())
 			}
-			binary.BigEndian.PutUint32(chunkKey[len(k):], chunk.Maximum())
 			if err := next(k, chunkKey, common.CopyBytes(buf.Bytes())); err != nil {
 				return err
 			}
 		}
-
-		currentBitmap.Clear()
 		return nil
 	}
-
-	if err := collectorTopics.Load(logPrefix, db, dbutils.LogTopicIndex, loaderFunc, etl.TransformArgs{Quit: quit}); err != nil {
-		return err
-	}
-
-	if err := collectorAddrs.Load(logPrefix, db, dbutils.LogAddressIndex, loaderFunc, etl.TransformArgs{Quit: quit}); err != nil {
-		return err
-	}
-
-	return nil
 }
 
 func UnwindLogIndex(u *UnwindState, s *StageState, db ethdb.Database, quitCh <-chan struct{}) error {
@@ -253,11 +339,17 @@ func unwindLogIndex(logPrefix string, db ethdb.DbWithPendingMutations, from, to
 	topics := map[string]struct{}{}
 	addrs := map[string]struct{}{}
 
+	// Receipts of all forks of the unwound blocks are read: after a reorg canonical hashes already point
+	// to the new chain, while the index still has the blocks of the old one.
+	// Keys which have no bits in the unwound range are left untouched.
 	start := dbutils.EncodeBlockNumber(to + 1)
 	if err := db.Walk(dbutils.BlockReceiptsPrefix, start, 0, func(k, v []byte) (bool, error) {
 		if err := common.Stopped(quitCh); err != nil {
 			return false, err
 		}
+		if binary.BigEndian.Uint64(k[:8]) > from {
+			return false, nil
+		}
 		receipts := types.Receipts{}
 		if err := cbor.Unmarshal(&receipts, v); err != nil {
 			return false, fmt.Errorf("%s: receipt unmarshal failed: %w, k=%x", logPrefix, err, k)
@@ -276,15 +368,41 @@ func unwindLogIndex(logPrefix string, db ethdb.DbWithPendingMutations, from, to
 		return err
 	}
 
-	if err := truncateBitmaps(db.(ethdb.HasTx).Tx(), dbutils.LogTopicIndex, topics, to+1, from+1); err != nil {
+	tx := db.(ethdb.HasTx).Tx()
+	topics, err := keysWithBits(tx, dbutils.LogTopicIndex, topics, to+1, from)
+	if err != nil {
+		return err
+	}
+	addrs, err = keysWithBits(tx, dbutils.LogAddressIndex, addrs, to+1, from)
+	if err != nil {
+		return err
+	}
+	if err := truncateBitmaps(tx, dbutils.LogTopicIndex, topics, to+1, from+1); err != nil {
 		return err
 	}
-	if err := truncateBitmaps(db.(ethdb.HasTx).Tx(), dbutils.LogAddressIndex, addrs, to+1, from+1); err != nil {
+	if err := truncateBitmaps(tx, dbutils.LogAddressIndex, addrs, to+1, from+1); err != nil {
 		return err
 	}
 	return nil
 }
 
+// keysWithBits - leaves only keys which have bits in the range [from, to] of the index, from > 0
+func keysWithBits(tx ethdb.Tx, bucket string, keys map[string]struct{}, from, to uint64) (map[string]struct{}, error) {
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	res := make(map[string]struct{}, len(keys))
+	for k := range keys {
+		m, err := bitmapdb.Get(c, []byte(k), uint32(from), uint32(to))
+		if err != nil {
+			return nil, err
+		}
+		if m.Rank(uint32(to)) > m.Rank(uint32(from-1)) {
+			res[k] = struct{}{}
+		}
+	}
+	return res, nil
+}
+
 func needFlush(bitmaps map[string]*roaring.Bitmap, memLimit datasize.ByteSize) bool {
 	sz := uint64(0)
 	for _, m := range bitmaps {
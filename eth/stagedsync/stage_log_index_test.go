@@ -1,13 +1,22 @@
 package stagedsync
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"math/big"
 	"testing"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/cbor"
 
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/stretchr/testify/require"
@@ -50,7 +59,7 @@ func TestLogIndex(t *testing.T) {
 	err = appendReceipts(tx, receipts2, 2, common.Hash{})
 	require.NoError(err)
 
-	err = promoteLogIndex("logPrefix", tx, 0, "", nil)
+	err = promoteLogIndex("logPrefix", tx, 0, 2, "", nil)
 	require.NoError(err)
 
 	// Check indices GetCardinality (in how many blocks they meet)
@@ -113,3 +122,356 @@ func TestLogIndex(t *testing.T) {
 	require.NoError(err)
 	require.Equal(0, int(m.GetCardinality()))
 }
+
+func TestLogIndexManyBlocks(t *testing.T) {
+	require := require.New(t)
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	// more blocks than fit into one shard
+	const blocks = 5000
+	addrs := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")}
+	expected := make([][]uint32, len(addrs))
+	for blockNum := uint64(1); blockNum <= blocks; blockNum++ {
+		var receipts types.Receipts
+		for i, addr := range addrs {
+			if blockNum%uint64(i+1) != 0 {
+				continue
+			}
+			receipts = append(receipts, &types.Receipt{Logs: []*types.Log{{Address: addr, Topics: []common.Hash{addr.Hash()}}}})
+			expected[i] = append(expected[i], uint32(blockNum))
+		}
+		require.NoError(appendReceipts(tx, receipts, blockNum, common.Hash{}))
+	}
+
+	require.NoError(promoteLogIndex("logPrefix", tx, 0, blocks, "", nil))
+
+	logAddrIndex := tx.(ethdb.HasTx).Tx().Cursor(dbutils.LogAddressIndex)
+	defer logAddrIndex.Close()
+	for i, addr := range addrs {
+		m, err := bitmapdb.Get(logAddrIndex, addr[:], 0, 10_000_000)
+		require.NoError(err)
+		require.Equal(expected[i], m.ToArray())
+	}
+
+	// shards are ordered by the blocks they keep
+	var prevMax uint32
+	var prevKey []byte
+	for k, v, err := logAddrIndex.First(); k != nil; k, v, err = logAddrIndex.Next() {
+		require.NoError(err)
+		if !bytes.Equal(k[:len(k)-4], prevKey) {
+			prevKey, prevMax = common.CopyBytes(k[:len(k)-4]), 0
+		}
+		m := roaring.New()
+		_, err = m.FromBuffer(v)
+		require.NoError(err)
+		require.Greater(m.Minimum(), prevMax)
+		prevMax = m.Maximum()
+	}
+
+	// broken receipts abort the stage
+	require.NoError(tx.Put(dbutils.BlockReceiptsPrefix, dbutils.BlockReceiptsKey(blocks+1, common.Hash{}), []byte{0xff}))
+	require.Error(promoteLogIndex("logPrefix", tx, 0, blocks+1, "", nil))
+}
+
+func TestLogIndexManyBufferFiles(t *testing.T) {
+	require := require.New(t)
+	defer func(size int) { logIndicesBufferSize = size }(logIndicesBufferSize)
+	logIndicesBufferSize = 1024 // every few blocks go to a new buffer file
+
+	db, refDb := ethdb.NewMemDatabase(), ethdb.NewMemDatabase()
+	defer db.Close()
+	defer refDb.Close()
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	defer tx.Rollback()
+	refTx, err := refDb.Begin(context.Background(), true)
+	require.NoError(err)
+	defer refTx.Rollback()
+
+	const blocks = 6000
+	for blockNum := uint64(1); blockNum <= blocks; blockNum++ {
+		var receipts types.Receipts
+		for i := uint64(1); i <= 5; i++ {
+			if blockNum%i != 0 {
+				continue
+			}
+			addr := common.BigToAddress(big.NewInt(int64(i)))
+			topics := []common.Hash{addr.Hash(), common.BigToHash(big.NewInt(int64(blockNum % 7)))}
+			receipts = append(receipts, &types.Receipt{Logs: []*types.Log{{Address: addr, Topics: topics}}})
+		}
+		require.NoError(appendReceipts(tx, receipts, blockNum, common.Hash{}))
+		require.NoError(appendReceipts(refTx, receipts, blockNum, common.Hash{}))
+	}
+
+	// second run merges into the last shards left by the first one
+	require.NoError(promoteLogIndex("logPrefix", tx, 0, blocks/2, "", nil))
+	require.NoError(promoteLogIndex("logPrefix", tx, blocks/2+1, blocks, "", nil))
+	require.NoError(promoteLogIndexBitmaps(refTx, 0, blocks/2))
+	require.NoError(promoteLogIndexBitmaps(refTx, blocks/2+1, blocks))
+
+	for _, bucket := range []string{dbutils.LogTopicIndex, dbutils.LogAddressIndex} {
+		got, expected := tx.(ethdb.HasTx).Tx().Cursor(bucket), refTx.(ethdb.HasTx).Tx().Cursor(bucket)
+		k, v, err := got.First()
+		require.NoError(err)
+		refK, refV, err := expected.First()
+		require.NoError(err)
+		for ; refK != nil; refK, refV, err = expected.Next() {
+			require.NoError(err)
+			require.Equal(refK, k, bucket)
+			m, refM := roaring.New(), roaring.New()
+			_, err = m.FromBuffer(v)
+			require.NoError(err)
+			_, err = refM.FromBuffer(refV)
+			require.NoError(err)
+			require.True(refM.Equals(m), "%s: shard %x", bucket, k)
+			k, v, err = got.Next()
+			require.NoError(err)
+		}
+		require.Nil(k, bucket)
+		got.Close()
+		expected.Close()
+	}
+}
+
+// promoteLogIndexBitmaps builds log indices the way it was done before the append buffers:
+// one bitmap per key in memory, OR-ed with the last shard on load
+func promoteLogIndexBitmaps(db ethdb.Database, start, end uint64) error {
+	topics := map[string]*roaring.Bitmap{}
+	addresses := map[string]*roaring.Bitmap{}
+	add := func(bitmaps map[string]*roaring.Bitmap, k []byte, blockNum uint64) {
+		m, ok := bitmaps[string(k)]
+		if !ok {
+			m = roaring.New()
+			bitmaps[string(k)] = m
+		}
+		m.Add(uint32(blockNum))
+	}
+	if err := db.Walk(dbutils.BlockReceiptsPrefix, dbutils.EncodeBlockNumber(start), 0, func(k, v []byte) (bool, error) {
+		blockNum := binary.BigEndian.Uint64(k[:8])
+		if blockNum > end {
+			return false, nil
+		}
+		receipts := types.Receipts{}
+		if err := cbor.Unmarshal(&receipts, v); err != nil {
+			return false, err
+		}
+		for _, receipt := range receipts {
+			for _, log := range receipt.Logs {
+				for _, topic := range log.Topics {
+					add(topics, topic.Bytes(), blockNum)
+				}
+				add(addresses, log.Address.Bytes(), blockNum)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	loadFunc := func(k []byte, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+		lastChunkKey := bitmapdb.ShardKey(k, ^uint32(0))
+		lastChunkBytes, err := table.Get(lastChunkKey)
+		if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+			return err
+		}
+		bm := roaring.New()
+		if _, err := bm.FromBuffer(common.CopyBytes(v)); err != nil {
+			return err
+		}
+		if len(lastChunkBytes) > 0 {
+			lastChunk := roaring.New()
+			if _, err := lastChunk.FromBuffer(common.CopyBytes(lastChunkBytes)); err != nil {
+				return err
+			}
+			bm.Or(lastChunk)
+		}
+		nextChunk := bitmapdb.ChunkIterator(bm, bitmapdb.ChunkLimit)
+		for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+			buf := bytes.NewBuffer(nil)
+			if _, err := chunk.WriteTo(buf); err != nil {
+				return err
+			}
+			chunkKey := lastChunkKey
+			if bm.GetCardinality() > 0 {
+				chunkKey = bitmapdb.ShardKey(k, chunk.Maximum())
+			}
+			if err := next(k, chunkKey, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for bucket, bitmaps := range map[string]map[string]*roaring.Bitmap{dbutils.LogTopicIndex: topics, dbutils.LogAddressIndex: addresses} {
+		collector := etl.NewCollector("", etl.NewSortableBuffer(etl.BufferOptimalSize))
+		if err := flushBitmaps(collector, bitmaps); err != nil {
+			return err
+		}
+		if err := collector.Load("logPrefix", db, bucket, loadFunc, etl.TransformArgs{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkPromoteLogIndex(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(b, err)
+	defer tx.Rollback()
+
+	for blockNum := uint64(1); blockNum <= 10_000; blockNum++ {
+		receipts := make(types.Receipts, 20)
+		for i := range receipts {
+			addr := common.BigToAddress(big.NewInt(int64(blockNum*20) + int64(i)%500))
+			receipts[i] = &types.Receipt{Logs: []*types.Log{{Address: addr, Topics: []common.Hash{addr.Hash(), common.HexToHash("0x01")}}}}
+		}
+		require.NoError(b, appendReceipts(tx, receipts, blockNum, common.Hash{}))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, promoteLogIndex("logPrefix", tx, 0, 10_000, "", nil))
+		b.StopTimer()
+		require.NoError(b, tx.(ethdb.HasTx).Tx().(ethdb.BucketMigrator).ClearBucket(dbutils.LogAddressIndex))
+		require.NoError(b, tx.(ethdb.HasTx).Tx().(ethdb.BucketMigrator).ClearBucket(dbutils.LogTopicIndex))
+		b.StartTimer()
+	}
+}
+
+func TestLogIndexUnwindWithOrphanedReceipts(t *testing.T) {
+	require := require.New(t)
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	addr1, addr2, orphanAddr := common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")
+	topic1, topic2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	writeReceipts := func(blockNum uint64, fork byte, canonical bool, logs ...*types.Log) {
+		hash := common.Hash{fork, byte(blockNum)}
+		if canonical {
+			require.NoError(rawdb.WriteCanonicalHash(tx, hash, blockNum))
+		}
+		require.NoError(appendReceipts(tx, types.Receipts{{Logs: logs}}, blockNum, hash))
+	}
+	snapshot := func() map[string][]uint32 {
+		res := map[string][]uint32{}
+		for _, bucket := range []string{dbutils.LogTopicIndex, dbutils.LogAddressIndex} {
+			c := tx.(ethdb.HasTx).Tx().Cursor(bucket)
+			for _, key := range [][]byte{addr1[:], addr2[:], orphanAddr[:], topic1[:], topic2[:]} {
+				m, err := bitmapdb.Get(c, key, 0, 10_000_000)
+				require.NoError(err)
+				res[bucket+string(key)] = m.ToArray()
+			}
+			c.Close()
+		}
+		return res
+	}
+
+	writeReceipts(1, 0, true, &types.Log{Address: addr1, Topics: []common.Hash{topic1}})
+	writeReceipts(2, 0, true, &types.Log{Address: addr2, Topics: []common.Hash{topic2}})
+	require.NoError(promoteLogIndex("logPrefix", tx, 0, 2, "", nil))
+	afterBlock2 := snapshot()
+
+	writeReceipts(3, 0, true, &types.Log{Address: addr1, Topics: []common.Hash{topic2}})
+	// receipts of an orphaned block 3, with logs of an address which is in canonical blocks too
+	writeReceipts(3, 1, false, &types.Log{Address: orphanAddr, Topics: []common.Hash{topic1}}, &types.Log{Address: addr2, Topics: []common.Hash{topic1}})
+	writeReceipts(4, 0, true, &types.Log{Address: addr2, Topics: []common.Hash{topic2}})
+	require.NoError(promoteLogIndex("logPrefix", tx, 3, 4, "", nil))
+	afterBlock4 := snapshot()
+	require.Equal([]uint32{1, 3}, afterBlock4[dbutils.LogAddressIndex+string(addr1[:])])
+	require.Equal([]uint32{2, 4}, afterBlock4[dbutils.LogAddressIndex+string(addr2[:])])
+	require.Equal([]uint32{1}, afterBlock4[dbutils.LogTopicIndex+string(topic1[:])])
+	require.Empty(afterBlock4[dbutils.LogAddressIndex+string(orphanAddr[:])], "orphaned receipts are not indexed")
+
+	// only keys with bits in the unwound range are truncated
+	keys, err := keysWithBits(tx.(ethdb.HasTx).Tx(), dbutils.LogAddressIndex, map[string]struct{}{
+		string(addr1[:]): {}, string(addr2[:]): {}, string(orphanAddr[:]): {},
+	}, 4, 4)
+	require.NoError(err)
+	require.Equal(map[string]struct{}{string(addr2[:]): {}}, keys)
+
+	require.NoError(unwindLogIndex("logPrefix", tx, 4, 2, nil))
+	require.Equal(afterBlock2, snapshot())
+
+	// re-promoting the unwound blocks gives the same index
+	require.NoError(promoteLogIndex("logPrefix", tx, 3, 4, "", nil))
+	require.Equal(afterBlock4, snapshot())
+}
+
+func TestLogIndexResumesFromCheckpoint(t *testing.T) {
+	require := require.New(t)
+	defer func(prev uint64) { checkpointEvery = prev }(checkpointEvery)
+	checkpointEvery = 50
+
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	const blocks = 200
+	addr := common.HexToAddress("0x01")
+	var expected []uint32
+	tx, err := db.Begin(context.Background(), true)
+	require.NoError(err)
+	for blockNum := uint64(1); blockNum <= blocks; blockNum++ {
+		require.NoError(appendReceipts(tx, types.Receipts{{Logs: []*types.Log{{Address: addr}}}}, blockNum, common.Hash{}))
+		expected = append(expected, uint32(blockNum))
+	}
+	require.NoError(stages.SaveStageProgress(tx, stages.Execution, blocks, nil))
+	_, err = tx.Commit()
+	require.NoError(err)
+	indexed := func() []uint32 {
+		tx, err := db.KV().Begin(context.Background(), nil, false)
+		require.NoError(err)
+		defer tx.Rollback()
+		c := tx.Cursor(dbutils.LogAddressIndex)
+		defer c.Close()
+		m, err := bitmapdb.Get(c, addr[:], 0, 10_000_000)
+		require.NoError(err)
+		return m.ToArray()
+	}
+	progress := func() uint64 {
+		progress, _, err := stages.GetStageProgress(db, stages.LogIndex)
+		require.NoError(err)
+		return progress
+	}
+
+	errCrash := errors.New("crash")
+	crashAt := func(blockNum uint64) *State {
+		st := NewState(nil)
+		st.OnCheckpoint(func(_ stages.SyncStage, n uint64) error {
+			if n == blockNum {
+				return errCrash
+			}
+			return nil
+		})
+		return st
+	}
+
+	// checkpoints never commit transaction of the caller
+	tx, err = db.Begin(context.Background(), true)
+	require.NoError(err)
+	err = SpawnLogIndex(&StageState{state: crashAt(99), Stage: stages.LogIndex}, tx, "", nil)
+	require.True(errors.Is(err, errCrash), "%v", err)
+	tx.Rollback()
+	require.Equal(uint64(0), progress())
+	require.Empty(indexed())
+
+	// the stage owning the transaction commits checkpoints
+	err = SpawnLogIndex(&StageState{state: crashAt(99), Stage: stages.LogIndex}, db, "", nil)
+	require.True(errors.Is(err, errCrash), "%v", err)
+	require.Equal(uint64(99), progress())
+	require.Equal(expected[:99], indexed())
+
+	// restart resumes from the checkpoint
+	require.NoError(SpawnLogIndex(&StageState{state: NewState(nil), Stage: stages.LogIndex, BlockNumber: progress()}, db, "", nil))
+	require.Equal(uint64(blocks), progress())
+	require.Equal(expected, indexed())
+}
@@ -0,0 +1,112 @@
+package stagedsync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+const stageMetricsLogEvery = 30 * time.Second
+
+// stageMetrics measures every run of a stage: wall time, blocks processed and bytes written,
+// persists them into dbutils.SyncStageMetrics and periodically logs a summary
+type stageMetrics struct {
+	lastLog time.Time
+}
+
+type stageRun struct {
+	stage     stages.SyncStage
+	start     time.Time
+	fromBlock uint64
+	dbSize    uint64
+}
+
+func (m *stageMetrics) start(stage stages.SyncStage, db ethdb.Getter) (*stageRun, error) {
+	fromBlock, _, err := stages.GetStageProgress(db, stage)
+	if err != nil {
+		return nil, err
+	}
+	size, err := dbSize(db)
+	if err != nil {
+		return nil, err
+	}
+	return &stageRun{stage: stage, start: time.Now(), fromBlock: fromBlock, dbSize: size}, nil
+}
+
+func (m *stageMetrics) finish(logPrefix string, run *stageRun, db ethdb.GetterPutter) error {
+	duration := time.Since(run.start)
+	toBlock, _, err := stages.GetStageProgress(db, run.stage)
+	if err != nil {
+		return err
+	}
+	size, err := dbSize(db)
+	if err != nil {
+		return err
+	}
+	var blocks uint64
+	if toBlock > run.fromBlock {
+		blocks = toBlock - run.fromBlock
+	}
+
+	metrics, err := stages.GetStageMetrics(db, run.stage)
+	if err != nil {
+		return err
+	}
+	if metrics == nil {
+		metrics = &stages.StageMetrics{}
+	}
+	metrics.Add(duration, blocks, int64(size)-int64(run.dbSize), time.Now())
+	if err = stages.SaveStageMetrics(db, run.stage, metrics); err != nil {
+		return fmt.Errorf("[%s] saving stage metrics: %w", logPrefix, err)
+	}
+
+	if time.Since(m.lastLog) > stageMetricsLogEvery {
+		m.lastLog = time.Now()
+		log.Info(fmt.Sprintf("[%s] Stage metrics", logPrefix),
+			"blocks", blocks,
+			"in", duration,
+			"blk/s", fmt.Sprintf("%.1f", metrics.BlocksPerSecond()),
+			"written", common.StorageSize(metrics.LastBytesWritten),
+			"runs", metrics.Runs,
+			"total", metrics.TotalDuration,
+		)
+	}
+	return nil
+}
+
+// dbSize sums sizes of all buckets, seen by the transaction of db if there is one
+func dbSize(db ethdb.Getter) (uint64, error) {
+	sum := func(tx ethdb.Tx) (uint64, error) {
+		var total uint64
+		for _, bucket := range dbutils.Buckets {
+			size, err := tx.BucketSize(bucket)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+		}
+		return total, nil
+	}
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		return sum(hasTx.Tx())
+	}
+	hasKV, ok := db.(ethdb.HasKV)
+	if !ok || hasKV.KV() == nil {
+		return 0, nil
+	}
+	var total uint64
+	if err := hasKV.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		var err error
+		total, err = sum(tx)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
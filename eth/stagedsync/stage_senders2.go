@@ -0,0 +1,153 @@
+package stagedsync
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"runtime"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// senders2BatchSize - amount of blocks whose senders are recovered by the cacher at once
+const senders2BatchSize = 1000
+
+// SpawnSenders2 recovers senders of the canonical blocks transactions and writes them into the Senders2 bucket
+func SpawnSenders2(s *StageState, db ethdb.Database, config *params.ChainConfig, quit <-chan struct{}) error {
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	logPrefix := s.state.LogPrefix()
+	to, _, err := stages.GetStageProgress(tx, stages.Bodies)
+	if err != nil {
+		return fmt.Errorf("%s: getting bodies progress: %w", logPrefix, err)
+	}
+	if to <= s.BlockNumber {
+		s.Done()
+		return nil
+	}
+
+	cacher := core.NewTxSenderCacher(runtime.NumCPU())
+	defer cacher.Close()
+	if err := promoteSenders2(logPrefix, tx, cacher, config, s.BlockNumber+1, to, quit); err != nil {
+		return err
+	}
+
+	if err := s.DoneAndUpdate(tx, to); err != nil {
+		return err
+	}
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteSenders2 - writes senders of the canonical blocks [from, to]. Senders of a batch of blocks are recovered
+// in the background by the cacher, then collected in the blocks order.
+func promoteSenders2(logPrefix string, db ethdb.Database, cacher *core.TxSenderCacher, config *params.ChainConfig, from, to uint64, quit <-chan struct{}) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	tx := db.(ethdb.HasTx).Tx()
+
+	bodies := make([]*types.Body, 0, senders2BatchSize)
+	signers := make([]types.Signer, 0, senders2BatchSize)
+	for batchFrom := from; batchFrom <= to; batchFrom += senders2BatchSize {
+		batchTo := batchFrom + senders2BatchSize - 1
+		if batchTo > to {
+			batchTo = to
+		}
+		bodies, signers = bodies[:0], signers[:0]
+		for blockNum := batchFrom; blockNum <= batchTo; blockNum++ {
+			if err := common.Stopped(quit); err != nil {
+				return err
+			}
+			hash, err := rawdb.ReadCanonicalHash(db, blockNum)
+			if err != nil {
+				return err
+			}
+			body := rawdb.ReadBody(db, hash, blockNum)
+			if body == nil {
+				return fmt.Errorf("%s: body of the block %d not found", logPrefix, blockNum)
+			}
+			signer := types.MakeSigner(config, big.NewInt(int64(blockNum)))
+			cacher.Recover(signer, body.Transactions)
+			bodies = append(bodies, body)
+			signers = append(signers, signer)
+		}
+
+		for i, body := range bodies {
+			blockNum := batchFrom + uint64(i)
+			senders := make([]common.Address, len(body.Transactions))
+			for j, txn := range body.Transactions {
+				sender, err := types.Sender(signers[i], txn)
+				if err != nil {
+					return fmt.Errorf("%s: error recovering sender for tx=%x, %w", logPrefix, txn.Hash(), err)
+				}
+				senders[j] = sender
+			}
+			if err := rawdb.WriteSenders2(tx, blockNum, senders); err != nil {
+				return err
+			}
+		}
+
+		select {
+		default:
+		case <-logEvery.C:
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			log.Info(fmt.Sprintf("[%s] Progress", logPrefix), "number", batchTo, "alloc", common.StorageSize(m.Alloc), "sys", common.StorageSize(m.Sys))
+		}
+	}
+	return nil
+}
+
+func UnwindSenders2(u *UnwindState, s *StageState, db ethdb.Database) error {
+	var tx ethdb.DbWithPendingMutations
+	var useExternalTx bool
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = db.(ethdb.DbWithPendingMutations)
+		useExternalTx = true
+	} else {
+		var err error
+		tx, err = db.Begin(context.Background(), true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	logPrefix := s.state.LogPrefix()
+	if err := rawdb.DeleteSenders2(tx.(ethdb.HasTx).Tx(), u.UnwindPoint+1); err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if err := u.Done(tx); err != nil {
+		return fmt.Errorf("%s: %w", logPrefix, err)
+	}
+	if !useExternalTx {
+		if _, err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
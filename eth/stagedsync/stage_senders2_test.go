@@ -0,0 +1,114 @@
+package stagedsync
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenders2(t *testing.T) {
+	require := require.New(t)
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	config := params.MainnetChainConfig
+	rnd := rand.New(rand.NewSource(42))
+
+	keys := make([]*ecdsa.PrivateKey, 50)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		require.NoError(err)
+		keys[i] = key
+	}
+	// 1000 transactions in 100 blocks around the EIP-155 activation, protected and not, with random payloads
+	const from, blocks, txsPerBlock = 2_674_950, 100, 10
+	expected := map[uint64][]common.Address{}
+	for blockNum := uint64(from); blockNum < from+blocks; blockNum++ {
+		signer := types.MakeSigner(config, new(big.Int).SetUint64(blockNum))
+		var txs []*types.Transaction
+		// some blocks are empty
+		if rnd.Intn(10) != 0 {
+			for i := 0; i < txsPerBlock; i++ {
+				var to common.Address
+				rnd.Read(to[:])
+				data := make([]byte, rnd.Intn(200))
+				rnd.Read(data)
+				txn := types.NewTransaction(rnd.Uint64(), to, uint256.NewInt().SetUint64(rnd.Uint64()), 21000+rnd.Uint64()%1_000_000, uint256.NewInt().SetUint64(rnd.Uint64()%1_000_000_000_000), data)
+				txSigner := signer
+				if rnd.Intn(2) == 0 {
+					txSigner = types.HomesteadSigner{}
+				}
+				key := keys[rnd.Intn(len(keys))]
+				signed, err := types.SignTx(txn, txSigner, key)
+				require.NoError(err)
+				txs = append(txs, signed)
+				expected[blockNum] = append(expected[blockNum], crypto.PubkeyToAddress(key.PublicKey))
+			}
+		}
+		header := &types.Header{Number: new(big.Int).SetUint64(blockNum)}
+		rawdb.WriteHeader(context.Background(), db, header)
+		rawdb.WriteBody(context.Background(), db, header.Hash(), blockNum, &types.Body{Transactions: txs})
+		require.NoError(rawdb.WriteCanonicalHash(db, header.Hash(), blockNum))
+	}
+	require.NoError(stages.SaveStageProgress(db, stages.Bodies, from+blocks-1, nil))
+
+	require.NoError(SpawnSenders2(&StageState{Stage: stages.Senders2, BlockNumber: from - 1}, db, config, nil))
+
+	tx, err := db.Begin(context.Background(), false)
+	require.NoError(err)
+	defer tx.Rollback()
+	for blockNum := uint64(from); blockNum < from+blocks; blockNum++ {
+		senders, err := rawdb.ReadSenders2(tx.(ethdb.HasTx).Tx(), blockNum)
+		require.NoError(err)
+		require.Equal(expected[blockNum], senders, "block %d", blockNum)
+
+		// same as recovered by the signer from the stored transactions
+		hash, err := rawdb.ReadCanonicalHash(tx, blockNum)
+		require.NoError(err)
+		body := rawdb.ReadBody(tx, hash, blockNum)
+		signer := types.MakeSigner(config, new(big.Int).SetUint64(blockNum))
+		for i, txn := range body.Transactions {
+			sender, err := signer.Sender(txn)
+			require.NoError(err)
+			require.Equal(sender, senders[i])
+		}
+
+		preferred, err := rawdb.ReadSendersPreferSenders2(tx, hash, blockNum)
+		require.NoError(err)
+		require.Equal(len(expected[blockNum]), len(preferred))
+		for i := range preferred {
+			require.Equal(expected[blockNum][i], preferred[i])
+		}
+	}
+	tx.Rollback()
+
+	const unwindPoint = from + blocks/2
+	u := &UnwindState{Stage: stages.Senders2, UnwindPoint: unwindPoint}
+	require.NoError(UnwindSenders2(u, &StageState{Stage: stages.Senders2, BlockNumber: from + blocks - 1}, db))
+	tx, err = db.Begin(context.Background(), false)
+	require.NoError(err)
+	defer tx.Rollback()
+	for blockNum := uint64(from); blockNum < from+blocks; blockNum++ {
+		senders, err := rawdb.ReadSenders2(tx.(ethdb.HasTx).Tx(), blockNum)
+		require.NoError(err)
+		if blockNum <= unwindPoint {
+			require.Equal(expected[blockNum], senders, "block %d", blockNum)
+		} else {
+			require.Nil(senders, "block %d", blockNum)
+		}
+	}
+	progress, _, err := stages.GetStageProgress(tx, stages.Senders2)
+	require.NoError(err)
+	require.Equal(uint64(unwindPoint), progress)
+}
@@ -2,9 +2,11 @@ package stagedsync
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -12,12 +14,12 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/rlp"
 )
 
 func SpawnTxLookup(s *StageState, db ethdb.Database, tmpdir string, quitCh <-chan struct{}) error {
 	var blockNum uint64
-	var startKey []byte
 
 	lastProcessedBlockNumber := s.BlockNumber
 	if lastProcessedBlockNumber > 0 {
@@ -29,41 +31,67 @@ func SpawnTxLookup(s *StageState, db ethdb.Database, tmpdir string, quitCh <-cha
 	}
 
 	logPrefix := s.state.LogPrefix()
-	startKey = dbutils.HeaderHashKey(blockNum)
-	if err = TxLookupTransform(logPrefix, db, startKey, dbutils.HeaderHashKey(syncHeadNumber), quitCh, tmpdir); err != nil {
+	if err = TxLookupTransform(logPrefix, db, blockNum, syncHeadNumber, quitCh, tmpdir); err != nil {
 		return err
 	}
 
 	return s.DoneAndUpdate(db, syncHeadNumber)
 }
 
-func TxLookupTransform(logPrefix string, db ethdb.Database, startKey, endKey []byte, quitCh <-chan struct{}, tmpdir string) error {
-	return etl.Transform(logPrefix, db, dbutils.HeaderPrefix, dbutils.TxLookupPrefix, tmpdir, func(k []byte, v []byte, next etl.ExtractNextFunc) error {
-		if !dbutils.CheckCanonicalKey(k) {
-			return nil
+// TxLookupTransform generates tx lookup entries of the canonical blocks [from, to]
+func TxLookupTransform(logPrefix string, db ethdb.Database, from, to uint64, quitCh <-chan struct{}, tmpdir string) error {
+	collector := etl.NewCollector(tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize))
+	if err := collectTxLookup(logPrefix, db, from, to, collector, quitCh); err != nil {
+		return err
+	}
+	return collector.Load(logPrefix, db, dbutils.TxLookupPrefix, etl.IdentityLoadFunc, etl.TransformArgs{Quit: quitCh})
+}
+
+// collectTxLookup - read transaction is closed before collected entries are loaded
+func collectTxLookup(logPrefix string, db ethdb.Database, from, to uint64, collector *etl.Collector, quitCh <-chan struct{}) error {
+	var tx ethdb.Tx
+	if hasTx, ok := db.(ethdb.HasTx); ok && hasTx.Tx() != nil {
+		tx = hasTx.Tx()
+	} else {
+		var err error
+		if tx, err = db.(ethdb.HasKV).KV().Begin(context.Background(), nil, false); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	next := from
+	if err := rawdb.ForEachCanonicalBody(context.Background(), tx, from, to, func(blockNum uint64, _ common.Hash, body *types.Body) error {
+		if err := common.Stopped(quitCh); err != nil {
+			return err
 		}
-		blocknum := binary.BigEndian.Uint64(k)
-		blockHash := common.BytesToHash(v)
-		body := rawdb.ReadBody(db, blockHash, blocknum)
-		if body == nil {
-			return fmt.Errorf("%s: tx lookup generation, empty block body %d, hash %x", logPrefix, blocknum, v)
+		if blockNum != next {
+			return fmt.Errorf("%s: tx lookup generation, empty block body %d", logPrefix, next)
 		}
+		next++
 
-		blockNumBytes := new(big.Int).SetUint64(blocknum).Bytes()
-		for _, tx := range body.Transactions {
-			if err := next(k, tx.Hash().Bytes(), blockNumBytes); err != nil {
+		blockNumBytes := new(big.Int).SetUint64(blockNum).Bytes()
+		for _, txn := range body.Transactions {
+			if err := collector.Collect(txn.Hash().Bytes(), blockNumBytes); err != nil {
 				return err
 			}
 		}
+
+		select {
+		default:
+		case <-logEvery.C:
+			log.Info(fmt.Sprintf("[%s] Progress", logPrefix), "block", blockNum)
+		}
 		return nil
-	}, etl.IdentityLoadFunc, etl.TransformArgs{
-		Quit:            quitCh,
-		ExtractStartKey: startKey,
-		ExtractEndKey:   endKey,
-		LogDetailsExtract: func(k, v []byte) (additionalLogArguments []interface{}) {
-			return []interface{}{"block", binary.BigEndian.Uint64(k)}
-		},
-	})
+	}); err != nil {
+		return err
+	}
+	if next <= to {
+		return fmt.Errorf("%s: tx lookup generation, empty block body %d", logPrefix, next)
+	}
+	return nil
 }
 
 func UnwindTxLookup(u *UnwindState, s *StageState, db ethdb.Database, tmpdir string, quitCh <-chan struct{}) error {
@@ -95,6 +123,10 @@ func UnwindTxLookup(u *UnwindState, s *StageState, db ethdb.Database, tmpdir str
 			return false, fmt.Errorf("%s, rlp decode err: %w", logPrefix, err)
 		}
 		for _, tx := range body.Transactions {
+			// bodies of all forks are walked, don't delete the entries of the same transaction in the blocks below the unwind point
+			if lookup := rawdb.ReadTxLookupEntry(db, tx.Hash()); lookup != nil && *lookup <= u.UnwindPoint {
+				continue
+			}
 			if err := collector.Collect(tx.Hash().Bytes(), nil); err != nil {
 				return false, err
 			}
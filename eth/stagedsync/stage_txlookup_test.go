@@ -0,0 +1,91 @@
+package stagedsync
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxLookupUnwindAndResync(t *testing.T) {
+	require := require.New(t)
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	newTx := func(nonce uint64, fork byte) *types.Transaction {
+		return types.NewTransaction(nonce, common.HexToAddress("0x01"), uint256.NewInt(), 21000, uint256.NewInt(), []byte{fork})
+	}
+	// writeBlock writes the body of the block, makes it canonical if requested
+	writeBlock := func(number uint64, fork byte, canonical bool, txs ...*types.Transaction) {
+		header := &types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte{fork}}
+		rawdb.WriteHeader(context.Background(), db, header)
+		rawdb.WriteBody(context.Background(), db, header.Hash(), number, &types.Body{Transactions: txs})
+		if canonical {
+			require.NoError(rawdb.WriteCanonicalHash(db, header.Hash(), number))
+		}
+	}
+	requireLookups := func(txs map[common.Hash]uint64) {
+		for hash, number := range txs {
+			tx, _, blockNumber, _ := rawdb.ReadTransaction(db, hash)
+			require.NotNil(tx, "tx %x", hash)
+			require.Equal(number, blockNumber)
+		}
+	}
+	requireNoLookups := func(txs map[common.Hash]uint64) {
+		for hash := range txs {
+			require.Nil(rawdb.ReadTxLookupEntry(db, hash), "tx %x", hash)
+		}
+	}
+
+	original := map[common.Hash]uint64{}
+	writeBlock(0, 0, true)
+	for number := uint64(1); number <= 30; number++ {
+		txs := []*types.Transaction{newTx(number*10, 0), newTx(number*10+1, 0)}
+		for _, tx := range txs {
+			original[tx.Hash()] = number
+		}
+		writeBlock(number, 0, true, txs...)
+	}
+	// a stale side block above the unwind point includes a transaction of the canonical block 5
+	writeBlock(25, 2, false, newTx(50, 0))
+
+	require.NoError(stages.SaveStageProgress(db, stages.Execution, 30, nil))
+	require.NoError(SpawnTxLookup(&StageState{Stage: stages.TxLookup}, db, "", nil))
+	requireLookups(original)
+
+	// reorg: blocks above 20 are replaced, canonical hashes already point to the new chain
+	replaced, kept, reorged := map[common.Hash]uint64{}, map[common.Hash]uint64{}, map[common.Hash]uint64{}
+	for hash, number := range original {
+		if number > 20 {
+			replaced[hash] = number
+		} else {
+			kept[hash] = number
+		}
+	}
+	for number := uint64(21); number <= 30; number++ {
+		tx := newTx(number*10, 1)
+		reorged[tx.Hash()] = number
+		writeBlock(number, 1, true, tx)
+	}
+
+	u := &UnwindState{Stage: stages.TxLookup, UnwindPoint: 20}
+	require.NoError(UnwindTxLookup(u, &StageState{Stage: stages.TxLookup, BlockNumber: 30}, db, "", nil))
+	requireLookups(kept)
+	requireNoLookups(replaced)
+	requireNoLookups(reorged)
+	progress, _, err := stages.GetStageProgress(db, stages.TxLookup)
+	require.NoError(err)
+	require.Equal(uint64(20), progress)
+
+	require.NoError(SpawnTxLookup(&StageState{Stage: stages.TxLookup, BlockNumber: 20}, db, "", nil))
+	requireLookups(kept)
+	requireLookups(reorged)
+	requireNoLookups(replaced)
+}
@@ -312,6 +312,41 @@ func DefaultStages() StageBuilders {
 				}
 			},
 		},
+		{
+			ID: stages.Senders2,
+			Build: func(world StageParameters) *Stage {
+				return &Stage{
+					ID:                  stages.Senders2,
+					Description:         "Write tx senders in the Senders2 layout",
+					Disabled:            !world.storageMode.Senders2,
+					DisabledDescription: "Enable by adding `s` to --storage-mode",
+					ExecFunc: func(s *StageState, u Unwinder) error {
+						return SpawnSenders2(s, world.TX, world.chainConfig, world.QuitCh)
+					},
+					UnwindFunc: func(u *UnwindState, s *StageState) error {
+						return UnwindSenders2(u, s, world.TX)
+					},
+				}
+			},
+		},
+		{
+			ID: stages.BlockBloom,
+			Build: func(world StageParameters) *Stage {
+				return &Stage{
+					ID:          stages.BlockBloom,
+					Description: "Write blooms of the block logs",
+					// logs index makes blooms redundant
+					Disabled:            !world.storageMode.Blooms || world.storageMode.Receipts,
+					DisabledDescription: "Enable by adding `b` and removing `r` from --storage-mode",
+					ExecFunc: func(s *StageState, u Unwinder) error {
+						return SpawnBlockBloom(s, world.TX, world.QuitCh)
+					},
+					UnwindFunc: func(u *UnwindState, s *StageState) error {
+						return UnwindBlockBloom(u, s, world.TX)
+					},
+				}
+			},
+		},
 		{
 			ID: stages.Finish,
 			Build: func(world StageParameters) *Stage {
@@ -358,6 +393,6 @@ func DefaultUnwindOrder() UnwindOrder {
 		3, 4,
 		// Unwinding of IHashes needs to happen after unwinding HashState
 		6, 5,
-		7, 8, 9, 10, 11,
+		7, 8, 9, 10, 11, 13, 14,
 	}
 }
@@ -1,9 +1,13 @@
 package stagedsync
 
 import (
+	"fmt"
+
 	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/params"
 )
@@ -27,6 +31,9 @@ type OptionalParameters struct {
 	// StateReaderBuilder is a function that returns state writer for the block execution stage.
 	// It can be used to update bloom or other types of filters between block execution.
 	StateWriterBuilder StateWriterBuilder
+
+	// Notifier receives the new chain heads, like the RPC daemon subscribed over the private API.
+	Notifier ChainEventNotifier
 }
 
 func New(stages StageBuilders, unwindOrder UnwindOrder, params OptionalParameters) *StagedSync {
@@ -38,6 +45,28 @@ func New(stages StageBuilders, unwindOrder UnwindOrder, params OptionalParameter
 	}
 }
 
+// NotifyNewHead sends the header of the block the Finish stage has reached to the notifier, if there is one.
+// It must be called after the sync cycle is committed, for the subscribers to see the new head in the database
+func (stagedSync *StagedSync) NotifyNewHead(db ethdb.Getter) error {
+	if stagedSync.params.Notifier == nil {
+		return nil
+	}
+	head, _, err := stages.GetStageProgress(db, stages.Finish)
+	if err != nil {
+		return err
+	}
+	hash, err := rawdb.ReadCanonicalHash(db, head)
+	if err != nil {
+		return err
+	}
+	header := rawdb.ReadHeader(db, hash, head)
+	if header == nil {
+		return fmt.Errorf("no header of the head block %d", head)
+	}
+	stagedSync.params.Notifier.OnNewHeader(header)
+	return nil
+}
+
 func (stagedSync *StagedSync) Prepare(
 	d DownloaderGlue,
 	chainConfig *params.ChainConfig,
@@ -0,0 +1,85 @@
+package stages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const stageMetricsLen = 8 * 8
+
+// StageMetrics is the timing and throughput of a sync stage: of its last run and accumulated over all runs
+type StageMetrics struct {
+	Runs              uint64        `json:"runs"`
+	LastDuration      time.Duration `json:"lastDuration"`
+	LastBlocks        uint64        `json:"lastBlocks"`
+	LastBytesWritten  int64         `json:"lastBytesWritten"`
+	TotalDuration     time.Duration `json:"totalDuration"`
+	TotalBlocks       uint64        `json:"totalBlocks"`
+	TotalBytesWritten int64         `json:"totalBytesWritten"`
+	UpdatedAt         int64         `json:"updatedAt"` // unix seconds
+}
+
+// Add accounts one run of the stage
+func (m *StageMetrics) Add(duration time.Duration, blocks uint64, bytesWritten int64, now time.Time) {
+	m.Runs++
+	m.LastDuration, m.LastBlocks, m.LastBytesWritten = duration, blocks, bytesWritten
+	m.TotalDuration += duration
+	m.TotalBlocks += blocks
+	m.TotalBytesWritten += bytesWritten
+	m.UpdatedAt = now.Unix()
+}
+
+// BlocksPerSecond of the last run
+func (m *StageMetrics) BlocksPerSecond() float64 {
+	if m.LastDuration <= 0 {
+		return 0
+	}
+	return float64(m.LastBlocks) / m.LastDuration.Seconds()
+}
+
+// GetStageMetrics retrieves saved metrics of given sync stage from the database, nil if the stage never ran
+func GetStageMetrics(db rawdb.DatabaseReader, stage SyncStage) (*StageMetrics, error) {
+	v, err := db.Get(dbutils.SyncStageMetrics, stage)
+	if err != nil {
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	if len(v) != stageMetricsLen {
+		return nil, fmt.Errorf("stage metrics must be %d bytes, got %d", stageMetricsLen, len(v))
+	}
+	return &StageMetrics{
+		Runs:              binary.BigEndian.Uint64(v),
+		LastDuration:      time.Duration(binary.BigEndian.Uint64(v[8:])),
+		LastBlocks:        binary.BigEndian.Uint64(v[16:]),
+		LastBytesWritten:  int64(binary.BigEndian.Uint64(v[24:])),
+		TotalDuration:     time.Duration(binary.BigEndian.Uint64(v[32:])),
+		TotalBlocks:       binary.BigEndian.Uint64(v[40:]),
+		TotalBytesWritten: int64(binary.BigEndian.Uint64(v[48:])),
+		UpdatedAt:         int64(binary.BigEndian.Uint64(v[56:])),
+	}, nil
+}
+
+// SaveStageMetrics saves the metrics of the given stage in the database
+func SaveStageMetrics(db ethdb.Putter, stage SyncStage, m *StageMetrics) error {
+	v := make([]byte, stageMetricsLen)
+	binary.BigEndian.PutUint64(v, m.Runs)
+	binary.BigEndian.PutUint64(v[8:], uint64(m.LastDuration))
+	binary.BigEndian.PutUint64(v[16:], m.LastBlocks)
+	binary.BigEndian.PutUint64(v[24:], uint64(m.LastBytesWritten))
+	binary.BigEndian.PutUint64(v[32:], uint64(m.TotalDuration))
+	binary.BigEndian.PutUint64(v[40:], m.TotalBlocks)
+	binary.BigEndian.PutUint64(v[48:], uint64(m.TotalBytesWritten))
+	binary.BigEndian.PutUint64(v[56:], uint64(m.UpdatedAt))
+	return db.Put(dbutils.SyncStageMetrics, stage, v)
+}
@@ -46,6 +46,8 @@ var (
 	CallTraces          SyncStage = []byte("CallTraces")          // Generating call traces index
 	TxLookup            SyncStage = []byte("TxLookup")            // Generating transactions lookup index
 	TxPool              SyncStage = []byte("TxPool")              // Starts Backend
+	Senders2            SyncStage = []byte("Senders2")            // Writing recovered senders in the Senders2 layout
+	BlockBloom          SyncStage = []byte("BlockBloom")          // Writing blooms of the block logs, when there is no logs index
 	Finish              SyncStage = []byte("Finish")              // Nominal stage after all other stages
 )
 
@@ -63,6 +65,8 @@ var AllStages = []SyncStage{
 	CallTraces,
 	TxLookup,
 	TxPool,
+	Senders2,
+	BlockBloom,
 	Finish,
 }
 
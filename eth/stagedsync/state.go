@@ -21,6 +21,9 @@ type State struct {
 	beforeStageRun    map[string]func() error
 	onBeforeUnwind    func(stages.SyncStage) error
 	beforeStageUnwind map[string]func() error
+	onCheckpoint      func(stages.SyncStage, uint64) error
+
+	metrics stageMetrics
 }
 
 func (s *State) Len() int {
@@ -210,7 +213,7 @@ func (s *State) Run(db ethdb.GetterPutter, tx ethdb.GetterPutter) error {
 	return nil
 }
 
-func (s *State) runStage(stage *Stage, db ethdb.Getter, tx ethdb.Getter) error {
+func (s *State) runStage(stage *Stage, db ethdb.GetterPutter, tx ethdb.GetterPutter) error {
 	if hasTx, ok := tx.(ethdb.HasTx); ok && hasTx.Tx() != nil {
 		db = tx
 	}
@@ -221,10 +224,17 @@ func (s *State) runStage(stage *Stage, db ethdb.Getter, tx ethdb.Getter) error {
 
 	start := time.Now()
 	logPrefix := s.LogPrefix()
+	run, err := s.metrics.start(stage.ID, db)
+	if err != nil {
+		return err
+	}
 	err = stage.ExecFunc(stageState, s)
 	if err != nil {
 		return err
 	}
+	if err = s.metrics.finish(logPrefix, run, db); err != nil {
+		return err
+	}
 
 	if time.Since(start) > 30*time.Second {
 		log.Info(fmt.Sprintf("[%s] DONE", logPrefix), "in", time.Since(start))
@@ -299,3 +309,8 @@ func (s *State) BeforeStageUnwind(id stages.SyncStage, f func() error) {
 func (s *State) OnBeforeUnwind(f func(id stages.SyncStage) error) {
 	s.onBeforeUnwind = f
 }
+
+// OnCheckpoint - f is called after every intermediate checkpoint of a stage, returned error interrupts the stage
+func (s *State) OnCheckpoint(f func(id stages.SyncStage, blockNum uint64) error) {
+	s.onCheckpoint = f
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStateStagesSuccess(t *testing.T) {
@@ -766,3 +768,40 @@ func TestStateSyncInterruptLongStage(t *testing.T) {
 func unwindOf(s stages.SyncStage) stages.SyncStage {
 	return append(s, 0xF0)
 }
+
+func TestStateStageMetrics(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	require.NoError(t, stages.SaveStageProgress(db, stages.Execution, 10, nil))
+	s := []*Stage{
+		{
+			ID:          stages.Execution,
+			Description: "Executing blocks",
+			ExecFunc: func(s *StageState, u Unwinder) error {
+				for i := uint64(0); i < 100; i++ {
+					if err := db.Put(dbutils.PlainStateBucket, dbutils.EncodeBlockNumber(i), make([]byte, 1024)); err != nil {
+						return err
+					}
+				}
+				return s.DoneAndUpdate(db, 25)
+			},
+		},
+	}
+	state := NewState(s)
+	require.NoError(t, state.Run(db, db))
+
+	metrics, err := stages.GetStageMetrics(db, stages.Execution)
+	require.NoError(t, err)
+	require.NotNil(t, metrics)
+	require.Equal(t, uint64(1), metrics.Runs)
+	require.Equal(t, uint64(15), metrics.LastBlocks)
+	require.Equal(t, uint64(15), metrics.TotalBlocks)
+	require.True(t, metrics.LastDuration > 0)
+	require.True(t, metrics.LastBytesWritten > 0, "written %d", metrics.LastBytesWritten)
+	require.NotZero(t, metrics.UpdatedAt)
+
+	// stages which did not run have no metrics
+	metrics, err = stages.GetStageMetrics(db, stages.Senders)
+	require.NoError(t, err)
+	require.Nil(t, metrics)
+}
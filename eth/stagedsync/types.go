@@ -1,5 +1,12 @@
 package stagedsync
 
+import "github.com/ledgerwatch/turbo-geth/core/types"
+
+// ChainEventNotifier - receives the header of the new chain head after every committed sync cycle
+type ChainEventNotifier interface {
+	OnNewHeader(*types.Header)
+}
+
 type DownloaderGlue interface {
 	SpawnHeaderDownloadStage([]func() error, *StageState, Unwinder) error
 	SpawnBodyDownloadStage(string, string, *StageState, Unwinder, *PrefetchedBlocks) (bool, error)
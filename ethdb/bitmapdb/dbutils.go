@@ -3,12 +3,16 @@ package bitmapdb
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"sort"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
 )
 
 const ChunkLimit = uint64(1900 * datasize.B) // threshold after which appear LMDB OverflowPages
@@ -72,6 +76,9 @@ func TruncateRange(tx ethdb.Tx, bucket string, key []byte, from, to uint64) erro
 		if !bytes.HasPrefix(k, key) {
 			break
 		}
+		if len(k) != len(key)+4 { // chunk of another key which has `key` as prefix
+			continue
+		}
 
 		bm := roaring.New()
 		_, err := bm.FromBuffer(v)
@@ -108,36 +115,35 @@ func TruncateRange(tx ethdb.Tx, bucket string, key []byte, from, to uint64) erro
 		}
 	}
 
-	// rename last chunk if it has no finality marker
-	binary.BigEndian.PutUint32(chunkKey[len(chunkKey)-4:], ^uint32(0))
-	k, v, err := c.Seek(chunkKey)
-	if err != nil {
+	// rename last remaining chunk of the key if it has no finality marker.
+	// re-seek by the key itself: chunks of the key could be all deleted, and cursor must not pick up chunk of other key
+	lastChunkKey := ShardKey(key, ^uint32(0))
+	if k, _, err := c.Seek(lastChunkKey); err != nil {
 		return err
+	} else if bytes.Equal(k, lastChunkKey) {
+		return nil
 	}
-	if k == nil || !bytes.HasPrefix(k, key) {
-		k, v, err = c.Prev()
+	var lastK, lastV []byte
+	for k, v, err := c.Seek(key); k != nil; k, v, err = c.Next() {
 		if err != nil {
 			return err
 		}
-
-		// case when all chunks were delted
-		if k == nil || !bytes.HasPrefix(k, key) {
-			return nil
+		if !bytes.HasPrefix(k, key) {
+			break
+		}
+		if len(k) == len(key)+4 {
+			lastK, lastV = k, v
 		}
 	}
-
-	copyV := common.CopyBytes(v)
-	err = cForDelete.Delete(k)
-	if err != nil {
-		return err
+	if lastK == nil { // all chunks were deleted
+		return nil
 	}
 
-	err = c.Put(chunkKey, copyV)
-	if err != nil {
+	lastK, lastV = common.CopyBytes(lastK), common.CopyBytes(lastV)
+	if err := cForDelete.Delete(lastK); err != nil {
 		return err
 	}
-
-	return nil
+	return c.Put(lastChunkKey, lastV)
 }
 
 // Get - reading as much chunks as needed to satisfy [from, to] condition
@@ -174,3 +180,274 @@ func Get(c ethdb.Cursor, key []byte, from, to uint32) (*roaring.Bitmap, error) {
 	}
 	return roaring.FastOr(chunks...), nil
 }
+
+// ShardKey - key of the shard: key + 4 bytes big-endian shard number
+// shard number is the max value stored in the shard, ^uint32(0) for the last shard
+func ShardKey(key []byte, n uint32) []byte {
+	shardKey := make([]byte, len(key)+4)
+	copy(shardKey, key)
+	binary.BigEndian.PutUint32(shardKey[len(key):], n)
+	return shardKey
+}
+
+// AppendMergeByOr - merges delta into the last shard of the bitmap stored under key,
+// and splits result into shards of ChunkLimit size. Only the last shard is rewritten,
+// it keeps ^uint32(0) number, the full ones get number of their max value.
+func AppendMergeByOr(db ethdb.GetterPutter, bucket string, key []byte, delta *roaring.Bitmap) error {
+	lastShardKey := ShardKey(key, ^uint32(0))
+	v, err := db.Get(bucket, lastShardKey)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return err
+	}
+
+	bm := roaring.New()
+	if len(v) > 0 {
+		if _, err = bm.FromBuffer(common.CopyBytes(v)); err != nil {
+			return err
+		}
+	}
+	bm.Or(delta)
+
+	buf := bytes.NewBuffer(nil)
+	nextChunk := ChunkIterator(bm, ChunkLimit)
+	for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+		chunk.RunOptimize()
+		buf.Reset()
+		if _, err = chunk.WriteTo(buf); err != nil {
+			return err
+		}
+		shardKey := lastShardKey
+		if bm.GetCardinality() > 0 {
+			shardKey = ShardKey(key, chunk.Maximum())
+		}
+		if err = db.Put(bucket, shardKey, common.CopyBytes(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact - rewrites shards of the bitmap stored under key to the minimal amount of shards of ChunkLimit size.
+// Bitmaps written by many small appends end up in many tiny shards, which makes Get slower and db bigger.
+// Last shard keeps ^uint32(0) number. Does nothing if shards can't be reduced.
+func Compact(c ethdb.Cursor, key []byte) error {
+	var shardKeys [][]byte
+	var shards []*roaring.Bitmap
+	for k, v, err := c.Seek(key); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, key) {
+			break
+		}
+		if len(k) != len(key)+4 { // shard of another key which has `key` as prefix
+			continue
+		}
+		bm := roaring.New()
+		if _, err := bm.FromBuffer(common.CopyBytes(v)); err != nil {
+			return err
+		}
+		shardKeys = append(shardKeys, common.CopyBytes(k))
+		shards = append(shards, bm)
+	}
+	if len(shards) < 2 {
+		return nil
+	}
+
+	bm := roaring.FastOr(shards...)
+	var chunks []*roaring.Bitmap
+	nextChunk := ChunkIterator(bm, ChunkLimit)
+	for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) >= len(shards) {
+		return nil
+	}
+
+	for _, k := range shardKeys {
+		if err := c.Delete(k); err != nil {
+			return err
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	for i, chunk := range chunks {
+		chunk.RunOptimize()
+		buf.Reset()
+		if _, err := chunk.WriteTo(buf); err != nil {
+			return err
+		}
+		shardKey := ShardKey(key, ^uint32(0))
+		if i < len(chunks)-1 {
+			shardKey = ShardKey(key, chunk.Maximum())
+		}
+		if err := c.Put(shardKey, common.CopyBytes(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactBucket - Compact for all keys of the bucket
+func CompactBucket(tx ethdb.Tx, bucket string, quit <-chan struct{}) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	cForCompact := tx.Cursor(bucket)
+	defer cForCompact.Close()
+
+	var keys int
+	k, _, err := c.First()
+	for k != nil {
+		if err != nil {
+			return err
+		}
+		if err = common.Stopped(quit); err != nil {
+			return err
+		}
+		if len(k) < 4 {
+			return fmt.Errorf("bucket %s: unexpected key %x", bucket, k)
+		}
+		key := common.CopyBytes(k[:len(k)-4])
+		if err = Compact(cForCompact, key); err != nil {
+			return err
+		}
+		keys++
+
+		select {
+		default:
+		case <-logEvery.C:
+			log.Info("Compacting bitmaps", "bucket", bucket, "keys", keys, "current", fmt.Sprintf("%x", key))
+		}
+
+		// continue after the last shard of the key
+		lastShardKey := ShardKey(key, ^uint32(0))
+		if k, _, err = c.Seek(lastShardKey); err == nil && bytes.Equal(k, lastShardKey) {
+			k, _, err = c.Next()
+		}
+	}
+	return err
+}
+
+// TruncateGreater - removes all values greater than n from the bitmap stored under key.
+// Shard which keeps n (if any) becomes the last shard. Unlike TruncateRange works over
+// ethdb.Database, so can be used with batches.
+func TruncateGreater(db ethdb.Database, bucket string, key []byte, n uint64) error {
+	type shard struct {
+		k  []byte
+		bm *roaring.Bitmap
+	}
+	var kept *shard // last shard which keeps values <= n
+	var toDelete [][]byte
+	if err := db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+		if len(k) != len(key)+4 {
+			return true, nil
+		}
+		if uint64(binary.BigEndian.Uint32(k[len(key):])) <= n {
+			kept = &shard{k: common.CopyBytes(k)}
+			return true, nil
+		}
+		bm := roaring.New()
+		if _, err := bm.FromBuffer(common.CopyBytes(v)); err != nil {
+			return false, err
+		}
+		toDelete = append(toDelete, common.CopyBytes(k))
+		bm.RemoveRange(n+1, uint64(^uint32(0))+1)
+		if bm.GetCardinality() > 0 {
+			kept = &shard{k: common.CopyBytes(k), bm: bm}
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range toDelete {
+		if err := db.Delete(bucket, k); err != nil {
+			return err
+		}
+	}
+	if kept == nil {
+		return nil
+	}
+	lastShardKey := ShardKey(key, ^uint32(0))
+	if kept.bm == nil { // full shard becomes the last one
+		v, err := db.Get(bucket, kept.k)
+		if err != nil {
+			return err
+		}
+		if err = db.Delete(bucket, kept.k); err != nil {
+			return err
+		}
+		return db.Put(bucket, lastShardKey, common.CopyBytes(v))
+	}
+	kept.bm.RunOptimize()
+	buf := bytes.NewBuffer(make([]byte, 0, kept.bm.GetSerializedSizeInBytes()))
+	if _, err := kept.bm.WriteTo(buf); err != nil {
+		return err
+	}
+	return db.Put(bucket, lastShardKey, buf.Bytes())
+}
+
+// TruncateLess - removes all values less than n from the bitmap stored under key.
+// Shards which keep only such values are deleted, the first remaining shard is rewritten.
+func TruncateLess(db ethdb.Database, bucket string, key []byte, n uint64) error {
+	var toDelete [][]byte
+	var firstKey []byte
+	var first *roaring.Bitmap
+	if err := db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+		if len(k) != len(key)+4 {
+			return true, nil
+		}
+		if uint64(binary.BigEndian.Uint32(k[len(key):])) < n {
+			toDelete = append(toDelete, common.CopyBytes(k))
+			return true, nil
+		}
+		first = roaring.New()
+		if _, err := first.FromBuffer(common.CopyBytes(v)); err != nil {
+			return false, err
+		}
+		first.RemoveRange(0, n)
+		firstKey = common.CopyBytes(k)
+		return false, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range toDelete {
+		if err := db.Delete(bucket, k); err != nil {
+			return err
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	if first.IsEmpty() { // only the last shard can become empty
+		return db.Delete(bucket, firstKey)
+	}
+	first.RunOptimize()
+	buf := bytes.NewBuffer(make([]byte, 0, first.GetSerializedSizeInBytes()))
+	if _, err := first.WriteTo(buf); err != nil {
+		return err
+	}
+	return db.Put(bucket, firstKey, buf.Bytes())
+}
+
+// SeekInBitmap - returns the smallest value in the bitmap which is greater or equal to n
+func SeekInBitmap(bm *roaring.Bitmap, n uint64) (uint64, bool) {
+	if n > uint64(^uint32(0)) || bm.IsEmpty() {
+		return 0, false
+	}
+	var rank uint64
+	if n > 0 {
+		rank = bm.Rank(uint32(n - 1)) // number of values < n
+	}
+	if rank >= bm.GetCardinality() {
+		return 0, false
+	}
+	v, err := bm.Select(uint32(rank))
+	if err != nil {
+		return 0, false
+	}
+	return uint64(v), true
+}
@@ -0,0 +1,255 @@
+package bitmapdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// 64-bit versions of the sharded bitmap helpers. Shards are keyed by key + 8 bytes big-endian shard number,
+// the number is the max value stored in the shard, ^uint64(0) for the last shard.
+
+func ChunkIterator64(bm *roaring64.Bitmap, target uint64) func() *roaring64.Bitmap {
+	return func() *roaring64.Bitmap {
+		return CutLeft64(bm, target)
+	}
+}
+
+// CutLeft64 - cut from bitmap `targetSize` bytes from left
+// removing lft part from `bm`
+// returns nil on zero cardinality
+func CutLeft64(bm *roaring64.Bitmap, targetSize uint64) *roaring64.Bitmap {
+	if bm.GetCardinality() == 0 {
+		return nil
+	}
+
+	if serializedSize64(bm) <= targetSize {
+		lft := bm.Clone()
+		bm.Clear()
+		return lft
+	}
+
+	// roaring64 has no cheap AddRange over sparse high bits, so search by amount of the leftmost values
+	// instead of by the values range: lft keeps values with rank < n
+	cut := func(n uint64) *roaring64.Bitmap {
+		lft := bm.Clone()
+		if n < bm.GetCardinality() {
+			v, _ := bm.Select(n)
+			removeFrom64(lft, v)
+		}
+		return lft
+	}
+	lo, hi := uint64(1), bm.GetCardinality() // lft of lo values always taken, even if it's bigger than targetSize
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if serializedSize64(cut(mid)) > targetSize {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+
+	lft := cut(lo)
+	removeTo64(bm, lft.Maximum())
+	return lft
+}
+
+// removeFrom64 - removes all values >= n
+func removeFrom64(bm *roaring64.Bitmap, n uint64) {
+	bm.RemoveRange(n, ^uint64(0))
+	bm.Remove(^uint64(0))
+}
+
+// removeTo64 - removes all values <= n
+func removeTo64(bm *roaring64.Bitmap, n uint64) {
+	if n == ^uint64(0) {
+		bm.Clear()
+		return
+	}
+	bm.RemoveRange(0, n+1)
+}
+
+// serializedSize64 - roaring64 doesn't provide GetSerializedSizeInBytes, so just count bytes of WriteTo
+func serializedSize64(bm *roaring64.Bitmap) uint64 {
+	var w countingWriter
+	_, _ = bm.WriteTo(&w)
+	return uint64(w)
+}
+
+type countingWriter uint64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func marshal64(bm *roaring64.Bitmap) ([]byte, error) {
+	bm.RunOptimize()
+	buf := bytes.NewBuffer(make([]byte, 0, serializedSize64(bm)))
+	if _, err := bm.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshal64(v []byte) (*roaring64.Bitmap, error) {
+	bm := roaring64.New()
+	if err := bm.UnmarshalBinary(v); err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+// ShardKey64 - key of the shard: key + 8 bytes big-endian shard number
+func ShardKey64(key []byte, n uint64) []byte {
+	shardKey := make([]byte, len(key)+8)
+	copy(shardKey, key)
+	binary.BigEndian.PutUint64(shardKey[len(key):], n)
+	return shardKey
+}
+
+// AppendMergeByOr64 - 64-bit version of AppendMergeByOr
+func AppendMergeByOr64(db ethdb.GetterPutter, bucket string, key []byte, delta *roaring64.Bitmap) error {
+	lastShardKey := ShardKey64(key, ^uint64(0))
+	v, err := db.Get(bucket, lastShardKey)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return err
+	}
+
+	bm := roaring64.New()
+	if len(v) > 0 {
+		if bm, err = unmarshal64(v); err != nil {
+			return err
+		}
+	}
+	bm.Or(delta)
+
+	nextChunk := ChunkIterator64(bm, ChunkLimit)
+	for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+		buf, err := marshal64(chunk)
+		if err != nil {
+			return err
+		}
+		shardKey := lastShardKey
+		if bm.GetCardinality() > 0 {
+			shardKey = ShardKey64(key, chunk.Maximum())
+		}
+		if err = db.Put(bucket, shardKey, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get64 - reading as much chunks as needed to satisfy [from, to] condition
+// join all chunks to 1 bitmap by Or operator
+func Get64(c ethdb.Cursor, key []byte, from, to uint64) (*roaring64.Bitmap, error) {
+	var chunks []*roaring64.Bitmap
+
+	for k, v, err := c.Seek(ShardKey64(key, from)); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(k, key) {
+			break
+		}
+		if len(k) != len(key)+8 { // shard of another key which has `key` as prefix
+			continue
+		}
+
+		bm, err := unmarshal64(v)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, bm)
+
+		if binary.BigEndian.Uint64(k[len(key):]) >= to {
+			break
+		}
+	}
+
+	if len(chunks) == 0 {
+		return roaring64.New(), nil
+	}
+	return roaring64.FastOr(chunks...), nil
+}
+
+// TruncateRange64 - 64-bit version of TruncateRange
+// !Important: [from, to)
+func TruncateRange64(tx ethdb.Tx, bucket string, key []byte, from, to uint64) error {
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	cForDelete := tx.Cursor(bucket)
+	defer cForDelete.Close()
+
+	for k, v, err := c.Seek(ShardKey64(key, from)); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		if !bytes.HasPrefix(k, key) {
+			break
+		}
+		if len(k) != len(key)+8 {
+			continue
+		}
+
+		bm, err := unmarshal64(v)
+		if err != nil {
+			return err
+		}
+		noReasonToCheckNextChunk := (bm.Minimum() <= from && bm.Maximum() >= to) || binary.BigEndian.Uint64(k[len(key):]) == ^uint64(0)
+
+		bm.RemoveRange(from, to)
+		if bm.IsEmpty() { // don't store empty bitmaps
+			if err = cForDelete.Delete(k); err != nil {
+				return err
+			}
+			if noReasonToCheckNextChunk {
+				break
+			}
+			continue
+		}
+
+		newV, err := marshal64(bm)
+		if err != nil {
+			return err
+		}
+		if err = c.Put(common.CopyBytes(k), newV); err != nil {
+			return err
+		}
+
+		if noReasonToCheckNextChunk {
+			break
+		}
+	}
+
+	// rename last remaining shard of the key if it has no finality marker
+	lastShardKey := ShardKey64(key, ^uint64(0))
+	var lastK, lastV []byte
+	for k, v, err := c.Seek(key); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, key) {
+			break
+		}
+		if len(k) == len(key)+8 {
+			lastK, lastV = k, v
+		}
+	}
+	if lastK == nil || bytes.Equal(lastK, lastShardKey) { // all shards were deleted, or the last one is in place
+		return nil
+	}
+
+	lastK, lastV = common.CopyBytes(lastK), common.CopyBytes(lastV)
+	if err := cForDelete.Delete(lastK); err != nil {
+		return err
+	}
+	return c.Put(lastShardKey, lastV)
+}
@@ -0,0 +1,158 @@
+package bitmapdb_test
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func read64(t *testing.T, db ethdb.Database, bucket string, key []byte) (*roaring64.Bitmap, []uint64) {
+	var shards []*roaring64.Bitmap
+	var numbers []uint64
+	require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+		if len(k) != len(key)+8 { // shard of another key which has `key` as prefix
+			return true, nil
+		}
+		bm := roaring64.New()
+		require.NoError(t, bm.UnmarshalBinary(v))
+		require.False(t, bm.IsEmpty())
+		require.True(t, uint64(len(v)) < bitmapdb.ChunkLimit+256)
+		n := binary.BigEndian.Uint64(k[len(key):])
+		// truncation keeps the shard key, so it's not less than the shard maximum
+		require.GreaterOrEqual(t, n, bm.Maximum())
+		shards = append(shards, bm)
+		numbers = append(numbers, n)
+		return true, nil
+	}))
+	return roaring64.FastOr(shards...), numbers
+}
+
+func get64(t *testing.T, db *ethdb.ObjectDatabase, bucket string, key []byte, from, to uint64) *roaring64.Bitmap {
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	bm, err := bitmapdb.Get64(c, key, from, to)
+	require.NoError(t, err)
+	return bm
+}
+
+func truncateRange64(t *testing.T, db *ethdb.ObjectDatabase, bucket string, key []byte, from, to uint64) {
+	tx, err := db.KV().Begin(context.Background(), nil, true)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	require.NoError(t, bitmapdb.TruncateRange64(tx, bucket, key, from, to))
+	require.NoError(t, tx.Commit(context.Background()))
+}
+
+func TestAppendMergeByOr64AndTruncateRange64(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket, key := dbutils.LogTopicIndex, []byte{1}
+
+	// logIdx<<32|blockNum composite values, sparse ones don't compress, so bitmap gets split to many shards
+	expected := roaring64.New()
+	for blockNum := uint64(0); blockNum < 10_000; blockNum += 100 {
+		delta := roaring64.New()
+		for i := blockNum; i < blockNum+100; i += 3 {
+			for logIdx := uint64(0); logIdx < 3; logIdx++ {
+				delta.Add(logIdx<<32 | i)
+			}
+		}
+		expected.Or(delta)
+		require.NoError(t, bitmapdb.AppendMergeByOr64(db, bucket, key, delta))
+	}
+	// neighbour key is untouched by all the operations
+	neighbour := []byte{1, 2}
+	require.NoError(t, bitmapdb.AppendMergeByOr64(db, bucket, neighbour, roaring64.BitmapOf(1, 2, 3)))
+
+	bm, shards := read64(t, db, bucket, key)
+	require.Greater(t, len(shards), 1)
+	require.Equal(t, ^uint64(0), shards[len(shards)-1])
+	require.True(t, expected.Equals(bm))
+	require.True(t, expected.Equals(get64(t, db, bucket, key, 0, ^uint64(0))))
+
+	// Get64 reads only the shards covering [from, to]
+	part := get64(t, db, bucket, key, 1<<32, 1<<32+10)
+	require.True(t, part.Contains(1<<32))
+	require.False(t, part.Contains(0))
+	require.False(t, part.Contains(2<<32))
+
+	truncateRange64(t, db, bucket, key, 1<<32+5_000, 2<<32)
+	expected.RemoveRange(1<<32+5_000, 2<<32)
+	bm, _ = read64(t, db, bucket, key)
+	require.True(t, expected.Equals(bm))
+
+	truncateRange64(t, db, bucket, key, 2<<32, ^uint64(0))
+	expected.RemoveRange(2<<32, ^uint64(0))
+	bm, shards = read64(t, db, bucket, key)
+	require.True(t, expected.Equals(bm))
+	require.Equal(t, ^uint64(0), shards[len(shards)-1])
+
+	truncateRange64(t, db, bucket, key, 0, ^uint64(0))
+	bm, shards = read64(t, db, bucket, key)
+	require.True(t, bm.IsEmpty())
+	require.Empty(t, shards)
+
+	bm, shards = read64(t, db, bucket, neighbour)
+	require.Equal(t, []uint64{1, 2, 3}, bm.ToArray())
+	require.Equal(t, []uint64{^uint64(0)}, shards)
+}
+
+// TestBitmap64Fuzz - random appends and truncations compared against an in-memory reference bitmap
+func TestBitmap64Fuzz(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket, key := dbutils.LogTopicIndex, []byte{1}
+	rnd := rand.New(rand.NewSource(42))
+
+	expected := roaring64.New()
+	var max uint64
+	for i := 0; i < 200; i++ {
+		switch rnd.Intn(3) {
+		case 0, 1:
+			// appends are ordered: only values greater than existing ones are added
+			delta := roaring64.New()
+			for j, n := 0, rnd.Intn(1_000); j < n; j++ {
+				max += 1 + uint64(rnd.Intn(1<<10))
+				if rnd.Intn(2) == 0 {
+					max += uint64(rnd.Intn(4)) << 32
+				}
+				delta.Add(max)
+			}
+			expected.Or(delta)
+			require.NoError(t, bitmapdb.AppendMergeByOr64(db, bucket, key, delta))
+		case 2:
+			from := uint64(rnd.Int63n(int64(max + 1)))
+			to := from + uint64(rnd.Int63n(int64(max-from+2)))
+			expected.RemoveRange(from, to)
+			truncateRange64(t, db, bucket, key, from, to)
+			if !expected.IsEmpty() {
+				max = expected.Maximum()
+			}
+		}
+
+		bm, shards := read64(t, db, bucket, key)
+		require.True(t, expected.Equals(bm), "step %d", i)
+		if len(shards) > 0 {
+			require.Equal(t, ^uint64(0), shards[len(shards)-1], "step %d", i)
+		}
+
+		from := uint64(rnd.Int63n(int64(max + 1)))
+		to := from + uint64(rnd.Int63n(int64(max-from+1)))
+		got := get64(t, db, bucket, key, from, to)
+		for _, v := range expected.ToArray() {
+			if v >= from && v <= to {
+				require.True(t, got.Contains(v), "step %d, value %d", i, v)
+			}
+		}
+	}
+}
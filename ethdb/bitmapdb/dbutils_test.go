@@ -1,9 +1,16 @@
 package bitmapdb_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
 	"testing"
 
 	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
 	"github.com/stretchr/testify/require"
 )
@@ -53,3 +60,334 @@ func TestCutLeft(t *testing.T) {
 	require.True(t, lft == nil)
 	require.True(t, bm.GetCardinality() == 0)
 }
+
+func TestAppendMergeByOrAndTruncateGreater(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket, key := dbutils.AccountsHistoryBucket, []byte{1}
+
+	// sparse values don't compress, so bitmap gets split to many shards
+	for j := uint32(0); j < 100_000; j += 1_000 {
+		delta := roaring.New()
+		for i := j; i < j+1_000; i += 3 {
+			delta.Add(i)
+		}
+		require.NoError(t, bitmapdb.AppendMergeByOr(db, bucket, key, delta))
+	}
+
+	read := func() (*roaring.Bitmap, int) {
+		var shards []*roaring.Bitmap
+		require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+			bm := roaring.New()
+			_, err := bm.FromBuffer(v)
+			require.NoError(t, err)
+			require.True(t, uint64(bm.GetSerializedSizeInBytes()) < bitmapdb.ChunkLimit+256)
+			shards = append(shards, bm)
+			return true, nil
+		}))
+		return roaring.FastOr(shards...), len(shards)
+	}
+	bm, shards := read()
+	require.Greater(t, shards, 1)
+	require.Equal(t, uint64(33_400), bm.GetCardinality())
+	_, err := db.Get(bucket, bitmapdb.ShardKey(key, ^uint32(0)))
+	require.NoError(t, err)
+
+	require.NoError(t, bitmapdb.TruncateGreater(db, bucket, key, 49_999))
+	bm, _ = read()
+	require.Equal(t, uint32(49_999), bm.Maximum())
+	last, err := db.Get(bucket, bitmapdb.ShardKey(key, ^uint32(0)))
+	require.NoError(t, err)
+	lastBm := roaring.New()
+	_, err = lastBm.FromBuffer(last)
+	require.NoError(t, err)
+	require.Equal(t, uint32(49_999), lastBm.Maximum())
+
+	require.NoError(t, bitmapdb.TruncateGreater(db, bucket, key, 0))
+	bm, shards = read()
+	require.Equal(t, 1, shards)
+	require.Equal(t, []uint32{0}, bm.ToArray())
+}
+
+func TestSeekInBitmap(t *testing.T) {
+	bm := roaring.BitmapOf(3, 10, 20)
+	for _, tc := range []struct {
+		n     uint64
+		found uint64
+		ok    bool
+	}{{0, 3, true}, {3, 3, true}, {4, 10, true}, {20, 20, true}, {21, 0, false}, {1 << 33, 0, false}} {
+		found, ok := bitmapdb.SeekInBitmap(bm, tc.n)
+		require.Equal(t, tc.ok, ok, tc.n)
+		require.Equal(t, tc.found, found, tc.n)
+	}
+	_, ok := bitmapdb.SeekInBitmap(roaring.New(), 0)
+	require.False(t, ok)
+}
+
+func TestTruncateLess(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket, key := dbutils.AccountsHistoryBucket, []byte{1}
+
+	delta := roaring.New()
+	for i := uint32(0); i < 100_000; i += 3 {
+		delta.Add(i)
+	}
+	require.NoError(t, bitmapdb.AppendMergeByOr(db, bucket, key, delta))
+
+	require.NoError(t, bitmapdb.TruncateLess(db, bucket, key, 50_000))
+	var values []uint32
+	require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+		bm := roaring.New()
+		_, err := bm.FromBuffer(v)
+		require.NoError(t, err)
+		require.False(t, bm.IsEmpty())
+		values = append(values, bm.ToArray()...)
+		return true, nil
+	}))
+	require.Equal(t, uint32(50_001), values[0])
+	require.Equal(t, uint32(99_999), values[len(values)-1])
+	require.Len(t, values, (99_999-50_001)/3+1)
+
+	require.NoError(t, bitmapdb.TruncateLess(db, bucket, key, 1<<20))
+	_, err := db.Get(bucket, bitmapdb.ShardKey(key, ^uint32(0)))
+	require.True(t, errors.Is(err, ethdb.ErrKeyNotFound))
+}
+
+func TestCompact(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.LogTopicIndex
+	key1, key2 := []byte{1}, []byte{2}
+
+	// fragmented fixture: every few values in own tiny shard
+	writeFragmented := func(key []byte) {
+		for j := uint32(0); j < 50_000; j += 100 {
+			bm := roaring.New()
+			for i := j; i < j+100; i += 7 {
+				bm.Add(i)
+			}
+			buf := bytes.NewBuffer(nil)
+			_, err := bm.WriteTo(buf)
+			require.NoError(t, err)
+			shardNum := bm.Maximum()
+			if j+100 >= 50_000 {
+				shardNum = ^uint32(0)
+			}
+			require.NoError(t, db.Put(bucket, bitmapdb.ShardKey(key, shardNum), buf.Bytes()))
+		}
+	}
+	writeFragmented(key1)
+	writeFragmented(key2)
+
+	shardsCount := func(key []byte) (n int) {
+		require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+			n++
+			return true, nil
+		}))
+		return n
+	}
+	get := func(key []byte, from, to uint32) []uint32 {
+		var res []uint32
+		require.NoError(t, db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+			c := tx.Cursor(bucket)
+			defer c.Close()
+			bm, err := bitmapdb.Get(c, key, from, to)
+			if err != nil {
+				return err
+			}
+			bm.RemoveRange(0, uint64(from))
+			bm.RemoveRange(uint64(to)+1, uint64(^uint32(0))+1)
+			res = bm.ToArray()
+			return nil
+		}))
+		return res
+	}
+	ranges := [][2]uint32{{0, ^uint32(0)}, {0, 0}, {1_000, 1_050}, {20_000, 30_000}, {49_990, 60_000}}
+	before := map[[2]uint32][]uint32{}
+	for _, r := range ranges {
+		before[r] = get(key1, r[0], r[1])
+	}
+	shards1, shards2 := shardsCount(key1), shardsCount(key2)
+
+	require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		c := tx.Cursor(bucket)
+		defer c.Close()
+		return bitmapdb.Compact(c, key1)
+	}))
+	require.Less(t, shardsCount(key1), shards1)
+	require.Equal(t, shards2, shardsCount(key2))
+	for _, r := range ranges {
+		require.Equal(t, before[r], get(key1, r[0], r[1]), r)
+	}
+	_, err := db.Get(bucket, bitmapdb.ShardKey(key1, ^uint32(0)))
+	require.NoError(t, err)
+
+	// compacted key stays the same
+	compacted := shardsCount(key1)
+	require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return bitmapdb.CompactBucket(tx, bucket, nil)
+	}))
+	require.Equal(t, compacted, shardsCount(key1))
+	require.Equal(t, compacted, shardsCount(key2))
+	for _, r := range ranges {
+		require.Equal(t, before[r], get(key2, r[0], r[1]), r)
+	}
+}
+
+func TestTruncateRange(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.LogTopicIndex
+	// {1, 2} has {1} as prefix, {2} is just next key
+	key, prefixNeighbour, neighbour := []byte{1}, []byte{1, 2}, []byte{2}
+
+	delta := roaring.New()
+	for i := uint32(0); i < 100_000; i += 3 {
+		delta.Add(i)
+	}
+	for _, k := range [][]byte{key, prefixNeighbour, neighbour} {
+		require.NoError(t, bitmapdb.AppendMergeByOr(db, bucket, k, delta))
+	}
+	read := func(key []byte) (*roaring.Bitmap, []uint32) {
+		var shards []*roaring.Bitmap
+		var numbers []uint32
+		require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+			if len(k) != len(key)+4 {
+				return true, nil
+			}
+			bm := roaring.New()
+			_, err := bm.FromBuffer(v)
+			require.NoError(t, err)
+			require.False(t, bm.IsEmpty())
+			shards = append(shards, bm)
+			numbers = append(numbers, binary.BigEndian.Uint32(k[len(key):]))
+			return true, nil
+		}))
+		return roaring.FastOr(shards...), numbers
+	}
+	truncate := func(key []byte, from, to uint64) {
+		require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+			return bitmapdb.TruncateRange(tx, bucket, key, from, to)
+		}))
+	}
+	_, shards := read(key)
+	require.Greater(t, len(shards), 2)
+
+	// middle of multi-shard key
+	truncate(key, 30_000, 60_000)
+	expected := delta.Clone()
+	expected.RemoveRange(30_000, 60_000)
+	bm, shards := read(key)
+	require.True(t, expected.Equals(bm))
+	require.Equal(t, ^uint32(0), shards[len(shards)-1])
+
+	// tail of the key, shard keeping 29_999 becomes last
+	truncate(key, 20_000, 100_000)
+	expected.RemoveRange(20_000, 100_000)
+	bm, shards = read(key)
+	require.True(t, expected.Equals(bm))
+	require.Equal(t, ^uint32(0), shards[len(shards)-1])
+
+	// whole key, neighbours untouched
+	truncate(key, 0, 100_000)
+	bm, shards = read(key)
+	require.True(t, bm.IsEmpty())
+	require.Empty(t, shards)
+	for _, k := range [][]byte{prefixNeighbour, neighbour} {
+		bm, shards = read(k)
+		require.True(t, delta.Equals(bm), "%x", k)
+		require.Equal(t, ^uint32(0), shards[len(shards)-1], "%x", k)
+	}
+
+	// truncation of already empty key doesn't touch neighbours too
+	truncate(key, 0, 100_000)
+	for _, k := range [][]byte{prefixNeighbour, neighbour} {
+		bm, _ = read(k)
+		require.True(t, delta.Equals(bm), "%x", k)
+	}
+}
+
+// TestBitmapFuzz - random appends, truncations and lookups compared against an in-memory reference bitmap
+func TestBitmapFuzz(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.LogTopicIndex
+	key, prefixNeighbour := []byte{1}, []byte{1, 2}
+	require.NoError(t, bitmapdb.AppendMergeByOr(db, bucket, prefixNeighbour, roaring.BitmapOf(1, 2, 3)))
+	rnd := rand.New(rand.NewSource(42))
+
+	read := func(key []byte) *roaring.Bitmap {
+		var shards []*roaring.Bitmap
+		var prev uint32
+		require.NoError(t, db.Walk(bucket, key, 8*len(key), func(k, v []byte) (bool, error) {
+			if len(k) != len(key)+4 {
+				return true, nil
+			}
+			bm := roaring.New()
+			_, err := bm.FromBuffer(v)
+			require.NoError(t, err)
+			require.False(t, bm.IsEmpty())
+			n := binary.BigEndian.Uint32(k[len(key):])
+			// truncation keeps the shard key, so it's not less than the shard maximum
+			require.GreaterOrEqual(t, n, bm.Maximum())
+			if len(shards) > 0 {
+				require.Greater(t, bm.Minimum(), prev)
+			}
+			prev = bm.Maximum()
+			shards = append(shards, bm)
+			return true, nil
+		}))
+		return roaring.FastOr(shards...)
+	}
+	get := func(from, to uint32) *roaring.Bitmap {
+		tx, err := db.KV().Begin(context.Background(), nil, false)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		c := tx.Cursor(bucket)
+		defer c.Close()
+		bm, err := bitmapdb.Get(c, key, from, to)
+		require.NoError(t, err)
+		return bm
+	}
+
+	expected := roaring.New()
+	var max uint32
+	for i := 0; i < 300; i++ {
+		switch rnd.Intn(3) {
+		case 0, 1:
+			// appends are ordered: only values greater than existing ones are added
+			delta := roaring.New()
+			for j, n := 0, rnd.Intn(2_000); j < n; j++ {
+				max += 1 + uint32(rnd.Intn(1<<8))
+				delta.Add(max)
+			}
+			expected.Or(delta)
+			require.NoError(t, bitmapdb.AppendMergeByOr(db, bucket, key, delta))
+		case 2:
+			from := uint64(rnd.Int63n(int64(max) + 1))
+			to := from + uint64(rnd.Int63n(int64(max)-int64(from)+2))
+			expected.RemoveRange(from, to)
+			require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+				return bitmapdb.TruncateRange(tx, bucket, key, from, to)
+			}))
+			max = 0
+			if !expected.IsEmpty() {
+				max = expected.Maximum()
+			}
+		}
+
+		require.True(t, expected.Equals(read(key)), "step %d", i)
+
+		// Get may return more shards than needed, values of [from, to] must be exactly the expected ones
+		from := uint32(rnd.Int63n(int64(max) + 1))
+		to := from + uint32(rnd.Int63n(int64(max)-int64(from)+1))
+		got, want := get(from, to), expected.Clone()
+		got.RemoveRange(0, uint64(from))
+		got.RemoveRange(uint64(to)+1, uint64(^uint32(0))+1)
+		want.RemoveRange(0, uint64(from))
+		want.RemoveRange(uint64(to)+1, uint64(^uint32(0))+1)
+		require.True(t, want.Equals(got), "step %d, [%d, %d]", i, from, to)
+	}
+	require.Equal(t, []uint32{1, 2, 3}, read(prefixNeighbour).ToArray())
+}
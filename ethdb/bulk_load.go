@@ -0,0 +1,106 @@
+package ethdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// KVIterator - source of pre-sorted data for BulkLoad, returns nil key when there is no more data
+type KVIterator func() ([]byte, []byte, error)
+
+// CursorIterator - KVIterator over all key/value pairs of the cursor
+func CursorIterator(c Cursor) KVIterator {
+	started := false
+	return func() ([]byte, []byte, error) {
+		if !started {
+			started = true
+			return c.First()
+		}
+		return c.Next()
+	}
+}
+
+// BulkLoadCommitSize - amount of data after which BulkLoad commits transaction, to cap amount of dirty pages
+var BulkLoadCommitSize = 512 * datasize.MB
+
+// BulkLoad - fills the bucket by pre-sorted data using cursor Append. Unlike raw Append, it validates that keys
+// (and values of DupSort buckets) are strictly increasing and returns ErrKeyOrder with the offending pair otherwise.
+// Data is committed every BulkLoadCommitSize bytes, so on error part of it can already be in the bucket.
+func BulkLoad(kv KV, bucket string, it KVIterator) error {
+	l := &bulkLoader{
+		bucket:    bucket,
+		isDupSort: dbutils.BucketsConfigs[bucket].Flags&lmdb.DupSort != 0,
+		it:        it,
+		logEvery:  time.NewTicker(30 * time.Second),
+	}
+	defer l.logEvery.Stop()
+
+	k, v, err := it()
+	for k != nil && err == nil {
+		var tx Tx
+		if tx, err = kv.Begin(context.Background(), nil, true); err != nil {
+			return err
+		}
+		if k, v, err = l.loadBatch(tx, k, v); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(context.Background()); err != nil {
+			return err
+		}
+		log.Debug("BulkLoad commit", "bucket", bucket, "size", common.StorageSize(l.total))
+	}
+	return err
+}
+
+type bulkLoader struct {
+	bucket       string
+	isDupSort    bool
+	it           KVIterator
+	logEvery     *time.Ticker
+	prevK, prevV []byte
+	total        uint64
+}
+
+// loadBatch - appends data to tx until BulkLoadCommitSize, returns first not appended pair
+func (l *bulkLoader) loadBatch(tx Tx, k, v []byte) ([]byte, []byte, error) {
+	c := tx.Cursor(l.bucket)
+	defer c.Close()
+	var batchSize uint64
+	var err error
+	for ; k != nil; k, v, err = l.it() {
+		if err != nil {
+			return nil, nil, err
+		}
+		if batchSize >= uint64(BulkLoadCommitSize) {
+			return k, v, nil
+		}
+		if l.prevK != nil {
+			cmp := tx.Cmp(l.bucket, l.prevK, k)
+			if cmp > 0 || (cmp == 0 && (!l.isDupSort || tx.DCmp(l.bucket, l.prevV, v) >= 0)) {
+				return nil, nil, fmt.Errorf("%w. bucket: %s, previous key: %x, key: %x", ErrKeyOrder, l.bucket, l.prevK, k)
+			}
+		}
+		if err = c.Append(k, v); err != nil {
+			return nil, nil, err
+		}
+		l.prevK = append(l.prevK[:0], k...)
+		l.prevV = append(l.prevV[:0], v...)
+		batchSize += uint64(len(k) + len(v))
+		l.total += uint64(len(k) + len(v))
+
+		select {
+		default:
+		case <-l.logEvery.C:
+			log.Info("BulkLoad", "bucket", l.bucket, "key", fmt.Sprintf("%x", k), "size", common.StorageSize(l.total))
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,117 @@
+package ethdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/require"
+)
+
+func sliceIterator(pairs [][2][]byte) KVIterator {
+	i := 0
+	return func() ([]byte, []byte, error) {
+		if i >= len(pairs) {
+			return nil, nil, nil
+		}
+		i++
+		return pairs[i-1][0], pairs[i-1][1], nil
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	defer func(prev datasize.ByteSize) { BulkLoadCommitSize = prev }(BulkLoadCommitSize)
+	BulkLoadCommitSize = 100 * datasize.B // many commits
+
+	db := NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.CodeBucket
+	var pairs [][2][]byte
+	for i := uint64(0); i < 1000; i++ {
+		pairs = append(pairs, [2][]byte{dbutils.EncodeBlockNumber(i), []byte{byte(i)}})
+	}
+	require.NoError(t, BulkLoad(db.KV(), bucket, sliceIterator(pairs)))
+	var loaded [][2][]byte
+	require.NoError(t, db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		loaded = append(loaded, [2][]byte{k, v})
+		return true, nil
+	}))
+	require.Equal(t, pairs, loaded)
+
+	// bucket keeps bigger keys
+	err := BulkLoad(db.KV(), bucket, sliceIterator([][2][]byte{{dbutils.EncodeBlockNumber(5), nil}}))
+	require.True(t, errors.Is(err, ErrKeyOrder), "%v", err)
+
+	// out of order data, the offending pair is in the error
+	err = BulkLoad(db.KV(), dbutils.PlainContractCodeBucket, sliceIterator([][2][]byte{{{1}, {1}}, {{3}, {1}}, {{2}, {1}}}))
+	require.True(t, errors.Is(err, ErrKeyOrder), "%v", err)
+	require.Contains(t, err.Error(), "previous key: 03, key: 02")
+
+	// duplicated key
+	err = BulkLoad(db.KV(), dbutils.BlockBodyPrefix, sliceIterator([][2][]byte{{{1}, {1}}, {{1}, {2}}}))
+	require.True(t, errors.Is(err, ErrKeyOrder), "%v", err)
+}
+
+func TestAppendKeyOrder(t *testing.T) {
+	db := NewMemDatabase()
+	defer db.Close()
+	err := db.KV().Update(context.Background(), func(tx Tx) error {
+		c := tx.Cursor(dbutils.CodeBucket)
+		defer c.Close()
+		require.NoError(t, c.Append([]byte{2}, []byte{1}))
+		return c.Append([]byte{1}, []byte{1})
+	})
+	require.True(t, errors.Is(err, ErrKeyOrder), "%v", err)
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	const entries = 10_000_000
+	iterator := func() KVIterator {
+		i := uint64(0)
+		k, v := make([]byte, 8), make([]byte, 32)
+		return func() ([]byte, []byte, error) {
+			if i >= entries {
+				return nil, nil, nil
+			}
+			binary.BigEndian.PutUint64(k, i)
+			binary.BigEndian.PutUint64(v, i)
+			i++
+			return k, v, nil
+		}
+	}
+
+	b.Run("BulkLoad", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			db := NewMemDatabase()
+			if err := BulkLoad(db.KV(), dbutils.CodeBucket, iterator()); err != nil {
+				b.Fatal(err)
+			}
+			db.Close()
+		}
+	})
+	b.Run("Put", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			db := NewMemDatabase()
+			if err := db.KV().Update(context.Background(), func(tx Tx) error {
+				c := tx.Cursor(dbutils.CodeBucket)
+				defer c.Close()
+				it := iterator()
+				for k, v, err := it(); k != nil; k, v, err = it() {
+					if err != nil {
+						return err
+					}
+					if err = c.Put(k, v); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+			db.Close()
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// ClearBucketsBatchSize - amount of keys ClearBucketsIncremental deletes per transaction
+var ClearBucketsBatchSize = 100_000
+
+// clearBucketsIncremental - deletes content of buckets by batches of ClearBucketsBatchSize keys, each batch is
+// committed by `commit` together with the progress marker in DatabaseInfoBucket. Buckets with the marker left by
+// interrupted call are cleared first. When bucket is empty it's cleared by BucketMigrator, so LMDB reclaims its pages.
+func clearBucketsIncremental(ctx context.Context, commit func(f func(tx Tx) error) error, buckets ...string) error {
+	var unfinished []string
+	if err := commit(func(tx Tx) error {
+		c := tx.Cursor(dbutils.DatabaseInfoBucket)
+		defer c.Close()
+		for k, _, err := c.Seek(dbutils.ClearingBucketPrefix); k != nil; k, _, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			if !bytes.HasPrefix(k, dbutils.ClearingBucketPrefix) {
+				break
+			}
+			unfinished = append(unfinished, string(k[len(dbutils.ClearingBucketPrefix):]))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, bucket := range append(unfinished, buckets...) {
+		if err := clearBucketIncremental(ctx, commit, bucket); err != nil {
+			return fmt.Errorf("clearing bucket %s: %w", bucket, err)
+		}
+	}
+	return nil
+}
+
+func clearBucketIncremental(ctx context.Context, commit func(f func(tx Tx) error) error, bucket string) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	marker := append(append([]byte{}, dbutils.ClearingBucketPrefix...), bucket...)
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			log.Info("Clearing bucket", "bucket", bucket)
+		default:
+		}
+
+		if err := commit(func(tx Tx) error {
+			var deleted uint64
+			if v, err := tx.GetOne(dbutils.DatabaseInfoBucket, marker); err != nil {
+				return err
+			} else if len(v) == 8 {
+				deleted = binary.BigEndian.Uint64(v)
+			}
+
+			c := tx.Cursor(bucket)
+			defer c.Close()
+			i := 0
+			k, _, err := c.First()
+			for ; k != nil && i < ClearBucketsBatchSize; k, _, err = c.First() {
+				if err != nil {
+					return err
+				}
+				if err = c.DeleteCurrent(); err != nil {
+					return err
+				}
+				i++
+			}
+			if err != nil {
+				return err
+			}
+			deleted += uint64(i)
+
+			if k != nil {
+				v := make([]byte, 8)
+				binary.BigEndian.PutUint64(v, deleted)
+				return tx.Cursor(dbutils.DatabaseInfoBucket).Put(marker, v)
+			}
+
+			// bucket is empty, drop/recreate it to reclaim pages
+			done = true
+			migrator, ok := tx.(BucketMigrator)
+			if !ok {
+				return fmt.Errorf("%T doesn't implement ethdb.TxMigrator interface", tx)
+			}
+			if err = migrator.ClearBucket(bucket); err != nil {
+				return err
+			}
+			log.Info("Cleared bucket", "bucket", bucket, "keys", deleted)
+			return tx.Cursor(dbutils.DatabaseInfoBucket).Delete(marker)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -288,3 +288,53 @@ func testWalk(db Database, t *testing.T) {
 
 	assert.Equal(t, keysInRange, gotKeys)
 }
+
+func TestMemCopy(t *testing.T) {
+	db := newTestLmdb()
+	defer db.Close()
+
+	// accounts and storage of them: storage keys are stored as dup values of address+incarnation
+	for i := 0; i < 10; i++ {
+		addr := common.BytesToAddress([]byte{byte(i + 1)})
+		require.NoError(t, db.Put(dbutils.PlainStateBucket, addr[:], []byte{0x01, byte(i)}))
+		for j := 0; j < 5; j++ {
+			storageKey := dbutils.PlainGenerateCompositeStorageKey(addr, 1, common.BytesToHash([]byte{byte(j)}))
+			require.NoError(t, db.Put(dbutils.PlainStateBucket, storageKey, []byte{byte(i), byte(j)}))
+		}
+	}
+	require.NoError(t, db.Put(dbutils.HeaderPrefix, []byte{0x01}, []byte{0x02}))
+
+	mem := db.MemCopy()
+	defer mem.Close()
+
+	rawDump := func(kv KV, bucket string) (res [][2][]byte) {
+		require.NoError(t, kv.View(context.Background(), func(tx Tx) error {
+			c := tx.(*lmdbTx).rawCursorDupSort(bucket)
+			defer c.Close()
+			for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+				if err != nil {
+					return err
+				}
+				res = append(res, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+			}
+			return nil
+		}))
+		return res
+	}
+	expected := rawDump(db.KV(), dbutils.PlainStateBucket)
+	require.Len(t, expected, 10*6)
+	require.Equal(t, expected, rawDump(mem.KV(), dbutils.PlainStateBucket))
+
+	v, err := mem.Get(dbutils.PlainStateBucket, dbutils.PlainGenerateCompositeStorageKey(common.BytesToAddress([]byte{3}), 1, common.BytesToHash([]byte{4})))
+	require.NoError(t, err)
+	require.Equal(t, []byte{2, 4}, v)
+	v, err = mem.Get(dbutils.HeaderPrefix, []byte{0x01})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x02}, v)
+
+	// copy is independent from the source
+	require.NoError(t, mem.Put(dbutils.HeaderPrefix, []byte{0x03}, []byte{0x04}))
+	has, err := db.Has(dbutils.HeaderPrefix, []byte{0x03})
+	require.NoError(t, err)
+	require.False(t, has)
+}
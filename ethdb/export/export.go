@@ -0,0 +1,580 @@
+// Package export writes buckets of the database into files and imports them back, see the format below.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/cespare/xxhash/v2"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Export format: the directory holds the manifest and the chunk files of every exported bucket.
+// Chunk file = magic | version | bucket header | records | 0 | xxhash64 of everything before it (8 bytes, big endian)
+// Bucket header = uvarint len(bucket) | bucket | uvarint flags | uvarint dupFromLen | uvarint dupToLen | uvarint chunk
+// Record = uvarint len(key) | key | uvarint len(value) | value, keys are never empty
+const (
+	exportMagic          = "tgex"
+	exportVersion        = 1
+	ManifestFile         = "manifest.json" // written when the export is complete
+	exportProgressFile   = "export.progress"
+	ImportProgressFile   = "import.progress" // suggested name, Import takes the path of its progress file
+	exportChunkExtension = ".chunk"
+)
+
+// exportChunkSize - amount of record bytes after which export starts the next chunk file
+var exportChunkSize = 256 * datasize.MB
+
+// bucketHeader - configuration of the exported bucket, import requires it to match BucketsConfigs
+type bucketHeader struct {
+	bucket     string
+	flags      uint
+	dupFromLen int
+	dupToLen   int
+	chunk      int
+}
+
+func newBucketHeader(bucket string, chunk int) (bucketHeader, error) {
+	cfg, ok := dbutils.BucketsConfigs[bucket]
+	if !ok {
+		return bucketHeader{}, fmt.Errorf("unknown bucket %s", bucket)
+	}
+	h := bucketHeader{bucket: bucket, flags: cfg.Flags, chunk: chunk}
+	if cfg.AutoDupSortKeysConversion {
+		h.dupFromLen, h.dupToLen = cfg.DupFromLen, cfg.DupToLen
+	}
+	return h, nil
+}
+
+type exportedBucket struct {
+	Name    string `json:"name"`
+	Chunks  int    `json:"chunks"`
+	Records uint64 `json:"records"`
+}
+
+type exportManifest struct {
+	Buckets []exportedBucket `json:"buckets"`
+}
+
+// transferProgress is saved after every chunk, so that interrupted export or import resumes from the next one
+type transferProgress struct {
+	Done      []exportedBucket `json:"done"`             // buckets transferred completely
+	Bucket    string           `json:"bucket,omitempty"` // bucket in progress
+	Chunks    int              `json:"chunks"`           // chunks of the bucket in progress transferred
+	Records   uint64           `json:"records"`          // records of the bucket in progress transferred
+	LastKey   hexutil.Bytes    `json:"lastKey,omitempty"`
+	LastValue hexutil.Bytes    `json:"lastValue,omitempty"`
+}
+
+func (p *transferProgress) done(bucket string) bool {
+	for _, b := range p.Done {
+		if b.Name == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *transferProgress) start(bucket string) {
+	*p = transferProgress{Done: p.Done, Bucket: bucket}
+}
+
+func (p *transferProgress) finish() {
+	p.Done = append(p.Done, exportedBucket{Name: p.Bucket, Chunks: p.Chunks, Records: p.Records})
+	p.start("")
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file atomically
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readProgress(path string) (*transferProgress, error) {
+	var p transferProgress
+	if err := readJSON(path, &p); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading progress file: %w", err)
+	}
+	return &p, nil
+}
+
+func chunkPath(dir string, bucket string, chunk int) string {
+	return filepath.Join(dir, fmt.Sprintf("%x-%06d%s", bucket, chunk, exportChunkExtension))
+}
+
+type chunkWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	h    *xxhash.Digest
+	size uint64
+	buf  [binary.MaxVarintLen64]byte
+}
+
+// createChunk - the chunk is written into the temporary file, which close renames
+func createChunk(path string, header bucketHeader) (*chunkWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	cw := &chunkWriter{path: path, f: f, w: bufio.NewWriter(f), h: xxhash.New()}
+	if err = cw.write(append([]byte(exportMagic), exportVersion)); err != nil {
+		cw.abort()
+		return nil, err
+	}
+	if err = cw.writeBytes([]byte(header.bucket)); err != nil {
+		cw.abort()
+		return nil, err
+	}
+	for _, n := range []uint64{uint64(header.flags), uint64(header.dupFromLen), uint64(header.dupToLen), uint64(header.chunk)} {
+		if err = cw.writeUvarint(n); err != nil {
+			cw.abort()
+			return nil, err
+		}
+	}
+	return cw, nil
+}
+
+func (cw *chunkWriter) write(b []byte) error {
+	_, _ = cw.h.Write(b)
+	_, err := cw.w.Write(b)
+	return err
+}
+
+func (cw *chunkWriter) writeUvarint(n uint64) error {
+	return cw.write(cw.buf[:binary.PutUvarint(cw.buf[:], n)])
+}
+
+func (cw *chunkWriter) writeBytes(b []byte) error {
+	if err := cw.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	return cw.write(b)
+}
+
+func (cw *chunkWriter) append(k, v []byte) error {
+	if err := cw.writeBytes(k); err != nil {
+		return err
+	}
+	if err := cw.writeBytes(v); err != nil {
+		return err
+	}
+	cw.size += uint64(len(k) + len(v))
+	return nil
+}
+
+func (cw *chunkWriter) close() error {
+	if err := cw.writeUvarint(0); err != nil {
+		cw.abort()
+		return err
+	}
+	binary.BigEndian.PutUint64(cw.buf[:8], cw.h.Sum64())
+	if _, err := cw.w.Write(cw.buf[:8]); err != nil {
+		cw.abort()
+		return err
+	}
+	if err := cw.w.Flush(); err != nil {
+		cw.abort()
+		return err
+	}
+	if err := cw.f.Sync(); err != nil {
+		cw.abort()
+		return err
+	}
+	if err := cw.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(cw.path+".tmp", cw.path)
+}
+
+func (cw *chunkWriter) abort() {
+	cw.f.Close()
+	os.Remove(cw.path + ".tmp")
+}
+
+type chunkReader struct {
+	path   string
+	f      *os.File
+	r      *bufio.Reader
+	h      *xxhash.Digest
+	size   uint64
+	header bucketHeader
+}
+
+func openChunk(path string) (*chunkReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cr := &chunkReader{path: path, f: f, r: bufio.NewReader(f), h: xxhash.New(), size: uint64(info.Size())}
+	if err = cr.readHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("chunk %s: %w", path, err)
+	}
+	return cr, nil
+}
+
+func (cr *chunkReader) readHeader() error {
+	var prefix [len(exportMagic) + 1]byte
+	if err := cr.read(prefix[:]); err != nil {
+		return err
+	}
+	if string(prefix[:len(exportMagic)]) != exportMagic {
+		return errors.New("not an export chunk")
+	}
+	if prefix[len(exportMagic)] != exportVersion {
+		return fmt.Errorf("unsupported version %d", prefix[len(exportMagic)])
+	}
+	bucket, err := cr.readBytes()
+	if err != nil {
+		return err
+	}
+	cr.header.bucket = string(bucket)
+	var fields [4]uint64
+	for i := range fields {
+		if fields[i], err = cr.readUvarint(); err != nil {
+			return err
+		}
+	}
+	cr.header.flags, cr.header.dupFromLen, cr.header.dupToLen, cr.header.chunk = uint(fields[0]), int(fields[1]), int(fields[2]), int(fields[3])
+	return nil
+}
+
+func (cr *chunkReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	_, _ = cr.h.Write([]byte{b})
+	return b, nil
+}
+
+func (cr *chunkReader) read(b []byte) error {
+	if _, err := io.ReadFull(cr.r, b); err != nil {
+		return err
+	}
+	_, _ = cr.h.Write(b)
+	return nil
+}
+
+func (cr *chunkReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(cr)
+}
+
+func (cr *chunkReader) readBytes() ([]byte, error) {
+	n, err := cr.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	return cr.readN(n)
+}
+
+// readN reads n bytes, corrupted lengths are caught before the allocation
+func (cr *chunkReader) readN(n uint64) ([]byte, error) {
+	if n > cr.size {
+		return nil, fmt.Errorf("length %d exceeds the chunk size", n)
+	}
+	b := make([]byte, n)
+	return b, cr.read(b)
+}
+
+// next returns nil key after the last record, once the checksum is verified
+func (cr *chunkReader) next() ([]byte, []byte, error) {
+	n, err := cr.readUvarint()
+	if err != nil {
+		return nil, nil, fmt.Errorf("chunk %s: %w", cr.path, err)
+	}
+	if n == 0 {
+		var sum [8]byte
+		if _, err = io.ReadFull(cr.r, sum[:]); err != nil {
+			return nil, nil, fmt.Errorf("chunk %s: %w", cr.path, err)
+		}
+		if binary.BigEndian.Uint64(sum[:]) != cr.h.Sum64() {
+			return nil, nil, fmt.Errorf("chunk %s: checksum mismatch", cr.path)
+		}
+		return nil, nil, nil
+	}
+	k, err := cr.readN(n)
+	if err != nil {
+		return nil, nil, fmt.Errorf("chunk %s: %w", cr.path, err)
+	}
+	v, err := cr.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("chunk %s: %w", cr.path, err)
+	}
+	return k, v, nil
+}
+
+func (cr *chunkReader) close() {
+	cr.f.Close()
+}
+
+// Viewer - ethdb.KV, or a transaction which is already open
+type Viewer interface {
+	View(ctx context.Context, f func(tx ethdb.Tx) error) error
+}
+
+// Buckets writes the buckets into the directory, resuming the export interrupted before
+func Buckets(ctx context.Context, kv Viewer, dir string, buckets []string) error {
+	for _, bucket := range buckets {
+		if _, err := newBucketHeader(bucket, 0); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(dir, ManifestFile)
+	if _, err := os.Stat(manifestPath); err == nil {
+		return fmt.Errorf("%s already contains a complete export", dir)
+	}
+	progressPath := filepath.Join(dir, exportProgressFile)
+	p, err := readProgress(progressPath)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if p.done(bucket) {
+			continue
+		}
+		if p.Bucket != bucket {
+			p.start(bucket)
+		} else {
+			log.Info("Resuming export", "bucket", bucket, "chunks", p.Chunks, "records", p.Records)
+		}
+		if err = exportBucket(ctx, kv, dir, progressPath, p); err != nil {
+			return err
+		}
+		log.Info("Exported", "bucket", bucket, "chunks", p.Done[len(p.Done)-1].Chunks, "records", p.Done[len(p.Done)-1].Records)
+	}
+	if err = writeJSON(manifestPath, exportManifest{Buckets: p.Done}); err != nil {
+		return err
+	}
+	return os.Remove(progressPath)
+}
+
+func exportBucket(ctx context.Context, kv Viewer, dir string, progressPath string, p *transferProgress) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	return kv.View(ctx, func(tx ethdb.Tx) error {
+		c := tx.Cursor(p.Bucket)
+		defer c.Close()
+		var k, v []byte
+		var err error
+		if p.LastKey == nil {
+			k, v, err = c.First()
+		} else {
+			// Skip the records exported before the interruption
+			for k, v, err = c.Seek(p.LastKey); k != nil && err == nil; k, v, err = c.Next() {
+				if !bytes.Equal(k, p.LastKey) || bytes.Compare(v, p.LastValue) > 0 {
+					break
+				}
+			}
+		}
+		var cw *chunkWriter
+		for ; k != nil && err == nil; k, v, err = c.Next() {
+			if err = common.Stopped(ctx.Done()); err != nil {
+				break
+			}
+			if cw == nil {
+				header, err1 := newBucketHeader(p.Bucket, p.Chunks)
+				if err1 != nil {
+					return err1
+				}
+				if cw, err = createChunk(chunkPath(dir, p.Bucket, p.Chunks), header); err != nil {
+					return err
+				}
+			}
+			if err = cw.append(k, v); err != nil {
+				break
+			}
+			p.Records++
+			p.LastKey = append(p.LastKey[:0], k...)
+			p.LastValue = append(p.LastValue[:0], v...)
+			if cw.size >= uint64(exportChunkSize) {
+				if err = cw.close(); err != nil {
+					return err
+				}
+				cw = nil
+				p.Chunks++
+				if err = writeJSON(progressPath, p); err != nil {
+					return err
+				}
+			}
+
+			select {
+			default:
+			case <-logEvery.C:
+				log.Info("Export", "bucket", p.Bucket, "chunks", p.Chunks, "records", p.Records)
+			}
+		}
+		if err != nil {
+			if cw != nil {
+				cw.abort()
+			}
+			return err
+		}
+		if cw != nil {
+			if err = cw.close(); err != nil {
+				return err
+			}
+			p.Chunks++
+		}
+		p.finish()
+		return writeJSON(progressPath, p)
+	})
+}
+
+// Import loads the export in the directory into the database, resuming the import interrupted before.
+// Buckets which are not empty are cleared first if force is set, otherwise the import is refused
+func Import(ctx context.Context, db *ethdb.ObjectDatabase, dir string, progressPath string, force bool) error {
+	var manifest exportManifest
+	if err := readJSON(filepath.Join(dir, ManifestFile), &manifest); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not contain a complete export", dir)
+		}
+		return err
+	}
+	p, err := readProgress(progressPath)
+	if err != nil {
+		return err
+	}
+	for _, b := range manifest.Buckets {
+		if p.done(b.Name) {
+			continue
+		}
+		if p.Bucket != b.Name {
+			k, _, err := db.Last(b.Name)
+			if err != nil {
+				return err
+			}
+			if k != nil {
+				if !force {
+					return fmt.Errorf("bucket %s is not empty, use --force to overwrite it", b.Name)
+				}
+				if err = db.ClearBuckets(b.Name); err != nil {
+					return err
+				}
+			}
+			p.start(b.Name)
+			if err = writeJSON(progressPath, p); err != nil {
+				return err
+			}
+		} else {
+			log.Info("Resuming import", "bucket", b.Name, "chunks", p.Chunks, "records", p.Records)
+		}
+		for p.Chunks < b.Chunks {
+			records, err := importChunk(ctx, db, chunkPath(dir, b.Name, p.Chunks), b.Name, p.Chunks)
+			if err != nil {
+				return err
+			}
+			p.Chunks++
+			p.Records += records
+			if err = writeJSON(progressPath, p); err != nil {
+				return err
+			}
+		}
+		if p.Records != b.Records {
+			return fmt.Errorf("bucket %s: imported %d records, exported %d", b.Name, p.Records, b.Records)
+		}
+		p.finish()
+		if err = writeJSON(progressPath, p); err != nil {
+			return err
+		}
+		log.Info("Imported", "bucket", b.Name, "chunks", b.Chunks, "records", b.Records)
+	}
+	return os.Remove(progressPath)
+}
+
+// importChunk verifies the checksum of the chunk and appends its records to the bucket.
+// Records appended before the interruption are skipped. It returns the number of records in the chunk
+func importChunk(ctx context.Context, db *ethdb.ObjectDatabase, path string, bucket string, chunk int) (uint64, error) {
+	expected, err := newBucketHeader(bucket, chunk)
+	if err != nil {
+		return 0, err
+	}
+	if err = verifyChunk(path, expected); err != nil {
+		return 0, err
+	}
+	lastK, lastV, err := db.Last(bucket)
+	if err != nil {
+		return 0, err
+	}
+	cr, err := openChunk(path)
+	if err != nil {
+		return 0, err
+	}
+	defer cr.close()
+	var records uint64
+	err = ethdb.BulkLoad(db.KV(), bucket, func() ([]byte, []byte, error) {
+		for {
+			if err := common.Stopped(ctx.Done()); err != nil {
+				return nil, nil, err
+			}
+			k, v, err := cr.next()
+			if err != nil || k == nil {
+				return nil, nil, err
+			}
+			records++
+			if lastK != nil {
+				if cmp := bytes.Compare(k, lastK); cmp < 0 || (cmp == 0 && bytes.Compare(v, lastV) <= 0) {
+					continue
+				}
+				lastK = nil
+			}
+			return k, v, nil
+		}
+	})
+	return records, err
+}
+
+func verifyChunk(path string, expected bucketHeader) error {
+	cr, err := openChunk(path)
+	if err != nil {
+		return err
+	}
+	defer cr.close()
+	if cr.header != expected {
+		return fmt.Errorf("chunk %s: header %+v does not match %+v", path, cr.header, expected)
+	}
+	for {
+		k, _, err := cr.next()
+		if err != nil || k == nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// testBuckets - buckets of exportFixture
+var testBuckets = []string{dbutils.HeaderPrefix, dbutils.BlockBodyPrefix, dbutils.PlainStateBucket}
+
+// countdownContext is cancelled once Done is called n times, to interrupt export and import at a given record
+type countdownContext struct {
+	context.Context
+	n    int
+	done chan struct{}
+}
+
+func newCountdownContext(n int) *countdownContext {
+	return &countdownContext{Context: context.Background(), n: n, done: make(chan struct{})}
+}
+
+func (c *countdownContext) Done() <-chan struct{} {
+	if c.n == 0 {
+		common.SafeClose(c.done)
+	}
+	c.n--
+	return c.done
+}
+
+func exportFixture(t *testing.T) *ethdb.ObjectDatabase {
+	db := ethdb.NewMemDatabase()
+	for i := uint64(0); i < 200; i++ {
+		hash := common.BytesToHash(dbutils.EncodeBlockNumber(i + 1))
+		require.NoError(t, db.Put(dbutils.HeaderPrefix, dbutils.HeaderKey(i, hash), hash.Bytes()))
+		require.NoError(t, db.Put(dbutils.BlockBodyPrefix, dbutils.BlockBodyKey(i, hash), make([]byte, i%7)))
+		address := common.BytesToAddress(dbutils.EncodeBlockNumber(i))
+		require.NoError(t, db.Put(dbutils.PlainStateBucket, address.Bytes(), []byte{byte(i), 1}))
+		for slot := uint64(0); slot < i%5; slot++ {
+			location := common.BytesToHash(dbutils.EncodeBlockNumber(slot))
+			require.NoError(t, db.Put(dbutils.PlainStateBucket, dbutils.PlainGenerateCompositeStorageKey(address, 1, location), []byte{byte(slot + 1)}))
+		}
+	}
+	return db
+}
+
+func bucketContents(t *testing.T, db ethdb.Database, bucket string) [][2][]byte {
+	var pairs [][2][]byte
+	require.NoError(t, db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		pairs = append(pairs, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+		return true, nil
+	}))
+	return pairs
+}
+
+func requireSameBuckets(t *testing.T, expected, actual ethdb.Database) {
+	for _, bucket := range testBuckets {
+		require.Equal(t, bucketContents(t, expected, bucket), bucketContents(t, actual, bucket), "bucket %s", bucket)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	defer func(prev datasize.ByteSize) { exportChunkSize = prev }(exportChunkSize)
+	exportChunkSize = 512 * datasize.B // many chunks per bucket
+	defer func(prev datasize.ByteSize) { ethdb.BulkLoadCommitSize = prev }(ethdb.BulkLoadCommitSize)
+	ethdb.BulkLoadCommitSize = 100 * datasize.B // many commits per chunk
+
+	dir, err := ioutil.TempDir("", "tg-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := exportFixture(t)
+	defer src.Close()
+
+	// Interrupted export resumes from the last complete chunk
+	err = Buckets(newCountdownContext(700), src.KV(), dir, testBuckets)
+	require.True(t, errors.Is(err, common.ErrStopped), "%v", err)
+	_, err = os.Stat(filepath.Join(dir, exportProgressFile))
+	require.NoError(t, err)
+	require.NoError(t, Buckets(context.Background(), src.KV(), dir, testBuckets))
+	_, err = os.Stat(filepath.Join(dir, exportProgressFile))
+	require.True(t, os.IsNotExist(err))
+	require.Error(t, Buckets(context.Background(), src.KV(), dir, testBuckets))
+
+	// Interrupted import resumes from the last record committed
+	dst := ethdb.NewMemDatabase()
+	defer dst.Close()
+	progressPath := filepath.Join(dir, ImportProgressFile)
+	err = Import(newCountdownContext(900), dst, dir, progressPath, false)
+	require.True(t, errors.Is(err, common.ErrStopped), "%v", err)
+	require.NoError(t, Import(context.Background(), dst, dir, progressPath, false))
+	_, err = os.Stat(progressPath)
+	require.True(t, os.IsNotExist(err))
+	requireSameBuckets(t, src, dst)
+
+	// Non-empty buckets are overwritten with force only
+	err = Import(context.Background(), dst, dir, progressPath, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not empty")
+	require.NoError(t, dst.Put(dbutils.HeaderPrefix, []byte{0xff}, []byte{1}))
+	require.NoError(t, Import(context.Background(), dst, dir, progressPath, true))
+	requireSameBuckets(t, src, dst)
+}
+
+func TestImportCorruptedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tg-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := exportFixture(t)
+	defer src.Close()
+	require.NoError(t, Buckets(context.Background(), src.KV(), dir, []string{dbutils.PlainStateBucket}))
+
+	path := chunkPath(dir, dbutils.PlainStateBucket, 0)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	dst := ethdb.NewMemDatabase()
+	defer dst.Close()
+	err = Import(context.Background(), dst, dir, filepath.Join(dir, ImportProgressFile), false)
+	require.Error(t, err)
+	k, _, err := dst.Last(dbutils.PlainStateBucket)
+	require.NoError(t, err)
+	require.Nil(t, k, "nothing is imported from the corrupted chunk")
+}
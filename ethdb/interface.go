@@ -37,8 +37,8 @@ type Getter interface {
 	// Get returns the value for a given key if it's present.
 	Get(bucket string, key []byte) ([]byte, error)
 
-	// Get returns prober chunk of index or error if index is not created.
-	// Key must contain 8byte inverted block number in the end.
+	// GetIndexChunk returns the shard of the history index (serialized roaring bitmap) which contains timestamp
+	// or error if index is not created.
 	GetIndexChunk(bucket string, key []byte, timestamp uint64) ([]byte, error)
 
 	// Has indicates whether a key exists in the database.
@@ -168,6 +168,9 @@ type BucketsMigrator interface {
 	// freelist-friendly methods
 	DropBucketsAndCommitEvery(deleteKeysPerTx uint64, buckets ...string) error
 	ClearBucketsAndCommitEvery(deleteKeysPerTx uint64, buckets ...string) error
+	// ClearBucketsIncremental - deletes keys by batches in separate transactions, persisting the progress.
+	// Interrupted clearing (ctx cancel or crash) is finished by the next call
+	ClearBucketsIncremental(ctx context.Context, buckets ...string) error
 
 	// _Deprecated: freelist-unfriendly methods
 	ClearBuckets(buckets ...string) error // makes them empty
@@ -3,15 +3,18 @@ package ethdb
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
 )
 
 var (
 	ErrAttemptToDeleteNonDeprecatedBucket = errors.New("only buckets from dbutils.DeprecatedBuckets can be deleted")
 	ErrUnknownBucket                      = errors.New("unknown bucket. add it to dbutils.Buckets")
+	ErrKeyOrder                           = errors.New("appended key is not greater than the last key of the bucket")
 )
 
 // KV low-level database interface - main target is - to provide common abstraction over top of LMDB and RemoteKV.
@@ -58,6 +61,10 @@ type KV interface {
 	//	Commit and Rollback while it has active child transactions.
 	Begin(ctx context.Context, parent Tx, writable bool) (Tx, error)
 	AllBuckets() dbutils.BucketsCfg
+
+	// Readers - open read transactions with their start time and caller, oldest first. For diagnostics
+	// of readers which keep LMDB from reusing free pages, see LmdbOpts.ReaderAgeLimit
+	Readers() []ReaderInfo
 }
 
 type Tx interface {
@@ -73,17 +80,48 @@ type Tx interface {
 	CursorDupFixed(bucket string) CursorDupFixed // CursorDupSort - can be used if bucket has lmdb.DupFixed flag
 	GetOne(bucket string, key []byte) (val []byte, err error)
 	HasOne(bucket string, key []byte) (bool, error)
+	// MultiGet - values of the keys in the same order, nil for not found keys. Cheaper than many GetOne calls:
+	// LMDB walks sorted keys by one cursor, other implementations just use GetOne
+	MultiGet(bucket string, keys [][]byte) ([][]byte, error)
 
 	Commit(ctx context.Context) error // Commit all the operations of a transaction into the database.
 	Rollback()                        // Rollback - abandon all the operations of the transaction instead of saving them.
 
 	BucketSize(name string) (uint64, error)
+	BucketStat(name string) (*BucketStat, error)
 
 	Comparator(bucket string) dbutils.CmpFunc
 	Cmp(bucket string, a, b []byte) int
 	DCmp(bucket string, a, b []byte) int
 }
 
+// BucketStat - statistics of the bucket, as LMDB reports them. Backends without pages report only Size
+type BucketStat struct {
+	Entries       uint64 `json:"entries"`
+	BranchPages   uint64 `json:"branchPages"`
+	LeafPages     uint64 `json:"leafPages"`
+	OverflowPages uint64 `json:"overflowPages"`
+	Size          uint64 `json:"size"` // bytes of all pages
+}
+
+// AllBucketsStat - statistics of all known buckets, by name
+func AllBucketsStat(ctx context.Context, kv KV) (map[string]*BucketStat, error) {
+	res := make(map[string]*BucketStat, len(dbutils.Buckets))
+	if err := kv.View(ctx, func(tx Tx) error {
+		for _, bucket := range dbutils.Buckets {
+			st, err := tx.BucketStat(bucket)
+			if err != nil {
+				return fmt.Errorf("bucket %s: %w", bucket, err)
+			}
+			res[bucket] = st
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Interface used for buckets migration, don't use it in usual app code
 type BucketMigrator interface {
 	DropBucket(string) error
@@ -149,6 +187,8 @@ type CursorDupSort interface {
 	FirstDup() ([]byte, error)          // FirstDup - position at first data item of current key
 	NextDup() ([]byte, []byte, error)   // NextDup - position at next data item of current key
 	NextNoDup() ([]byte, []byte, error) // NextNoDup - position at first data item of next key
+	PrevDup() ([]byte, []byte, error)   // PrevDup - position at previous data item of current key
+	PrevNoDup() ([]byte, []byte, error) // PrevNoDup - position at last data item of previous key
 	LastDup(k []byte) ([]byte, error)   // LastDup - position at last data item of current key
 
 	CountDuplicates() (uint64, error)  // CountDuplicates - number of duplicates for the current key
@@ -183,6 +223,11 @@ type Backend interface {
 	AddLocal([]byte) ([]byte, error)
 	Etherbase() (common.Address, error)
 	NetVersion() (uint64, error)
+	// ProtocolVersions - supported versions of the eth protocol, the first is primary
+	ProtocolVersions() ([]uint, error)
+	// Subscribe calls onEvent for the events of the node, like the new chain heads, until the context is done
+	// or the subscription breaks
+	Subscribe(ctx context.Context, onEvent func(*remote.Event)) error
 }
 
 type DbProvider uint8
@@ -191,3 +236,16 @@ const (
 	Remote DbProvider = iota
 	Lmdb
 )
+
+// multiGet - MultiGet by GetOne calls, for implementations which can't do better
+func multiGet(tx Tx, bucket string, keys [][]byte) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		v, err := tx.GetOne(bucket, k)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
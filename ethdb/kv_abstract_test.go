@@ -2,14 +2,19 @@ package ethdb_test
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/lmdb-go/lmdb"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
@@ -111,6 +116,7 @@ func setupDatabases(f ethdb.BucketConfigsFunc) (writeDBs []ethdb.KV, readDBs []e
 	grpcServer := grpc.NewServer()
 	go func() {
 		remote.RegisterKVServer(grpcServer, remotedbserver.NewKvServer(writeDBs[1]))
+		remote.RegisterDBServer(grpcServer, remotedbserver.NewDBServer(writeDBs[1]))
 		if err := grpcServer.Serve(conn); err != nil {
 			log.Error("private RPC server fail", "err", err)
 		}
@@ -453,3 +459,464 @@ func TestReadAfterPut(t *testing.T) {
 		})
 	}
 }
+
+func TestMultiGet(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.CodeBucket
+	for i := 0; i < 1000; i += 2 {
+		require.NoError(t, db.Put(bucket, dbutils.EncodeBlockNumber(uint64(i)), []byte(fmt.Sprintf("%d", i))))
+	}
+
+	require.NoError(t, db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		keys := [][]byte{dbutils.EncodeBlockNumber(998), dbutils.EncodeBlockNumber(1), dbutils.EncodeBlockNumber(0), dbutils.EncodeBlockNumber(500), dbutils.EncodeBlockNumber(5000)}
+		vals, err := tx.MultiGet(bucket, keys)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("998"), nil, []byte("0"), []byte("500"), nil}, vals)
+
+		vals, err = tx.MultiGet(bucket, nil)
+		require.NoError(t, err)
+		require.Empty(t, vals)
+		return nil
+	}))
+}
+
+func TestCursorAfterTxPanics(t *testing.T) {
+	debug.OverrideCursorAfterTxCheck(true)
+	defer debug.OverrideCursorAfterTxCheck(false)
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+
+	var c ethdb.Cursor
+	require.NoError(t, db.KV().View(context.Background(), func(tx ethdb.Tx) error {
+		c = tx.Cursor(dbutils.CodeBucket)
+		_, _, err := c.First()
+		return err
+	}))
+	func() {
+		defer func() {
+			msg, _ := recover().(string)
+			require.Contains(t, msg, "is used after its transaction was done")
+			require.Contains(t, msg, "TestCursorAfterTxPanics") // stack of Rollback
+		}()
+		_, _, _ = c.Next()
+	}()
+}
+
+func BenchmarkMultiGet(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	bucket := dbutils.CodeBucket
+	const entries = 1_000_000
+	if err := ethdb.BulkLoad(db.KV(), bucket, func() func() ([]byte, []byte, error) {
+		i := uint64(0)
+		v := make([]byte, 32)
+		return func() ([]byte, []byte, error) {
+			if i >= entries {
+				return nil, nil, nil
+			}
+			i++
+			return dbutils.EncodeBlockNumber(i - 1), v, nil
+		}
+	}()); err != nil {
+		b.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(42))
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = dbutils.EncodeBlockNumber(uint64(rnd.Intn(entries)))
+	}
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	b.Run("MultiGet", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := tx.MultiGet(bucket, keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetOne", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, k := range keys {
+				if _, err := tx.GetOne(bucket, k); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestRemoteDupSort(t *testing.T) {
+	writeDBs, readDBs, closeAll := setupDatabases(func(defaultBuckets dbutils.BucketsCfg) dbutils.BucketsCfg {
+		return defaultBuckets
+	})
+	defer closeAll()
+	ctx := context.Background()
+
+	// CurrentStateBucket layout: storage keys (account hash + incarnation + location hash) are stored
+	// as duplicates of account hash + incarnation
+	for _, db := range writeDBs {
+		require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+			c := tx.Cursor(dbutils.CurrentStateBucket)
+			for i := byte(1); i <= 3; i++ {
+				if err := c.Put(common.Hash{i}.Bytes(), []byte{i}); err != nil {
+					return err
+				}
+				for j := byte(1); j <= 3; j++ {
+					if err := c.Put(dbutils.GenerateCompositeStorageKey(common.Hash{i}, 1, common.Hash{j}), []byte{i, j}); err != nil {
+						return err
+					}
+				}
+			}
+			c2 := tx.CursorDupFixed(dbutils.Senders2)
+			for i := byte(1); i <= 3; i++ {
+				page := make([]byte, 0, 3*4)
+				for j := byte(1); j <= 3; j++ {
+					page = append(page, 0, 0, i, j)
+				}
+				if err := c2.PutMulti([]byte{i}, page, 4); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	acc2 := dbutils.GenerateStoragePrefix(common.Hash{2}.Bytes(), 1)
+	read := func(db ethdb.KV) (res [][]byte) {
+		add := func(vals ...[]byte) {
+			for _, v := range vals {
+				res = append(res, common.CopyBytes(v))
+			}
+		}
+		require.NoError(t, db.View(ctx, func(tx ethdb.Tx) error {
+			c := tx.CursorDupSort(dbutils.CurrentStateBucket)
+			k, v, err := c.SeekBothRange(acc2, common.Hash{2}.Bytes())
+			require.NoError(t, err)
+			add(k, v)
+			k, v, err = c.NextDup()
+			require.NoError(t, err)
+			add(k, v)
+			k, v, err = c.PrevDup()
+			require.NoError(t, err)
+			add(k, v)
+			k, v, err = c.NextNoDup()
+			require.NoError(t, err)
+			add(k, v)
+			k, v, err = c.PrevNoDup()
+			require.NoError(t, err)
+			add(k, v)
+			v, err = c.FirstDup()
+			require.NoError(t, err)
+			add(v)
+			v, err = c.LastDup(acc2)
+			require.NoError(t, err)
+			add(v)
+			k, v, err = c.SeekBothExact(acc2, v)
+			require.NoError(t, err)
+			add(k, v)
+
+			// DupFixed bucket gets CursorDupFixed by Cursor
+			c2, ok := tx.Cursor(dbutils.Senders2).(ethdb.CursorDupFixed)
+			require.True(t, ok)
+			k, _, err = c2.Seek([]byte{2})
+			require.NoError(t, err)
+			add(k)
+			v, err = c2.GetMulti()
+			require.NoError(t, err)
+			add(v)
+			k, v, err = c2.NextMulti()
+			require.NoError(t, err)
+			add(k, v)
+			return nil
+		}))
+		return res
+	}
+
+	expected := read(readDBs[0])
+	require.Equal(t, append(common.Hash{2}.Bytes(), 2, 2), expected[1])
+	require.Equal(t, []byte{0, 0, 2, 1, 0, 0, 2, 2, 0, 0, 2, 3}, expected[len(expected)-3])
+	require.Equal(t, expected, read(readDBs[1]))
+	require.Equal(t, expected, read(readDBs[2])) // remote
+}
+
+func TestMapSizeGrowth(t *testing.T) {
+	kv := ethdb.NewLMDB().InMem().MapSize(2 * datasize.MB).MapSizeIncrement(2 * datasize.MB).MustOpen()
+	defer kv.Close()
+	db := ethdb.NewObjectDatabase(kv)
+	ctx := context.Background()
+
+	// readers in parallel with the growing writer
+	stop := make(chan struct{})
+	readersDone := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					readersDone <- nil
+					return
+				default:
+				}
+				if err := kv.View(ctx, func(tx ethdb.Tx) error {
+					_, err := tx.GetOne(dbutils.CodeBucket, dbutils.EncodeBlockNumber(0))
+					return err
+				}); err != nil {
+					readersDone <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// 20MB in 1MB transactions, map starts with 2MB
+	v := make([]byte, 4096)
+	for i := uint64(0); i < 20; i++ {
+		require.NoError(t, kv.Update(ctx, func(tx ethdb.Tx) error {
+			c := tx.Cursor(dbutils.CodeBucket)
+			for j := uint64(0); j < 256; j++ {
+				binary.BigEndian.PutUint64(v, i*256+j)
+				if err := c.Put(dbutils.EncodeBlockNumber(i*256+j), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	close(stop)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, <-readersDone)
+	}
+
+	for i := uint64(0); i < 20*256; i++ {
+		got, err := db.Get(dbutils.CodeBucket, dbutils.EncodeBlockNumber(i))
+		require.NoError(t, err)
+		require.Equal(t, i, binary.BigEndian.Uint64(got))
+	}
+	current, max, err := ethdb.GetMapSize(db)
+	require.NoError(t, err)
+	require.Greater(t, current, uint64(20*datasize.MB))
+	require.Equal(t, uint64(ethdb.LMDBDefaultMapSize), max)
+}
+
+func TestMapSizeGrowthCallerManagedTx(t *testing.T) {
+	kv := ethdb.NewLMDB().InMem().MapSize(2 * datasize.MB).MapSizeIncrement(2 * datasize.MB).MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+
+	// 20MB in 1MB transactions opened and committed by the caller, without retries of KV.Update
+	v := make([]byte, 4096)
+	for i := uint64(0); i < 20; i++ {
+		tx, err := kv.Begin(ctx, nil, true)
+		require.NoError(t, err)
+		c := tx.Cursor(dbutils.CodeBucket)
+		for j := uint64(0); j < 256; j++ {
+			binary.BigEndian.PutUint64(v, i*256+j)
+			require.NoError(t, c.Put(dbutils.EncodeBlockNumber(i*256+j), v))
+		}
+		require.NoError(t, tx.Commit(ctx))
+	}
+
+	db := ethdb.NewObjectDatabase(kv)
+	current, _, err := ethdb.GetMapSize(db)
+	require.NoError(t, err)
+	require.Greater(t, current, uint64(20*datasize.MB))
+	got, err := db.Get(dbutils.CodeBucket, dbutils.EncodeBlockNumber(20*256-1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(20*256-1), binary.BigEndian.Uint64(got))
+}
+
+func TestReaders(t *testing.T) {
+	debug.OverrideReadersStacks(true)
+	defer debug.OverrideReadersStacks(false)
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+	require.NoError(t, kv.Update(ctx, func(tx ethdb.Tx) error {
+		return tx.Cursor(dbutils.Buckets[0]).Put([]byte{1}, []byte{1})
+	}))
+	require.Empty(t, kv.Readers())
+
+	tx, err := kv.Begin(ctx, nil, false)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	readers := kv.Readers()
+	require.Len(t, readers, 1)
+	require.GreaterOrEqual(t, int64(readers[0].Age()), int64(10*time.Millisecond))
+	require.Contains(t, readers[0].Caller, "TestReaders")
+	tx.Rollback()
+	require.Empty(t, kv.Readers())
+
+	// writers are not tracked
+	require.NoError(t, kv.Update(ctx, func(tx ethdb.Tx) error {
+		require.Empty(t, kv.Readers())
+		return nil
+	}))
+}
+
+func TestReaderAgeLimit(t *testing.T) {
+	kv := ethdb.NewLMDB().InMem().ReaderAgeLimit(50 * time.Millisecond).MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+	require.NoError(t, kv.Update(ctx, func(tx ethdb.Tx) error {
+		return tx.Cursor(dbutils.Buckets[0]).Put([]byte{1}, []byte{1})
+	}))
+
+	tx, err := kv.Begin(ctx, nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	c := tx.Cursor(dbutils.Buckets[0])
+	k, _, err := c.First()
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, k)
+
+	require.Eventually(t, func() bool {
+		_, _, err = c.First()
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	_, err = tx.GetOne(dbutils.Buckets[0], []byte{1})
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+
+	// aborted reader is still listed until it's closed
+	require.Len(t, kv.Readers(), 1)
+	tx.Rollback()
+	require.Empty(t, kv.Readers())
+	require.NoError(t, kv.View(ctx, func(tx ethdb.Tx) error {
+		v, err := tx.GetOne(dbutils.Buckets[0], []byte{1})
+		require.Equal(t, []byte{1}, v)
+		return err
+	}))
+}
+
+// fillDupFixed - keys with 0..n values of 24 bytes, big keys span many pages
+func fillDupFixed(t testing.TB, kv ethdb.KV, keys int, valuesOf func(i int) int) (expected [][2][]byte) {
+	require.NoError(t, kv.Update(context.Background(), func(tx ethdb.Tx) error {
+		c := tx.CursorDupFixed(dbutils.Senders2)
+		defer c.Close()
+		for i := 0; i < keys; i++ {
+			k := dbutils.EncodeBlockNumber(uint64(i))
+			for j := 0; j < valuesOf(i); j++ {
+				v := make([]byte, 24)
+				binary.BigEndian.PutUint32(v, uint32(j))
+				v[23] = byte(i)
+				if err := c.AppendDup(k, v); err != nil {
+					return err
+				}
+				expected = append(expected, [2][]byte{k, v})
+			}
+		}
+		return nil
+	}))
+	return expected
+}
+
+func TestPrefetchDupFixed(t *testing.T) {
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+	expected := fillDupFixed(t, kv, 100, func(i int) int { return (i % 4) * (i % 7) * 50 })
+
+	require.NoError(t, kv.View(context.Background(), func(tx ethdb.Tx) error {
+		var got [][2][]byte
+		require.NoError(t, ethdb.ForEachPrefetched(tx.Cursor(dbutils.Senders2), 100, func(k, v []byte) (bool, error) {
+			got = append(got, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+			return true, nil
+		}))
+		require.Equal(t, expected, got)
+
+		// other operations in the middle of prefetched window see position of the last Next
+		c := tx.Cursor(dbutils.Senders2).Prefetch(100)
+		k, v, err := c.First()
+		require.NoError(t, err)
+		for i := 1; i < 500; i++ {
+			k, v, err = c.Next()
+			require.NoError(t, err)
+			require.Equal(t, expected[i][0], k)
+			require.Equal(t, expected[i][1], v)
+		}
+		k, v, err = c.Current()
+		require.NoError(t, err)
+		require.Equal(t, expected[499], [2][]byte{k, v})
+		k, v, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, expected[500], [2][]byte{k, v})
+		k, v, err = c.Prev()
+		require.NoError(t, err)
+		require.Equal(t, expected[499], [2][]byte{k, v})
+		for i := 500; i < 1000; i++ {
+			k, v, err = c.Next()
+			require.NoError(t, err)
+			require.Equal(t, expected[i], [2][]byte{k, v})
+		}
+		k, v, err = c.Seek(expected[200][0])
+		require.NoError(t, err)
+		require.Equal(t, expected[200], [2][]byte{k, v})
+		k, v, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, expected[201], [2][]byte{k, v})
+		return nil
+	}))
+}
+
+// BenchmarkPrefetchDupFixed - the gain is in amount of CGO calls, so it's the same on bigger (production-size)
+// buckets: one call per page of values instead of one call per value
+func BenchmarkPrefetchDupFixed(b *testing.B) {
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+	fillDupFixed(b, kv, 10_000, func(i int) int { return 100 })
+
+	for _, prefetch := range []uint{0, 1000} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				if err := kv.View(context.Background(), func(tx ethdb.Tx) error {
+					return ethdb.ForEachPrefetched(tx.Cursor(dbutils.Senders2), prefetch, func(k, v []byte) (bool, error) {
+						return true, nil
+					})
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketStat(t *testing.T) {
+	writeDBs, readDBs, closeAll := setupDatabases(ethdb.DefaultBucketConfigs)
+	defer closeAll()
+	ctx := context.Background()
+
+	for _, db := range readDBs {
+		stats, err := ethdb.AllBucketsStat(ctx, db)
+		require.NoError(t, err)
+		require.Len(t, stats, len(dbutils.Buckets))
+		require.Equal(t, uint64(0), stats[dbutils.CodeBucket].Entries)
+	}
+
+	for _, db := range writeDBs {
+		require.NoError(t, db.Update(ctx, func(tx ethdb.Tx) error {
+			c := tx.Cursor(dbutils.CodeBucket)
+			for i := uint64(0); i < 1000; i++ {
+				if err := c.Put(dbutils.EncodeBlockNumber(i), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			// value bigger than page goes to overflow pages
+			return c.Put(dbutils.EncodeBlockNumber(1000), make([]byte, 10_000))
+		}))
+	}
+
+	for _, db := range readDBs {
+		stats, err := ethdb.AllBucketsStat(ctx, db)
+		require.NoError(t, err)
+		st := stats[dbutils.CodeBucket]
+		require.Equal(t, uint64(1001), st.Entries)
+		require.Greater(t, st.LeafPages, uint64(1))
+		require.Greater(t, st.BranchPages, uint64(0))
+		require.Greater(t, st.OverflowPages, uint64(0))
+		require.Equal(t, (st.LeafPages+st.BranchPages+st.OverflowPages)*uint64(os.Getpagesize()), st.Size)
+	}
+}
@@ -3,17 +3,23 @@ package ethdb
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
+	runtimedebug "runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/lmdb-go/lmdb"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
 	"github.com/ledgerwatch/turbo-geth/log"
 )
 
@@ -22,7 +28,9 @@ const (
 )
 
 var (
-	LMDBDefaultMapSize          = 2 * datasize.TB
+	LMDBDefaultMapSize          = 2 * datasize.TB // max size of the map, it grows up to it
+	LMDBDefaultInitialMapSize   = 8 * datasize.GB
+	LMDBDefaultMapSizeIncrement = 2 * datasize.GB
 	LMDBDefaultMaxFreelistReuse = uint(1000) // measured in pages
 )
 
@@ -33,7 +41,10 @@ type LmdbOpts struct {
 	path             string
 	bucketsCfg       BucketConfigsFunc
 	mapSize          datasize.ByteSize
+	mapSizeIncrement datasize.ByteSize
+	maxMapSize       datasize.ByteSize
 	maxFreelistReuse uint
+	readerAgeLimit   time.Duration
 }
 
 func (opts LmdbOpts) Path(path string) LmdbOpts {
@@ -55,11 +66,30 @@ func (opts LmdbOpts) MapSize(sz datasize.ByteSize) LmdbOpts {
 	return opts
 }
 
+// MapSizeIncrement - map grows by this amount when transaction fails with MDB_MAP_FULL
+func (opts LmdbOpts) MapSizeIncrement(sz datasize.ByteSize) LmdbOpts {
+	opts.mapSizeIncrement = sz
+	return opts
+}
+
+// MaxMapSize - map doesn't grow above it
+func (opts LmdbOpts) MaxMapSize(sz datasize.ByteSize) LmdbOpts {
+	opts.maxMapSize = sz
+	return opts
+}
+
 func (opts LmdbOpts) MaxFreelistReuse(pages uint) LmdbOpts {
 	opts.maxFreelistReuse = pages
 	return opts
 }
 
+// ReaderAgeLimit - read transactions older than limit are aborted: their next operation fails.
+// They pin pages freed after they started, so LMDB can't reuse them and the database grows. 0 - no limit
+func (opts LmdbOpts) ReaderAgeLimit(limit time.Duration) LmdbOpts {
+	opts.readerAgeLimit = limit
+	return opts
+}
+
 func (opts LmdbOpts) ReadOnly() LmdbOpts {
 	opts.readOnly = true
 	return opts
@@ -99,12 +129,21 @@ func (opts LmdbOpts) Open() (KV, error) {
 		if opts.inMem {
 			opts.mapSize = 64 * datasize.MB
 		} else {
-			opts.mapSize = LMDBDefaultMapSize
+			opts.mapSize = LMDBDefaultInitialMapSize
 		}
 	}
 	if err = env.SetMapSize(int64(opts.mapSize.Bytes())); err != nil {
 		return nil, err
 	}
+	if opts.mapSizeIncrement == 0 {
+		opts.mapSizeIncrement = LMDBDefaultMapSizeIncrement
+	}
+	if opts.maxMapSize == 0 {
+		opts.maxMapSize = LMDBDefaultMapSize
+		if opts.mapSize > opts.maxMapSize {
+			opts.maxMapSize = opts.mapSize
+		}
+	}
 
 	if opts.maxFreelistReuse == 0 {
 		opts.maxFreelistReuse = LMDBDefaultMaxFreelistReuse
@@ -137,6 +176,7 @@ func (opts LmdbOpts) Open() (KV, error) {
 		wg:      &sync.WaitGroup{},
 		buckets: dbutils.BucketsCfg{},
 	}
+	db.resizeCond = sync.NewCond(&db.resizeMu)
 	customBuckets := opts.bucketsCfg(dbutils.BucketsConfigs)
 	for name, cfg := range customBuckets { // copy map to avoid changing global variable
 		db.buckets[name] = cfg
@@ -210,6 +250,11 @@ func (opts LmdbOpts) Open() (KV, error) {
 		return nil, err
 	}
 
+	if opts.readerAgeLimit > 0 {
+		db.stopReaderCheck = make(chan struct{})
+		go db.readers.enforceAgeLimit(opts.readerAgeLimit, db.stopReaderCheck, db.log)
+	}
+
 	if !opts.inMem {
 		if staleReaders, err := db.env.ReaderCheck(); err != nil {
 			db.log.Error("failed ReaderCheck", "err", err)
@@ -234,6 +279,19 @@ type LmdbKV struct {
 	log     log.Logger
 	buckets dbutils.BucketsCfg
 	wg      *sync.WaitGroup
+
+	// read-only environment shares the file with a writer from another process, which may grow the map.
+	// writer grows the map itself before write transactions, see growIfNeeded.
+	// to adopt new map size all transactions of this process must be closed, see beginTopLevel
+	resizeMu        sync.Mutex
+	resizeCond      *sync.Cond
+	activeTxs       int
+	resizing        bool
+	growRequested   int32 // atomic, 1 if write failed with MDB_MAP_FULL
+	growPostponedAt time.Time
+
+	readers         readersTracker // top-level read transactions, see Readers
+	stopReaderCheck chan struct{}
 }
 
 func NewLMDB() LmdbOpts {
@@ -246,6 +304,10 @@ func (db *LmdbKV) Close() {
 	if db.env != nil {
 		db.wg.Wait()
 	}
+	if db.stopReaderCheck != nil {
+		close(db.stopReaderCheck)
+		db.stopReaderCheck = nil
+	}
 
 	if db.env != nil {
 		env := db.env
@@ -278,9 +340,13 @@ func (db *LmdbKV) Begin(_ context.Context, parent Tx, writable bool) (Tx, error)
 		return nil, fmt.Errorf("db closed")
 	}
 	isSubTx := parent != nil
+	var reader *trackedReader
 	if !isSubTx {
 		runtime.LockOSThread()
 		db.wg.Add(1)
+		if !writable {
+			reader = db.readers.add(nil)
+		}
 	}
 
 	flags := uint(0)
@@ -291,26 +357,226 @@ func (db *LmdbKV) Begin(_ context.Context, parent Tx, writable bool) (Tx, error)
 	if parent != nil {
 		parentTx = parent.(*lmdbTx).tx
 	}
-	tx, err := db.env.BeginTxn(parentTx, flags)
+	var tx *lmdb.Txn
+	var err error
+	if !isSubTx {
+		if writable {
+			db.growIfNeeded()
+		}
+		tx, err = db.beginTopLevel(flags)
+	} else {
+		tx, err = db.env.BeginTxn(parentTx, flags)
+	}
 	if err != nil {
 		if !isSubTx {
 			runtime.UnlockOSThread() // unlock only in case of error. normal flow is "defer .Rollback()"
 		}
+		if reader != nil {
+			db.readers.remove(reader)
+		}
 		return nil, err
 	}
 	tx.RawRead = true
 	return &lmdbTx{
-		db:      db,
-		tx:      tx,
-		isSubTx: isSubTx,
+		db:       db,
+		tx:       tx,
+		isSubTx:  isSubTx,
+		readOnly: !writable,
+		reader:   reader,
 	}, nil
 }
 
+// beginTopLevel opens top-level transaction. New transactions are held back while the map grows.
+// If another process has grown the map (MDB_MAP_RESIZED), new transactions are held back until the open ones are
+// closed, then new map size is adopted and transaction is retried. Goroutine may hold a transaction while opening
+// another one, so the wait is bounded: after resizeFenceTimeout open readers are aborted, and if they still
+// don't release the map, Begin fails.
+func (db *LmdbKV) beginTopLevel(flags uint) (*lmdb.Txn, error) {
+	db.resizeMu.Lock()
+	for db.resizing {
+		db.resizeCond.Wait()
+	}
+	db.activeTxs++
+	db.resizeMu.Unlock()
+
+	tx, err := db.env.BeginTxn(nil, flags)
+	if err == nil {
+		return tx, nil
+	}
+	if !lmdb.IsMapResized(err) {
+		db.txDone()
+		return nil, err
+	}
+
+	db.resizeMu.Lock()
+	defer db.resizeMu.Unlock()
+	db.activeTxs--
+	for db.resizing { // another goroutine adopts new size
+		db.resizeCond.Wait()
+	}
+	db.resizing = true
+	defer func() {
+		db.resizing = false
+		db.resizeCond.Broadcast()
+	}()
+	if !db.waitNoActiveTxs() {
+		db.log.Warn("Aborting read transactions to adopt map size grown by another process", "open", db.activeTxs)
+		db.readers.abortAll(db.log)
+		if !db.waitNoActiveTxs() {
+			return nil, fmt.Errorf("adopting new map size: %d transactions are still open: %w", db.activeTxs, err)
+		}
+	}
+	if err = db.env.SetMapSize(0); err != nil { // 0 - adopt size set by the writer
+		return nil, fmt.Errorf("adopting new map size: %w", err)
+	}
+	db.log.Info("Adopted database map size grown by another process")
+	if tx, err = db.env.BeginTxn(nil, flags); err != nil {
+		return nil, err
+	}
+	db.activeTxs++
+	return tx, nil
+}
+
+// resizeFenceTimeout - how long resize waits for open transactions of this process to close
+var resizeFenceTimeout = 5 * time.Second
+
+// waitNoActiveTxs - waits until all transactions of this process are closed, at most resizeFenceTimeout.
+// Must be called with resizeMu held and resizing set, new transactions are held back meanwhile.
+func (db *LmdbKV) waitNoActiveTxs() bool {
+	if db.activeTxs == 0 {
+		return true
+	}
+	deadline := time.Now().Add(resizeFenceTimeout)
+	timer := time.AfterFunc(resizeFenceTimeout, func() {
+		db.resizeMu.Lock()
+		defer db.resizeMu.Unlock()
+		db.resizeCond.Broadcast()
+	})
+	defer timer.Stop()
+	for db.activeTxs > 0 && time.Now().Before(deadline) {
+		db.resizeCond.Wait()
+	}
+	return db.activeTxs == 0
+}
+
+func (db *LmdbKV) txDone() {
+	db.resizeMu.Lock()
+	db.activeTxs--
+	if db.activeTxs == 0 {
+		db.resizeCond.Broadcast()
+	}
+	db.resizeMu.Unlock()
+}
+
+// growIfNeeded - grows the map by mapSizeIncrement before write transaction, if previous one failed with
+// MDB_MAP_FULL or less than mapSizeIncrement is left. LMDB discards writes of the failed transaction, so map must
+// grow ahead, growing after the failure only helps the retry of KV.Update.
+// Growth waits for open transactions of this process at most resizeFenceTimeout, otherwise it's postponed
+// to the next write transaction.
+func (db *LmdbKV) growIfNeeded() {
+	if db.opts.readOnly {
+		return
+	}
+	requested := atomic.SwapInt32(&db.growRequested, 0) == 1
+	info, err := db.env.Info()
+	if err != nil {
+		db.log.Error("Growing map: reading env info", "err", err)
+		return
+	}
+	stat, err := db.env.Stat()
+	if err != nil {
+		db.log.Error("Growing map: reading env stat", "err", err)
+		return
+	}
+	current, max := datasize.ByteSize(info.MapSize), db.opts.maxMapSize
+	used := datasize.ByteSize(uint64(info.LastPNO+1) * uint64(stat.PSize))
+	if !requested && used < current && current-used >= db.opts.mapSizeIncrement {
+		return
+	}
+	if current >= max {
+		if requested {
+			db.log.Error("Map is full and reached max size", "size", current.HumanReadable())
+		}
+		return
+	}
+
+	db.resizeMu.Lock()
+	defer db.resizeMu.Unlock()
+	if !requested && time.Since(db.growPostponedAt) < time.Minute { // don't stall every write transaction
+		return
+	}
+	for db.resizing { // adopting or growing by another goroutine
+		db.resizeCond.Wait()
+	}
+	db.resizing = true
+	defer func() {
+		db.resizing = false
+		db.resizeCond.Broadcast()
+	}()
+	if !db.waitNoActiveTxs() {
+		db.log.Warn("Map growth postponed, transactions are still open", "open", db.activeTxs)
+		db.growPostponedAt = time.Now()
+		if requested {
+			atomic.StoreInt32(&db.growRequested, 1)
+		}
+		return
+	}
+	if info, err = db.env.Info(); err != nil { // could grow while we were waiting
+		db.log.Error("Growing map: reading env info", "err", err)
+		return
+	}
+	if datasize.ByteSize(info.MapSize) > current {
+		return
+	}
+	newSize := current + db.opts.mapSizeIncrement
+	if newSize > max {
+		newSize = max
+	}
+	if err = db.env.SetMapSize(int64(newSize.Bytes())); err != nil {
+		db.log.Error("Growing map", "err", err)
+		return
+	}
+	db.log.Info("Map size grown", "from", current.HumanReadable(), "to", newSize.HumanReadable(), "max", max.HumanReadable())
+	if err = db.saveMapSize(newSize, max); err != nil {
+		db.log.Warn("Saving map size", "err", err)
+	}
+}
+
+// saveMapSize - saves current and max map size to DatabaseInfoBucket, see GetMapSize
+func (db *LmdbKV) saveMapSize(current, max datasize.ByteSize) error {
+	dbi := db.buckets[dbutils.DatabaseInfoBucket].DBI
+	return db.env.Update(func(txn *lmdb.Txn) error {
+		v := make([]byte, 16)
+		binary.BigEndian.PutUint64(v, current.Bytes())
+		binary.BigEndian.PutUint64(v[8:], max.Bytes())
+		return txn.Put(dbi, dbutils.LMDBMapSize, v, 0)
+	})
+}
+
+// GetMapSize - current and max map size of LMDB, saved when the map grows
+func GetMapSize(db Getter) (current, max uint64, err error) {
+	v, err := db.Get(dbutils.DatabaseInfoBucket, dbutils.LMDBMapSize)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return 0, 0, err
+	}
+	if len(v) != 16 {
+		return 0, 0, nil
+	}
+	return binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:]), nil
+}
+
 type lmdbTx struct {
-	isSubTx bool
-	tx      *lmdb.Txn
-	db      *LmdbKV
-	cursors []*lmdb.Cursor
+	isSubTx   bool
+	tx        *lmdb.Txn
+	db        *LmdbKV
+	cursors   []*lmdb.Cursor
+	doneStack []byte // stack of Commit/Rollback, only with CHECK_CURSOR_AFTER_TX env variable
+	mapFull   bool   // some write failed with MDB_MAP_FULL, map will grow before next write transaction
+	readOnly  bool
+	reader    *trackedReader
+	released  bool // aborted reader was reset, see checkAborted
+	// configs of the buckets before the transaction created or dropped them, LMDB closes such handles on abort
+	bucketsBefore dbutils.BucketsCfg
 }
 
 type LmdbCursor struct {
@@ -321,6 +587,13 @@ type LmdbCursor struct {
 	prefix     []byte
 
 	c *lmdb.Cursor
+
+	// values of DupFixed bucket prefetched by Next, see Prefetch
+	prefetch  bool
+	window    []byte // values following lastV, raw cursor is positioned at the last of them
+	windowK   []byte // key of lastV and window values
+	lastV     []byte // value returned by the last Next, nil if last operation wasn't Next
+	atPageEnd bool   // raw cursor is at the last value of the page read by GetMultiple/NextMultiple
 }
 
 func (db *LmdbKV) Env() *lmdb.Env {
@@ -335,10 +608,70 @@ func (db *LmdbKV) AllDBI() map[string]lmdb.DBI {
 	return res
 }
 
+// Readers - open top-level read transactions, oldest first
+func (db *LmdbKV) Readers() []ReaderInfo {
+	return db.readers.list()
+}
+
 func (db *LmdbKV) AllBuckets() dbutils.BucketsCfg {
 	return db.buckets
 }
 
+// memCopy - copies all buckets to new in-memory db with same buckets config.
+// Data is copied in the layout it's stored: DupSort buckets by CursorDupSort on both sides, without keys conversion.
+func (db *LmdbKV) memCopy() (*LmdbKV, error) {
+	opts := NewLMDB().InMem().WithBucketsConfig(db.opts.bucketsCfg)
+	if db.opts.inMem {
+		opts = opts.MapSize(db.opts.mapSize)
+	}
+	mem, err := opts.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.View(context.Background(), func(readTx Tx) error {
+		return mem.Update(context.Background(), func(writeTx Tx) error {
+			for name, cfg := range db.buckets {
+				if cfg.IsDeprecated || cfg.DBI == NonExistingDBI {
+					continue
+				}
+				if err := copyBucket(readTx.(*lmdbTx), writeTx.(*lmdbTx), name); err != nil {
+					return fmt.Errorf("copying bucket %s: %w", name, err)
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		mem.Close()
+		return nil, err
+	}
+	return mem.(*LmdbKV), nil
+}
+
+func copyBucket(from, to *lmdbTx, name string) error {
+	var src, dst Cursor
+	var appendFn func(k, v []byte) error
+	if from.db.buckets[name].Flags&lmdb.DupSort != 0 {
+		c := to.rawCursorDupSort(name)
+		src, dst, appendFn = from.rawCursorDupSort(name), c, c.AppendDup
+	} else {
+		src, dst = from.stdCursor(name), to.stdCursor(name)
+		appendFn = dst.Append
+	}
+	defer src.Close()
+	defer dst.Close()
+
+	for k, v, err := src.First(); k != nil; k, v, err = src.Next() {
+		if err != nil {
+			return err
+		}
+		if err = appendFn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (tx *lmdbTx) Comparator(bucket string) dbutils.CmpFunc {
 	b := tx.db.buckets[bucket]
 	return chooseComparator(tx.tx, b.DBI, b)
@@ -390,6 +723,8 @@ func (db *LmdbKV) View(ctx context.Context, f func(tx Tx) error) (err error) {
 	return f(tx)
 }
 
+// Update - runs f in write transaction and commits it. If transaction failed because map is full,
+// f is run once again after the map has grown.
 func (db *LmdbKV) Update(ctx context.Context, f func(tx Tx) error) (err error) {
 	if db.env == nil {
 		return fmt.Errorf("db closed")
@@ -397,23 +732,29 @@ func (db *LmdbKV) Update(ctx context.Context, f func(tx Tx) error) (err error) {
 	db.wg.Add(1)
 	defer db.wg.Done()
 
+	mapFull, err := db.update(ctx, f)
+	if mapFull {
+		db.log.Info("Map is full, retrying transaction after map growth", "err", err)
+		_, err = db.update(ctx, f)
+	}
+	return err
+}
+
+func (db *LmdbKV) update(ctx context.Context, f func(tx Tx) error) (mapFull bool, err error) {
 	tx, err := db.Begin(ctx, nil, true)
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer func() { mapFull = err != nil && tx.(*lmdbTx).mapFull }()
 	defer tx.Rollback()
-	err = f(tx)
-	if err != nil {
-		return err
-	}
-	err = tx.Commit(ctx)
-	if err != nil {
-		return err
+	if err = f(tx); err != nil {
+		return
 	}
-	return nil
+	return false, tx.Commit(ctx)
 }
 
 func (tx *lmdbTx) CreateBucket(name string) error {
+	tx.rememberBucket(name)
 	var flags = tx.db.buckets[name].Flags
 	if !tx.db.opts.readOnly {
 		flags |= lmdb.Create
@@ -480,6 +821,7 @@ func (tx *lmdbTx) dropEvenIfBucketIsNotDeprecated(name string) error {
 			return err
 		}
 	}
+	tx.rememberBucket(name)
 	if err := tx.tx.Drop(dbi, true); err != nil {
 		return err
 	}
@@ -489,6 +831,55 @@ func (tx *lmdbTx) dropEvenIfBucketIsNotDeprecated(name string) error {
 	return nil
 }
 
+// rememberBucket - config of the bucket before its first change by the transaction, see restoreBuckets
+func (tx *lmdbTx) rememberBucket(name string) {
+	if tx.isSubTx {
+		return
+	}
+	if tx.bucketsBefore == nil {
+		tx.bucketsBefore = dbutils.BucketsCfg{}
+	}
+	if _, ok := tx.bucketsBefore[name]; ok {
+		return
+	}
+	cfg, ok := tx.db.buckets[name]
+	if !ok {
+		cfg.DBI = NonExistingDBI
+	}
+	tx.bucketsBefore[name] = cfg
+}
+
+// restoreBuckets - after abort of the transaction the buckets it created don't exist, and the handles of the buckets
+// it dropped are closed by LMDB, they are opened again
+func (tx *lmdbTx) restoreBuckets() {
+	if len(tx.bucketsBefore) == 0 {
+		return
+	}
+	before := tx.bucketsBefore
+	tx.bucketsBefore = nil
+	if err := tx.db.env.View(func(txn *lmdb.Txn) error {
+		for name, cfg := range before {
+			if cfg.DBI != NonExistingDBI {
+				dbi, err := txn.OpenDBI(name, 0)
+				if err != nil {
+					return fmt.Errorf("bucket %s: %w", name, err)
+				}
+				cfg.DBI = dbi
+				switch cfg.CustomDupComparator {
+				case dbutils.DupCmpSuffix32:
+					if err := txn.SetDupCmpExcludeSuffix32(dbi); err != nil {
+						return err
+					}
+				}
+			}
+			tx.db.buckets[name] = cfg
+		}
+		return nil
+	}); err != nil {
+		tx.db.log.Error("failed to reopen buckets after rollback", "err", err)
+	}
+}
+
 func (tx *lmdbTx) ClearBucket(bucket string) error {
 	if err := tx.dropEvenIfBucketIsNotDeprecated(bucket); err != nil {
 		return nil
@@ -520,17 +911,35 @@ func (tx *lmdbTx) Commit(ctx context.Context) error {
 	}
 	defer func() {
 		tx.tx = nil
+		if debug.IsCursorAfterTxCheckEnabled() {
+			tx.doneStack = runtimedebug.Stack()
+		}
 		if !tx.isSubTx {
+			if !tx.released {
+				tx.db.txDone()
+			}
+			if tx.reader != nil {
+				tx.db.readers.remove(tx.reader)
+			}
+			if tx.mapFull {
+				atomic.StoreInt32(&tx.db.growRequested, 1)
+			}
 			tx.db.wg.Done()
 			runtime.UnlockOSThread()
 		}
 	}()
 	tx.closeCursors()
+	if tx.released {
+		tx.tx.Abort()
+		return errReaderAborted
+	}
 
 	commitTimer := time.Now()
 	if err := tx.tx.Commit(); err != nil {
-		return err
+		tx.restoreBuckets() // failed commit aborts the transaction
+		return tx.noteErr(err)
 	}
+	tx.bucketsBefore = nil
 	commitTook := time.Since(commitTimer)
 	if commitTook > 20*time.Second {
 		log.Info("Batch", "commit", commitTook)
@@ -558,13 +967,55 @@ func (tx *lmdbTx) Rollback() {
 	}
 	defer func() {
 		tx.tx = nil
+		if debug.IsCursorAfterTxCheckEnabled() {
+			tx.doneStack = runtimedebug.Stack()
+		}
 		if !tx.isSubTx {
+			if !tx.released {
+				tx.db.txDone()
+			}
+			if tx.reader != nil {
+				tx.db.readers.remove(tx.reader)
+			}
+			if tx.mapFull {
+				atomic.StoreInt32(&tx.db.growRequested, 1)
+			}
 			tx.db.wg.Done()
 			runtime.UnlockOSThread()
 		}
 	}()
 	tx.closeCursors()
 	tx.tx.Abort()
+	tx.restoreBuckets()
+}
+
+func (tx *lmdbTx) MultiGet(bucket string, keys [][]byte) ([][]byte, error) {
+	// sorted keys are close to each other, so LMDB often finds them on the page where cursor already is
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(keys[order[i]], keys[order[j]]) < 0 })
+
+	c := tx.Cursor(bucket)
+	defer c.Close()
+	vals := make([][]byte, len(keys))
+	for _, i := range order {
+		v, err := c.SeekExact(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// noteErr - remembers that map is full, to grow it when tx is done
+func (tx *lmdbTx) noteErr(err error) error {
+	if err != nil && lmdb.IsMapFull(err) {
+		tx.mapFull = true
+	}
+	return err
 }
 
 func (tx *lmdbTx) get(dbi lmdb.DBI, key []byte) ([]byte, error) {
@@ -585,12 +1036,34 @@ func (c *LmdbCursor) Prefix(v []byte) Cursor {
 	return c
 }
 
+// Prefetch - for DupFixed buckets in read-only transactions Next reads a page of values per call to LMDB
+// (MDB_GET_MULTIPLE/MDB_NEXT_MULTIPLE) and serves them from memory. lmdb-go has no batched get for
+// other buckets, so there it does nothing and each Next is still one call to LMDB - only DupFixed buckets are
+// supported. Amount of values is defined by the page, not by v.
 func (c *LmdbCursor) Prefetch(v uint) Cursor {
-	//c.cursorOpts.PrefetchSize = int(v)
+	c.prefetch = v > 1 && c.bucketCfg.Flags&lmdb.DupFixed != 0 && c.tx.readOnly
 	return c
 }
 
+// checkAborted - read transaction was aborted by ReaderAgeLimit. On first check after abort the transaction
+// is reset: it releases its snapshot, so pages it pinned can be reused before the owner calls Rollback.
+// Reset happens here, in the goroutine of the owner, because LMDB transaction can't be used concurrently.
+func (tx *lmdbTx) checkAborted() error {
+	if tx.reader == nil || !tx.reader.isAborted() {
+		return nil
+	}
+	if !tx.released {
+		tx.tx.Reset()
+		tx.released = true
+		tx.db.txDone()
+	}
+	return errReaderAborted
+}
+
 func (tx *lmdbTx) GetOne(bucket string, key []byte) ([]byte, error) {
+	if err := tx.checkAborted(); err != nil {
+		return nil, err
+	}
 	b := tx.db.buckets[bucket]
 	if b.AutoDupSortKeysConversion && len(key) == b.DupFromLen {
 		from, to := b.DupFromLen, b.DupToLen
@@ -623,6 +1096,9 @@ func (tx *lmdbTx) GetOne(bucket string, key []byte) ([]byte, error) {
 }
 
 func (tx *lmdbTx) HasOne(bucket string, key []byte) (bool, error) {
+	if err := tx.checkAborted(); err != nil {
+		return false, err
+	}
 	b := tx.db.buckets[bucket]
 	if b.AutoDupSortKeysConversion && len(key) == b.DupFromLen {
 		from, to := b.DupFromLen, b.DupToLen
@@ -658,18 +1134,36 @@ func (tx *lmdbTx) BucketSize(name string) (uint64, error) {
 	return (st.LeafPages + st.BranchPages + st.OverflowPages) * uint64(os.Getpagesize()), nil
 }
 
-func (tx *lmdbTx) BucketStat(name string) (*lmdb.Stat, error) {
-	if name == "freelist" || name == "gc" || name == "free_list" { //nolint:goconst
-		return tx.tx.Stat(lmdb.DBI(0))
+// BucketStat - also accepts "freelist" and "root" names of LMDB internal trees
+func (tx *lmdbTx) BucketStat(name string) (*BucketStat, error) {
+	var dbi lmdb.DBI
+	switch name {
+	case "freelist", "gc", "free_list": //nolint:goconst
+		dbi = lmdb.DBI(0)
+	case "root": //nolint:goconst
+		dbi = lmdb.DBI(1)
+	default:
+		cfg, ok := tx.db.buckets[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownBucket, name)
+		}
+		dbi = cfg.DBI
 	}
-	if name == "root" { //nolint:goconst
-		return tx.tx.Stat(lmdb.DBI(1))
+	st, err := tx.tx.Stat(dbi)
+	if err != nil {
+		return nil, err
 	}
-	return tx.tx.Stat(tx.db.buckets[name].DBI)
+	return &BucketStat{
+		Entries:       st.Entries,
+		BranchPages:   st.BranchPages,
+		LeafPages:     st.LeafPages,
+		OverflowPages: st.OverflowPages,
+		Size:          (st.BranchPages + st.LeafPages + st.OverflowPages) * uint64(st.PSize),
+	}, nil
 }
 
 func (tx *lmdbTx) Cursor(bucket string) Cursor {
-	b := tx.db.buckets[bucket]
+	b := tx.db.buckets.MustBucket(bucket)
 	if b.AutoDupSortKeysConversion {
 		return tx.stdCursor(bucket)
 	}
@@ -686,8 +1180,8 @@ func (tx *lmdbTx) Cursor(bucket string) Cursor {
 }
 
 func (tx *lmdbTx) stdCursor(bucket string) Cursor {
-	b := tx.db.buckets[bucket]
-	return &LmdbCursor{bucketName: bucket, tx: tx, bucketCfg: b, dbi: tx.db.buckets[bucket].DBI}
+	b := tx.db.buckets.MustBucket(bucket)
+	return &LmdbCursor{bucketName: bucket, tx: tx, bucketCfg: b, dbi: b.DBI}
 }
 
 func (tx *lmdbTx) CursorDupSort(bucket string) CursorDupSort {
@@ -695,31 +1189,46 @@ func (tx *lmdbTx) CursorDupSort(bucket string) CursorDupSort {
 	return &LmdbDupSortCursor{LmdbCursor: basicCursor}
 }
 
+// rawCursorDupSort - CursorDupSort which works with AutoDupSortKeysConversion buckets too:
+// keys and values are read and written in the layout they are stored in db, without conversion
+func (tx *lmdbTx) rawCursorDupSort(bucket string) *LmdbDupSortCursor {
+	basicCursor := tx.stdCursor(bucket).(*LmdbCursor)
+	basicCursor.bucketCfg.AutoDupSortKeysConversion = false // cursor has own copy of config
+	return &LmdbDupSortCursor{LmdbCursor: basicCursor}
+}
+
 func (tx *lmdbTx) CursorDupFixed(bucket string) CursorDupFixed {
 	basicCursor := tx.CursorDupSort(bucket).(*LmdbDupSortCursor)
 	return &LmdbDupFixedCursor{LmdbDupSortCursor: basicCursor}
 }
 
 // methods here help to see better pprof picture
-func (c *LmdbCursor) set(k []byte) ([]byte, []byte, error)    { return c.c.Get(k, nil, lmdb.Set) }
-func (c *LmdbCursor) getCurrent() ([]byte, []byte, error)     { return c.c.Get(nil, nil, lmdb.GetCurrent) }
-func (c *LmdbCursor) first() ([]byte, []byte, error)          { return c.c.Get(nil, nil, lmdb.First) }
-func (c *LmdbCursor) next() ([]byte, []byte, error)           { return c.c.Get(nil, nil, lmdb.Next) }
-func (c *LmdbCursor) nextDup() ([]byte, []byte, error)        { return c.c.Get(nil, nil, lmdb.NextDup) }
-func (c *LmdbCursor) nextNoDup() ([]byte, []byte, error)      { return c.c.Get(nil, nil, lmdb.NextNoDup) }
-func (c *LmdbCursor) prev() ([]byte, []byte, error)           { return c.c.Get(nil, nil, lmdb.Prev) }
-func (c *LmdbCursor) prevDup() ([]byte, []byte, error)        { return c.c.Get(nil, nil, lmdb.PrevDup) }
-func (c *LmdbCursor) prevNoDup() ([]byte, []byte, error)      { return c.c.Get(nil, nil, lmdb.PrevNoDup) }
-func (c *LmdbCursor) last() ([]byte, []byte, error)           { return c.c.Get(nil, nil, lmdb.Last) }
-func (c *LmdbCursor) delCurrent() error                       { return c.c.Del(0) }
-func (c *LmdbCursor) delNoDupData() error                     { return c.c.Del(lmdb.NoDupData) }
-func (c *LmdbCursor) put(k, v []byte) error                   { return c.c.Put(k, v, 0) }
-func (c *LmdbCursor) putCurrent(k, v []byte) error            { return c.c.Put(k, v, lmdb.Current) }
-func (c *LmdbCursor) putNoOverwrite(k, v []byte) error        { return c.c.Put(k, v, lmdb.NoOverwrite) }
-func (c *LmdbCursor) putNoDupData(k, v []byte) error          { return c.c.Put(k, v, lmdb.NoDupData) }
-func (c *LmdbCursor) append(k, v []byte) error                { return c.c.Put(k, v, lmdb.Append) }
-func (c *LmdbCursor) appendDup(k, v []byte) error             { return c.c.Put(k, v, lmdb.AppendDup) }
-func (c *LmdbCursor) reserve(k []byte, n int) ([]byte, error) { return c.c.PutReserve(k, n, 0) }
+func (c *LmdbCursor) set(k []byte) ([]byte, []byte, error) { return c.c.Get(k, nil, lmdb.Set) }
+func (c *LmdbCursor) getCurrent() ([]byte, []byte, error)  { return c.c.Get(nil, nil, lmdb.GetCurrent) }
+func (c *LmdbCursor) first() ([]byte, []byte, error)       { return c.c.Get(nil, nil, lmdb.First) }
+func (c *LmdbCursor) next() ([]byte, []byte, error)        { return c.c.Get(nil, nil, lmdb.Next) }
+func (c *LmdbCursor) nextDup() ([]byte, []byte, error)     { return c.c.Get(nil, nil, lmdb.NextDup) }
+func (c *LmdbCursor) nextNoDup() ([]byte, []byte, error)   { return c.c.Get(nil, nil, lmdb.NextNoDup) }
+func (c *LmdbCursor) prev() ([]byte, []byte, error)        { return c.c.Get(nil, nil, lmdb.Prev) }
+func (c *LmdbCursor) prevDup() ([]byte, []byte, error)     { return c.c.Get(nil, nil, lmdb.PrevDup) }
+func (c *LmdbCursor) prevNoDup() ([]byte, []byte, error)   { return c.c.Get(nil, nil, lmdb.PrevNoDup) }
+func (c *LmdbCursor) last() ([]byte, []byte, error)        { return c.c.Get(nil, nil, lmdb.Last) }
+func (c *LmdbCursor) delCurrent() error                    { return c.c.Del(0) }
+func (c *LmdbCursor) delNoDupData() error                  { return c.c.Del(lmdb.NoDupData) }
+func (c *LmdbCursor) put(k, v []byte) error                { return c.tx.noteErr(c.c.Put(k, v, 0)) }
+func (c *LmdbCursor) putCurrent(k, v []byte) error         { return c.tx.noteErr(c.c.Put(k, v, lmdb.Current)) }
+func (c *LmdbCursor) putNoOverwrite(k, v []byte) error {
+	return c.tx.noteErr(c.c.Put(k, v, lmdb.NoOverwrite))
+}
+func (c *LmdbCursor) putNoDupData(k, v []byte) error {
+	return c.tx.noteErr(c.c.Put(k, v, lmdb.NoDupData))
+}
+func (c *LmdbCursor) append(k, v []byte) error    { return c.tx.noteErr(c.c.Put(k, v, lmdb.Append)) }
+func (c *LmdbCursor) appendDup(k, v []byte) error { return c.tx.noteErr(c.c.Put(k, v, lmdb.AppendDup)) }
+func (c *LmdbCursor) reserve(k []byte, n int) ([]byte, error) {
+	v, err := c.c.PutReserve(k, n, 0)
+	return v, c.tx.noteErr(err)
+}
 func (c *LmdbCursor) getBoth(k, v []byte) ([]byte, []byte, error) {
 	return c.c.Get(k, v, lmdb.GetBoth)
 }
@@ -759,6 +1268,7 @@ func (c *LmdbCursor) initCursor() error {
 }
 
 func (c *LmdbCursor) Count() (uint64, error) {
+	c.assertTxAlive()
 	st, err := c.tx.tx.Stat(c.bucketCfg.DBI)
 	if err != nil {
 		return 0, err
@@ -767,6 +1277,10 @@ func (c *LmdbCursor) Count() (uint64, error) {
 }
 
 func (c *LmdbCursor) First() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -777,6 +1291,13 @@ func (c *LmdbCursor) First() ([]byte, []byte, error) {
 }
 
 func (c *LmdbCursor) Last() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.tx.checkAborted(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -807,6 +1328,13 @@ func (c *LmdbCursor) Last() ([]byte, []byte, error) {
 }
 
 func (c *LmdbCursor) Seek(seek []byte) (k, v []byte, err error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.tx.checkAborted(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -897,11 +1425,18 @@ func (c *LmdbCursor) seekDupSort(seek []byte) (k, v []byte, err error) {
 }
 
 func (c *LmdbCursor) Next() (k, v []byte, err error) {
+	c.assertTxAlive()
+	if err := c.tx.checkAborted(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err = c.initCursor(); err != nil {
 			log.Error("init cursor", "err", err)
 		}
 	}
+	if c.prefetch && c.lastV != nil {
+		return c.nextPrefetched()
+	}
 
 	k, v, err = c.next()
 	if err != nil {
@@ -910,6 +1445,9 @@ func (c *LmdbCursor) Next() (k, v []byte, err error) {
 		}
 		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.Next(): %w", err)
 	}
+	if c.prefetch {
+		c.windowK, c.lastV = k, v
+	}
 
 	b := c.bucketCfg
 	if b.AutoDupSortKeysConversion && len(k) == b.DupToLen {
@@ -925,7 +1463,99 @@ func (c *LmdbCursor) Next() (k, v []byte, err error) {
 	return k, v, nil
 }
 
+// nextPrefetched - Next of DupFixed bucket served from prefetched window
+func (c *LmdbCursor) nextPrefetched() ([]byte, []byte, error) {
+	for len(c.window) == 0 {
+		more, err := c.fillWindow()
+		if err != nil {
+			return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.Next(): %w", err)
+		}
+		if !more {
+			break
+		}
+	}
+	if len(c.window) > 0 {
+		stride := len(c.lastV)
+		c.lastV, c.window = c.window[:stride], c.window[stride:]
+		return c.windowK, c.lastV, nil
+	}
+
+	// values of the key are over
+	c.atPageEnd = false
+	k, v, err := c.nextNoDup()
+	if err != nil {
+		c.windowK, c.lastV = nil, nil
+		if lmdb.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return []byte{}, nil, fmt.Errorf("failed LmdbKV cursor.Next(): %w", err)
+	}
+	c.windowK, c.lastV = k, v
+	if c.prefix != nil && !bytes.HasPrefix(k, c.prefix) {
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
+// fillWindow - reads values of the current key following lastV, returns false if there are no more of them
+func (c *LmdbCursor) fillWindow() (bool, error) {
+	if c.atPageEnd {
+		_, page, err := c.c.Get(nil, nil, lmdb.NextMultiple)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		c.window = page
+		return true, nil
+	}
+
+	// whole page of lastV, from its beginning
+	_, page, err := c.c.Get(nil, nil, lmdb.GetMultiple)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(page) == 0 { // key has single value
+		return false, nil
+	}
+	c.atPageEnd = true
+	stride := len(c.lastV)
+	for i := 0; i+stride <= len(page); i += stride {
+		if bytes.Equal(page[i:i+stride], c.lastV) {
+			c.window = page[i+stride:]
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("prefetch: value %x not found on its page", c.lastV)
+}
+
+// dropWindow - called by all methods except Next. If prefetched values remain, raw cursor is ahead of the last
+// returned value, so it's moved back
+func (c *LmdbCursor) dropWindow() error {
+	if c.lastV == nil {
+		return nil
+	}
+	k, v, rest := c.windowK, c.lastV, len(c.window)
+	c.window, c.windowK, c.lastV, c.atPageEnd = nil, nil, nil, false
+	if rest == 0 {
+		return nil
+	}
+	_, _, err := c.getBoth(k, v)
+	return err
+}
+
 func (c *LmdbCursor) Prev() (k, v []byte, err error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.tx.checkAborted(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err = c.initCursor(); err != nil {
 			log.Error("init cursor", "err", err)
@@ -956,6 +1586,13 @@ func (c *LmdbCursor) Prev() (k, v []byte, err error) {
 
 // Current - return key/data at current cursor position
 func (c *LmdbCursor) Current() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
+	if err := c.tx.checkAborted(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -985,6 +1622,10 @@ func (c *LmdbCursor) Current() ([]byte, []byte, error) {
 }
 
 func (c *LmdbCursor) Delete(key []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1012,6 +1653,10 @@ func (c *LmdbCursor) Delete(key []byte) error {
 // Both MDB_NEXT and MDB_GET_CURRENT will return the same record after
 // this operation.
 func (c *LmdbCursor) DeleteCurrent() error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1022,6 +1667,10 @@ func (c *LmdbCursor) DeleteCurrent() error {
 }
 
 func (c *LmdbCursor) Reserve(k []byte, n int) ([]byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return nil, err
@@ -1064,6 +1713,10 @@ func (c *LmdbCursor) deleteDupSort(key []byte) error {
 }
 
 func (c *LmdbCursor) PutNoOverwrite(key []byte, value []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
 		return fmt.Errorf("lmdb doesn't support empty keys. bucket: %s", c.bucketName)
 	}
@@ -1081,6 +1734,10 @@ func (c *LmdbCursor) PutNoOverwrite(key []byte, value []byte) error {
 }
 
 func (c *LmdbCursor) Put(key []byte, value []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
 		return fmt.Errorf("lmdb doesn't support empty keys. bucket: %s", c.bucketName)
 	}
@@ -1141,6 +1798,10 @@ func (c *LmdbCursor) putDupSort(key []byte, value []byte) error {
 }
 
 func (c *LmdbCursor) PutCurrent(key []byte, value []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
 		return fmt.Errorf("lmdb doesn't support empty keys. bucket: %s", c.bucketName)
 	}
@@ -1160,6 +1821,13 @@ func (c *LmdbCursor) PutCurrent(key []byte, value []byte) error {
 }
 
 func (c *LmdbCursor) SeekExact(key []byte) ([]byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return nil, err
+	}
+	if err := c.tx.checkAborted(); err != nil {
+		return nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return nil, err
@@ -1196,6 +1864,10 @@ func (c *LmdbCursor) SeekExact(key []byte) ([]byte, error) {
 // Cast your cursor to *LmdbCursor to use this method.
 // Return error - if provided data will not sorted (or bucket have old records which mess with new in sorting manner).
 func (c *LmdbCursor) Append(k []byte, v []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if len(k) == 0 {
 		return fmt.Errorf("lmdb doesn't support empty keys. bucket: %s", c.bucketName)
 	}
@@ -1219,10 +1891,31 @@ func (c *LmdbCursor) Append(k []byte, v []byte) error {
 	}
 
 	if b.Flags&lmdb.DupSort != 0 {
-		return c.appendDup(k, v)
+		if err := c.appendDup(k, v); err != nil {
+			return appendErr(c.bucketName, k, err)
+		}
+		return nil
 	}
 
-	return c.append(k, v)
+	if err := c.append(k, v); err != nil {
+		return appendErr(c.bucketName, k, err)
+	}
+	return nil
+}
+
+// appendErr - LMDB returns MDB_KEYEXIST when appended data isn't sorted, replace it by ErrKeyOrder
+func appendErr(bucket string, k []byte, err error) error {
+	if lmdb.IsErrno(err, lmdb.KeyExist) {
+		return fmt.Errorf("%w. bucket: %s, key: %x", ErrKeyOrder, bucket, k)
+	}
+	return err
+}
+
+// assertTxAlive - with CHECK_CURSOR_AFTER_TX env variable panics if cursor is used after its transaction was done
+func (c *LmdbCursor) assertTxAlive() {
+	if c.tx.tx == nil && debug.IsCursorAfterTxCheckEnabled() {
+		panic(fmt.Sprintf("cursor of bucket %s is used after its transaction was done at:\n%s", c.bucketName, c.tx.doneStack))
+	}
 }
 
 func (c *LmdbCursor) Close() {
@@ -1274,6 +1967,10 @@ func (c *LmdbDupSortCursor) PutCurrent(k, v []byte) error {
 
 // DeleteExact - does delete
 func (c *LmdbDupSortCursor) DeleteExact(k1, k2 []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1291,6 +1988,10 @@ func (c *LmdbDupSortCursor) DeleteExact(k1, k2 []byte) error {
 }
 
 func (c *LmdbDupSortCursor) SeekBothExact(key, value []byte) ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1308,6 +2009,10 @@ func (c *LmdbDupSortCursor) SeekBothExact(key, value []byte) ([]byte, []byte, er
 }
 
 func (c *LmdbDupSortCursor) SeekBothRange(key, value []byte) ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1325,6 +2030,10 @@ func (c *LmdbDupSortCursor) SeekBothRange(key, value []byte) ([]byte, []byte, er
 }
 
 func (c *LmdbDupSortCursor) FirstDup() ([]byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return nil, err
@@ -1343,6 +2052,10 @@ func (c *LmdbDupSortCursor) FirstDup() ([]byte, error) {
 
 // NextDup - iterate only over duplicates of current key
 func (c *LmdbDupSortCursor) NextDup() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1361,6 +2074,10 @@ func (c *LmdbDupSortCursor) NextDup() ([]byte, []byte, error) {
 
 // NextNoDup - iterate with skipping all duplicates
 func (c *LmdbDupSortCursor) NextNoDup() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1378,6 +2095,10 @@ func (c *LmdbDupSortCursor) NextNoDup() ([]byte, []byte, error) {
 }
 
 func (c *LmdbDupSortCursor) PrevDup() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1395,6 +2116,10 @@ func (c *LmdbDupSortCursor) PrevDup() ([]byte, []byte, error) {
 }
 
 func (c *LmdbDupSortCursor) PrevNoDup() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1412,6 +2137,10 @@ func (c *LmdbDupSortCursor) PrevNoDup() ([]byte, []byte, error) {
 }
 
 func (c *LmdbDupSortCursor) LastDup(k []byte) ([]byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return nil, err
@@ -1429,6 +2158,10 @@ func (c *LmdbDupSortCursor) LastDup(k []byte) ([]byte, error) {
 }
 
 func (c *LmdbDupSortCursor) AppendDup(k []byte, v []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1436,12 +2169,16 @@ func (c *LmdbDupSortCursor) AppendDup(k []byte, v []byte) error {
 	}
 
 	if err := c.appendDup(k, v); err != nil {
-		return fmt.Errorf("in AppendDup: %w", err)
+		return fmt.Errorf("in AppendDup: %w", appendErr(c.bucketName, k, err))
 	}
 	return nil
 }
 
 func (c *LmdbDupSortCursor) PutNoDupData(key, value []byte) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1456,6 +2193,10 @@ func (c *LmdbDupSortCursor) PutNoDupData(key, value []byte) error {
 
 // DeleteCurrentDuplicates - delete all of the data items for the current key.
 func (c *LmdbDupSortCursor) DeleteCurrentDuplicates() error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
@@ -1469,6 +2210,10 @@ func (c *LmdbDupSortCursor) DeleteCurrentDuplicates() error {
 
 // Count returns the number of duplicates for the current key. See mdb_cursor_count
 func (c *LmdbDupSortCursor) CountDuplicates() (uint64, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return 0, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return 0, err
@@ -1498,6 +2243,10 @@ func (c *LmdbDupFixedCursor) initCursor() error {
 }
 
 func (c *LmdbDupFixedCursor) GetMulti() ([]byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return nil, err
@@ -1514,6 +2263,10 @@ func (c *LmdbDupFixedCursor) GetMulti() ([]byte, error) {
 }
 
 func (c *LmdbDupFixedCursor) NextMulti() ([]byte, []byte, error) {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return []byte{}, nil, err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return []byte{}, nil, err
@@ -1530,11 +2283,15 @@ func (c *LmdbDupFixedCursor) NextMulti() ([]byte, []byte, error) {
 }
 
 func (c *LmdbDupFixedCursor) PutMulti(key []byte, page []byte, stride int) error {
+	c.assertTxAlive()
+	if err := c.dropWindow(); err != nil {
+		return err
+	}
 	if c.c == nil {
 		if err := c.initCursor(); err != nil {
 			return err
 		}
 	}
 
-	return c.c.PutMulti(key, page, stride, 0)
+	return c.tx.noteErr(c.c.PutMulti(key, page, stride, 0))
 }
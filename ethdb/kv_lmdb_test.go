@@ -0,0 +1,132 @@
+package ethdb
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdoptMapSizeWithNestedTx(t *testing.T) {
+	defer func(timeout time.Duration) { resizeFenceTimeout = timeout }(resizeFenceTimeout)
+	resizeFenceTimeout = 100 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "lmdb-resize")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writer := NewLMDB().Path(dir).MapSize(2 * datasize.MB).MapSizeIncrement(2 * datasize.MB).MustOpen()
+	defer writer.Close()
+	reader := NewLMDB().Path(dir).ReadOnly().MapSize(2 * datasize.MB).MustOpen()
+	defer reader.Close()
+	ctx := context.Background()
+
+	outer, err := reader.Begin(ctx, nil, false)
+	require.NoError(t, err)
+
+	// writer grows the map above the size known to reader
+	v := make([]byte, 4096)
+	for i := uint64(0); i < 8; i++ {
+		require.NoError(t, writer.Update(ctx, func(tx Tx) error {
+			c := tx.Cursor(dbutils.CodeBucket)
+			for j := uint64(0); j < 256; j++ {
+				binary.BigEndian.PutUint64(v, i*256+j)
+				if err := c.Put(dbutils.EncodeBlockNumber(i*256+j), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	// outer transaction of the same goroutine pins the old map: Begin must fail instead of waiting forever
+	_, err = reader.Begin(ctx, nil, false)
+	require.Error(t, err)
+	outer.Rollback()
+
+	require.NoError(t, reader.View(ctx, func(tx Tx) error {
+		got, err := tx.GetOne(dbutils.CodeBucket, dbutils.EncodeBlockNumber(8*256-1))
+		require.NoError(t, err)
+		require.Equal(t, uint64(8*256-1), binary.BigEndian.Uint64(got))
+		return nil
+	}))
+}
+
+func TestGrowMapWithNestedTx(t *testing.T) {
+	defer func(timeout time.Duration) { resizeFenceTimeout = timeout }(resizeFenceTimeout)
+	resizeFenceTimeout = 100 * time.Millisecond
+
+	kv := NewLMDB().InMem().MapSize(2 * datasize.MB).MapSizeIncrement(2 * datasize.MB).MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+	put := func(from, to uint64) error {
+		return kv.Update(ctx, func(tx Tx) error {
+			v := make([]byte, 4096)
+			c := tx.Cursor(dbutils.CodeBucket)
+			for i := from; i < to; i++ {
+				binary.BigEndian.PutUint64(v, i)
+				if err := c.Put(dbutils.EncodeBlockNumber(i), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// read transaction of the same goroutine is open: growth is postponed instead of waiting for it forever
+	outer, err := kv.Begin(ctx, nil, false)
+	require.NoError(t, err)
+	require.NoError(t, put(0, 64))
+	current, _, err := GetMapSize(NewObjectDatabase(kv))
+	require.NoError(t, err)
+	require.Zero(t, current)
+	outer.Rollback()
+
+	for i := uint64(1); i < 8; i++ {
+		require.NoError(t, put(i*256, (i+1)*256))
+	}
+	current, _, err = GetMapSize(NewObjectDatabase(kv))
+	require.NoError(t, err)
+	require.Greater(t, current, uint64(4*datasize.MB))
+}
+
+func TestAbortedReaderReleasesMap(t *testing.T) {
+	defer func(timeout time.Duration) { resizeFenceTimeout = timeout }(resizeFenceTimeout)
+	resizeFenceTimeout = 100 * time.Millisecond
+
+	kv := NewLMDB().InMem().MapSize(2 * datasize.MB).MapSizeIncrement(2 * datasize.MB).ReaderAgeLimit(20 * time.Millisecond).MustOpen()
+	defer kv.Close()
+	ctx := context.Background()
+
+	tx, err := kv.Begin(ctx, nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	require.Eventually(t, func() bool {
+		_, err = tx.GetOne(dbutils.CodeBucket, []byte{1})
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	db := kv.(*LmdbKV)
+	db.resizeMu.Lock()
+	require.Zero(t, db.activeTxs)
+	db.resizeMu.Unlock()
+
+	// aborted reader is not rolled back yet, but doesn't hold back growth of the map
+	v := make([]byte, 4096)
+	for i := uint64(0); i < 8; i++ {
+		require.NoError(t, kv.Update(ctx, func(tx Tx) error {
+			c := tx.Cursor(dbutils.CodeBucket)
+			for j := uint64(0); j < 256; j++ {
+				binary.BigEndian.PutUint64(v, i*256+j)
+				if err := c.Put(dbutils.EncodeBlockNumber(i*256+j), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+}
@@ -74,6 +74,38 @@ func TestBucketCRUD(t *testing.T) {
 	}
 }
 
+func TestBucketsAfterRollback(t *testing.T) {
+	require := require.New(t)
+	kv := NewLMDB().InMem().MustOpen()
+	defer kv.Close()
+
+	ctx := context.Background()
+	dropped, created := dbutils.DeprecatedBuckets[0], dbutils.DeprecatedBuckets[1]
+	require.NoError(kv.Update(ctx, func(tx Tx) error {
+		if err := tx.(BucketMigrator).CreateBucket(dropped); err != nil {
+			return err
+		}
+		return tx.Cursor(dropped).Put([]byte{1}, []byte{1})
+	}))
+
+	tx, err := kv.Begin(ctx, nil, true)
+	require.NoError(err)
+	migrator := tx.(BucketMigrator)
+	require.NoError(migrator.DropBucket(dropped))
+	require.NoError(migrator.CreateBucket(created))
+	tx.Rollback()
+
+	require.NoError(kv.View(ctx, func(tx Tx) error {
+		migrator := tx.(BucketMigrator)
+		require.True(migrator.ExistsBucket(dropped))
+		require.False(migrator.ExistsBucket(created))
+		v, err := tx.GetOne(dropped, []byte{1})
+		require.NoError(err)
+		require.Equal([]byte{1}, v)
+		return nil
+	}))
+}
+
 func TestReadOnlyMode(t *testing.T) {
 	path := os.TempDir() + "/tm1"
 	err := os.RemoveAll(path)
@@ -104,3 +136,51 @@ func TestReadOnlyMode(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClearBucketsIncremental(t *testing.T) {
+	defer func(prev int) { ClearBucketsBatchSize = prev }(ClearBucketsBatchSize)
+	ClearBucketsBatchSize = 10
+	db := NewMemDatabase()
+	defer db.Close()
+	for i := uint64(0); i < 100; i++ {
+		require.NoError(t, db.Put(dbutils.CodeBucket, dbutils.EncodeBlockNumber(i), []byte{1}))
+		require.NoError(t, db.Put(dbutils.PlainContractCodeBucket, dbutils.EncodeBlockNumber(i), []byte{1}))
+	}
+	count := func(bucket string) (n int) {
+		require.NoError(t, db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			n++
+			return true, nil
+		}))
+		return n
+	}
+	marker := append(append([]byte{}, dbutils.ClearingBucketPrefix...), dbutils.CodeBucket...)
+
+	// interrupt after 2 batches
+	ctx, cancel := context.WithCancel(context.Background())
+	commits := 0
+	err := clearBucketsIncremental(ctx, func(f func(tx Tx) error) error {
+		if err := db.kv.Update(context.Background(), f); err != nil {
+			return err
+		}
+		if commits++; commits == 3 { // first commit reads unfinished buckets
+			cancel()
+		}
+		return nil
+	}, dbutils.CodeBucket)
+	require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	require.Equal(t, 80, count(dbutils.CodeBucket))
+	v, err := db.Get(dbutils.DatabaseInfoBucket, marker)
+	require.NoError(t, err)
+	require.Equal(t, dbutils.EncodeBlockNumber(20), v)
+
+	// next call finishes it
+	require.NoError(t, db.ClearBucketsIncremental(context.Background()))
+	require.Equal(t, 0, count(dbutils.CodeBucket))
+	_, err = db.Get(dbutils.DatabaseInfoBucket, marker)
+	require.True(t, errors.Is(err, ErrKeyNotFound), "%v", err)
+	require.Equal(t, 100, count(dbutils.PlainContractCodeBucket))
+
+	// bucket is usable after clearing
+	require.NoError(t, db.Put(dbutils.CodeBucket, []byte{1}, []byte{1}))
+	require.Equal(t, 1, count(dbutils.CodeBucket))
+}
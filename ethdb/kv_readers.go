@@ -0,0 +1,183 @@
+package ethdb
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// ReaderInfo - open read transaction, see KV.Readers
+type ReaderInfo struct {
+	Started time.Time
+	Caller  string // stack of the code which opened the transaction, only with TRACK_READERS_STACKS env variable
+}
+
+func (r ReaderInfo) Age() time.Duration {
+	return time.Since(r.Started)
+}
+
+const readersShards = 16
+
+// readersTracker - registry of open read transactions. Long-living reader pins pages freed after it started,
+// LMDB can't reuse them and writer grows the database instead.
+// Every read transaction is registered, so the registry is sharded to keep Begin cheap.
+type readersTracker struct {
+	next   uint32 // atomic, shard of the next reader
+	shards [readersShards]readersShard
+}
+
+type readersShard struct {
+	mu      sync.Mutex
+	readers map[*trackedReader]struct{}
+}
+
+type trackedReader struct {
+	started time.Time
+	callers []uintptr // only with debug.IsReadersStacksEnabled
+	cancel  func()    // optional
+	shard   *readersShard
+	aborted int32 // set before cancel, cheap check for every cursor operation
+}
+
+func (r *trackedReader) isAborted() bool {
+	return atomic.LoadInt32(&r.aborted) == 1
+}
+
+func (r *trackedReader) caller() string {
+	if len(r.callers) == 0 {
+		return "unknown, set TRACK_READERS_STACKS env variable to see it"
+	}
+	var sb strings.Builder
+	frames := runtime.CallersFrames(r.callers)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&sb, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// errReaderAborted - returned by operations of the read transaction aborted by age limit
+var errReaderAborted = fmt.Errorf("read transaction is older than age limit: %w", context.Canceled)
+
+// add - registers reader, cancel is called when it's aborted. Must be called directly from KV.Begin:
+// it captures stack of the Begin caller
+func (t *readersTracker) add(cancel func()) *trackedReader {
+	r := &trackedReader{started: time.Now(), cancel: cancel}
+	if debug.IsReadersStacksEnabled() {
+		pcs := make([]uintptr, 32)
+		r.callers = pcs[:runtime.Callers(3, pcs)] // skip runtime.Callers, add and Begin
+	}
+	r.shard = &t.shards[atomic.AddUint32(&t.next, 1)%readersShards]
+
+	r.shard.mu.Lock()
+	defer r.shard.mu.Unlock()
+	if r.shard.readers == nil {
+		r.shard.readers = map[*trackedReader]struct{}{}
+	}
+	r.shard.readers[r] = struct{}{}
+	return r
+}
+
+func (t *readersTracker) remove(r *trackedReader) {
+	r.shard.mu.Lock()
+	delete(r.shard.readers, r)
+	r.shard.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel() // release context resources
+	}
+}
+
+func (t *readersTracker) all() []*trackedReader {
+	var readers []*trackedReader
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for r := range shard.readers {
+			readers = append(readers, r)
+		}
+		shard.mu.Unlock()
+	}
+	return readers
+}
+
+// list - oldest first
+func (t *readersTracker) list() []ReaderInfo {
+	readers := t.all()
+	sort.Slice(readers, func(i, j int) bool { return readers[i].started.Before(readers[j].started) })
+	res := make([]ReaderInfo, len(readers))
+	for i, r := range readers {
+		res[i] = ReaderInfo{Started: r.started, Caller: r.caller()}
+	}
+	return res
+}
+
+// abortOlderThan - cancels readers older than limit, they fail on next operation
+func (t *readersTracker) abortOlderThan(limit time.Duration, logger log.Logger) {
+	for _, r := range t.all() {
+		age := time.Since(r.started)
+		if age < limit || !atomic.CompareAndSwapInt32(&r.aborted, 0, 1) {
+			continue
+		}
+		logger.Warn("Aborting read transaction", "age", age, "limit", limit, "opened at", r.caller())
+		if r.cancel != nil {
+			r.cancel()
+		}
+	}
+}
+
+// abortAll - cancels all readers, they fail on next operation
+func (t *readersTracker) abortAll(logger log.Logger) {
+	t.abortOlderThan(0, logger)
+}
+
+// enforceAgeLimit - aborts readers older than limit until quit is closed
+func (t *readersTracker) enforceAgeLimit(limit time.Duration, quit <-chan struct{}, logger log.Logger) {
+	checkEvery := limit / 4
+	if checkEvery > time.Minute {
+		checkEvery = time.Minute
+	}
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			t.abortOlderThan(limit, logger)
+		}
+	}
+}
+
+// LogOldestReader - logs age of the oldest read transaction of kv every `every` until quit is closed
+func LogOldestReader(quit <-chan struct{}, kv KV, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		readers := kv.Readers()
+		if len(readers) == 0 {
+			continue
+		}
+		oldest := readers[0]
+		if oldest.Age() < every {
+			log.Info("Read transactions", "amount", len(readers), "oldest", oldest.Age())
+			continue
+		}
+		log.Info("Read transactions", "amount", len(readers), "oldest", oldest.Age(), "opened at", oldest.Caller)
+	}
+}
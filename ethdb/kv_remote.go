@@ -3,24 +3,25 @@ package ethdb
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -38,6 +39,7 @@ type remoteOpts struct {
 	DialAddress string
 	inMemConn   *bufconn.Listener // for tests
 	bucketsCfg  BucketConfigsFunc
+	token       string
 }
 
 type RemoteKV struct {
@@ -47,6 +49,16 @@ type RemoteKV struct {
 	conn     *grpc.ClientConn
 	log      log.Logger
 	buckets  dbutils.BucketsCfg
+	readers  readersTracker
+	closeErr atomic.Value // closeReason, set by CloseWithError
+}
+
+// ErrNodeUnavailable - the connection to the node is lost. It's a gRPC Unavailable error, the operation may be
+// retried when the connection is restored
+var ErrNodeUnavailable = status.Error(codes.Unavailable, "connection to the node is lost, retry later")
+
+type closeReason struct {
+	err error
 }
 
 type remoteTx struct {
@@ -56,10 +68,12 @@ type remoteTx struct {
 	stream             remote.KV_TxClient
 	streamCancelFn     context.CancelFunc
 	streamingRequested bool
+	reader             *trackedReader
 }
 
 type remoteCursor struct {
 	initialized bool
+	dupSort     bool // server must open CursorDupSort even if bucket has AutoDupSortKeysConversion
 	id          uint32
 	prefetch    uint32
 	ctx         context.Context
@@ -92,6 +106,12 @@ func (opts remoteOpts) WithBucketsConfig(f BucketConfigsFunc) remoteOpts {
 	return opts
 }
 
+// WithToken - shared token sent with every call, for the nodes which require it
+func (opts remoteOpts) WithToken(token string) remoteOpts {
+	opts.token = token
+	return opts
+}
+
 func (opts remoteOpts) InMem(listener *bufconn.Listener) remoteOpts {
 	opts.inMemConn = listener
 	return opts
@@ -102,6 +122,12 @@ type RemoteBackend struct {
 	remoteEthBackend remote.ETHBACKENDClient
 	conn             *grpc.ClientConn
 	log              log.Logger
+
+	// the network id and the protocol versions do not change while the node runs, they are fetched once,
+	// the lock guards only the cached values, not the requests
+	versionsLock     sync.Mutex
+	netVersion       *uint64
+	protocolVersions []uint
 }
 
 func (opts remoteOpts) Open(certFile, keyFile, caCert string) (KV, Backend, error) {
@@ -116,39 +142,15 @@ func (opts remoteOpts) Open(certFile, keyFile, caCert string) (KV, Backend, erro
 	if certFile == "" {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
 	} else {
-		var creds credentials.TransportCredentials
-		var err error
-		if caCert == "" {
-			creds, err = credentials.NewClientTLSFromFile(certFile, "")
-
-			if err != nil {
-				return nil, nil, err
-			}
-		} else {
-			// load peer cert/key, ca cert
-			peerCert, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				log.Error("load peer cert/key error:%v", err)
-				return nil, nil, err
-			}
-			caCert, err := ioutil.ReadFile(caCert)
-			if err != nil {
-				log.Error("read ca cert file error:%v", err)
-				return nil, nil, err
-			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
-			creds = credentials.NewTLS(&tls.Config{
-				Certificates: []tls.Certificate{peerCert},
-				ClientCAs:    caCertPool,
-				ClientAuth:   tls.RequireAndVerifyClientCert,
-				//nolint:gosec
-				InsecureSkipVerify: true, // This is to make it work when Common Name does not match - remove when procedure is updated for common name
-			})
+		creds, err := clientTLS(certFile, keyFile, caCert)
+		if err != nil {
+			return nil, nil, err
 		}
-
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
 	}
+	if opts.token != "" {
+		dialOpts = append(dialOpts, tokenInterceptors(opts.token)...)
+	}
 
 	if opts.inMemConn != nil {
 		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, url string) (net.Conn, error) {
@@ -216,6 +218,39 @@ func (db *RemoteKV) Close() {
 	}
 }
 
+// CloseWithError closes the connection, the open transactions fail with err on the next operation
+func (db *RemoteKV) CloseWithError(err error) {
+	db.closeErr.Store(closeReason{err})
+	db.readers.abortAll(db.log)
+	db.Close()
+}
+
+// streamErr - the error of the transaction stream, replaced by the reason of CloseWithError
+func (db *RemoteKV) streamErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if reason, ok := db.closeErr.Load().(closeReason); ok {
+		return reason.err
+	}
+	return err
+}
+
+// remoteTxStream reports the streams broken by CloseWithError with its reason
+type remoteTxStream struct {
+	remote.KV_TxClient
+	db *RemoteKV
+}
+
+func (s remoteTxStream) Send(c *remote.Cursor) error {
+	return s.db.streamErr(s.KV_TxClient.Send(c))
+}
+
+func (s remoteTxStream) Recv() (*remote.Pair, error) {
+	pair, err := s.KV_TxClient.Recv()
+	return pair, s.db.streamErr(err)
+}
+
 func (db *RemoteKV) DiskSize(ctx context.Context) (uint64, error) {
 	sizeReply, err := db.remoteDB.Size(ctx, &remote.SizeRequest{})
 	if err != nil {
@@ -225,13 +260,22 @@ func (db *RemoteKV) DiskSize(ctx context.Context) (uint64, error) {
 }
 
 func (db *RemoteKV) Begin(ctx context.Context, parent Tx, writable bool) (Tx, error) {
+	if reason, ok := db.closeErr.Load().(closeReason); ok {
+		return nil, reason.err
+	}
 	streamCtx, streamCancelFn := context.WithCancel(ctx) // We create child context for the stream so we can cancel it to prevent leak
 	stream, err := db.remoteKV.Tx(streamCtx)
 	if err != nil {
 		streamCancelFn()
 		return nil, err
 	}
-	return &remoteTx{ctx: ctx, db: db, stream: stream, streamCancelFn: streamCancelFn}, nil
+	reader := db.readers.add(streamCancelFn)
+	return &remoteTx{ctx: ctx, db: db, stream: remoteTxStream{stream, db}, streamCancelFn: streamCancelFn, reader: reader}, nil
+}
+
+// Readers - open transactions of this client, server side has its own age limit
+func (db *RemoteKV) Readers() []ReaderInfo {
+	return db.readers.list()
 }
 
 func (db *RemoteKV) View(ctx context.Context, f func(tx Tx) error) (err error) {
@@ -261,6 +305,7 @@ func (tx *remoteTx) Rollback() {
 		c.Close()
 	}
 	tx.closeGrpcStream()
+	tx.db.readers.remove(tx.reader)
 }
 
 func (c *remoteCursor) Prefix(v []byte) Cursor {
@@ -281,12 +326,30 @@ func (tx *remoteTx) BucketSize(name string) (uint64, error) {
 	return sizeReply.Size, nil
 }
 
+func (tx *remoteTx) BucketStat(name string) (*BucketStat, error) {
+	reply, err := tx.db.remoteDB.BucketSize(tx.ctx, &remote.BucketSizeRequest{BucketName: name})
+	if err != nil {
+		return nil, err
+	}
+	return &BucketStat{
+		Entries:       reply.Entries,
+		BranchPages:   reply.BranchPages,
+		LeafPages:     reply.LeafPages,
+		OverflowPages: reply.OverflowPages,
+		Size:          reply.Size,
+	}, nil
+}
+
 func (tx *remoteTx) GetOne(bucket string, key []byte) (val []byte, err error) {
 	c := tx.Cursor(bucket)
 	defer c.Close()
 	return c.SeekExact(key)
 }
 
+func (tx *remoteTx) MultiGet(bucket string, keys [][]byte) ([][]byte, error) {
+	return multiGet(tx, bucket, keys)
+}
+
 func (tx *remoteTx) HasOne(bucket string, key []byte) (bool, error) {
 	c := tx.Cursor(bucket)
 	defer c.Close()
@@ -312,7 +375,24 @@ func (c *remoteCursor) Prev() ([]byte, []byte, error) {
 }
 
 func (tx *remoteTx) Cursor(bucket string) Cursor {
-	b := tx.db.buckets[bucket]
+	b := tx.db.buckets.MustBucket(bucket)
+	if b.AutoDupSortKeysConversion {
+		return tx.stdCursor(bucket)
+	}
+
+	if b.Flags&lmdb.DupFixed != 0 {
+		return tx.CursorDupFixed(bucket)
+	}
+
+	if b.Flags&lmdb.DupSort != 0 {
+		return tx.CursorDupSort(bucket)
+	}
+
+	return tx.stdCursor(bucket)
+}
+
+func (tx *remoteTx) stdCursor(bucket string) *remoteCursor {
+	b := tx.db.buckets.MustBucket(bucket)
 	c := &remoteCursor{tx: tx, ctx: tx.ctx, bucketName: bucket, bucketCfg: b, stream: tx.stream}
 	tx.cursors = append(tx.cursors, c)
 	return c
@@ -322,7 +402,11 @@ func (c *remoteCursor) initCursor() error {
 	if c.initialized {
 		return nil
 	}
-	if err := c.stream.Send(&remote.Cursor{Op: remote.Op_OPEN, BucketName: c.bucketName}); err != nil {
+	op := remote.Op_OPEN
+	if c.dupSort {
+		op = remote.Op_OPEN_DUP_SORT
+	}
+	if err := c.stream.Send(&remote.Cursor{Op: op, BucketName: c.bucketName}); err != nil {
 		return err
 	}
 	msg, err := c.stream.Recv()
@@ -592,7 +676,9 @@ func (c *remoteCursor) Close() {
 }
 
 func (tx *remoteTx) CursorDupSort(bucket string) CursorDupSort {
-	return &remoteCursorDupSort{remoteCursor: tx.Cursor(bucket).(*remoteCursor)}
+	c := tx.stdCursor(bucket)
+	c.dupSort = c.bucketCfg.AutoDupSortKeysConversion // for other buckets server opens cursor of right type by default
+	return &remoteCursorDupSort{remoteCursor: c}
 }
 
 func (c *remoteCursorDupSort) Prefetch(v uint) Cursor {
@@ -712,11 +798,70 @@ func (back *RemoteBackend) Etherbase() (common.Address, error) {
 	return common.BytesToAddress(res.Hash), nil
 }
 
+// versionsTimeout - timeout of the requests of NetVersion and ProtocolVersions
+const versionsTimeout = 10 * time.Second
+
 func (back *RemoteBackend) NetVersion() (uint64, error) {
-	res, err := back.remoteEthBackend.NetVersion(context.Background(), &remote.NetVersionRequest{})
+	back.versionsLock.Lock()
+	cached := back.netVersion
+	back.versionsLock.Unlock()
+	if cached != nil {
+		return *cached, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionsTimeout)
+	defer cancel()
+	res, err := back.remoteEthBackend.NetVersion(ctx, &remote.NetVersionRequest{})
 	if err != nil {
 		return 0, err
 	}
 
-	return res.Id, nil
+	id := res.Id
+	back.versionsLock.Lock()
+	back.netVersion = &id
+	back.versionsLock.Unlock()
+	return id, nil
+}
+
+func (back *RemoteBackend) ProtocolVersions() ([]uint, error) {
+	back.versionsLock.Lock()
+	cached := back.protocolVersions
+	back.versionsLock.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionsTimeout)
+	defer cancel()
+	res, err := back.remoteEthBackend.ProtocolVersion(ctx, &remote.ProtocolVersionRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Versions) == 0 {
+		return nil, errors.New("node reported no protocol versions")
+	}
+
+	versions := make([]uint, len(res.Versions))
+	for i, v := range res.Versions {
+		versions[i] = uint(v)
+	}
+	back.versionsLock.Lock()
+	back.protocolVersions = versions
+	back.versionsLock.Unlock()
+	return versions, nil
+}
+
+func (back *RemoteBackend) Subscribe(ctx context.Context, onEvent func(*remote.Event)) error {
+	subscription, err := back.remoteEthBackend.Subscribe(ctx, &remote.SubscribeRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := subscription.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		onEvent(event)
+	}
 }
@@ -0,0 +1,142 @@
+package ethdb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// PrivateApiTokenKey - metadata key of the shared token, which the node may require from the clients of the private API
+const PrivateApiTokenKey = "tg-private-api-token"
+
+// Errors of Ping, they tell what to fix when the connection to the node does not work
+var (
+	ErrPrivateApiTLS         = errors.New("TLS handshake with the node failed, check the certificates of both sides")
+	ErrPrivateApiToken       = errors.New("the node rejected the token, check that both sides use the same token")
+	ErrPrivateApiUnreachable = errors.New("the node is not reachable, check the address and that the node serves the private API on it")
+)
+
+// clientTLS - credentials of the client side. With the CA certificate the connection is mutually authenticated:
+// the client presents certFile/keyFile and accepts only the node certificates issued by the CA. Without it certFile
+// is the certificate the node is expected to present
+func clientTLS(certFile, keyFile, caCert string) (credentials.TransportCredentials, error) {
+	if caCert == "" {
+		creds, err := credentials.NewClientTLSFromFile(certFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not load the certificate of the node %s: %w", certFile, err)
+		}
+		return creds, nil
+	}
+	peerCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the client certificate %s with the key %s: %w", certFile, keyFile, err)
+	}
+	caPEM, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CA certificate: %w", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in the CA certificate file %s", caCert)
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{peerCert},
+		// The certificates of the node are not issued for its host name (see README of the rpcdaemon), so the host
+		// name is not verified, the chain to the CA is verified by verifyByCA instead
+		//nolint:gosec
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyByCA(caCertPool),
+	}), nil
+}
+
+// verifyByCA accepts the peer certificate if it is issued by one of the CA certificates
+func verifyByCA(roots *x509.CertPool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("x509: the node presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	}
+}
+
+// tokenInterceptors attach the shared token to every call to the node
+func tokenInterceptors(token string) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(metadata.AppendToOutgoingContext(ctx, PrivateApiTokenKey, token), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(metadata.AppendToOutgoingContext(ctx, PrivateApiTokenKey, token), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// Ping checks that the node answers, with the cheap KV.Version call. The connection is established lazily, so this
+// is the first place where the certificates and the token are checked; the errors wrap ErrPrivateApiTLS,
+// ErrPrivateApiToken or ErrPrivateApiUnreachable
+func (db *RemoteKV) Ping(ctx context.Context) error {
+	_, err := db.remoteKV.Version(ctx, &remote.VersionRequest{})
+	return explainConnError(db.opts.DialAddress, err)
+}
+
+func explainConnError(addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return fmt.Errorf("%w: %s", ErrPrivateApiToken, s.Message())
+	case codes.Unavailable:
+		if isTLSFailure(s.Message()) {
+			return fmt.Errorf("%w: %s: %s", ErrPrivateApiTLS, addr, s.Message())
+		}
+		return fmt.Errorf("%w: %s: %s", ErrPrivateApiUnreachable, addr, s.Message())
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %s: no answer in time", ErrPrivateApiUnreachable, addr)
+	default:
+		return err
+	}
+}
+
+// isTLSFailure - the node was reached, but the TLS session was not established. The node closes the connection
+// right after the handshake when it rejects the client certificate, or when only one side uses TLS
+func isTLSFailure(msg string) bool {
+	for _, sign := range []string{"x509", "tls:", "handshake", "connection closed"} {
+		if strings.Contains(msg, sign) {
+			return true
+		}
+	}
+	return false
+}
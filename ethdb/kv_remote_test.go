@@ -0,0 +1,155 @@
+package ethdb_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/remote/remotedbserver"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, dir: dir}
+}
+
+func (ca *testCA) certFile() string {
+	return filepath.Join(ca.dir, ca.cert.Subject.CommonName+".crt")
+}
+
+// issue writes the certificate and the key of name signed by the CA, returns the paths
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// startPrivateApi serves the private API on a random local port
+func startPrivateApi(t *testing.T, creds *credentials.TransportCredentials, token string) (string, func()) {
+	kv := ethdb.NewLMDB().InMem().MustOpen()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := remotedbserver.NewGrpcServer(kv, nil, nil, creds, token)
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+	return lis.Addr().String(), func() {
+		grpcServer.Stop()
+		kv.Close()
+	}
+}
+
+// ping takes the results of Open
+func ping(kv ethdb.KV, _ ethdb.Backend, err error) error {
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return kv.(*ethdb.RemoteKV).Ping(ctx)
+}
+
+func TestPrivateApiMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tg-private-api-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "CA")
+	nodeCert, nodeKey := ca.issue(t, "TG", x509.ExtKeyUsageServerAuth)
+	rpcCert, rpcKey := ca.issue(t, "RPC", x509.ExtKeyUsageClientAuth)
+	otherCA := newTestCA(t, dir, "OtherCA")
+	strangerCert, strangerKey := otherCA.issue(t, "Stranger", x509.ExtKeyUsageClientAuth)
+
+	creds, err := remotedbserver.TLS(nodeCert, nodeKey, ca.certFile())
+	require.NoError(t, err)
+	addr, stop := startPrivateApi(t, &creds, "")
+	defer stop()
+
+	require.NoError(t, ping(ethdb.NewRemote().Path(addr).Open(rpcCert, rpcKey, ca.certFile())), "certificate issued by the CA")
+
+	err = ping(ethdb.NewRemote().Path(addr).Open(strangerCert, strangerKey, ca.certFile()))
+	require.True(t, errors.Is(err, ethdb.ErrPrivateApiTLS), "client certificate of another CA: %v", err)
+
+	err = ping(ethdb.NewRemote().Path(addr).Open(rpcCert, rpcKey, otherCA.certFile()))
+	require.True(t, errors.Is(err, ethdb.ErrPrivateApiTLS), "node certificate is not trusted: %v", err)
+
+	_, _, err = ethdb.NewRemote().Path(addr).Open(rpcCert, filepath.Join(dir, "missing.key"), ca.certFile())
+	require.Error(t, err, "missing key")
+}
+
+func TestPrivateApiToken(t *testing.T) {
+	addr, stop := startPrivateApi(t, nil, "secret")
+	defer stop()
+
+	require.NoError(t, ping(ethdb.NewRemote().Path(addr).WithToken("secret").Open("", "", "")))
+	for _, token := range []string{"", "guess"} {
+		err := ping(ethdb.NewRemote().Path(addr).WithToken(token).Open("", "", ""))
+		require.True(t, errors.Is(err, ethdb.ErrPrivateApiToken), "token %q: %v", token, err)
+	}
+}
+
+func TestPrivateApiUnreachable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	err = ping(ethdb.NewRemote().Path(addr).Open("", "", ""))
+	require.True(t, errors.Is(err, ethdb.ErrPrivateApiUnreachable), "%v", err)
+}
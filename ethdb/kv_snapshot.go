@@ -83,6 +83,10 @@ func (s *snapshotCursor) Count() (uint64, error) {
 	return s.dbCursor.Count()
 }
 
+func (s *SnapshotKV) Readers() []ReaderInfo {
+	return s.db.Readers()
+}
+
 func (s *SnapshotKV) AllBuckets() dbutils.BucketsCfg {
 	return s.db.AllBuckets()
 }
@@ -265,6 +269,10 @@ func (v *lazyTx) GetOne(bucket string, key []byte) (val []byte, err error) {
 	return tx.GetOne(bucket, key)
 }
 
+func (v *lazyTx) MultiGet(bucket string, keys [][]byte) ([][]byte, error) {
+	return multiGet(v, bucket, keys)
+}
+
 func (v *lazyTx) HasOne(bucket string, key []byte) (bool, error) {
 	if _, ok := v.forBuckets[bucket]; !ok {
 		return false, ErrNotSnapshotBucket
@@ -299,6 +307,17 @@ func (v *lazyTx) BucketSize(bucket string) (uint64, error) {
 	return tx.BucketSize(bucket)
 }
 
+func (v *lazyTx) BucketStat(bucket string) (*BucketStat, error) {
+	if _, ok := v.forBuckets[bucket]; !ok {
+		return &BucketStat{}, nil
+	}
+	tx, err := v.getTx()
+	if err != nil {
+		return nil, err
+	}
+	return tx.BucketStat(bucket)
+}
+
 type snapshotTX struct {
 	dbTX       Tx
 	snTX       Tx
@@ -345,6 +364,10 @@ func (s *snapshotTX) GetOne(bucket string, key []byte) (val []byte, err error) {
 	return s.snTX.GetOne(bucket, key)
 }
 
+func (s *snapshotTX) MultiGet(bucket string, keys [][]byte) ([][]byte, error) {
+	return multiGet(s, bucket, keys)
+}
+
 func (s *snapshotTX) HasOne(bucket string, key []byte) (bool, error) {
 	_, ok := s.forBuckets[bucket]
 	if !ok {
@@ -372,6 +395,25 @@ func (s *snapshotTX) BucketSize(name string) (uint64, error) {
 	return dbSize + snSize, nil
 }
 
+// BucketStat - sum of db and snapshot statistics
+func (s *snapshotTX) BucketStat(name string) (*BucketStat, error) {
+	dbStat, err := s.dbTX.BucketStat(name)
+	if err != nil {
+		return nil, fmt.Errorf("db err %w", err)
+	}
+	snStat, err := s.snTX.BucketStat(name)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot db err %w", err)
+	}
+	return &BucketStat{
+		Entries:       dbStat.Entries + snStat.Entries,
+		BranchPages:   dbStat.BranchPages + snStat.BranchPages,
+		LeafPages:     dbStat.LeafPages + snStat.LeafPages,
+		OverflowPages: dbStat.OverflowPages + snStat.OverflowPages,
+		Size:          dbStat.Size + snStat.Size,
+	}, nil
+}
+
 type snapshotCursor struct {
 	snCursor Cursor
 	dbCursor Cursor
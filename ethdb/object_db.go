@@ -20,6 +20,7 @@ package ethdb
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strings"
@@ -169,17 +170,21 @@ func (db *ObjectDatabase) Last(bucket string) ([]byte, []byte, error) {
 	return key, value, nil
 }
 
-// GetIndexChunk returns proper index chunk or return error if index is not created.
-// key must contain inverted block number in the end
+// GetIndexChunk returns serialized roaring bitmap of the history index shard which contains timestamp
+// or return error if index is not created.
 func (db *ObjectDatabase) GetIndexChunk(bucket string, key []byte, timestamp uint64) ([]byte, error) {
 	var dat []byte
 	err := db.kv.View(context.Background(), func(tx Tx) error {
+		indexKey := dbutils.CompositeKeyWithoutIncarnation(key)
+		shardKey := make([]byte, len(indexKey)+4)
+		copy(shardKey, indexKey)
+		binary.BigEndian.PutUint32(shardKey[len(indexKey):], uint32(timestamp))
 		c := tx.Cursor(bucket)
-		k, v, err := c.Seek(dbutils.IndexChunkKey(key, timestamp))
+		k, v, err := c.Seek(shardKey)
 		if err != nil {
 			return err
 		}
-		if !bytes.HasPrefix(k, dbutils.CompositeKeyWithoutIncarnation(key)) {
+		if len(k) != len(shardKey) || !bytes.HasPrefix(k, indexKey) {
 			return ErrKeyNotFound
 		}
 		dat = make([]byte, len(v))
@@ -262,6 +267,12 @@ func (db *ObjectDatabase) ClearBucketsAndCommitEvery(deleteKeysPerTx uint64, buc
 	return nil
 }
 
+func (db *ObjectDatabase) ClearBucketsIncremental(ctx context.Context, buckets ...string) error {
+	return clearBucketsIncremental(ctx, func(f func(tx Tx) error) error {
+		return db.kv.Update(ctx, f)
+	}, buckets...)
+}
+
 // removeBucketContentByMultipleTransactions - allows to avoid single large freelist record inside database and
 // avoid "too big transaction" error
 func (db *ObjectDatabase) removeBucketContentByMultipleTransactions(bucket string, deleteKeysPerTx uint64) error {
@@ -408,36 +419,18 @@ func (db *ObjectDatabase) SetKV(kv KV) {
 	db.kv = kv
 }
 
+// MemCopy - copy of the database in memory. Buckets are created by the same BucketsConfig,
+// DupSort buckets are copied without keys conversion - layout of the copy is byte-identical.
 func (db *ObjectDatabase) MemCopy() *ObjectDatabase {
-	var mem *ObjectDatabase
-	// Open the db and recover any potential corruptions
-	switch db.kv.(type) {
-	case *LmdbKV:
-		opts := db.kv.(*LmdbKV).opts
-		mem = NewObjectDatabase(NewLMDB().Set(opts).MustOpen())
+	kv, ok := db.kv.(*LmdbKV)
+	if !ok {
+		panic(fmt.Sprintf("MemCopy is not supported for %T", db.kv))
 	}
-
-	if err := db.kv.View(context.Background(), func(readTx Tx) error {
-		for _, name := range dbutils.Buckets {
-			name := name
-			if err := mem.kv.Update(context.Background(), func(writeTx Tx) error {
-				newBucketToWrite := writeTx.Cursor(name)
-				return ForEach(readTx.Cursor(name), func(k, v []byte) (bool, error) {
-					if err := newBucketToWrite.Put(common.CopyBytes(k), common.CopyBytes(v)); err != nil {
-						return false, err
-					}
-					return true, nil
-				})
-			}); err != nil {
-				return err
-			}
-		}
-		return nil
-	}); err != nil {
+	mem, err := kv.memCopy()
+	if err != nil {
 		panic(err)
 	}
-
-	return mem
+	return NewObjectDatabase(mem)
 }
 
 func (db *ObjectDatabase) NewBatch() DbWithPendingMutations {
@@ -28,11 +28,15 @@ func (s *DBServer) Size(ctx context.Context, in *remote.SizeRequest) (*remote.Si
 func (s *DBServer) BucketSize(ctx context.Context, in *remote.BucketSizeRequest) (*remote.BucketSizeReply, error) {
 	out := &remote.BucketSizeReply{}
 	if err := s.kv.View(ctx, func(tx ethdb.Tx) error {
-		sz, err := tx.BucketSize(in.BucketName)
+		st, err := tx.BucketStat(in.BucketName)
 		if err != nil {
 			return err
 		}
-		out.Size = sz
+		out.Size = st.Size
+		out.Entries = st.Entries
+		out.BranchPages = st.BranchPages
+		out.LeafPages = st.LeafPages
+		out.OverflowPages = st.OverflowPages
 		return nil
 	}); err != nil {
 		return nil, err
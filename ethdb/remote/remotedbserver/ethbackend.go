@@ -2,22 +2,25 @@ package remotedbserver
 
 import (
 	"context"
+	"errors"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core"
 	"github.com/ledgerwatch/turbo-geth/core/types"
 	"github.com/ledgerwatch/turbo-geth/ethdb/remote"
+	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/rlp"
 )
 
 type EthBackendServer struct {
 	remote.UnimplementedETHBACKENDServer // must be embedded to have forward compatible implementations.
 
-	eth core.Backend
+	eth    core.Backend
+	events *Events
 }
 
-func NewEthBackendServer(eth core.Backend) *EthBackendServer {
-	return &EthBackendServer{eth: eth}
+func NewEthBackendServer(eth core.Backend, events *Events) *EthBackendServer {
+	return &EthBackendServer{eth: eth, events: events}
 }
 
 func (s *EthBackendServer) Add(_ context.Context, in *remote.TxRequest) (*remote.AddReply, error) {
@@ -55,3 +58,43 @@ func (s *EthBackendServer) NetVersion(_ context.Context, _ *remote.NetVersionReq
 	}
 	return &remote.NetVersionReply{Id: id}, nil
 }
+
+func (s *EthBackendServer) ProtocolVersion(_ context.Context, _ *remote.ProtocolVersionRequest) (*remote.ProtocolVersionReply, error) {
+	versions := s.eth.ProtocolVersions()
+	out := &remote.ProtocolVersionReply{Versions: make([]uint32, len(versions))}
+	for i, v := range versions {
+		out.Versions[i] = uint32(v)
+	}
+	return out, nil
+}
+
+// Subscribe streams the headers of the new chain heads until the client goes away. A client which does not keep
+// up with the headers gets an error, and is expected to subscribe again
+func (s *EthBackendServer) Subscribe(_ *remote.SubscribeRequest, subscribeServer remote.ETHBACKEND_SubscribeServer) error {
+	headers, unsubscribe := s.events.AddHeaderSubscription()
+	defer unsubscribe()
+	log.Debug("Event subscription established with the RPC daemon")
+	for {
+		select {
+		case <-subscribeServer.Context().Done():
+			log.Debug("Event subscription closed by the RPC daemon")
+			return nil
+		case header, ok := <-headers:
+			if !ok {
+				return errors.New("subscriber does not keep up with the new headers")
+			}
+			enc, err := rlp.EncodeToBytes(header)
+			if err != nil {
+				return err
+			}
+			if err = subscribeServer.Send(&remote.Event{
+				Type:   remote.EventType_HEADER,
+				Hash:   header.Hash().Bytes(),
+				Number: header.Number.Uint64(),
+				Header: enc,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
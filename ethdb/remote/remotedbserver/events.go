@@ -0,0 +1,54 @@
+package remotedbserver
+
+import (
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/core/types"
+)
+
+// headersBuffer - number of the headers a subscriber may lag behind before it is dropped
+const headersBuffer = 16
+
+// Events - fan-out of the chain events to the subscribers of the ETHBACKEND service
+type Events struct {
+	lock    sync.Mutex
+	id      int
+	headers map[int]chan *types.Header
+}
+
+func NewEvents() *Events {
+	return &Events{headers: map[int]chan *types.Header{}}
+}
+
+// AddHeaderSubscription returns the channel of the new headers and the function which unsubscribes. The channel
+// is closed if the subscriber does not keep up with the headers
+func (e *Events) AddHeaderSubscription() (<-chan *types.Header, func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.id++
+	id := e.id
+	ch := make(chan *types.Header, headersBuffer)
+	e.headers[id] = ch
+	return ch, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if ch, ok := e.headers[id]; ok {
+			delete(e.headers, id)
+			close(ch)
+		}
+	}
+}
+
+// OnNewHeader sends the header of the new chain head to the subscribers
+func (e *Events) OnNewHeader(header *types.Header) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for id, ch := range e.headers {
+		select {
+		case ch <- header:
+		default:
+			delete(e.headers, id)
+			close(ch)
+		}
+	}
+}
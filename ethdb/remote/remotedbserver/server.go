@@ -1,6 +1,7 @@
 package remotedbserver
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -23,22 +24,42 @@ import (
 
 const MaxTxTTL = 30 * time.Second
 
+// Version of the KV interface: major changes break the clients, minor ones add to the interface
+const (
+	KvServiceMajor = 1
+	KvServiceMinor = 0
+	KvServicePatch = 0
+)
+
 type KvServer struct {
 	remote.UnimplementedKVServer // must be embedded to have forward compatible implementations.
 
 	kv ethdb.KV
 }
 
-func StartGrpc(kv ethdb.KV, eth core.Backend, addr string, creds *credentials.TransportCredentials) (*grpc.Server, error) {
+// StartGrpc serves the private API on addr. With the token the calls without it are rejected
+func StartGrpc(kv ethdb.KV, eth core.Backend, events *Events, addr string, creds *credentials.TransportCredentials, token string) (*grpc.Server, error) {
 	log.Info("Starting private RPC server", "on", addr)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("could not create listener: %w, addr=%s", err, addr)
 	}
 
+	grpcServer := NewGrpcServer(kv, eth, events, creds, token)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Error("private RPC server fail", "err", err)
+		}
+	}()
+
+	return grpcServer, nil
+}
+
+// NewGrpcServer - the server of the private API with all the services registered
+func NewGrpcServer(kv ethdb.KV, eth core.Backend, events *Events, creds *credentials.TransportCredentials, token string) *grpc.Server {
 	kv2Srv := NewKvServer(kv)
 	dbSrv := NewDBServer(kv)
-	ethBackendSrv := NewEthBackendServer(eth)
+	ethBackendSrv := NewEthBackendServer(eth, events)
 	var (
 		streamInterceptors []grpc.StreamServerInterceptor
 		unaryInterceptors  []grpc.UnaryServerInterceptor
@@ -49,6 +70,10 @@ func StartGrpc(kv ethdb.KV, eth core.Backend, addr string, creds *credentials.Tr
 	}
 	streamInterceptors = append(streamInterceptors, grpc_recovery.StreamServerInterceptor())
 	unaryInterceptors = append(unaryInterceptors, grpc_recovery.UnaryServerInterceptor())
+	if token != "" {
+		streamInterceptors = append(streamInterceptors, tokenStreamInterceptor(token))
+		unaryInterceptors = append(unaryInterceptors, tokenUnaryInterceptor(token))
+	}
 	var grpcServer *grpc.Server
 	cpus := uint32(runtime.GOMAXPROCS(-1))
 	opts := []grpc.ServerOption{
@@ -75,20 +100,17 @@ func StartGrpc(kv ethdb.KV, eth core.Backend, addr string, creds *credentials.Tr
 	if metrics.Enabled {
 		grpc_prometheus.Register(grpcServer)
 	}
-
-	go func() {
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Error("private RPC server fail", "err", err)
-		}
-	}()
-
-	return grpcServer, nil
+	return grpcServer
 }
 
 func NewKvServer(kv ethdb.KV) *KvServer {
 	return &KvServer{kv: kv}
 }
 
+func (s *KvServer) Version(context.Context, *remote.VersionRequest) (*remote.VersionReply, error) {
+	return &remote.VersionReply{Major: KvServiceMajor, Minor: KvServiceMinor, Patch: KvServicePatch}, nil
+}
+
 func (s *KvServer) Tx(stream remote.KV_TxServer) error {
 	tx, errBegin := s.kv.Begin(stream.Context(), nil, false)
 	if errBegin != nil {
@@ -101,9 +123,10 @@ func (s *KvServer) Tx(stream remote.KV_TxServer) error {
 
 	var CursorID uint32
 	type CursorInfo struct {
-		bucket string
-		c      ethdb.Cursor
-		k, v   []byte //fields to save current position of cursor - used when Tx reopen
+		bucket  string
+		dupSort bool // opened by OPEN_DUP_SORT
+		c       ethdb.Cursor
+		k, v    []byte //fields to save current position of cursor - used when Tx reopen
 	}
 	cursors := map[uint32]*CursorInfo{}
 
@@ -140,7 +163,11 @@ func (s *KvServer) Tx(stream remote.KV_TxServer) error {
 			}
 
 			for _, c := range cursors { // restore all cursors position
-				c.c = tx.Cursor(c.bucket)
+				if c.dupSort {
+					c.c = tx.CursorDupSort(c.bucket)
+				} else {
+					c.c = tx.Cursor(c.bucket)
+				}
 				switch casted := c.c.(type) {
 				case ethdb.CursorDupFixed:
 					k, _, err := casted.SeekBothRange(c.k, c.v)
@@ -183,11 +210,15 @@ func (s *KvServer) Tx(stream remote.KV_TxServer) error {
 		}
 
 		switch in.Op {
-		case remote.Op_OPEN:
+		case remote.Op_OPEN, remote.Op_OPEN_DUP_SORT:
 			CursorID++
-			cursors[CursorID] = &CursorInfo{
-				c: tx.Cursor(in.BucketName),
+			cInfo := &CursorInfo{bucket: in.BucketName, dupSort: in.Op == remote.Op_OPEN_DUP_SORT}
+			if cInfo.dupSort {
+				cInfo.c = tx.CursorDupSort(in.BucketName)
+			} else {
+				cInfo.c = tx.Cursor(in.BucketName)
 			}
+			cursors[CursorID] = cInfo
 			if err := stream.Send(&remote.Pair{CursorID: CursorID}); err != nil {
 				return fmt.Errorf("server-side error: %w", err)
 			}
@@ -238,16 +269,10 @@ func handleOp(c ethdb.Cursor, stream remote.KV_TxServer, in *remote.Cursor) erro
 		k, v, err = c.(ethdb.CursorDupSort).NextNoDup()
 	case remote.Op_PREV:
 		k, v, err = c.Prev()
-	//case remote.Op_PREV_DUP:
-	//	k, v, err = c.(ethdb.CursorDupSort).Prev()
-	//	if err != nil {
-	//		return err
-	//	}
-	//case remote.Op_PREV_NO_DUP:
-	//	k, v, err = c.Prev()
-	//	if err != nil {
-	//		return err
-	//	}
+	case remote.Op_PREV_DUP:
+		k, v, err = c.(ethdb.CursorDupSort).PrevDup()
+	case remote.Op_PREV_NO_DUP:
+		k, v, err = c.(ethdb.CursorDupSort).PrevNoDup()
 	case remote.Op_SEEK_EXACT:
 		v, err = c.SeekExact(in.K)
 	case remote.Op_SEEK_BOTH_EXACT:
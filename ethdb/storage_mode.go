@@ -12,6 +12,8 @@ type StorageMode struct {
 	Receipts   bool
 	TxIndex    bool
 	CallTraces bool
+	Senders2   bool
+	Blooms     bool
 }
 
 var DefaultStorageMode = StorageMode{History: true, Receipts: true, TxIndex: true, CallTraces: false}
@@ -30,6 +32,12 @@ func (m StorageMode) ToString() string {
 	if m.CallTraces {
 		modeString += "c"
 	}
+	if m.Senders2 {
+		modeString += "s"
+	}
+	if m.Blooms {
+		modeString += "b"
+	}
 	return modeString
 }
 
@@ -45,6 +53,10 @@ func StorageModeFromString(flags string) (StorageMode, error) {
 			mode.TxIndex = true
 		case 'c':
 			mode.CallTraces = true
+		case 's':
+			mode.Senders2 = true
+		case 'b':
+			mode.Blooms = true
 		default:
 			return mode, fmt.Errorf("unexpected flag found: %c", flag)
 		}
@@ -83,6 +95,18 @@ func GetStorageModeFromDB(db Database) (StorageMode, error) {
 	}
 	sm.CallTraces = len(v) == 1 && v[0] == 1
 
+	v, err = db.Get(dbutils.DatabaseInfoBucket, dbutils.StorageModeSenders2)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return StorageMode{}, err
+	}
+	sm.Senders2 = len(v) == 1 && v[0] == 1
+
+	v, err = db.Get(dbutils.DatabaseInfoBucket, dbutils.StorageModeBlooms)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return StorageMode{}, err
+	}
+	sm.Blooms = len(v) == 1 && v[0] == 1
+
 	return sm, nil
 }
 
@@ -110,6 +134,16 @@ func SetStorageModeIfNotExist(db Database, sm StorageMode) error {
 		return err
 	}
 
+	err = setModeOnEmpty(db, dbutils.StorageModeSenders2, sm.Senders2)
+	if err != nil {
+		return err
+	}
+
+	err = setModeOnEmpty(db, dbutils.StorageModeBlooms, sm.Blooms)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
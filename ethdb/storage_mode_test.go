@@ -19,10 +19,12 @@ func TestSetStorageModeIfNotExist(t *testing.T) {
 	}
 
 	err = SetStorageModeIfNotExist(db, StorageMode{
-		true,
-		true,
-		true,
-		true,
+		History:    true,
+		Receipts:   true,
+		TxIndex:    true,
+		CallTraces: true,
+		Senders2:   true,
+		Blooms:     true,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -34,10 +36,12 @@ func TestSetStorageModeIfNotExist(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(sm, StorageMode{
-		true,
-		true,
-		true,
-		true,
+		History:    true,
+		Receipts:   true,
+		TxIndex:    true,
+		CallTraces: true,
+		Senders2:   true,
+		Blooms:     true,
 	}) {
 		spew.Dump(sm)
 		t.Fatal("not equal")
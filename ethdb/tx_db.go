@@ -270,6 +270,12 @@ func ForEach(c Cursor, walker func(k, v []byte) (bool, error)) error {
 	return nil
 }
 
+// ForEachPrefetched - ForEach for sequential scans of whole bucket, the cursor reads data by batches of n,
+// see Cursor.Prefetch. Only DupFixed buckets of LMDB are read by batches, for other buckets it's same as ForEach
+func ForEachPrefetched(c Cursor, n uint, walker func(k, v []byte) (bool, error)) error {
+	return ForEach(c.Prefetch(n), walker)
+}
+
 func (m *TxDb) MultiWalk(bucket string, startkeys [][]byte, fixedbits []int, walker func(int, []byte, []byte) error) error {
 	m.panicOnEmptyDB()
 	return MultiWalk(m.cursors[bucket], startkeys, fixedbits, walker)
@@ -440,6 +446,16 @@ func (m *TxDb) ClearBucketsAndCommitEvery(deleteKeysPerTx uint64, buckets ...str
 	return nil
 }
 
+// ClearBucketsIncremental - commits the transaction after every batch, with all pending changes
+func (m *TxDb) ClearBucketsIncremental(ctx context.Context, buckets ...string) error {
+	return clearBucketsIncremental(ctx, func(f func(tx Tx) error) error {
+		if err := f(m.tx); err != nil {
+			return err
+		}
+		return m.CommitAndBegin(ctx)
+	}, buckets...)
+}
+
 func (m *TxDb) DropBucketsAndCommitEvery(deleteKeysPerTx uint64, buckets ...string) error {
 	for i := range buckets {
 		name := buckets[i]
@@ -18,6 +18,7 @@ package ethdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/ledgerwatch/turbo-geth/common/changeset"
@@ -134,3 +135,94 @@ func GetModifiedAccounts(tx Tx, startNum, endNum uint64) ([]common.Address, erro
 
 	return result, nil
 }
+
+// ModifiedStorageKey - storage slot modified in block range. Incarnation distinguishes slots of the contract
+// re-created at the same address. Key is a hash of the slot if changesets are not plain
+type ModifiedStorageKey struct {
+	Incarnation uint64
+	Key         common.Hash
+}
+
+// WalkModifiedAccountsAndStorage - calls walker for every change of account (storageKey == nil) and storage
+// in the block range [startNum, endNum]: accounts first, then storage. Changes from the plain changesets
+// when plain is true (addr is address), otherwise from hashed ones (addr is address hash).
+// Same account or key is reported as many times as it's changed, arguments are valid only during the call.
+func WalkModifiedAccountsAndStorage(tx Tx, startNum, endNum uint64, plain bool, walker func(addr []byte, incarnation uint64, storageKey []byte) error) error {
+	accountsBucket, storageBucket, addrLen := dbutils.AccountChangeSetBucket, dbutils.StorageChangeSetBucket, common.HashLength
+	if plain {
+		accountsBucket, storageBucket, addrLen = dbutils.PlainAccountChangeSetBucket, dbutils.PlainStorageChangeSetBucket, common.AddressLength
+	}
+
+	if err := walkChangeSets(tx, accountsBucket, startNum, endNum, func(v []byte) error {
+		return walkChangeSet(v, plain, false, func(k, _ []byte) error {
+			return walker(k, 0, nil)
+		})
+	}); err != nil {
+		return fmt.Errorf("iterating over account changesets: %w", err)
+	}
+
+	if err := walkChangeSets(tx, storageBucket, startNum, endNum, func(v []byte) error {
+		return walkChangeSet(v, plain, true, func(k, _ []byte) error {
+			if len(k) != addrLen+common.IncarnationLength+common.HashLength {
+				return fmt.Errorf("unexpected length of storage key: %x", k)
+			}
+			return walker(k[:addrLen], binary.BigEndian.Uint64(k[addrLen:]), k[addrLen+common.IncarnationLength:])
+		})
+	}); err != nil {
+		return fmt.Errorf("iterating over storage changesets: %w", err)
+	}
+	return nil
+}
+
+// GetModifiedAccountsAndStorage - accounts modified in the block range [startNum, endNum] and storage keys modified for each of them.
+// Map keys are addresses (or address hashes if plain is false) as strings, accounts without storage changes have empty set.
+// Result may be big for long ranges - use WalkModifiedAccountsAndStorage to process changes without collecting them
+func GetModifiedAccountsAndStorage(tx Tx, startNum, endNum uint64, plain bool) (map[string]map[ModifiedStorageKey]struct{}, error) {
+	res := make(map[string]map[ModifiedStorageKey]struct{})
+	if err := WalkModifiedAccountsAndStorage(tx, startNum, endNum, plain, func(addr []byte, incarnation uint64, storageKey []byte) error {
+		keys, ok := res[string(addr)]
+		if !ok {
+			keys = make(map[ModifiedStorageKey]struct{})
+			res[string(addr)] = keys
+		}
+		if storageKey != nil {
+			keys[ModifiedStorageKey{Incarnation: incarnation, Key: common.BytesToHash(storageKey)}] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func walkChangeSets(tx Tx, bucket string, startNum, endNum uint64, walker func(v []byte) error) error {
+	c := tx.Cursor(bucket)
+	defer c.Close()
+
+	for k, v, err := c.Seek(dbutils.EncodeTimestamp(startNum)); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		currentNum, _ := dbutils.DecodeTimestamp(k)
+		if currentNum > endNum {
+			break
+		}
+		if err = walker(v); err != nil {
+			return fmt.Errorf("changeset of block %d: %w", currentNum, err)
+		}
+	}
+	return nil
+}
+
+func walkChangeSet(v []byte, plain, storage bool, walker func(k, v []byte) error) error {
+	switch {
+	case plain && storage:
+		return changeset.StorageChangeSetPlainBytes(v).Walk(walker)
+	case plain:
+		return changeset.AccountChangeSetPlainBytes(v).Walk(walker)
+	case storage:
+		return changeset.StorageChangeSetBytes(v).Walk(walker)
+	default:
+		return changeset.AccountChangeSetBytes(v).Walk(walker)
+	}
+}
@@ -0,0 +1,81 @@
+package ethdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetModifiedAccountsAndStorage(t *testing.T) {
+	db := newTestLmdb()
+	defer db.Close()
+
+	addr1, addr2 := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	key1, key2 := common.HexToHash("0x11"), common.HexToHash("0x22")
+
+	putChangeSets := func(blockNum uint64, accounts []common.Address, storage [][]byte) {
+		accountChanges := changeset.NewAccountChangeSetPlain()
+		for _, addr := range accounts {
+			require.NoError(t, accountChanges.Add(addr[:], []byte{0x01}))
+		}
+		v, err := changeset.EncodeAccountsPlain(accountChanges)
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.PlainAccountChangeSetBucket, dbutils.EncodeTimestamp(blockNum), v))
+
+		storageChanges := changeset.NewStorageChangeSetPlain()
+		for _, k := range storage {
+			require.NoError(t, storageChanges.Add(k, []byte{0x02}))
+		}
+		v, err = changeset.EncodeStoragePlain(storageChanges)
+		require.NoError(t, err)
+		require.NoError(t, db.Put(dbutils.PlainStorageChangeSetBucket, dbutils.EncodeTimestamp(blockNum), v))
+	}
+
+	putChangeSets(1, []common.Address{addr1}, [][]byte{dbutils.PlainGenerateCompositeStorageKey(addr1, 1, key1)})
+	putChangeSets(2, nil, [][]byte{dbutils.PlainGenerateCompositeStorageKey(addr1, 1, key2)})
+	// contract re-created: same slot of the new incarnation
+	putChangeSets(3, []common.Address{addr1}, [][]byte{dbutils.PlainGenerateCompositeStorageKey(addr1, 2, key1)})
+	putChangeSets(4, []common.Address{addr2}, [][]byte{dbutils.PlainGenerateCompositeStorageKey(addr2, 1, key1)})
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	modified, err := GetModifiedAccountsAndStorage(tx, 1, 3, true)
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[ModifiedStorageKey]struct{}{
+		string(addr1[:]): {
+			{Incarnation: 1, Key: key1}: {},
+			{Incarnation: 1, Key: key2}: {},
+			{Incarnation: 2, Key: key1}: {},
+		},
+	}, modified)
+
+	modified, err = GetModifiedAccountsAndStorage(tx, 3, 4, true)
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[ModifiedStorageKey]struct{}{
+		string(addr1[:]): {{Incarnation: 2, Key: key1}: {}},
+		string(addr2[:]): {{Incarnation: 1, Key: key1}: {}},
+	}, modified)
+
+	// hashed changesets are empty
+	modified, err = GetModifiedAccountsAndStorage(tx, 1, 4, false)
+	require.NoError(t, err)
+	require.Empty(t, modified)
+
+	var accountChanges, storageChanges int
+	require.NoError(t, WalkModifiedAccountsAndStorage(tx, 0, 10, true, func(addr []byte, incarnation uint64, storageKey []byte) error {
+		if storageKey == nil {
+			accountChanges++
+		} else {
+			storageChanges++
+		}
+		return nil
+	}))
+	require.Equal(t, 3, accountChanges)
+	require.Equal(t, 4, storageChanges)
+}
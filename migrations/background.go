@@ -0,0 +1,264 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ugorji/go/codec"
+)
+
+// backgroundMigrations run after the startup, while the node works, in order of this array. Unlike migrations they
+// don't block the node, so they fit conversions of big buckets. Features which read the converted data must not be
+// enabled until the migration is done - see Feature
+var backgroundMigrations = []BackgroundMigration{
+	senders2Backfill,
+}
+
+// BackgroundMigration is resumable: Run migrates one batch in its own transaction, and the cursor it returns is
+// committed together with the batch into the dbutils.Migrations bucket. After a crash or a restart Run continues from
+// the last committed cursor, so a batch must be idempotent - it may be applied again if its commit is lost
+type BackgroundMigration interface {
+	Name() string
+	// Run migrates at most batchSize items after cursor (nil - from the beginning), returns the cursor of the next
+	// batch, the amount of migrated items and done=true when there is nothing left
+	Run(tx ethdb.Database, cursor []byte, batchSize int) (next []byte, migrated int, done bool, err error)
+}
+
+// Batches of the background migrations, and the pause between them while the node is syncing
+var (
+	backgroundBatchSize = 10_000
+	backgroundThrottle  = 5 * time.Second
+	backgroundLogEvery  = 30 * time.Second
+)
+
+var ErrBackgroundMigrationUnfinished = errors.New("background migration is not finished yet")
+
+// backgroundProgress is stored under "_progress_"+name in dbutils.Migrations until the migration is done, then
+// the name gets the usual payload of MarshalMigrationPayload
+type backgroundProgress struct {
+	Cursor   []byte
+	Migrated uint64
+}
+
+func progressKey(name string) []byte {
+	return []byte("_progress_" + name)
+}
+
+func readBackgroundProgress(db ethdb.Getter, name string) (*backgroundProgress, error) {
+	v, err := db.Get(dbutils.Migrations, progressKey(name))
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	p := &backgroundProgress{}
+	if len(v) == 0 {
+		return p, nil
+	}
+	if err := codec.NewDecoder(bytes.NewReader(v), &codec.CborHandle{}).Decode(p); err != nil {
+		return nil, fmt.Errorf("progress of the background migration %s: %w", name, err)
+	}
+	return p, nil
+}
+
+func writeBackgroundProgress(db ethdb.Putter, name string, p *backgroundProgress) error {
+	buf := bytes.NewBuffer(nil)
+	if err := codec.NewEncoder(buf, &codec.CborHandle{}).Encode(p); err != nil {
+		return err
+	}
+	return db.Put(dbutils.Migrations, progressKey(name), buf.Bytes())
+}
+
+func isBackgroundDone(db ethdb.Getter, name string) (bool, error) {
+	_, err := db.Get(dbutils.Migrations, []byte(name))
+	if errors.Is(err, ethdb.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// applyBackground runs the migration batch by batch until it's done or quit is closed. While busy() the batches are
+// throttled to give the sync the database
+func applyBackground(db ethdb.Database, m BackgroundMigration, batchSize int, quit <-chan struct{}, busy func() bool) error {
+	if done, err := isBackgroundDone(db, m.Name()); err != nil || done {
+		return err
+	}
+	logEvery := time.NewTicker(backgroundLogEvery)
+	defer logEvery.Stop()
+
+	for {
+		done, err := applyBatch(db, m, batchSize)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		pause := time.Duration(0)
+		if busy != nil && busy() {
+			pause = backgroundThrottle
+		}
+		select {
+		case <-quit:
+			return nil
+		case <-logEvery.C:
+			if p, err := readBackgroundProgress(db, m.Name()); err == nil {
+				log.Info("Background migration progress", "name", m.Name(), "migrated", p.Migrated, "cursor", hexutil.Bytes(p.Cursor))
+			}
+		case <-time.After(pause):
+		}
+	}
+}
+
+// applyBatch - one batch and its cursor in one transaction
+func applyBatch(db ethdb.Database, m BackgroundMigration, batchSize int) (bool, error) {
+	tx, err := db.Begin(context.Background(), true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	p, err := readBackgroundProgress(tx, m.Name())
+	if err != nil {
+		return false, err
+	}
+	next, migrated, done, err := m.Run(tx, p.Cursor, batchSize)
+	if err != nil {
+		return false, fmt.Errorf("background migration %s: %w", m.Name(), err)
+	}
+	p.Cursor, p.Migrated = common.CopyBytes(next), p.Migrated+uint64(migrated)
+
+	if !done {
+		if err = writeBackgroundProgress(tx, m.Name(), p); err != nil {
+			return false, err
+		}
+		_, err = tx.Commit()
+		return false, err
+	}
+
+	stagesProgress, err := MarshalMigrationPayload(tx)
+	if err != nil {
+		return false, err
+	}
+	if err = tx.Put(dbutils.Migrations, []byte(m.Name()), stagesProgress); err != nil {
+		return false, err
+	}
+	if err = tx.Delete(dbutils.Migrations, progressKey(m.Name())); err != nil {
+		return false, err
+	}
+	if _, err = tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Info("Applied background migration", "name", m.Name(), "migrated", p.Migrated)
+	return true, nil
+}
+
+// BackgroundScheduler runs the background migrations one after another in a goroutine, see BackgroundMigration
+type BackgroundScheduler struct {
+	db         ethdb.Database
+	migrations []BackgroundMigration
+	busy       func() bool
+
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBackgroundScheduler - busy tells that the node is syncing, the migrations slow down meanwhile
+func NewBackgroundScheduler(db ethdb.Database, busy func() bool) *BackgroundScheduler {
+	return &BackgroundScheduler{
+		db:         db,
+		migrations: backgroundMigrations,
+		busy:       busy,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *BackgroundScheduler) Start() {
+	go func() {
+		defer close(s.done)
+		for _, m := range s.migrations {
+			if err := applyBackground(s.db, m, backgroundBatchSize, s.quit, s.busy); err != nil {
+				// the next migrations may depend on this one, retry all of them after restart
+				log.Error("Background migration failed, it will continue after restart", "name", m.Name(), "err", err)
+				return
+			}
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+// Stop waits for the current batch to commit
+func (s *BackgroundScheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		<-s.done
+	})
+}
+
+// BackgroundMigrationStatus - progress of a background migration, as tg_migrationStatus returns it
+type BackgroundMigrationStatus struct {
+	Name     string        `json:"name"`
+	Done     bool          `json:"done"`
+	Migrated uint64        `json:"migrated"`
+	Cursor   hexutil.Bytes `json:"cursor,omitempty"`
+}
+
+// BackgroundStatus reads the progress of all background migrations from the db
+func BackgroundStatus(db ethdb.Getter) ([]BackgroundMigrationStatus, error) {
+	res := make([]BackgroundMigrationStatus, 0, len(backgroundMigrations))
+	for _, m := range backgroundMigrations {
+		done, err := isBackgroundDone(db, m.Name())
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			res = append(res, BackgroundMigrationStatus{Name: m.Name(), Done: true})
+			continue
+		}
+		p, err := readBackgroundProgress(db, m.Name())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, BackgroundMigrationStatus{Name: m.Name(), Migrated: p.Migrated, Cursor: p.Cursor})
+	}
+	return res, nil
+}
+
+// Feature which reads data converted by background migrations, it must stay disabled until they are done
+type Feature struct {
+	Name     string
+	Requires []string
+}
+
+// Check returns ErrBackgroundMigrationUnfinished if any of the required migrations is not done yet
+func (f Feature) Check(db ethdb.Getter) error {
+	var unfinished []string
+	for _, name := range f.Requires {
+		done, err := isBackgroundDone(db, name)
+		if err != nil {
+			return err
+		}
+		if !done {
+			unfinished = append(unfinished, name)
+		}
+	}
+	if len(unfinished) > 0 {
+		return fmt.Errorf("%w: %s requires %s, see tg_migrationStatus", ErrBackgroundMigrationUnfinished, f.Name, strings.Join(unfinished, ", "))
+	}
+	return nil
+}
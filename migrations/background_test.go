@@ -0,0 +1,157 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// crashingMigration fails the given batch after the migration wrote its data
+type crashingMigration struct {
+	BackgroundMigration
+	crashAt int
+}
+
+func (m *crashingMigration) Run(tx ethdb.Database, cursor []byte, batchSize int) ([]byte, int, bool, error) {
+	next, migrated, done, err := m.BackgroundMigration.Run(tx, cursor, batchSize)
+	if m.crashAt--; m.crashAt == 0 {
+		return nil, 0, false, errors.New("crash")
+	}
+	return next, migrated, done, err
+}
+
+// writeSenders - blocks [1, blocks] with i senders in the block i, the Senders stage is deep enough to backfill all
+func writeSenders(t *testing.T, db ethdb.Database, blocks uint64) {
+	for i := uint64(1); i <= blocks; i++ {
+		hash := common.Hash{byte(i)}
+		require.NoError(t, rawdb.WriteCanonicalHash(db, hash, i))
+		senders := make([]common.Address, i)
+		for j := range senders {
+			senders[j] = common.Address{byte(i), byte(j)}
+		}
+		rawdb.WriteSenders(context.Background(), db, hash, i, senders)
+	}
+	require.NoError(t, stages.SaveStageProgress(db, stages.Senders, blocks+senders2BackfillDepth, nil))
+}
+
+func senders2Copied(t *testing.T, db ethdb.Database, blockNum uint64) bool {
+	var senders []common.Address
+	require.NoError(t, db.(ethdb.HasKV).KV().View(context.Background(), func(tx ethdb.Tx) error {
+		var err error
+		senders, err = rawdb.ReadSenders2(tx, blockNum)
+		return err
+	}))
+	if senders == nil {
+		return false
+	}
+	require.Equal(t, rawdb.ReadSenders(db, common.Hash{byte(blockNum)}, blockNum), senders, "block %d", blockNum)
+	return true
+}
+
+func TestBackgroundResumeAfterCrash(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	writeSenders(t, db, 10)
+
+	err := applyBackground(db, &crashingMigration{BackgroundMigration: senders2Backfill, crashAt: 2}, 4, nil, nil)
+	require.Error(err)
+
+	p, err := readBackgroundProgress(db, senders2Backfill.Name())
+	require.NoError(err)
+	require.Equal(uint64(4), p.Migrated, "only the first batch is committed")
+	for i := uint64(1); i <= 10; i++ {
+		require.Equal(i <= 4, senders2Copied(t, db, i), "block %d", i)
+	}
+	require.True(errors.Is(FeatureSenders2.Check(db), ErrBackgroundMigrationUnfinished))
+
+	status, err := BackgroundStatus(db)
+	require.NoError(err)
+	require.Equal(BackgroundMigrationStatus{Name: senders2Backfill.Name(), Migrated: 4, Cursor: p.Cursor}, status[0])
+
+	// resume after restart
+	require.NoError(applyBackground(db, senders2Backfill, 4, nil, nil))
+	for i := uint64(1); i <= 10; i++ {
+		require.True(senders2Copied(t, db, i), "block %d", i)
+	}
+	senders2At, _, err := stages.GetStageProgress(db, stages.Senders2)
+	require.NoError(err)
+	require.Equal(uint64(10), senders2At, "the stage continues after the copied blocks")
+	require.NoError(FeatureSenders2.Check(db))
+
+	status, err = BackgroundStatus(db)
+	require.NoError(err)
+	require.Equal(BackgroundMigrationStatus{Name: senders2Backfill.Name(), Done: true}, status[0])
+
+	applied, err := AppliedMigrations(db, false)
+	require.NoError(err)
+	_, ok := applied[senders2Backfill.Name()]
+	require.True(ok)
+
+	// done migrations are not applied again
+	require.NoError(applyBackground(db, &crashingMigration{BackgroundMigration: senders2Backfill, crashAt: 1}, 4, nil, nil))
+}
+
+func TestBackgroundSchedulerStop(t *testing.T) {
+	defer func(migrations []BackgroundMigration, batchSize int, throttle time.Duration) {
+		backgroundMigrations, backgroundBatchSize, backgroundThrottle = migrations, batchSize, throttle
+	}(backgroundMigrations, backgroundBatchSize, backgroundThrottle)
+	backgroundMigrations, backgroundBatchSize, backgroundThrottle = []BackgroundMigration{senders2Backfill}, 2, time.Hour
+
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	writeSenders(t, db, 10)
+
+	// the node is syncing, so the scheduler waits after every batch
+	scheduler := NewBackgroundScheduler(db, func() bool { return true })
+	scheduler.Start()
+	require.Eventually(func() bool {
+		p, err := readBackgroundProgress(db, senders2Backfill.Name())
+		return err == nil && p.Migrated > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	scheduler.Stop()
+
+	status, err := BackgroundStatus(db)
+	require.NoError(err)
+	require.Equal(uint64(2), status[0].Migrated, "one batch before the throttle")
+	require.False(status[0].Done)
+
+	scheduler = NewBackgroundScheduler(db, func() bool { return false })
+	scheduler.Start()
+	require.Eventually(func() bool {
+		return FeatureSenders2.Check(db) == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	scheduler.Stop()
+	for i := uint64(1); i <= 10; i++ {
+		require.True(senders2Copied(t, db, i), "block %d", i)
+	}
+}
+
+func TestBackgroundMigrationNames(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	require.NoError(NewMigrator().checkUniqueNames(), "names of the migrations and the background migrations don't clash")
+
+	// the foreground migration with the name of a background one would take its done mark
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{{
+		Name: senders2Backfill.Name(),
+		Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			return OnLoadCommit(db, nil, true)
+		},
+	}}
+	err := migrator.Apply(db, "")
+	require.True(errors.Is(err, ErrMigrationNonUniqueName), "%v", err)
+	done, err := isBackgroundDone(db, senders2Backfill.Name())
+	require.NoError(err)
+	require.False(done)
+
+	require.True(errors.Is(checkUniqueNames(nil, []BackgroundMigration{senders2Backfill, senders2Backfill}), ErrMigrationNonUniqueName))
+}
@@ -0,0 +1,89 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func bucketRenameMigrations(renames []dbutils.BucketRename) []Migration {
+	res := make([]Migration, len(renames))
+	for i := range renames {
+		res[i] = bucketRenameMigration(renames[i])
+	}
+	return res
+}
+
+// bucketRenameMigration - moves data of r.Old to r.New and drops r.Old
+func bucketRenameMigration(r dbutils.BucketRename) Migration {
+	name := "rename_bucket_" + r.Old + "_to_" + r.New
+	oldEntries := int64(-1) // amount of entries in r.Old, known if the bucket was moved by this process
+	return Migration{
+		Name: name,
+		Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			if exists, err := db.(ethdb.BucketsMigrator).BucketExists(r.Old); err != nil {
+				return err
+			} else if !exists {
+				return OnLoadCommit(db, nil, true)
+			}
+
+			if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), r.New); err != nil {
+				return err
+			}
+			st, err := db.(ethdb.HasTx).Tx().BucketStat(r.Old)
+			if err != nil {
+				return err
+			}
+			oldEntries = int64(st.Entries)
+			extractFunc := func(k []byte, v []byte, next etl.ExtractNextFunc) error {
+				if r.TransformKV == nil {
+					return next(k, k, v)
+				}
+				newK, newV := r.TransformKV(k, v)
+				return next(k, newK, newV)
+			}
+			// old bucket is dropped in the same transaction in which migration is marked as applied
+			onLoadCommit := func(putter ethdb.Putter, key []byte, isDone bool) error {
+				if isDone {
+					if err := db.(ethdb.BucketsMigrator).DropBuckets(r.Old); err != nil {
+						return err
+					}
+				}
+				return OnLoadCommit(putter, key, isDone)
+			}
+
+			return etl.Transform(
+				name,
+				db,
+				r.Old,
+				r.New,
+				tmpdir,
+				extractFunc,
+				etl.IdentityLoadFunc,
+				etl.TransformArgs{OnLoadCommit: onLoadCommit},
+			)
+		},
+		// the old bucket is dropped, and without TransformKV the new one has all its entries
+		Verify: func(db ethdb.Database) error {
+			if exists, err := db.(ethdb.BucketsMigrator).BucketExists(r.Old); err != nil {
+				return err
+			} else if exists {
+				return fmt.Errorf("bucket %s is not dropped", r.Old)
+			}
+			if oldEntries < 0 || r.TransformKV != nil {
+				return nil
+			}
+			st, err := db.(ethdb.HasTx).Tx().BucketStat(r.New)
+			if err != nil {
+				return err
+			}
+			if int64(st.Entries) != oldEntries {
+				return fmt.Errorf("%d entries moved from %s, %d found in %s", oldEntries, r.Old, st.Entries, r.New)
+			}
+			return nil
+		},
+	}
+}
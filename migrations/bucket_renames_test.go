@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketRename(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	oldBucket, newBucket := dbutils.SyncStageProgressOld1, dbutils.SyncStageProgress
+
+	err := db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.(ethdb.BucketMigrator).CreateBucket(oldBucket)
+	})
+	require.NoError(err)
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put(oldBucket, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	// must be cleared by migration
+	require.NoError(db.Put(newBucket, []byte("garbage"), []byte{1}))
+
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{bucketRenameMigration(dbutils.BucketRename{
+		Old: oldBucket,
+		New: newBucket,
+		TransformKV: func(k, v []byte) ([]byte, []byte) {
+			return append([]byte("new_"), k...), v
+		},
+	})}
+	require.NoError(migrator.Apply(db, ""))
+
+	i := 0
+	err = db.Walk(newBucket, nil, 0, func(k, v []byte) (bool, error) {
+		require.Equal(fmt.Sprintf("new_key%03d", i), string(k))
+		require.Equal(fmt.Sprintf("value%d", i), string(v))
+		i++
+		return true, nil
+	})
+	require.NoError(err)
+	require.Equal(100, i)
+
+	exists, err := db.BucketExists(oldBucket)
+	require.NoError(err)
+	require.False(exists)
+	verification, err := ReadVerification(db, migrator.Migrations[0].Name)
+	require.NoError(err)
+	require.True(verification.Ok, verification.Error)
+
+	// apply twice
+	require.NoError(migrator.Apply(db, ""))
+	v, err := db.Get(newBucket, []byte("new_key042"))
+	require.NoError(err)
+	require.Equal([]byte("value42"), common.CopyBytes(v))
+}
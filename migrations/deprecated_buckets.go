@@ -0,0 +1,102 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/export"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// dropDeprecatedBucketPrefix - "drop_deprecated_bucket_"+bucket is the name of the migration which drops the bucket
+const dropDeprecatedBucketPrefix = "drop_deprecated_bucket_"
+
+// dropDeprecatedBucketMigrations - one migration for every deprecated bucket, so the data of the bucket is freed
+// on the databases which still have it as soon as the bucket is added to dbutils.DeprecatedBuckets
+func dropDeprecatedBucketMigrations(exportDir string) []Migration {
+	res := make([]Migration, len(dbutils.DeprecatedBuckets))
+	for i, bucket := range dbutils.DeprecatedBuckets {
+		res[i] = dropDeprecatedBucket(bucket, exportDir)
+	}
+	return res
+}
+
+// dropDeprecatedBucket - exports the bucket into exportDir/bucket if exportDir is not empty, then clears it in batches
+// and drops it. Interrupted migration continues the export, and the clear from the entries which are left
+func dropDeprecatedBucket(bucket string, exportDir string) Migration {
+	return Migration{
+		Name: dropDeprecatedBucketPrefix + bucket,
+		Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			if exists, err := db.(ethdb.BucketsMigrator).BucketExists(bucket); err != nil {
+				return err
+			} else if !exists {
+				return OnLoadCommit(db, nil, true)
+			}
+
+			if exportDir != "" {
+				dir := path.Join(exportDir, bucket)
+				if _, err := os.Stat(path.Join(dir, export.ManifestFile)); os.IsNotExist(err) {
+					if err = export.Buckets(context.Background(), txView{db.(ethdb.HasTx)}, dir, []string{bucket}); err != nil {
+						return fmt.Errorf("exporting %s: %w", bucket, err)
+					}
+				} else if err != nil {
+					return err
+				}
+				log.Info("Deprecated bucket is exported", "bucket", bucket, "dir", dir)
+			}
+
+			if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), bucket); err != nil {
+				return err
+			}
+			if err := db.(ethdb.BucketsMigrator).DropBuckets(bucket); err != nil {
+				return err
+			}
+			return OnLoadCommit(db, nil, true)
+		},
+		Verify: func(db ethdb.Database) error {
+			if exists, err := db.(ethdb.BucketsMigrator).BucketExists(bucket); err != nil {
+				return err
+			} else if exists {
+				return fmt.Errorf("bucket %s is not dropped", bucket)
+			}
+			return nil
+		},
+	}
+}
+
+// txView - export of the transaction of the migration, which ClearBucketsIncremental replaces after every batch
+type txView struct {
+	db ethdb.HasTx
+}
+
+func (v txView) View(_ context.Context, f func(tx ethdb.Tx) error) error {
+	return f(v.db.Tx())
+}
+
+// KeepDeprecatedBuckets - the deprecated buckets are not dropped, for the developers who still use them. Their
+// migrations stay pending, so the buckets are dropped by the first start without this option
+func (m *Migrator) KeepDeprecatedBuckets() {
+	res := m.Migrations[:0:0]
+	for _, v := range m.Migrations {
+		if !strings.HasPrefix(v.Name, dropDeprecatedBucketPrefix) {
+			res = append(res, v)
+		}
+	}
+	m.Migrations = res
+}
+
+// ExportDeprecatedBuckets - the deprecated buckets are exported into the subdirectories of dir before they are
+// dropped, see ethdb/export for the format
+func (m *Migrator) ExportDeprecatedBuckets(dir string) {
+	for i, v := range m.Migrations {
+		if strings.HasPrefix(v.Name, dropDeprecatedBucketPrefix) {
+			m.Migrations[i] = dropDeprecatedBucket(strings.TrimPrefix(v.Name, dropDeprecatedBucketPrefix), dir)
+		}
+	}
+}
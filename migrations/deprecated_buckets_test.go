@@ -0,0 +1,128 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/export"
+	"github.com/stretchr/testify/require"
+)
+
+var testDeprecatedBuckets = []string{dbutils.SyncStageProgressOld1, dbutils.SyncStageUnwindOld1}
+
+func seedDeprecatedBuckets(t *testing.T, db *ethdb.ObjectDatabase) {
+	for _, bucket := range testDeprecatedBuckets {
+		require.NoError(t, db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+			return tx.(ethdb.BucketMigrator).CreateBucket(bucket)
+		}))
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put(bucket, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))))
+		}
+	}
+}
+
+func TestDropDeprecatedBuckets(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	seedDeprecatedBuckets(t, db)
+	dir, err := ioutil.TempDir("", "tg-deprecated")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	migrator := NewMigrator()
+	migrator.Migrations = dropDeprecatedBucketMigrations("")
+	migrator.ExportDeprecatedBuckets(dir)
+	require.NoError(migrator.Apply(db, ""))
+
+	for _, bucket := range testDeprecatedBuckets {
+		exists, err := db.BucketExists(bucket)
+		require.NoError(err)
+		require.False(exists, bucket)
+		verification, err := ReadVerification(db, dropDeprecatedBucketPrefix+bucket)
+		require.NoError(err)
+		require.True(verification.Ok, verification.Error)
+
+		_, err = os.Stat(path.Join(dir, bucket, export.ManifestFile))
+		require.NoError(err, "export of %s is complete", bucket)
+	}
+
+	// the export keeps the data
+	restored := ethdb.NewMemDatabase()
+	defer restored.Close()
+	bucket := testDeprecatedBuckets[0]
+	require.NoError(restored.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.(ethdb.BucketMigrator).CreateBucket(bucket)
+	}))
+	require.NoError(export.Import(context.Background(), restored, path.Join(dir, bucket), path.Join(dir, export.ImportProgressFile), false))
+	i := 0
+	require.NoError(restored.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		require.Equal(fmt.Sprintf("key%03d", i), string(k))
+		require.Equal(fmt.Sprintf("value%d", i), string(v))
+		i++
+		return true, nil
+	}))
+	require.Equal(100, i)
+
+	// the buckets are not created again, applied migrations are skipped
+	require.NoError(migrator.Apply(db, ""))
+}
+
+func TestKeepDeprecatedBuckets(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	seedDeprecatedBuckets(t, db)
+
+	migrator := NewMigrator()
+	migrator.Migrations = dropDeprecatedBucketMigrations("")
+	migrator.KeepDeprecatedBuckets()
+	require.Equal(0, len(migrator.Migrations))
+	require.NoError(migrator.Apply(db, ""))
+
+	applied, err := AppliedMigrations(db, false)
+	require.NoError(err)
+	for _, bucket := range testDeprecatedBuckets {
+		exists, err := db.BucketExists(bucket)
+		require.NoError(err)
+		require.True(exists, bucket)
+		_, ok := applied[dropDeprecatedBucketPrefix+bucket]
+		require.False(ok, "%s stays pending", bucket)
+	}
+
+	// started without the option
+	migrator.Migrations = dropDeprecatedBucketMigrations("")
+	require.NoError(migrator.Apply(db, ""))
+	for _, bucket := range testDeprecatedBuckets {
+		exists, err := db.BucketExists(bucket)
+		require.NoError(err)
+		require.False(exists, bucket)
+	}
+}
+
+func TestDryRunKeepsDeprecatedBuckets(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	defer db.Close()
+	seedDeprecatedBuckets(t, db)
+
+	migrator := NewMigrator()
+	migrator.Migrations = dropDeprecatedBucketMigrations("")
+	reports, err := migrator.DryRun(db, "")
+	require.NoError(err)
+	require.Equal(len(migrator.Migrations), len(reports))
+
+	// the dropped buckets are back after the dry run, and their handles are usable
+	for _, bucket := range testDeprecatedBuckets {
+		exists, err := db.BucketExists(bucket)
+		require.NoError(err)
+		require.True(exists, bucket)
+		v, err := db.Get(bucket, []byte("key000"))
+		require.NoError(err)
+		require.Equal([]byte("value0"), v)
+	}
+	require.NoError(migrator.Apply(db, ""))
+}
@@ -0,0 +1,140 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// BucketChange - entries and size of a bucket before and after a migration
+type BucketChange struct {
+	EntriesBefore, EntriesAfter uint64
+	SizeBefore, SizeAfter       uint64
+}
+
+// DryRunReport - what a pending migration would do, changes of the buckets by name
+type DryRunReport struct {
+	Name         string
+	Buckets      map[string]BucketChange
+	Verification *Verification // nil if the migration has no Verify
+}
+
+// dryRunTx keeps the changes of all the migrations in one transaction, which DryRun rolls back. The methods which
+// would commit in between don't
+type dryRunTx struct {
+	*ethdb.TxDb
+}
+
+func (tx dryRunTx) CommitAndBegin(context.Context) error {
+	return nil
+}
+
+func (tx dryRunTx) Commit() (uint64, error) {
+	return 0, nil
+}
+
+func (tx dryRunTx) ClearBucketsIncremental(_ context.Context, buckets ...string) error {
+	return tx.ClearBuckets(buckets...)
+}
+
+func (tx dryRunTx) ClearBucketsAndCommitEvery(_ uint64, buckets ...string) error {
+	return tx.ClearBuckets(buckets...)
+}
+
+func (tx dryRunTx) DropBucketsAndCommitEvery(_ uint64, buckets ...string) error {
+	return tx.DropBuckets(buckets...)
+}
+
+// DryRun applies the pending migrations, reports the changes of every bucket and the result of Verify, and rolls
+// everything back. All the changes are kept in one transaction, so the database needs space for the whole migration.
+// The buckets which the migrations create or drop are reopened by the rollback, the db stays usable after DryRun
+func (m *Migrator) DryRun(db ethdb.Database, tmpdir string) ([]DryRunReport, error) {
+	if err := m.checkUniqueNames(); err != nil {
+		return nil, err
+	}
+	applied, err := AppliedMigrations(db, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dbTx, err := db.Begin(context.Background(), true)
+	if err != nil {
+		return nil, err
+	}
+	defer dbTx.Rollback()
+	txDb, ok := dbTx.(*ethdb.TxDb)
+	if !ok {
+		return nil, fmt.Errorf("dry run is not supported by %T", dbTx)
+	}
+	tx := dryRunTx{txDb}
+
+	// separate from the files of the interrupted migrations, they must survive the dry run
+	tmpdir = path.Join(tmpdir, "migrations-dry-run")
+	defer os.RemoveAll(tmpdir)
+
+	var reports []DryRunReport
+	for _, v := range m.Migrations {
+		if _, ok := applied[v.Name]; ok {
+			continue
+		}
+		before, err := bucketsStat(tx)
+		if err != nil {
+			return reports, err
+		}
+		progress, err := tx.Get(dbutils.Migrations, []byte("_progress_"+v.Name))
+		if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+			return reports, err
+		}
+
+		commitFuncCalled := false
+		if err = v.Up(tx, path.Join(tmpdir, v.Name), progress, func(_ ethdb.Putter, _ []byte, isDone bool) error {
+			commitFuncCalled = commitFuncCalled || isDone
+			return nil
+		}); err != nil {
+			return reports, fmt.Errorf("%s: %w", v.Name, err)
+		}
+		if !commitFuncCalled {
+			return reports, fmt.Errorf("%w: %s", ErrMigrationCommitNotCalled, v.Name)
+		}
+
+		after, err := bucketsStat(tx)
+		if err != nil {
+			return reports, err
+		}
+		report := DryRunReport{Name: v.Name, Buckets: map[string]BucketChange{}}
+		for name, st := range after {
+			if b := before[name]; b != st {
+				report.Buckets[name] = BucketChange{b.Entries, st.Entries, b.Size, st.Size}
+			}
+		}
+		if v.Verify != nil {
+			verification := newVerification(v.Name, v.Verify(tx))
+			report.Verification = &verification
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// bucketsStat - entries and size of all known buckets, zero for the missing ones
+func bucketsStat(db ethdb.HasTx) (map[string]ethdb.BucketStat, error) {
+	tx := db.Tx()
+	res := make(map[string]ethdb.BucketStat, len(dbutils.Buckets)+len(dbutils.DeprecatedBuckets))
+	for _, name := range append(dbutils.Buckets[:len(dbutils.Buckets):len(dbutils.Buckets)], dbutils.DeprecatedBuckets...) {
+		if !tx.(ethdb.BucketMigrator).ExistsBucket(name) {
+			res[name] = ethdb.BucketStat{}
+			continue
+		}
+		st, err := tx.BucketStat(name)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %w", name, err)
+		}
+		res[name] = *st
+	}
+	return res, nil
+}
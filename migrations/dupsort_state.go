@@ -1,6 +1,7 @@
 package migrations
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
@@ -19,7 +20,7 @@ var dupSortHashState = Migration{
 			return OnLoadCommit(db, nil, true)
 		}
 
-		if err := db.(ethdb.BucketsMigrator).ClearBuckets(dbutils.CurrentStateBucket); err != nil {
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), dbutils.CurrentStateBucket); err != nil {
 			return err
 		}
 		extractFunc := func(k []byte, v []byte, next etl.ExtractNextFunc) error {
@@ -55,7 +56,7 @@ var dupSortPlainState = Migration{
 			return OnLoadCommit(db, nil, true)
 		}
 
-		if err := db.(ethdb.BucketsMigrator).ClearBuckets(dbutils.PlainStateBucket); err != nil {
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), dbutils.PlainStateBucket); err != nil {
 			return err
 		}
 		extractFunc := func(k []byte, v []byte, next etl.ExtractNextFunc) error {
@@ -85,14 +86,14 @@ var dupSortPlainState = Migration{
 var dupSortIH = Migration{
 	Name: "dupsort_intermediate_trie_hashes",
 	Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
-		if err := db.(ethdb.BucketsMigrator).ClearBuckets(dbutils.IntermediateTrieHashBucket); err != nil {
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), dbutils.IntermediateTrieHashBucket); err != nil {
 			return err
 		}
 		buf := etl.NewSortableBuffer(etl.BufferOptimalSize)
 		comparator := db.(ethdb.HasTx).Tx().Comparator(dbutils.IntermediateTrieHashBucket)
 		buf.SetComparator(comparator)
 		collector := etl.NewCollector(tmpdir, buf)
-		hashCollector := func(keyHex []byte, hash []byte) error {
+		hashCollector := trie.HashCollectorFunc(func(keyHex []byte, hash []byte) error {
 			if len(keyHex) == 0 {
 				return nil
 			}
@@ -100,7 +101,7 @@ var dupSortIH = Migration{
 				return collector.Collect(keyHex[:trie.IHDupKeyLen], append(keyHex[trie.IHDupKeyLen:], hash...))
 			}
 			return collector.Collect(keyHex, hash)
-		}
+		})
 		loader := trie.NewFlatDBTrieLoader("dupsort_intermediate_trie_hashes", dbutils.CurrentStateBucket, dbutils.IntermediateTrieHashBucket)
 		if err := loader.Reset(trie.NewRetainList(0), hashCollector /* HashCollector */, false); err != nil {
 			return err
@@ -126,7 +127,7 @@ var dupSortIH = Migration{
 var clearIndices = Migration{
 	Name: "clear_log_indices7",
 	Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
-		if err := db.(ethdb.BucketsMigrator).ClearBuckets(dbutils.LogAddressIndex, dbutils.LogTopicIndex); err != nil {
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), dbutils.LogAddressIndex, dbutils.LogTopicIndex); err != nil {
 			return err
 		}
 
@@ -144,7 +145,7 @@ var clearIndices = Migration{
 var resetIHBucketToRecoverDB = Migration{
 	Name: "reset_in_bucket_to_recover_db",
 	Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
-		if err := db.(ethdb.BucketsMigrator).ClearBuckets(dbutils.IntermediateTrieHashBucket); err != nil {
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), dbutils.IntermediateTrieHashBucket); err != nil {
 			return err
 		}
 		if err := stages.SaveStageProgress(db, stages.IntermediateHashes, 0, nil); err != nil {
@@ -0,0 +1,117 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+)
+
+var accountsHistoryIndexToBitmap = Migration{
+	Name: "accounts_history_index_to_bitmap",
+	Up:   historyIndexToBitmap("accounts_history_index_to_bitmap", dbutils.AccountsHistoryBucketOld1, dbutils.AccountsHistoryBucket),
+}
+
+var storageHistoryIndexToBitmap = Migration{
+	Name: "storage_history_index_to_bitmap",
+	Up:   historyIndexToBitmap("storage_history_index_to_bitmap", dbutils.StorageHistoryBucketOld1, dbutils.StorageHistoryBucket),
+}
+
+// historyIndexToBitmap - converts chunks of HistoryIndexBytes (key + 8 bytes chunk number)
+// to shards of roaring bitmaps (key + 4 bytes shard number)
+func historyIndexToBitmap(name string, oldBucket string, newBucket string) func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+	return func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+		if exists, err := db.(ethdb.BucketsMigrator).BucketExists(oldBucket); err != nil {
+			return err
+		} else if !exists {
+			return OnLoadCommit(db, nil, true)
+		}
+
+		if err := db.(ethdb.BucketsMigrator).ClearBucketsIncremental(context.Background(), newBucket); err != nil {
+			return err
+		}
+
+		buf := bytes.NewBuffer(nil)
+		extractFunc := func(k []byte, v []byte, next etl.ExtractNextFunc) error {
+			blockNums, _, err := dbutils.WrapHistoryIndex(v).Decode()
+			if err != nil {
+				return fmt.Errorf("decode index chunk %x: %w", k, err)
+			}
+			bm := roaring.New()
+			for _, blockNum := range blockNums {
+				bm.Add(uint32(blockNum))
+			}
+			bm.RunOptimize()
+			buf.Reset()
+			if _, err = bm.WriteTo(buf); err != nil {
+				return err
+			}
+			// old key is kept to load chunks of the same key in ascending order
+			return next(k, k, common.CopyBytes(buf.Bytes()))
+		}
+
+		loadFunc := func(k []byte, v []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
+			indexKey := k[:len(k)-8]
+			lastShardKey := bitmapdb.ShardKey(indexKey, ^uint32(0))
+			lastShard, err := table.Get(lastShardKey)
+			if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+				return fmt.Errorf("find last shard failed: %w", err)
+			}
+
+			bm := roaring.New()
+			if _, err = bm.FromBuffer(v); err != nil {
+				return err
+			}
+			if len(lastShard) > 0 {
+				lastShardBm := roaring.New()
+				if _, err = lastShardBm.FromBuffer(common.CopyBytes(lastShard)); err != nil {
+					return fmt.Errorf("couldn't read last shard of %x: %w", indexKey, err)
+				}
+				bm.Or(lastShardBm)
+			}
+
+			shardBuf := bytes.NewBuffer(nil)
+			nextChunk := bitmapdb.ChunkIterator(bm, bitmapdb.ChunkLimit)
+			for chunk := nextChunk(); chunk != nil; chunk = nextChunk() {
+				chunk.RunOptimize()
+				shardBuf.Reset()
+				if _, err = chunk.WriteTo(shardBuf); err != nil {
+					return err
+				}
+				shardKey := lastShardKey
+				if bm.GetCardinality() > 0 { // not the last shard
+					shardKey = bitmapdb.ShardKey(indexKey, chunk.Maximum())
+				}
+				if err = next(k, shardKey, common.CopyBytes(shardBuf.Bytes())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if err := etl.Transform(
+			name,
+			db,
+			oldBucket,
+			newBucket,
+			tmpdir,
+			extractFunc,
+			loadFunc,
+			etl.TransformArgs{OnLoadCommit: OnLoadCommit},
+		); err != nil {
+			return err
+		}
+
+		if err := db.(ethdb.BucketsMigrator).DropBuckets(oldBucket); err != nil {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb/bitmapdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountsHistoryIndexToBitmap(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+
+	err := db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.(ethdb.BucketMigrator).CreateBucket(dbutils.AccountsHistoryBucketOld1)
+	})
+	require.NoError(err)
+
+	addr1 := common.HexToAddress("0x01").Bytes()
+	addr2 := common.HexToAddress("0x02").Bytes()
+	// addr1 has 2 chunks in the old format
+	var expected1 []uint32
+	index := dbutils.NewHistoryIndex()
+	for i := uint64(0); i < 10; i++ {
+		index = index.Append(i, false)
+		expected1 = append(expected1, uint32(i))
+	}
+	err = db.Put(dbutils.AccountsHistoryBucketOld1, dbutils.IndexChunkKey(addr1, 9), index)
+	require.NoError(err)
+	index = dbutils.NewHistoryIndex()
+	for i := uint64(100); i < 110; i++ {
+		index = index.Append(i, i == 105)
+		expected1 = append(expected1, uint32(i))
+	}
+	err = db.Put(dbutils.AccountsHistoryBucketOld1, dbutils.CurrentChunkKey(addr1), index)
+	require.NoError(err)
+	err = db.Put(dbutils.AccountsHistoryBucketOld1, dbutils.CurrentChunkKey(addr2), dbutils.NewHistoryIndex().Append(7, false))
+	require.NoError(err)
+
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{accountsHistoryIndexToBitmap}
+	err = migrator.Apply(db, "")
+	require.NoError(err)
+	// second application is a noop
+	err = migrator.Apply(db, "")
+	require.NoError(err)
+
+	exists, err := db.BucketExists(dbutils.AccountsHistoryBucketOld1)
+	require.NoError(err)
+	require.False(exists)
+
+	checkLastShard := func(key []byte, expected []uint32) {
+		v, err := db.Get(dbutils.AccountsHistoryBucket, bitmapdb.ShardKey(key, ^uint32(0)))
+		require.NoError(err)
+		bm := roaring.New()
+		_, err = bm.FromBuffer(v)
+		require.NoError(err)
+		require.Equal(expected, bm.ToArray())
+	}
+	checkLastShard(addr1, expected1)
+	checkLastShard(addr2, []uint32{7})
+}
+
+func TestStorageHistoryIndexToBitmap(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+
+	err := db.KV().Update(context.Background(), func(tx ethdb.Tx) error {
+		return tx.(ethdb.BucketMigrator).CreateBucket(dbutils.StorageHistoryBucketOld1)
+	})
+	require.NoError(err)
+
+	key := dbutils.PlainGenerateCompositeStorageKey(common.HexToAddress("0x01"), 1, common.HexToHash("0x02"))
+	err = db.Put(dbutils.StorageHistoryBucketOld1, dbutils.CurrentChunkKey(key), dbutils.NewHistoryIndex().Append(3, false).Append(5, true))
+	require.NoError(err)
+
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{storageHistoryIndexToBitmap}
+	err = migrator.Apply(db, "")
+	require.NoError(err)
+
+	v, err := db.Get(dbutils.StorageHistoryBucket, bitmapdb.ShardKey(dbutils.CompositeKeyWithoutIncarnation(key), ^uint32(0)))
+	require.NoError(err)
+	bm := roaring.New()
+	_, err = bm.FromBuffer(v)
+	require.NoError(err)
+	require.Equal([]uint32{3, 5}, bm.ToArray())
+}
@@ -54,6 +54,10 @@ import (
 //	},
 // - if you need migrate multiple buckets - create separate migration for each bucket
 // - write test where apply migration twice
+// - implement Verify, so the migration is not marked applied if its result is wrong
+// - to just rename bucket (maybe converting keys and values) use dbutils.BucketRenames instead
+// - buckets added to dbutils.DeprecatedBuckets are dropped by the generated migrations after all others, see KeepDeprecatedBuckets
+// - conversion of a big bucket, which would block the startup for hours, can run while the node works - see BackgroundMigration
 var migrations = []Migration{
 	stagesToUseNamedKeys,
 	unwindStagesToUseNamedKeys,
@@ -65,22 +69,30 @@ var migrations = []Migration{
 	clearIndices,
 	resetIHBucketToRecoverDB,
 	receiptsCborEncode,
+	accountsHistoryIndexToBitmap,
+	storageHistoryIndexToBitmap,
 }
 
 type Migration struct {
 	Name string
 	Up   func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommitOnLoadCommit etl.LoadCommitHandler) error
+	// Verify is optional. It checks the result of Up in the transaction which marks the migration applied - for
+	// example compares amount of records in the old and new buckets, or decodes some of the new records. Also run by
+	// `tg migrate --verify` for the applied migrations
+	Verify func(db ethdb.Database) error
 }
 
 var (
 	ErrMigrationNonUniqueName   = fmt.Errorf("please provide unique migration name")
 	ErrMigrationCommitNotCalled = fmt.Errorf("migraion commit function was not called")
 	ErrMigrationETLFilesDeleted = fmt.Errorf("db migration progress was interrupted after extraction step and ETL files was deleted, please contact development team for help or re-sync from scratch")
+	ErrMigrationVerifyFailed    = fmt.Errorf("db migration verification failed, the migration is not applied, please contact development team for help")
 )
 
 func NewMigrator() *Migrator {
+	res := append(migrations[:len(migrations):len(migrations)], bucketRenameMigrations(dbutils.BucketRenames)...)
 	return &Migrator{
-		Migrations: migrations,
+		Migrations: append(res, dropDeprecatedBucketMigrations("")...),
 	}
 }
 
@@ -91,7 +103,7 @@ type Migrator struct {
 func AppliedMigrations(db ethdb.Database, withPayload bool) (map[string][]byte, error) {
 	applied := map[string][]byte{}
 	err := db.Walk(dbutils.Migrations, nil, 0, func(k []byte, v []byte) (bool, error) {
-		if bytes.HasPrefix(k, []byte("_progress_")) {
+		if bytes.HasPrefix(k, []byte("_progress_")) || bytes.HasPrefix(k, []byte(verificationPrefix)) {
 			return true, nil
 		}
 		if withPayload {
@@ -114,14 +126,8 @@ func (m *Migrator) Apply(db ethdb.Database, tmpdir string) error {
 		return err1
 	}
 
-	// migration names must be unique, protection against people's mistake
-	uniqueNameCheck := map[string]bool{}
-	for i := range m.Migrations {
-		_, ok := uniqueNameCheck[m.Migrations[i].Name]
-		if ok {
-			return fmt.Errorf("%w, duplicate: %s", ErrMigrationNonUniqueName, m.Migrations[i].Name)
-		}
-		uniqueNameCheck[m.Migrations[i].Name] = true
+	if err := m.checkUniqueNames(); err != nil {
+		return err
 	}
 
 	tx, err1 := db.Begin(context.Background(), true)
@@ -137,6 +143,7 @@ func (m *Migrator) Apply(db ethdb.Database, tmpdir string) error {
 		}
 
 		commitFuncCalled := false // commit function must be called if no error, protection against people's mistake
+		var verifyErr error
 
 		log.Info("Apply migration", "name", v.Name)
 		progress, err := tx.Get(dbutils.Migrations, []byte("_progress_"+v.Name))
@@ -160,6 +167,15 @@ func (m *Migrator) Apply(db ethdb.Database, tmpdir string) error {
 			}
 			commitFuncCalled = true
 
+			if v.Verify != nil {
+				if verifyErr = v.Verify(tx); verifyErr != nil {
+					return fmt.Errorf("%w: %s: %v", ErrMigrationVerifyFailed, v.Name, verifyErr)
+				}
+				if err = writeVerification(tx, newVerification(v.Name, nil)); err != nil {
+					return err
+				}
+			}
+
 			stagesProgress, err := MarshalMigrationPayload(tx)
 			if err != nil {
 				return err
@@ -179,6 +195,13 @@ func (m *Migrator) Apply(db ethdb.Database, tmpdir string) error {
 			}
 			return nil
 		}); err != nil {
+			if verifyErr != nil {
+				// changes since the last commit of the migration are discarded, the failure stays for bug-reports
+				tx.Rollback()
+				if err2 := writeVerification(db, newVerification(v.Name, verifyErr)); err2 != nil {
+					log.Warn("Could not save the verification result", "name", v.Name, "err", err2)
+				}
+			}
 			return err
 		}
 
@@ -190,6 +213,30 @@ func (m *Migrator) Apply(db ethdb.Database, tmpdir string) error {
 	return nil
 }
 
+// checkUniqueNames - migration names must be unique, protection against people's mistake. The background migrations
+// keep their progress and the done mark under the same keys of dbutils.Migrations, so their names are checked too
+func (m *Migrator) checkUniqueNames() error {
+	return checkUniqueNames(m.Migrations, backgroundMigrations)
+}
+
+func checkUniqueNames(migrations []Migration, background []BackgroundMigration) error {
+	uniqueNameCheck := map[string]bool{}
+	for i := range migrations {
+		_, ok := uniqueNameCheck[migrations[i].Name]
+		if ok {
+			return fmt.Errorf("%w, duplicate: %s", ErrMigrationNonUniqueName, migrations[i].Name)
+		}
+		uniqueNameCheck[migrations[i].Name] = true
+	}
+	for _, b := range background {
+		if uniqueNameCheck[b.Name()] {
+			return fmt.Errorf("%w, duplicate: %s", ErrMigrationNonUniqueName, b.Name())
+		}
+		uniqueNameCheck[b.Name()] = true
+	}
+	return nil
+}
+
 func MarshalMigrationPayload(db ethdb.Getter) ([]byte, error) {
 	s := map[string][]byte{}
 
@@ -16,14 +16,14 @@ func TestApplyWithInit(t *testing.T) {
 	require, db := require.New(t), ethdb.NewMemDatabase()
 	migrations = []Migration{
 		{
-			"one",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "one",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				return OnLoadCommit(db, nil, true)
 			},
 		},
 		{
-			"two",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "two",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				return OnLoadCommit(db, nil, true)
 			},
 		},
@@ -55,15 +55,15 @@ func TestApplyWithoutInit(t *testing.T) {
 	require, db := require.New(t), ethdb.NewMemDatabase()
 	migrations = []Migration{
 		{
-			"one",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "one",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				t.Fatal("shouldn't been executed")
 				return nil
 			},
 		},
 		{
-			"two",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "two",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				return OnLoadCommit(db, nil, true)
 			},
 		},
@@ -98,14 +98,14 @@ func TestWhenNonFirstMigrationAlreadyApplied(t *testing.T) {
 	require, db := require.New(t), ethdb.NewMemDatabase()
 	migrations = []Migration{
 		{
-			"one",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "one",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				return OnLoadCommit(db, nil, true)
 			},
 		},
 		{
-			"two",
-			func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			Name: "two",
+			Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
 				t.Fatal("shouldn't been executed")
 				return nil
 			},
@@ -200,3 +200,109 @@ func TestCommitCallRequired(t *testing.T) {
 	require.NoError(err)
 	require.Equal(0, len(applied))
 }
+
+// toyMigration writes the keys into CodeBucket and deletes "obsolete" from it
+func toyMigration(name string, verify func(db ethdb.Database) error, keys ...string) Migration {
+	return Migration{
+		Name: name,
+		Up: func(db ethdb.Database, tmpdir string, progress []byte, OnLoadCommit etl.LoadCommitHandler) error {
+			for _, k := range keys {
+				if err := db.Put(dbutils.CodeBucket, []byte(k), []byte{1}); err != nil {
+					return err
+				}
+			}
+			if err := db.Delete(dbutils.CodeBucket, []byte("obsolete")); err != nil {
+				return err
+			}
+			return OnLoadCommit(db, nil, true)
+		},
+		Verify: verify,
+	}
+}
+
+func TestVerificationFailed(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{
+		toyMigration("one", nil, "a"),
+		toyMigration("two", func(db ethdb.Database) error {
+			return errors.New("b is wrong")
+		}, "b"),
+	}
+	err := migrator.Apply(db, "")
+	require.True(errors.Is(err, ErrMigrationVerifyFailed), "%v", err)
+
+	applied, err := AppliedMigrations(db, false)
+	require.NoError(err)
+	require.Equal(map[string][]byte{"one": {}}, applied, "failed migration is not applied")
+	_, err = db.Get(dbutils.CodeBucket, []byte("b"))
+	require.True(errors.Is(err, ethdb.ErrKeyNotFound), "changes of the failed migration are discarded")
+
+	verification, err := ReadVerification(db, "two")
+	require.NoError(err)
+	require.False(verification.Ok)
+	require.Equal("b is wrong", verification.Error)
+
+	// fixed
+	migrator.Migrations[1].Verify = func(db ethdb.Database) error {
+		_, err := db.Get(dbutils.CodeBucket, []byte("b"))
+		return err
+	}
+	require.NoError(migrator.Apply(db, ""))
+	verification, err = ReadVerification(db, "two")
+	require.NoError(err)
+	require.True(verification.Ok)
+
+	// verification of the applied migrations
+	migrator.Migrations[1].Verify = func(db ethdb.Database) error {
+		return errors.New("b is broken later")
+	}
+	res, err := migrator.Verify(db)
+	require.NoError(err)
+	require.Equal(1, len(res), "migrations without Verify are skipped")
+	require.Equal("two", res[0].Name)
+	require.False(res[0].Ok)
+	verification, err = ReadVerification(db, "two")
+	require.NoError(err)
+	require.Equal("b is broken later", verification.Error)
+}
+
+func TestDryRun(t *testing.T) {
+	require, db := require.New(t), ethdb.NewMemDatabase()
+	require.NoError(db.Put(dbutils.CodeBucket, []byte("obsolete"), []byte{1}))
+
+	migrator := NewMigrator()
+	migrator.Migrations = []Migration{
+		toyMigration("one", nil, "a", "b", "c"),
+		toyMigration("two", func(db ethdb.Database) error {
+			return errors.New("wrong")
+		}, "d"),
+	}
+	reports, err := migrator.DryRun(db, "")
+	require.NoError(err)
+	require.Equal(2, len(reports))
+
+	require.Equal("one", reports[0].Name)
+	change := reports[0].Buckets[dbutils.CodeBucket]
+	require.Equal(uint64(1), change.EntriesBefore)
+	require.Equal(uint64(3), change.EntriesAfter, "3 written, 1 deleted")
+	require.Nil(reports[0].Verification)
+
+	require.Equal("two", reports[1].Name)
+	change = reports[1].Buckets[dbutils.CodeBucket]
+	require.Equal(uint64(3), change.EntriesBefore, "changes of the previous migration are visible")
+	require.Equal(uint64(4), change.EntriesAfter)
+	require.False(reports[1].Verification.Ok)
+
+	// nothing is changed
+	applied, err := AppliedMigrations(db, false)
+	require.NoError(err)
+	require.Equal(0, len(applied))
+	_, err = db.Get(dbutils.CodeBucket, []byte("a"))
+	require.True(errors.Is(err, ethdb.ErrKeyNotFound))
+	_, err = db.Get(dbutils.CodeBucket, []byte("obsolete"))
+	require.NoError(err)
+	verification, err := ReadVerification(db, "two")
+	require.NoError(err)
+	require.Nil(verification)
+}
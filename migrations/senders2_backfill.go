@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"encoding/binary"
+
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// senders2BackfillDepth - the backfill copies senders of the blocks which are deeper than this, they are never unwound,
+// so the copy stays valid without the unwinds of the Senders2 stage
+var senders2BackfillDepth uint64 = params.FullImmutabilityThreshold
+
+// senders2Backfill copies senders of the old canonical blocks from the Senders bucket to the Senders2 bucket, so
+// storage mode `s` can be switched on for an existing database without recovering all the senders again. The Senders2
+// stage continues from the last copied block
+var senders2Backfill = senders2BackfillMigration{}
+
+// FeatureSenders2 - storage mode `s` of an existing database
+var FeatureSenders2 = Feature{Name: "storage mode s", Requires: []string{senders2Backfill.Name()}}
+
+type senders2BackfillMigration struct{}
+
+func (senders2BackfillMigration) Name() string {
+	return "senders2_backfill"
+}
+
+// Run - the cursor is the next block and the last block to copy, 8 bytes big-endian each. The last block is chosen by
+// the first batch
+func (senders2BackfillMigration) Run(db ethdb.Database, cursor []byte, batchSize int) ([]byte, int, bool, error) {
+	var from, to uint64
+	if len(cursor) == 16 {
+		from, to = binary.BigEndian.Uint64(cursor), binary.BigEndian.Uint64(cursor[8:])
+	} else {
+		sm, err := ethdb.GetStorageModeFromDB(db)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if sm.Senders2 { // the stage writes them since the genesis
+			return nil, 0, true, nil
+		}
+		sendersAt, _, err := stages.GetStageProgress(db, stages.Senders)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		senders2At, _, err := stages.GetStageProgress(db, stages.Senders2)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if sendersAt <= senders2BackfillDepth || sendersAt-senders2BackfillDepth <= senders2At {
+			return nil, 0, true, nil
+		}
+		from, to = senders2At+1, sendersAt-senders2BackfillDepth
+	}
+
+	tx := db.(ethdb.HasTx).Tx()
+	migrated := 0
+	for ; from <= to && migrated < batchSize; from++ {
+		hash, err := rawdb.ReadCanonicalHash(db, from)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if err = rawdb.WriteSenders2(tx, from, rawdb.ReadSenders(db, hash, from)); err != nil {
+			return nil, 0, false, err
+		}
+		migrated++
+	}
+	if from > to {
+		if err := stages.SaveStageProgress(db, stages.Senders2, to, nil); err != nil {
+			return nil, 0, false, err
+		}
+		return nil, migrated, true, nil
+	}
+
+	next := make([]byte, 16)
+	binary.BigEndian.PutUint64(next, from)
+	binary.BigEndian.PutUint64(next[8:], to)
+	return next, migrated, false, nil
+}
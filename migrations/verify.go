@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ugorji/go/codec"
+)
+
+// verificationPrefix - "_verify_"+name in dbutils.Migrations keeps the result of the last verification of the migration
+const verificationPrefix = "_verify_"
+
+// Verification - result of Migration.Verify
+type Verification struct {
+	Name  string
+	Ok    bool
+	Error string
+	Time  int64 // unix seconds
+}
+
+func newVerification(name string, err error) Verification {
+	v := Verification{Name: name, Ok: err == nil, Time: time.Now().Unix()}
+	if err != nil {
+		v.Error = err.Error()
+	}
+	return v
+}
+
+func writeVerification(db ethdb.Putter, v Verification) error {
+	buf := bytes.NewBuffer(nil)
+	if err := codec.NewEncoder(buf, &codec.CborHandle{}).Encode(&v); err != nil {
+		return err
+	}
+	return db.Put(dbutils.Migrations, []byte(verificationPrefix+v.Name), buf.Bytes())
+}
+
+// ReadVerification - result of the last verification of the migration, nil if it was never verified
+func ReadVerification(db ethdb.Getter, name string) (*Verification, error) {
+	data, err := db.Get(dbutils.Migrations, []byte(verificationPrefix+name))
+	if err != nil {
+		if errors.Is(err, ethdb.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	v := &Verification{}
+	if err := codec.NewDecoder(bytes.NewReader(data), &codec.CborHandle{}).Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Verify runs Verify of the applied migrations against the current state of the db and saves the results. Migrations
+// without Verify are skipped
+func (m *Migrator) Verify(db ethdb.Database) ([]Verification, error) {
+	applied, err := AppliedMigrations(db, false)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(context.Background(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var res []Verification
+	for _, v := range m.Migrations {
+		if _, ok := applied[v.Name]; !ok || v.Verify == nil {
+			continue
+		}
+		res = append(res, newVerification(v.Name, v.Verify(tx)))
+	}
+	tx.Rollback()
+
+	for _, v := range res {
+		if err := writeVerification(db, v); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -25,6 +25,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/ledgerwatch/turbo-geth/turbo/torrent"
@@ -186,6 +187,7 @@ type Config struct {
 	LMDB                 bool
 	LMDBMapSize          datasize.ByteSize
 	LMDBMaxFreelistReuse uint
+	LMDBReaderAgeLimit   time.Duration
 	SnapshotMode         torrent.SnapshotMode
 
 	// Address to listen to when launchig listener for remote database access
@@ -200,6 +202,9 @@ type Config struct {
 	TLSCertFile   string
 	TLSKeyFile    string
 	TLSCACert     string
+
+	// PrivateApiToken - when set, the clients of the private API must send it with every call
+	PrivateApiToken string
 }
 
 // IPCEndpoint resolves an IPC endpoint based on a configured value, taking into
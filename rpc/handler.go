@@ -385,7 +385,14 @@ func (h *handler) handleSubscribe(cp *callProc, msg *jsonrpcMessage) *jsonrpcMes
 
 // runMethod runs the Go callback for an RPC method.
 func (h *handler) runMethod(ctx context.Context, msg *jsonrpcMessage, callb *callback, args []reflect.Value) *jsonrpcMessage {
-	result, err := callb.call(ctx, msg.Method, args)
+	var result interface{}
+	var err error
+	if chain := h.reg.wrapped(); chain != nil {
+		ctx = context.WithValue(ctx, methodCallKey{}, &methodCall{callb: callb, args: args})
+		result, err = chain(ctx, msg.Method, msg.Params)
+	} else {
+		result, err = callb.call(ctx, msg.Method, args)
+	}
 	if err != nil {
 		return msg.errorResponse(err)
 	}
@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+)
+
+// MethodHandler executes a single method call. It returns the value which will be
+// encoded into the response and the error returned by the method.
+type MethodHandler func(ctx context.Context, method string, params json.RawMessage) (interface{}, error)
+
+// Middleware wraps the execution of method calls. Elements of a batch request pass
+// through the middleware one by one. Calls of unknown methods and calls with invalid
+// parameters are rejected before reaching the middleware.
+type Middleware func(next MethodHandler) MethodHandler
+
+// Use appends m to the middleware chain of the server. The first added middleware is
+// the outermost one. Use must be called before the server starts serving requests.
+func (s *Server) Use(m Middleware) {
+	s.services.use(m)
+}
+
+// use appends m and rebuilds the chain, so calls don't pay for wrapping
+func (r *serviceRegistry) use(m Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, m)
+	var handler MethodHandler = invokeCallback
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](handler)
+	}
+	r.chain.Store(handler)
+}
+
+// wrapped returns the middleware chain, nil if no middleware registered
+func (r *serviceRegistry) wrapped() MethodHandler {
+	handler, _ := r.chain.Load().(MethodHandler)
+	return handler
+}
+
+type methodCallKey struct{}
+
+// methodCall - callback and parsed arguments of the call, passed to the innermost handler of the chain
+type methodCall struct {
+	callb *callback
+	args  []reflect.Value
+}
+
+// invokeCallback is the innermost handler of the middleware chain
+func invokeCallback(ctx context.Context, method string, _ json.RawMessage) (interface{}, error) {
+	c := ctx.Value(methodCallKey{}).(*methodCall)
+	return c.callb.call(ctx, method, c.args)
+}
@@ -24,6 +24,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unicode"
 
 	"github.com/ledgerwatch/turbo-geth/log"
@@ -37,8 +38,10 @@ var (
 )
 
 type serviceRegistry struct {
-	mu       sync.Mutex
-	services map[string]service
+	mu          sync.Mutex
+	services    map[string]service
+	middlewares []Middleware
+	chain       atomic.Value // MethodHandler, built by use()
 }
 
 // service represents a registered object.
@@ -1,72 +1,38 @@
 package adapter
 
 import (
-	"math/big"
-
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/consensus"
+	"github.com/ledgerwatch/turbo-geth/consensus/clique"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
 	"github.com/ledgerwatch/turbo-geth/core/rawdb"
-	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/params"
-	"github.com/ledgerwatch/turbo-geth/rpc"
 )
 
 type chainContext struct {
-	db rawdb.DatabaseReader
+	db     rawdb.DatabaseReader
+	engine consensus.Engine
 }
 
-func NewChainContext(db rawdb.DatabaseReader) *chainContext {
+// NewChainContext - chain context for the replay of the blocks, engine must be the one of the chain (see NewEngine):
+// it resolves the authors of the blocks, who receive the fees
+func NewChainContext(db rawdb.DatabaseReader, engine consensus.Engine) *chainContext {
 	return &chainContext{
-		db: db,
+		db:     db,
+		engine: engine,
 	}
 }
 
-type powEngine struct {
-}
-
-func (c *powEngine) VerifyHeader(chain consensus.ChainHeaderReader, header *types.Header, seal bool) error {
-
-	panic("must not be called")
-}
-func (c *powEngine) VerifyHeaders(chain consensus.ChainHeaderReader, headers []*types.Header, seals []bool) (func(), <-chan error) {
-	panic("must not be called")
-}
-func (c *powEngine) VerifyUncles(chain consensus.ChainReader, block *types.Block) error {
-	panic("must not be called")
-}
-func (c *powEngine) VerifySeal(chain consensus.ChainHeaderReader, header *types.Header) error {
-	panic("must not be called")
-}
-func (c *powEngine) Prepare(chain consensus.ChainHeaderReader, header *types.Header) error {
-	panic("must not be called")
-}
-func (c *powEngine) Finalize(chainConfig *params.ChainConfig, header *types.Header, state *state.IntraBlockState, txs []*types.Transaction, uncles []*types.Header) {
-	panic("must not be called")
-}
-func (c *powEngine) FinalizeAndAssemble(chainConfig *params.ChainConfig, header *types.Header, state *state.IntraBlockState, txs []*types.Transaction,
-	uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
-	panic("must not be called")
-}
-func (c *powEngine) Seal(_ consensus.Cancel, chain consensus.ChainHeaderReader, block *types.Block, results chan<- consensus.ResultWithContext, stop <-chan struct{}) error {
-	panic("must not be called")
-}
-func (c *powEngine) SealHash(header *types.Header) common.Hash {
-	panic("must not be called")
-}
-func (c *powEngine) CalcDifficulty(chain consensus.ChainHeaderReader, time, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
-	panic("must not be called")
-}
-func (c *powEngine) APIs(chain consensus.ChainHeaderReader) []rpc.API {
-	panic("must not be called")
-}
-
-func (c *powEngine) Close() error {
-	panic("must not be called")
-}
-
-func (c *powEngine) Author(header *types.Header) (common.Address, error) {
-	return header.Coinbase, nil
+// NewEngine - consensus engine for the replay of the blocks of the chain. The seals of PoW blocks are not verified,
+// so it is ethash faker for them. Clique recovers the authors from the signatures, it loads the snapshots from
+// CliqueBucket, but doesn't store new ones, so db may be read-only
+func NewEngine(config *params.ChainConfig, db ethdb.Database) consensus.Engine {
+	if config.Clique != nil {
+		return clique.NewReadOnly(config.Clique, db)
+	}
+	return ethash.NewFaker()
 }
 
 func (c *chainContext) GetHeader(hash common.Hash, number uint64) *types.Header {
@@ -74,5 +40,5 @@ func (c *chainContext) GetHeader(hash common.Hash, number uint64) *types.Header
 }
 
 func (c *chainContext) Engine() consensus.Engine {
-	return &powEngine{}
+	return c.engine
 }
@@ -0,0 +1,50 @@
+package adapter
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/clique"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainContextCliqueAuthor(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Difficulty: big.NewInt(2),
+		GasLimit:   8_000_000,
+		Time:       15,
+		Extra:      make([]byte, 32+crypto.SignatureLength), // vanity and seal
+	}
+	sig, err := crypto.Sign(clique.SealHash(header).Bytes(), key)
+	require.NoError(t, err)
+	copy(header.Extra[32:], sig)
+
+	config := &params.ChainConfig{ChainID: big.NewInt(5), Clique: &params.CliqueConfig{Period: 15, Epoch: 30000}}
+	cc := NewChainContext(db, NewEngine(config, db))
+	author, err := cc.Engine().Author(header)
+	require.NoError(t, err)
+	require.Equal(t, signer, author)
+
+	// the fees of the replayed transactions go to the signer, the coinbase of clique blocks is empty
+	msg := types.NewMessage(common.Address{1}, nil, 0, uint256.NewInt(), 21000, uint256.NewInt().SetUint64(1), nil, false)
+	require.Equal(t, signer, core.NewEVMContext(msg, header, cc, nil).Coinbase)
+
+	// PoW chain
+	header.Coinbase = common.Address{2}
+	cc = NewChainContext(db, NewEngine(params.MainnetChainConfig, db))
+	require.Equal(t, common.Address{2}, core.NewEVMContext(msg, header, cc, nil).Coinbase)
+}
@@ -25,6 +25,7 @@ type StateReader struct {
 	blockNr      uint64
 	tx           ethdb.Tx
 	storage      map[common.Address]*llrb.LLRB
+	history      *state.HistoryCacheView
 }
 
 func NewStateReader(tx ethdb.Tx, blockNr uint64) *StateReader {
@@ -38,6 +39,39 @@ func NewStateReader(tx ethdb.Tx, blockNr uint64) *StateReader {
 	}
 }
 
+// SetHistoryCache - accounts and storage are read through the cache, see state.HistoryCache
+func (r *StateReader) SetHistoryCache(cache *state.HistoryCache) error {
+	view, err := cache.View(r.tx)
+	if err != nil {
+		return err
+	}
+	r.history = view
+	return nil
+}
+
+// Copy - reader of the same block over tx, which keeps the storage written by the transactions applied so far.
+// The copy starts with empty sets of reads and without the history cache
+func (r *StateReader) Copy(tx ethdb.Tx) *StateReader {
+	c := NewStateReader(tx, r.blockNr)
+	for addr, t := range r.storage {
+		ct := llrb.New()
+		t.AscendGreaterOrEqual(&storageItem{}, func(i llrb.Item) bool {
+			item := *i.(*storageItem)
+			ct.ReplaceOrInsert(&item)
+			return true
+		})
+		c.storage[addr] = ct
+	}
+	return c
+}
+
+func (r *StateReader) getAsOf(storage bool, key []byte) ([]byte, error) {
+	if r.history != nil {
+		return r.history.GetAsOf(storage, key, r.blockNr+1)
+	}
+	return state.GetAsOf(r.tx, storage, key, r.blockNr+1)
+}
+
 func (r *StateReader) GetAccountReads() [][]byte {
 	output := make([][]byte, 0)
 	for address := range r.accountReads {
@@ -66,8 +100,11 @@ func (r *StateReader) GetCodeReads() [][]byte {
 
 func (r *StateReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
 	r.accountReads[address] = struct{}{}
-	enc, err := state.GetAsOf(r.tx, false /* storage */, address[:], r.blockNr+1)
-	if err != nil || enc == nil || len(enc) == 0 {
+	enc, err := r.getAsOf(false /* storage */, address[:])
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
+	if err != nil || len(enc) == 0 {
 		return nil, nil
 	}
 	var acc accounts.Account
@@ -85,7 +122,10 @@ func (r *StateReader) ReadAccountStorage(address common.Address, incarnation uin
 	}
 	m[*key] = struct{}{}
 	compositeKey := dbutils.PlainGenerateCompositeStorageKey(address, incarnation, *key)
-	enc, err := state.GetAsOf(r.tx, true /* storage */, compositeKey, r.blockNr+1)
+	enc, err := r.getAsOf(true /* storage */, compositeKey)
+	if err != nil && !errors.Is(err, ethdb.ErrKeyNotFound) {
+		return nil, err
+	}
 	if err != nil || enc == nil {
 		return nil, nil
 	}
@@ -150,7 +190,7 @@ func (r *StateReader) ForEachStorage(addr common.Address, start []byte, cb func(
 	st := llrb.New()
 	var s [common.AddressLength + common.IncarnationLength + common.HashLength]byte
 	copy(s[:], addr[:])
-	accData, err := state.GetAsOf(r.tx, false /* storage */, addr[:], r.blockNr+1)
+	accData, err := r.getAsOf(false /* storage */, addr[:])
 	if err != nil {
 		if errors.Is(err, ethdb.ErrKeyNotFound) {
 			return fmt.Errorf("account %x not found at %d", addr, r.blockNr)
@@ -24,16 +24,20 @@ var DefaultFlags = []cli.Flag{
 	utils.TxPoolLifetimeFlag,
 	utils.TxLookupLimitFlag,
 	utils.StorageModeFlag,
+	utils.KeepDeprecatedBucketsFlag,
+	utils.ExportDeprecatedBucketsFlag,
 	utils.SnapshotModeFlag,
 	utils.BatchSizeFlag,
 	utils.DatabaseFlag,
 	utils.LMDBMapSizeFlag,
 	utils.LMDBMaxFreelistReuseFlag,
+	utils.LMDBReaderAgeLimitFlag,
 	utils.TLSFlag,
 	utils.TLSCertFlag,
 	utils.TLSKeyFlag,
 	utils.TLSCACertFlag,
 	utils.PrivateApiAddr,
+	utils.PrivateApiTokenFileFlag,
 	utils.ListenPortFlag,
 	utils.NATFlag,
 	utils.NoDiscoverFlag,
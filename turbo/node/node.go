@@ -12,6 +12,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/eth"
 	"github.com/ledgerwatch/turbo-geth/eth/stagedsync"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
 	"github.com/ledgerwatch/turbo-geth/metrics"
 	"github.com/ledgerwatch/turbo-geth/node"
@@ -83,6 +84,14 @@ func New(
 	return &TurboGethNode{stack: node, backend: ethereum}
 }
 
+// OpenChainDatabase opens the database of the node configured by the command-line flags, for the commands which
+// work with the database without running the node. Closing the returned node closes the database.
+func OpenChainDatabase(ctx *cli.Context, optionalParams Params) (*node.Node, *ethdb.ObjectDatabase) {
+	prepareBuckets(optionalParams.CustomBuckets)
+	stack := makeConfigNode(makeNodeConfig(ctx, optionalParams))
+	return stack, utils.MakeChainDatabase(ctx, stack)
+}
+
 func makeEthConfig(ctx *cli.Context, node *node.Node) *eth.Config {
 	ethConfig := &eth.DefaultConfig
 	utils.SetEthConfig(ctx, node, ethConfig)
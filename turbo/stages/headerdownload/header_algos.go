@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"container/heap"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,8 +19,14 @@ import (
 
 	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/petar/GoLLRB/llrb"
 )
 
 // Implements sort.Interface so we can sort the incoming header in the message by block height
@@ -51,6 +58,9 @@ func (hd *HeaderDownload) SplitIntoSegments(msg []*types.Header) ([]*ChainSegmen
 		if _, bad := hd.badHeaders[headerHash]; bad {
 			return nil, BadBlockPenalty, nil
 		}
+		if !hd.preverifiedMatch(header, headerHash) {
+			return nil, BadBlockPenalty, nil
+		}
 		if _, duplicate := dedupMap[headerHash]; duplicate {
 			return nil, DuplicateHeaderPenalty, nil
 		}
@@ -98,6 +108,9 @@ func (hd *HeaderDownload) SingleHeaderAsSegment(header *types.Header) ([]*ChainS
 	if _, bad := hd.badHeaders[headerHash]; bad {
 		return nil, BadBlockPenalty, nil
 	}
+	if !hd.preverifiedMatch(header, headerHash) {
+		return nil, BadBlockPenalty, nil
+	}
 	return []*ChainSegment{{Headers: []*types.Header{header}}}, NoPenalty, nil
 }
 
@@ -130,6 +143,9 @@ func (hd *HeaderDownload) InvalidateAnchors(anchorParent common.Hash, invalidAnc
 					// Invalidate the entire tree that is rooted at this anchor anchor
 					hd.anchorTree.Delete(anchor)
 					for _, anchorTipItem := range *anchor.tipQueue {
+						if tip, ok := hd.tips[anchorTipItem.hash]; ok {
+							hd.tipLimiter.Delete(&TipItem{tipHash: anchorTipItem.hash, cumulativeDifficulty: tip.cumulativeDifficulty})
+						}
 						delete(hd.tips, anchorTipItem.hash)
 						hd.tipCount--
 					}
@@ -175,13 +191,18 @@ func (hd *HeaderDownload) FindTip(segment *ChainSegment, start int) (found bool,
 // It reports first verification error, or returns the powDepth that the anchor of this
 // chain segment should have, if created
 func (hd *HeaderDownload) VerifySeals(segment *ChainSegment, anchorFound, tipFound bool, start, end int, currentTime uint64) (powDepth int, err error) {
+	// Headers at and below the highest preverified header are committed to by its hash, their seals are not verified
+	preverified := hd.findPreverified(segment, start, end)
 	if !anchorFound && !tipFound {
 		anchorHeader := segment.Headers[end-1]
-		if anchorHeader.Time > currentTime+hd.newAnchorFutureLimit {
-			return 0, fmt.Errorf("detached segment too far in the future")
-		}
-		if anchorHeader.Time+hd.newAnchorPastLimit < currentTime {
-			return 0, fmt.Errorf("detached segment too far in the past")
+		// Requested skeleton headers and preverified segments are allowed to become anchors regardless of their age
+		if _, skeleton := hd.skeletonHeights[anchorHeader.Number.Uint64()]; !skeleton && preverified == end {
+			if anchorHeader.Time > currentTime+hd.newAnchorFutureLimit {
+				return 0, ErrTooFarFuture
+			}
+			if anchorHeader.Time+hd.newAnchorPastLimit < currentTime {
+				return 0, ErrTooFarPast
+			}
 		}
 	}
 
@@ -198,10 +219,15 @@ func (hd *HeaderDownload) VerifySeals(segment *ChainSegment, anchorFound, tipFou
 			return 0, fmt.Errorf("verifySeals anchors were not found for %x", segment.Headers[start].Hash())
 		}
 	}
-	for _, header := range segment.Headers[start:end] {
+	for i, header := range segment.Headers[start:end] {
+		if start+i == preverified {
+			// Ancestors of the preverified header will not need verification either
+			powDepth = 0
+			break
+		}
 		if !anchorFound || powDepth > 0 {
 			if err := hd.verifySealFunc(header); err != nil {
-				return powDepth, err
+				return powDepth, fmt.Errorf("%w for block %d: %v", ErrInvalidSeal, header.Number.Uint64(), err)
 			}
 		}
 		if anchorFound && powDepth > 0 {
@@ -211,6 +237,28 @@ func (hd *HeaderDownload) VerifySeals(segment *ChainSegment, anchorFound, tipFou
 	return powDepth, nil
 }
 
+// preverifiedMatch returns false if the header is at the height of a preverified hash, but has a different hash
+func (hd *HeaderDownload) preverifiedMatch(header *types.Header, headerHash common.Hash) bool {
+	if preverifiedHash, ok := hd.preverifiedHashes[header.Number.Uint64()]; ok {
+		return preverifiedHash == headerHash
+	}
+	return true
+}
+
+// findPreverified returns the index of the highest preverified header within segment.Headers[start:end], or end if there is none
+func (hd *HeaderDownload) findPreverified(segment *ChainSegment, start, end int) int {
+	if len(hd.preverifiedHashes) == 0 {
+		return end
+	}
+	for i := start; i < end; i++ {
+		header := segment.Headers[i]
+		if preverifiedHash, ok := hd.preverifiedHashes[header.Number.Uint64()]; ok && preverifiedHash == header.Hash() {
+			return i
+		}
+	}
+	return end
+}
+
 // ExtendUp extends a working tree up from the tip, using given chain segment
 func (hd *HeaderDownload) ExtendUp(segment *ChainSegment, start, end int, currentTime uint64) error {
 	// Find attachment tip again
@@ -227,7 +275,7 @@ func (hd *HeaderDownload) ExtendUp(segment *ChainSegment, start, end int, curren
 			}
 			cumulativeDifficulty.Add(&cumulativeDifficulty, diff)
 			if err := hd.addHeaderAsTip(header, newAnchor, cumulativeDifficulty, currentTime); err != nil {
-				return fmt.Errorf("extendUp addHeaderAsTip for %x: %v", header.Hash(), err)
+				return fmt.Errorf("extendUp addHeaderAsTip for %x: %w", header.Hash(), err)
 			}
 		}
 	} else {
@@ -273,7 +321,11 @@ func (hd *HeaderDownload) ExtendDown(segment *ChainSegment, start, end int, powD
 			hd.anchorTree.Delete(anchor)
 			for _, tipQueueItem := range *anchor.tipQueue {
 				if tip, ok := hd.getTip(tipQueueItem.hash); ok {
+					hd.tipLimiter.Delete(&TipItem{tipHash: tipQueueItem.hash, cumulativeDifficulty: tip.cumulativeDifficulty})
 					tip.cumulativeDifficulty.Add(&tip.cumulativeDifficulty, &difficultyDifference)
+					if !tipQueueItem.hard {
+						hd.tipLimiter.ReplaceOrInsert(&TipItem{tipHash: tipQueueItem.hash, cumulativeDifficulty: tip.cumulativeDifficulty})
+					}
 					tip.anchor = newAnchor
 					heap.Push(newAnchor.tipQueue, tipQueueItem)
 					if tip.blockHeight > newAnchor.maxTipHeight {
@@ -283,6 +335,7 @@ func (hd *HeaderDownload) ExtendDown(segment *ChainSegment, start, end int, powD
 			}
 		}
 		delete(hd.anchors, anchorHeader.Hash())
+		hd.responseArrived(anchorHeader.Hash())
 		hd.anchorTree.ReplaceOrInsert(newAnchor)
 		// Add all headers in the segments as tips to this anchor
 		// Recalculate cumulative difficulty for each header
@@ -295,7 +348,7 @@ func (hd *HeaderDownload) ExtendDown(segment *ChainSegment, start, end int, powD
 			}
 			cumulativeDifficulty.Add(&cumulativeDifficulty, diff)
 			if err := hd.addHeaderAsTip(header, newAnchor, cumulativeDifficulty, currentTime); err != nil {
-				return fmt.Errorf("extendUp addHeaderAsTip for %x: %v", header.Hash(), err)
+				return fmt.Errorf("extendUp addHeaderAsTip for %x: %w", header.Hash(), err)
 			}
 		}
 		hd.requestQueue.PushFront(RequestQueueItem{anchorParent: newAnchorHeader.ParentHash, waitUntil: currentTime})
@@ -335,7 +388,11 @@ func (hd *HeaderDownload) Connect(segment *ChainSegment, start, end int, current
 		hd.anchorTree.Delete(anchor)
 		for _, tipQueueItem := range *anchor.tipQueue {
 			if tip, ok := hd.getTip(tipQueueItem.hash); ok {
+				hd.tipLimiter.Delete(&TipItem{tipHash: tipQueueItem.hash, cumulativeDifficulty: tip.cumulativeDifficulty})
 				tip.cumulativeDifficulty.Add(&tip.cumulativeDifficulty, &difficultyDifference)
+				if !tipQueueItem.hard {
+					hd.tipLimiter.ReplaceOrInsert(&TipItem{tipHash: tipQueueItem.hash, cumulativeDifficulty: tip.cumulativeDifficulty})
+				}
 				tip.anchor = newAnchor
 				heap.Push(newAnchor.tipQueue, tipQueueItem)
 				if tip.blockHeight > newAnchor.maxTipHeight {
@@ -346,6 +403,7 @@ func (hd *HeaderDownload) Connect(segment *ChainSegment, start, end int, current
 	}
 	cumulativeDifficulty := attachmentTip.cumulativeDifficulty
 	delete(hd.anchors, anchorHeader.Hash())
+	hd.responseArrived(anchorHeader.Hash())
 	hd.anchorTree.ReplaceOrInsert(newAnchor)
 	// Iterate over headers backwards (from parents towards children), to be able calculate cumulative difficulty along the way
 	for i := end - 1; i >= start; i-- {
@@ -356,7 +414,7 @@ func (hd *HeaderDownload) Connect(segment *ChainSegment, start, end int, current
 		}
 		cumulativeDifficulty.Add(&cumulativeDifficulty, diff)
 		if err := hd.addHeaderAsTip(header, newAnchor, cumulativeDifficulty, currentTime); err != nil {
-			return fmt.Errorf("extendUp addHeaderAsTip for %x: %v", header.Hash(), err)
+			return fmt.Errorf("extendUp addHeaderAsTip for %x: %w", header.Hash(), err)
 		}
 	}
 	return nil
@@ -379,9 +437,14 @@ func (hd *HeaderDownload) NewAnchor(segment *ChainSegment, start, end int, curre
 		}
 		cumulativeDifficulty.Add(&cumulativeDifficulty, diff)
 		if err = hd.addHeaderAsTip(header, anchor, cumulativeDifficulty, currentTime); err != nil {
-			return fmt.Errorf("newAnchor addHeaderAsTip for %x: %v", header.Hash(), err)
+			if anchor.tipQueue.Len() == 0 {
+				// Anchor itself was not added as a tip
+				hd.removeAnchor(anchorHeader.ParentHash, anchor)
+			}
+			return fmt.Errorf("newAnchor addHeaderAsTip for %x: %w", header.Hash(), err)
 		}
 	}
+	delete(hd.skeletonHeights, anchorHeader.Number.Uint64())
 	if anchorHeader.ParentHash != (common.Hash{}) {
 		hd.requestQueue.PushFront(RequestQueueItem{anchorParent: anchorHeader.ParentHash, waitUntil: currentTime})
 	}
@@ -400,12 +463,16 @@ func (hd *HeaderDownload) HardCodedHeader(header *types.Header, currentTime uint
 			timestamp:            header.Time,
 			blockHeight:          header.Number.Uint64(),
 			uncleHash:            header.UncleHash,
+			parentHash:           header.ParentHash,
 			difficulty:           *diff,
 		}
 		tipHash := header.Hash()
 		hd.tips[tipHash] = tip
 		_, hard := hd.hardTips[tipHash]
 		hd.tips[tipHash] = tip
+		if !hard {
+			hd.tipLimiter.ReplaceOrInsert(&TipItem{tipHash: tipHash, cumulativeDifficulty: tip.cumulativeDifficulty})
+		}
 		heap.Push(anchor.tipQueue, AnchorTipItem{hash: tipHash, height: tip.blockHeight, hard: hard})
 		hd.tipCount++
 		if tip.blockHeight > anchor.maxTipHeight {
@@ -426,18 +493,14 @@ func (hd *HeaderDownload) AddSegmentToBuffer(segment *ChainSegment, start, end i
 	if end > start {
 		fmt.Printf("Adding segment [%d-%d] to the buffer\n", segment.Headers[end-1].Number.Uint64(), segment.Headers[start].Number.Uint64())
 	}
-	var serBuffer [HeaderSerLength]byte
 	for _, header := range segment.Headers[start:end] {
-		SerialiseHeader(header, serBuffer[:])
-		hd.buffer = append(hd.buffer, serBuffer[:]...)
+		hd.buffer[header.Hash()] = header
 	}
 }
 
 func (hd *HeaderDownload) AddHeaderToBuffer(header *types.Header) {
 	fmt.Printf("Adding header %d to the buffer\n", header.Number.Uint64())
-	var serBuffer [HeaderSerLength]byte
-	SerialiseHeader(header, serBuffer[:])
-	hd.buffer = append(hd.buffer, serBuffer[:]...)
+	hd.buffer[header.Hash()] = header
 }
 
 func (hd *HeaderDownload) AnchorState() string {
@@ -540,28 +603,98 @@ func (h *Heap) Pop() interface{} {
 
 const AnchorSerLen = 32 /* ParentHash */ + 8 /* powDepth */ + 8 /* maxTipHeight */
 
-func (hd *HeaderDownload) CheckFiles() error {
-	fileInfos, err := ioutil.ReadDir(hd.filesDir)
+// headerFile is the index of a file written by FlushBuffer. The file consists of the anchor sequence and count,
+// the anchors, the headers sorted by block height and hash, and the footer with the range of block heights
+type headerFile struct {
+	name           string
+	anchorSequence uint32
+	anchorCount    int
+	minHeight      uint64
+	maxHeight      uint64
+	headerCount    int
+}
+
+func (hf *headerFile) headersOffset() int64 {
+	return 8 + int64(hf.anchorCount)*AnchorSerLen
+}
+
+// readHeaderFile reads the index of the header file, without reading anchors and headers
+func readHeaderFile(filename string) (*headerFile, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var buffer [HeaderSerLength]byte
-	var anchorBuf [AnchorSerLen]byte
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var buf [HeaderFileFooterLen]byte
+	if _, err = io.ReadFull(f, buf[:8]); err != nil {
+		return nil, fmt.Errorf("reading anchor sequence and count: %w", err)
+	}
+	hf := &headerFile{
+		name:           filename,
+		anchorSequence: binary.BigEndian.Uint32(buf[:]),
+		anchorCount:    int(binary.BigEndian.Uint32(buf[4:])),
+	}
+	if fileInfo.Size() < hf.headersOffset()+HeaderFileFooterLen {
+		return nil, fmt.Errorf("file of %d bytes is too short for %d anchors", fileInfo.Size(), hf.anchorCount)
+	}
+	if _, err = f.ReadAt(buf[:], fileInfo.Size()-HeaderFileFooterLen); err != nil {
+		return nil, fmt.Errorf("reading footer: %w", err)
+	}
+	hf.minHeight = binary.BigEndian.Uint64(buf[:])
+	hf.maxHeight = binary.BigEndian.Uint64(buf[8:])
+	hf.headerCount = int(binary.BigEndian.Uint32(buf[16:]))
+	if size := hf.headersOffset() + int64(hf.headerCount)*HeaderSerLength + HeaderFileFooterLen; size != fileInfo.Size() {
+		return nil, fmt.Errorf("file of %d bytes does not match %d anchors and %d headers", fileInfo.Size(), hf.anchorCount, hf.headerCount)
+	}
+	return hf, nil
+}
+
+// readHeaderFiles reads the indices of all header files in the directory, skipping the files that cannot be read
+func readHeaderFiles(filesDir string) ([]*headerFile, error) {
+	fileInfos, err := ioutil.ReadDir(filesDir)
+	if err != nil {
+		return nil, err
+	}
+	hfs := make([]*headerFile, 0, len(fileInfos))
 	for _, fileInfo := range fileInfos {
-		f, err1 := os.Open(path.Join(hd.filesDir, fileInfo.Name()))
+		hf, err1 := readHeaderFile(path.Join(filesDir, fileInfo.Name()))
 		if err1 != nil {
-			return fmt.Errorf("open file %s: %v", fileInfo.Name(), err1)
-		}
-		r := bufio.NewReader(f)
-		if _, err = io.ReadFull(r, anchorBuf[:8]); err != nil {
-			fmt.Printf("reading anchor sequence and count from file: %v\n", err)
+			fmt.Printf("reading header file %s: %v\n", fileInfo.Name(), err1)
 			continue
 		}
-		anchorCount := int(binary.BigEndian.Uint32((anchorBuf[4:])))
-		for i := 0; i < anchorCount; i++ {
-			if _, err = io.ReadFull(r, anchorBuf[:]); err != nil {
-				fmt.Printf("reading anchor %x from file: %v\n", i, err)
-			}
+		hfs = append(hfs, hf)
+	}
+	return hfs, nil
+}
+
+// openHeaders opens the header file and returns the reader of its headers
+func (hf *headerFile) openHeaders() (*os.File, io.Reader, error) {
+	f, err := os.Open(hf.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = f.Seek(hf.headersOffset(), io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, io.LimitReader(bufio.NewReader(f), int64(hf.headerCount)*HeaderSerLength), nil
+}
+
+func (hd *HeaderDownload) CheckFiles() error {
+	hfs, err := readHeaderFiles(hd.filesDir)
+	if err != nil {
+		return err
+	}
+	var buffer [HeaderSerLength]byte
+	for _, hf := range hfs {
+		fmt.Printf("File %s: anchor sequence %d, %d anchors, %d headers [%d-%d]\n", hf.name, hf.anchorSequence, hf.anchorCount, hf.headerCount, hf.minHeight, hf.maxHeight)
+		f, r, err1 := hf.openHeaders()
+		if err1 != nil {
+			return fmt.Errorf("open file %s: %v", hf.name, err1)
 		}
 		for {
 			var header types.Header
@@ -572,8 +705,9 @@ func (hd *HeaderDownload) CheckFiles() error {
 				break
 			}
 			DeserialiseHeader(&header, buffer[:])
-			fmt.Printf("Read header %d from file %s\n", header.Number.Uint64(), fileInfo.Name())
+			fmt.Printf("Read header %d from file %s\n", header.Number.Uint64(), hf.name)
 		}
+		f.Close()
 	}
 	return nil
 }
@@ -603,83 +737,129 @@ func (hd *HeaderDownload) InitHardCodedTips(filename string) {
 	}
 }
 
+// PreverifiedSerLength is the length of the record in the file of preverified hashes: block height followed by the hash
+const PreverifiedSerLength = 8 + 32
+
+// ReadPreverifiedHashes reads the mapping of block heights to preverified hashes from the file, to be passed to NewHeaderDownload
+func ReadPreverifiedHashes(filename string) (map[uint64]common.Hash, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	preverifiedHashes := make(map[uint64]common.Hash)
+	var buf [PreverifiedSerLength]byte
+	for {
+		if _, err = io.ReadFull(f, buf[:]); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading preverified hash %d: %w", len(preverifiedHashes), err)
+		}
+		preverifiedHashes[binary.BigEndian.Uint64(buf[:])] = common.BytesToHash(buf[8:])
+	}
+	return preverifiedHashes, nil
+}
+
+// readAnchors reads the anchors recorded in the header file
+func (hd *HeaderDownload) readAnchors(hf *headerFile) (map[common.Hash]*Anchor, error) {
+	f, err := os.Open(hf.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, err = r.Discard(8); err != nil {
+		return nil, err
+	}
+	var anchorBuf [AnchorSerLen]byte
+	var anchors = make(map[common.Hash]*Anchor)
+	for i := 0; i < hf.anchorCount; i++ {
+		if _, err = io.ReadFull(r, anchorBuf[:]); err != nil {
+			return nil, fmt.Errorf("reading anchor %d: %w", i, err)
+		}
+		anchor := &Anchor{tipQueue: &AnchorTipQueue{}, anchorID: hd.nextAnchorID}
+		hd.nextAnchorID++
+		heap.Init(anchor.tipQueue)
+		pos := 0
+		copy(anchor.hash[:], anchorBuf[pos:])
+		pos += 32
+		anchor.powDepth = int(binary.BigEndian.Uint64(anchorBuf[pos:]))
+		pos += 8
+		anchor.maxTipHeight = binary.BigEndian.Uint64(anchorBuf[pos:])
+		anchors[anchor.hash] = anchor
+		fmt.Printf("anchor: %x, powDepth: %d, maxTipHeight %d\n", anchor.hash, anchor.powDepth, anchor.maxTipHeight)
+	}
+	return anchors, nil
+}
+
 func (hd *HeaderDownload) RecoverFromFiles(currentTime uint64) (bool, error) {
-	fileInfos, err := ioutil.ReadDir(hd.filesDir)
+	hfs, err := readHeaderFiles(hd.filesDir)
 	if err != nil {
 		return false, err
 	}
+	// Only the file with the latest anchor sequence has the relevant information about the anchors
+	hd.anchorSequence = 0
+	var lastAnchors = make(map[common.Hash]*Anchor)
+	var lastFile *headerFile
+	for _, hf := range hfs {
+		if lastFile == nil || hf.anchorSequence > lastFile.anchorSequence {
+			lastFile = hf
+		}
+	}
+	if lastFile != nil {
+		fmt.Printf("Reading anchor sequence %d, anchor count: %d\n", lastFile.anchorSequence, lastFile.anchorCount)
+		if lastAnchors, err = hd.readAnchors(lastFile); err != nil {
+			return false, fmt.Errorf("read anchors from %s: %w", lastFile.name, err)
+		}
+		hd.anchorSequence = lastFile.anchorSequence + 1
+	}
+	// Files are opened in the order of their lowest block heights, once the merge reaches these heights,
+	// so that only the files with relevant headers are open at any time. Files without headers are skipped
+	var withHeaders []*headerFile
+	for _, hf := range hfs {
+		if hf.headerCount > 0 {
+			withHeaders = append(withHeaders, hf)
+		}
+	}
+	sort.Slice(withHeaders, func(i, j int) bool { return withHeaders[i].minHeight < withHeaders[j].minHeight })
 	h := &Heap{}
 	heap.Init(h)
 	var buffer [HeaderSerLength]byte
-	var anchorBuf [AnchorSerLen]byte
-	//nolint:prealloc
-	var fs []*os.File
-	//nolint:prealloc
-	var rs []io.Reader
-	// Open all files and only read anchor sequences to decide which one has the latest information about the anchors
-	hd.anchorSequence = 0
-	var lastAnchors = make(map[common.Hash]*Anchor)
-	for _, fileInfo := range fileInfos {
-		f, err1 := os.Open(path.Join(hd.filesDir, fileInfo.Name()))
+	nextFile := 0
+	openNextFile := func() error {
+		hf := withHeaders[nextFile]
+		nextFile++
+		f, r, err1 := hf.openHeaders()
 		if err1 != nil {
-			return false, fmt.Errorf("open file %s: %v", fileInfo.Name(), err1)
-		}
-		r := bufio.NewReader(f)
-		if _, err = io.ReadFull(r, anchorBuf[:8]); err != nil {
-			fmt.Printf("reading anchor sequence and count from file: %v\n", err)
-			continue
+			return fmt.Errorf("open file %s: %w", hf.name, err1)
 		}
-		anchorSequence := binary.BigEndian.Uint32(anchorBuf[:])
-		anchorCount := int(binary.BigEndian.Uint32((anchorBuf[4:])))
-		var anchors = make(map[common.Hash]*Anchor)
-		if anchorSequence >= hd.anchorSequence {
-			fmt.Printf("Reading anchor sequence %d, anchor count: %d\n", anchorSequence, anchorCount)
-		}
-		for i := 0; i < anchorCount; i++ {
-			if _, err = io.ReadFull(r, anchorBuf[:]); err != nil {
-				fmt.Printf("reading anchor %x from file: %v\n", i, err)
-			}
-			if anchorSequence >= hd.anchorSequence { // Don't bother with parsing if we are not going to use this info
-				anchor := &Anchor{tipQueue: &AnchorTipQueue{}, anchorID: hd.nextAnchorID}
-				hd.nextAnchorID++
-				heap.Init(anchor.tipQueue)
-				pos := 0
-				copy(anchor.hash[:], anchorBuf[pos:])
-				pos += 32
-				anchor.powDepth = int(binary.BigEndian.Uint64(anchorBuf[pos:]))
-				pos += 8
-				anchor.maxTipHeight = binary.BigEndian.Uint64(anchorBuf[pos:])
-				anchors[anchor.hash] = anchor
-				fmt.Printf("anchor: %x, powDepth: %d, maxTipHeight %d\n", anchor.hash, anchor.powDepth, anchor.maxTipHeight)
-			}
-		}
-		if anchorSequence >= hd.anchorSequence {
-			hd.anchorSequence = anchorSequence + 1
-			lastAnchors = anchors
-		}
-		fs = append(fs, f)
-		rs = append(rs, r)
-	}
-	for i, f := range fs {
-		r := rs[i]
 		var header types.Header
-		if _, err = io.ReadFull(r, buffer[:]); err != nil {
-			if !errors.Is(err, io.EOF) {
-				fmt.Printf("reading header from file: %v\n", err)
-			}
-			continue
+		if _, err1 = io.ReadFull(r, buffer[:]); err1 != nil {
+			f.Close()
+			return fmt.Errorf("reading header from file %s: %w", hf.name, err1)
 		}
 		DeserialiseHeader(&header, buffer[:])
-		he := HeapElem{file: f, reader: r, blockHeight: header.Number.Uint64(), hash: header.Hash(), header: &header}
-		heap.Push(h, he)
+		heap.Push(h, HeapElem{file: f, reader: r, blockHeight: header.Number.Uint64(), hash: header.Hash(), header: &header})
+		return nil
 	}
+	defer func() {
+		// Close the files left open if the recovery fails
+		for _, he := range *h {
+			he.file.Close()
+		}
+	}()
 	var prevHeight uint64
 	var parentAnchors = make(map[common.Hash]*Anchor)
 	var parentDiffs = make(map[common.Hash]*uint256.Int)
 	var childAnchors = make(map[common.Hash]*Anchor)
 	var childDiffs = make(map[common.Hash]*uint256.Int)
 	var prevHash common.Hash // Hash of previously seen header - to filter out potential duplicates
-	for h.Len() > 0 {
+	for h.Len() > 0 || nextFile < len(withHeaders) {
+		for nextFile < len(withHeaders) && (h.Len() == 0 || withHeaders[nextFile].minHeight <= (*h)[0].blockHeight) {
+			if err = openNextFile(); err != nil {
+				return false, err
+			}
+		}
 		he := (heap.Pop(h)).(HeapElem)
 		hash := he.header.Hash()
 		if hash != prevHash {
@@ -705,11 +885,12 @@ func (hd *HeaderDownload) RecoverFromFiles(currentTime uint64) (bool, error) {
 			if parentAnchor, found := parentAnchors[parentHash]; found {
 				parentDiff := parentDiffs[parentHash]
 				cumulativeDiff.Add(cumulativeDiff, parentDiff)
-				if err = hd.addHeaderAsTip(he.header, parentAnchor, *cumulativeDiff, currentTime); err != nil {
-					return false, fmt.Errorf("add header as tip: %v", err)
+				if err = hd.addHeaderAsTip(he.header, parentAnchor, *cumulativeDiff, currentTime); err == nil {
+					childAnchors[hash] = parentAnchor
+					childDiffs[hash] = cumulativeDiff
+				} else if !errors.Is(err, ErrTipBelowLimit) {
+					return false, fmt.Errorf("add header as tip: %w", err)
 				}
-				childAnchors[hash] = parentAnchor
-				childDiffs[hash] = cumulativeDiff
 			} else {
 				anchor, anchorExisted := lastAnchors[hash]
 				if !anchorExisted {
@@ -725,17 +906,18 @@ func (hd *HeaderDownload) RecoverFromFiles(currentTime uint64) (bool, error) {
 				anchor.difficulty = *diff
 				anchor.timestamp = he.header.Time
 				anchor.blockHeight = he.header.Number.Uint64()
-				if err = hd.addHeaderAsTip(he.header, anchor, *cumulativeDiff, currentTime); err != nil {
-					return false, fmt.Errorf("add header as tip: %v", err)
-				}
-				if len(hd.anchors[parentHash]) == 0 {
-					if parentHash != (common.Hash{}) {
-						hd.requestQueue.PushFront(RequestQueueItem{anchorParent: parentHash, waitUntil: currentTime})
+				if err = hd.addHeaderAsTip(he.header, anchor, *cumulativeDiff, currentTime); err == nil {
+					if len(hd.anchors[parentHash]) == 0 {
+						if parentHash != (common.Hash{}) {
+							hd.requestQueue.PushFront(RequestQueueItem{anchorParent: parentHash, waitUntil: currentTime})
+						}
 					}
+					hd.anchors[parentHash] = append(hd.anchors[parentHash], anchor)
+					childAnchors[hash] = anchor
+					childDiffs[hash] = cumulativeDiff
+				} else if !errors.Is(err, ErrTipBelowLimit) {
+					return false, fmt.Errorf("add header as tip: %w", err)
 				}
-				hd.anchors[parentHash] = append(hd.anchors[parentHash], anchor)
-				childAnchors[hash] = anchor
-				childDiffs[hash] = cumulativeDiff
 			}
 			prevHash = hash
 		} else {
@@ -760,6 +942,9 @@ func (hd *HeaderDownload) RecoverFromFiles(currentTime uint64) (bool, error) {
 	return hd.anchorSequence > 0, nil
 }
 
+// RequestMoreHeaders returns requests for the anchor parents whose time has come. There is only one outstanding request
+// per anchor parent: the request is repeated after timeout if there is no response, and the delay is doubled with
+// every attempt, up to maxRequestBackoff
 func (hd *HeaderDownload) RequestMoreHeaders(currentTime, timeout uint64) []*HeaderRequest {
 	if hd.requestQueue.Len() == 0 {
 		return nil
@@ -769,16 +954,120 @@ func (hd *HeaderDownload) RequestMoreHeaders(currentTime, timeout uint64) []*Hea
 	for peek := hd.requestQueue.Front(); peek != nil && peek.Value.(RequestQueueItem).waitUntil <= currentTime; peek = hd.requestQueue.Front() {
 		hd.requestQueue.Remove(peek)
 		item := peek.Value.(RequestQueueItem)
-		if anchors, present := hd.anchors[item.anchorParent]; present {
-			// Anchor still exists after the timeout
-			requests = append(requests, &HeaderRequest{Hash: item.anchorParent, Number: anchors[0].blockHeight - 1, Length: 192})
-			hd.requestQueue.PushBack(RequestQueueItem{anchorParent: item.anchorParent, waitUntil: currentTime + timeout})
+		anchors, present := hd.anchors[item.anchorParent]
+		if !present {
+			delete(hd.anchorRequests, item.anchorParent)
+			continue
 		}
+		// Anchor still exists after the timeout
+		req, ok := hd.anchorRequests[item.anchorParent]
+		if !ok {
+			req = &AnchorRequest{}
+			hd.anchorRequests[item.anchorParent] = req
+		}
+		if req.outstanding && req.nextRequest > currentTime {
+			// Duplicate queue item, the repeated request is already scheduled
+			continue
+		}
+		requests = append(requests, hd.anchorParentRequest(item.anchorParent, anchors[0].blockHeight))
+		req.attempts++
+		req.lastRequest = currentTime
+		req.nextRequest = currentTime + hd.requestBackoff(req.attempts, timeout)
+		req.outstanding = true
+		hd.scheduleRequest(RequestQueueItem{anchorParent: item.anchorParent, waitUntil: req.nextRequest})
 	}
 	hd.resetRequestQueueTimer(prevTopTime, currentTime)
 	return requests
 }
 
+// anchorParentRequest requests headers down from the anchor parent. If the gap below the anchor is longer than
+// skeletonThreshold, it requests a skeleton - every MaxHeadersPerRequest-th header, to be filled in afterwards
+func (hd *HeaderDownload) anchorParentRequest(anchorParent common.Hash, anchorHeight uint64) *HeaderRequest {
+	req := &HeaderRequest{Hash: anchorParent, Number: anchorHeight - 1, Amount: MaxHeadersPerRequest, Reverse: true}
+	if hd.skeletonThreshold == 0 {
+		return req
+	}
+	gap := anchorHeight - hd.highestTipBelow(anchorHeight)
+	if gap <= hd.skeletonThreshold || gap < 2*MaxHeadersPerRequest {
+		return req
+	}
+	req.Skip = MaxHeadersPerRequest - 1
+	req.Amount = int(gap / MaxHeadersPerRequest)
+	if req.Amount > MaxHeadersPerRequest {
+		req.Amount = MaxHeadersPerRequest
+	}
+	// First header is the anchor parent itself, it extends the anchor down
+	for i := 1; i < req.Amount; i++ {
+		hd.skeletonHeights[req.Number-uint64(i)*MaxHeadersPerRequest] = struct{}{}
+	}
+	return req
+}
+
+// highestTipBelow returns the highest block height of the tips below the given height, or 0
+func (hd *HeaderDownload) highestTipBelow(height uint64) uint64 {
+	var highest uint64
+	for _, anchors := range hd.anchors {
+		for _, anchor := range anchors {
+			if anchor.maxTipHeight < height && anchor.maxTipHeight > highest {
+				highest = anchor.maxTipHeight
+			}
+		}
+	}
+	return highest
+}
+
+// SetSkeletonThreshold enables skeleton requests for the gaps below anchors longer than threshold, 0 disables them
+func (hd *HeaderDownload) SetSkeletonThreshold(threshold uint64) {
+	hd.skeletonThreshold = threshold
+}
+
+// requestBackoff is the delay before repeating the request after given number of attempts
+func (hd *HeaderDownload) requestBackoff(attempts int, timeout uint64) uint64 {
+	backoff := timeout
+	for i := 1; i < attempts && backoff < hd.maxRequestBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > hd.maxRequestBackoff {
+		backoff = hd.maxRequestBackoff
+	}
+	return backoff
+}
+
+// scheduleRequest inserts the item into the request queue, keeping it sorted by waitUntil
+func (hd *HeaderDownload) scheduleRequest(item RequestQueueItem) {
+	for e := hd.requestQueue.Back(); e != nil; e = e.Prev() {
+		if e.Value.(RequestQueueItem).waitUntil <= item.waitUntil {
+			hd.requestQueue.InsertAfter(item, e)
+			return
+		}
+	}
+	hd.requestQueue.PushFront(item)
+}
+
+// SetMaxRequestBackoff sets the maximum delay (in seconds) between repeated requests for the same anchor parent
+func (hd *HeaderDownload) SetMaxRequestBackoff(maxRequestBackoff uint64) {
+	hd.maxRequestBackoff = maxRequestBackoff
+}
+
+// responseArrived clears the request state of the anchor parent, once a segment extending its anchors arrives
+func (hd *HeaderDownload) responseArrived(anchorParent common.Hash) {
+	delete(hd.anchorRequests, anchorParent)
+}
+
+// Stats returns the number of anchors, tips and outstanding requests
+func (hd *HeaderDownload) Stats() Stats {
+	stats := Stats{Tips: len(hd.tips)}
+	for _, anchors := range hd.anchors {
+		stats.Anchors += len(anchors)
+	}
+	for _, req := range hd.anchorRequests {
+		if req.outstanding {
+			stats.OutstandingRequests++
+		}
+	}
+	return stats
+}
+
 func (hd *HeaderDownload) resetRequestQueueTimer(prevTopTime, currentTime uint64) {
 	var nextTopTime uint64
 	if hd.requestQueue.Len() > 0 {
@@ -795,56 +1084,264 @@ func (hd *HeaderDownload) resetRequestQueueTimer(prevTopTime, currentTime uint64
 	hd.RequestQueueTimer = time.NewTimer(time.Duration(nextTopTime-currentTime) * time.Second)
 }
 
-func (hd *HeaderDownload) FlushBuffer() error {
-	if len(hd.buffer) < hd.bufferLimit {
+// writeHeaderFile writes the current anchors and given headers (sorted by block height and hash) into a new file
+func (hd *HeaderDownload) writeHeaderFile(headers []*types.Header) error {
+	bufferFile, err := ioutil.TempFile(hd.filesDir, "headers-buf")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(bufferFile)
+	// First write the anchors
+	var buf [HeaderSerLength]byte
+	binary.BigEndian.PutUint32(buf[:], hd.anchorSequence)
+	anchorCount := 0
+	for _, anchors := range hd.anchors {
+		anchorCount += len(anchors)
+	}
+	binary.BigEndian.PutUint32(buf[4:], uint32(anchorCount))
+	if _, err = w.Write(buf[:8]); err != nil {
+		bufferFile.Close()
+		return err
+	}
+	for _, anchors := range hd.anchors {
+		for _, anchor := range anchors {
+			pos := 0
+			copy(buf[pos:], anchor.hash[:])
+			pos += 32
+			binary.BigEndian.PutUint64(buf[pos:], uint64(anchor.powDepth))
+			pos += 8
+			binary.BigEndian.PutUint64(buf[pos:], anchor.maxTipHeight)
+			if _, err = w.Write(buf[:AnchorSerLen]); err != nil {
+				bufferFile.Close()
+				return err
+			}
+		}
+	}
+	for _, header := range headers {
+		SerialiseHeader(header, buf[:])
+		if _, err = w.Write(buf[:]); err != nil {
+			bufferFile.Close()
+			return err
+		}
+	}
+	// Footer allows reading the range of block heights without reading the headers
+	binary.BigEndian.PutUint64(buf[:], headers[0].Number.Uint64())
+	binary.BigEndian.PutUint64(buf[8:], headers[len(headers)-1].Number.Uint64())
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(headers)))
+	if _, err = w.Write(buf[:HeaderFileFooterLen]); err != nil {
+		bufferFile.Close()
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		bufferFile.Close()
+		return err
+	}
+	return bufferFile.Close()
+}
+
+// FlushBuffer writes the buffer into new files, once it is full. Headers are written sorted by block height and hash,
+// at most headersPerFile headers in each file. If kv is not nil, anchors and tips are saved into it too
+func (hd *HeaderDownload) FlushBuffer(kv ethdb.KV) error {
+	if len(hd.buffer)*HeaderSerLength < hd.bufferLimit {
 		// Not flushing the buffer unless it is full
 		return nil
 	}
-	// Sort the buffer first
-	sort.Sort(BufferSorter(hd.buffer))
-	if bufferFile, err := ioutil.TempFile(hd.filesDir, "headers-buf"); err == nil {
-		// First write the anchors
-		var buf [AnchorSerLen]byte
-		binary.BigEndian.PutUint32(buf[:], hd.anchorSequence)
-		anchorCount := 0
-		for _, anchors := range hd.anchors {
-			anchorCount += len(anchors)
-		}
-		binary.BigEndian.PutUint32(buf[4:], uint32(anchorCount))
-		if _, err = bufferFile.Write(buf[:8]); err != nil {
-			bufferFile.Close()
+	type hashAndHeader struct {
+		hash   common.Hash
+		header *types.Header
+	}
+	sorted := make([]hashAndHeader, 0, len(hd.buffer))
+	for hash, header := range hd.buffer {
+		sorted = append(sorted, hashAndHeader{hash: hash, header: header})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].header.Number.Cmp(sorted[j].header.Number); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(sorted[i].hash[:], sorted[j].hash[:]) < 0
+	})
+	headers := make([]*types.Header, len(sorted))
+	for i, item := range sorted {
+		headers[i] = item.header
+	}
+	for i := 0; i < len(headers); i += hd.headersPerFile {
+		j := i + hd.headersPerFile
+		if j > len(headers) {
+			j = len(headers)
+		}
+		if err := hd.writeHeaderFile(headers[i:j]); err != nil {
 			return err
 		}
-		for _, anchors := range hd.anchors {
-			for _, anchor := range anchors {
-				pos := 0
-				copy(buf[pos:], anchor.hash[:])
-				pos += 32
-				binary.BigEndian.PutUint64(buf[pos:], uint64(anchor.powDepth))
-				pos += 8
-				binary.BigEndian.PutUint64(buf[pos:], anchor.maxTipHeight)
-				if _, err = bufferFile.Write(buf[:]); err != nil {
-					bufferFile.Close()
-					return err
-				}
+	}
+	hd.buffer = make(map[common.Hash]*types.Header)
+	hd.anchorSequence++
+	if kv != nil {
+		if err := kv.Update(context.Background(), hd.SaveState); err != nil {
+			return fmt.Errorf("save header download state: %w", err)
+		}
+	}
+	fmt.Printf("Successfully flushed the buffer\n")
+	return nil
+}
+
+const anchorStateLen = 32 /* anchorParent */ + 8 /* powDepth */ + 32 /* difficulty */ + 8 /* blockHeight */ + 8 /* timestamp */ + 8 /* maxTipHeight */
+
+const tipStateLen = 32 /* anchor hash */ + 32 /* cumulativeDifficulty */ + 32 /* difficulty */ + 8 /* timestamp */ + 8 /* blockHeight */ + 32 /* uncleHash */ + 32 /* parentHash */ + 1 /* noPrepend */
+
+// SaveState replaces anchors and tips in the HeaderDownloadBucket by the current ones
+func (hd *HeaderDownload) SaveState(tx ethdb.Tx) error {
+	if err := tx.(ethdb.BucketMigrator).ClearBucket(dbutils.HeaderDownloadBucket); err != nil {
+		return err
+	}
+	c := tx.Cursor(dbutils.HeaderDownloadBucket)
+	defer c.Close()
+	var buf [tipStateLen]byte
+	for anchorParent, anchors := range hd.anchors {
+		for _, anchor := range anchors {
+			pos := 0
+			copy(buf[pos:], anchorParent[:])
+			pos += 32
+			binary.BigEndian.PutUint64(buf[pos:], uint64(anchor.powDepth))
+			pos += 8
+			difficulty := anchor.difficulty.Bytes32()
+			copy(buf[pos:], difficulty[:])
+			pos += 32
+			binary.BigEndian.PutUint64(buf[pos:], anchor.blockHeight)
+			pos += 8
+			binary.BigEndian.PutUint64(buf[pos:], anchor.timestamp)
+			pos += 8
+			binary.BigEndian.PutUint64(buf[pos:], anchor.maxTipHeight)
+			if err := c.Put(append(common.CopyBytes(dbutils.HeaderDownloadAnchorPrefix), anchor.hash[:]...), buf[:anchorStateLen]); err != nil {
+				return err
 			}
 		}
-		if _, err = bufferFile.Write(hd.buffer); err != nil {
-			bufferFile.Close()
-			return err
+	}
+	for tipHash, tip := range hd.tips {
+		pos := 0
+		copy(buf[pos:], tip.anchor.hash[:])
+		pos += 32
+		cumulativeDifficulty := tip.cumulativeDifficulty.Bytes32()
+		copy(buf[pos:], cumulativeDifficulty[:])
+		pos += 32
+		difficulty := tip.difficulty.Bytes32()
+		copy(buf[pos:], difficulty[:])
+		pos += 32
+		binary.BigEndian.PutUint64(buf[pos:], tip.timestamp)
+		pos += 8
+		binary.BigEndian.PutUint64(buf[pos:], tip.blockHeight)
+		pos += 8
+		copy(buf[pos:], tip.uncleHash[:])
+		pos += 32
+		copy(buf[pos:], tip.parentHash[:])
+		pos += 32
+		buf[pos] = 0
+		if tip.noPrepend {
+			buf[pos] = 1
 		}
-		if err = bufferFile.Close(); err != nil {
+		if err := c.Put(append(common.CopyBytes(dbutils.HeaderDownloadTipPrefix), tipHash[:]...), buf[:tipStateLen]); err != nil {
 			return err
 		}
-		hd.buffer = hd.buffer[:0]
-		hd.anchorSequence++
-	} else {
-		return err
 	}
-	fmt.Printf("Successfully flushed the buffer\n")
 	return nil
 }
 
+// LoadState restores anchors and tips saved by SaveState, and returns false if there was nothing to restore.
+// It is expected to be called on the fresh HeaderDownload, after InitHardCodedTips
+func (hd *HeaderDownload) LoadState(tx ethdb.Tx, currentTime uint64) (bool, error) {
+	c := tx.Cursor(dbutils.HeaderDownloadBucket)
+	defer c.Close()
+	// Nothing is changed in hd until all the state is read
+	anchors := make(map[common.Hash]*Anchor)
+	anchorParents := make(map[common.Hash]common.Hash)
+	for k, v, err := c.Seek(dbutils.HeaderDownloadAnchorPrefix); ; k, v, err = c.Next() {
+		if err != nil {
+			return false, err
+		}
+		if k == nil || !bytes.HasPrefix(k, dbutils.HeaderDownloadAnchorPrefix) {
+			break
+		}
+		if len(v) != anchorStateLen {
+			return false, fmt.Errorf("anchor %x: unexpected length of state %d", k[1:], len(v))
+		}
+		anchor := &Anchor{tipQueue: &AnchorTipQueue{}, anchorID: hd.nextAnchorID}
+		hd.nextAnchorID++
+		heap.Init(anchor.tipQueue)
+		copy(anchor.hash[:], k[1:])
+		pos := 0
+		anchorParent := common.BytesToHash(v[pos : pos+32])
+		pos += 32
+		anchor.powDepth = int(binary.BigEndian.Uint64(v[pos:]))
+		pos += 8
+		anchor.difficulty.SetBytes(v[pos : pos+32])
+		pos += 32
+		anchor.blockHeight = binary.BigEndian.Uint64(v[pos:])
+		pos += 8
+		anchor.timestamp = binary.BigEndian.Uint64(v[pos:])
+		pos += 8
+		anchor.maxTipHeight = binary.BigEndian.Uint64(v[pos:])
+		anchorParents[anchor.hash] = anchorParent
+		anchors[anchor.hash] = anchor
+	}
+	tips := make(map[common.Hash]*Tip)
+	for k, v, err := c.Seek(dbutils.HeaderDownloadTipPrefix); ; k, v, err = c.Next() {
+		if err != nil {
+			return false, err
+		}
+		if k == nil || !bytes.HasPrefix(k, dbutils.HeaderDownloadTipPrefix) {
+			break
+		}
+		if len(v) != tipStateLen {
+			return false, fmt.Errorf("tip %x: unexpected length of state %d", k[1:], len(v))
+		}
+		tipHash := common.BytesToHash(k[1:])
+		pos := 0
+		anchor, ok := anchors[common.BytesToHash(v[pos:pos+32])]
+		if !ok {
+			return false, fmt.Errorf("tip %x: anchor %x not found", tipHash, v[pos:pos+32])
+		}
+		pos += 32
+		tip := &Tip{anchor: anchor}
+		tip.cumulativeDifficulty.SetBytes(v[pos : pos+32])
+		pos += 32
+		tip.difficulty.SetBytes(v[pos : pos+32])
+		pos += 32
+		tip.timestamp = binary.BigEndian.Uint64(v[pos:])
+		pos += 8
+		tip.blockHeight = binary.BigEndian.Uint64(v[pos:])
+		pos += 8
+		copy(tip.uncleHash[:], v[pos:pos+32])
+		pos += 32
+		copy(tip.parentHash[:], v[pos:pos+32])
+		pos += 32
+		tip.noPrepend = v[pos] == 1
+		tips[tipHash] = tip
+	}
+
+	for tipHash, tip := range tips {
+		hd.tips[tipHash] = tip
+		if !tip.noPrepend {
+			_, hard := hd.hardTips[tipHash]
+			heap.Push(tip.anchor.tipQueue, AnchorTipItem{hash: tipHash, height: tip.blockHeight, hard: hard})
+			hd.tipCount++
+			if !hard {
+				hd.tipLimiter.ReplaceOrInsert(&TipItem{tipHash: tipHash, cumulativeDifficulty: tip.cumulativeDifficulty})
+			}
+		}
+	}
+	for anchorHash, anchor := range anchors {
+		anchorParent := anchorParents[anchorHash]
+		if len(hd.anchors[anchorParent]) == 0 && anchorParent != (common.Hash{}) {
+			hd.requestQueue.PushFront(RequestQueueItem{anchorParent: anchorParent, waitUntil: currentTime})
+		}
+		hd.anchors[anchorParent] = append(hd.anchors[anchorParent], anchor)
+		// Anchors get into the tree with their first tip, see addHeaderAsTip
+		if anchor.tipQueue.Len() > 0 {
+			hd.anchorTree.ReplaceOrInsert(anchor)
+		}
+	}
+	return len(anchors) > 0, nil
+}
+
 // CheckInitiation looks at the first header in the given segment, and assuming
 // that it has been added as a tip, checks whether the anchor parent hash
 // associated with this tip equals to pre-set value (0x00..00 for genesis)
@@ -899,6 +1396,12 @@ func (hd *HeaderDownload) addHeaderAsTip(header *types.Header, anchor *Anchor, c
 		return fmt.Errorf("overflow when converting header.Difficulty to uint256: %s", header.Difficulty)
 	}
 	tipHash := header.Hash()
+	_, hard := hd.hardTips[tipHash]
+	if !hard && hd.tipCount >= hd.tipLimit && hd.tipLimiter.Len() > 0 {
+		if lowest := hd.tipLimiter.Min().(*TipItem); cumulativeDifficulty.Lt(&lowest.cumulativeDifficulty) {
+			return ErrTipBelowLimit
+		}
+	}
 	tip := &Tip{
 		anchor:               anchor,
 		cumulativeDifficulty: cumulativeDifficulty,
@@ -906,8 +1409,11 @@ func (hd *HeaderDownload) addHeaderAsTip(header *types.Header, anchor *Anchor, c
 		difficulty:           *diff,
 		blockHeight:          header.Number.Uint64(),
 		uncleHash:            header.UncleHash,
+		parentHash:           header.ParentHash,
+	}
+	if prevTip, ok := hd.tips[tipHash]; ok {
+		hd.tipLimiter.Delete(&TipItem{tipHash: tipHash, cumulativeDifficulty: prevTip.cumulativeDifficulty})
 	}
-	_, hard := hd.hardTips[tipHash]
 	hd.anchorTree.Delete(anchor)
 	hd.tips[tipHash] = tip
 	heap.Push(anchor.tipQueue, AnchorTipItem{hash: tipHash, height: tip.blockHeight, hard: hard})
@@ -916,6 +1422,9 @@ func (hd *HeaderDownload) addHeaderAsTip(header *types.Header, anchor *Anchor, c
 		anchor.maxTipHeight = tip.blockHeight
 	}
 	hd.anchorTree.ReplaceOrInsert(anchor)
+	if !hard {
+		hd.tipLimiter.ReplaceOrInsert(&TipItem{tipHash: tipHash, cumulativeDifficulty: cumulativeDifficulty})
+	}
 	hd.limitTips()
 	return nil
 }
@@ -927,6 +1436,7 @@ func (hd *HeaderDownload) addHardCodedTip(blockHeight uint64, timestamp uint64,
 		cumulativeDifficulty: cumulativeDifficulty,
 		timestamp:            timestamp,
 		blockHeight:          blockHeight,
+		noPrepend:            true,
 	}
 	hd.tips[hash] = tip
 }
@@ -951,18 +1461,68 @@ func (hd *HeaderDownload) addHeaderAsAnchor(header *types.Header, powDepth int)
 	return anchor, nil
 }
 
-// reserveTip makes sure there is a space for at least one more tip
+// removeAnchor removes the anchor from the anchors of the given anchor parent
+func (hd *HeaderDownload) removeAnchor(anchorParent common.Hash, anchor *Anchor) {
+	anchors := hd.anchors[anchorParent]
+	for i, a := range anchors {
+		if a == anchor {
+			anchors = append(anchors[:i], anchors[i+1:]...)
+			break
+		}
+	}
+	if len(anchors) > 0 {
+		hd.anchors[anchorParent] = anchors
+	} else {
+		delete(hd.anchors, anchorParent)
+	}
+}
+
+// limitTips evicts tips with the lowest cumulative difficulty while there are more than tipLimit of them.
+// Hard-coded tips, the highest-difficulty tip and its ancestors are never evicted
 func (hd *HeaderDownload) limitTips() {
-	for hd.tipCount > hd.tipLimit {
-		//fmt.Printf("limitTips tips %d >= %d\n", hd.tipCount, hd.tipLimit)
-		// Pick the anchor with the largest (maxTipHeight - minTipHeight) difference
-		anchor := hd.anchorTree.DeleteMin().(*Anchor)
-		//fmt.Printf("Chose anchor %d with maxTipHeight %d, tipStetch: %d\n", anchor.blockHeight, anchor.maxTipHeight, anchor.tipStretch())
-		//hd.anchorTree.Delete(&AnchorItem{ID: anchor.anchorID, tipStretch: anchor.tipStretch()})
-		tipItem := heap.Pop(anchor.tipQueue).(AnchorTipItem)
+	if hd.tipCount <= hd.tipLimit || hd.tipLimiter.Len() == 0 {
+		return
+	}
+	highest := hd.tipLimiter.Max().(*TipItem).tipHash
+	ancestors := make(map[common.Hash]struct{})
+	for tip, ok := hd.tips[highest]; ok; tip, ok = hd.tips[tip.parentHash] {
+		ancestors[tip.parentHash] = struct{}{}
+	}
+	var evict []*TipItem
+	hd.tipLimiter.AscendGreaterOrEqual(hd.tipLimiter.Min(), func(i llrb.Item) bool {
+		if hd.tipCount-len(evict) <= hd.tipLimit {
+			return false
+		}
+		tipItem := i.(*TipItem)
+		if _, ancestor := ancestors[tipItem.tipHash]; !ancestor && tipItem.tipHash != highest {
+			evict = append(evict, tipItem)
+		}
+		return true
+	})
+	for _, tipItem := range evict {
+		hd.evictTip(tipItem)
+	}
+}
+
+// evictTip removes the tip from the tipLimiter, the tips map and the tip queue of its anchor
+func (hd *HeaderDownload) evictTip(tipItem *TipItem) {
+	hd.tipLimiter.Delete(tipItem)
+	tip, ok := hd.tips[tipItem.tipHash]
+	if !ok {
+		return
+	}
+	delete(hd.tips, tipItem.tipHash)
+	anchor := tip.anchor
+	hd.anchorTree.Delete(anchor)
+	for i, anchorTipItem := range *anchor.tipQueue {
+		if anchorTipItem.hash == tipItem.tipHash {
+			heap.Remove(anchor.tipQueue, i)
+			hd.tipCount--
+			break
+		}
+	}
+	if anchor.tipQueue.Len() > 0 {
 		hd.anchorTree.ReplaceOrInsert(anchor)
-		delete(hd.tips, tipItem.hash)
-		hd.tipCount--
 	}
 }
 
@@ -980,3 +1540,108 @@ func (hd *HeaderDownload) anchorParentValid(anchor *Anchor, parent *types.Header
 	}
 	return anchor.difficulty.ToBig().Cmp(childDifficulty) == 0
 }
+
+// InsertHeaders writes the chain of headers (ordered from the lowest block height to the highest) into the database,
+// together with their total difficulties. The parent of the first header must already be in the database.
+// If the total difficulty of the last header exceeds the one of the current head, the headers become canonical,
+// canonical markers of the abandoned fork are replaced, and the progress of the Headers stage is updated
+func InsertHeaders(db ethdb.Database, headers []*types.Header) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	first := headers[0]
+	if first.Number.Sign() == 0 {
+		return fmt.Errorf("cannot insert genesis header %x", first.Hash())
+	}
+	parentNumber := first.Number.Uint64() - 1
+	if rawdb.ReadHeader(db, first.ParentHash, parentNumber) == nil {
+		return fmt.Errorf("%w %x of block %d", ErrUnknownParent, first.ParentHash, first.Number.Uint64())
+	}
+	parentTd, err := rawdb.ReadTd(db, first.ParentHash, parentNumber)
+	if err != nil {
+		return err
+	}
+	if parentTd == nil {
+		return fmt.Errorf("total difficulty of parent %x of block %d not found", first.ParentHash, first.Number.Uint64())
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].ParentHash != headers[i-1].Hash() || headers[i].Number.Uint64() != headers[i-1].Number.Uint64()+1 {
+			return fmt.Errorf("broken chain at block %d", headers[i].Number.Uint64())
+		}
+	}
+	batch := db.NewBatch()
+	defer batch.Rollback()
+	td := new(big.Int).Set(parentTd)
+	for _, header := range headers {
+		hash := header.Hash()
+		number := header.Number.Uint64()
+		td.Add(td, header.Difficulty)
+		data, err1 := rlp.EncodeToBytes(header)
+		if err1 != nil {
+			return fmt.Errorf("encode header %d: %w", number, err1)
+		}
+		if err1 = batch.Put(dbutils.HeaderPrefix, dbutils.HeaderKey(number, hash), data); err1 != nil {
+			return fmt.Errorf("store header %d: %w", number, err1)
+		}
+		if err1 = batch.Put(dbutils.HeaderNumberPrefix, hash[:], dbutils.EncodeBlockNumber(number)); err1 != nil {
+			return fmt.Errorf("store hash to number mapping %d: %w", number, err1)
+		}
+		if err1 = rawdb.WriteTd(batch, hash, number, td); err1 != nil {
+			return fmt.Errorf("store total difficulty %d: %w", number, err1)
+		}
+	}
+	headHash := rawdb.ReadHeadHeaderHash(db)
+	var headNumber uint64
+	if number := rawdb.ReadHeaderNumber(db, headHash); number != nil {
+		headNumber = *number
+		localTd, err1 := rawdb.ReadTd(db, headHash, headNumber)
+		if err1 != nil {
+			return err1
+		}
+		if localTd != nil && td.Cmp(localTd) <= 0 {
+			// Not heavier than the current head, headers are only stored as a side chain
+			_, err = batch.Commit()
+			return err
+		}
+	}
+	last := headers[len(headers)-1]
+	for _, header := range headers {
+		if err = rawdb.WriteCanonicalHash(batch, header.Hash(), header.Number.Uint64()); err != nil {
+			return err
+		}
+	}
+	// Walk back from the parent of the first header to the fork point, marking the ancestors as canonical
+	hash, number := first.ParentHash, parentNumber
+	for {
+		ch, err1 := rawdb.ReadCanonicalHash(batch, number)
+		if err1 != nil {
+			return err1
+		}
+		if ch == hash {
+			break
+		}
+		if err1 = rawdb.WriteCanonicalHash(batch, hash, number); err1 != nil {
+			return err1
+		}
+		if number == 0 {
+			break
+		}
+		header := rawdb.ReadHeader(batch, hash, number)
+		if header == nil {
+			return fmt.Errorf("header %x of block %d on the fork not found", hash, number)
+		}
+		hash, number = header.ParentHash, number-1
+	}
+	// Canonical markers above the new head belong to the abandoned chain
+	for n := last.Number.Uint64() + 1; n <= headNumber; n++ {
+		if err = rawdb.DeleteCanonicalHash(batch, n); err != nil {
+			return err
+		}
+	}
+	rawdb.WriteHeadHeaderHash(batch, last.Hash())
+	if err = stages.SaveStageProgress(batch, stages.Headers, last.Number.Uint64(), nil); err != nil {
+		return err
+	}
+	_, err = batch.Commit()
+	return err
+}
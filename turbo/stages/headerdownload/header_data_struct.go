@@ -1,8 +1,10 @@
 package headerdownload
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
 	"time"
@@ -86,8 +88,39 @@ type Tip struct {
 	difficulty           uint256.Int
 	blockHeight          uint64
 	uncleHash            common.Hash
+	parentHash           common.Hash
+	noPrepend            bool // Hard-coded tip, which is not in the tip queue of its anchor
 }
 
+// TipItem is element of the tipLimiter tree, which orders tips by cumulative difficulty, lowest first
+type TipItem struct {
+	tipHash              common.Hash
+	cumulativeDifficulty uint256.Int
+}
+
+// For placing tips into the tipLimiter tree
+func (ti *TipItem) Less(bi llrb.Item) bool {
+	b := bi.(*TipItem)
+	if ti.cumulativeDifficulty.Eq(&b.cumulativeDifficulty) {
+		return bytes.Compare(ti.tipHash[:], b.tipHash[:]) < 0
+	}
+	return ti.cumulativeDifficulty.Lt(&b.cumulativeDifficulty)
+}
+
+// ErrTipBelowLimit is returned when a tip is not added, because the tip limit is reached and its cumulative
+// difficulty is below the lowest one. Headers of such tips should not be buffered
+var ErrTipBelowLimit = errors.New("tip limit reached, cumulative difficulty is below the lowest tip")
+
+// Errors reported by VerifySeals, so that the caller can tell which penalty the sending peer deserves
+var (
+	ErrTooFarFuture = errors.New("detached segment too far in the future")
+	ErrTooFarPast   = errors.New("detached segment too far in the past")
+	ErrInvalidSeal  = errors.New("invalid seal")
+)
+
+// ErrUnknownParent is returned by InsertHeaders when the parent of the headers is not in the database yet
+var ErrUnknownParent = errors.New("unknown parent")
+
 // First item in ChainSegment is the anchor
 // ChainSegment must be contigous and must not include bad headers
 type ChainSegment struct {
@@ -116,19 +149,23 @@ type PeerPenalty struct {
 	err        error // Underlying error if available
 }
 
-// Request for chain segment starting with hash and going to its parent, etc, with length headers in total
+// Request for chain segment starting with hash and going to its parent, etc, with amount headers in total.
+// Skeleton requests have non-zero skip, to get sparse headers which become anchors
 type HeaderRequest struct {
-	Hash   common.Hash
-	Number uint64
-	Length int
+	Hash    common.Hash
+	Number  uint64
+	Amount  int
+	Skip    uint64
+	Reverse bool
 }
 
 type VerifySealFunc func(header *types.Header) error
 type CalcDifficultyFunc func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int
 
 type HeaderDownload struct {
-	buffer                 []byte
-	bufferLimit            int
+	buffer                 map[common.Hash]*types.Header // Headers to be written into files, by header hash
+	bufferLimit            int                           // Size (in bytes of serialised headers) of the buffer that triggers the flush
+	headersPerFile         int                           // Maximum number of headers in one file written by the flush
 	filesDir               string
 	anchorSequence         uint32 // Sequence number to be used for recording anchors next time the buffer is flushed
 	badHeaders             map[common.Hash]struct{}
@@ -139,11 +176,17 @@ type HeaderDownload struct {
 	tips                   map[common.Hash]*Tip     // Tips by tip hash
 	tipCount               int                      // Total number of tips associated to all anchors
 	tipLimit               int                      // Maximum allowed number of tips
+	tipLimiter             *llrb.LLRB               // Balanced tree of tips, except hard-coded ones, sorted by cumulative difficulty (lowest first)
 	initPowDepth           int                      // powDepth assigned to the newly inserted anchor
 	newAnchorFutureLimit   uint64                   // How far in the future (relative to current time) the new anchors are allowed to be
 	newAnchorPastLimit     uint64                   // How far in the past (relative to current time) the new anchors are allowed to be
 	highestTotalDifficulty uint256.Int
 	requestQueue           *list.List
+	anchorRequests         map[common.Hash]*AnchorRequest // Request state by anchor parent hash, to deduplicate requests and back off
+	maxRequestBackoff      uint64                         // Maximum delay (in seconds) between repeated requests for the same anchor parent
+	skeletonThreshold      uint64                         // Gaps below anchors longer than this are requested as skeletons first, 0 disables skeleton requests
+	skeletonHeights        map[uint64]struct{}            // Block heights of the requested skeleton headers, which are allowed to become anchors
+	preverifiedHashes      map[uint64]common.Hash         // Known hashes of the canonical chain by block height, headers at and below them do not need seal verification
 	calcDifficultyFunc     CalcDifficultyFunc
 	verifySealFunc         VerifySealFunc
 	RequestQueueTimer      *time.Timer
@@ -159,6 +202,37 @@ type RequestQueueItem struct {
 	waitUntil    uint64
 }
 
+// MaxHeadersPerRequest is the number of headers requested at once, and the spacing of skeleton headers
+const MaxHeadersPerRequest = 192
+
+// DefaultMaxRequestBackoff is the default maximum delay (in seconds) between repeated requests for the same anchor parent
+const DefaultMaxRequestBackoff = 300
+
+// DefaultHeadersPerFile is the maximum number of headers written into one file when the buffer is flushed
+const DefaultHeadersPerFile = 64 * 1024
+
+// HeaderFileFooterLen is the length of the index at the end of each header file: lowest and highest block heights, and number of headers
+const HeaderFileFooterLen = 8 /* minHeight */ + 8 /* maxHeight */ + 4 /* headerCount */
+
+// AnchorRequest is the state of requests for the headers of an anchor parent
+type AnchorRequest struct {
+	attempts    int    // Number of requests sent since the anchor parent appeared
+	lastRequest uint64 // Time of the last request
+	nextRequest uint64 // Time when the request can be repeated, if there is still no response
+	outstanding bool   // Whether the last request has not been answered yet
+}
+
+// Stats is a summary of the HeaderDownload state, for logging
+type Stats struct {
+	Anchors             int
+	Tips                int
+	OutstandingRequests int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("anchors=%d tips=%d outstanding requests=%d", s.Anchors, s.Tips, s.OutstandingRequests)
+}
+
 type RequestQueue []RequestQueueItem
 
 func (rq RequestQueue) Len() int {
@@ -192,10 +266,13 @@ func NewHeaderDownload(filesDir string,
 	calcDifficultyFunc CalcDifficultyFunc,
 	verifySealFunc VerifySealFunc,
 	newAnchorFutureLimit, newAnchorPastLimit uint64,
+	preverifiedHashes map[uint64]common.Hash,
 ) *HeaderDownload {
 	hd := &HeaderDownload{
 		filesDir:             filesDir,
+		buffer:               make(map[common.Hash]*types.Header),
 		bufferLimit:          bufferLimit,
+		headersPerFile:       DefaultHeadersPerFile,
 		badHeaders:           make(map[common.Hash]struct{}),
 		anchors:              make(map[common.Hash][]*Anchor),
 		tipLimit:             tipLimit,
@@ -208,6 +285,11 @@ func NewHeaderDownload(filesDir string,
 		newAnchorPastLimit:   newAnchorPastLimit,
 		hardTips:             make(map[common.Hash]struct{}),
 		tips:                 make(map[common.Hash]*Tip),
+		tipLimiter:           llrb.New(),
+		anchorRequests:       make(map[common.Hash]*AnchorRequest),
+		maxRequestBackoff:    DefaultMaxRequestBackoff,
+		skeletonHeights:      make(map[uint64]struct{}),
+		preverifiedHashes:    preverifiedHashes,
 	}
 	hd.RequestQueueTimer = time.NewTimer(time.Hour)
 	return hd
@@ -328,23 +410,3 @@ func DeserialiseHeader(header *types.Header, buffer []byte) {
 	pos += 32
 	header.Nonce = types.EncodeNonce(binary.BigEndian.Uint64(buffer[pos : pos+8]))
 }
-
-// Wrapper for the header buffer to sort headers within by block height
-type BufferSorter []byte
-
-func (bs BufferSorter) Len() int {
-	return len(bs) / HeaderSerLength
-}
-
-func (bs BufferSorter) Less(i, j int) bool {
-	hi := binary.BigEndian.Uint64(bs[i*HeaderSerLength+HeaderPreBlockHeight:])
-	hj := binary.BigEndian.Uint64(bs[j*HeaderSerLength+HeaderPreBlockHeight:])
-	return hi < hj
-}
-
-func (bs BufferSorter) Swap(i, j int) {
-	var swapBuffer [HeaderSerLength]byte
-	copy(swapBuffer[:], bs[i*HeaderSerLength:])
-	copy(bs[i*HeaderSerLength:i*HeaderSerLength+HeaderSerLength], bs[j*HeaderSerLength:j*HeaderSerLength+HeaderSerLength])
-	copy(bs[j*HeaderSerLength:], swapBuffer[:])
-}
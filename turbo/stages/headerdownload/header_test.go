@@ -2,13 +2,25 @@ package headerdownload
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/eth/stagedsync/stages"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 )
 
 const TestBufferLimit = 32 * 1024
@@ -19,7 +31,7 @@ func TestSplitIntoSegments(t *testing.T) {
 	hd := NewHeaderDownload("", TestBufferLimit, TestTipLimit, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
 		// To get child difficulty, we just add 1000 to the parent difficulty
 		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
-	}, nil, 60, 60)
+	}, nil, 60, 60, nil)
 
 	// Empty message
 	if chainSegments, penalty, err := hd.SplitIntoSegments([]*types.Header{}); err == nil {
@@ -182,7 +194,7 @@ func TestSingleHeaderAsSegment(t *testing.T) {
 	hd := NewHeaderDownload("", TestBufferLimit, TestTipLimit, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
 		// To get child difficulty, we just add 1000 to the parent difficulty
 		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
-	}, nil, 60, 60)
+	}, nil, 60, 60, nil)
 	var h types.Header
 	h.Number = big.NewInt(5)
 	if chainSegments, penalty, err := hd.SingleHeaderAsSegment(&h); err == nil {
@@ -293,7 +305,7 @@ func TestExtendUp(t *testing.T) {
 		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
 	}, func(header *types.Header) error {
 		return nil
-	}, 60, 60,
+	}, 60, 60, nil,
 	)
 
 	var currentTime uint64 = 100
@@ -429,7 +441,7 @@ func TestExtendDown(t *testing.T) {
 		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
 	}, func(header *types.Header) error {
 		return nil
-	}, 60, 60,
+	}, 60, 60, nil,
 	)
 
 	// single header in the chain segment
@@ -468,3 +480,624 @@ func TestHeaderSerialisation(t *testing.T) {
 		t.Errorf("header serialistion must be the same")
 	}
 }
+
+// dumpState prints anchors, their tip queues and tips in the deterministic order, for comparison
+func dumpState(hd *HeaderDownload) string {
+	var lines []string
+	for anchorParent, anchors := range hd.anchors {
+		for _, anchor := range anchors {
+			var queue []string
+			for _, item := range *anchor.tipQueue {
+				queue = append(queue, fmt.Sprintf("%x:%d:%t", item.hash, item.height, item.hard))
+			}
+			sort.Strings(queue)
+			lines = append(lines, fmt.Sprintf("anchor %x parent %x powDepth %d difficulty %d height %d timestamp %d maxTipHeight %d tips %v",
+				anchor.hash, anchorParent, anchor.powDepth, anchor.difficulty.ToBig(), anchor.blockHeight, anchor.timestamp, anchor.maxTipHeight, queue))
+		}
+	}
+	for tipHash, tip := range hd.tips {
+		lines = append(lines, fmt.Sprintf("tip %x anchor %x cumulativeDifficulty %d difficulty %d timestamp %d height %d uncleHash %x parentHash %x noPrepend %t",
+			tipHash, tip.anchor.hash, tip.cumulativeDifficulty.ToBig(), tip.difficulty.ToBig(), tip.timestamp, tip.blockHeight, tip.uncleHash, tip.parentHash, tip.noPrepend))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestSaveLoadState(t *testing.T) {
+	newHeaderDownload := func() *HeaderDownload {
+		return NewHeaderDownload("", TestBufferLimit, TestTipLimit, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+			// To get child difficulty, we just add 1000 to the parent difficulty
+			return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+		}, func(header *types.Header) error {
+			return nil
+		}, 60, 60, nil,
+		)
+	}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	var currentTime uint64 = 100
+
+	hd := newHeaderDownload()
+	var h1, h2, h3, h31, h5, h6, h7 types.Header
+	h1.Number, h1.Difficulty, h1.Time = big.NewInt(1), big.NewInt(10), 10
+	h2.Number, h2.Difficulty, h2.Time, h2.ParentHash = big.NewInt(2), big.NewInt(1010), 20, h1.Hash()
+	h3.Number, h3.Difficulty, h3.Time, h3.ParentHash = big.NewInt(3), big.NewInt(2010), 30, h2.Hash()
+	h31.Number, h31.Difficulty, h31.Time, h31.ParentHash, h31.Extra = big.NewInt(3), big.NewInt(2010), 30, h2.Hash(), []byte("Extra")
+	h5.Number, h5.Difficulty, h5.Time, h5.ParentHash = big.NewInt(5), big.NewInt(4010), 50, common.HexToHash("0x4")
+	h6.Number, h6.Difficulty, h6.Time, h6.ParentHash = big.NewInt(6), big.NewInt(5010), 60, h5.Hash()
+	h7.Number, h7.Difficulty, h7.ParentHash = big.NewInt(7), big.NewInt(6010), common.HexToHash("0x6")
+	// h1 is anchor of the genesis, tree h1 <- h2 <- (h3, h31)
+	if err := hd.NewAnchor(&ChainSegment{Headers: []*types.Header{&h2, &h1}}, 0, 2, currentTime); err != nil {
+		t.Fatalf("new anchor h1: %v", err)
+	}
+	if err := hd.ExtendUp(&ChainSegment{Headers: []*types.Header{&h3}}, 0, 1, currentTime); err != nil {
+		t.Fatalf("extend up h3: %v", err)
+	}
+	if err := hd.ExtendUp(&ChainSegment{Headers: []*types.Header{&h31}}, 0, 1, currentTime); err != nil {
+		t.Fatalf("extend up h31: %v", err)
+	}
+	// detached tree h5 <- h6
+	if err := hd.NewAnchor(&ChainSegment{Headers: []*types.Header{&h6, &h5}}, 0, 2, currentTime); err != nil {
+		t.Fatalf("new anchor h5: %v", err)
+	}
+	// hard-coded tip
+	if anchor, err := hd.addHeaderAsAnchor(&h7, 256); err == nil {
+		hd.addHardCodedTip(10, 5555, h7.Hash(), anchor, *new(uint256.Int).SetUint64(2000))
+	} else {
+		t.Fatalf("settings up h7 (anchor): %v", err)
+	}
+
+	if err := db.KV().Update(context.Background(), hd.SaveState); err != nil {
+		t.Fatal(err)
+	}
+	// Simulated restart
+	restored := newHeaderDownload()
+	var recovered bool
+	if err := db.KV().View(context.Background(), func(tx ethdb.Tx) (err error) {
+		recovered, err = restored.LoadState(tx, currentTime)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !recovered {
+		t.Fatalf("expected state to be recovered")
+	}
+	if want, have := dumpState(hd), dumpState(restored); want != have {
+		t.Fatalf("state is different after restart\nwant:\n%s\nhave:\n%s", want, have)
+	}
+	if restored.tipCount != hd.tipCount || restored.anchorTree.Len() != hd.anchorTree.Len() || restored.tipLimiter.Len() != hd.tipLimiter.Len() || restored.requestQueue.Len() != 2 {
+		t.Errorf("have tipCount %d, anchorTree %d, tipLimiter %d, requestQueue %d; want %d, %d, %d, 2",
+			restored.tipCount, restored.anchorTree.Len(), restored.tipLimiter.Len(), restored.requestQueue.Len(), hd.tipCount, hd.anchorTree.Len(), hd.tipLimiter.Len())
+	}
+
+	// Cumulative difficulties survive and are used for the new tips
+	var h4 types.Header
+	h4.Number, h4.Difficulty, h4.Time, h4.ParentHash = big.NewInt(4), big.NewInt(3010), 40, h3.Hash()
+	if err := restored.ExtendUp(&ChainSegment{Headers: []*types.Header{&h4}}, 0, 1, currentTime); err != nil {
+		t.Fatalf("extend up h4 after restart: %v", err)
+	}
+	if tip, ok := restored.getTip(h4.Hash()); !ok || !tip.cumulativeDifficulty.Eq(new(uint256.Int).SetUint64(10+1010+2010+3010)) || tip.anchor.hash != h1.Hash() {
+		t.Errorf("unexpected tip h4 after restart: %v", tip)
+	}
+
+	// Saving again replaces the previous state
+	if err := db.KV().Update(context.Background(), restored.SaveState); err != nil {
+		t.Fatal(err)
+	}
+	restoredAgain := newHeaderDownload()
+	if err := db.KV().View(context.Background(), func(tx ethdb.Tx) (err error) {
+		_, err = restoredAgain.LoadState(tx, currentTime)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := dumpState(restored), dumpState(restoredAgain); want != have {
+		t.Fatalf("state is different after second restart\nwant:\n%s\nhave:\n%s", want, have)
+	}
+
+	// Nothing to recover from the empty database
+	empty := ethdb.NewMemDatabase()
+	defer empty.Close()
+	if err := empty.KV().View(context.Background(), func(tx ethdb.Tx) (err error) {
+		recovered, err = newHeaderDownload().LoadState(tx, currentTime)
+		return err
+	}); err != nil || recovered {
+		t.Errorf("empty database: recovered %t, err %v", recovered, err)
+	}
+}
+
+func TestLimitTips(t *testing.T) {
+	hd := NewHeaderDownload("", TestBufferLimit, TestTipLimit, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+		// To get child difficulty, we just add 1000 to the parent difficulty
+		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+	}, func(header *types.Header) error {
+		return nil
+	}, 60, 60, nil,
+	)
+	var currentTime uint64 = 100
+
+	// Hard-coded tip with the lowest difficulty
+	var hh types.Header
+	hh.Number, hh.Difficulty, hh.ParentHash = big.NewInt(100), big.NewInt(1), common.HexToHash("0x99")
+	hd.hardTips[hh.Hash()] = struct{}{}
+	if err := hd.HardCodedHeader(&hh, currentTime); err != nil {
+		t.Fatalf("hard-coded header: %v", err)
+	}
+	// Anchor with lower difficulty than all the tips above it, but it is the ancestor of the highest tip
+	var h0 types.Header
+	h0.Number, h0.Difficulty = big.NewInt(1), big.NewInt(100)
+	anchor, err := hd.addHeaderAsAnchor(&h0, 0)
+	if err != nil {
+		t.Fatalf("setting up h0 (anchor): %v", err)
+	}
+	if err = hd.addHeaderAsTip(&h0, anchor, *new(uint256.Int).SetUint64(100), currentTime); err != nil {
+		t.Fatalf("setting up h0 (tip): %v", err)
+	}
+	// Forks on top of the anchor, more than the limit
+	const forks = 2 * TestTipLimit
+	type fork struct {
+		hash                 common.Hash
+		cumulativeDifficulty uint64
+	}
+	var pushed []fork
+	for i := 0; i < forks; i++ {
+		var h types.Header
+		h.Number, h.Difficulty, h.ParentHash, h.Extra = big.NewInt(2), big.NewInt(int64((i*7)%forks+1)*10), h0.Hash(), []byte{byte(i)}
+		cumulativeDifficulty := 100 + h.Difficulty.Uint64()
+		if err = hd.addHeaderAsTip(&h, anchor, *new(uint256.Int).SetUint64(cumulativeDifficulty), currentTime); err != nil {
+			t.Fatalf("adding fork %d: %v", i, err)
+		}
+		pushed = append(pushed, fork{hash: h.Hash(), cumulativeDifficulty: cumulativeDifficulty})
+		if hd.tipCount > TestTipLimit {
+			t.Fatalf("after fork %d: %d tips, limit %d", i, hd.tipCount, TestTipLimit)
+		}
+	}
+
+	// Highest forks survive, and also the hard-coded tip and the anchor
+	sort.Slice(pushed, func(i, j int) bool { return pushed[i].cumulativeDifficulty > pushed[j].cumulativeDifficulty })
+	expected := map[common.Hash]struct{}{hh.Hash(): {}, h0.Hash(): {}}
+	for _, f := range pushed[:TestTipLimit-len(expected)] {
+		expected[f.hash] = struct{}{}
+	}
+	if len(hd.tips) != len(expected) || hd.tipCount != TestTipLimit || hd.tipLimiter.Len() != TestTipLimit-1 || anchor.tipQueue.Len() != TestTipLimit-1 {
+		t.Fatalf("have %d tips, tipCount %d, tipLimiter %d, tip queue %d; want %d", len(hd.tips), hd.tipCount, hd.tipLimiter.Len(), anchor.tipQueue.Len(), len(expected))
+	}
+	for tipHash := range expected {
+		if !hd.HasTip(tipHash) {
+			t.Errorf("expected tip %x to survive", tipHash)
+		}
+	}
+	for _, item := range *anchor.tipQueue {
+		if _, ok := expected[item.hash]; !ok {
+			t.Errorf("evicted tip %x is still in the tip queue", item.hash)
+		}
+	}
+
+	// At the capacity, new anchor with difficulty below the lowest tip is refused
+	var hn types.Header
+	hn.Number, hn.Difficulty, hn.ParentHash = big.NewInt(50), big.NewInt(1), common.HexToHash("0x49")
+	if err = hd.NewAnchor(&ChainSegment{Headers: []*types.Header{&hn}}, 0, 1, currentTime); !errors.Is(err, ErrTipBelowLimit) {
+		t.Fatalf("new anchor below the limit: have err %v, want %v", err, ErrTipBelowLimit)
+	}
+	if _, ok := hd.anchors[hn.ParentHash]; ok || hd.HasTip(hn.Hash()) || len(hd.tips) != len(expected) {
+		t.Errorf("refused anchor must not be added")
+	}
+}
+
+func TestRequestBackoff(t *testing.T) {
+	hd := NewHeaderDownload("", TestBufferLimit, TestTipLimit, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+		// To get child difficulty, we just add 1000 to the parent difficulty
+		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+	}, func(header *types.Header) error {
+		return nil
+	}, 60, 60, nil,
+	)
+	hd.SetMaxRequestBackoff(40)
+	const timeout = 5
+
+	var h1, h2, h3, h21 types.Header
+	h1.Number, h1.Difficulty, h1.ParentHash = big.NewInt(1), big.NewInt(10), common.HexToHash("0x1")
+	h2.Number, h2.Difficulty, h2.ParentHash = big.NewInt(2), big.NewInt(1010), h1.Hash()
+	h21.Number, h21.Difficulty, h21.ParentHash, h21.Extra = big.NewInt(2), big.NewInt(1010), h1.Hash(), []byte("Extra")
+	h3.Number, h3.Difficulty, h3.ParentHash = big.NewInt(3), big.NewInt(2010), h2.Hash()
+	// Two anchors with the same parent put two items into the request queue
+	if err := hd.NewAnchor(&ChainSegment{Headers: []*types.Header{&h3, &h2}}, 0, 2, 0); err != nil {
+		t.Fatalf("new anchor h2: %v", err)
+	}
+	if err := hd.NewAnchor(&ChainSegment{Headers: []*types.Header{&h21}}, 0, 1, 0); err != nil {
+		t.Fatalf("new anchor h21: %v", err)
+	}
+
+	// Timer ticks every second, and there are no responses
+	var requestTimes []uint64
+	for currentTime := uint64(0); currentTime <= 100; currentTime++ {
+		for _, req := range hd.RequestMoreHeaders(currentTime, timeout) {
+			if req.Hash != h1.Hash() || req.Number != 1 {
+				t.Fatalf("unexpected request %+v", req)
+			}
+			requestTimes = append(requestTimes, currentTime)
+		}
+	}
+	// Delays are 5, 10, 20, 40, 40 (capped)
+	if fmt.Sprint(requestTimes) != fmt.Sprint([]uint64{0, 5, 15, 35, 75}) {
+		t.Errorf("requests sent at %v", requestTimes)
+	}
+	if stats := hd.Stats(); stats.OutstandingRequests != 1 || stats.Anchors != 2 || stats.Tips != 3 {
+		t.Errorf("unexpected stats %s", stats)
+	}
+
+	// Response extends the anchors down, the request for the new anchor parent is sent right away
+	if err := hd.ExtendDown(&ChainSegment{Headers: []*types.Header{&h1}}, 0, 1, 0, 100); err != nil {
+		t.Fatalf("extend down h1: %v", err)
+	}
+	if stats := hd.Stats(); stats.OutstandingRequests != 0 {
+		t.Errorf("unexpected stats after response %s", stats)
+	}
+	if reqs := hd.RequestMoreHeaders(101, timeout); len(reqs) != 1 || reqs[0].Hash != h1.ParentHash || reqs[0].Number != 0 {
+		t.Errorf("expected request for the parent of h1, got %d requests", len(reqs))
+	}
+	if _, ok := hd.anchorRequests[h1.Hash()]; ok {
+		t.Errorf("request state of the extended anchor must be removed")
+	}
+}
+
+// processSegment does the same as the downloader, for a segment of headers received from a peer
+func processSegment(hd *HeaderDownload, segment *ChainSegment, currentTime uint64) error {
+	foundAnchor, start, _, _ := hd.FindAnchors(segment)
+	foundTip, end, penalty := hd.FindTip(segment, start)
+	if penalty != NoPenalty {
+		return fmt.Errorf("findTip penalty %s", penalty)
+	}
+	powDepth, err := hd.VerifySeals(segment, foundAnchor, foundTip, start, end, currentTime)
+	if err != nil {
+		return err
+	}
+	switch {
+	case foundAnchor && foundTip:
+		return hd.Connect(segment, start, end, currentTime)
+	case foundAnchor:
+		return hd.ExtendDown(segment, start, end, powDepth, currentTime)
+	case foundTip:
+		if end == 0 {
+			return nil
+		}
+		return hd.ExtendUp(segment, start, end, currentTime)
+	default:
+		return hd.NewAnchor(segment, start, end, currentTime)
+	}
+}
+
+// roundTripsToFillGap counts rounds of requests and responses, until the anchor at the top of the chain
+// of given length is connected to the genesis
+func roundTripsToFillGap(t *testing.T, length int, skeletonThreshold uint64) int {
+	hd := NewHeaderDownload("", TestBufferLimit, 2*length, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+		// To get child difficulty, we just add 1000 to the parent difficulty
+		return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+	}, func(header *types.Header) error {
+		return nil
+	}, 60, 60, nil,
+	)
+	hd.SetSkeletonThreshold(skeletonThreshold)
+	// All headers are too old to become anchors, unless they are requested as skeleton
+	chain := make([]*types.Header, length+1)
+	heights := make(map[common.Hash]int)
+	for i := range chain {
+		header := &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(int64(i+1) * 1000)}
+		if i > 0 {
+			header.ParentHash = chain[i-1].Hash()
+		}
+		chain[i] = header
+		heights[header.Hash()] = i
+	}
+	var currentTime uint64 = 1000
+	for _, i := range []int{0, length} {
+		if err := hd.NewAnchor(&ChainSegment{Headers: []*types.Header{chain[i]}}, 0, 1, currentTime); err != nil {
+			t.Fatalf("anchor %d: %v", i, err)
+		}
+	}
+	genesisAnchor := hd.anchors[common.Hash{}][0]
+
+	for rounds := 1; rounds <= length; rounds++ {
+		currentTime++
+		for _, req := range hd.RequestMoreHeaders(currentTime, 5 /* timeout */) {
+			origin, ok := heights[req.Hash]
+			if !ok || !req.Reverse {
+				t.Fatalf("unexpected request %+v", req)
+			}
+			var headers []*types.Header
+			for i := 0; i < req.Amount && origin-i*int(req.Skip+1) >= 0; i++ {
+				headers = append(headers, chain[origin-i*int(req.Skip+1)])
+			}
+			segments, penalty, err := hd.SplitIntoSegments(headers)
+			if err != nil || penalty != NoPenalty {
+				t.Fatalf("split into segments: %v, penalty %s", err, penalty)
+			}
+			for _, segment := range segments {
+				if err = processSegment(hd, segment, currentTime); err != nil {
+					t.Fatalf("round %d, segment from %d: %v", rounds, segment.Headers[0].Number, err)
+				}
+			}
+		}
+		if tip, ok := hd.getTip(chain[length].Hash()); ok && tip.anchor == genesisAnchor {
+			if len(hd.anchors) != 1 {
+				t.Errorf("expected only genesis anchor, got %d anchor parents", len(hd.anchors))
+			}
+			return rounds
+		}
+	}
+	t.Fatalf("gap was not filled")
+	return 0
+}
+
+func TestSkeletonRequests(t *testing.T) {
+	const length = 10_000
+	contiguous := roundTripsToFillGap(t, length, 0)
+	skeleton := roundTripsToFillGap(t, length, 1000)
+	// Contiguous requests one after another (length/192 rounded up), vs skeleton, then all the gaps at once, and the rest at the bottom
+	if contiguous != 53 || skeleton != 3 {
+		t.Errorf("round trips without skeleton %d, with skeleton %d", contiguous, skeleton)
+	}
+}
+
+func TestPreverifiedHashes(t *testing.T) {
+	chain := make([]*types.Header, 61)
+	for i := range chain {
+		header := &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(int64(i+1) * 1000)}
+		if i > 0 {
+			header.ParentHash = chain[i-1].Hash()
+		}
+		chain[i] = header
+	}
+	// Headers from..to, from the highest to the lowest, as a peer would send them
+	headers := func(from, to int) []*types.Header {
+		var hs []*types.Header
+		for i := from; i >= to; i-- {
+			hs = append(hs, chain[i])
+		}
+		return hs
+	}
+	var verified int
+	newHd := func(preverifiedHashes map[uint64]common.Hash) *HeaderDownload {
+		return NewHeaderDownload("", TestBufferLimit, 1000, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+			// To get child difficulty, we just add 1000 to the parent difficulty
+			return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+		}, func(header *types.Header) error {
+			verified++
+			return nil
+		}, 60, 60, preverifiedHashes,
+		)
+	}
+
+	// Segment crossing a checkpoint with a different hash
+	hd := newHd(map[uint64]common.Hash{50: {1}})
+	if _, penalty, err := hd.SplitIntoSegments(headers(60, 40)); err != nil || penalty != BadBlockPenalty {
+		t.Errorf("expected BadBlock penalty, got %s, error %v", penalty, err)
+	}
+	if _, penalty, err := hd.SingleHeaderAsSegment(chain[50]); err != nil || penalty != BadBlockPenalty {
+		t.Errorf("expected BadBlock penalty for single header, got %s, error %v", penalty, err)
+	}
+
+	// Segments crossing matching checkpoints, all headers are too old to become anchors without them
+	hd = newHd(map[uint64]common.Hash{50: chain[50].Hash(), 30: chain[30].Hash()})
+	var currentTime uint64 = 1000
+	for _, tc := range []struct {
+		from, to int
+		verified int
+	}{
+		{60, 40, 10}, // New anchor, only headers above the checkpoint 50 are verified
+		{39, 20, 9},  // Extends down, powDepth drops to 0 at the checkpoint 30
+		{19, 0, 0},   // Extends down below the checkpoint, nothing to verify
+	} {
+		verified = 0
+		segments, penalty, err := hd.SplitIntoSegments(headers(tc.from, tc.to))
+		if err != nil || penalty != NoPenalty || len(segments) != 1 {
+			t.Fatalf("split into segments %d-%d: %v, penalty %s", tc.from, tc.to, err, penalty)
+		}
+		if err = processSegment(hd, segments[0], currentTime); err != nil {
+			t.Fatalf("segment %d-%d: %v", tc.from, tc.to, err)
+		}
+		if verified != tc.verified {
+			t.Errorf("segment %d-%d: expected %d seals verified, got %d", tc.from, tc.to, tc.verified, verified)
+		}
+	}
+	if tip, ok := hd.getTip(chain[60].Hash()); !ok || tip.anchor.blockHeight != 0 {
+		t.Errorf("expected the chain to be anchored at genesis")
+	}
+
+	// Preverified hashes file
+	f, err := ioutil.TempFile("", "preverified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	var buf [PreverifiedSerLength]byte
+	for _, i := range []int{30, 50} {
+		binary.BigEndian.PutUint64(buf[:], uint64(i))
+		copy(buf[8:], chain[i].Hash().Bytes())
+		if _, err = f.Write(buf[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	preverifiedHashes, err := ReadPreverifiedHashes(f.Name())
+	if err != nil {
+		t.Fatalf("read preverified hashes: %v", err)
+	}
+	if len(preverifiedHashes) != 2 || preverifiedHashes[30] != chain[30].Hash() || preverifiedHashes[50] != chain[50].Hash() {
+		t.Errorf("unexpected preverified hashes %v", preverifiedHashes)
+	}
+}
+
+func TestFlushBufferDeduplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newHd := func() *HeaderDownload {
+		hd := NewHeaderDownload(dir, 1 /* flush every time */, 1000, TestInitPowDepth, func(childTimestamp uint64, parentTime uint64, parentDifficulty, parentNumber *big.Int, parentHash, parentUncleHash common.Hash) *big.Int {
+			// To get child difficulty, we just add 1000 to the parent difficulty
+			return big.NewInt(0).Add(parentDifficulty, big.NewInt(1000))
+		}, func(header *types.Header) error {
+			return nil
+		}, 60, 60, nil,
+		)
+		hd.headersPerFile = 4
+		return hd
+	}
+	chain := make([]*types.Header, 10)
+	for i := range chain {
+		header := &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(int64(i+1) * 1000)}
+		if i > 0 {
+			header.ParentHash = chain[i-1].Hash()
+		}
+		chain[i] = header
+	}
+	// Headers arrive out of order, overlapping segments and single headers are duplicated
+	hd := newHd()
+	hd.AddSegmentToBuffer(&ChainSegment{Headers: []*types.Header{chain[9], chain[8], chain[7], chain[6], chain[5]}}, 0, 5)
+	hd.AddSegmentToBuffer(&ChainSegment{Headers: []*types.Header{chain[6], chain[5], chain[4], chain[3], chain[2], chain[1], chain[0]}}, 0, 7)
+	hd.AddHeaderToBuffer(chain[5])
+	hd.AddHeaderToBuffer(chain[0])
+	if len(hd.buffer) != len(chain) {
+		t.Errorf("expected %d headers in the buffer, got %d", len(chain), len(hd.buffer))
+	}
+	if err = hd.FlushBuffer(nil); err != nil {
+		t.Fatalf("flush buffer: %v", err)
+	}
+	if len(hd.buffer) != 0 {
+		t.Errorf("expected empty buffer after flush, got %d headers", len(hd.buffer))
+	}
+
+	// Headers are split into files of 4, each header appears once, in the order of block heights
+	hfs, err := readHeaderFiles(dir)
+	if err != nil {
+		t.Fatalf("read header files: %v", err)
+	}
+	sort.Slice(hfs, func(i, j int) bool { return hfs[i].minHeight < hfs[j].minHeight })
+	var ranges []string
+	var heights []uint64
+	var buffer [HeaderSerLength]byte
+	for _, hf := range hfs {
+		ranges = append(ranges, fmt.Sprintf("%d-%d:%d", hf.minHeight, hf.maxHeight, hf.headerCount))
+		f, r, err1 := hf.openHeaders()
+		if err1 != nil {
+			t.Fatalf("open headers: %v", err1)
+		}
+		for {
+			if _, err1 = io.ReadFull(r, buffer[:]); err1 != nil {
+				break
+			}
+			var header types.Header
+			DeserialiseHeader(&header, buffer[:])
+			heights = append(heights, header.Number.Uint64())
+		}
+		f.Close()
+	}
+	if fmt.Sprint(ranges) != "[0-3:4 4-7:4 8-9:2]" {
+		t.Errorf("unexpected files %v", ranges)
+	}
+	if fmt.Sprint(heights) != fmt.Sprint([]uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("unexpected headers in files %v", heights)
+	}
+
+	// Recovery finds each header once
+	hd = newHd()
+	recovered, err := hd.RecoverFromFiles(0)
+	if err != nil || !recovered {
+		t.Fatalf("recover from files: %t, %v", recovered, err)
+	}
+	if hd.tipCount != len(chain) {
+		t.Errorf("expected %d tips after recovery, got %d", len(chain), hd.tipCount)
+	}
+	if tip, ok := hd.getTip(chain[9].Hash()); !ok || tip.anchor.blockHeight != 0 {
+		t.Errorf("expected chain to be recovered under the genesis anchor")
+	}
+}
+
+func TestInsertHeaders(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1000)}
+	rawdb.WriteHeader(context.Background(), db, genesis)
+	if err := rawdb.WriteTd(db, genesis.Hash(), 0, genesis.Difficulty); err != nil {
+		t.Fatal(err)
+	}
+	if err := rawdb.WriteCanonicalHash(db, genesis.Hash(), 0); err != nil {
+		t.Fatal(err)
+	}
+	rawdb.WriteHeadHeaderHash(db, genesis.Hash())
+
+	// makeChain creates the chain of headers on top of the parent, with given difficulty and extra to tell the forks apart
+	makeChain := func(parent *types.Header, length int, difficulty int64, extra string) []*types.Header {
+		headers := make([]*types.Header, length)
+		for i := range headers {
+			headers[i] = &types.Header{
+				ParentHash: parent.Hash(),
+				Number:     big.NewInt(parent.Number.Int64() + 1),
+				Difficulty: big.NewInt(difficulty),
+				Extra:      []byte(extra),
+			}
+			parent = headers[i]
+		}
+		return headers
+	}
+	checkCanonical := func(name string, expected []*types.Header, removed uint64) {
+		for _, header := range expected {
+			if ch, err := rawdb.ReadCanonicalHash(db, header.Number.Uint64()); err != nil || ch != header.Hash() {
+				t.Errorf("%s: unexpected canonical hash %x for block %d, error %v", name, ch, header.Number.Uint64(), err)
+			}
+		}
+		if removed > 0 {
+			if ch, err := rawdb.ReadCanonicalHash(db, removed); err != nil || ch != (common.Hash{}) {
+				t.Errorf("%s: expected no canonical hash for block %d, got %x, error %v", name, removed, ch, err)
+			}
+		}
+		last := expected[len(expected)-1]
+		if head := rawdb.ReadHeadHeaderHash(db); head != last.Hash() {
+			t.Errorf("%s: expected head %x, got %x", name, last.Hash(), head)
+		}
+		if progress, _, err := stages.GetStageProgress(db, stages.Headers); err != nil || progress != last.Number.Uint64() {
+			t.Errorf("%s: expected Headers stage progress %d, got %d, error %v", name, last.Number.Uint64(), progress, err)
+		}
+	}
+
+	a := makeChain(genesis, 5, 1000, "a") // Blocks 1-5, total difficulty 6000
+	if err := InsertHeaders(db, a); err != nil {
+		t.Fatalf("insert a: %v", err)
+	}
+	checkCanonical("a", a, 0)
+	if td, err := rawdb.ReadTd(db, a[4].Hash(), 5); err != nil || td.Int64() != 6000 {
+		t.Errorf("expected total difficulty 6000, got %d, error %v", td, err)
+	}
+
+	// Shorter fork from block 2 with higher total difficulty 9000 takes over, block 5 is not canonical anymore
+	b := makeChain(a[1], 2, 3000, "b")
+	if err := InsertHeaders(db, b); err != nil {
+		t.Fatalf("insert b: %v", err)
+	}
+	checkCanonical("b", append(a[:2:2], b...), 5)
+
+	// Lighter fork is stored, but canonical chain does not change
+	c := makeChain(a[0], 3, 1000, "c")
+	if err := InsertHeaders(db, c); err != nil {
+		t.Fatalf("insert c: %v", err)
+	}
+	checkCanonical("c", append(a[:2:2], b...), 5)
+	if header := rawdb.ReadHeader(db, c[2].Hash(), 4); header == nil {
+		t.Errorf("expected side chain header to be stored")
+	}
+
+	// Extension of the abandoned fork a, with total difficulty 11000, makes whole fork a canonical again
+	d := makeChain(a[4], 1, 5000, "d")
+	if err := InsertHeaders(db, d); err != nil {
+		t.Fatalf("insert d: %v", err)
+	}
+	checkCanonical("d", append(a[:5:5], d...), 0)
+
+	// Headers without known parent are not inserted
+	orphan := makeChain(&types.Header{Number: big.NewInt(10), Extra: []byte("orphan")}, 1, 1000, "e")
+	if err := InsertHeaders(db, orphan); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("expected ErrUnknownParent, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package transactions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	state2 "github.com/ledgerwatch/turbo-geth/turbo/adapter"
+)
+
+// The memory taken by the state of a block is estimated by the transactions applied to it: the state they touch
+// grows with the gas they use
+const (
+	txEnvTxSize      = 1024 // per applied transaction
+	txEnvGasPerByte  = 16
+	txEnvMinCacheMem = 1024 * 1024
+)
+
+// TxEnvCache - the states of the blocks after the transactions last computed by ComputeTxEnv, so the request for the
+// next transaction of the same block applies only the transactions in between, instead of the whole prefix of the
+// block. The entries are keyed by the block hash, each is used by one request at a time. The least recently used
+// entries are dropped when the estimated memory of the states exceeds the limit
+type TxEnvCache struct {
+	hits    uint64 // atomic
+	misses  uint64 // atomic
+	applied uint64 // atomic
+
+	lock    sync.Mutex
+	entries map[common.Hash]*txEnvEntry
+	maxSize int
+	size    int
+	clock   uint64
+}
+
+type txEnvEntry struct {
+	lock     sync.Mutex
+	ibs      *state.IntraBlockState // state before the transaction next
+	reader   *state2.StateReader
+	next     int
+	size     int    // guarded by the lock of the cache
+	lastUsed uint64 // guarded by the lock of the cache
+}
+
+// NewTxEnvCache - maxSize is the limit of the estimated memory of the cached states in bytes
+func NewTxEnvCache(maxSize int) *TxEnvCache {
+	if maxSize < txEnvMinCacheMem {
+		maxSize = txEnvMinCacheMem
+	}
+	return &TxEnvCache{
+		entries: make(map[common.Hash]*txEnvEntry),
+		maxSize: maxSize,
+	}
+}
+
+// TxEnvCacheStats - Hits and Misses count the requests which continued a cached state and which started from the
+// parent block, Applied - the transactions replayed to get the states
+type TxEnvCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Applied uint64
+}
+
+func (c *TxEnvCache) Stats() TxEnvCacheStats {
+	return TxEnvCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Applied: atomic.LoadUint64(&c.applied),
+	}
+}
+
+// ComputeTxEnv - same as ComputeTxEnv of the package, but continues the state of the block computed by the previous
+// call if its index is not greater than txIndex. The returned state is a copy, the caller may change it.
+// The nil cache computes the environment from scratch
+func (c *TxEnvCache) ComputeTxEnv(ctx context.Context, blockGetter BlockGetter, cfg *params.ChainConfig, chain core.ChainContext, tx ethdb.Tx, blockHash common.Hash, txIndex uint64) (core.Message, vm.Context, *state.IntraBlockState, *state2.StateReader, error) {
+	if c == nil {
+		return ComputeTxEnv(ctx, blockGetter, cfg, chain, tx, blockHash, txIndex)
+	}
+	block, err := blockGetter.GetBlockByHash(blockHash)
+	if err != nil {
+		return nil, vm.Context{}, nil, nil, err
+	}
+	if block == nil || txIndex >= uint64(len(block.Transactions())) {
+		// nothing to continue, the errors are reported there
+		return ComputeTxEnv(ctx, blockGetter, cfg, chain, tx, blockHash, txIndex)
+	}
+
+	e := c.entry(blockHash)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	reset := false
+	if e.ibs == nil || e.next > int(txIndex) {
+		parent := blockGetter.GetBlock(block.ParentHash(), block.NumberU64()-1)
+		if parent == nil {
+			c.drop(blockHash, e)
+			return nil, vm.Context{}, nil, nil, fmt.Errorf("parent %x not found", block.ParentHash())
+		}
+		e.ibs, e.reader = state2.ComputeIntraBlockState(tx, parent)
+		e.next = 0
+		reset = true
+		atomic.AddUint64(&c.misses, 1)
+	} else {
+		// the state was computed in the transaction of another request
+		e.reader = e.reader.Copy(tx)
+		e.ibs.SetStateReader(e.reader)
+		atomic.AddUint64(&c.hits, 1)
+	}
+
+	header := block.Header()
+	signer := types.MakeSigner(cfg, block.Number())
+	txs := block.Transactions()
+	applied := 0
+	for ; e.next < int(txIndex); e.next++ {
+		select {
+		default:
+		case <-ctx.Done():
+			c.drop(blockHash, e)
+			return nil, vm.Context{}, nil, nil, ctx.Err()
+		}
+		txn := txs[e.next]
+		e.ibs.Prepare(txn.Hash(), blockHash, e.next)
+		msg, _ := txn.AsMessage(signer)
+		vmenv := vm.NewEVM(core.NewEVMContext(msg, header, chain, nil), e.ibs, cfg, vm.Config{})
+		res, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(txn.Gas()))
+		if err != nil {
+			c.drop(blockHash, e)
+			return nil, vm.Context{}, nil, nil, fmt.Errorf("transaction %x failed: %v", txn.Hash(), err)
+		}
+		_ = e.ibs.FinalizeTx(vmenv.ChainConfig().WithEIPsFlags(context.Background(), block.Number()), e.reader)
+		atomic.AddUint64(&c.applied, 1)
+		applied += txEnvTxSize + int(res.UsedGas/txEnvGasPerByte)
+	}
+	c.resize(blockHash, e, reset, applied)
+
+	txn := txs[txIndex]
+	msg, _ := txn.AsMessage(signer)
+	reader := e.reader.Copy(tx)
+	ibs := e.ibs.Copy()
+	ibs.SetStateReader(reader)
+	ibs.Prepare(txn.Hash(), blockHash, int(txIndex))
+	return msg, core.NewEVMContext(msg, header, chain, nil), ibs, reader, nil
+}
+
+func (c *TxEnvCache) entry(blockHash common.Hash) *txEnvEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clock++
+	e, ok := c.entries[blockHash]
+	if !ok {
+		e = &txEnvEntry{}
+		c.entries[blockHash] = e
+	}
+	e.lastUsed = c.clock
+	return e
+}
+
+// drop - the state of the entry is not valid after an error
+func (c *TxEnvCache) drop(blockHash common.Hash, e *txEnvEntry) {
+	e.ibs, e.reader, e.next = nil, nil, 0
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[blockHash] == e {
+		delete(c.entries, blockHash)
+		c.size -= e.size
+	}
+}
+
+// resize - adds the size of the transactions applied to the entry, reset - the state was computed from the parent
+// block. Then the least recently used entries are dropped while the cache is above the limit, the entry itself
+// is the last one
+func (c *TxEnvCache) resize(blockHash common.Hash, e *txEnvEntry, reset bool, added int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[blockHash] != e {
+		// dropped by another request meanwhile
+		return
+	}
+	if reset {
+		c.size -= e.size
+		e.size = 0
+	}
+	c.size += added
+	e.size += added
+	for c.size > c.maxSize && len(c.entries) > 1 {
+		var oldest common.Hash
+		var oldestEntry *txEnvEntry
+		for hash, entry := range c.entries {
+			if entry != e && (oldestEntry == nil || entry.lastUsed < oldestEntry.lastUsed) {
+				oldest, oldestEntry = hash, entry
+			}
+		}
+		delete(c.entries, oldest)
+		c.size -= oldestEntry.size
+	}
+	if c.size > c.maxSize {
+		delete(c.entries, blockHash)
+		c.size -= e.size
+	}
+}
@@ -0,0 +1,99 @@
+package transactions
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/turbo/adapter"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlockGetter - the blocks generated by core.GenerateChain are not written to the database
+type testBlockGetter map[common.Hash]*types.Block
+
+func (g testBlockGetter) GetBlockByHash(hash common.Hash) (*types.Block, error) {
+	return g[hash], nil
+}
+
+func (g testBlockGetter) GetBlock(hash common.Hash, _ uint64) *types.Block {
+	return g[hash]
+}
+
+func TestTxEnvCache(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	recipient := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  core.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+	}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	genesis := gspec.MustCommit(db)
+
+	const n = 50
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+	blocks, _, err := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 1, func(i int, b *core.BlockGen) {
+		for j := 0; j < n; j++ {
+			tx, err := types.SignTx(types.NewTransaction(b.TxNonce(sender), recipient, uint256.NewInt().SetUint64(1000), params.TxGas, uint256.NewInt(), nil), signer, key)
+			require.NoError(t, err)
+			b.AddTx(tx)
+		}
+	}, false /* intermediateHashes */)
+	require.NoError(t, err)
+	block := blocks[0]
+	getter := testBlockGetter{genesis.Hash(): genesis, block.Hash(): block}
+	chain := adapter.NewChainContext(db, ethash.NewFaker())
+
+	tx, err := db.KV().Begin(context.Background(), nil, false)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ctx := context.Background()
+	cache := NewTxEnvCache(64 * 1024 * 1024)
+
+	check := func(txIndex uint64) {
+		msg, vmctx, ibs, _, err := cache.ComputeTxEnv(ctx, getter, gspec.Config, chain, tx, block.Hash(), txIndex)
+		require.NoError(t, err)
+		require.Equal(t, txIndex, ibs.GetNonce(sender))
+		require.Equal(t, new(uint256.Int).SetUint64(1000*txIndex), ibs.GetBalance(recipient))
+
+		expectedMsg, _, expected, _, err := ComputeTxEnv(ctx, getter, gspec.Config, chain, tx, block.Hash(), txIndex)
+		require.NoError(t, err)
+		require.Equal(t, expectedMsg.Nonce(), msg.Nonce())
+		require.Equal(t, expected.GetBalance(sender), ibs.GetBalance(sender))
+
+		// the caller applies the transaction to the returned state, as the tracers do, it doesn't change the cache
+		vmenv := vm.NewEVM(vmctx, ibs, gspec.Config, vm.Config{})
+		_, err = core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+		require.NoError(t, err)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		check(i)
+	}
+	require.Equal(t, TxEnvCacheStats{Hits: n - 1, Misses: 1, Applied: n - 1}, cache.Stats(),
+		fmt.Sprintf("%d transactions must be applied, not %d", n-1, n*(n-1)/2))
+
+	// back to an earlier transaction - the state is computed from the parent block again
+	check(5)
+	require.Equal(t, TxEnvCacheStats{Hits: n - 1, Misses: 2, Applied: n - 1 + 5}, cache.Stats())
+	check(10)
+	require.Equal(t, TxEnvCacheStats{Hits: n, Misses: 2, Applied: n - 1 + 10}, cache.Stats())
+
+	// the nil cache computes from scratch
+	var noCache *TxEnvCache
+	_, _, ibs, _, err := noCache.ComputeTxEnv(ctx, getter, gspec.Config, chain, tx, block.Hash(), 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ibs.GetNonce(sender))
+}
@@ -19,7 +19,6 @@
 package trie
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 
@@ -58,8 +57,11 @@ func Load(r io.Reader) (*Trie, error) {
 	return BuildTrieFromWitness(witness, false, false)
 }
 
+// PrintDiff prints the points where the tries diverge, one per line
 func (t *Trie) PrintDiff(t2 *Trie, w io.Writer) {
-	printDiff(t.root, t2.root, w, "", "0x")
+	for _, e := range t.Diff(t2, 0) {
+		fmt.Fprintf(w, "%s\n", e)
+	}
 }
 
 func (n *fullNode) fstring(ind string) string {
@@ -147,152 +149,6 @@ func (an accountNode) print(w io.Writer) {
 	fmt.Fprintf(w, "v(%x)", encodedAccount)
 }
 
-func printDiffSide(n node, w io.Writer, ind string, key string) {
-	switch n := n.(type) {
-	case *fullNode:
-		fmt.Fprintf(w, "full(\n")
-		for i, child := range &n.Children {
-			if child != nil {
-				fmt.Fprintf(w, "%s%s:", ind, indices[i])
-				printDiffSide(child, w, "  "+ind, key+indices[i])
-				fmt.Fprintf(w, "\n")
-			}
-		}
-		fmt.Fprintf(w, "%s)\n", ind)
-	case *duoNode:
-		fmt.Fprintf(w, "duo(\n")
-		i1, i2 := n.childrenIdx()
-		fmt.Fprintf(w, "%s%s:", ind, indices[i1])
-		printDiffSide(n.child1, w, "  "+ind, key+indices[i1])
-		fmt.Fprintf(w, "\n")
-		fmt.Fprintf(w, "%s%s:", ind, indices[i2])
-		printDiffSide(n.child2, w, "  "+ind, key+indices[i2])
-		fmt.Fprintf(w, "\n")
-		fmt.Fprintf(w, "%s)\n", ind)
-	case *shortNode:
-		fmt.Fprintf(w, "short %x(", n.reference())
-		keyHex := n.Key
-		hexV := make([]byte, len(keyHex))
-		for i := 0; i < len(hexV); i++ {
-			hexV[i] = []byte(indices[keyHex[i]])[0]
-		}
-		fmt.Fprintf(w, "%s:", string(hexV))
-		printDiffSide(n.Val, w, "  "+ind, key+string(hexV))
-		fmt.Fprintf(w, "\n")
-		fmt.Fprintf(w, "%s)\n", ind)
-	case hashNode:
-		fmt.Fprintf(w, "hash(%x)", n.hash)
-	case valueNode:
-		fmt.Fprintf(w, "value(%s %x)", key, []byte(n))
-	case *accountNode:
-		fmt.Fprintf(w, "account(%s %x)", key, n)
-	}
-}
-
-func printDiff(n1, n2 node, w io.Writer, ind string, key string) {
-	if nv1, ok := n1.(valueNode); ok {
-		fmt.Fprintf(w, "value(")
-		if n, ok := n2.(valueNode); ok {
-			fmt.Fprintf(w, "%s %x/%x", key, []byte(nv1), []byte(n))
-		} else {
-			fmt.Fprintf(w, "/%T", n2)
-		}
-		fmt.Fprintf(w, ")")
-		return
-	}
-	if n2 != nil && bytes.Equal(n1.reference(), n2.reference()) {
-		fmt.Fprintf(w, "hash(%x)", n1.reference())
-		if len(n1.reference()) == 0 {
-			fmt.Fprintf(w, "%s/%s", n1.fstring(""), n2.fstring(""))
-		}
-		return
-	}
-	switch n1 := n1.(type) {
-	case *fullNode:
-		fmt.Fprintf(w, "full(\n")
-		if n, ok := n2.(*fullNode); ok {
-			for i, child := range &n1.Children {
-				child2 := n.Children[i]
-				if child == nil {
-					if child2 != nil {
-						fmt.Fprintf(w, "%s%s:(nil/%x %T)\n", ind, indices[i], child2.reference(), child2)
-					}
-				} else if child2 == nil {
-					fmt.Fprintf(w, "%s%s:(%T/nil)\n", ind, indices[i], child)
-					printDiffSide(child, w, ind, key+indices[i])
-				} else {
-					fmt.Fprintf(w, "%s%s:", ind, indices[i])
-					printDiff(child, child2, w, "  "+ind, key+indices[i])
-					fmt.Fprintf(w, "\n")
-				}
-			}
-		} else {
-			fmt.Fprintf(w, "%s/%T\n", ind, n2)
-			printDiffSide(n1, w, ind, key)
-			printDiffSide(n2, w, ind, key)
-		}
-		fmt.Fprintf(w, "%s)\n", ind)
-	case *duoNode:
-		fmt.Fprintf(w, "duo(\n")
-		if n, ok := n2.(*duoNode); ok {
-			i1, i2 := n1.childrenIdx()
-			j1, j2 := n.childrenIdx()
-			if i1 == j1 {
-				fmt.Fprintf(w, "%s%s:", ind, indices[i1])
-				printDiff(n1.child1, n.child1, w, "  "+ind, key+indices[i1])
-				fmt.Fprintf(w, "\n")
-			} else {
-				fmt.Fprintf(w, "%s%s:(/%s)", ind, indices[i1], indices[j1])
-			}
-			if i2 == j2 {
-				fmt.Fprintf(w, "%s%s:", ind, indices[i2])
-				printDiff(n1.child2, n.child2, w, "  "+ind, key+indices[i2])
-				fmt.Fprintf(w, "\n")
-			} else {
-				fmt.Fprintf(w, "%s%s:(/%s)", ind, indices[i2], indices[j2])
-			}
-		} else {
-			fmt.Fprintf(w, "%s/%T\n", ind, n2)
-			printDiffSide(n1, w, ind, key)
-		}
-		fmt.Fprintf(w, "%s)\n", ind)
-	case *shortNode:
-		fmt.Fprintf(w, "short(")
-		if n, ok := n2.(*shortNode); ok {
-			if bytes.Equal(n1.Key, n.Key) {
-				keyHex := n1.Key
-				hexV := make([]byte, len(keyHex))
-				for i := 0; i < len(hexV); i++ {
-					hexV[i] = []byte(indices[keyHex[i]])[0]
-				}
-				fmt.Fprintf(w, "%s:", string(hexV))
-				printDiff(n1.Val, n.Val, w, "  "+ind, key+string(hexV))
-				fmt.Fprintf(w, "\n")
-			} else {
-				fmt.Fprintf(w, "%x:(/%x)", n1.Key, n.Key)
-				fmt.Fprintf(w, "\n:LEFT\n")
-				printDiffSide(n1, w, ind, key)
-				fmt.Fprintf(w, "\nRIGHT\n")
-				printDiffSide(n2, w, ind, key)
-			}
-		} else {
-			fmt.Fprintf(w, "/%T\n", n2)
-			printDiffSide(n1, w, ind, key)
-			printDiffSide(n2, w, ind, key)
-		}
-		fmt.Fprintf(w, "%s)\n", ind)
-	case hashNode:
-		fmt.Fprintf(w, "hash(")
-		if n, ok := n2.(hashNode); ok {
-			fmt.Fprintf(w, "%x/%x", n1.hash, n.hash)
-		} else {
-			fmt.Fprintf(w, "hash(%x)/%T(%x)\n", n1.hash, n2, n2.reference())
-			//printDiffSide(n2, w, ind, key)
-		}
-		fmt.Fprintf(w, ")")
-	}
-}
-
 func (t *Trie) HashOfHexKey(hexKey []byte) (common.Hash, error) {
 	nd := t.root
 	pos := 0
@@ -33,3 +33,16 @@ type MissingNodeError struct {
 func (err *MissingNodeError) Error() string {
 	return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
 }
+
+// ErrTruncatedWitness is returned by BuildTrieFromWitness when an operator of the witness
+// needs more nodes than the preceding operators have produced.
+type ErrTruncatedWitness struct {
+	Index     int    // index of the offending operator
+	Operator  string // type of the offending operator
+	Needed    int    // number of nodes the operator consumes
+	Available int    // number of nodes produced by the preceding operators
+}
+
+func (err *ErrTruncatedWitness) Error() string {
+	return fmt.Sprintf("truncated witness: operator %d (%s) needs %d nodes, only %d available", err.Index, err.Operator, err.Needed, err.Available)
+}
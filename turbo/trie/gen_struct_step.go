@@ -41,8 +41,41 @@ type structInfoReceiver interface {
 	topHash() []byte
 }
 
-// hashCollector gets called whenever there might be a need to create intermediate hash record
-type HashCollector func(keyHex []byte, hash []byte) error
+// IHNodeType is the kind of the trie node an intermediate hash record is collected for
+type IHNodeType uint8
+
+const (
+	IHAccountBranch IHNodeType = iota // Branch node of the account trie
+	IHStorageBranch                   // Branch node of a storage trie
+	IHShortNode                       // Extension node of either trie
+)
+
+// ihBranchType returns the type of the branch node at the given path. Paths longer than
+// the account key are in storage tries
+func ihBranchType(keyHex []byte) IHNodeType {
+	if len(keyHex) > 2*common.HashLength {
+		return IHStorageBranch
+	}
+	return IHAccountBranch
+}
+
+// HashCollector gets called whenever there might be a need to create intermediate hash record.
+// If del is true, the record for keyHex is stale and needs to be removed, and hash is nil
+type HashCollector func(keyHex []byte, nodeType IHNodeType, hash []byte, del bool) error
+
+// HashCollectorFunc adapts the collectors taking only the key and the hash, with nil hash for
+// deletions. Only branch nodes are passed on to them
+func HashCollectorFunc(f func(keyHex []byte, hash []byte) error) HashCollector {
+	return func(keyHex []byte, nodeType IHNodeType, hash []byte, del bool) error {
+		if nodeType == IHShortNode {
+			return nil
+		}
+		if del {
+			return f(keyHex, nil)
+		}
+		return f(keyHex, hash)
+	}
+}
 
 func calcPrecLen(groups []uint16) int {
 	if len(groups) == 0 {
@@ -178,6 +211,11 @@ func GenStructStep(
 						return nil, err
 					}
 				}
+				if h != nil {
+					if err := h(curr[:remainderStart], IHShortNode, e.topHash(), false); err != nil {
+						return nil, err
+					}
+				}
 			}
 		}
 		// Check for the optional part
@@ -196,7 +234,7 @@ func GenStructStep(
 				}
 			}
 			if h != nil {
-				if err := h(curr[:maxLen], e.topHash()); err != nil {
+				if err := h(curr[:maxLen], ihBranchType(curr[:maxLen]), e.topHash(), false); err != nil {
 					return nil, err
 				}
 			}
@@ -0,0 +1,42 @@
+package trie
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// ETLHashCollector buffers the intermediate hashes of the branch nodes in an etl.Collector, and loads
+// them into IntermediateTrieHashBucket with the keys in the CompressNibbles form.
+// Deletions are collected as empty values, which remove the records when loaded
+type ETLHashCollector struct {
+	collector *etl.Collector
+}
+
+// NewETLHashCollector creates the collector which flushes its buffer into tmpdir every time it grows over bufferSize
+func NewETLHashCollector(tmpdir string, bufferSize int) *ETLHashCollector {
+	return &ETLHashCollector{collector: etl.NewCollector(tmpdir, etl.NewSortableBuffer(bufferSize))}
+}
+
+// Collect is the HashCollector to pass to the loaders
+func (c *ETLHashCollector) Collect(keyHex []byte, nodeType IHNodeType, hash []byte, del bool) error {
+	if nodeType == IHShortNode {
+		return nil
+	}
+	// Keys with odd number of nibbles cannot be compressed
+	if len(keyHex)%2 != 0 || len(keyHex) == 0 {
+		return nil
+	}
+	var k []byte
+	CompressNibbles(keyHex, &k)
+	if del {
+		return c.collector.Collect(k, nil)
+	}
+	return c.collector.Collect(k, common.CopyBytes(hash))
+}
+
+// Load writes the collected records into IntermediateTrieHashBucket
+func (c *ETLHashCollector) Load(logPrefix string, db ethdb.Database, quit <-chan struct{}) error {
+	return c.collector.Load(logPrefix, db, dbutils.IntermediateTrieHashBucket, etl.IdentityLoadFunc, etl.TransformArgs{Quit: quit})
+}
@@ -0,0 +1,81 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/etl"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyHashCollector is the two-argument collector the ETLHashCollector replaces
+func legacyHashCollector(collector *etl.Collector) HashCollector {
+	return HashCollectorFunc(func(keyHex []byte, hash []byte) error {
+		if len(keyHex)%2 != 0 || len(keyHex) == 0 {
+			return nil
+		}
+		var k []byte
+		CompressNibbles(keyHex, &k)
+		if hash == nil {
+			return collector.Collect(k, nil)
+		}
+		return collector.Collect(k, common.CopyBytes(hash))
+	})
+}
+
+func hashCollectorFixture(t *testing.T) ethdb.Database {
+	db := ethdb.NewMemDatabase()
+	for i := 0; i < 500; i++ {
+		putChangeSetsAccount(t, db, i, uint64(i))
+	}
+	for i := 0; i < 3; i++ {
+		for slot := byte(0); slot < 50; slot++ {
+			require.NoError(t, db.Put(dbutils.CurrentStateBucket, changeSetsStorageKey(i, slot), []byte{slot + 1}))
+		}
+	}
+	return db
+}
+
+func walkIntermediateHashes(t *testing.T, db ethdb.Database) [][2][]byte {
+	var records [][2][]byte
+	require.NoError(t, db.Walk(dbutils.IntermediateTrieHashBucket, nil, 0, func(k, v []byte) (bool, error) {
+		records = append(records, [2][]byte{common.CopyBytes(k), common.CopyBytes(v)})
+		return true, nil
+	}))
+	return records
+}
+
+func TestETLHashCollector(t *testing.T) {
+	legacyDb, etlDb := hashCollectorFixture(t), hashCollectorFixture(t)
+	defer legacyDb.Close()
+	defer etlDb.Close()
+
+	// The first pass creates the records, the second one retains a few keys, which deletes the records on their paths
+	retains := []*RetainList{NewRetainList(0), NewRetainList(0)}
+	retains[1].AddKey(changeSetsAddrHash(3).Bytes())
+	retains[1].AddKey(changeSetsStorageKey(1, 7))
+	for pass, rl := range retains {
+		legacy := etl.NewCollector("", etl.NewSortableBuffer(etl.BufferOptimalSize))
+		loader := NewFlatDbSubTrieLoader()
+		require.NoError(t, loader.Reset(legacyDb, rl, rl, legacyHashCollector(legacy), [][]byte{nil}, []int{0}, false))
+		legacyHashes, err := loader.LoadSubTries()
+		require.NoError(t, err)
+		require.NoError(t, legacy.Load("legacy", legacyDb, dbutils.IntermediateTrieHashBucket, etl.IdentityLoadFunc, etl.TransformArgs{}))
+
+		rl.Rewind()
+		// Small buffer makes the collector flush into files
+		collector := NewETLHashCollector("", 256)
+		loader = NewFlatDbSubTrieLoader()
+		require.NoError(t, loader.Reset(etlDb, rl, rl, collector.Collect, [][]byte{nil}, []int{0}, false))
+		etlHashes, err := loader.LoadSubTries()
+		require.NoError(t, err)
+		require.NoError(t, collector.Load("etl", etlDb, nil))
+
+		require.Equal(t, legacyHashes.Hashes, etlHashes.Hashes)
+		expected := walkIntermediateHashes(t, legacyDb)
+		require.NotEmpty(t, expected)
+		require.Equal(t, expected, walkIntermediateHashes(t, etlDb), "pass %d", pass)
+	}
+}
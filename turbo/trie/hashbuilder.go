@@ -340,7 +340,7 @@ func (hb *HashBuilder) extension(key []byte) error {
 	case nil:
 		branchHash := common.CopyBytes(hb.hashStack[len(hb.hashStack)-common.HashLength:])
 		s = &shortNode{Key: common.CopyBytes(key), Val: hashNode{hash: branchHash}}
-	case *fullNode:
+	case *fullNode, *duoNode:
 		s = &shortNode{Key: common.CopyBytes(key), Val: n}
 	default:
 		return fmt.Errorf("wrong Val type for an extension: %T", nd)
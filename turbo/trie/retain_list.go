@@ -39,9 +39,15 @@ type RetainList struct {
 	minLength   int  // Mininum length of prefixes for which `HashOnly` function can return `true`
 	lteIndex    int  // Index of the "LTE" key in the keys slice. Next one is "GT"
 	hexes       sortable
+	ranges      []retainInterval // Sorted disjoint intervals of keys, in the same encoding as hexes
 	codeTouches map[common.Hash]struct{}
 }
 
+// retainInterval is the interval of keys between from and to, inclusive
+type retainInterval struct {
+	from, to []byte
+}
+
 // NewRetainList creates new RetainList
 func NewRetainList(minLength int) *RetainList {
 	return &RetainList{minLength: minLength, codeTouches: make(map[common.Hash]struct{})}
@@ -63,6 +69,7 @@ func (rl *RetainList) AddKey(key []byte) {
 
 // AddHex adds a new key (in HEX encoding) to the list
 func (rl *RetainList) AddHex(hex []byte) {
+	rl.inited = false // keys added after the first Retain are sorted again
 	if rl.binary {
 		rl.hexes = append(rl.hexes, keyHexToBin(hex))
 	} else {
@@ -70,6 +77,60 @@ func (rl *RetainList) AddHex(hex []byte) {
 	}
 }
 
+// AddRange adds all the keys (in HEX encoding) between fromHex and toHex inclusive to the list.
+// Overlapping ranges are merged
+func (rl *RetainList) AddRange(fromHex, toHex []byte) {
+	from, to := common.CopyBytes(fromHex), common.CopyBytes(toHex)
+	if rl.binary {
+		from, to = keyHexToBin(from), keyHexToBin(to)
+	}
+	if bytes.Compare(from, to) > 0 {
+		from, to = to, from
+	}
+	// Ranges starting before the new one stay in place, unless the last of them overlaps it
+	i := sort.Search(len(rl.ranges), func(i int) bool { return bytes.Compare(rl.ranges[i].from, from) > 0 })
+	if i > 0 && bytes.Compare(rl.ranges[i-1].to, from) >= 0 {
+		i--
+		from = rl.ranges[i].from
+	}
+	// Ranges starting inside the new one are absorbed by it
+	j := i
+	for ; j < len(rl.ranges) && bytes.Compare(rl.ranges[j].from, to) <= 0; j++ {
+		if bytes.Compare(rl.ranges[j].to, to) > 0 {
+			to = rl.ranges[j].to
+		}
+	}
+	merged := retainInterval{from: from, to: to}
+	if i == j {
+		rl.ranges = append(rl.ranges, retainInterval{})
+		copy(rl.ranges[i+1:], rl.ranges[i:])
+		rl.ranges[i] = merged
+		return
+	}
+	rl.ranges[i] = merged
+	rl.ranges = append(rl.ranges[:i+1], rl.ranges[j:]...)
+}
+
+// inRanges checks whether any of the keys with the given prefix is in the ranges of the list
+func (rl *RetainList) inRanges(prefix []byte) bool {
+	// Binary search for the first range starting after the prefix
+	lo, hi := 0, len(rl.ranges)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if bytes.Compare(rl.ranges[mid].from, prefix) > 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	// The prefix itself is in the preceding range
+	if lo > 0 && bytes.Compare(prefix, rl.ranges[lo-1].to) <= 0 {
+		return true
+	}
+	// Keys with the prefix which are greater than the prefix, start with it
+	return lo < len(rl.ranges) && bytes.HasPrefix(rl.ranges[lo].from, prefix)
+}
+
 // AddCodeTouch adds a new code touch into the resolve set
 func (rl *RetainList) AddCodeTouch(codeHash common.Hash) {
 	rl.codeTouches[codeHash] = struct{}{}
@@ -95,12 +156,16 @@ func (rl *RetainList) ensureInited() {
 // checking if this is prefix of any of the keys added to the set
 // Since keys in the set are sorted, and we expect that the prefixes will
 // come in monotonically ascending order, we optimise for this, though
-// the function would still work if the order is different
+// the function would still work if the order is different.
+// It also returns true if the prefix is a prefix of any key in the ranges added to the set
 func (rl *RetainList) Retain(prefix []byte) bool {
 	rl.ensureInited()
 	if len(prefix) < rl.minLength {
 		return true
 	}
+	if len(rl.ranges) > 0 && rl.inRanges(prefix) {
+		return true
+	}
 	// Adjust "GT" if necessary
 	var gtAdjusted bool
 	for rl.lteIndex < len(rl.hexes)-1 && bytes.Compare(rl.hexes[rl.lteIndex+1], prefix) <= 0 {
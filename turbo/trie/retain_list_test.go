@@ -0,0 +1,126 @@
+package trie
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+// retainListTest is a random set of keys and ranges over a small alphabet of nibbles, so that the brute-force
+// reference can enumerate all the keys up to the maximum length
+type retainListTest struct {
+	keys   [][]byte
+	ranges [][2][]byte
+}
+
+const (
+	retainTestAlphabet = 3
+	retainTestMaxLen   = 4
+)
+
+func retainTestUniverse() [][]byte {
+	universe := [][]byte{{}}
+	for prev := [][]byte{{}}; len(prev[0]) < retainTestMaxLen; {
+		var next [][]byte
+		for _, p := range prev {
+			for n := byte(0); n < retainTestAlphabet; n++ {
+				next = append(next, append(append([]byte{}, p...), n))
+			}
+		}
+		universe = append(universe, next...)
+		prev = next
+	}
+	sort.Slice(universe, func(i, j int) bool { return bytes.Compare(universe[i], universe[j]) < 0 })
+	return universe
+}
+
+func (retainListTest) Generate(r *rand.Rand, size int) reflect.Value {
+	genKey := func() []byte {
+		key := make([]byte, 1+r.Intn(retainTestMaxLen))
+		for i := range key {
+			key[i] = byte(r.Intn(retainTestAlphabet))
+		}
+		return key
+	}
+	var test retainListTest
+	for i := r.Intn(4); i > 0; i-- {
+		test.keys = append(test.keys, genKey())
+	}
+	for i := r.Intn(6); i > 0; i-- {
+		test.ranges = append(test.ranges, [2][]byte{genKey(), genKey()})
+	}
+	return reflect.ValueOf(test)
+}
+
+// retain is the brute-force reference: the prefix is retained if any key with it is in the list or in a range
+func (test retainListTest) retain(universe [][]byte, prefix []byte) bool {
+	for _, key := range test.keys {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	for _, key := range universe {
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, r := range test.ranges {
+			from, to := r[0], r[1]
+			if bytes.Compare(from, to) > 0 {
+				from, to = to, from
+			}
+			if bytes.Compare(from, key) <= 0 && bytes.Compare(key, to) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestRetainListRanges(t *testing.T) {
+	universe := retainTestUniverse()
+	check := func(test retainListTest) bool {
+		rl := NewRetainList(0)
+		for _, key := range test.keys {
+			rl.AddHex(key)
+		}
+		for _, r := range test.ranges {
+			rl.AddRange(r[0], r[1])
+		}
+		for i := 1; i < len(rl.ranges); i++ {
+			if bytes.Compare(rl.ranges[i-1].to, rl.ranges[i].from) >= 0 {
+				t.Logf("ranges are not sorted and disjoint: %x", rl.ranges)
+				return false
+			}
+		}
+		for _, prefix := range universe {
+			if rl.Retain(prefix) != test.retain(universe, prefix) {
+				t.Logf("unexpected Retain(%x) = %t for keys %x, ranges %x", prefix, rl.Retain(prefix), test.keys, test.ranges)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetainListRangesNoAllocs(t *testing.T) {
+	rl := NewRetainList(0)
+	rl.AddHex([]byte{1, 2, 3})
+	rl.AddRange([]byte{2, 0}, []byte{2, 5})
+	rl.AddRange([]byte{4}, []byte{5, 1})
+	prefixes := [][]byte{{}, {1}, {1, 2}, {2, 3, 1}, {3}, {5, 0, 7}, {6}}
+	allocs := testing.AllocsPerRun(100, func() {
+		rl.Rewind()
+		for _, prefix := range prefixes {
+			rl.Retain(prefix)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %f", allocs)
+	}
+}
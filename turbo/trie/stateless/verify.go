@@ -0,0 +1,175 @@
+// Package stateless executes blocks against the state trie reconstructed from block witnesses,
+// without access to the state database
+package stateless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/consensus"
+	"github.com/ledgerwatch/turbo-geth/consensus/misc"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/turbo/trie"
+)
+
+// ErrWitnessIncomplete is returned by VerifyBlockWitness when the execution of the block
+// reads parts of the state which are not in the witness.
+type ErrWitnessIncomplete struct {
+	Prefixes [][]byte // nibble paths of the hash nodes on the way to the absent keys, or of the accounts with absent code
+}
+
+func (err *ErrWitnessIncomplete) Error() string {
+	prefixes := make([]string, len(err.Prefixes))
+	for i, prefix := range err.Prefixes {
+		var sb strings.Builder
+		for _, nibble := range prefix {
+			sb.WriteByte("0123456789abcdef"[nibble&0xf])
+		}
+		prefixes[i] = sb.String()
+	}
+	return fmt.Sprintf("witness is incomplete, absent prefixes: [%s]", strings.Join(prefixes, " "))
+}
+
+// VerifyBlockWitness rebuilds the state trie from the witness, checks that its root is expectedRoot
+// (the state root of the parent block), executes the transactions of the block on top of it
+// and checks the resulting state root against the header of the block. The engine finalizes the block, it must be
+// the engine of the chain, e.g. ethash for block rewards. Only the parent block hash is available to the BLOCKHASH opcode
+func VerifyBlockWitness(chainConfig *params.ChainConfig, engine consensus.Engine, block *types.Block, witness *trie.Witness, expectedRoot common.Hash) error {
+	if block.NumberU64() == 0 {
+		return errors.New("genesis block has no parent state to verify against")
+	}
+	s, err := state.NewStateless(expectedRoot, witness, block.NumberU64()-1, false /* trace */, false /* isBinary */)
+	if err != nil {
+		return err
+	}
+	s.SetBlockNr(block.NumberU64())
+	ws := &witnessState{Stateless: s, seen: make(map[string]struct{})}
+	ibs := state.New(ws)
+
+	header := block.Header()
+	chain := &headerlessChain{engine: engine}
+	if chainConfig.DAOForkSupport && chainConfig.DAOForkBlock != nil && chainConfig.DAOForkBlock.Cmp(block.Number()) == 0 {
+		misc.ApplyDAOHardFork(ibs)
+	}
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	usedGas := new(uint64)
+	for i, tx := range block.Transactions() {
+		ibs.Prepare(tx.Hash(), block.Hash(), i)
+		if _, err = core.ApplyTransaction(chainConfig, chain, nil, gp, ibs, ws, header, tx, usedGas, vm.Config{}); err != nil {
+			// Transactions may fail because the absent state was taken for empty
+			if ws.incomplete() != nil {
+				return ws.incomplete()
+			}
+			return fmt.Errorf("tx %x failed: %w", tx.Hash(), err)
+		}
+	}
+	engine.Finalize(chainConfig, header, ibs, block.Transactions(), block.Uncles())
+	if err = ws.incomplete(); err != nil {
+		return err
+	}
+	if err = ibs.Error(); err != nil {
+		return err
+	}
+	ctx := chainConfig.WithEIPsFlags(context.Background(), header.Number)
+	if err = ibs.CommitBlock(ctx, ws); err != nil {
+		return fmt.Errorf("committing block %d failed: %w", block.NumberU64(), err)
+	}
+	return s.CheckRoot(header.Root)
+}
+
+// witnessState is the state reader and writer over the trie built from the witness.
+// It records the absent parts of the state which the reads have run into
+type witnessState struct {
+	*state.Stateless
+	absent [][]byte
+	seen   map[string]struct{}
+}
+
+func (s *witnessState) incomplete() error {
+	if len(s.absent) == 0 {
+		return nil
+	}
+	return &ErrWitnessIncomplete{Prefixes: s.absent}
+}
+
+// addAbsent records the hash nodes on the path to the key (hashed account key or hashed storage key
+// with incarnation). If there are none, the key itself is recorded
+func (s *witnessState) addAbsent(key []byte) {
+	rl := trie.NewRetainList(0)
+	rl.AddKey(key)
+	_, _, hooks := s.GetTrie().FindSubTriesToLoad(rl)
+	if len(hooks) == 0 {
+		hex := make([]byte, 2*len(key))
+		for i, b := range key {
+			hex[2*i], hex[2*i+1] = b>>4, b&0xf
+		}
+		hooks = [][]byte{hex}
+	}
+	for _, hook := range hooks {
+		if _, ok := s.seen[string(hook)]; ok {
+			continue
+		}
+		s.seen[string(hook)] = struct{}{}
+		s.absent = append(s.absent, hook)
+	}
+}
+
+func (s *witnessState) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	acc, err := s.Stateless.ReadAccountData(address)
+	if err != nil {
+		s.addAbsent(addrHash(address).Bytes())
+	}
+	return acc, err
+}
+
+func (s *witnessState) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	enc, err := s.Stateless.ReadAccountStorage(address, incarnation, key)
+	if err != nil {
+		keyHash, _ := common.HashData(key[:])
+		s.addAbsent(dbutils.GenerateCompositeStorageKey(addrHash(address), incarnation, keyHash))
+	}
+	return enc, err
+}
+
+func (s *witnessState) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	code, err := s.Stateless.ReadAccountCode(address, codeHash)
+	if err != nil {
+		s.addAbsent(addrHash(address).Bytes())
+	}
+	return code, err
+}
+
+func (s *witnessState) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	codeSize, err := s.Stateless.ReadAccountCodeSize(address, codeHash)
+	if err != nil {
+		s.addAbsent(addrHash(address).Bytes())
+	}
+	return codeSize, err
+}
+
+func addrHash(address common.Address) common.Hash {
+	h, _ := common.HashData(address[:])
+	return h
+}
+
+// headerlessChain is the chain context of a single block, without access to the earlier headers
+type headerlessChain struct {
+	engine consensus.Engine
+}
+
+func (c *headerlessChain) Engine() consensus.Engine {
+	return c.engine
+}
+
+func (c *headerlessChain) GetHeader(common.Hash, uint64) *types.Header {
+	return nil
+}
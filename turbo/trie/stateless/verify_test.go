@@ -0,0 +1,74 @@
+package stateless
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/turbo/trie"
+)
+
+func TestVerifyBlockWitness(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	recipient := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	other := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: core.GenesisAlloc{
+			sender:    {Balance: big.NewInt(params.Ether)},
+			recipient: {Balance: big.NewInt(1)},
+			other:     {Balance: big.NewInt(2)},
+		},
+	}
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	genesis := gspec.MustCommit(db)
+	signer := types.MakeSigner(gspec.Config, big.NewInt(1))
+	blocks, _, err := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 1, func(i int, b *core.BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(sender), recipient, uint256.NewInt().SetUint64(1000), params.TxGas, uint256.NewInt(), nil), signer, key)
+		require.NoError(t, err)
+		b.AddTx(tx)
+	}, false /* intermediateHashes */)
+	require.NoError(t, err)
+	block := blocks[0]
+
+	// The reference state of the parent block is the genesis trie
+	_, _, tds, err := gspec.ToBlock(nil, false)
+	require.NoError(t, err)
+	tr := tds.Trie()
+	require.Equal(t, genesis.Root(), tr.Hash())
+
+	witness, err := tr.ExtractWitness(false, trie.NewRetainAll(nil))
+	require.NoError(t, err)
+	require.NoError(t, VerifyBlockWitness(gspec.Config, ethash.NewFaker(), block, witness, genesis.Root()))
+	require.Error(t, VerifyBlockWitness(gspec.Config, ethash.NewFaker(), genesis, witness, genesis.Root()), "genesis has no parent")
+
+	// The witness without the recipient of the transfer
+	rl := trie.NewRetainList(0)
+	for _, address := range []common.Address{sender, block.Coinbase()} {
+		rl.AddKey(crypto.Keccak256(address[:]))
+	}
+	witness, err = tr.ExtractWitness(false, rl)
+	require.NoError(t, err)
+	err = VerifyBlockWitness(gspec.Config, ethash.NewFaker(), block, witness, genesis.Root())
+	var incomplete *ErrWitnessIncomplete
+	require.True(t, errors.As(err, &incomplete), "unexpected error %v", err)
+	require.NotEmpty(t, incomplete.Prefixes)
+	recipientHash := crypto.Keccak256(recipient[:])
+	for _, prefix := range incomplete.Prefixes {
+		for i, nibble := range prefix {
+			require.Equal(t, recipientHash[i/2]>>(4*(1-uint(i%2)))&0xf, nibble, "prefix %x is not on the path to the recipient", prefix)
+		}
+	}
+}
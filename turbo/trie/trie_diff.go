@@ -0,0 +1,192 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// DiffKind is the kind of the divergence between two tries
+type DiffKind uint8
+
+const (
+	DiffMissingLeft   DiffKind = iota // the node is only present in the right trie
+	DiffMissingRight                  // the node is only present in the left trie
+	DiffValueMismatch                 // the leaves (values or accounts) at the same path differ
+	DiffHashMismatch                  // the nodes at the same path cannot be compared further and their hashes differ
+)
+
+var diffKindNames = [...]string{"missing-left", "missing-right", "value-mismatch", "hash-mismatch"}
+
+func (k DiffKind) String() string {
+	if int(k) < len(diffKindNames) {
+		return diffKindNames[k]
+	}
+	return fmt.Sprintf("DiffKind(%d)", k)
+}
+
+func (k DiffKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// DiffEntry is a point where two tries diverge. The subtries below it are not compared
+type DiffEntry struct {
+	Path      []byte // nibbles of the path to the node, including incarnation-less storage paths
+	Kind      DiffKind
+	LeftHash  []byte // reference of the left node, or the hash of the leaf value
+	RightHash []byte // reference of the right node, or the hash of the leaf value
+	Depth     int    // number of nodes above the divergence
+}
+
+func (e DiffEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path      string   `json:"path"`
+		Kind      DiffKind `json:"kind"`
+		LeftHash  string   `json:"leftHash,omitempty"`
+		RightHash string   `json:"rightHash,omitempty"`
+		Depth     int      `json:"depth"`
+	}{
+		Path:      nibblesString(e.Path),
+		Kind:      e.Kind,
+		LeftHash:  fmt.Sprintf("%x", e.LeftHash),
+		RightHash: fmt.Sprintf("%x", e.RightHash),
+		Depth:     e.Depth,
+	})
+}
+
+func (e DiffEntry) String() string {
+	return fmt.Sprintf("%s path=%s depth=%d left=%x right=%x", e.Kind, nibblesString(e.Path), e.Depth, e.LeftHash, e.RightHash)
+}
+
+func nibblesString(nibbles []byte) string {
+	s := make([]byte, len(nibbles))
+	for i, n := range nibbles {
+		s[i] = indices[n][0]
+	}
+	return string(s)
+}
+
+// Diff walks both tries down from the roots, skipping the subtries with equal hashes, and returns
+// the points where they diverge, in the order of their paths.
+// If limit is not 0, the walk stops after that many entries
+func (t *Trie) Diff(other *Trie, limit int) []DiffEntry {
+	// References of the nodes are needed to skip equal subtries
+	t.Hash()
+	other.Hash()
+	d := &differ{limit: limit}
+	d.diff(t.root, other.root, nil, 0)
+	return d.entries
+}
+
+type differ struct {
+	entries []DiffEntry
+	limit   int
+}
+
+func (d *differ) done() bool {
+	return d.limit != 0 && len(d.entries) >= d.limit
+}
+
+func (d *differ) add(kind DiffKind, path []byte, n1, n2 node, depth int) {
+	if d.done() {
+		return
+	}
+	d.entries = append(d.entries, DiffEntry{
+		Path:      common.CopyBytes(path),
+		Kind:      kind,
+		LeftHash:  diffHash(n1),
+		RightHash: diffHash(n2),
+		Depth:     depth,
+	})
+}
+
+// diffHash returns the reference of the node, or the hash of the leaf
+func diffHash(n node) []byte {
+	switch n := n.(type) {
+	case nil:
+		return nil
+	case valueNode:
+		return crypto.Keccak256(n)
+	case *accountNode:
+		enc := make([]byte, n.EncodingLengthForHashing())
+		n.EncodeForHashing(enc)
+		return crypto.Keccak256(enc)
+	default:
+		return common.CopyBytes(n.reference())
+	}
+}
+
+// branchChild returns the i-th child of a branch node
+func branchChild(n node, i byte) node {
+	switch n := n.(type) {
+	case *fullNode:
+		return n.Children[i]
+	case *duoNode:
+		i1, i2 := n.childrenIdx()
+		if i == i1 {
+			return n.child1
+		}
+		if i == i2 {
+			return n.child2
+		}
+	}
+	return nil
+}
+
+func (d *differ) diff(n1, n2 node, path []byte, depth int) {
+	if d.done() {
+		return
+	}
+	switch {
+	case n1 == nil && n2 == nil:
+		return
+	case n1 == nil:
+		d.add(DiffMissingLeft, path, n1, n2, depth)
+		return
+	case n2 == nil:
+		d.add(DiffMissingRight, path, n1, n2, depth)
+		return
+	}
+	if ref1, ref2 := n1.reference(), n2.reference(); len(ref1) > 0 && bytes.Equal(ref1, ref2) {
+		return
+	}
+	switch n1 := n1.(type) {
+	case *fullNode, *duoNode:
+		switch n2.(type) {
+		case *fullNode, *duoNode:
+			for i := byte(0); i < 16; i++ {
+				d.diff(branchChild(n1, i), branchChild(n2, i), append(path, i), depth+1)
+			}
+			return
+		}
+	case *shortNode:
+		if n2, ok := n2.(*shortNode); ok && bytes.Equal(n1.Key, n2.Key) {
+			key := n1.Key
+			// Remove terminator
+			if key[len(key)-1] == 16 {
+				key = key[:len(key)-1]
+			}
+			d.diff(n1.Val, n2.Val, append(path, key...), depth+1)
+			return
+		}
+	case valueNode:
+		if n2, ok := n2.(valueNode); ok {
+			if !bytes.Equal(n1, n2) {
+				d.add(DiffValueMismatch, path, n1, n2, depth)
+			}
+			return
+		}
+	case *accountNode:
+		if n2, ok := n2.(*accountNode); ok {
+			if n1.Nonce != n2.Nonce || !n1.Balance.Eq(&n2.Balance) || n1.CodeHash != n2.CodeHash {
+				d.add(DiffValueMismatch, path, n1, n2, depth)
+			}
+			d.diff(n1.storage, n2.storage, path, depth+1)
+			return
+		}
+	}
+	d.add(DiffHashMismatch, path, n1, n2, depth)
+}
@@ -0,0 +1,57 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrieDiff(t *testing.T) {
+	key := func(first, last byte) []byte {
+		k := make([]byte, common.HashLength)
+		k[0], k[common.HashLength-1] = first, last
+		return k
+	}
+	build := func(values map[string][]byte) *Trie {
+		tr := New(common.Hash{})
+		for k, v := range values {
+			tr.Update([]byte(k), v)
+		}
+		return tr
+	}
+	values := map[string][]byte{
+		string(key(0x00, 0)): []byte("value00"),
+		string(key(0x00, 1)): []byte("value01"),
+		string(key(0x10, 0)): []byte("value10"),
+		string(key(0x10, 1)): []byte("value11"),
+	}
+	left := build(values)
+	require.Empty(t, left.Diff(build(values), 0))
+
+	// Right trie differs in one leaf under the nibble 1, and in the subtrie under the nibble 0,
+	// which is only present as a hash
+	values[string(key(0x10, 1))] = []byte("changed11")
+	values[string(key(0x00, 1))] = []byte("changed01")
+	right := build(values)
+	right.Hash()
+	evictedHash := common.CopyBytes(branchChild(right.root, 0).reference())
+	right.EvictNode([]byte{0})
+
+	leafPath := keybytesToHex(key(0x10, 1))
+	leafPath = leafPath[:len(leafPath)-1]
+	diff := left.Diff(right, 0)
+	require.Len(t, diff, 2)
+	require.Equal(t, DiffHashMismatch, diff[0].Kind)
+	require.Equal(t, []byte{0}, diff[0].Path)
+	require.Equal(t, 1, diff[0].Depth)
+	require.Equal(t, branchChild(left.root, 0).reference(), diff[0].LeftHash)
+	require.Equal(t, evictedHash, diff[0].RightHash)
+	require.Equal(t, DiffValueMismatch, diff[1].Kind)
+	require.Equal(t, leafPath, diff[1].Path)
+	require.Equal(t, crypto.Keccak256([]byte("value11")), diff[1].LeftHash)
+	require.Equal(t, crypto.Keccak256([]byte("changed11")), diff[1].RightHash)
+
+	require.Equal(t, diff[:1], left.Diff(right, 1))
+}
@@ -0,0 +1,109 @@
+package trie
+
+import (
+	"bytes"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// UpdateFromChangeSets brings the trie, loaded from an earlier state of the database, to the current state
+// of the database, and returns the new root hash. accountChanges and storageChanges are the hashed change sets
+// of the blocks since the trie was loaded (either can be nil).
+// Only the paths to the changed keys are loaded from the database, the rest of the state is represented by
+// the intermediate hashes. The nodes of the cached trie whose hashes did not change are then put back in place
+// of the hashes, so the cost of the update is proportional to the number of changes, not to the size of the state.
+// Changed keys which were not resolved in the cached trie become resolved, and are added to the retain list
+// (if it is not nil), so that it keeps describing the resolved part of the trie
+func UpdateFromChangeSets(db ethdb.Database, tr *Trie, accountChanges, storageChanges *changeset.ChangeSet, rl *RetainList) (common.Hash, error) {
+	unfurl := NewRetainList(0)
+	for _, changes := range []*changeset.ChangeSet{accountChanges, storageChanges} {
+		if changes == nil {
+			continue
+		}
+		for _, change := range changes.Changes {
+			unfurl.AddKey(change.Key)
+			if rl != nil && !tr.isResolved(change.Key) {
+				rl.AddKey(change.Key)
+			}
+		}
+	}
+	if len(unfurl.hexes) == 0 {
+		return tr.Hash(), nil
+	}
+
+	// References of the cached nodes are needed to recognise them in the loaded trie
+	tr.Hash()
+	cached := New(common.Hash{})
+	cached.root = tr.root
+
+	loader := NewSubTrieLoader(0)
+	subTries, err := loader.LoadSubTries(db, 0, unfurl, nil /* HashCollector */, [][]byte{nil}, []int{0}, false)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if subTries.roots[0] == nil {
+		tr.root = nil
+		return EmptyRoot, nil
+	}
+	// The root is replaced by the hash of the loaded trie, so that it can be hooked
+	tr.root = hashNode{hash: common.CopyBytes(subTries.Hashes[0][:])}
+	if err = tr.HookSubTries(subTries, [][]byte{nil}); err != nil {
+		return common.Hash{}, err
+	}
+	tr.root = reuseCachedNodes(cached, tr.root, nil)
+	return subTries.Hashes[0], nil
+}
+
+// isResolved checks whether the path to the key (hashed account key, or hashed storage key with incarnation)
+// does not go through a hash node
+func (t *Trie) isResolved(key []byte) bool {
+	if len(key) == common.HashLength+common.IncarnationLength+common.HashLength {
+		// Storage keys in the trie do not contain incarnation
+		storageKey := make([]byte, 2*common.HashLength)
+		copy(storageKey, key[:common.HashLength])
+		copy(storageKey[common.HashLength:], key[common.HashLength+common.IncarnationLength:])
+		_, ok := t.Get(storageKey)
+		return ok
+	}
+	_, ok := t.GetAccount(key)
+	return ok
+}
+
+// reuseCachedNodes replaces the hash nodes of the loaded trie with the nodes of the cached trie at the same
+// paths, if their hashes match
+func reuseCachedNodes(cached *Trie, nd node, hex []byte) node {
+	switch n := nd.(type) {
+	case *shortNode:
+		h := n.Key
+		// Remove terminator
+		if h[len(h)-1] == 16 {
+			h = h[:len(h)-1]
+		}
+		n.Val = reuseCachedNodes(cached, n.Val, concat(hex, h...))
+	case *duoNode:
+		i1, i2 := n.childrenIdx()
+		n.child1 = reuseCachedNodes(cached, n.child1, concat(hex, i1))
+		n.child2 = reuseCachedNodes(cached, n.child2, concat(hex, i2))
+	case *fullNode:
+		for i, child := range n.Children {
+			if child != nil {
+				n.Children[i] = reuseCachedNodes(cached, child, concat(hex, byte(i)))
+			}
+		}
+	case *accountNode:
+		if n.storage != nil {
+			n.storage = reuseCachedNodes(cached, n.storage, hex)
+		}
+	case hashNode:
+		old, _, ok, _ := cached.getNode(hex, false)
+		if !ok || old == nil {
+			return nd
+		}
+		if _, isHash := old.(hashNode); !isHash && bytes.Equal(old.reference(), n.hash) {
+			return old
+		}
+	}
+	return nd
+}
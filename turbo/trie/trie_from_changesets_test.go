@@ -0,0 +1,127 @@
+package trie
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/changeset"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/require"
+)
+
+func changeSetsAddrHash(i int) common.Hash {
+	return crypto.Keccak256Hash([]byte{byte(i >> 16), byte(i >> 8), byte(i)})
+}
+
+func changeSetsStorageKey(i int, slot byte) []byte {
+	return dbutils.GenerateCompositeStorageKey(changeSetsAddrHash(i), 1, crypto.Keccak256Hash([]byte{slot}))
+}
+
+func putChangeSetsAccount(tb testing.TB, db ethdb.Database, i int, balance uint64) {
+	a := accounts.Account{Initialised: true, Nonce: uint64(i), CodeHash: EmptyCodeHash, Incarnation: 1}
+	a.Balance.SetUint64(balance)
+	require.NoError(tb, writeAccount(db, changeSetsAddrHash(i), a))
+}
+
+func loadChangeSetsTrie(tb testing.TB, db ethdb.Database, rl RetainDecider) *Trie {
+	subTries, err := NewSubTrieLoader(0).LoadSubTries(db, 0, rl, nil /* HashCollector */, [][]byte{nil}, []int{0}, false)
+	require.NoError(tb, err)
+	tr := New(subTries.Hashes[0])
+	require.NoError(tb, tr.HookSubTries(subTries, [][]byte{nil}))
+	return tr
+}
+
+func TestUpdateFromChangeSets(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		putChangeSetsAccount(t, db, i, uint64(i))
+	}
+	for slot := byte(0); slot < 10; slot++ {
+		require.NoError(t, db.Put(dbutils.CurrentStateBucket, changeSetsStorageKey(0, slot), []byte{slot + 1}))
+	}
+
+	rl := NewRetainList(0)
+	rl.AddKey(changeSetsAddrHash(1).Bytes())
+	rl.AddKey(changeSetsAddrHash(2).Bytes())
+	rl.AddKey(changeSetsStorageKey(0, 3))
+	tr := loadChangeSetsTrie(t, db, rl)
+	rl.Rewind()
+
+	accountChanges, storageChanges := changeset.NewChangeSet(), changeset.NewChangeSet()
+	for _, i := range []int{1, 5, 7, 1000} {
+		require.NoError(t, accountChanges.Add(changeSetsAddrHash(i).Bytes(), nil))
+	}
+	putChangeSetsAccount(t, db, 1, 1001) // resolved in the cached trie
+	putChangeSetsAccount(t, db, 5, 1005) // not resolved in the cached trie
+	require.NoError(t, db.Delete(dbutils.CurrentStateBucket, changeSetsAddrHash(7).Bytes()))
+	putChangeSetsAccount(t, db, 1000, 1000) // new account
+	for _, slot := range []byte{3, 4} {
+		require.NoError(t, storageChanges.Add(changeSetsStorageKey(0, slot), nil))
+	}
+	require.NoError(t, db.Put(dbutils.CurrentStateBucket, changeSetsStorageKey(0, 3), []byte{0xff}))
+	require.NoError(t, db.Delete(dbutils.CurrentStateBucket, changeSetsStorageKey(0, 4)))
+
+	root, err := UpdateFromChangeSets(db, tr, accountChanges, storageChanges, rl)
+	require.NoError(t, err)
+	expected := loadChangeSetsTrie(t, db, NewRetainList(0)).Hash()
+	require.Equal(t, expected, root)
+	require.Equal(t, expected, tr.Hash())
+
+	acc, ok := tr.GetAccount(changeSetsAddrHash(5).Bytes())
+	require.True(t, ok, "changed account must be resolved")
+	require.Equal(t, uint64(1005), acc.Balance.Uint64())
+	acc, ok = tr.GetAccount(changeSetsAddrHash(2).Bytes())
+	require.True(t, ok, "unchanged cached account must stay resolved")
+	require.Equal(t, uint64(2), acc.Balance.Uint64())
+	acc, ok = tr.GetAccount(changeSetsAddrHash(7).Bytes())
+	require.True(t, ok)
+	require.Nil(t, acc)
+
+	// The changes outside of the cached structure widen the retain list
+	for _, key := range [][]byte{changeSetsAddrHash(5).Bytes(), changeSetsStorageKey(0, 4)} {
+		require.True(t, rl.Retain(keybytesToHex(key)[:2*len(key)]), "%x must be retained", key)
+	}
+}
+
+func BenchmarkUpdateFromChangeSets(b *testing.B) {
+	for _, size := range []int{10000, 50000} {
+		for _, changes := range []int{1, 10, 100} {
+			size, changes := size, changes
+			b.Run(fmt.Sprintf("accounts=%d/changes=%d", size, changes), func(b *testing.B) {
+				db := ethdb.NewMemDatabase()
+				defer db.Close()
+				for i := 0; i < size; i++ {
+					putChangeSetsAccount(b, db, i, uint64(i))
+				}
+				// Intermediate hashes of the subtries under the first byte of the key let the loader skip them
+				full := loadChangeSetsTrie(b, db, NewRetainAll(nil))
+				full.Hash()
+				for prefix := 0; prefix < 256; prefix++ {
+					nd, _, ok, _ := full.getNode([]byte{byte(prefix) >> 4, byte(prefix) & 0xf}, false)
+					if ok && nd != nil && len(nd.reference()) == common.HashLength {
+						require.NoError(b, db.Put(dbutils.IntermediateTrieHashBucket, []byte{byte(prefix)}, common.CopyBytes(nd.reference())))
+					}
+				}
+				tr := loadChangeSetsTrie(b, db, NewRetainList(0))
+
+				accountChanges := changeset.NewChangeSet()
+				for i := 0; i < changes; i++ {
+					account := i * (size / changes)
+					putChangeSetsAccount(b, db, account, uint64(size+i))
+					require.NoError(b, accountChanges.Add(changeSetsAddrHash(account).Bytes(), nil))
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := UpdateFromChangeSets(db, tr, accountChanges, nil, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
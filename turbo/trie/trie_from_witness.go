@@ -2,15 +2,46 @@ package trie
 
 import (
 	"fmt"
+	"io"
+	"math/bits"
 
 	"github.com/holiman/uint256"
 
 	"github.com/ledgerwatch/turbo-geth/turbo/rlphacks"
 )
 
+// BuildTrieFromWitness replays the operators of the witness on a hash builder and returns the resulting trie.
+// Branches with two children are represented by duoNode, like in the tries modified by updates.
+// A witness with an operator consuming more nodes than are available yields ErrTruncatedWitness.
 func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, error) {
-	hb := NewHashBuilder(false)
-	for _, operator := range witness.Operators {
+	next := 0
+	return buildTrieFromOperators(func() (WitnessOperator, error) {
+		if next == len(witness.Operators) {
+			return nil, io.EOF
+		}
+		next++
+		return witness.Operators[next-1], nil
+	}, isBinary, trace)
+}
+
+// BuildTrieFromWitnessStream is BuildTrieFromWitness for the operators decoded one by one from the stream
+func BuildTrieFromWitnessStream(reader *WitnessStreamReader, isBinary bool, trace bool) (*Trie, error) {
+	return buildTrieFromOperators(reader.Next, isBinary, trace)
+}
+
+func buildTrieFromOperators(next func() (WitnessOperator, error), isBinary bool, trace bool) (*Trie, error) {
+	hb := NewHashBuilder(trace)
+	for i := 0; ; i++ {
+		operator, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operator %d: %w", i, err)
+		}
+		if needed := witnessOperatorInputs(operator); needed > len(hb.nodeStack) {
+			return nil, &ErrTruncatedWitness{Index: i, Operator: fmt.Sprintf("%T", operator), Needed: needed, Available: len(hb.nodeStack)}
+		}
 		switch op := operator.(type) {
 		case *OperatorLeafValue:
 			if trace {
@@ -19,28 +50,33 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 			keyHex := op.Key
 			val := op.Value
 			if err := hb.leaf(len(op.Key), keyHex, rlphacks.RlpSerializableBytes(val)); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
 			}
 		case *OperatorExtension:
 			if trace {
 				fmt.Printf("EXTENSION ")
 			}
 			if err := hb.extension(op.Key); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
 			}
 		case *OperatorBranch:
 			if trace {
 				fmt.Printf("BRANCH ")
 			}
 			if err := hb.branch(uint16(op.Mask)); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
+			}
+			if bits.OnesCount32(op.Mask) == 2 {
+				if f, ok := hb.nodeStack[len(hb.nodeStack)-1].(*fullNode); ok {
+					hb.nodeStack[len(hb.nodeStack)-1] = f.duoCopy()
+				}
 			}
 		case *OperatorHash:
 			if trace {
 				fmt.Printf("HASH ")
 			}
 			if err := hb.hash(op.Hash[:]); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
 			}
 		case *OperatorCode:
 			if trace {
@@ -48,7 +84,7 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 			}
 
 			if err := hb.code(op.Code); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
 			}
 
 		case *OperatorLeafAccount:
@@ -59,11 +95,7 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 			balance.SetBytes(op.Balance.Bytes())
 			nonce := op.Nonce
 
-			// FIXME: probably not needed, fix hb.accountLeaf
-			fieldSet := uint32(3)
-			if op.HasCode && op.HasStorage {
-				fieldSet = 15
-			}
+			fieldSet := accountLeafFieldSet(op)
 
 			// Incarnation is always needed for a hashbuilder.
 			// but it is just our implementation detail needed for contract self-descruction suport with our
@@ -71,7 +103,7 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 			incarnation := uint64(0)
 
 			if err := hb.accountLeaf(len(op.Key), op.Key, balance, nonce, incarnation, fieldSet, int(op.CodeSize)); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("operator %d: %w", i, err)
 			}
 		case *OperatorEmptyRoot:
 			if trace {
@@ -79,7 +111,7 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 			}
 			hb.emptyRoot()
 		default:
-			return nil, fmt.Errorf("unknown operand type: %T", operator)
+			return nil, fmt.Errorf("operator %d: unknown operand type: %T", i, operator)
 		}
 	}
 	if trace {
@@ -101,3 +133,26 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, e
 	tr.root = r
 	return tr, nil
 }
+
+// accountLeafFieldSet returns the fields of the account leaf passed to the hash builder. The storage root
+// and the code hash are either both taken from the stack or both left empty
+func accountLeafFieldSet(op *OperatorLeafAccount) uint32 {
+	if op.HasCode && op.HasStorage {
+		return 15
+	}
+	return 3
+}
+
+// witnessOperatorInputs returns the number of nodes the operator takes from the stack of the hash builder
+func witnessOperatorInputs(operator WitnessOperator) int {
+	switch op := operator.(type) {
+	case *OperatorExtension:
+		return 1
+	case *OperatorBranch:
+		return bits.OnesCount32(op.Mask)
+	case *OperatorLeafAccount:
+		return bits.OnesCount32(accountLeafFieldSet(op) &^ 3)
+	default:
+		return 0
+	}
+}
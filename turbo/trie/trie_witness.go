@@ -18,6 +18,19 @@ func (t *Trie) ExtractWitnessForPrefix(prefix []byte, trace bool, rl RetainDecid
 	return extractWitnessFromRootNode(foundNode, trace, rl)
 }
 
+// ExtractWitnessTo is ExtractWitness which writes the witness operators into the stream writer instead of
+// collecting them in memory
+func (t *Trie) ExtractWitnessTo(out *WitnessStreamWriter, trace bool, rl RetainDecider) error {
+	builder := NewWitnessBuilder(t.root, trace)
+	var limiter *MerklePathLimiter = nil
+	if rl != nil {
+		hr := newHasher(false)
+		defer returnHasherToPool(hr)
+		limiter = &MerklePathLimiter{rl, hr.hash}
+	}
+	return builder.StreamTo(limiter, out)
+}
+
 // ExtractWitnesses extracts witnesses for subtries starting from the specified root
 // if retainDec param is nil it will make a witness for the full subtrie,
 // if retainDec param is set to a RetainList instance, it will make a witness for only the accounts/storages that were actually touched; other paths will be hashed.
@@ -69,73 +69,27 @@ func (w *Witness) WriteTo(out io.Writer) (*BlockWitnessStats, error) {
 }
 
 func NewWitnessFromReader(input io.Reader, trace bool) (*Witness, error) {
-	var header WitnessHeader
-	if err := header.LoadFrom(input); err != nil {
+	reader, err := NewWitnessStreamReader(input, trace)
+	if err != nil {
 		return nil, err
 	}
 
-	if header.Version != WitnessVersion {
-		return nil, fmt.Errorf("unexpected witness version: expected %d, got %d", WitnessVersion, header.Version)
-	}
-
-	operatorLoader := NewOperatorUnmarshaller(input)
-
-	opcode := make([]byte, 1)
-	var err error
 	operands := make([]WitnessOperator, 0)
-	for _, err = input.Read(opcode); ; _, err = input.Read(opcode) {
+	for {
+		op, err := reader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		var op WitnessOperator
-		switch OperatorKindCode(opcode[0]) {
-		case OpHash:
-			op = &OperatorHash{}
-		case OpLeaf:
-			op = &OperatorLeafValue{}
-		case OpAccountLeaf:
-			op = &OperatorLeafAccount{}
-		case OpCode:
-			op = &OperatorCode{}
-		case OpBranch:
-			op = &OperatorBranch{}
-		case OpEmptyRoot:
-			op = &OperatorEmptyRoot{}
-		case OpExtension:
-			op = &OperatorExtension{}
-		case OpNewTrie:
-			/* end of the current trie, end the function */
-			break
-		default:
-			return nil, fmt.Errorf("unexpected opcode while reading witness: %x", opcode[0])
-		}
-
-		if op == nil {
-			break
-		}
-
-		err = op.LoadFrom(operatorLoader)
-		if err != nil {
-			return nil, err
-		}
-
-		if trace {
-			fmt.Printf("read op %T -> %+v\n", op, op)
-		}
-
 		operands = append(operands, op)
 	}
 	if trace {
 		fmt.Println("end of read ***** ")
 	}
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
 
-	return &Witness{Header: header, Operators: operands}, nil
+	return &Witness{Header: reader.header, Operators: operands}, nil
 }
 
 func (w *Witness) WriteDiff(w2 *Witness, output io.Writer) {
@@ -18,6 +18,7 @@ type WitnessBuilder struct {
 	root     node
 	trace    bool
 	operands []WitnessOperator
+	stream   *WitnessStreamWriter // if set, operators are written into it instead of collected into operands
 }
 
 func NewWitnessBuilder(root node, trace bool) *WitnessBuilder {
@@ -35,6 +36,21 @@ func (b *WitnessBuilder) Build(limiter *MerklePathLimiter) (*Witness, error) {
 	return witness, err
 }
 
+// StreamTo writes the witness operators into the stream writer while traversing the trie, without keeping them
+func (b *WitnessBuilder) StreamTo(limiter *MerklePathLimiter, out *WitnessStreamWriter) error {
+	b.stream = out
+	defer func() { b.stream = nil }()
+	return b.makeBlockWitness(b.root, []byte{}, limiter, true)
+}
+
+func (b *WitnessBuilder) addOperator(op WitnessOperator) error {
+	if b.stream != nil {
+		return b.stream.WriteOperator(op)
+	}
+	b.operands = append(b.operands, op)
+	return nil
+}
+
 func (b *WitnessBuilder) addLeafOp(key []byte, value []byte) error {
 	if b.trace {
 		fmt.Printf("LEAF_VALUE: k %x v:%x\n", key, value)
@@ -49,8 +65,7 @@ func (b *WitnessBuilder) addLeafOp(key []byte, value []byte) error {
 		copy(op.Value[:], value)
 	}
 
-	b.operands = append(b.operands, &op)
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) addAccountLeafOp(key []byte, accountNode *accountNode, codeSize int) error {
@@ -73,9 +88,7 @@ func (b *WitnessBuilder) addAccountLeafOp(key []byte, accountNode *accountNode,
 
 	op.CodeSize = uint64(codeSize)
 
-	b.operands = append(b.operands, &op)
-
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) addExtensionOp(key []byte) error {
@@ -87,8 +100,7 @@ func (b *WitnessBuilder) addExtensionOp(key []byte) error {
 	op.Key = make([]byte, len(key))
 	copy(op.Key[:], key)
 
-	b.operands = append(b.operands, &op)
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) makeHashNode(n node, force bool, hashNodeFunc HashNodeFunc) (hashNode, error) {
@@ -112,8 +124,7 @@ func (b *WitnessBuilder) addHashOp(n hashNode) error {
 	var op OperatorHash
 	op.Hash = common.BytesToHash(n.hash)
 
-	b.operands = append(b.operands, &op)
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) addBranchOp(mask uint32) error {
@@ -124,8 +135,7 @@ func (b *WitnessBuilder) addBranchOp(mask uint32) error {
 	var op OperatorBranch
 	op.Mask = mask
 
-	b.operands = append(b.operands, &op)
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) addCodeOp(code []byte) error {
@@ -137,8 +147,7 @@ func (b *WitnessBuilder) addCodeOp(code []byte) error {
 	op.Code = make([]byte, len(code))
 	copy(op.Code, code)
 
-	b.operands = append(b.operands, &op)
-	return nil
+	return b.addOperator(&op)
 }
 
 func (b *WitnessBuilder) addEmptyRoot() error {
@@ -146,8 +155,7 @@ func (b *WitnessBuilder) addEmptyRoot() error {
 		fmt.Printf("EMPTY ROOT\n")
 	}
 
-	b.operands = append(b.operands, &OperatorEmptyRoot{})
-	return nil
+	return b.addOperator(&OperatorEmptyRoot{})
 }
 
 func (b *WitnessBuilder) processAccountCode(n *accountNode, retainDec RetainDecider) (int, error) {
@@ -2,6 +2,7 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -81,3 +82,54 @@ func TestBlockWitnessBinaryAccount(t *testing.T) {
 		t.Errorf("received account is not equal to the initial one")
 	}
 }
+
+func TestBlockWitnessDuoNode(t *testing.T) {
+	tr := New(common.Hash{})
+	tr.Update([]byte("ABCD0001"), []byte("val1"))
+	tr.Update([]byte("ABCE0002"), []byte("val2"))
+
+	rl := NewRetainList(0)
+	rl.AddKey([]byte("ABCD0001"))
+	rl.AddKey([]byte("ABCE0002"))
+
+	bwb := NewWitnessBuilder(tr.root, false)
+
+	hr := newHasher(false)
+	defer returnHasherToPool(hr)
+
+	w, err := bwb.Build(&MerklePathLimiter{rl, hr.hash})
+	if err != nil {
+		t.Fatalf("Could not make block witness: %v", err)
+	}
+
+	tr1, err := BuildTrieFromWitness(w, false /*is-binary*/, false /*trace*/)
+	if err != nil {
+		t.Fatalf("Could not restore trie from the block witness: %v", err)
+	}
+	if tr.Hash() != tr1.Hash() {
+		t.Errorf("Reconstructed block witness has different root hash than source trie")
+	}
+	if n, ok := tr1.root.(*shortNode); !ok {
+		t.Errorf("expected extension at the root, got %T", tr1.root)
+	} else if _, ok := n.Val.(*duoNode); !ok {
+		t.Errorf("expected duoNode under the extension, got %T", n.Val)
+	}
+
+	for key, expected := range map[string][]byte{"ABCD0001": []byte("val1"), "ABCE0002": []byte("val2")} {
+		got, _ := tr1.Get([]byte(key))
+		if !bytes.Equal(got, expected) {
+			t.Errorf("unexpected value for %s: %x (expected %x)", key, got, expected)
+		}
+	}
+
+	// Without the first leaf, the branch does not have enough children on the stack
+	w.Operators = w.Operators[1:]
+	_, err = BuildTrieFromWitness(w, false /*is-binary*/, false /*trace*/)
+	var truncated *ErrTruncatedWitness
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected truncated witness error, got %v", err)
+	}
+	if truncated.Index != 1 || truncated.Needed != 2 || truncated.Available != 1 {
+		t.Errorf("unexpected error %v", truncated)
+	}
+}
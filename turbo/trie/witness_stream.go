@@ -0,0 +1,104 @@
+package trie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrWitnessSizeExceeded is returned by WitnessStreamWriter when the encoded witness grows over the size limit
+var ErrWitnessSizeExceeded = errors.New("witness size limit exceeded")
+
+// WitnessStreamWriter encodes witness operators into the output as soon as they are produced,
+// so that the witness of a large subtrie does not need to be kept in memory
+// IMPORTANT: not thread-safe! use from a single thread only
+type WitnessStreamWriter struct {
+	marshaller *OperatorMarshaller
+	limit      uint64 // 0 means no limit
+}
+
+// NewWitnessStreamWriter writes the witness header into the output. If limit is not 0, writing an operator
+// which takes the size of the witness over the limit fails with ErrWitnessSizeExceeded
+func NewWitnessStreamWriter(out io.Writer, limit uint64) (*WitnessStreamWriter, error) {
+	s := &WitnessStreamWriter{marshaller: NewOperatorMarshaller(out), limit: limit}
+	header := defaultWitnessHeader()
+	if err := header.WriteTo(s.marshaller); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *WitnessStreamWriter) WriteOperator(op WitnessOperator) error {
+	if err := op.WriteTo(s.marshaller); err != nil {
+		return err
+	}
+	if s.limit != 0 && s.marshaller.total > s.limit {
+		return fmt.Errorf("%w: %d > %d", ErrWitnessSizeExceeded, s.marshaller.total, s.limit)
+	}
+	return nil
+}
+
+// Stats returns the sizes of the parts of the witness written so far
+func (s *WitnessStreamWriter) Stats() *BlockWitnessStats {
+	return s.marshaller.GetStats()
+}
+
+// WitnessStreamReader decodes witness operators from the input one by one
+type WitnessStreamReader struct {
+	input  io.Reader
+	loader *OperatorUnmarshaller
+	header WitnessHeader
+	trace  bool
+}
+
+// NewWitnessStreamReader reads and checks the witness header
+func NewWitnessStreamReader(input io.Reader, trace bool) (*WitnessStreamReader, error) {
+	r := &WitnessStreamReader{input: input, trace: trace}
+	if err := r.header.LoadFrom(input); err != nil {
+		return nil, err
+	}
+	if r.header.Version != WitnessVersion {
+		return nil, fmt.Errorf("unexpected witness version: expected %d, got %d", WitnessVersion, r.header.Version)
+	}
+	r.loader = NewOperatorUnmarshaller(input)
+	return r, nil
+}
+
+// Next returns the next operator of the witness, or io.EOF when the input or the current trie ends
+func (r *WitnessStreamReader) Next() (WitnessOperator, error) {
+	opcode := make([]byte, 1)
+	if _, err := r.input.Read(opcode); err != nil {
+		return nil, err
+	}
+	var op WitnessOperator
+	switch OperatorKindCode(opcode[0]) {
+	case OpHash:
+		op = &OperatorHash{}
+	case OpLeaf:
+		op = &OperatorLeafValue{}
+	case OpAccountLeaf:
+		op = &OperatorLeafAccount{}
+	case OpCode:
+		op = &OperatorCode{}
+	case OpBranch:
+		op = &OperatorBranch{}
+	case OpEmptyRoot:
+		op = &OperatorEmptyRoot{}
+	case OpExtension:
+		op = &OperatorExtension{}
+	case OpNewTrie:
+		/* end of the current trie */
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("unexpected opcode while reading witness: %x", opcode[0])
+	}
+
+	if err := op.LoadFrom(r.loader); err != nil {
+		return nil, err
+	}
+
+	if r.trace {
+		fmt.Printf("read op %T -> %+v\n", op, op)
+	}
+	return op, nil
+}
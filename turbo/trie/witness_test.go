@@ -2,8 +2,11 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"math/rand"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -94,3 +97,68 @@ func TestWitnessSerialization(t *testing.T) {
 		t.Errorf("witnesses not equal: expected %+v; got %+v", expectedWitness, decodedWitness)
 	}
 }
+
+func TestWitnessStream(t *testing.T) {
+	tr := New(common.Hash{})
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		key := make([]byte, 32)
+		value := make([]byte, 256)
+		rnd.Read(key)
+		rnd.Read(value)
+		tr.Update(key, value)
+	}
+
+	expected, err := tr.ExtractWitness(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expectedBuffer bytes.Buffer
+	expectedStats, err := expected.WriteTo(&expectedBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewWitnessStreamWriter(&buffer, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.ExtractWitnessTo(writer, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	stats := writer.Stats()
+	if stats.BlockWitnessSize() < 2*1024*1024 || stats.BlockWitnessSize() != uint64(buffer.Len()) {
+		t.Errorf("unexpected witness size %d (buffer %d)", stats.BlockWitnessSize(), buffer.Len())
+	}
+	if !bytes.Equal(buffer.Bytes(), expectedBuffer.Bytes()) {
+		t.Errorf("streamed witness differs from the serialized one")
+	}
+	if stats.LeafValuesSize() != expectedStats.LeafValuesSize() || stats.HashesSize() != expectedStats.HashesSize() || stats.CodesSize() != expectedStats.CodesSize() {
+		t.Errorf("unexpected stats %+v, expected %+v", stats, expectedStats)
+	}
+
+	reader, err := NewWitnessStreamReader(&buffer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr1, err := BuildTrieFromWitnessStream(reader, false /*is-binary*/, false /*trace*/)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := BuildTrieFromWitness(expected, false /*is-binary*/, false /*trace*/)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr1.Hash() != tr.Hash() || tr2.Hash() != tr.Hash() {
+		t.Errorf("unexpected root hashes %x (streamed), %x (in memory), expected %x", tr1.Hash(), tr2.Hash(), tr.Hash())
+	}
+
+	writer, err = NewWitnessStreamWriter(ioutil.Discard, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.ExtractWitnessTo(writer, false, nil); !errors.Is(err, ErrWitnessSizeExceeded) {
+		t.Errorf("expected witness size to be exceeded, got %v", err)
+	}
+}